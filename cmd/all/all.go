@@ -1,10 +1,48 @@
 package all
 
 import (
+	_ "github.com/sagan/goaider/cmd/anonymize"
+	_ "github.com/sagan/goaider/cmd/audiostats"
+	_ "github.com/sagan/goaider/cmd/augment"
 	_ "github.com/sagan/goaider/cmd/caption"
+	_ "github.com/sagan/goaider/cmd/captions"
+	_ "github.com/sagan/goaider/cmd/cluster"
 	_ "github.com/sagan/goaider/cmd/crop"
+	_ "github.com/sagan/goaider/cmd/datasetinit"
+	_ "github.com/sagan/goaider/cmd/describevideo"
+	_ "github.com/sagan/goaider/cmd/detectwatermark"
+	_ "github.com/sagan/goaider/cmd/editcaptions"
+	_ "github.com/sagan/goaider/cmd/embed"
+	_ "github.com/sagan/goaider/cmd/export"
+	_ "github.com/sagan/goaider/cmd/filteraudio"
+	_ "github.com/sagan/goaider/cmd/filtersubject"
+	_ "github.com/sagan/goaider/cmd/flushqueue"
+	_ "github.com/sagan/goaider/cmd/inpaint"
+	_ "github.com/sagan/goaider/cmd/inspectmodel"
+	_ "github.com/sagan/goaider/cmd/labelstudio"
+	_ "github.com/sagan/goaider/cmd/models"
 	_ "github.com/sagan/goaider/cmd/norfilenames"
+	_ "github.com/sagan/goaider/cmd/normalizecolors"
+	_ "github.com/sagan/goaider/cmd/normalizetext"
+	_ "github.com/sagan/goaider/cmd/ocr"
+	_ "github.com/sagan/goaider/cmd/pack"
+	_ "github.com/sagan/goaider/cmd/pairframes"
 	_ "github.com/sagan/goaider/cmd/parsetfef"
+	_ "github.com/sagan/goaider/cmd/polishcaptions"
+	_ "github.com/sagan/goaider/cmd/pushhub"
+	_ "github.com/sagan/goaider/cmd/regimages"
+	_ "github.com/sagan/goaider/cmd/review"
+	_ "github.com/sagan/goaider/cmd/run"
+	_ "github.com/sagan/goaider/cmd/scoretranscripts"
+	_ "github.com/sagan/goaider/cmd/search"
 	_ "github.com/sagan/goaider/cmd/sovits-genlist"
+	_ "github.com/sagan/goaider/cmd/splitchannels"
 	_ "github.com/sagan/goaider/cmd/stt"
+	_ "github.com/sagan/goaider/cmd/subtitlealign"
+	_ "github.com/sagan/goaider/cmd/sync"
+	_ "github.com/sagan/goaider/cmd/tagdrift"
+	_ "github.com/sagan/goaider/cmd/thumbs"
+	_ "github.com/sagan/goaider/cmd/tts"
+	_ "github.com/sagan/goaider/cmd/verifyimages"
+	_ "github.com/sagan/goaider/cmd/verifyspeaker"
 )
@@ -0,0 +1,349 @@
+package anonymize
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/util"
+)
+
+// Region labels, the values of --targets
+const (
+	targetFaces  = "faces"
+	targetPlates = "plates"
+)
+
+const (
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	// JPEG quality of the images (and the --subject photo) sent to the API
+	uploadQuality = 90
+
+	// Rough token counts of a detection request, used for the pre-flight estimate
+	detectPromptTokens = 200
+	detectOutputTokens = 100
+
+	// Padding of a detected region on each side (relative to its size), as the boxes of the model are loose
+	regionPadding = 0.1
+)
+
+// The prompt lines of each target
+var targetPrompts = map[string]string{
+	targetFaces:  `- "face": the face of every person other than %s (bystanders, passers-by, people in the background), including small, partly visible and side faces.`,
+	targetPlates: `- "plate": every vehicle license plate.`,
+}
+
+const detectPrompt = `Detect the regions of this image to anonymize before publishing it in a dataset:
+%s
+Return the bounding box of each region as "box_2d": [ymin, xmin, ymax, xmax], normalized to 0-1000.
+Return an empty list if there is none.`
+
+var detectSchema = &gemini.Schema{
+	Type: "ARRAY",
+	Items: &gemini.Schema{
+		Type: "OBJECT",
+		Properties: map[string]*gemini.Schema{
+			"label":  {Type: "STRING", Description: `"face" or "plate"`},
+			"box_2d": {Type: "ARRAY", Items: &gemini.Schema{Type: "INTEGER"}},
+		},
+		Required: []string{"label", "box_2d"},
+	},
+}
+
+// region is a detected region to blur.
+type region struct {
+	Label string `json:"label"`
+	Box   []int  `json:"box_2d"` // [ymin, xmin, ymax, xmax], normalized to 0-1000
+}
+
+var (
+	flagDir           string
+	flagOutputDir     string
+	flagSubject       string
+	flagTargets       []string
+	flagStrength      float64
+	flagModel         string
+	flagForce         bool
+	flagYes           bool
+	flagMaxFiles      int
+	flagUploadMaxSize int
+	flagApiKeysFile   string
+	flagMaxRetryDur   time.Duration
+	flagTimeout       time.Duration
+	flagTimeoutPerMB  time.Duration
+	fileFilter        util.FileFilter
+)
+
+var anonymizeCmd = &cobra.Command{
+	Use:   "anonymize [image]...",
+	Short: "Blur the faces of bystanders and the license plates in the images of a dataset",
+	Long: `Anonymize the images of a dataset before publishing it: the faces of people other than
+the subject (bystanders, people in the background) and the vehicle license plates are detected
+by the Gemini API and blurred. Requires the GEMINI_API_KEY environment variable to be set.
+
+By default, the faces of all people except the main subject of each photo are blurred.
+Set --subject to the path of a reference photo of the subject, whose face is then kept
+in all images, and the faces of all other people are blurred.
+
+Anonymized images (.jpg, .jpeg, .png) are saved to the --output dir with the same file names,
+including the images where nothing was detected. Output images are re-encoded without metadata
+(e.g. the EXIF GPS location of photos). Detection is not perfect: review the output before publishing.
+Instead of --dir, image files can be given as arguments to anonymize only them.`,
+	RunE: anonymize,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(anonymizeCmd)
+	anonymizeCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	anonymizeCmd.Flags().StringVar(&flagOutputDir, "output", "", `Optional: Output dir. default to "<input-dir>-anonymized"`)
+	anonymizeCmd.Flags().StringVar(&flagSubject, "subject", "", "Optional: Path of a reference photo of the subject, whose face is not blurred. default: the main subject of each photo")
+	anonymizeCmd.Flags().StringSliceVar(&flagTargets, "targets", []string{targetFaces, targetPlates}, "Optional: Comma-separated regions to blur: "+targetFaces+", "+targetPlates)
+	anonymizeCmd.Flags().Float64Var(&flagStrength, "strength", 10, "Optional: Blur strength: the blur radius in percentage of the size of a region")
+	anonymizeCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_MODEL, "Optional: The Gemini model to use")
+	anonymizeCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing output files")
+	anonymizeCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Optional: Start without asking for confirmation of the pre-flight summary")
+	anonymizeCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Optional: Abort if the number of images to process exceeds this limit. 0 = unlimited")
+	anonymizeCmd.Flags().IntVar(&flagUploadMaxSize, "upload-max-size", 2048, "Optional: Downscale images whose longest side exceeds this (pixels) before sending to the API. Output images are not downscaled. 0 = disable")
+	anonymizeCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Optional: Path of a file of Gemini API keys (one per line), rotated among requests")
+	anonymizeCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Optional: Max total time spent on one image including retries. 0 = unlimited")
+	anonymizeCmd.Flags().DurationVar(&flagTimeout, "timeout", 60*time.Second, "Optional: Base timeout of a single API request. 0 = no timeout")
+	anonymizeCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 5*time.Second, "Optional: Additional API request timeout per MB of payload")
+	fileFilter.AddFlags(anonymizeCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(anonymizeCmd.Flags(), "dir")
+	cmd.SetPromptDefault(anonymizeCmd.Flags(), "dir", ".")
+}
+
+func anonymize(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if len(flagTargets) == 0 {
+		return errs.New(errs.ExitConfig, "--targets must not be empty")
+	}
+	for _, target := range flagTargets {
+		if targetPrompts[target] == "" {
+			return errs.New(errs.ExitConfig, "invalid --targets %q, expect %s or %s", target, targetFaces, targetPlates)
+		}
+	}
+	if flagStrength <= 0 {
+		return errs.New(errs.ExitConfig, "invalid --strength %v: must be positive", flagStrength)
+	}
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return err
+	}
+	var subject *gemini.InlineData
+	if flagSubject != "" {
+		img, _, err := util.LoadImage(flagSubject)
+		if err != nil {
+			return errs.New(errs.ExitConfig, "failed to load --subject image: %w", err)
+		}
+		if subject, err = gemini.NewImageData(img, flagUploadMaxSize, uploadQuality); err != nil {
+			return err
+		}
+	}
+	output := flagOutputDir
+	if output == "" {
+		inputDir := flagDir
+		if len(args) > 0 {
+			inputDir = filepath.Dir(args[0])
+		}
+		absDir, err := filepath.Abs(inputDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path %s: %w", inputDir, err)
+		}
+		output = absDir + "-anonymized"
+	}
+
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []util.InputFile
+	skippedCnt := 0
+	estimate := &util.UsageEstimate{ImageMaxSide: flagUploadMaxSize}
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		if !flagForce && util.OutputUpToDate(file.Path, filepath.Join(output, file.Name()), false) {
+			skippedCnt++
+			continue
+		}
+		images = append(images, file)
+		var size int64
+		if info, err := file.Info(); err == nil {
+			size = info.Size()
+		}
+		estimate.AddImage(file.Path, size, detectPromptTokens, detectOutputTokens)
+	}
+	if estimate.Files > 0 {
+		if err := cmd.CheckModel(keys, "", flagModel); err != nil {
+			return err
+		}
+	}
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, 0); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(util.LongPath(output), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	fmt.Printf("Anonymizing %d images (%d up to date) into %q\n", len(images), skippedCnt, output)
+
+	client := &gemini.Client{
+		HTTPClient:   &http.Client{},
+		Keys:         keys,
+		Timeout:      flagTimeout,
+		TimeoutPerMB: flagTimeoutPerMB,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+			MaxDuration: flagMaxRetryDur,
+		},
+	}
+	errorCnt, regionCnt := 0, 0
+	for _, file := range images {
+		regions, err := anonymizeImage(client, file.Path, filepath.Join(output, file.Name()), subject)
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				return fmt.Errorf("run aborted: %w", err)
+			}
+			continue
+		}
+		regionCnt += len(regions)
+		if len(regions) == 0 {
+			fmt.Printf("✅ %s: nothing to blur\n", file.Name())
+		} else {
+			fmt.Printf("✅ %s: blurred %s\n", file.Name(), countLabels(regions))
+		}
+	}
+	fmt.Printf("Done. %d regions blurred in %d images, %d failed\n", regionCnt, len(images)-errorCnt, errorCnt)
+	return errs.RunResult(len(images), errorCnt)
+}
+
+// anonymizeImage detects the regions to blur of the image at inputPath, and saves the image with them blurred
+// to outputPath. It returns the blurred regions.
+func anonymizeImage(client *gemini.Client, inputPath string, outputPath string,
+	subject *gemini.InlineData) ([]*region, error) {
+	img, _, err := util.LoadImage(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	regions, err := detectRegions(client, img, subject)
+	if err != nil {
+		return nil, err
+	}
+	nrgba := imaging.Clone(img)
+	for _, r := range regions {
+		blurRegion(nrgba, r)
+	}
+	format, err := imaging.FormatFromFilename(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	return regions, util.WriteAtomic(outputPath, func(w io.Writer) error {
+		return imaging.Encode(w, nrgba, format, imaging.JPEGQuality(95))
+	})
+}
+
+// detectRegions detects the regions of --targets of img using the Gemini API.
+// subject is the reference photo of the subject (--subject), or nil.
+func detectRegions(client *gemini.Client, img image.Image, subject *gemini.InlineData) ([]*region, error) {
+	data, err := gemini.NewImageData(img, flagUploadMaxSize, uploadQuality)
+	if err != nil {
+		return nil, err
+	}
+	subjectDesc := "the main subject of the photo"
+	var parts []gemini.Part
+	if subject != nil {
+		subjectDesc = "the subject (the person of the reference photo)"
+		parts = append(parts, gemini.Part{Text: "Reference photo of the subject:"}, gemini.Part{InlineData: subject},
+			gemini.Part{Text: "The image to anonymize:"})
+	}
+	var lines []string
+	for _, target := range flagTargets {
+		prompt := targetPrompts[target]
+		if target == targetFaces {
+			prompt = fmt.Sprintf(prompt, subjectDesc)
+		}
+		lines = append(lines, prompt)
+	}
+	parts = append(parts, gemini.Part{InlineData: data},
+		gemini.Part{Text: fmt.Sprintf(detectPrompt, strings.Join(lines, "\n"))})
+	text, err := client.GenerateText(context.Background(), flagModel, &gemini.Request{
+		Contents: []gemini.Content{{Parts: parts}},
+		GenerationConfig: &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   detectSchema,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var regions []*region
+	if err := json.Unmarshal([]byte(text), &regions); err != nil {
+		return nil, fmt.Errorf("invalid detection response %q: %w", text, err)
+	}
+	// Drop malformed boxes and the labels of other targets
+	return slices.DeleteFunc(regions, func(r *region) bool {
+		return len(r.Box) != 4 || r.Box[0] >= r.Box[2] || r.Box[1] >= r.Box[3] ||
+			!slices.Contains(flagTargets, r.Label+"s")
+	}), nil
+}
+
+// blurRegion blurs the region (with padding) of img in place.
+func blurRegion(img *image.NRGBA, r *region) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	x0, x1 := float64(r.Box[1])*float64(width)/1000, float64(r.Box[3])*float64(width)/1000
+	y0, y1 := float64(r.Box[0])*float64(height)/1000, float64(r.Box[2])*float64(height)/1000
+	padX, padY := (x1-x0)*regionPadding, (y1-y0)*regionPadding
+	rect := image.Rect(int(x0-padX), int(y0-padY), int(x1+padX), int(y1+padY)).Intersect(img.Bounds())
+	if rect.Empty() {
+		return
+	}
+	sigma := float64(max(rect.Dx(), rect.Dy())) * flagStrength / 100
+	draw.Draw(img, rect, imaging.Blur(imaging.Crop(img, rect), sigma), image.Point{}, draw.Src)
+}
+
+// countLabels returns the counts of the labels of regions, e.g. "2 faces, 1 plate".
+func countLabels(regions []*region) string {
+	var parts []string
+	for _, target := range flagTargets {
+		label := strings.TrimSuffix(target, "s")
+		count := 0
+		for _, r := range regions {
+			if r.Label == label {
+				count++
+			}
+		}
+		if count == 1 {
+			parts = append(parts, "1 "+label)
+		} else if count > 1 {
+			parts = append(parts, fmt.Sprintf("%d %s", count, target))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,277 @@
+package audiostats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// Samples at or above this absolute level count as clipped
+	clipLevel = 0.999
+	// A run of at least this many consecutive clipped samples of a channel marks the file as clipping
+	clipRun = 3
+	// Length of the analysis windows of speech detection
+	speechWindow = 30 * time.Millisecond
+)
+
+var (
+	flagDir         string
+	flagMinDuration time.Duration
+	flagMaxDuration time.Duration
+	flagSilenceDb   float64
+	fileFilter      util.FileFilter
+)
+
+var audioStatsCmd = &cobra.Command{
+	Use:   "audio-stats",
+	Short: "Report audio metadata statistics of a directory of audio files",
+	Long: `Report the audio metadata statistics of a directory of audio files:
+duration distribution, sample rates, channels, bit depths, clipping and total speech hours.
+
+Only .wav files are analyzed; other audio files are counted as unsupported.
+Speech is estimated as the total length of 30ms windows louder than --silence-db.
+
+It warns about clips outside the GPT-SoVITS recommended duration range (--min-duration to --max-duration,
+default 3-10s), and clipping files (3 or more consecutive samples at full scale).`,
+	RunE: audioStats,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(audioStatsCmd)
+	audioStatsCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Directory containing audio files")
+	audioStatsCmd.Flags().DurationVar(&flagMinDuration, "min-duration", 3*time.Second, "Warn about clips shorter than this")
+	audioStatsCmd.Flags().DurationVar(&flagMaxDuration, "max-duration", 10*time.Second, "Warn about clips longer than this")
+	audioStatsCmd.Flags().Float64Var(&flagSilenceDb, "silence-db", -40, "Windows quieter than this level (dBFS) are not counted as speech")
+	fileFilter.AddFlags(audioStatsCmd.Flags())
+	audioStatsCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(audioStatsCmd.Flags(), "dir", ".")
+}
+
+// audioStat is the analysis result of an audio file.
+type audioStat struct {
+	name     string
+	info     *util.WavInfo
+	duration float64 // seconds
+	speech   float64 // seconds
+	clipped  int     // number of clipped samples
+	clipping bool
+}
+
+func audioStats(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	entries, err := os.ReadDir(util.LongPath(flagDir))
+	if err != nil {
+		return err
+	}
+	var stats []*audioStat
+	var unsupported []string
+	errorCnt := 0
+	total := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !fileFilter.Match(entry) {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		switch ext {
+		case ".wav":
+		case ".mp3", ".m4a", ".flac", ".ogg", ".opus", ".aac":
+			unsupported = append(unsupported, entry.Name())
+			continue
+		default:
+			continue
+		}
+		total++
+		stat, err := analyze(filepath.Join(flagDir, entry.Name()))
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", entry.Name(), err)
+			errorCnt++
+			continue
+		}
+		stats = append(stats, stat)
+	}
+	if len(unsupported) > 0 {
+		fmt.Printf("%d non-wav audio files are not analyzed (%s)\n", len(unsupported), summarize(unsupported))
+	}
+	if len(stats) == 0 {
+		fmt.Printf("No wav file analyzed in %s\n", flagDir)
+		return errs.RunResult(total, errorCnt)
+	}
+	printReport(stats)
+	return errs.RunResult(total, errorCnt)
+}
+
+// analyze reads the header and all samples of the wav file at path.
+func analyze(path string) (*audioStat, error) {
+	info, err := util.ReadWavInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	stat := &audioStat{name: filepath.Base(path), info: info, duration: info.Duration()}
+	decode, err := info.SampleDecoder()
+	if err != nil {
+		// Duration and format are still reported
+		return stat, nil
+	}
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(info.DataOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(io.LimitReader(f, info.DataSize), 1<<16)
+
+	sampleSize := int(info.BitsPerSample / 8)
+	channels := int(info.Channels)
+	frame := make([]byte, info.BlockAlign)
+	runs := make([]int, channels)
+	windowFrames := max(1, int(float64(info.SampleRate)*speechWindow.Seconds()))
+	silence := math.Pow(10, flagSilenceDb/20)
+	var windowSum float64
+	windowCnt := 0
+	speechFrames := 0
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		for ch := 0; ch < channels && (ch+1)*sampleSize <= len(frame); ch++ {
+			v := decode(frame[ch*sampleSize : (ch+1)*sampleSize])
+			windowSum += v * v
+			if math.Abs(v) >= clipLevel {
+				stat.clipped++
+				runs[ch]++
+				if runs[ch] >= clipRun {
+					stat.clipping = true
+				}
+			} else {
+				runs[ch] = 0
+			}
+		}
+		windowCnt++
+		if windowCnt == windowFrames {
+			if math.Sqrt(windowSum/float64(windowCnt*channels)) >= silence {
+				speechFrames += windowCnt
+			}
+			windowSum, windowCnt = 0, 0
+		}
+	}
+	if windowCnt > 0 && math.Sqrt(windowSum/float64(windowCnt*channels)) >= silence {
+		speechFrames += windowCnt
+	}
+	stat.speech = float64(speechFrames) / float64(info.SampleRate)
+	return stat, nil
+}
+
+func printReport(stats []*audioStat) {
+	durations := make([]float64, len(stats))
+	var totalDuration, totalSpeech float64
+	sampleRates := map[string]int{}
+	channels := map[string]int{}
+	formats := map[string]int{}
+	for i, stat := range stats {
+		durations[i] = stat.duration
+		totalDuration += stat.duration
+		totalSpeech += stat.speech
+		sampleRates[fmt.Sprintf("%d Hz", stat.info.SampleRate)]++
+		channels[fmt.Sprintf("%d ch", stat.info.Channels)]++
+		formats[stat.info.FormatName()]++
+	}
+	sort.Float64s(durations)
+
+	fmt.Printf("Files: %d\n", len(stats))
+	fmt.Printf("Total duration: %.2f h (%.1f s)\n", totalDuration/3600, totalDuration)
+	fmt.Printf("Total speech:   %.2f h (%.1f s, %.0f%%)\n", totalSpeech/3600, totalSpeech,
+		100*totalSpeech/max(totalDuration, 1e-9))
+	fmt.Printf("Duration (s): min %.2f, median %.2f, mean %.2f, max %.2f\n", durations[0],
+		durations[len(durations)/2], totalDuration/float64(len(durations)), durations[len(durations)-1])
+	bounds := []float64{1, 3, 5, 10, 20, 30}
+	counts := make([]int, len(bounds)+1)
+	for _, d := range durations {
+		counts[sort.SearchFloat64s(bounds, d+1e-9)]++
+	}
+	for i, count := range counts {
+		label := ""
+		switch {
+		case i == 0:
+			label = fmt.Sprintf("< %gs", bounds[0])
+		case i == len(bounds):
+			label = fmt.Sprintf(">= %gs", bounds[i-1])
+		default:
+			label = fmt.Sprintf("%g-%gs", bounds[i-1], bounds[i])
+		}
+		fmt.Printf("  %-7s %5d %s\n", label, count, strings.Repeat("█", (count*40+len(stats)-1)/len(stats)))
+	}
+	printCounts("Sample rates", sampleRates)
+	printCounts("Channels", channels)
+	printCounts("Sample formats", formats)
+
+	var outOfRange, clipping []*audioStat
+	for _, stat := range stats {
+		if stat.duration < flagMinDuration.Seconds() || stat.duration > flagMaxDuration.Seconds() {
+			outOfRange = append(outOfRange, stat)
+		}
+		if stat.clipping {
+			clipping = append(clipping, stat)
+		}
+	}
+	if len(outOfRange) > 0 {
+		fmt.Printf("⚠️ %d clips are outside the recommended duration range (%v-%v):\n", len(outOfRange),
+			flagMinDuration, flagMaxDuration)
+		for _, stat := range outOfRange {
+			fmt.Printf("  %s (%.2fs)\n", stat.name, stat.duration)
+		}
+	}
+	if len(clipping) > 0 {
+		fmt.Printf("⚠️ %d clips are clipping:\n", len(clipping))
+		for _, stat := range clipping {
+			fmt.Printf("  %s (%d clipped samples)\n", stat.name, stat.clipped)
+		}
+	}
+}
+
+// printCounts prints the counts of values, most common first.
+func printCounts(title string, counts map[string]int) {
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	slices.SortFunc(values, func(a, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return strings.Compare(a, b)
+	})
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%s: %d", value, counts[value])
+	}
+	fmt.Printf("%s: %s\n", title, strings.Join(parts, ", "))
+}
+
+// summarize returns the first few names, e.g. "a.mp3, b.mp3, ...".
+func summarize(names []string) string {
+	if len(names) > 3 {
+		return strings.Join(names[:3], ", ") + ", ..."
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,267 @@
+package augment
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir        string
+	flagOutputDir  string
+	flagFlip       bool
+	flagRotate     []int
+	flagJitter     float64
+	flagSeed       uint64
+	flagSwapRules  string
+	flagCaptionExt string
+	flagForce      bool
+	flagProgress   bool
+	fileFilter     util.FileFilter
+)
+
+// Suffixes of augmented copies, e.g. "foo_flip.jpg", "foo_rot-10.jpg". Images with them are not augmented again.
+var augmentedRegexp = regexp.MustCompile(`_(flip|rot-?\d+|jitter)$`)
+
+// defaultSwapRules are the tag swaps of flipped captions if --swap-rules is not set.
+var defaultSwapRules = [][2]string{{"left", "right"}}
+
+var augmentCmd = &cobra.Command{
+	Use:   "augment [image]...",
+	Short: "Generate flipped / rotated / color jittered copies of images with their captions",
+	Long: `Generate augmented copies of the images (.jpg, .jpeg, .png) of a dir, for small datasets:
+horizontally flipped copies (--flip, default), rotated copies (--rotate) and color jittered copies (--jitter).
+Copies are saved as "<name>_flip.jpg", "<name>_rot10.jpg", "<name>_jitter.jpg"... in --output (default: the dir
+itself), and the caption file of each image is duplicated for its copies. In the captions of flipped copies,
+"left" and "right" are swapped (see --swap-rules).
+
+Instead of --dir, image files can be given as arguments to augment only them.`,
+	RunE: augment,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(augmentCmd)
+	augmentCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	augmentCmd.Flags().StringVar(&flagOutputDir, "output", "", "Optional: Output dir of the copies. default: the dir of each image")
+	augmentCmd.Flags().BoolVar(&flagFlip, "flip", true, "Optional: Generate horizontally flipped copies")
+	augmentCmd.Flags().IntSliceVar(&flagRotate, "rotate", nil, `Optional: Comma-separated angles (degrees, counter-clockwise) of rotated copies, e.g. "-10,10". The copies keep the original size, uncovered corners are black`)
+	augmentCmd.Flags().Float64Var(&flagJitter, "jitter", 0, "Optional: Generate a color jittered copy, with brightness, contrast and saturation randomly changed by up to this fraction (e.g. 0.1 = ±10%). 0 = disable")
+	augmentCmd.Flags().Uint64Var(&flagSeed, "seed", 0, "Optional: Random seed of --jitter, for reproducible copies. 0 = random")
+	augmentCmd.Flags().StringVar(&flagSwapRules, "swap-rules", "", `Optional: Path of a file of the caption word swaps of flipped copies, one "<word> = <word>" pair per line. default: "left = right"`)
+	augmentCmd.Flags().StringVar(&flagCaptionExt, "caption-ext", ".txt", "Optional: Extension of the caption files")
+	augmentCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing copies")
+	augmentCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar instead of per-image lines. Ignored if stdout is not a terminal")
+	fileFilter.AddFlags(augmentCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(augmentCmd.Flags(), "dir")
+	cmd.SetPromptDefault(augmentCmd.Flags(), "dir", ".")
+}
+
+// variant is an augmented copy of an image.
+type variant struct {
+	suffix    string
+	transform func(img image.Image) image.Image
+	// Apply the swap rules to the caption
+	swap bool
+}
+
+func augment(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagJitter < 0 || flagJitter >= 1 {
+		return errs.New(errs.ExitConfig, "--jitter must be in [0, 1)")
+	}
+	captionExt, err := util.ParseOutputExt(flagCaptionExt, ".txt")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	swapRules := defaultSwapRules
+	if flagSwapRules != "" {
+		if swapRules, err = loadSwapRules(flagSwapRules); err != nil {
+			return errs.New(errs.ExitConfig, "failed to load --swap-rules file: %w", err)
+		}
+	}
+	seed := flagSeed
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	random := rand.New(rand.NewPCG(seed, seed))
+
+	var variants []*variant
+	if flagFlip {
+		variants = append(variants, &variant{suffix: "_flip", transform: func(img image.Image) image.Image {
+			return imaging.FlipH(img)
+		}, swap: true})
+	}
+	for _, angle := range flagRotate {
+		if angle%360 == 0 {
+			continue
+		}
+		variants = append(variants, &variant{suffix: "_rot" + strconv.Itoa(angle), transform: func(img image.Image) image.Image {
+			rotated := imaging.Rotate(img, float64(angle), color.Black)
+			return imaging.CropCenter(rotated, img.Bounds().Dx(), img.Bounds().Dy())
+		}})
+	}
+	if flagJitter > 0 {
+		variants = append(variants, &variant{suffix: "_jitter", transform: func(img image.Image) image.Image {
+			factor := func() float64 { return (random.Float64()*2 - 1) * flagJitter * 100 }
+			img = imaging.AdjustBrightness(img, factor())
+			img = imaging.AdjustContrast(img, factor())
+			return imaging.AdjustSaturation(img, factor())
+		}})
+	}
+	if len(variants) == 0 {
+		return errs.New(errs.ExitConfig, "no augmentation set (--flip, --rotate or --jitter)")
+	}
+
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !cropper.IsImageFile(name) || !fileFilter.Match(file) ||
+			augmentedRegexp.MatchString(strings.TrimSuffix(name, filepath.Ext(name))) {
+			continue
+		}
+		images = append(images, file.Path)
+	}
+	if flagOutputDir != "" {
+		if err := os.MkdirAll(util.LongPath(flagOutputDir), 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	fmt.Printf("Augmenting %d images (%d copies each)\n", len(images), len(variants))
+	progress := util.NewProgress(len(images), flagProgress)
+	generatedCnt, skippedCnt, errorCnt := 0, 0, 0
+	for _, imagePath := range images {
+		progress.Start(filepath.Base(imagePath))
+		generated, skipped, err := augmentImage(imagePath, variants, captionExt, swapRules)
+		generatedCnt += generated
+		skippedCnt += skipped
+		progress.Done(err != nil)
+		if err != nil {
+			progress.Printf("❌ %s: %v\n", filepath.Base(imagePath), err)
+			errorCnt++
+		} else if !progress.Enabled {
+			fmt.Printf("✅ %s: %d copies\n", filepath.Base(imagePath), generated)
+		}
+	}
+	progress.Finish()
+	fmt.Printf("Done. %d copies generated, %d existing skipped, %d images failed\n", generatedCnt, skippedCnt, errorCnt)
+	return errs.RunResult(len(images), errorCnt)
+}
+
+// augmentImage generates the variants of the image and their captions.
+// It returns the number of generated and skipped (existing) copies.
+func augmentImage(imagePath string, variants []*variant, captionExt string,
+	swapRules [][2]string) (generated int, skipped int, err error) {
+	outputDir := flagOutputDir
+	if outputDir == "" {
+		outputDir = filepath.Dir(imagePath)
+	}
+	ext := filepath.Ext(imagePath)
+	base := strings.TrimSuffix(filepath.Base(imagePath), ext)
+	caption, err := os.ReadFile(util.LongPath(captioner.CaptionFilePath(imagePath, captionExt)))
+	hasCaption := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, fmt.Errorf("failed to read caption: %w", err)
+	}
+	var img image.Image
+	for _, v := range variants {
+		outputPath := filepath.Join(outputDir, base+v.suffix+ext)
+		if !flagForce && util.OutputUpToDate(imagePath, outputPath, false) {
+			skipped++
+			continue
+		}
+		if img == nil {
+			if img, _, err = util.LoadImage(imagePath); err != nil {
+				return generated, skipped, err
+			}
+		}
+		if err := saveImage(v.transform(img), outputPath); err != nil {
+			return generated, skipped, err
+		}
+		if hasCaption {
+			text := string(caption)
+			if v.swap {
+				text = swapWords(text, swapRules)
+			}
+			if err := util.WriteFileAtomic(captioner.CaptionFilePath(outputPath, captionExt), []byte(text)); err != nil {
+				return generated, skipped, fmt.Errorf("failed to write caption: %w", err)
+			}
+		}
+		generated++
+	}
+	return generated, skipped, nil
+}
+
+func saveImage(img image.Image, outputPath string) error {
+	format, err := imaging.FormatFromFilename(outputPath)
+	if err != nil {
+		return err
+	}
+	return util.WriteAtomic(outputPath, func(w io.Writer) error {
+		return imaging.Encode(w, img, format, imaging.JPEGQuality(95))
+	})
+}
+
+// loadSwapRules reads the "<word> = <word>" pairs of a swap rules file.
+func loadSwapRules(path string) ([][2]string, error) {
+	lines, err := util.ReadListFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules [][2]string
+	for _, line := range lines {
+		a, b, ok := strings.Cut(line, "=")
+		a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+		if !ok || a == "" || b == "" {
+			return nil, fmt.Errorf("invalid line %q, expect \"<word> = <word>\"", line)
+		}
+		rules = append(rules, [2]string{a, b})
+	}
+	return rules, nil
+}
+
+// swapWords swaps the words of each rule in text (whole words, case-insensitive),
+// e.g. "left hand" => "right hand". The capitalization of the first letter is kept.
+func swapWords(text string, rules [][2]string) string {
+	swaps := map[string]string{}
+	var words []string
+	for _, rule := range rules {
+		swaps[strings.ToLower(rule[0])] = rule[1]
+		swaps[strings.ToLower(rule[1])] = rule[0]
+		words = append(words, regexp.QuoteMeta(rule[0]), regexp.QuoteMeta(rule[1]))
+	}
+	re := regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+	return re.ReplaceAllStringFunc(text, func(word string) string {
+		swapped := swaps[strings.ToLower(word)]
+		if first, _ := utf8.DecodeRuneInString(word); unicode.IsUpper(first) {
+			r, size := utf8.DecodeRuneInString(swapped)
+			swapped = string(unicode.ToUpper(r)) + swapped[size:]
+		}
+		return swapped
+	})
+}
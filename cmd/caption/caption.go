@@ -1,13 +1,13 @@
 package caption
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -15,311 +15,719 @@ import (
 
 	"github.com/sagan/goaider/cmd"
 	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/notify"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/provider"
+	"github.com/sagan/goaider/queue"
+	"github.com/sagan/goaider/util"
 )
 
-// --- Structs for Gemini API Request ---
-
-type GeminiRequest struct {
-	Contents []Content `json:"contents"`
-}
-
-type Content struct {
-	Role  string `json:"role"`
-	Parts []Part `json:"parts"`
-}
-
-type Part struct {
-	Text       string      `json:"text,omitempty"`
-	InlineData *InlineData `json:"inlineData,omitempty"`
-}
-
-type InlineData struct {
-	MimeType string `json:"mimeType"`
-	Data     string `json:"data"`
-}
-
-// --- Structs for Gemini API Response ---
-
-type GeminiResponse struct {
-	Candidates []Candidate `json:"candidates"`
-}
-
-type Candidate struct {
-	Content Content `json:"content"`
-}
-
 // --- API and Program Constants ---
 
 const (
-	// This prompt is optimized for LoRa training captions
-	captionPrompt = `Generate a simple, comma-separated caption for this image, optimized for LoRa training.
-
-RULES:
-1.  Focus ONLY on the main subject.
-2.  Describe visible attributes: clothing (e.g., "pink jacket"), hairstyle (e.g., "ponytail"), pose (e.g., "crouching", "standing"), and expression (e.g., "smiling").
-3.  You can describe an object that the main subject is interacting with (e.g., "holding a toy").
+	maxRetries  = 3               // Number of retries for API calls
+	baseBackoff = 2 * time.Second // Initial retry delay
 
-CRITICAL:
-* DO NOT use general category words like "girl", "boy", "child", "woman", "man", or "person".
-* DO NOT describe the background, environment, or location (e.g., AVOID "in a room", "child's room", "indoor", "outside", "at home").
-* DO NOT describe artistic style, lighting, camera quality, or effects.
-
-Good example: "pink puffer jacket, ponytail, hair clips, crouching, holding toy".
-
-Bad example: "young girl, pink puffer jacket, fur collar, black pants, slippers, pink bunny hair clips, ponytail, pink bobbles, crouching, holding a pink plastic toy, child's room, pink desk, pink chair, toys, curtains, wooden floor".
-"
-`
+	// Rough token counts of a caption request, used for the pre-flight estimate
+	captionPromptTokens = 400
+	captionOutputTokens = 60
+)
 
-	maxRetries = 3 // Number of retries for API calls
+var (
+	banWords []*captioner.BanWord
+	// Rules of --identity-map
+	identityRules []*identityRule
+	// Images whose captions still contain banned words (or are not in --caption-lang) after all regenerations
+	flaggedImages []string
+	// Where status messages are printed. Stderr in --stdin mode, where stdout is the caption
+	logOut io.Writer = os.Stdout
+	// Backup of the overwritten captions of this run. nil if --no-backup is set
+	backup *util.Backup
+	// Extension of the caption files (--output-ext)
+	outputExt string
+	// The known facts of the images of --metadata-csv. nil if it's not set
+	metadataFacts *metadataTable
 )
 
 // Flag variables to store command line arguments
 var (
-	flagDir      string
-	flagForce    bool
-	flagIdentity string
-	flagModel    string
+	flagDir            string
+	flagForce          bool
+	flagChangedOnly    bool
+	flagIdentity       string
+	flagIdentityMap    string
+	flagStripWords     []string
+	flagRecursive      bool
+	flagClassToken     string
+	flagClassTokenPos  int
+	flagModel          string
+	flagYes            bool
+	flagMaxRetryDur    time.Duration
+	flagTimeout        time.Duration
+	flagTimeoutPerMB   time.Duration
+	flagUploadMaxSize  int
+	flagUploadQuality  int
+	flagNotify         []string
+	flagApiKeysFile    string
+	flagApiURL         string
+	flagMaxTags        int
+	flagMaxChars       int
+	flagMetadata       bool
+	flagBanWords       string
+	flagBanRetries     int
+	flagMaxFiles       int
+	flagMaxSize        int
+	flagStdin          bool
+	flagProgress       bool
+	flagNoBackup       bool
+	flagMoveCorrupt    bool
+	flagOutputExt      string
+	flagBOM            bool
+	flagQueueOnly      bool
+	flagProvider       string
+	flagPrompt         string
+	flagCaptionLang    string
+	flagMimeType       string
+	flagUseExif        bool
+	flagExifFields     []string
+	flagExifTo         []string
+	flagUseCropDir     string
+	flagRetryFailed    bool
+	flagFallback       []string
+	flagBatchSize      int
+	flagContextCaption bool
+	flagMetadataCSV    string
+	flagTemplate       string
+	fileFilter         util.FileFilter
+	sampling           gemini.Sampling
 )
 
 var captionCmd = &cobra.Command{
-	Use:   "caption",
+	Use:   "caption [image]...",
 	Short: "Generate captions for images in a directory",
-	Long:  `This command generates captions for all images in a specified directory using the Gemini API.`,
-	RunE:  caption,
+	Long: `This command generates captions for all images in a specified directory using the Gemini API.
+
+Instead of --dir, image files can be given as arguments to caption only them,
+e.g. to quickly test a prompt on a single image.
+
+Pipe mode (--stdin): read the image from stdin and write the caption to stdout
+(the metadata JSON in --metadata mode), e.g.:
+  cat foo.jpg | goaider caption --stdin --mime-type image/jpeg`,
+	RunE: caption,
 }
 
 func init() {
 	cmd.RootCmd.AddCommand(captionCmd)
 	// Refactored to use Var functions to bind flags to package-level variables
-	captionCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the image directory")
+	captionCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
 	captionCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Force re-generation of all captions, even if .txt files exist")
+	captionCmd.Flags().BoolVar(&flagChangedOnly, "changed-only", false, "Optional: Also re-generate captions of images modified after their .txt files")
+	captionCmd.MarkFlagsMutuallyExclusive("force", "changed-only")
 	captionCmd.Flags().StringVar(&flagIdentity, "identity", "", "Optional: The trigger word (e.g., 'foobar' or 'photo of foobar') to prepend to each caption")
+	captionCmd.Flags().StringVar(&flagIdentityMap, "identity-map", "", `Optional: Path of a file mapping folders or "/regexp/" patterns of image paths to identities (one "<pattern> = <identity>" per line), for datasets of multiple characters. Images matching no pattern use --identity`)
+	captionCmd.Flags().StringSliceVar(&flagStripWords, "strip-class-words", captioner.DefaultClassWords, `Optional: Comma-separated class words removed from the generated caption (alone or after the trigger word, e.g. "foobar girl") when an identity is set, as they duplicate it. The identity itself is always removed. "" = none`)
+	captionCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also caption the images in the subdirectories of --dir (except hidden ones)")
+	captionCmd.Flags().StringVar(&flagClassToken, "class-token", "", "Optional: A class word (e.g., '1girl' or 'person') to insert into each caption, skipped if the caption already has it")
+	captionCmd.Flags().IntVar(&flagClassTokenPos, "class-token-pos", -1, "Optional: 0-based tag position in the generated caption to insert the class token at. -1 = append to the end")
+	captionCmd.Flags().StringVar(&flagCaptionLang, "caption-lang", "", `Optional: Language of the captions, e.g. "Chinese" or "zh" (for Hunyuan / Kolors training). Captions not in the script of the language are regenerated (up to --ban-words-retries times) and then flagged. default: English`)
+	captionCmd.Flags().StringVar(&flagPrompt, "prompt", "", "Optional: Custom prompt of the model, replacing the default one (optimized for LoRA training tags)")
 	captionCmd.Flags().StringVarP(&flagModel, "model", "", constants.DEFAULT_GEMINI_MODEL, "The model to use for captioning")
-
-	captionCmd.MarkFlagRequired("dir")
+	captionCmd.Flags().StringVar(&flagProvider, "provider", provider.GEMINI, "Optional: The model backend. Available: "+strings.Join(provider.CaptionProviders(), ", "))
+
+	captionCmd.Flags().IntVar(&flagBatchSize, "batch-size", 1, "Optional: Number of images captioned in one request (with a structured response of the caption of each image), to reduce the request count of rate-limited accounts. Can not be used with --metadata, --max-tags, --max-chars, --use-exif, --metadata-csv, --queue-only or --stdin")
+	captionCmd.Flags().BoolVar(&flagContextCaption, "context-caption", false, "Optional: Include the caption of the previous image of the same folder (or the folder's "+captioner.StyleContextFile+" style context file if it exists) in the prompt, to keep the tags consistent across a series of related images. Can not be used with --batch-size or --stdin")
+	captionCmd.Flags().StringVar(&flagMetadataCSV, "metadata-csv", "", `Optional: Path of a CSV file of the known facts of the images: a header row of column names (e.g. "file,outfit,location,episode") and a row of each image, whose "file" column (or the first one) is its path relative to --dir or its file name. The facts are given to the model as authoritative hints. Can not be used with --batch-size or --stdin`)
+	captionCmd.Flags().StringVar(&flagTemplate, "caption-template", "", `Optional: Template of the final caption merging the --metadata-csv columns with the generated tags, e.g. "{outfit}, {location}, {tags}". "{tags}" is the generated tags; empty and duplicate tags are removed. The identity is still prepended`)
+	captionCmd.Flags().StringSliceVar(&flagFallback, "fallback", nil, `Optional: Comma-separated fallback chain of "[<provider>:]<model>" (e.g. "gemini-2.0-flash,ollama:llava:13b"), tried in order when the previous one fails for an image with an exhausted quota or a safety block. The provider defaults to --provider`)
+	captionCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Optional: Start without asking for confirmation of the pre-flight summary")
+	captionCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Optional: Abort if the number of images to caption exceeds this limit. 0 = unlimited")
+	captionCmd.Flags().IntVar(&flagMaxSize, "max-size", 0, "Optional: Abort if the total size of the images to caption exceeds this limit (MiB). 0 = unlimited")
+	captionCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Optional: Max total time spent on one image including retries, after which it's skipped as failed. 0 = unlimited")
+	captionCmd.Flags().DurationVar(&flagTimeout, "timeout", 45*time.Second, "Optional: Base timeout of a single API request. 0 = no timeout")
+	captionCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 5*time.Second, "Optional: Additional API request timeout per MB of payload")
+	captionCmd.Flags().IntVar(&flagUploadMaxSize, "upload-max-size", 1536, "Optional: Downscale images whose longest side exceeds this (pixels) before sending to the API. Files on disk are not modified. 0 = disable")
+	captionCmd.Flags().StringVar(&flagUseCropDir, "use-crop-dir", "", `Optional: Dir of the cropped images (e.g. "<dir>-crop" of the crop command). The cropped image of the same name (relative path) is sent to the API instead of the original, so the caption matches what the trainer sees. Captions are still saved next to the originals. Images without a cropped one are sent as is`)
+	captionCmd.Flags().IntVar(&flagUploadQuality, "upload-quality", 85, "Optional: JPEG quality (1-100) of downscaled images sent to the API")
+	captionCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Optional: Path of a file of Gemini API keys (one per line), rotated among requests")
+	captionCmd.Flags().StringVar(&flagApiURL, "api-url", "", `Optional: Base url of the Gemini API, e.g. of a proxy or gateway ("https://<host>[/<path>]/v1beta"). default: the `+constants.ENV_GEMINI_API_URL+` env, or the official API`)
+	captionCmd.Flags().IntVar(&flagMaxTags, "max-tags", 0, "Optional: Max number of tags generated by the model (enforced via structured output). 0 = unlimited")
+	captionCmd.Flags().IntVar(&flagMaxChars, "max-chars", 0, "Optional: Max length (in chars) of the final caption, trailing tags are dropped to fit. 0 = unlimited")
+	captionCmd.Flags().BoolVar(&flagMetadata, "metadata", false, "Optional: Request structured metadata (subject, clothing, pose, expression, objects...) and also save it to a .json sidecar file")
+	captionCmd.Flags().StringVar(&flagBanWords, "ban-words", "", "Optional: Path of a file of banned terms (one per line). A caption containing any of them is regenerated with an amended prompt")
+	captionCmd.Flags().IntVar(&flagBanRetries, "ban-words-retries", 2, "Optional: Max regenerations of a caption containing banned terms (or not in --caption-lang), after which the image is flagged")
+	captionCmd.Flags().BoolVar(&flagQueueOnly, "queue-only", false, "Optional: Only prepare the API requests and save them to the queue (in "+queue.QUEUE_DIR+"/) without network access, to be sent later by flush-queue")
+	captionCmd.Flags().StringVar(&flagOutputExt, "output-ext", ".txt", `Optional: Extension of the caption files, e.g. ".caption" or ".tags"`)
+	captionCmd.Flags().BoolVar(&flagBOM, "bom", false, "Optional: Write the caption files with the UTF-8 BOM, for Windows tools that expect it")
+	captionCmd.Flags().BoolVar(&flagMoveCorrupt, "move-corrupt", false, "Optional: Move the corrupt images found by the pre-scan (zero-byte, truncated or unreadable) to the "+util.CORRUPT_DIR+" folder next to them")
+	captionCmd.Flags().BoolVar(&flagNoBackup, "no-backup", false, "Optional: Do not back up existing captions (to "+util.BACKUPS_DIR+"/<time>/) before overwriting them")
+	captionCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar (done/total, ETA, throughput, errors) instead of per-image lines. Ignored if stdout is not a terminal")
+	captionCmd.Flags().BoolVar(&flagStdin, "stdin", false, "Optional: Pipe mode: read the image from stdin and write the caption to stdout. Requires --mime-type")
+	captionCmd.Flags().StringVar(&flagMimeType, "mime-type", "", `Optional: MIME type of the --stdin image, e.g. "image/jpeg"`)
+	captionCmd.Flags().BoolVar(&flagUseExif, "use-exif", false, "Optional: Read the EXIF metadata of images and use the --exif-fields as caption hints")
+	captionCmd.Flags().StringSliceVar(&flagExifFields, "exif-fields", []string{util.EXIF_CAMERA, util.EXIF_LENS, util.EXIF_DATE, util.EXIF_ORIENTATION}, "Optional: Comma-separated EXIF fields used by --use-exif: "+strings.Join(util.EXIF_FIELDS, ", ")+`. "gps" (the capture location) must be set explicitly`)
+	captionCmd.Flags().StringSliceVar(&flagExifTo, "exif-to", []string{"prompt"}, `Optional: Where --use-exif puts the EXIF fields: "prompt" (as hints to the model) and / or "metadata" (the .json sidecar of --metadata)`)
+	cmd.AddRetryFailedFlag(captionCmd.Flags(), &flagRetryFailed, "caption")
+	notify.AddFlag(captionCmd.Flags(), &flagNotify)
+	fileFilter.AddFlags(captionCmd.Flags())
+	sampling.AddFlags(captionCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(captionCmd.Flags(), "dir", "stdin")
+	cmd.SetPromptDefault(captionCmd.Flags(), "dir", ".")
 }
 
-func caption(cmd *cobra.Command, args []string) error {
-	// 1. Get API Key from environment
-	apiKey := os.Getenv(constants.ENV_GEMINI_API_KEY)
-	if apiKey == "" {
-		return fmt.Errorf("GEMINI_API_KEY environment variable not set")
+func caption(_ *cobra.Command, args []string) error {
+	var err error
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if err := sampling.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagApiURL, err = gemini.ResolveAPIURL(flagApiURL); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	logOut = os.Stdout
+	if flagStdin {
+		if len(args) > 0 || flagDir != "" || flagQueueOnly {
+			return errs.New(errs.ExitConfig, "--stdin can not be used with --dir, file args or --queue-only")
+		}
+		if flagMimeType == "" {
+			return errs.New(errs.ExitConfig, "--mime-type flag is required in --stdin mode")
+		}
+		logOut = os.Stderr
+	}
+
+	// 1. Create the provider (get API Key from environment) and its fallback chain. Not needed in --queue-only mode
+	var p, primary provider.CaptionProvider
+	fallbacks, err := provider.ParseFallbacks(flagFallback, flagProvider)
+	if err != nil {
+		return err
+	}
+	if flagQueueOnly {
+		if flagProvider != provider.GEMINI {
+			return errs.New(errs.ExitConfig, "--queue-only requires the %s provider", provider.GEMINI)
+		}
+		if len(fallbacks) > 0 {
+			return errs.New(errs.ExitConfig, "--fallback can not be used with --queue-only")
+		}
+	} else {
+		config := &provider.Config{
+			APIKeysFile:  flagApiKeysFile,
+			APIURL:       flagApiURL,
+			Timeout:      flagTimeout,
+			TimeoutPerMB: flagTimeoutPerMB,
+			Retry: util.RetryPolicy{
+				MaxRetries:  maxRetries,
+				BaseBackoff: baseBackoff,
+				MaxDuration: flagMaxRetryDur,
+			},
+			Log: logOut,
+		}
+		if primary, err = provider.NewCaption(flagProvider, config); err != nil {
+			return err
+		}
+		p = primary
+		if len(fallbacks) > 0 {
+			if p, err = provider.NewCaptionChain(flagProvider+":"+flagModel, primary, fallbacks, config); err != nil {
+				return err
+			}
+		}
 	}
 
-	// 3. Read the specified directory
-	files, err := os.ReadDir(flagDir)
+	identityRules = nil
+	if flagIdentityMap != "" {
+		if identityRules, err = loadIdentityMap(flagIdentityMap); err != nil {
+			return errs.New(errs.ExitConfig, "failed to load --identity-map file: %w", err)
+		}
+	}
+	if flagClassToken != "" {
+		identities := []string{flagIdentity}
+		for _, rule := range identityRules {
+			identities = append(identities, rule.identity)
+		}
+		for _, identity := range identities {
+			if strings.EqualFold(strings.TrimSpace(flagClassToken), strings.TrimSpace(identity)) {
+				return errs.New(errs.ExitConfig, "--class-token must be different from the identities")
+			}
+		}
+	}
+
+	if outputExt, err = util.ParseOutputExt(flagOutputExt, ".txt", ".json"); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	banWords = nil
+	flaggedImages = nil
+	backup = nil
+	if !flagNoBackup {
+		backup = util.NewBackup()
+	}
+	if flagBanWords != "" {
+		if banWords, err = captioner.LoadBanWords(flagBanWords); err != nil {
+			return errs.New(errs.ExitConfig, "failed to load --ban-words file: %w", err)
+		}
+	}
+	if flagMaxTags < 0 || flagMaxChars < 0 {
+		return errs.New(errs.ExitConfig, "--max-tags and --max-chars must not be negative")
+	}
+	if flagUploadQuality < 1 || flagUploadQuality > 100 {
+		return errs.New(errs.ExitConfig, "invalid --upload-quality %d: must be in 1-100", flagUploadQuality)
+	}
+	if flagBatchSize < 1 {
+		return errs.New(errs.ExitConfig, "invalid --batch-size %d: must be positive", flagBatchSize)
+	}
+	if flagBatchSize > 1 && (flagMetadata || flagMaxTags > 0 || flagMaxChars > 0 || flagUseExif ||
+		flagMetadataCSV != "" || flagQueueOnly || flagStdin) {
+		return errs.New(errs.ExitConfig,
+			"--batch-size can not be used with --metadata, --max-tags, --max-chars, --use-exif, --metadata-csv, --queue-only or --stdin")
+	}
+	if flagContextCaption && (flagBatchSize > 1 || flagStdin) {
+		return errs.New(errs.ExitConfig, "--context-caption can not be used with --batch-size or --stdin")
+	}
+	metadataFacts = nil
+	if flagMetadataCSV != "" {
+		if flagStdin {
+			return errs.New(errs.ExitConfig, "--metadata-csv can not be used with --stdin")
+		}
+		if metadataFacts, err = loadMetadataCSV(flagMetadataCSV); err != nil {
+			return errs.New(errs.ExitConfig, "failed to load --metadata-csv file: %w", err)
+		}
+	}
+	if flagTemplate != "" {
+		if metadataFacts == nil {
+			return errs.New(errs.ExitConfig, "--caption-template requires --metadata-csv")
+		}
+		for _, field := range captioner.TemplateFields(flagTemplate) {
+			if field != captioner.TemplateTagsField && !slices.Contains(metadataFacts.columns, field) {
+				return errs.New(errs.ExitConfig, "invalid --caption-template field {%s}: not a column of --metadata-csv (%s)",
+					field, strings.Join(metadataFacts.columns, ", "))
+			}
+		}
+	}
+	if flagUseCropDir != "" {
+		if flagStdin {
+			return errs.New(errs.ExitConfig, "--use-crop-dir can not be used with --stdin")
+		}
+		if info, err := os.Stat(util.LongPath(flagUseCropDir)); err != nil || !info.IsDir() {
+			return errs.New(errs.ExitConfig, "invalid --use-crop-dir %q: not a dir", flagUseCropDir)
+		}
+	}
+	if flagUseExif {
+		for _, field := range flagExifFields {
+			if !slices.Contains(util.EXIF_FIELDS, field) {
+				return errs.New(errs.ExitConfig, "invalid --exif-fields field %q", field)
+			}
+		}
+		for _, to := range flagExifTo {
+			if to != "prompt" && to != "metadata" {
+				return errs.New(errs.ExitConfig, "invalid --exif-to %q", to)
+			}
+		}
+		if slices.Contains(flagExifTo, "metadata") && !flagMetadata {
+			return errs.New(errs.ExitConfig, `--exif-to "metadata" requires --metadata`)
+		}
+	}
+
+	if flagStdin {
+		return captionStdin(p)
+	}
+	// In progress bar mode, only failures are printed (above the bar)
+	showProgress := flagProgress && util.IsTerminal(os.Stdout)
+	if showProgress {
+		logOut = io.Discard
+	}
+
+	// 3. Read the specified directory (or the failed files of the last run)
+	if flagRetryFailed {
+		if args, err = cmd.LoadFailedFiles(flagDir, "caption", args); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			fmt.Printf("No failed image of the last run in %s\n", flagDir)
+			return nil
+		}
+		fmt.Printf("Retrying %d failed images of the last run\n", len(args))
+	}
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, args)
 	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", flagDir, err)
+		return err
 	}
 
-	fmt.Printf("Starting captioning for images in: %s\n", flagDir)
+	if len(args) > 0 {
+		fmt.Printf("Starting captioning for %d images\n", len(files))
+	} else {
+		fmt.Printf("Starting captioning for images in: %s\n", flagDir)
+	}
 	if flagForce {
 		fmt.Printf("FORCE flag set: Re-generating all captions.\n")
 	}
-	if flagIdentity != "" {
+	if len(identityRules) > 0 {
+		fmt.Printf("IDENTITY MAP set: Prepending the identities of %d rules to new captions.\n", len(identityRules))
+	}
+	if flagIdentity != "" && len(identityRules) > 0 {
+		fmt.Printf("IDENTITY set: Prepending %q to new captions of images matching no --identity-map rule.\n", flagIdentity)
+	} else if flagIdentity != "" {
 		fmt.Printf("IDENTITY set: Prepending %q to all new captions.\n", flagIdentity)
 	}
+	if flagClassToken != "" {
+		fmt.Printf("CLASS TOKEN set: Inserting %q to all new captions.\n", flagClassToken)
+	}
 
-	// Create an HTTP client with a timeout
-	client := &http.Client{Timeout: 45 * time.Second}
-
-	errorCnt := 0
-	// 4. Loop over all files and process images
+	// 4. Collect images and estimate the API usage of those to be captioned
+	var imagePaths []string
+	var corruptFiles []*cmd.CorruptFile
+	skippedCnt := 0
+	estimate := &util.UsageEstimate{ImageMaxSide: flagUploadMaxSize, BatchSize: flagBatchSize}
+	previousImages = map[string]string{}
+	lastImages := map[string]string{} // the last image of each folder
 	for _, file := range files {
-		if file.IsDir() || !isImageFile(file.Name()) {
-			continue // Skip directories and non-image files
+		if file.IsDir() || !captioner.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue // Skip directories, non-image and filtered out files
+		}
+		fullPath := file.Path
+		previousImages[fullPath] = lastImages[filepath.Dir(fullPath)]
+		lastImages[filepath.Dir(fullPath)] = fullPath
+		if !flagForce && util.OutputUpToDate(fullPath, captioner.CaptionFilePath(fullPath, outputExt), flagChangedOnly) {
+			fmt.Fprintf(logOut, "Processing %s: ⏩ SKIPPED (caption already exists)\n", file.Name())
+			skippedCnt++
+			continue
+		}
+		// Pre-scan: exclude corrupt images before any API call
+		if err := util.CheckMediaFile(fullPath); err != nil {
+			corruptFiles = append(corruptFiles, &cmd.CorruptFile{Path: fullPath, Err: err})
+			continue
+		}
+		imagePaths = append(imagePaths, fullPath)
+		uploadPath := cropImagePath(fullPath)
+		var size int64
+		if info, err := os.Stat(util.LongPath(uploadPath)); err == nil {
+			size = info.Size()
 		}
+		estimate.AddImage(uploadPath, size, captionPromptTokens, captionOutputTokens)
+	}
+	cmd.ReportCorruptFiles(corruptFiles, flagMoveCorrupt)
+	if metadataFacts != nil {
+		missing := 0
+		for _, imagePath := range imagePaths {
+			if metadataFacts.facts(imagePath) == nil {
+				missing++
+			}
+		}
+		if missing > 0 {
+			fmt.Printf("Warning: %d of %d images to caption have no row in --metadata-csv\n", missing, len(imagePaths))
+		}
+	}
+	if g, ok := primary.(*provider.Gemini); ok && estimate.Files > 0 {
+		if err := cmd.CheckModel(g.Client.Keys, g.Client.APIURL, flagModel); err != nil {
+			return err
+		}
+	}
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, flagMaxSize); err != nil {
+		return err
+	}
 
-		fullPath := filepath.Join(flagDir, file.Name())
+	summary := &notify.Summary{
+		Command: "caption",
+		Dir:     flagDir,
+		Total:   len(imagePaths) + skippedCnt,
+		Skipped: skippedCnt,
+	}
+	start := time.Now()
 
-		// processImage does all the work: API call, retries, and file saving
-		err := processImage(client, fullPath, apiKey, flagForce, flagIdentity)
-		if err != nil {
-			fmt.Printf("Processing %s: ❌ FAILED (%v)\n", file.Name(), err)
-			errorCnt++
+	progress := util.NewProgress(len(imagePaths), showProgress)
+	errorCnt := 0
+	var fatalErr error
+	failed := &cmd.FailedFiles{}
+	// 5. Loop over all images (in batches of --batch-size) and process them
+	for start := 0; start < len(imagePaths) && fatalErr == nil; start += flagBatchSize {
+		batch := imagePaths[start:min(start+flagBatchSize, len(imagePaths))]
+		progress.Start(filepath.Base(batch[0]))
+		var batchErrs []error
+		if len(batch) == 1 {
+			// processImage does all the work: API call, retries, and file saving
+			batchErrs = []error{processImage(p, batch[0], flagForce, flagOptions(batch[0]))}
+		} else {
+			batchErrs = processBatch(p, batch)
+		}
+		for i, err := range batchErrs {
+			fullPath := batch[i]
+			progress.Done(err != nil)
+			if err != nil {
+				progress.Printf("Processing %s: ❌ FAILED (%v)\n", filepath.Base(fullPath), err)
+				errorCnt++
+				failed.Add(fullPath, err)
+				// All remaining requests would fail the same way
+				if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+					fatalErr = err
+					// The remaining images are retried by --retry-failed too
+					for _, remaining := range imagePaths[start+i+1:] {
+						failed.Add(remaining, fmt.Errorf("not processed, run aborted: %w", err))
+					}
+					break
+				}
+			} else {
+				summary.Succeeded++
+			}
 		}
 	}
-	fmt.Printf("Captioning complete.\n")
-	if errorCnt > 0 {
-		return fmt.Errorf("%d errors", errorCnt)
+	progress.Finish()
+	failed.Save(cmd.InputDir(flagDir, args), "caption")
+	if flagQueueOnly {
+		fmt.Printf("Queued %d requests. Run \"goaider flush-queue\" to send them.\n", summary.Succeeded)
+	} else {
+		fmt.Printf("Captioning complete.\n")
 	}
-	return nil
+	if len(flaggedImages) > 0 {
+		fmt.Printf("%d images flagged for review (caption contains banned words or is in the wrong language):\n", len(flaggedImages))
+		for _, imagePath := range flaggedImages {
+			fmt.Printf("  %s\n", imagePath)
+		}
+	}
+	summary.Failed = errorCnt
+	summary.Duration = time.Since(start)
+	if fatalErr != nil {
+		summary.Error = fatalErr.Error()
+	}
+	notify.Send(flagNotify, summary)
+	cmd.RecordFiles(summary.Total, summary.Succeeded, summary.Skipped, summary.Failed)
+	if fatalErr != nil {
+		return fmt.Errorf("run aborted: %w", fatalErr)
+	}
+	return errs.RunResult(len(imagePaths), errorCnt)
 }
 
 /**
  * processImage handles the full logic for a single image:
  * 1. Checks if caption file exists (and skips if -force is not set)
- * 2. Reads the image file
+ * 2. Reads the image file (downscaled for upload if it's too large)
  * 3. Encodes it to base64
- * 4. Calls the Gemini API (with retries)
+ * 4. Calls the provider API (with retries)
  * 5. Parses the response
- * 6. Prepends identity (if provided)
- * 7. Saves the caption to a .txt file
+ * 6. Inserts class token and prepends identity (if provided)
+ * 7. Saves the caption to a .txt file (and the structured metadata to a .json file in --metadata mode)
  */
-func processImage(client *http.Client, imagePath string, apiKey string, force bool, identity string) error {
+func processImage(p provider.CaptionProvider, imagePath string, force bool, opts *captioner.Options) error {
 	// 1. Check for existing .txt file before doing any work
 	baseName := filepath.Base(imagePath)
-	ext := filepath.Ext(baseName)
-	txtFileName := strings.TrimSuffix(baseName, ext) + ".txt"
-	txtPath := filepath.Join(filepath.Dir(imagePath), txtFileName)
-
-	if !force {
-		if _, err := os.Stat(txtPath); err == nil {
-			// File exists, skip processing
-			fmt.Printf("Processing %s: ⏩ SKIPPED (caption already exists)\n", baseName)
-			return nil
-		}
+	txtPath := captioner.CaptionFilePath(imagePath, opts.OutputExt)
+
+	if !force && util.OutputUpToDate(imagePath, txtPath, flagChangedOnly) {
+		// File exists, skip processing
+		fmt.Fprintf(logOut, "Processing %s: ⏩ SKIPPED (caption already exists)\n", baseName)
+		return nil
 	}
 
-	fmt.Printf("Processing %s: ⏳ GENERATING...\n", baseName)
+	if !flagQueueOnly {
+		fmt.Fprintf(logOut, "Processing %s: ⏳ GENERATING...\n", baseName)
+	}
 
-	// 2. Read image file and encode to base64
-	imageData, err := os.ReadFile(imagePath)
+	// 2. Read image file (or its cropped one of --use-crop-dir, downscaled if it's too large)
+	imageData, mimeType, err := captioner.ReadImage(cropImagePath(imagePath), opts)
 	if err != nil {
-		return fmt.Errorf("failed to read image: %w", err)
-	}
-	base64Image := base64.StdEncoding.EncodeToString(imageData)
-	mimeType := getMimeType(imagePath)
-
-	// 3. Construct the API request payload
-	payload := GeminiRequest{
-		Contents: []Content{
-			{
-				Role: "user",
-				Parts: []Part{
-					{Text: captionPrompt}, // The prompt to the model
-					{
-						InlineData: &InlineData{ // The image data
-							MimeType: mimeType,
-							Data:     base64Image,
-						},
-					},
-				},
-			},
-		},
+		return err
+	}
+
+	if flagQueueOnly {
+		if err := queueImage(imagePath, imageData, mimeType, opts); err != nil {
+			return err
+		}
+		fmt.Fprintf(logOut, "Processing %s: 📥 QUEUED\n", baseName)
+		return nil
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	// 3-6. Generate the caption
+	finalCaption, metadata, err := generateCaption(p, imagePath, imageData, mimeType, opts)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON payload: %w", err)
+		return err
 	}
 
-	apiUrl := fmt.Sprintf("%s%s:generateContent?key=%s", constants.GEMINI_API_URL, flagModel, apiKey)
-	var geminiResp GeminiResponse
-	var resp *http.Response
-	var reqErr error
-	delay := 2 * time.Second // Initial retry delay
+	// 7. Save the caption
+	if err := saveCaption(imagePath, finalCaption, metadata, opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(logOut, "Processing %s: ✅ SUCCESS\n", baseName)
+	return nil
+}
 
-	// 4. API Call with simple exponential backoff
-	for range maxRetries {
-		req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(jsonPayload))
+// processBatch captions the images in one request (--batch-size) and saves their captions.
+// It returns the error of each image.
+func processBatch(p provider.CaptionProvider, imagePaths []string) []error {
+	imageErrs := make([]error, len(imagePaths))
+	var images []*captioner.BatchImage
+	var indexes []int
+	for i, imagePath := range imagePaths {
+		fmt.Fprintf(logOut, "Processing %s: ⏳ GENERATING (batch of %d)...\n", filepath.Base(imagePath), len(imagePaths))
+		opts := flagOptions(imagePath)
+		imageData, mimeType, err := captioner.ReadImage(cropImagePath(imagePath), opts)
 		if err != nil {
-			return fmt.Errorf("failed to create request: %w", err)
-		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, reqErr = client.Do(req)
-
-		// If there's a network error, retry
-		if reqErr != nil {
-			fmt.Printf("  ...network error (%v), retrying in %v\n", reqErr, delay)
-			time.Sleep(delay)
-			delay *= 2 // Double the delay for next retry
+			imageErrs[i] = err
 			continue
 		}
-
-		// Check for 429 (Throttling) or 5xx (Server Error) and retry
-		if resp.StatusCode == 429 || resp.StatusCode >= 500 {
-			fmt.Printf("  ...API error (%s), retrying in %v\n", resp.Status, delay)
-			if resp.Body != nil {
-				resp.Body.Close() // Must close body before retrying
-			}
-			time.Sleep(delay)
-			delay *= 2
+		images = append(images, &captioner.BatchImage{Name: imagePath, Data: imageData, MimeType: mimeType,
+			Options: opts})
+		indexes = append(indexes, i)
+	}
+	if len(images) == 0 {
+		return imageErrs
+	}
+	results, resultErrs := captioner.CaptionBatch(context.Background(), p, images, flagOptions(""))
+	for j, i := range indexes {
+		imagePath := imagePaths[i]
+		if imageErrs[i] = resultErrs[j]; imageErrs[i] != nil {
 			continue
 		}
-
-		// Any other non-200 status code is a non-retryable error
-		if resp.StatusCode != http.StatusOK {
-			break // Exit the loop to handle the error below
+		reportFlagged(imagePath, results[j], images[j].Options)
+		if imageErrs[i] = saveCaption(imagePath, results[j].Caption, nil, images[j].Options); imageErrs[i] == nil {
+			fmt.Fprintf(logOut, "Processing %s: ✅ SUCCESS\n", filepath.Base(imagePath))
 		}
+	}
+	return imageErrs
+}
 
-		// Try to decode the response. If it's empty, we might want to retry.
-		if err := json.NewDecoder(resp.Body).Decode(&geminiResp); err != nil {
-			if resp.Body != nil {
-				resp.Body.Close()
-			}
-			return fmt.Errorf("failed to decode API response: %w", err)
+// saveCaption saves the caption to the caption file of the image (and the metadata to the .json file if not nil),
+// backing up the existing ones.
+func saveCaption(imagePath string, finalCaption string, metadata *captioner.ImageMetadata,
+	opts *captioner.Options) error {
+	if backup != nil {
+		if err := backup.Save(captioner.CaptionFilePath(imagePath, opts.OutputExt)); err != nil {
+			return err
 		}
-		resp.Body.Close() // Close body after successful decode
-
-		// If the response is empty, retry
-		if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 || geminiResp.Candidates[0].Content.Parts[0].Text == "" {
-			fmt.Printf("  ...API returned empty caption, retrying in %v\n", delay)
-			time.Sleep(delay)
-			delay *= 2
-			continue
+		if err := backup.Save(captioner.MetadataFilePath(imagePath)); err != nil {
+			return err
 		}
-
-		// If we got a valid response, break the loop
-		break
 	}
+	return captioner.Save(imagePath, &captioner.Result{Caption: finalCaption, Metadata: metadata}, opts)
+}
 
-	// If all retries failed on a network error
-	if reqErr != nil {
-		return fmt.Errorf("all retries failed: %w", reqErr)
+// captionStdin captions the image read from stdin (--stdin mode) and writes the caption to stdout.
+func captionStdin(p provider.CaptionProvider) error {
+	imageData, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
 	}
-
-	// Handle non-OK, non-retryable status codes after the loop
-	if resp != nil && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API request failed with status %s", resp.Status)
+	if len(imageData) == 0 {
+		return errs.New(errs.ExitConfig, "no image data in stdin")
 	}
-
-	// 5. Extract the caption text (already decoded in the loop)
-	if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 || geminiResp.Candidates[0].Content.Parts[0].Text == "" {
-		return fmt.Errorf("no caption generated (empty response from API)")
+	mimeType, warning := util.CheckMimeType(imageData, flagMimeType)
+	if warning != "" {
+		fmt.Fprintf(logOut, "stdin: %s\n", warning)
 	}
-	caption := geminiResp.Candidates[0].Content.Parts[0].Text
-
-	// 6. Prepend identity if provided
-	finalCaption := strings.TrimSpace(caption) // Clean up any extra whitespace
-	if identity != "" {
-		finalCaption = identity + ", " + finalCaption
+	if data, shrunk, err := util.ShrinkImageDataForUpload(imageData, flagUploadMaxSize, flagUploadQuality); err != nil {
+		fmt.Fprintf(logOut, "failed to downscale image (%v), sending the original\n", err)
+	} else if shrunk {
+		imageData, mimeType = data, "image/jpeg"
+	}
+	caption, metadata, err := generateCaption(p, "stdin", imageData, mimeType, flagOptions(""))
+	if err != nil {
+		return err
 	}
+	if metadata != nil {
+		data, err := json.MarshalIndent(metadata, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+		caption = string(data)
+	}
+	fmt.Println(caption)
+	return nil
+}
 
-	// 7. Save the caption to a .txt file
-	err = os.WriteFile(txtPath, []byte(finalCaption), 0644)
+// generateCaption calls the provider to caption the image data and returns the final caption,
+// and the structured metadata (with the final caption) in --metadata mode.
+// name is the image path (or "stdin"), used in messages and the flagged images list.
+func generateCaption(p provider.CaptionProvider, name string, imageData []byte, mimeType string,
+	opts *captioner.Options) (string, *captioner.ImageMetadata, error) {
+	result, err := captioner.Caption(context.Background(), p, name, imageData, mimeType, opts)
 	if err != nil {
-		return fmt.Errorf("failed to write caption file: %w", err)
+		return "", nil, err
 	}
+	reportFlagged(name, result, opts)
+	return result.Caption, result.Metadata, nil
+}
 
-	fmt.Printf("Processing %s: ✅ SUCCESS\n", baseName)
-	return nil
+// reportFlagged prints and records the image (name) if its caption still contains banned words or is in
+// the wrong language.
+func reportFlagged(name string, result *captioner.Result, opts *captioner.Options) {
+	if len(result.Flagged) > 0 {
+		fmt.Fprintf(logOut, "Processing %s: ⚠️ FLAGGED (caption still contains banned words: %s)\n",
+			filepath.Base(name), strings.Join(result.Flagged, ", "))
+	}
+	if result.WrongLanguage {
+		fmt.Fprintf(logOut, "Processing %s: ⚠️ FLAGGED (caption is still not in %s)\n", filepath.Base(name), opts.Language)
+	}
+	if len(result.Flagged) > 0 || result.WrongLanguage {
+		flaggedImages = append(flaggedImages, name)
+	}
 }
 
-// isImageFile checks if a filename has a common image extension
-func isImageFile(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".jpg", ".jpeg", ".png", ".webp":
-		return true
-	default:
-		return false
+// flagOptions returns the caption options set by flags for the image file at imagePath ("" in --stdin mode).
+func flagOptions(imagePath string) *captioner.Options {
+	prompt := captioner.DefaultPrompt
+	if flagPrompt != "" {
+		prompt = flagPrompt
+	}
+	var exifFields map[string]string
+	if flagUseExif && imagePath != "" {
+		// An unreadable image fails later when it's read for the request
+		exifFields, _ = util.ReadExifFields(imagePath, flagExifFields)
+		if len(exifFields) > 0 && slices.Contains(flagExifTo, "prompt") {
+			prompt += captioner.ExifPrompt(exifFields)
+		}
+		if !slices.Contains(flagExifTo, "metadata") {
+			exifFields = nil
+		}
+	}
+	facts := metadataFacts.facts(imagePath)
+	prompt += captioner.FactsPrompt(facts, flagTemplate != "")
+	if flagContextCaption && imagePath != "" {
+		if reference := contextCaption(imagePath); reference != "" {
+			prompt += captioner.ContextPrompt(reference)
+		}
+	}
+	return &captioner.Options{
+		Model:         flagModel,
+		Prompt:        prompt,
+		Identity:      mapIdentity(identityRules, imagePath, flagIdentity),
+		StripWords:    flagStripWords,
+		Language:      flagCaptionLang,
+		OutputExt:     outputExt,
+		BOM:           flagBOM,
+		ClassToken:    flagClassToken,
+		ClassTokenPos: flagClassTokenPos,
+		Template:      flagTemplate,
+		Facts:         facts,
+		MaxTags:       flagMaxTags,
+		MaxChars:      flagMaxChars,
+		Metadata:      flagMetadata,
+		Exif:          exifFields,
+		BanWords:      banWords,
+		BanRetries:    flagBanRetries,
+		Sampling:      &sampling,
+		UploadMaxSize: flagUploadMaxSize,
+		UploadQuality: flagUploadQuality,
+		Log:           logOut,
 	}
 }
 
-// getMimeType determines the MIME type from the file extension
-func getMimeType(imagePath string) string {
-	ext := strings.ToLower(filepath.Ext(imagePath))
-	switch ext {
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	case ".webp":
-		return "image/webp"
-	default:
-		// A safe default
-		return "application/octet-stream"
+// cropImagePath returns the path of the cropped image of imagePath in --use-crop-dir (of the same path relative to
+// --dir, or the same name for image args), or imagePath if --use-crop-dir is not set or it has no cropped image.
+func cropImagePath(imagePath string) string {
+	if flagUseCropDir == "" {
+		return imagePath
+	}
+	rel := filepath.Base(imagePath)
+	if flagDir != "" {
+		if r, err := filepath.Rel(flagDir, imagePath); err == nil && !strings.HasPrefix(r, "..") {
+			rel = r
+		}
+	}
+	cropPath := filepath.Join(flagUseCropDir, rel)
+	if _, err := os.Stat(util.LongPath(cropPath)); err != nil {
+		return imagePath
 	}
+	return cropPath
 }
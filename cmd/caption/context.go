@@ -0,0 +1,32 @@
+package caption
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/util"
+)
+
+// The previous image (in the listing order) of each image in the same folder, for --context-caption
+var previousImages map[string]string
+
+// contextCaption returns the caption context of the image at imagePath (--context-caption): the style context file
+// of its folder if it exists, or else the caption of the previous image of the same folder (generated in this run
+// or an existing one). "" = none.
+func contextCaption(imagePath string) string {
+	if data, err := os.ReadFile(util.LongPath(filepath.Join(filepath.Dir(imagePath),
+		captioner.StyleContextFile))); err == nil {
+		return strings.TrimSpace(strings.TrimPrefix(string(data), util.UTF8_BOM))
+	}
+	previous := previousImages[imagePath]
+	if previous == "" {
+		return ""
+	}
+	data, err := os.ReadFile(util.LongPath(captioner.CaptionFilePath(previous, outputExt)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(string(data), util.UTF8_BOM))
+}
@@ -0,0 +1,74 @@
+package caption
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sagan/goaider/util"
+)
+
+// identityRule maps the images of a folder, or whose paths match a regexp, to an identity (trigger word).
+type identityRule struct {
+	folder   string // slash-separated, relative to --dir
+	regexp   *regexp.Regexp
+	identity string
+}
+
+// loadIdentityMap reads the --identity-map file. Each line is "<pattern> = <identity>",
+// where pattern is a folder relative to --dir, or a "/regexp/" matched against the slash-separated
+// path of the image relative to --dir.
+func loadIdentityMap(path string) ([]*identityRule, error) {
+	lines, err := util.ReadListFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*identityRule
+	for _, line := range lines {
+		// The identity is after the last "=", as a regexp may contain "="
+		i := strings.LastIndex(line, "=")
+		if i == -1 {
+			return nil, fmt.Errorf(`invalid line %q: must be "<pattern> = <identity>"`, line)
+		}
+		pattern, identity := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if pattern == "" || identity == "" {
+			return nil, fmt.Errorf(`invalid line %q: must be "<pattern> = <identity>"`, line)
+		}
+		rule := &identityRule{identity: identity}
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			if rule.regexp, err = regexp.Compile(pattern[1 : len(pattern)-1]); err != nil {
+				return nil, fmt.Errorf("invalid regexp %q: %w", pattern, err)
+			}
+		} else {
+			rule.folder = strings.Trim(filepath.ToSlash(filepath.Clean(pattern)), "/")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// mapIdentity returns the identity of the first rule matching the image at imagePath,
+// or defaultIdentity if none matches.
+func mapIdentity(rules []*identityRule, imagePath string, defaultIdentity string) string {
+	if imagePath == "" {
+		return defaultIdentity
+	}
+	relPath := imagePath
+	if flagDir != "" {
+		if rel, err := filepath.Rel(flagDir, imagePath); err == nil {
+			relPath = rel
+		}
+	}
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	for _, rule := range rules {
+		if rule.regexp != nil {
+			if rule.regexp.MatchString(relPath) {
+				return rule.identity
+			}
+		} else if rule.folder == "." && !strings.Contains(relPath, "/") || strings.HasPrefix(relPath, rule.folder+"/") {
+			return rule.identity
+		}
+	}
+	return defaultIdentity
+}
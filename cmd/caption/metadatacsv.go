@@ -0,0 +1,87 @@
+package caption
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sagan/goaider/util"
+)
+
+// The names of the file column of the --metadata-csv file. If it has none of them, the first column is used
+var fileColumns = []string{"file", "filename", "image", "path"}
+
+// metadataTable is the per-image known facts of the --metadata-csv file.
+type metadataTable struct {
+	// The columns of the facts (other than the file column)
+	columns []string
+	// The facts of each image, keyed by the slash-separated path relative to --dir (or the file name)
+	rows map[string]map[string]string
+}
+
+// loadMetadataCSV reads the --metadata-csv file: a header row of the column names, and a row of each image.
+func loadMetadataCSV(path string) (*metadataTable, error) {
+	file, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no header row")
+	}
+	header := records[0]
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], util.UTF8_BOM)
+	}
+	fileColumn := slices.IndexFunc(header, func(name string) bool {
+		return slices.Contains(fileColumns, strings.ToLower(strings.TrimSpace(name)))
+	})
+	if fileColumn == -1 {
+		fileColumn = 0
+	}
+	table := &metadataTable{rows: map[string]map[string]string{}}
+	for i, name := range header {
+		if i != fileColumn {
+			table.columns = append(table.columns, strings.TrimSpace(name))
+		}
+	}
+	for _, record := range records[1:] {
+		if fileColumn >= len(record) || strings.TrimSpace(record[fileColumn]) == "" {
+			continue
+		}
+		facts := map[string]string{}
+		for i, value := range record {
+			if i != fileColumn && i < len(header) {
+				facts[strings.TrimSpace(header[i])] = strings.TrimSpace(value)
+			}
+		}
+		table.rows[filepath.ToSlash(filepath.Clean(strings.TrimSpace(record[fileColumn])))] = facts
+	}
+	return table, nil
+}
+
+// facts returns the facts of the image at imagePath: of its path relative to --dir, or of its file name.
+// It returns nil if the image has no row.
+func (t *metadataTable) facts(imagePath string) map[string]string {
+	if t == nil || imagePath == "" {
+		return nil
+	}
+	if flagDir != "" {
+		if rel, err := filepath.Rel(flagDir, imagePath); err == nil {
+			if facts, ok := t.rows[filepath.ToSlash(rel)]; ok {
+				return facts
+			}
+		}
+	}
+	return t.rows[filepath.Base(imagePath)]
+}
@@ -0,0 +1,71 @@
+package caption
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/provider"
+	"github.com/sagan/goaider/queue"
+	"github.com/sagan/goaider/util"
+)
+
+// queuedCaption are the options saved with a queued caption request (--queue-only).
+type queuedCaption struct {
+	captioner.Options
+	// Absolute path of the --ban-words file. Captions of flushed requests that contain banned words
+	// are flagged, but not regenerated.
+	BanWords string `json:"banWords,omitempty"`
+	NoBackup bool   `json:"noBackup,omitempty"`
+	// The generation parameters of the request, recorded in the metadata
+	Generation *captioner.Generation `json:"generation,omitempty"`
+}
+
+func init() {
+	queue.Register("caption", flushCaption)
+}
+
+// queueImage queues the request to caption the image data of the image file at imagePath.
+func queueImage(imagePath string, imageData []byte, mimeType string, opts *captioner.Options) error {
+	request, _ := captioner.NewRequest(imageData, mimeType, opts)
+	queued := &queuedCaption{Options: *opts, NoBackup: flagNoBackup, Generation: captioner.NewGeneration(request)}
+	if flagBanWords != "" {
+		queued.BanWords, _ = filepath.Abs(flagBanWords)
+	}
+	return queue.Add("caption", imagePath, flagModel, provider.GeminiCaptionRequest(request), queued)
+}
+
+// flushCaption saves the caption of the response of a queued request, the same way as processImage does.
+func flushCaption(item *queue.Item, imagePath string, text string) error {
+	var queued queuedCaption
+	if err := json.Unmarshal(item.Options, &queued); err != nil {
+		return fmt.Errorf("invalid queued caption options: %w", err)
+	}
+	caption, metadata, err := captioner.ParseResponse(text, &queued.Options)
+	if err != nil {
+		return err
+	}
+	if queued.BanWords != "" {
+		words, err := captioner.LoadBanWords(queued.BanWords)
+		if err != nil {
+			return fmt.Errorf("failed to load ban words file: %w", err)
+		}
+		if found := captioner.FindBanWords(words, caption); len(found) > 0 {
+			fmt.Fprintf(logOut, "Processing %s: ⚠️ FLAGGED (caption contains banned words: %s)\n",
+				filepath.Base(imagePath), strings.Join(found, ", "))
+		}
+	}
+	if !captioner.IsInLanguage(caption, queued.Language) {
+		fmt.Fprintf(logOut, "Processing %s: ⚠️ FLAGGED (caption is not in %s)\n", filepath.Base(imagePath), queued.Language)
+	}
+	caption, metadata = captioner.Finish(caption, metadata, &queued.Options)
+	if metadata != nil {
+		metadata.Generation = queued.Generation
+	}
+	if !queued.NoBackup && backup == nil {
+		backup = util.NewBackup()
+	}
+	return saveCaption(imagePath, caption, metadata, &queued.Options)
+}
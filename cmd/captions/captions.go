@@ -0,0 +1,206 @@
+package captions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir    string
+	flagBackup string
+	flagList   bool
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "captions-diff [caption.txt]...",
+	Short: "Show the changes of captions since a backup",
+	Long: `Show the tag changes of the captions (.txt files) of a dir since a backup.
+
+Existing captions are backed up to "<dir>/` + util.BACKUPS_DIR + `/<time>/" before they are
+overwritten by caption (and review / captions-restore). By default, the latest backup is compared.
+Use --list to list all backups, and --backup to select one. Only the given caption files
+are compared if any.`,
+	RunE: diff,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "captions-restore [caption.txt]...",
+	Short: "Restore captions from a backup",
+	Long: `Restore the captions (.txt files, and .json metadata sidecar files) of a dir from a backup,
+e.g. to revert a bad regeneration run. By default, the latest backup is restored.
+Only the given caption files are restored if any.
+
+The current captions are backed up first, so a restore can be reverted too.`,
+	RunE: restore,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{diffCmd, restoreCmd} {
+		cmd.RootCmd.AddCommand(c)
+		c.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dataset dir")
+		c.Flags().StringVar(&flagBackup, "backup", "", "Optional: ID of the backup (see --list). default: latest")
+		c.MarkFlagRequired("dir")
+		cmd.SetPromptDefault(c.Flags(), "dir", ".")
+	}
+	diffCmd.Flags().BoolVar(&flagList, "list", false, "Optional: List all backups and exit")
+}
+
+// selectBackup returns the ID of the --backup, or the latest backup.
+func selectBackup() (string, error) {
+	ids, err := util.ListBackups(flagDir)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no backup found in %q", flagDir)
+	}
+	if flagBackup == "" {
+		return ids[len(ids)-1], nil
+	}
+	if !slices.Contains(ids, flagBackup) {
+		return "", errs.New(errs.ExitConfig, "backup %q not found", flagBackup)
+	}
+	return flagBackup, nil
+}
+
+// backupFiles returns the names of files in backup id, or the names of args (if any) that are in the backup.
+func backupFiles(id string, args []string, exts ...string) ([]string, error) {
+	entries, err := os.ReadDir(util.BackupPath(flagDir, id, ""))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !slices.Contains(exts, strings.ToLower(filepath.Ext(entry.Name()))) {
+			continue
+		}
+		if len(args) > 0 && !slices.ContainsFunc(args, func(arg string) bool {
+			return filepath.Base(arg) == entry.Name()
+		}) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func diff(_ *cobra.Command, args []string) error {
+	if flagList {
+		ids, err := util.ListBackups(flagDir)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			names, _ := backupFiles(id, nil, ".txt")
+			fmt.Printf("%s  (%d captions)\n", id, len(names))
+		}
+		return nil
+	}
+	id, err := selectBackup()
+	if err != nil {
+		return err
+	}
+	names, err := backupFiles(id, args, ".txt")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Comparing %d captions with backup %s\n", len(names), id)
+	changedCnt := 0
+	for _, name := range names {
+		old, err := os.ReadFile(util.BackupPath(flagDir, id, name))
+		if err != nil {
+			return err
+		}
+		current, err := os.ReadFile(util.LongPath(filepath.Join(flagDir, name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("%s: (deleted)\n", name)
+			changedCnt++
+			continue
+		}
+		removed, added := diffTags(splitTags(string(old)), splitTags(string(current)))
+		if len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+		changedCnt++
+		fmt.Printf("%s:\n", name)
+		for _, tag := range removed {
+			fmt.Printf("  - %s\n", tag)
+		}
+		for _, tag := range added {
+			fmt.Printf("  + %s\n", tag)
+		}
+	}
+	fmt.Printf("%d of %d captions changed\n", changedCnt, len(names))
+	return nil
+}
+
+func splitTags(caption string) []string {
+	var tags []string
+	for _, tag := range strings.Split(caption, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// diffTags returns the tags of old not in current, and the tags of current not in old.
+func diffTags(old, current []string) (removed, added []string) {
+	for _, tag := range old {
+		if !slices.Contains(current, tag) {
+			removed = append(removed, tag)
+		}
+	}
+	for _, tag := range current {
+		if !slices.Contains(old, tag) {
+			added = append(added, tag)
+		}
+	}
+	return removed, added
+}
+
+func restore(_ *cobra.Command, args []string) error {
+	id, err := selectBackup()
+	if err != nil {
+		return err
+	}
+	names, err := backupFiles(id, args, ".txt", ".json")
+	if err != nil {
+		return err
+	}
+	backup := util.NewBackup()
+	if backup.ID == id {
+		return fmt.Errorf("backup %s was just created, retry in a second", id)
+	}
+	errorCnt := 0
+	for _, name := range names {
+		data, err := os.ReadFile(util.BackupPath(flagDir, id, name))
+		if err == nil {
+			path := filepath.Join(flagDir, name)
+			if err = backup.Save(path); err == nil {
+				err = os.WriteFile(util.LongPath(path), data, 0644)
+			}
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("✅ %s\n", name)
+	}
+	fmt.Printf("Restored %d files from backup %s (current files are backed up to %s)\n", len(names)-errorCnt, id,
+		backup.ID)
+	return errs.RunResult(len(names), errorCnt)
+}
@@ -0,0 +1,251 @@
+package cluster
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/pkg/embedder"
+	"github.com/sagan/goaider/util"
+)
+
+// Embedding types, the values of --type
+const (
+	typeImage = "image"
+	typeText  = "text"
+)
+
+const (
+	maxIterations = 100
+	// The size of the cells of the contact sheets
+	cellSize = 256
+)
+
+var (
+	flagDir           string
+	flagK             int
+	flagType          string
+	flagEmbeddings    string
+	flagSeed          uint64
+	flagReport        string
+	flagContactSheets bool
+	flagSheetSize     int
+	flagMove          bool
+)
+
+var clusterCmd = &cobra.Command{
+	Use:   "cluster --k <n>",
+	Short: "Group the images of a dataset into clusters by their embeddings",
+	Long: `Group the images of a dataset into --k clusters by k-means of their embeddings,
+computed beforehand by the embed command (default "<dir>/.goaider/embeddings.npz"), e.g. to find
+the over-represented outfits, poses or backgrounds of a dataset, or the outliers.
+
+The cluster and the similarity to the cluster center of each image are written to a CSV report
+(default "<dir>/.goaider/clusters.csv"). Set --contact-sheets to also render a JPEG grid of the images
+of each cluster (the most typical ones first), and --move to move the images of each cluster
+(with their sidecar files, e.g. captions) into the "cluster-<n>" subfolders of --dir.
+The clusters are numbered by size, from 1 (the largest).`,
+	Args: cobra.NoArgs,
+	RunE: cluster,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(clusterCmd)
+	clusterCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the image directory (the --dir of the embed command)")
+	clusterCmd.Flags().IntVar(&flagK, "k", 0, "Required: Number of clusters")
+	clusterCmd.Flags().StringVar(&flagType, "type", typeImage, "Optional: The embeddings to cluster by: "+typeImage+" or "+typeText+" (of the captions)")
+	clusterCmd.Flags().StringVar(&flagEmbeddings, "embeddings", "", `Optional: Path of the embeddings .npz file of the embed command. default: "<dir>/.goaider/embeddings.npz"`)
+	clusterCmd.Flags().Uint64Var(&flagSeed, "seed", 1, "Optional: Random seed of the k-means initialization. Different seeds may give different clusters")
+	clusterCmd.Flags().StringVar(&flagReport, "report", "", `Optional: Path of the output CSV report. default: "<dir>/.goaider/clusters.csv"`)
+	clusterCmd.Flags().BoolVar(&flagContactSheets, "contact-sheets", false, `Optional: Render a contact sheet of each cluster to "<dir>/.goaider/clusters/cluster-<n>.jpg"`)
+	clusterCmd.Flags().IntVar(&flagSheetSize, "sheet-size", 36, "Optional: Max number of images of each contact sheet")
+	clusterCmd.Flags().BoolVar(&flagMove, "move", false, `Optional: Move the images of each cluster (with their sidecar files) into the "cluster-<n>" subfolders of --dir`)
+	clusterCmd.MarkFlagRequired("k")
+	clusterCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(clusterCmd.Flags(), "dir", ".")
+}
+
+// member is an image of a cluster and its similarity to the cluster centroid.
+type member struct {
+	name       string // the path relative to --dir
+	similarity float64
+}
+
+func cluster(_ *cobra.Command, _ []string) error {
+	if flagK < 1 {
+		return errs.New(errs.ExitConfig, "invalid --k %d: must be >= 1", flagK)
+	}
+	if flagType != typeImage && flagType != typeText {
+		return errs.New(errs.ExitConfig, "invalid --type %q", flagType)
+	}
+	if flagSheetSize < 1 {
+		return errs.New(errs.ExitConfig, "invalid --sheet-size %d: must be >= 1", flagSheetSize)
+	}
+	storePath := flagEmbeddings
+	if storePath == "" {
+		storePath = embedder.DefaultStorePath(flagDir)
+	}
+	store, err := embedder.LoadStore(storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errs.New(errs.ExitConfig, "no embeddings at %q: run `goaider embed --dir %s` first", storePath, flagDir)
+		}
+		return errs.New(errs.ExitConfig, "failed to load the embeddings %q: %w", storePath, err)
+	}
+	rows := store.Image
+	if flagType == typeText {
+		rows = store.Text
+	}
+	if rows == nil {
+		return errs.New(errs.ExitConfig, "no %s embeddings in %q: run `goaider embed --type %s` first",
+			flagType, storePath, flagType)
+	}
+	// The images that still exist and have an embedding
+	var names []string
+	var vectors [][]float32
+	for i, name := range store.Files {
+		if rows[i] == nil {
+			continue
+		}
+		if _, err := os.Stat(util.LongPath(filepath.Join(flagDir, filepath.FromSlash(name)))); err != nil {
+			continue
+		}
+		names = append(names, name)
+		vectors = append(vectors, rows[i])
+	}
+	if len(vectors) == 0 {
+		return errs.New(errs.ExitConfig, "none of the images of %q has %s embeddings", storePath, flagType)
+	}
+	if flagK > len(vectors) {
+		return errs.New(errs.ExitConfig, "--k %d is larger than the number of images (%d)", flagK, len(vectors))
+	}
+
+	fmt.Printf("Clustering %d images into %d clusters\n", len(vectors), flagK)
+	assignments, centroids := embedder.KMeans(vectors, flagK, flagSeed, maxIterations)
+	clusters := make([][]*member, len(centroids))
+	for i, c := range assignments {
+		clusters[c] = append(clusters[c], &member{names[i], embedder.Similarity(vectors[i], centroids[c])})
+	}
+	clusters = slices.DeleteFunc(clusters, func(members []*member) bool { return len(members) == 0 })
+	// The largest cluster first, and the most typical images of each cluster first
+	slices.SortStableFunc(clusters, func(a, b []*member) int { return len(b) - len(a) })
+	for _, members := range clusters {
+		slices.SortStableFunc(members, func(a, b *member) int { return cmp.Compare(b.similarity, a.similarity) })
+	}
+
+	report := flagReport
+	if report == "" {
+		report = filepath.Join(flagDir, ".goaider", "clusters.csv")
+	}
+	if err := writeReport(report, clusters); err != nil {
+		return fmt.Errorf("failed to write the report: %w", err)
+	}
+	for i, members := range clusters {
+		fmt.Printf("Cluster %d: %d images (mean similarity %.3f), e.g. %s\n", i+1, len(members),
+			meanSimilarity(members), members[0].name)
+	}
+	fmt.Printf("Report saved to %s\n", report)
+
+	errorCnt := 0
+	if flagContactSheets {
+		sheetsDir := filepath.Join(flagDir, ".goaider", "clusters")
+		for i, members := range clusters {
+			output := filepath.Join(sheetsDir, clusterName(i)+".jpg")
+			if err := renderContactSheet(output, members[:min(len(members), flagSheetSize)]); err != nil {
+				fmt.Printf("❌ failed to render the contact sheet of cluster %d: %v\n", i+1, err)
+				errorCnt++
+			}
+		}
+		fmt.Printf("Contact sheets saved to %s\n", sheetsDir)
+	}
+	if flagMove {
+		for i, members := range clusters {
+			target := filepath.Join(flagDir, clusterName(i))
+			for _, m := range members {
+				if err := cropper.MoveImage(filepath.Join(flagDir, filepath.FromSlash(m.name)), target); err != nil {
+					fmt.Printf("❌ failed to move %s: %v\n", m.name, err)
+					errorCnt++
+				}
+			}
+		}
+		fmt.Printf("Moved the images into the cluster-<n> subfolders of %q. "+
+			"Re-run the embed command before clustering again\n", flagDir)
+	}
+	return errs.RunResult(len(vectors), errorCnt)
+}
+
+// clusterName returns the name of the i-th (0-based) cluster, e.g. "cluster-1".
+func clusterName(i int) string {
+	return "cluster-" + strconv.Itoa(i+1)
+}
+
+func meanSimilarity(members []*member) float64 {
+	sum := 0.0
+	for _, m := range members {
+		sum += m.similarity
+	}
+	return sum / float64(len(members))
+}
+
+// writeReport writes the "file,cluster,similarity" CSV report of the clusters.
+func writeReport(filename string, clusters [][]*member) (err error) {
+	if err := os.MkdirAll(util.LongPath(filepath.Dir(filename)), 0755); err != nil {
+		return err
+	}
+	writer, closeCSV, err := (*util.CSVOptions)(nil).CreateCSV(util.LongPath(filename))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := closeCSV(); err == nil {
+			err = closeErr
+		}
+	}()
+	if err := writer.Write([]string{"file", "cluster", "similarity"}); err != nil {
+		return err
+	}
+	for i, members := range clusters {
+		for _, m := range members {
+			if err := writer.Write([]string{m.name, strconv.Itoa(i + 1),
+				strconv.FormatFloat(m.similarity, 'f', 4, 64)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderContactSheet renders the images of members as a square-ish grid of cellSize thumbnails
+// to the JPEG file at output.
+func renderContactSheet(output string, members []*member) error {
+	columns := int(math.Ceil(math.Sqrt(float64(len(members)))))
+	rows := (len(members) + columns - 1) / columns
+	sheet := imaging.New(columns*cellSize, rows*cellSize, color.White)
+	for i, m := range members {
+		img, _, err := util.LoadImage(filepath.Join(flagDir, filepath.FromSlash(m.name)))
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		thumb := imaging.Fit(img, cellSize, cellSize, imaging.Lanczos)
+		// Centered in the cell
+		x := (i%columns)*cellSize + (cellSize-thumb.Bounds().Dx())/2
+		y := (i/columns)*cellSize + (cellSize-thumb.Bounds().Dy())/2
+		sheet = imaging.Overlay(sheet, thumb, image.Pt(x, y), 1)
+	}
+	if err := os.MkdirAll(util.LongPath(filepath.Dir(output)), 0755); err != nil {
+		return err
+	}
+	return imaging.Save(sheet, util.LongPath(output), imaging.JPEGQuality(85))
+}
@@ -1,230 +1,256 @@
 package crop
 
 import (
+	"context"
 	"fmt"
-	"image"
-	"image/png"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/disintegration/imaging"
-	"github.com/muesli/smartcrop"
-	"github.com/rwcarlsen/goexif/exif"
 	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/notify"
+	"github.com/sagan/goaider/pkg/batch"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/util"
 	"github.com/spf13/cobra"
 )
 
 // Flag variables to store command line arguments
 var (
-	flagDir       string
-	flagOutputDir string
-	flagWidth     int
-	flagHeight    int
-	flagForce     bool
+	flagDir         string
+	flagOutputDir   string
+	flagWidth       int
+	flagHeight      int
+	flagMultiSize   string
+	flagSeries      string
+	flagHeadroom    float64
+	flagPadding     float64
+	flagThirds      bool
+	flagTrimBorders bool
+	flagIgnoreEdge  int
+	flagExclude     []string
+	flagOutputName  string
+	flagOutputExt   string
+	flagSidecars    []string
+	flagRetryFailed bool
+	flagForce       bool
+	flagChangedOnly bool
+	flagProgress    bool
+	flagNotify      []string
+	fileFilter      util.FileFilter
 )
 
 var cropCmd = &cobra.Command{
-	Use:   "crop",
+	Use:   "crop [image]...",
 	Short: "Crop and resize images in a directory",
-	Long:  `This command crops and resizes all images in a specified directory using smartcrop.`,
-	RunE:  crop,
+	Long: `This command crops and resizes all images in a specified directory using smartcrop.
+
+Instead of --dir, image files can be given as arguments to crop only them.`,
+	RunE: crop,
 }
 
 func init() {
 	cmd.RootCmd.AddCommand(cropCmd)
 
 	// Bind flags to variables using StringVar, IntVar, BoolVar
-	cropCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the image directory")
-	cropCmd.Flags().StringVar(&flagOutputDir, "output", "", "Optional: output dir name. default to \"<input-dir>-crop\"")
+	cropCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	cropCmd.Flags().StringVar(&flagOutputDir, "output", "", "Optional: output dir name. default to \"<input-dir>-crop\" (input dir of image args: dir of the first image)")
 	cropCmd.Flags().IntVar(&flagWidth, "width", 1024, "Optional: target photo width. default: 1024.")
 	cropCmd.Flags().IntVar(&flagHeight, "height", 1024, "Optional: target photo height. default: 1024.")
+	cropCmd.Flags().StringVar(&flagMultiSize, "multi-size", "", "Optional: Comma-separated target sizes (e.g. \"1024x1024,768x1344\"). Each image is cropped to every size, saved to the \"<width>x<height>\" sub dirs of the output dir. Overrides --width and --height.")
+	cropCmd.MarkFlagsMutuallyExclusive("multi-size", "width")
+	cropCmd.MarkFlagsMutuallyExclusive("multi-size", "height")
+	cropCmd.Flags().StringVar(&flagSeries, "series", "", `Optional: Crop image series consistently: the crop window found in the first image of a series is applied to all its images. "dir": all images in the same dir are a series; "prefix": images whose names only differ in the trailing number (e.g. "burst-001.jpg", "burst-002.jpg") are a series`)
+	cropCmd.Flags().Float64Var(&flagHeadroom, "headroom", 0, "Optional: Move the selected crop window up by this percent (0-100) of its height, keeping headroom above faces")
+	cropCmd.Flags().Float64Var(&flagPadding, "padding-percent", 0, "Optional: Expand the selected crop window by this percent of its size on each side (clamped to the image bounds) before resizing, giving the subject breathing room when smartcrop crops too tight")
+	cropCmd.Flags().BoolVar(&flagThirds, "rule-of-thirds", false, "Optional: Move the selected crop window so that the subject is on its upper third line, instead of centered")
+	cropCmd.Flags().BoolVar(&flagTrimBorders, "trim-borders", false, "Optional: Detect and trim the solid-color borders (e.g. letterbox / pillarbox bars, scanner margins) of the images before cropping, so they never end up in the crops")
+	cropCmd.Flags().IntVar(&flagIgnoreEdge, "ignore-border", 0, "Optional: Ignore the strips of this many pixels along the edges of the images in the smartcrop analysis (e.g. of watermarks or frames), so they don't attract the crop window. The window may still include them")
+	cropCmd.Flags().StringArrayVar(&flagExclude, "exclude-region", nil, `Optional: A region "<x>,<y>,<width>,<height>" of the images to ignore in the smartcrop analysis, e.g. a watermarked corner, like --ignore-border. Each value is in pixels, or in percent of the image size (e.g. "80%,85%,20%,15%" is the bottom right corner). Can be set multiple times`)
+	cropCmd.Flags().StringVar(&flagOutputName, "output-name", "", `Optional: Template of the output file names (without the extension), e.g. "{name}_{width}x{height}" or "img_{index}". Fields: {name} (the input file name without the extension), {index} (the 1-based index of the input file in all images of --dir, zero-padded), {width} and {height} (the target size), {hash} (the first 12 hex digits of the SHA-256 of the input file). Note that caption --use-crop-dir requires the input file names. default: the input file name`)
+	cropCmd.Flags().StringVar(&flagOutputExt, "output-ext", "", `Optional: Extension of the output files (".jpg" or ".png"), converting the images to its format. default: the extension of the input file`)
+	cropCmd.Flags().StringSliceVar(&flagSidecars, "copy-sidecars", nil, `Optional: Comma-separated extensions of the sidecar files (e.g. ".txt,.json") of the images to copy next to their output files, renamed after them (e.g. "a.txt" of "a.jpg" => "img_1.txt" of "img_1.png"), keeping image / caption pairs together. The copies are updated when the sidecars change, even if the image is skipped`)
 	cropCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Process and generate the target output file even if the file already exists.")
-	cropCmd.MarkFlagRequired("dir")
+	cropCmd.Flags().BoolVar(&flagChangedOnly, "changed-only", false, "Optional: Also re-process images modified after their output files.")
+	cropCmd.MarkFlagsMutuallyExclusive("force", "changed-only")
+	cropCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar (done/total, ETA, throughput, errors) instead of per-image lines. Ignored if stdout is not a terminal.")
+	cmd.AddRetryFailedFlag(cropCmd.Flags(), &flagRetryFailed, "crop")
+	notify.AddFlag(cropCmd.Flags(), &flagNotify)
+	fileFilter.AddFlags(cropCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(cropCmd.Flags(), "dir")
+	cmd.SetPromptDefault(cropCmd.Flags(), "dir", ".")
 }
 
-func crop(cmd *cobra.Command, args []string) error {
-	// Logic: specific output directory calculation
-	finalOutput := flagOutputDir
-	if finalOutput == "" {
-		absDir, err := filepath.Abs(flagDir)
-		if err != nil {
-			return fmt.Errorf("failed to resolve path %s: %w", flagDir, err)
-		}
-		finalOutput = absDir + "-crop"
+func crop(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
 	}
-
-	if err := os.MkdirAll(finalOutput, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+	var sizes []cropper.Size
+	if flagMultiSize != "" {
+		var err error
+		if sizes, err = cropper.ParseSizes(flagMultiSize); err != nil {
+			return errs.New(errs.ExitConfig, "invalid --multi-size: %v", err)
+		}
 	}
 
-	files, err := os.ReadDir(flagDir)
-	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", flagDir, err)
+	if flagOutputName != "" {
+		if err := cropper.ValidateNameTemplate(flagOutputName); err != nil {
+			return errs.New(errs.ExitConfig, "invalid --output-name: %v", err)
+		}
 	}
-
-	errorCnt := 0
-	for _, file := range files {
-		if file.IsDir() || !isProcessableImage(file.Name()) {
+	var sidecarExts []string
+	for _, ext := range flagSidecars {
+		if ext = strings.TrimSpace(ext); ext == "" {
 			continue
 		}
-
-		inputPath := filepath.Join(flagDir, file.Name())
-		outputPath := filepath.Join(finalOutput, file.Name())
-
-		if !flagForce {
-			if _, err := os.Stat(outputPath); err == nil {
-				fmt.Printf("Skipping %s, output file already exists.\n", inputPath)
-				continue
-			}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
 		}
-
-		if err := processImageFile(inputPath, outputPath, flagWidth, flagHeight); err != nil {
-			fmt.Printf("Failed to process %s: %v\n", inputPath, err)
-			errorCnt++
+		if cropper.IsImageFile("a" + ext) {
+			return errs.New(errs.ExitConfig, "invalid --copy-sidecars %q: not a sidecar extension", ext)
 		}
+		sidecarExts = append(sidecarExts, ext)
 	}
-	if errorCnt > 0 {
-		return fmt.Errorf("%d errors", errorCnt)
+	outputExt := ""
+	if flagOutputExt != "" {
+		var err error
+		if outputExt, err = util.ParseOutputExt(strings.ToLower(flagOutputExt), ""); err != nil ||
+			!cropper.IsImageFile("a"+outputExt) {
+			return errs.New(errs.ExitConfig, "invalid --output-ext %q, must be .jpg, .jpeg or .png", flagOutputExt)
+		}
 	}
-	return nil
-}
 
-func isProcessableImage(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".jpg", ".jpeg", ".png":
-		return true
-	default:
-		return false
+	if flagPadding < 0 {
+		return errs.New(errs.ExitConfig, "invalid --padding-percent %g, must not be negative", flagPadding)
 	}
-}
-
-type resizer struct{}
-
-func (r resizer) Resize(img image.Image, width, height uint) image.Image {
-	// Use the new imaging library's Resize function
-	return imaging.Resize(img, int(width), int(height), imaging.Lanczos)
-}
-
-func processImageFile(inputPath, outputPath string, width, height int) error {
-	file, err := os.Open(inputPath)
-	if err != nil {
-		return err
+	if flagIgnoreEdge < 0 {
+		return errs.New(errs.ExitConfig, "invalid --ignore-border %d, must not be negative", flagIgnoreEdge)
 	}
-	defer file.Close()
-
-	// -----------------------------------------------------------------
-	// START: EXIF Orientation Fix
-	// -----------------------------------------------------------------
-
-	// 1. Read EXIF data first
-	x, err := exif.Decode(file)
-	var orientation int
-	if err == nil { // If EXIF data exists
-		tag, err := x.Get(exif.Orientation)
-		if err == nil { // If Orientation tag exists
-			orientation, _ = tag.Int(0) // Get the orientation value
+	var excludeRegions []cropper.Region
+	for _, str := range flagExclude {
+		region, err := cropper.ParseRegion(str)
+		if err != nil {
+			return errs.New(errs.ExitConfig, "invalid --exclude-region: %v", err)
 		}
+		excludeRegions = append(excludeRegions, region)
 	}
-
-	// 2. Rewind the file to read it again for image decoding
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		return fmt.Errorf("failed to rewind file: %w", err)
+	if flagHeadroom < 0 || flagHeadroom > 100 {
+		return errs.New(errs.ExitConfig, "invalid --headroom %g, must be 0-100", flagHeadroom)
 	}
-
-	// 3. Decode the image (and get its format)
-	img, imgFormat, err := image.Decode(file)
-	if err != nil {
-		return err
+	var seriesKey func(string) string
+	switch flagSeries {
+	case "":
+	case "dir":
+		seriesKey = cropper.SeriesByDir
+	case "prefix":
+		seriesKey = cropper.SeriesByPrefix
+	default:
+		return errs.New(errs.ExitConfig, "invalid --series %q, must be dir or prefix", flagSeries)
 	}
 
-	// 4. Apply rotation IF it's a JPEG and has an orientation tag
-	if imgFormat == "jpeg" && orientation > 1 {
-		img = applyExifOrientation(img, orientation)
+	// Logic: specific output directory calculation
+	finalOutput := flagOutputDir
+	if finalOutput == "" {
+		inputDir := flagDir
+		if len(args) > 0 {
+			inputDir = filepath.Dir(args[0])
+		}
+		absDir, err := filepath.Abs(inputDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path %s: %w", inputDir, err)
+		}
+		finalOutput = absDir + "-crop"
 	}
 
-	// -----------------------------------------------------------------
-	// END: EXIF Orientation Fix
-	// -----------------------------------------------------------------
-
-	// Calculate crop size
-	targetRatio := float64(width) / float64(height)
-	imgWidth := img.Bounds().Dx()
-	imgHeight := img.Bounds().Dy()
-	imgRatio := float64(imgWidth) / float64(imgHeight)
-
-	var cropWidth, cropHeight int
-	if imgRatio > targetRatio {
-		cropHeight = imgHeight
-		cropWidth = int(float64(imgHeight) * targetRatio)
-	} else {
-		cropWidth = imgWidth
-		cropHeight = int(float64(imgWidth) / targetRatio)
+	if err := os.MkdirAll(util.LongPath(finalOutput), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	analyzer := smartcrop.NewAnalyzer(resizer{})
-	topCrop, err := analyzer.FindBestCrop(img, cropWidth, cropHeight)
+	if flagRetryFailed {
+		var err error
+		if args, err = cmd.LoadFailedFiles(flagDir, "crop", args); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			fmt.Printf("No failed image of the last run in %s\n", flagDir)
+			return nil
+		}
+		fmt.Printf("Retrying %d failed images of the last run\n", len(args))
+	}
+	files, err := util.ListInputFiles(flagDir, args)
 	if err != nil {
 		return err
 	}
 
-	type subImager interface {
-		SubImage(r image.Rectangle) image.Image
-	}
-
-	croppedImg := img.(subImager).SubImage(topCrop)
-
-	// Use imaging.Resize for the final resize
-	resizedImg := imaging.Resize(croppedImg, width, height, imaging.Lanczos)
-
-	// -----------------------------------------------------------------
-	// START: Corrected Save Logic
-	// -----------------------------------------------------------------
-
-	// Use imaging.Save, passing the image and the *path string*.
-	ext := strings.ToLower(filepath.Ext(outputPath))
-	switch ext {
-	case ".jpg", ".jpeg":
-		// Correct signature: imaging.Save(image, path, ...options)
-		err = imaging.Save(resizedImg, outputPath, imaging.JPEGQuality(95))
-	case ".png":
-		// Correct signature: imaging.Save(image, path, ...options)
-		err = imaging.Save(resizedImg, outputPath, imaging.PNGCompressionLevel(png.DefaultCompression))
-	default:
-		return fmt.Errorf("unsupported image format: %s", ext)
+	start := time.Now()
+	summary := &notify.Summary{Command: "crop", Dir: flagDir}
+	errorCnt := 0
+	var images []string
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		images = append(images, file.Path)
 	}
-
-	// -----------------------------------------------------------------
-	// END: Corrected Save Logic
-	// -----------------------------------------------------------------
-
-	if err == nil {
-		fmt.Printf("Successfully cropped and resized %s to %s\n", inputPath, outputPath)
+	// {index} is the position in all images of --dir, so that it's stable whichever of them are processed
+	// (e.g. with --retry-failed or the file filters)
+	var indexPaths []string
+	if strings.Contains(flagOutputName, "{"+cropper.NameFieldIndex+"}") {
+		if flagDir == "" {
+			return errs.New(errs.ExitConfig, "--output-name {%s} requires --dir", cropper.NameFieldIndex)
+		}
+		dirFiles, err := util.ListInputFiles(flagDir, nil)
+		if err != nil {
+			return err
+		}
+		for _, file := range dirFiles {
+			if !file.IsDir() && cropper.IsImageFile(file.Name()) {
+				indexPaths = append(indexPaths, file.Path)
+			}
+		}
 	}
-
-	return err
-}
-
-// applyExifOrientation checks for an EXIF orientation tag and rotates the image accordingly.
-func applyExifOrientation(img image.Image, orientation int) image.Image {
-	switch orientation {
-	case 2: // F: Horizontal Flip
-		return imaging.FlipH(img)
-	case 3: // R180: Rotate 180
-		return imaging.Rotate180(img)
-	case 4: // FV: Vertical Flip
-		return imaging.FlipV(img)
-	case 5: // T: Transpose (FlipH + R270)
-		return imaging.Transpose(img)
-	case 6: // R270: Rotate 270 (or 90 clockwise)
-		return imaging.Rotate270(img)
-	case 7: // TV: Transverse (FlipV + R270)
-		return imaging.Transverse(img)
-	case 8: // R90: Rotate 90 (or 270 clockwise)
-		return imaging.Rotate90(img)
-	default: // 1 or unknown
-		return img
+	summary.Total = len(images)
+	// In progress bar mode, only failures are printed (above the bar)
+	progress := util.NewProgress(len(images), flagProgress)
+	failed := &cmd.FailedFiles{}
+	opts := &cropper.Options{Width: flagWidth, Height: flagHeight, Force: flagForce, ChangedOnly: flagChangedOnly,
+		Sizes: sizes, SeriesKey: seriesKey, Headroom: flagHeadroom, RuleOfThirds: flagThirds,
+		PaddingPercent: flagPadding, TrimBorders: flagTrimBorders, IgnoreBorder: flagIgnoreEdge,
+		ExcludeRegions: excludeRegions, NameTemplate: flagOutputName, IndexPaths: indexPaths,
+		OutputExt: outputExt, SidecarExts: sidecarExts, Log: progress}
+	err = cropper.CropFiles(context.Background(), images, finalOutput, opts, func(p *batch.Progress) {
+		switch {
+		case !p.Done:
+			progress.Start(filepath.Base(p.Path))
+		case p.Skipped:
+			if !progress.Enabled {
+				fmt.Printf("Skipping %s, output file already exists.\n", p.Path)
+			}
+			summary.Skipped++
+			progress.Done(false)
+		case p.Err != nil:
+			progress.Done(true)
+			progress.Printf("Failed to process %s: %v\n", p.Path, p.Err)
+			errorCnt++
+			failed.Add(p.Path, p.Err)
+		default:
+			progress.Done(false)
+			if !progress.Enabled {
+				fmt.Printf("Successfully cropped and resized %s to %s\n", p.Path, p.Output)
+			}
+		}
+	})
+	progress.Finish()
+	failed.Save(cmd.InputDir(flagDir, args), "crop")
+	if err != nil {
+		return err
 	}
+	summary.Failed = errorCnt
+	summary.Succeeded = summary.Total - summary.Skipped - summary.Failed
+	summary.Duration = time.Since(start)
+	notify.Send(flagNotify, summary)
+	cmd.RecordFiles(summary.Total, summary.Succeeded, summary.Skipped, summary.Failed)
+	return errs.RunResult(summary.Total-summary.Skipped, errorCnt)
 }
@@ -0,0 +1,152 @@
+package datasetinit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/util"
+)
+
+// Sub dirs of the canonical dataset layout
+const (
+	RAW_DIR     = "raw"
+	CROPPED_DIR = "cropped"
+	REG_DIR     = "reg"
+	OUTPUT_DIR  = "output"
+)
+
+const README_FILENAME = "README.md"
+
+var (
+	flagIdentity   string
+	flagClassToken string
+	flagResolution string
+	flagForce      bool
+)
+
+var datasetInitCmd = &cobra.Command{
+	Use:   "dataset-init [dir]",
+	Short: "Create the folder layout of a new subject dataset",
+	Long: `Create the canonical folder layout of a new subject dataset in dir (default: current dir):
+
+  ` + RAW_DIR + `/       the source images
+  ` + CROPPED_DIR + `/   the cropped images and their captions, the training dir
+  ` + REG_DIR + `/       the regularization images of the class
+  ` + OUTPUT_DIR + `/    the training outputs (checkpoints, logs, samples)
+
+It writes a ` + cmd.SETTINGS_FILENAME + ` settings file with the identity, class token and resolution
+(applied to the commands run on the sub dirs), and a ` + README_FILENAME + ` describing the pipeline.
+Existing files are kept unless --force is set.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: datasetInit,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(datasetInitCmd)
+	datasetInitCmd.Flags().StringVar(&flagIdentity, "identity", "", "Optional: The trigger word of the subject (e.g. 'foobar'), prepended to captions")
+	datasetInitCmd.Flags().StringVar(&flagClassToken, "class-token", "", "Optional: The class word of the subject (e.g. '1girl' or 'person'), inserted into captions")
+	datasetInitCmd.Flags().StringVar(&flagResolution, "resolution", "1024x1024", "Optional: Training resolution (<width>x<height>), the size of the cropped images")
+	datasetInitCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite the existing settings and README files")
+}
+
+// settings is the settings file of a dataset.
+type settings struct {
+	Identity   string `yaml:"identity,omitempty"`
+	ClassToken string `yaml:"class-token,omitempty"`
+	Crop       struct {
+		Width  int `yaml:"width"`
+		Height int `yaml:"height"`
+	} `yaml:"crop"`
+}
+
+func datasetInit(_ *cobra.Command, args []string) error {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	sizes, err := cropper.ParseSizes(flagResolution)
+	if err != nil || len(sizes) != 1 {
+		return errs.New(errs.ExitConfig, "invalid --resolution %q, must be <width>x<height>", flagResolution)
+	}
+	size := sizes[0]
+	for _, sub := range []string{RAW_DIR, CROPPED_DIR, REG_DIR, OUTPUT_DIR} {
+		if err := os.MkdirAll(util.LongPath(filepath.Join(dir, sub)), 0755); err != nil {
+			return fmt.Errorf("failed to create dir: %w", err)
+		}
+	}
+	fmt.Printf("Created %s/, %s/, %s/ and %s/ in %s\n", RAW_DIR, CROPPED_DIR, REG_DIR, OUTPUT_DIR, dir)
+
+	s := &settings{Identity: flagIdentity, ClassToken: flagClassToken}
+	s.Crop.Width, s.Crop.Height = size.Width, size.Height
+	var buf bytes.Buffer
+	buf.WriteString("# goaider settings of this dataset, applied to the commands run on it and its sub dirs.\n" +
+		"# Flags set on the command line take precedence.\n")
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, cmd.SETTINGS_FILENAME), buf.Bytes()); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, README_FILENAME), []byte(readme(dir, size)))
+}
+
+// writeFile writes data to path, unless path exists and --force is not set.
+func writeFile(path string, data []byte) error {
+	if _, err := os.Stat(util.LongPath(path)); err == nil && !flagForce {
+		fmt.Printf("Skipping %s, file already exists.\n", path)
+		return nil
+	}
+	if err := util.WriteFileAtomic(path, data); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", path)
+	return nil
+}
+
+// readme returns the README of the dataset in dir.
+func readme(dir string, size cropper.Size) string {
+	name := filepath.Base(dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		name = filepath.Base(abs)
+	}
+	subject := "the subject"
+	if flagIdentity != "" {
+		subject = "`" + flagIdentity + "`"
+	}
+	if flagClassToken != "" {
+		subject += " (" + flagClassToken + ")"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s\n\n", name)
+	fmt.Fprintf(&sb, "Training dataset of %s at %s, created by `goaider dataset-init`.\n\n", subject, size)
+	sb.WriteString("## Layout\n\n")
+	fmt.Fprintf(&sb, "- `%s/`: the source images. They are never modified.\n", RAW_DIR)
+	fmt.Fprintf(&sb, "- `%s/`: the images cropped to %s and their captions (`.txt`). This is the training dir.\n",
+		CROPPED_DIR, size)
+	fmt.Fprintf(&sb, "- `%s/`: the regularization images of the class.\n", REG_DIR)
+	fmt.Fprintf(&sb, "- `%s/`: the training outputs (checkpoints, logs, samples).\n", OUTPUT_DIR)
+	fmt.Fprintf(&sb, "- `%s`: the identity, class token and resolution, applied to the goaider commands run on this dir "+
+		"and its sub dirs.\n\n", cmd.SETTINGS_FILENAME)
+	sb.WriteString("## Pipeline\n\n")
+	sb.WriteString("Run the commands in this dir:\n\n")
+	fmt.Fprintf(&sb, "1. Put the source images into `%s/`, and move the corrupt ones out of the way:\n"+
+		"   `goaider verify-images --dir %s --move-corrupt`\n", RAW_DIR, RAW_DIR)
+	fmt.Fprintf(&sb, "2. Crop them to the training resolution: `goaider crop --dir %s --output %s`\n", RAW_DIR, CROPPED_DIR)
+	fmt.Fprintf(&sb, "3. Caption the cropped images: `goaider caption --dir %s`\n", CROPPED_DIR)
+	fmt.Fprintf(&sb, "4. Review the captions: `goaider review --dir %s`\n", CROPPED_DIR)
+	fmt.Fprintf(&sb, "5. Train on `%s/` (and `%s/`), writing the outputs to `%s/`.\n", CROPPED_DIR, REG_DIR, OUTPUT_DIR)
+	fmt.Fprintf(&sb, "6. Before training the next version, compare the dataset with the trained one:\n"+
+		"   `goaider tag-drift %s/<lora>.safetensors --dir %s`\n", OUTPUT_DIR, CROPPED_DIR)
+	return sb.String()
+}
@@ -0,0 +1,211 @@
+package describevideo
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	captionPrompt = `Write a caption for this video, optimized for training text-to-video models.
+Describe in one paragraph of plain text: the main subjects and their appearance, the actions and movements,
+the setting, the camera angle and camera movement, lighting and visual style.
+Describe only what is visible. Do not mention the audio. Output only the caption.`
+
+	summaryPrompt = `Summarize this video in a few sentences of plain text: what happens, who appears in it,
+the setting, and any notable spoken content. Output only the summary.`
+
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	// Rough token counts of a request, used for the pre-flight estimate
+	promptTokens = 100
+	outputTokens = 200
+)
+
+var (
+	flagDir               string
+	flagModel             string
+	flagPrompt            string
+	flagSummary           bool
+	flagForce             bool
+	flagYes               bool
+	flagMaxFiles          int
+	flagApiKeysFile       string
+	flagMaxRetryDur       time.Duration
+	flagTimeout           time.Duration
+	flagTimeoutPerMB      time.Duration
+	flagProcessingTimeout time.Duration
+	fileFilter            util.FileFilter
+)
+
+var describeVideoCmd = &cobra.Command{
+	Use:   "describe-video [video]...",
+	Short: "Caption or summarize video files using the Gemini API",
+	Long: `Caption (or summarize, if --summary is set) each video file of a dir using the Gemini API,
+writing the result to a "<name>.txt" sidecar file, for video dataset curation.
+Existing .txt files are skipped unless --force is set.
+
+Videos larger than 20 MiB are uploaded via the Files API and deleted after use.
+Uploaded videos are processed by the server before they can be used, which may take a while
+for long videos (see --processing-timeout).
+
+Supported formats: mp4, mpeg, mov, avi, flv, webm, wmv, 3gp.
+
+Instead of --dir, video files can be given as arguments.
+
+Requires the GEMINI_API_KEY environment variable to be set.`,
+	RunE: describeVideo,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(describeVideoCmd)
+	describeVideoCmd.Flags().StringVar(&flagDir, "dir", "", "Directory containing video files (required unless video files are given as args)")
+	describeVideoCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_MODEL, "The model to use")
+	describeVideoCmd.Flags().StringVar(&flagPrompt, "prompt", "", "Optional: Custom prompt, replacing the built-in caption / summary prompt")
+	describeVideoCmd.Flags().BoolVar(&flagSummary, "summary", false, "Write a summary of each video instead of a caption")
+	describeVideoCmd.Flags().BoolVar(&flagForce, "force", false, "Overwrite existing .txt files")
+	describeVideoCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Start without asking for confirmation of the pre-flight summary")
+	describeVideoCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Abort if the number of videos to process exceeds this limit. 0 = unlimited")
+	describeVideoCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Path of a file of Gemini API keys (one per line), rotated among requests")
+	describeVideoCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 10*time.Minute, "Max total time spent on one video including retries. 0 = unlimited")
+	describeVideoCmd.Flags().DurationVar(&flagTimeout, "timeout", 120*time.Second, "Base timeout of a single API request. 0 = no timeout")
+	describeVideoCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 10*time.Second, "Additional API request timeout per MB of payload")
+	describeVideoCmd.Flags().DurationVar(&flagProcessingTimeout, "processing-timeout", 10*time.Minute, "Max time to wait for the server to process an uploaded video. 0 = unlimited")
+	fileFilter.AddFlags(describeVideoCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(describeVideoCmd.Flags(), "dir")
+	cmd.SetPromptDefault(describeVideoCmd.Flags(), "dir", ".")
+}
+
+func describeVideo(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	prompt := captionPrompt
+	if flagSummary {
+		prompt = summaryPrompt
+	}
+	if flagPrompt != "" {
+		prompt = flagPrompt
+	}
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return err
+	}
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var videos []util.InputFile
+	estimate := &util.UsageEstimate{}
+	for _, file := range files {
+		if file.IsDir() || gemini.VideoMimeType(file.Name()) == "" || !fileFilter.Match(file) {
+			continue
+		}
+		if !flagForce {
+			if _, err := os.Stat(util.LongPath(sidecarPath(file.Path))); err == nil {
+				continue
+			}
+		}
+		videos = append(videos, file)
+		var size int64
+		if info, err := file.Info(); err == nil {
+			size = info.Size()
+		}
+		estimate.AddVideo(size, promptTokens, outputTokens)
+	}
+	if estimate.Files > 0 {
+		if err := cmd.CheckModel(keys, "", flagModel); err != nil {
+			return err
+		}
+	}
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, 0); err != nil {
+		return err
+	}
+
+	client := &gemini.Client{
+		HTTPClient:   &http.Client{},
+		Keys:         keys,
+		Timeout:      flagTimeout,
+		TimeoutPerMB: flagTimeoutPerMB,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+			MaxDuration: flagMaxRetryDur,
+		},
+	}
+	errorCnt := 0
+	for _, file := range videos {
+		text, err := describe(client, file.Path, prompt)
+		if err == nil {
+			err = os.WriteFile(util.LongPath(sidecarPath(file.Path)), []byte(text+"\n"), 0644)
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				return fmt.Errorf("run aborted: %w", err)
+			}
+			continue
+		}
+		fmt.Printf("✅ %s\n", file.Name())
+	}
+	return errs.RunResult(len(videos), errorCnt)
+}
+
+// describe calls the API to caption or summarize the video file at path with prompt.
+func describe(client *gemini.Client, path string, prompt string) (string, error) {
+	ctx := context.Background()
+	mimeType := gemini.VideoMimeType(path)
+	stat, err := os.Stat(util.LongPath(path))
+	if err != nil {
+		return "", err
+	}
+	var videoPart gemini.Part
+	// Base64 encoding inflates inline data by 4/3
+	if stat.Size()*4/3 < gemini.MaxInlineSize {
+		data, err := os.ReadFile(util.LongPath(path))
+		if err != nil {
+			return "", err
+		}
+		videoPart = gemini.Part{InlineData: &gemini.InlineData{
+			MimeType: mimeType,
+			Data:     base64.StdEncoding.EncodeToString(data),
+		}}
+	} else {
+		file, err := client.UploadFile(ctx, path, mimeType)
+		if err != nil {
+			return "", fmt.Errorf("failed to upload video: %w", err)
+		}
+		defer client.DeleteFile(ctx, file)
+		file, err = client.WaitFileActive(ctx, file, flagProcessingTimeout)
+		if err != nil {
+			return "", err
+		}
+		videoPart = file.Part()
+	}
+	// Gemini recommends placing the video before the text prompt
+	return client.GenerateText(ctx, flagModel, &gemini.Request{
+		Contents: []gemini.Content{{Parts: []gemini.Part{videoPart, {Text: prompt}}}},
+	})
+}
+
+// sidecarPath returns the path of the .txt sidecar file of the video at path.
+func sidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".txt"
+}
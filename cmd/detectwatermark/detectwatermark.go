@@ -0,0 +1,413 @@
+package detectwatermark
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/pkg/embedder"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// SidecarSuffix is the suffix of the sidecar file of the detection result, e.g. "foo.watermark.json" of "foo.jpg"
+	SidecarSuffix = ".watermark.json"
+
+	// The folder (next to the images) where the flagged images are moved by --move
+	moveDir = "_watermarked"
+)
+
+// Detection providers, the values of --provider
+const (
+	providerAuto   = "auto"
+	providerGemini = "gemini"
+	providerLocal  = "local"
+)
+
+// Region labels
+const (
+	LabelWatermark = "watermark"
+	LabelText      = "text"
+)
+
+const (
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	// JPEG quality of the images sent to the API. The box coordinates of the model are normalized,
+	// so they apply to the original (not downscaled) image as well
+	uploadQuality = 90
+
+	// Rough token counts of a detection request, used for the pre-flight estimate
+	detectPromptTokens = 150
+	detectOutputTokens = 80
+
+	// Scale of the CLIP similarities (the logit scale of CLIP) of the zero-shot classification of the local model
+	logitScale = 100
+)
+
+const detectPrompt = `Detect the watermarks and overlaid text of this image, which should be removed before training
+an image model on it:
+- "watermark": logos, stamps, signatures, copyright notices and website / social media handles added on top of the image,
+  including semi-transparent ones.
+- "text": captions, subtitles, meme text, timestamps and other text overlaid on the image.
+Natural text that is part of the scene (signs, book covers, clothing prints) is neither.
+Return the bounding box of each region as "box_2d": [ymin, xmin, ymax, xmax], normalized to 0-1000.
+Return an empty list if there is none.`
+
+var detectSchema = &gemini.Schema{
+	Type: "ARRAY",
+	Items: &gemini.Schema{
+		Type: "OBJECT",
+		Properties: map[string]*gemini.Schema{
+			"label":  {Type: "STRING", Description: `"watermark" or "text"`},
+			"box_2d": {Type: "ARRAY", Items: &gemini.Schema{Type: "INTEGER"}},
+		},
+		Required: []string{"label", "box_2d"},
+	},
+}
+
+// The zero-shot prompts of the local model: an image is flagged by the probability of the first one
+var localPrompts = []string{
+	"a photo with a watermark, a logo or text overlaid on it",
+	"a clean photo without any watermark or text",
+}
+
+// Result is the detection result of an image, saved to its SidecarSuffix sidecar file.
+type Result struct {
+	// Whether the image has a visible watermark or overlaid text
+	Watermarked bool `json:"watermarked"`
+	// The probability of a watermark of the local model. Not set by Gemini
+	Score float64 `json:"score,omitempty"`
+	// The detected regions, only by Gemini
+	Regions []*Region `json:"regions,omitempty"`
+	// The provider that detected it: "gemini" or "local:<model>"
+	Provider string `json:"provider"`
+}
+
+// Region is a detected watermark or text region, in the pixels of the upright image (after the EXIF orientation).
+type Region struct {
+	Label string `json:"label"` // LabelWatermark or LabelText
+	cropper.Rect
+}
+
+// SidecarPath returns the path of the detection result sidecar file of the image at path.
+func SidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + SidecarSuffix
+}
+
+// LoadResult reads the detection result sidecar file of the image at path.
+func LoadResult(path string) (*Result, error) {
+	data, err := os.ReadFile(util.LongPath(SidecarPath(path)))
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", filepath.Base(SidecarPath(path)), err)
+	}
+	return result, nil
+}
+
+var (
+	flagDir           string
+	flagProvider      string
+	flagModel         string
+	flagThreshold     float64
+	flagMove          bool
+	flagForce         bool
+	flagYes           bool
+	flagMaxFiles      int
+	flagUploadMaxSize int
+	flagApiKeysFile   string
+	flagMaxRetryDur   time.Duration
+	flagTimeout       time.Duration
+	flagTimeoutPerMB  time.Duration
+	embedOptions      embedder.Options
+	fileFilter        util.FileFilter
+)
+
+var detectWatermarkCmd = &cobra.Command{
+	Use:   "detect-watermark [image]...",
+	Short: "Flag the images with visible watermarks or overlaid text",
+	Long: `Detect the visible watermarks (logos, signatures, website handles...) and overlaid text (captions, meme text,
+timestamps...) of each image of a dir, so that the flagged images can be excluded or inpainted before training.
+The result of each image is written to a "<name>` + SidecarSuffix + `" sidecar file: whether it's watermarked,
+and the detected regions (Gemini only, in pixels), which the inpaint command can fill.
+Existing sidecar files are skipped unless --force is set; their results are still listed.
+
+--provider:
+- gemini: use the Gemini API, which also locates the regions. Requires the GEMINI_API_KEY environment variable to be set.
+- local: zero-shot classification by the local CLIP model (--embed-model), which must have a text encoder.
+  Images whose watermark probability is at least --threshold are flagged. No regions are detected.
+- auto (default): use Gemini if an API key is set, otherwise the local model.
+
+The flagged images are listed at the end; set --move to move them (with their sidecar files, e.g. captions)
+to the "` + moveDir + `" folder next to them.
+Instead of --dir, image files can be given as arguments.`,
+	RunE: detectWatermark,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(detectWatermarkCmd)
+	detectWatermarkCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	detectWatermarkCmd.Flags().StringVar(&flagProvider, "provider", providerAuto, "Optional: Detection provider: "+providerAuto+" | "+providerGemini+" | "+providerLocal)
+	detectWatermarkCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_MODEL, "Optional: The Gemini model to use")
+	detectWatermarkCmd.Flags().Float64Var(&flagThreshold, "threshold", 0.5, "Optional: Min watermark probability (0.0-1.0) of the local model, at which an image is flagged")
+	detectWatermarkCmd.Flags().BoolVar(&flagMove, "move", false, "Optional: Move the flagged images (with their sidecar files) to the "+moveDir+" folder next to them")
+	detectWatermarkCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing "+SidecarSuffix+" files")
+	detectWatermarkCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Optional: Start without asking for confirmation of the pre-flight summary")
+	detectWatermarkCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Optional: Abort if the number of images to process exceeds this limit. 0 = unlimited")
+	detectWatermarkCmd.Flags().IntVar(&flagUploadMaxSize, "upload-max-size", 2048, "Optional: Downscale images whose longest side exceeds this (pixels) before sending to the API. 0 = disable")
+	detectWatermarkCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Optional: Path of a file of Gemini API keys (one per line), rotated among requests")
+	detectWatermarkCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Optional: Max total time spent on one image including retries. 0 = unlimited")
+	detectWatermarkCmd.Flags().DurationVar(&flagTimeout, "timeout", 60*time.Second, "Optional: Base timeout of a single API request. 0 = no timeout")
+	detectWatermarkCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 5*time.Second, "Optional: Additional API request timeout per MB of payload")
+	embedOptions.AddFlags(detectWatermarkCmd.Flags())
+	fileFilter.AddFlags(detectWatermarkCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(detectWatermarkCmd.Flags(), "dir")
+	cmd.SetPromptDefault(detectWatermarkCmd.Flags(), "dir", ".")
+}
+
+// detector detects the watermarks of an image.
+type detector func(path string) (*Result, error)
+
+func detectWatermark(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagThreshold < 0 || flagThreshold > 1 {
+		return errs.New(errs.ExitConfig, "invalid --threshold %v: must be in 0.0-1.0", flagThreshold)
+	}
+	var keys *gemini.KeyPool
+	var err error
+	switch flagProvider {
+	case providerGemini:
+		if keys, err = gemini.LoadKeys(flagApiKeysFile); err != nil {
+			return err
+		}
+	case providerLocal:
+	case providerAuto:
+		if keys, err = gemini.LoadKeys(flagApiKeysFile); err != nil {
+			if !embedOptions.Configured() {
+				return errs.New(errs.ExitConfig, "neither a Gemini API key is set (%v) nor the local model (--embed-model)", err)
+			}
+			fmt.Printf("No Gemini API key set, using the local model\n")
+		}
+	default:
+		return errs.New(errs.ExitConfig, "invalid --provider %q", flagProvider)
+	}
+
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []util.InputFile
+	results := map[string]*Result{} // of all images, including the skipped ones
+	estimate := &util.UsageEstimate{ImageMaxSide: flagUploadMaxSize}
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		if !flagForce {
+			if result, err := LoadResult(file.Path); err == nil {
+				results[file.Path] = result
+				continue
+			}
+		}
+		images = append(images, file)
+		if keys != nil {
+			var size int64
+			if info, err := file.Info(); err == nil {
+				size = info.Size()
+			}
+			estimate.AddImage(file.Path, size, detectPromptTokens, detectOutputTokens)
+		}
+	}
+	if estimate.Files > 0 {
+		if err := cmd.CheckModel(keys, "", flagModel); err != nil {
+			return err
+		}
+	}
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, 0); err != nil {
+		return err
+	}
+
+	var detect detector
+	if keys != nil {
+		client := &gemini.Client{
+			HTTPClient:   &http.Client{},
+			Keys:         keys,
+			Timeout:      flagTimeout,
+			TimeoutPerMB: flagTimeoutPerMB,
+			Retry: util.RetryPolicy{
+				MaxRetries:  maxRetries,
+				BaseBackoff: baseBackoff,
+				MaxBackoff:  maxBackoff,
+				MaxDuration: flagMaxRetryDur,
+			},
+		}
+		detect = func(path string) (*Result, error) { return geminiDetect(client, path) }
+	} else if len(images) > 0 {
+		e, err := embedder.New(&embedOptions)
+		if err != nil {
+			return err
+		}
+		defer e.Close()
+		var prompts [][]float32
+		for _, prompt := range localPrompts {
+			v, err := e.EmbedText(prompt)
+			if err != nil {
+				return errs.Wrap(errs.ExitConfig, err)
+			}
+			prompts = append(prompts, v)
+		}
+		provider := embedder.LocalModelName(&embedOptions)
+		detect = func(path string) (*Result, error) { return localDetect(e, prompts, provider, path) }
+	}
+
+	fmt.Printf("Checking %d images (%d already checked)\n", len(images), len(results))
+	errorCnt := 0
+	for _, file := range images {
+		result, err := detect(file.Path)
+		if err == nil {
+			var data []byte
+			if data, err = json.MarshalIndent(result, "", "  "); err == nil {
+				err = util.WriteFileAtomic(SidecarPath(file.Path), data)
+			}
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				return fmt.Errorf("run aborted: %w", err)
+			}
+			continue
+		}
+		results[file.Path] = result
+		fmt.Printf("✅ %s: %s\n", file.Name(), result)
+	}
+
+	var flagged []string
+	for path, result := range results {
+		if result.Watermarked {
+			flagged = append(flagged, path)
+		}
+	}
+	slices.Sort(flagged)
+	fmt.Printf("%d of %d images have watermarks or overlaid text:\n", len(flagged), len(results))
+	for _, path := range flagged {
+		fmt.Printf("  %s: %s\n", path, results[path])
+		if flagMove {
+			target := filepath.Join(filepath.Dir(path), moveDir)
+			if err := cropper.MoveImage(path, target); err != nil {
+				fmt.Printf("    failed to move: %v\n", err)
+				errorCnt++
+			} else {
+				fmt.Printf("    moved to %s\n", target)
+			}
+		}
+	}
+	return errs.RunResult(len(images), errorCnt)
+}
+
+// String returns the summary of the result, e.g. "watermarked (1 watermark, 2 text)" or "clean (0.123)".
+func (r *Result) String() string {
+	summary := "clean"
+	if r.Watermarked {
+		summary = "watermarked"
+	}
+	var details []string
+	for _, label := range []string{LabelWatermark, LabelText} {
+		if count := len(slices.DeleteFunc(slices.Clone(r.Regions), func(r *Region) bool { return r.Label != label })); count > 0 {
+			details = append(details, fmt.Sprintf("%d %s", count, label))
+		}
+	}
+	if r.Score > 0 {
+		details = append(details, fmt.Sprintf("%.3f", r.Score))
+	}
+	if len(details) > 0 {
+		summary += " (" + strings.Join(details, ", ") + ")"
+	}
+	return summary
+}
+
+// geminiDetect detects the watermark and text regions of the image at path using the Gemini API.
+func geminiDetect(client *gemini.Client, path string) (*Result, error) {
+	img, _, err := util.LoadImage(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gemini.NewImageData(img, flagUploadMaxSize, uploadQuality)
+	if err != nil {
+		return nil, err
+	}
+	text, err := client.GenerateText(context.Background(), flagModel, &gemini.Request{
+		Contents: []gemini.Content{{Parts: []gemini.Part{{InlineData: data}, {Text: detectPrompt}}}},
+		GenerationConfig: &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   detectSchema,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var boxes []struct {
+		Label string `json:"label"`
+		Box   []int  `json:"box_2d"` // [ymin, xmin, ymax, xmax], normalized to 0-1000
+	}
+	if err := json.Unmarshal([]byte(text), &boxes); err != nil {
+		return nil, fmt.Errorf("invalid detection response %q: %w", text, err)
+	}
+	result := &Result{Provider: providerGemini}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	for _, box := range boxes {
+		// Drop malformed boxes and other labels
+		if len(box.Box) != 4 || box.Box[0] >= box.Box[2] || box.Box[1] >= box.Box[3] ||
+			(box.Label != LabelWatermark && box.Label != LabelText) {
+			continue
+		}
+		rect := image.Rect(box.Box[1]*width/1000, box.Box[0]*height/1000,
+			box.Box[3]*width/1000, box.Box[2]*height/1000).Intersect(image.Rect(0, 0, width, height))
+		if rect.Empty() {
+			continue
+		}
+		result.Regions = append(result.Regions, &Region{Label: box.Label,
+			Rect: cropper.Rect{X: rect.Min.X, Y: rect.Min.Y, Width: rect.Dx(), Height: rect.Dy()}})
+	}
+	result.Watermarked = len(result.Regions) > 0
+	return result, nil
+}
+
+// localDetect classifies the image at path by the similarities of its embedding to the localPrompts embeddings.
+func localDetect(e embedder.Embedder, prompts [][]float32, provider string, path string) (*Result, error) {
+	v, err := embedder.EmbedImageFile(e, path)
+	if err != nil {
+		return nil, err
+	}
+	// The softmax of the scaled similarities, as the zero-shot classification of CLIP
+	var sum float64
+	probs := make([]float64, len(prompts))
+	for i, prompt := range prompts {
+		probs[i] = math.Exp(logitScale * embedder.Similarity(v, prompt))
+		sum += probs[i]
+	}
+	score := probs[0] / sum
+	return &Result{Watermarked: score >= flagThreshold, Score: score, Provider: provider}, nil
+}
@@ -0,0 +1,196 @@
+package editcaptions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir       string
+	flagFind      string
+	flagReplace   string
+	flagRemove    []string
+	flagInsert    []string
+	flagInsertPos int
+	flagExt       string
+	flagRecursive bool
+	flagDryRun    bool
+	flagNoBackup  bool
+	fileFilter    util.FileFilter
+)
+
+var editCaptionsCmd = &cobra.Command{
+	Use:   "edit-captions [caption.txt]...",
+	Short: "Find / replace, insert and remove tags in the captions of a dir",
+	Long: `Edit the captions (.txt files) of a dir in place, instead of sed one-liners:
+- --find / --replace: replace the matches of a regular expression (Go syntax) in the captions,
+  e.g. --find "\bgirl\b" --replace "woman". The replacement can refer to submatches as $1 / ${name}.
+- --remove: remove the tags (of comma-separated captions) equal to a tag (case-insensitive),
+  or matching a "/regexp/". Can be set multiple times.
+- --insert: insert a tag at --insert-pos (0-based tag position, -1 = append to the end),
+  skipped if the caption already has it. Can be set multiple times; the tags are inserted in order.
+The edits are applied in this order.
+
+Use --dry-run to preview the changes (the old and new caption of each changed file).
+The old versions of changed captions are backed up (see captions-diff / captions-restore)
+unless --no-backup is set.
+Instead of --dir, caption files can be given as arguments.`,
+	RunE: editCaptions,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(editCaptionsCmd)
+	editCaptionsCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless caption files are given as args): Path to the dir of the captions")
+	editCaptionsCmd.Flags().StringVar(&flagFind, "find", "", "Optional: Regular expression (Go syntax) to find in the captions")
+	editCaptionsCmd.Flags().StringVar(&flagReplace, "replace", "", "Optional: Replacement of the --find matches. $1 / ${name} refer to submatches. default: remove the matches")
+	editCaptionsCmd.Flags().StringArrayVar(&flagRemove, "remove", nil, `Optional: Remove the tags equal to this tag (case-insensitive) or matching this "/regexp/". Can be set multiple times`)
+	editCaptionsCmd.Flags().StringArrayVar(&flagInsert, "insert", nil, "Optional: Insert this tag (if the caption does not have it). Can be set multiple times")
+	editCaptionsCmd.Flags().IntVar(&flagInsertPos, "insert-pos", -1, "Optional: 0-based tag position to insert the --insert tags at. -1 = append to the end")
+	editCaptionsCmd.Flags().StringVar(&flagExt, "ext", ".txt", "Optional: Extension of the caption files, e.g. .caption")
+	editCaptionsCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also edit the captions in the subdirectories of --dir (except hidden ones)")
+	editCaptionsCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "Optional: Only print the changes, do not write them")
+	editCaptionsCmd.Flags().BoolVar(&flagNoBackup, "no-backup", false, "Optional: Do not back up changed captions (to "+util.BACKUPS_DIR+"/<time>/) before overwriting them")
+	fileFilter.AddFlags(editCaptionsCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(editCaptionsCmd.Flags(), "dir")
+	cmd.SetPromptDefault(editCaptionsCmd.Flags(), "dir", ".")
+}
+
+func editCaptions(c *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagFind == "" && len(flagRemove) == 0 && len(flagInsert) == 0 {
+		return errs.New(errs.ExitConfig, "nothing to do: set --find, --remove or --insert")
+	}
+	if c.Flags().Changed("replace") && flagFind == "" {
+		return errs.New(errs.ExitConfig, "--replace requires --find")
+	}
+	var find *regexp.Regexp
+	if flagFind != "" {
+		var err error
+		if find, err = regexp.Compile(flagFind); err != nil {
+			return errs.New(errs.ExitConfig, "invalid --find: %w", err)
+		}
+	}
+	removeMatch, err := parseTagPatterns(flagRemove)
+	if err != nil {
+		return errs.New(errs.ExitConfig, "invalid --remove: %w", err)
+	}
+	for _, tag := range flagInsert {
+		if strings.TrimSpace(tag) == "" || strings.Contains(tag, ",") {
+			return errs.New(errs.ExitConfig, "invalid --insert %q: must be a single non-empty tag", tag)
+		}
+	}
+	ext, err := util.ParseOutputExt(flagExt, ".txt", ".json")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var backup *util.Backup
+	if !flagDryRun && !flagNoBackup {
+		backup = util.NewBackup()
+	}
+
+	total, changedCnt, writtenCnt, errorCnt := 0, 0, 0, 0
+	for _, file := range files {
+		if file.IsDir() || !strings.EqualFold(filepath.Ext(file.Name()), ext) || !fileFilter.Match(file) {
+			continue
+		}
+		total++
+		content, err := os.ReadFile(util.LongPath(file.Path))
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Path, err)
+			errorCnt++
+			continue
+		}
+		bom := strings.HasPrefix(string(content), util.UTF8_BOM)
+		caption := strings.TrimRight(strings.TrimPrefix(string(content), util.UTF8_BOM), "\r\n")
+		edited := caption
+		if find != nil {
+			edited = find.ReplaceAllString(edited, flagReplace)
+		}
+		if removeMatch != nil {
+			edited = captioner.RemoveTags(edited, removeMatch)
+		}
+		for i, tag := range flagInsert {
+			pos := flagInsertPos
+			if pos >= 0 {
+				pos += i
+			}
+			edited = captioner.InsertTag(edited, tag, pos)
+		}
+		if edited == caption {
+			continue
+		}
+		changedCnt++
+		if flagDryRun {
+			fmt.Printf("%s:\n- %s\n+ %s\n", file.Path, caption, edited)
+			continue
+		}
+		if backup != nil {
+			err = backup.Save(file.Path)
+		}
+		if err == nil {
+			err = util.WriteTextFile(file.Path, edited, bom)
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Path, err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("✅ %s: %s\n", file.Path, edited)
+		writtenCnt++
+	}
+	if flagDryRun {
+		fmt.Printf("Dry run. %d of %d captions would be changed\n", changedCnt, total)
+		return nil
+	}
+	fmt.Printf("Done. %d of %d captions changed, %d failed\n", writtenCnt, total, errorCnt)
+	if backup != nil && writtenCnt > 0 {
+		fmt.Printf("Old versions are backed up to backup %s (see captions-diff / captions-restore)\n", backup.ID)
+	}
+	return errs.RunResult(writtenCnt+errorCnt, errorCnt)
+}
+
+// parseTagPatterns returns the func that reports whether a tag matches any of the patterns:
+// a tag (case-insensitive) or a "/regexp/". It returns nil if there is no pattern.
+func parseTagPatterns(patterns []string) (func(tag string) bool, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var tags []string
+	var regexps []*regexp.Regexp
+	for _, pattern := range patterns {
+		if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, err
+			}
+			regexps = append(regexps, re)
+		} else if tag := strings.TrimSpace(pattern); tag != "" {
+			tags = append(tags, strings.ToLower(tag))
+		}
+	}
+	return func(tag string) bool {
+		return slices.Contains(tags, strings.ToLower(tag)) ||
+			slices.ContainsFunc(regexps, func(re *regexp.Regexp) bool { return re.MatchString(tag) })
+	}, nil
+}
@@ -0,0 +1,293 @@
+package embed
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/pkg/embedder"
+	"github.com/sagan/goaider/util"
+)
+
+// Embedding types, the values of --type
+const (
+	typeImage = "image"
+	typeText  = "text"
+)
+
+// Text embedding providers, the values of --text-provider
+const (
+	providerLocal  = "local"
+	providerGemini = "gemini"
+)
+
+const (
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+)
+
+var (
+	flagDir          string
+	flagOutput       string
+	flagTypes        []string
+	flagTextProvider string
+	flagTextModel    string
+	flagCaptionExt   string
+	flagRecursive    bool
+	flagForce        bool
+	flagProgress     bool
+	flagApiKeysFile  string
+	embedOptions     embedder.Options
+	fileFilter       util.FileFilter
+)
+
+var embedCmd = &cobra.Command{
+	Use:   "embed [image]...",
+	Short: "Compute the image and caption embeddings of a dataset",
+	Long: `Compute the embeddings of the images (and / or their captions) of a dataset and save them to a
+NumPy .npz file keyed by file name (default "<dir>/.goaider/embeddings.npz"), for clustering, dedup and retrieval
+(the cluster and search commands, or your own scripts: numpy.load(path)).
+
+--type:
+- image (default): the image embeddings of the local CLIP or SigLIP model (--embed-model).
+- text: the embeddings of the caption files (--caption-ext) of the images, by --text-provider:
+  - local (default): the text encoder of the local CLIP model, in the same space as the image embeddings,
+    so that images can be searched by text.
+  - gemini: the Gemini embedding API (--text-model). Requires the GEMINI_API_KEY environment variable to be set.
+
+The arrays of the .npz file: "files" (the paths relative to --dir), "image" and "text"
+(n x dimensions float32, L2-normalized; the rows of files without an embedding are zero),
+"mtimes", "image_model" and "text_model". Existing embeddings of unchanged files (and captions)
+are kept unless --force is set.
+Instead of --dir, image files can be given as arguments.`,
+	RunE: embed,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(embedCmd)
+	embedCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	embedCmd.Flags().StringVar(&flagOutput, "output", "", `Optional: Path of the output .npz file. default: "<dir>/.goaider/embeddings.npz"`)
+	embedCmd.Flags().StringSliceVar(&flagTypes, "type", []string{typeImage}, "Optional: Comma-separated embedding types: "+typeImage+", "+typeText+" (of the caption files)")
+	embedCmd.Flags().StringVar(&flagTextProvider, "text-provider", providerLocal, "Optional: The provider of the text embeddings: "+providerLocal+" (the text encoder of the local model) or "+providerGemini+" (the Gemini embedding API)")
+	embedCmd.Flags().StringVar(&flagTextModel, "text-model", gemini.DefaultEmbeddingModel, "Optional: The Gemini embedding model of --text-provider "+providerGemini)
+	embedCmd.Flags().StringVar(&flagCaptionExt, "caption-ext", ".txt", "Optional: Extension of the caption files of --type "+typeText)
+	embedCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also embed the images in the subdirectories of --dir (except hidden ones)")
+	embedCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Re-compute all embeddings, even those of unchanged files")
+	embedCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar instead of per-image lines. Ignored if stdout is not a terminal")
+	embedCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Optional: Path of a file of Gemini API keys (one per line), rotated among requests")
+	embedOptions.AddFlags(embedCmd.Flags())
+	fileFilter.AddFlags(embedCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(embedCmd.Flags(), "dir")
+	cmd.SetPromptDefault(embedCmd.Flags(), "dir", ".")
+}
+
+func embed(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	for _, t := range flagTypes {
+		if t != typeImage && t != typeText {
+			return errs.New(errs.ExitConfig, "invalid --type %q", t)
+		}
+	}
+	withImage, withText := slices.Contains(flagTypes, typeImage), slices.Contains(flagTypes, typeText)
+	if !withImage && !withText {
+		return errs.New(errs.ExitConfig, "--type must not be empty")
+	}
+	if flagTextProvider != providerLocal && flagTextProvider != providerGemini {
+		return errs.New(errs.ExitConfig, "invalid --text-provider %q", flagTextProvider)
+	}
+	captionExt, err := util.ParseOutputExt(flagCaptionExt, ".txt")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	inputDir := cmd.InputDir(flagDir, args)
+	output := flagOutput
+	if output == "" {
+		output = embedder.DefaultStorePath(inputDir)
+	}
+
+	// 1. Load the models
+	var e embedder.Embedder
+	var client *gemini.Client
+	imageModel, textModel := "", ""
+	if withImage || (withText && flagTextProvider == providerLocal) {
+		if e, err = embedder.New(&embedOptions); err != nil {
+			return err
+		}
+		defer e.Close()
+	}
+	if withImage {
+		imageModel = embedder.LocalModelName(&embedOptions)
+	}
+	if withText {
+		if flagTextProvider == providerLocal {
+			// Check that the model has a text encoder
+			if _, err := e.EmbedText(""); err != nil {
+				return errs.Wrap(errs.ExitConfig, err)
+			}
+			textModel = embedder.LocalModelName(&embedOptions)
+		} else {
+			keys, err := gemini.LoadKeys(flagApiKeysFile)
+			if err != nil {
+				return err
+			}
+			client = &gemini.Client{
+				HTTPClient: &http.Client{},
+				Keys:       keys,
+				Timeout:    60 * time.Second,
+				Retry:      util.RetryPolicy{MaxRetries: maxRetries, BaseBackoff: baseBackoff},
+			}
+			textModel = providerGemini + ":" + flagTextModel
+		}
+	}
+
+	// 2. List the images, and reuse the existing embeddings of unchanged files of the same models
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var old *embedder.Store
+	var oldIndex map[string]int
+	if !flagForce {
+		if old, err = embedder.LoadStore(output); err == nil {
+			oldIndex = old.Index()
+		} else if !os.IsNotExist(err) {
+			fmt.Printf("Warning: failed to load the existing embeddings %s (%v), re-computing all\n", output, err)
+		}
+	}
+	store := &embedder.Store{ImageModel: imageModel, TextModel: textModel}
+	var captions []string
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		name := file.Path
+		if rel, err := filepath.Rel(inputDir, file.Path); err == nil {
+			name = filepath.ToSlash(rel)
+		}
+		var mtime int64
+		if info, err := file.Info(); err == nil {
+			mtime = info.ModTime().UnixNano()
+		}
+		caption := ""
+		if withText {
+			captionPath := captioner.CaptionFilePath(file.Path, captionExt)
+			if data, err := os.ReadFile(util.LongPath(captionPath)); err == nil {
+				caption = strings.TrimSpace(strings.TrimPrefix(string(data), util.UTF8_BOM))
+				if info, err := os.Stat(util.LongPath(captionPath)); err == nil {
+					mtime = max(mtime, info.ModTime().UnixNano())
+				}
+			}
+		}
+		store.Files = append(store.Files, name)
+		store.Mtimes = append(store.Mtimes, mtime)
+		captions = append(captions, caption)
+	}
+	if withImage {
+		store.Image = make([][]float32, len(store.Files))
+	}
+	if withText {
+		store.Text = make([][]float32, len(store.Files))
+	}
+	var todo []int // the files of which any embedding is to be computed
+	for i, name := range store.Files {
+		if j, ok := oldIndex[name]; ok && old.Mtimes[j] == store.Mtimes[i] {
+			if withImage && old.ImageModel == imageModel && old.Image != nil {
+				store.Image[i] = old.Image[j]
+			}
+			if withText && old.TextModel == textModel && old.Text != nil {
+				store.Text[i] = old.Text[j]
+			}
+		}
+		if (withImage && store.Image[i] == nil) || (withText && store.Text[i] == nil && captions[i] != "") {
+			todo = append(todo, i)
+		}
+	}
+	fmt.Printf("Computing the embeddings of %d images (%d up to date) into %q\n", len(todo),
+		len(store.Files)-len(todo), output)
+
+	// 3. Compute the embeddings
+	errorCnt := 0
+	progress := util.NewProgress(len(todo), flagProgress && util.IsTerminal(os.Stdout))
+	var apiTexts []int // the files of which the text embeddings are requested from the API
+	for _, i := range todo {
+		name := store.Files[i]
+		progress.Start(name)
+		err := func() error {
+			if withImage && store.Image[i] == nil {
+				v, err := embedder.EmbedImageFile(e, filepath.Join(inputDir, filepath.FromSlash(name)))
+				if err != nil {
+					return err
+				}
+				store.Image[i] = v
+			}
+			if withText && store.Text[i] == nil && captions[i] != "" {
+				if client != nil {
+					apiTexts = append(apiTexts, i)
+					return nil
+				}
+				v, err := e.EmbedText(captions[i])
+				if err != nil {
+					return err
+				}
+				store.Text[i] = v
+			}
+			return nil
+		}()
+		progress.Done(err != nil)
+		if err != nil {
+			progress.Printf("❌ %s: %v\n", name, err)
+			errorCnt++
+			// Saved without its embeddings (and the mtime), so that the next run retries it
+			store.Mtimes[i] = 0
+		} else if !progress.Enabled {
+			fmt.Printf("✅ %s\n", name)
+		}
+	}
+	progress.Finish()
+	if len(apiTexts) > 0 {
+		fmt.Printf("Requesting the text embeddings of %d captions from %s\n", len(apiTexts), flagTextModel)
+		var texts []string
+		for _, i := range apiTexts {
+			texts = append(texts, captions[i])
+		}
+		embeddings, err := client.EmbedTexts(context.Background(), flagTextModel, texts)
+		if err != nil {
+			fmt.Printf("❌ failed to get the text embeddings: %v\n", err)
+			errorCnt += len(apiTexts)
+			for _, i := range apiTexts {
+				store.Mtimes[i] = 0
+			}
+		} else {
+			for j, i := range apiTexts {
+				store.Text[i] = embedder.Normalize(embeddings[j])
+			}
+		}
+	}
+
+	if err := os.MkdirAll(util.LongPath(filepath.Dir(output)), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := store.Save(output); err != nil {
+		return fmt.Errorf("failed to save the embeddings: %w", err)
+	}
+	fmt.Printf("Saved the embeddings of %d images to %s\n", len(store.Files), output)
+	return errs.RunResult(len(todo), errorCnt)
+}
@@ -0,0 +1,279 @@
+package export
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/cmd/thumbs"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/parquet"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	formatWebDataset = "webdataset"
+	formatParquet    = "parquet"
+)
+
+var (
+	flagDir       string
+	flagOutput    string
+	flagFormat    string
+	flagPrefix    string
+	flagShardSize int
+	flagExt       string
+	flagRecursive bool
+	flagForce     bool
+	fileFilter    util.FileFilter
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the images and captions of a dir as WebDataset tar shards or parquet files",
+	Long: `Export the captioned images of a dir (with their .txt captions and .json metadata sidecar files)
+as shards for training frameworks that stream data. Each shard is at most --shard-size MiB
+(except a shard of a single larger image). Images without a caption are skipped.
+
+--format:
+- webdataset: "<prefix>-000000.tar", ... tar shards of WebDataset (https://github.com/webdataset/webdataset).
+  The files of a sample are "<key>.<image ext>", "<key>.txt" (the caption) and "<key>.json" (the metadata
+  sidecar, if any), where key is the image path in the dir without the extension, with "." replaced by "_".
+- parquet: "<prefix>-00000-of-00003.parquet", ... parquet files of the columns "image" ({bytes, path},
+  the Image feature of HuggingFace datasets), "caption" and "metadata" (the JSON of the metadata sidecar,
+  "" if none).
+
+The default prefix "train" makes the shards the train split of a HuggingFace dataset (see push-hub).`,
+	Args: cobra.NoArgs,
+	RunE: export,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dataset dir")
+	exportCmd.Flags().StringVar(&flagFormat, "format", formatWebDataset, "Optional: Output format: webdataset | parquet")
+	exportCmd.Flags().StringVar(&flagOutput, "output", "", `Optional: Output dir of the shards. Default: "<dir name>-<format>" in current dir`)
+	exportCmd.Flags().StringVar(&flagPrefix, "prefix", "train", "Optional: Filename prefix of the shards")
+	exportCmd.Flags().IntVar(&flagShardSize, "shard-size", 1024, "Optional: Max size of a shard in MiB")
+	exportCmd.Flags().StringVar(&flagExt, "ext", ".txt", "Optional: Extension of the caption files, e.g. .caption")
+	exportCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also export the images in the subdirectories of --dir (except hidden ones)")
+	exportCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing shards")
+	fileFilter.AddFlags(exportCmd.Flags())
+	exportCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(exportCmd.Flags(), "dir", ".")
+}
+
+// sample is a captioned image of the dataset.
+type sample struct {
+	name     string // path relative to the dir, with forward slashes
+	path     string
+	caption  string
+	metadata []byte // the metadata sidecar file, nil if none
+	size     int64  // total size of the files
+}
+
+func export(_ *cobra.Command, _ []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagFormat != formatWebDataset && flagFormat != formatParquet {
+		return errs.New(errs.ExitConfig, "invalid --format %q. Must be one of: webdataset, parquet", flagFormat)
+	}
+	if flagShardSize <= 0 {
+		return errs.New(errs.ExitConfig, "invalid --shard-size %d: must be positive", flagShardSize)
+	}
+	ext, err := util.ParseOutputExt(flagExt, ".txt", ".json")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	absDir, err := filepath.Abs(flagDir)
+	if err != nil {
+		return err
+	}
+	output := flagOutput
+	if output == "" {
+		output = filepath.Base(absDir) + "-" + flagFormat
+	}
+	samples, uncaptionedCnt, err := listSamples(ext)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no captioned images found in %q", flagDir)
+	}
+
+	// Plan the shards first, for the total count in the parquet filenames
+	var shards [][]*sample
+	var shardSize int64
+	for _, s := range samples {
+		if len(shards) == 0 || shardSize > 0 && shardSize+s.size > int64(flagShardSize)<<20 {
+			shards = append(shards, nil)
+			shardSize = 0
+		}
+		shards[len(shards)-1] = append(shards[len(shards)-1], s)
+		shardSize += s.size
+	}
+	names := make([]string, len(shards))
+	for i := range shards {
+		if flagFormat == formatParquet {
+			names[i] = fmt.Sprintf("%s-%05d-of-%05d.parquet", flagPrefix, i, len(shards))
+		} else {
+			names[i] = fmt.Sprintf("%s-%06d.tar", flagPrefix, i)
+		}
+		if _, err := os.Stat(util.LongPath(filepath.Join(output, names[i]))); err == nil && !flagForce {
+			return fmt.Errorf("%q already exists. Use --force to overwrite", filepath.Join(output, names[i]))
+		}
+	}
+	if err := os.MkdirAll(util.LongPath(output), 0755); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exporting %d captioned images (%d uncaptioned skipped) into %d %s shards in %q\n",
+		len(samples), uncaptionedCnt, len(shards), flagFormat, output)
+	start := time.Now()
+	var totalSize int64
+	for i, shard := range shards {
+		path := filepath.Join(output, names[i])
+		err := util.WriteAtomic(path, func(w io.Writer) error {
+			if flagFormat == formatParquet {
+				return writeParquet(w, shard)
+			}
+			return writeWebDataset(w, shard)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write %q: %w", path, err)
+		}
+		stat, err := os.Stat(util.LongPath(path))
+		if err != nil {
+			return err
+		}
+		totalSize += stat.Size()
+		fmt.Printf("✅ %s: %d images (%s)\n", names[i], len(shard), util.FormatBytes(stat.Size()))
+	}
+	fmt.Printf("Done. %d shards (%s) written in %v\n", len(shards), util.FormatBytes(totalSize),
+		time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// listSamples returns the captioned images of --dir, and the number of images without a caption.
+func listSamples(ext string) ([]*sample, int, error) {
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	var samples []*sample
+	uncaptionedCnt := 0
+	for _, file := range files {
+		if file.IsDir() || !thumbs.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		content, err := os.ReadFile(util.LongPath(captioner.CaptionFilePath(file.Path, ext)))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+		caption := strings.TrimSpace(strings.TrimPrefix(string(content), util.UTF8_BOM))
+		if caption == "" {
+			uncaptionedCnt++
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, 0, err
+		}
+		name, err := filepath.Rel(flagDir, file.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		s := &sample{name: filepath.ToSlash(name), path: file.Path, caption: caption}
+		metadata, err := os.ReadFile(util.LongPath(captioner.MetadataFilePath(file.Path)))
+		if err == nil && json.Valid(metadata) {
+			s.metadata = metadata
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+		s.size = info.Size() + int64(len(s.caption)) + int64(len(s.metadata))
+		samples = append(samples, s)
+	}
+	return samples, uncaptionedCnt, nil
+}
+
+// sampleKey returns the WebDataset key of the sample: its path without the extension, without dots,
+// which separate the key from the extensions of its files.
+func sampleKey(s *sample) string {
+	return strings.ReplaceAll(strings.TrimSuffix(s.name, filepath.Ext(s.name)), ".", "_")
+}
+
+func writeWebDataset(w io.Writer, samples []*sample) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	writeFile := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	keys := map[string]bool{}
+	for _, s := range samples {
+		key := sampleKey(s)
+		for i := 2; keys[key]; i++ {
+			key = fmt.Sprintf("%s_%d", sampleKey(s), i)
+		}
+		keys[key] = true
+		image, err := os.ReadFile(util.LongPath(s.path))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(key+strings.ToLower(filepath.Ext(s.name)), image); err != nil {
+			return err
+		}
+		if err := writeFile(key+".txt", []byte(s.caption)); err != nil {
+			return err
+		}
+		if s.metadata != nil {
+			if err := writeFile(key+".json", s.metadata); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// The schema of the exported parquet files
+var parquetSchema = []*parquet.Field{
+	{Name: "image", Fields: []*parquet.Field{{Name: "bytes"}, {Name: "path", String: true}}},
+	{Name: "caption", String: true},
+	{Name: "metadata", String: true},
+}
+
+// The dataset info of the parquet files, so that HuggingFace datasets decodes the "image" column as images
+const huggingFaceInfo = `{"info":{"features":{"image":{"_type":"Image"},"caption":{"dtype":"string","_type":"Value"},"metadata":{"dtype":"string","_type":"Value"}}}}`
+
+func writeParquet(w io.Writer, samples []*sample) error {
+	return parquet.Write(w, parquetSchema, len(samples), func(column int, row int) ([]byte, error) {
+		s := samples[row]
+		switch column {
+		case 0:
+			return os.ReadFile(util.LongPath(s.path))
+		case 1:
+			return []byte(s.name), nil
+		case 2:
+			return []byte(s.caption), nil
+		default:
+			return s.metadata, nil
+		}
+	}, map[string]string{"huggingface": huggingFaceInfo})
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// FailedFile is a file that failed to process in a run of a command.
+type FailedFile struct {
+	Path  string `json:"path"`  // absolute path
+	Class string `json:"class"` // the failure class (see errs.Code), e.g. "quota"
+	Error string `json:"error"`
+}
+
+// FailedFiles are the failed files of a run of a command, saved to the dataset dir at the end of the run,
+// so that the next run with --retry-failed re-processes only them.
+type FailedFiles struct {
+	Files []*FailedFile
+}
+
+// Add records that the file at path failed with err.
+func (f *FailedFiles) Add(path string, err error) {
+	if absPath, absErr := filepath.Abs(path); absErr == nil {
+		path = absPath
+	}
+	f.Files = append(f.Files, &FailedFile{Path: path, Class: errs.CodeOf(err).String(), Error: err.Error()})
+}
+
+// FailedFilesPath returns the path of the failed files file of command in the dataset dir.
+func FailedFilesPath(dir string, command string) string {
+	return filepath.Join(dir, ".goaider", "failed-"+command+".json")
+}
+
+// InputDir returns the dataset dir of a command run: dir (--dir), or the dir of the first file arg.
+func InputDir(dir string, args []string) string {
+	if dir == "" && len(args) > 0 {
+		return filepath.Dir(args[0])
+	}
+	return dir
+}
+
+// AddRetryFailedFlag adds the --retry-failed flag of command.
+func AddRetryFailedFlag(flags *pflag.FlagSet, value *bool, command string) {
+	flags.BoolVar(value, "retry-failed", false, `Optional: Only re-process the files that failed in the last run `+
+		`(recorded in "<dir>/.goaider/failed-`+command+`.json"). Can not be used with file args`)
+}
+
+// Save writes the failed files of the run of command to the dataset dir, replacing those of the last run.
+// The file is removed if there is no failed file. Failing to write it only prints a warning.
+func (f *FailedFiles) Save(dir string, command string) {
+	path := FailedFilesPath(dir, command)
+	var err error
+	if len(f.Files) == 0 {
+		if err = os.Remove(util.LongPath(path)); os.IsNotExist(err) {
+			err = nil
+		}
+	} else if err = os.MkdirAll(util.LongPath(filepath.Dir(path)), 0755); err == nil {
+		data, _ := json.MarshalIndent(f.Files, "", "  ")
+		err = util.WriteFileAtomic(path, data)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write failed files file %s: %v\n", path, err)
+	}
+}
+
+// LoadFailedFiles returns the paths of the files that failed in the last run of command on the dataset dir
+// and still exist, for --retry-failed. The paths of files in dir are joined from dir, as the ones of a dir listing.
+// It returns an error if args are also given.
+func LoadFailedFiles(dir string, command string, args []string) ([]string, error) {
+	if len(args) > 0 {
+		return nil, errs.New(errs.ExitConfig, "--retry-failed can not be used with file args")
+	}
+	data, err := os.ReadFile(util.LongPath(FailedFilesPath(dir, command)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []*FailedFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("invalid failed files file: %w", err)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		if _, err := os.Stat(util.LongPath(file.Path)); err != nil {
+			continue
+		}
+		path := file.Path
+		if rel, err := filepath.Rel(absDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			path = filepath.Join(dir, rel)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
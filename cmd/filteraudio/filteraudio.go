@@ -0,0 +1,369 @@
+package filteraudio
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// Classification results of the clips of a dir, relative to the dir. Re-runs skip classified clips
+	resultsFile = ".goaider/filter-audio.json"
+
+	classifyPrompt = `Classify this audio clip, which is a candidate for a text-to-speech (TTS) voice training dataset.
+- "music": background music, singing or any musical instruments are audible.
+- "noise": heavy background noise (e.g. traffic, crowd, wind, hum, static) that clearly degrades the voice.
+  Light room tone or faint noise is NOT heavy noise.
+- "overlapping_speech": more than one person speaks at the same time, or another voice is clearly audible.
+- "reason": a short explanation of any problem found, or empty if the clip is clean.`
+
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	// Rough token counts of a classification request, used for the pre-flight estimate
+	classifyPromptTokens          = 150
+	classifyOutputTokensPerSecond = 0
+)
+
+// Problem categories of clips, the values of --reject
+const (
+	categoryMusic   = "music"
+	categoryNoise   = "noise"
+	categoryOverlap = "overlap"
+)
+
+var (
+	flagDir          string
+	flagModel        string
+	flagReject       []string
+	flagAction       string
+	flagForce        bool
+	flagYes          bool
+	flagMaxFiles     int
+	flagApiKeysFile  string
+	flagMaxRetryDur  time.Duration
+	flagTimeout      time.Duration
+	flagTimeoutPerMB time.Duration
+	fileFilter       util.FileFilter
+)
+
+var filterAudioCmd = &cobra.Command{
+	Use:   "filter-audio [audio]...",
+	Short: "Flag or remove audio clips containing music, heavy noise or overlapping speech",
+	Long: `Classify the audio clips of a dir with the Gemini API, and flag or remove the clips
+containing music, heavy noise or overlapping speech, which poison TTS training.
+
+--action:
+- flag (default): add the rejected clips to the flagged list file "` + util.FLAGGED_FILE + `"
+  (the same one as review's), to be deleted manually.
+- move: move the rejected clips (and their .txt / .json sidecar files of the same name) to "<dir>/rejected/".
+- delete: delete the rejected clips and their .txt / .json sidecar files.
+
+Classification results are saved to "` + resultsFile + `" in the dir, so re-runs only classify new clips
+(unless --force is set) and apply --action to all rejected ones.
+
+Instead of --dir, audio files can be given as arguments to classify only them.
+
+Requires the GEMINI_API_KEY environment variable to be set.`,
+	RunE: filterAudio,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(filterAudioCmd)
+	filterAudioCmd.Flags().StringVar(&flagDir, "dir", "", "Directory containing audio files (required unless audio files are given as args)")
+	filterAudioCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_MODEL, "The model to use for classification")
+	filterAudioCmd.Flags().StringSliceVar(&flagReject, "reject", []string{categoryMusic, categoryNoise, categoryOverlap}, "Comma-separated categories of clips to reject: music, noise, overlap")
+	filterAudioCmd.Flags().StringVar(&flagAction, "action", "flag", "What to do with rejected clips: flag | move | delete")
+	filterAudioCmd.Flags().BoolVar(&flagForce, "force", false, "Re-classify clips that were already classified")
+	filterAudioCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Start without asking for confirmation of the pre-flight summary")
+	filterAudioCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Abort if the number of clips to classify exceeds this limit. 0 = unlimited")
+	filterAudioCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Path of a file of Gemini API keys (one per line), rotated among requests")
+	filterAudioCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Max total time spent on one clip including retries. 0 = unlimited")
+	filterAudioCmd.Flags().DurationVar(&flagTimeout, "timeout", 60*time.Second, "Base timeout of a single API request. 0 = no timeout")
+	filterAudioCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 10*time.Second, "Additional API request timeout per MB of payload")
+	fileFilter.AddFlags(filterAudioCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(filterAudioCmd.Flags(), "dir")
+	cmd.SetPromptDefault(filterAudioCmd.Flags(), "dir", ".")
+}
+
+// classification is the classification result of a clip.
+type classification struct {
+	Music             bool   `json:"music"`
+	Noise             bool   `json:"noise"`
+	OverlappingSpeech bool   `json:"overlapping_speech"`
+	Reason            string `json:"reason,omitempty"`
+	Model             string `json:"model,omitempty"`
+}
+
+// problems returns the categories of c in reject.
+func (c *classification) problems(reject []string) []string {
+	var problems []string
+	for _, category := range reject {
+		if category == categoryMusic && c.Music || category == categoryNoise && c.Noise ||
+			category == categoryOverlap && c.OverlappingSpeech {
+			problems = append(problems, category)
+		}
+	}
+	return problems
+}
+
+var classificationSchema = &gemini.Schema{
+	Type: "OBJECT",
+	Properties: map[string]*gemini.Schema{
+		"music":              {Type: "BOOLEAN"},
+		"noise":              {Type: "BOOLEAN"},
+		"overlapping_speech": {Type: "BOOLEAN"},
+		"reason":             {Type: "STRING"},
+	},
+	Required: []string{"music", "noise", "overlapping_speech", "reason"},
+}
+
+func filterAudio(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	for _, category := range flagReject {
+		if !slices.Contains([]string{categoryMusic, categoryNoise, categoryOverlap}, category) {
+			return errs.New(errs.ExitConfig, "invalid --reject category %q", category)
+		}
+	}
+	if !slices.Contains([]string{"flag", "move", "delete"}, flagAction) {
+		return errs.New(errs.ExitConfig, "invalid --action %q", flagAction)
+	}
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return err
+	}
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+
+	// Clips are grouped by dir, as file args may be in different dirs
+	results := map[string]map[string]*classification{}
+	loadResults := func(dir string) (map[string]*classification, error) {
+		if results[dir] == nil {
+			dirResults := map[string]*classification{}
+			if data, err := os.ReadFile(util.LongPath(filepath.Join(dir, resultsFile))); err == nil {
+				if err := json.Unmarshal(data, &dirResults); err != nil {
+					return nil, fmt.Errorf("invalid %s: %w", resultsFile, err)
+				}
+			}
+			results[dir] = dirResults
+		}
+		return results[dir], nil
+	}
+	var clips []util.InputFile
+	var toClassify []util.InputFile
+	estimate := &util.UsageEstimate{}
+	for _, file := range files {
+		if file.IsDir() || audioMimeType(file.Name()) == "" || !fileFilter.Match(file) {
+			continue
+		}
+		dirResults, err := loadResults(filepath.Dir(file.Path))
+		if err != nil {
+			return err
+		}
+		clips = append(clips, file)
+		if !flagForce && dirResults[file.Name()] != nil {
+			continue
+		}
+		toClassify = append(toClassify, file)
+		var size int64
+		if info, err := file.Info(); err == nil {
+			size = info.Size()
+		}
+		estimate.AddAudio(file.Path, size, classifyPromptTokens, classifyOutputTokensPerSecond)
+	}
+	if estimate.Files > 0 {
+		if err := cmd.CheckModel(keys, "", flagModel); err != nil {
+			return err
+		}
+	}
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, 0); err != nil {
+		return err
+	}
+
+	client := &gemini.Client{
+		HTTPClient:   &http.Client{},
+		Keys:         keys,
+		Timeout:      flagTimeout,
+		TimeoutPerMB: flagTimeoutPerMB,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+			MaxDuration: flagMaxRetryDur,
+		},
+	}
+	errorCnt := 0
+	var fatalErr error
+	for _, file := range toClassify {
+		dir := filepath.Dir(file.Path)
+		result, err := classify(client, file.Path)
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				fatalErr = err
+				break
+			}
+			continue
+		}
+		results[dir][file.Name()] = result
+		if err := saveResults(dir, results[dir]); err != nil {
+			return err
+		}
+		if problems := result.problems(flagReject); len(problems) > 0 {
+			fmt.Printf("⚠️ %s: %s (%s)\n", file.Name(), strings.Join(problems, ", "), result.Reason)
+		} else {
+			fmt.Printf("✅ %s: clean\n", file.Name())
+		}
+	}
+
+	// Apply the action to all rejected clips, including those classified in previous runs
+	rejected := map[string][]string{} // dir => names
+	for _, file := range clips {
+		dir := filepath.Dir(file.Path)
+		if result := results[dir][file.Name()]; result != nil && len(result.problems(flagReject)) > 0 {
+			rejected[dir] = append(rejected[dir], file.Name())
+		}
+	}
+	rejectedCnt := 0
+	for dir, names := range rejected {
+		rejectedCnt += len(names)
+		if err := applyAction(dir, names); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%d of %d clips rejected (action: %s)\n", rejectedCnt, len(clips), flagAction)
+	if fatalErr != nil {
+		return fmt.Errorf("run aborted: %w", fatalErr)
+	}
+	return errs.RunResult(len(toClassify), errorCnt)
+}
+
+// classify calls the API to classify the audio file at path.
+func classify(client *gemini.Client, path string) (*classification, error) {
+	ctx := context.Background()
+	mimeType := audioMimeType(path)
+	stat, err := os.Stat(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var audioPart gemini.Part
+	// Base64 encoding inflates inline data by 4/3
+	if stat.Size()*4/3 < gemini.MaxInlineSize {
+		data, err := os.ReadFile(util.LongPath(path))
+		if err != nil {
+			return nil, err
+		}
+		audioPart = gemini.Part{InlineData: &gemini.InlineData{
+			MimeType: mimeType,
+			Data:     base64.StdEncoding.EncodeToString(data),
+		}}
+	} else {
+		file, err := client.UploadFile(ctx, path, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload audio: %w", err)
+		}
+		defer client.DeleteFile(ctx, file)
+		audioPart = file.Part()
+	}
+	text, err := client.GenerateText(ctx, flagModel, &gemini.Request{
+		Contents: []gemini.Content{{Parts: []gemini.Part{{Text: classifyPrompt}, audioPart}}},
+		GenerationConfig: &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   classificationSchema,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &classification{}
+	if err := json.Unmarshal([]byte(text), result); err != nil {
+		return nil, fmt.Errorf("invalid classification response %q: %w", text, err)
+	}
+	result.Model = flagModel
+	return result, nil
+}
+
+// saveResults writes the classification results of the clips of dir.
+func saveResults(dir string, dirResults map[string]*classification) error {
+	data, err := json.MarshalIndent(dirResults, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, filepath.FromSlash(resultsFile))
+	if err := os.MkdirAll(util.LongPath(filepath.Dir(path)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(util.LongPath(path), data, 0644)
+}
+
+// applyAction flags, moves or deletes the rejected clips of dir, and their sidecar files.
+func applyAction(dir string, names []string) error {
+	sort.Strings(names)
+	if flagAction == "flag" {
+		flagged, err := util.ReadFlagged(dir)
+		if err != nil {
+			return err
+		}
+		return util.WriteFlagged(dir, append(flagged, names...))
+	}
+	for _, name := range names {
+		// Only the clip and its own sidecars, not other media of the same name (e.g. "a.mp3" of "a.wav")
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		for _, file := range []string{name, base + ".txt", base + ".json"} {
+			path := filepath.Join(dir, file)
+			var err error
+			if flagAction == "delete" {
+				err = os.Remove(util.LongPath(path))
+			} else {
+				rejectedPath := filepath.Join(dir, "rejected", file)
+				if err = os.MkdirAll(util.LongPath(filepath.Dir(rejectedPath)), 0755); err == nil {
+					err = os.Rename(util.LongPath(path), util.LongPath(rejectedPath))
+				}
+			}
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// audioMimeType returns the MIME type of a supported audio file, or "".
+func audioMimeType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".wav":
+		return "audio/wav"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a":
+		return "audio/m4a"
+	case ".flac":
+		return "audio/flac"
+	case ".ogg":
+		return "audio/ogg"
+	default:
+		return ""
+	}
+}
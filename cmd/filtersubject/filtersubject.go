@@ -0,0 +1,150 @@
+package filtersubject
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/pkg/embedder"
+	"github.com/sagan/goaider/util"
+)
+
+// The folder (next to the images) where the images below the threshold are moved by --eject
+const ejectDir = "_not-subject"
+
+var (
+	flagDir       string
+	flagRefs      []string
+	flagThreshold float64
+	flagEject     bool
+	flagRecursive bool
+	flagProgress  bool
+	embedOptions  embedder.Options
+	fileFilter    util.FileFilter
+)
+
+var filterSubjectCmd = &cobra.Command{
+	Use:   "filter-subject --ref <image>... [image]...",
+	Short: "Find the images that are not of the subject (e.g. wrong-person photos of a scraped set)",
+	Long: `Compare each image of a dir against a few reference images of the subject (--ref),
+using the image embeddings of a local CLIP or SigLIP model (--embed-model), and flag the images
+whose similarity to all references is below --threshold, e.g. the photos of other people in a scraped set.
+The flagged images are listed with their similarity; set --eject to move them (with their sidecar files,
+e.g. captions) to the "` + ejectDir + `" folder next to them.
+
+The model runs locally with the onnxruntime library (see --onnxruntime-lib), no API key is needed.
+The best --threshold depends on the model and the dataset: run without --eject first and check the
+similarity of the flagged images.
+Instead of --dir, image files can be given as arguments.`,
+	RunE: filterSubject,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(filterSubjectCmd)
+	filterSubjectCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	filterSubjectCmd.Flags().StringSliceVar(&flagRefs, "ref", nil, "Required: Comma-separated paths of reference images of the subject (a few photos of different angles work best). Can be set multiple times")
+	filterSubjectCmd.Flags().Float64Var(&flagThreshold, "threshold", 0.75, "Optional: Min similarity (cosine, -1.0-1.0) of an image to the most similar reference, below which it's flagged")
+	filterSubjectCmd.Flags().BoolVar(&flagEject, "eject", false, "Optional: Move the flagged images (with their sidecar files) to the "+ejectDir+" folder next to them")
+	filterSubjectCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also check the images in the subdirectories of --dir (except hidden ones)")
+	filterSubjectCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar instead of per-image lines. Ignored if stdout is not a terminal")
+	embedOptions.AddFlags(filterSubjectCmd.Flags())
+	fileFilter.AddFlags(filterSubjectCmd.Flags())
+	filterSubjectCmd.MarkFlagRequired("ref")
+	cmd.MarkFlagRequiredUnlessArgs(filterSubjectCmd.Flags(), "dir")
+	cmd.SetPromptDefault(filterSubjectCmd.Flags(), "dir", ".")
+}
+
+// scored is an image and its similarity to the references.
+type scored struct {
+	path       string
+	similarity float64
+}
+
+func filterSubject(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagThreshold < -1 || flagThreshold > 1 {
+		return errs.New(errs.ExitConfig, "invalid --threshold %v: must be in -1.0-1.0", flagThreshold)
+	}
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []string
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) ||
+			filepath.Base(filepath.Dir(file.Path)) == ejectDir {
+			continue
+		}
+		images = append(images, file.Path)
+	}
+
+	e, err := embedder.New(&embedOptions)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	var refs [][]float32
+	for _, ref := range flagRefs {
+		v, err := embedder.EmbedImageFile(e, ref)
+		if err != nil {
+			return errs.New(errs.ExitConfig, "failed to embed the reference image %q: %w", ref, err)
+		}
+		refs = append(refs, v)
+	}
+
+	fmt.Printf("Checking %d images against %d reference images\n", len(images), len(refs))
+	progress := util.NewProgress(len(images), flagProgress && util.IsTerminal(os.Stdout))
+	errorCnt := 0
+	var flagged []*scored
+	for _, imagePath := range images {
+		progress.Start(filepath.Base(imagePath))
+		v, err := embedder.EmbedImageFile(e, imagePath)
+		progress.Done(err != nil)
+		if err != nil {
+			progress.Printf("❌ %s: %v\n", imagePath, err)
+			errorCnt++
+			continue
+		}
+		similarity, _ := embedder.MaxSimilarity(v, refs)
+		if similarity < flagThreshold {
+			flagged = append(flagged, &scored{imagePath, similarity})
+		} else if !progress.Enabled {
+			fmt.Printf("✅ %s: %.3f\n", imagePath, similarity)
+		}
+	}
+	progress.Finish()
+
+	slices.SortFunc(flagged, func(a, b *scored) int {
+		if a.similarity < b.similarity {
+			return -1
+		} else if a.similarity > b.similarity {
+			return 1
+		}
+		return 0
+	})
+	fmt.Printf("%d of %d images below the similarity threshold %.3f:\n", len(flagged), len(images)-errorCnt, flagThreshold)
+	for _, image := range flagged {
+		fmt.Printf("  %.3f %s\n", image.similarity, image.path)
+		if flagEject {
+			if err := cropper.MoveImage(image.path, filepath.Join(filepath.Dir(image.path), ejectDir)); err != nil {
+				fmt.Printf("    failed to move: %v\n", err)
+				errorCnt++
+			} else {
+				fmt.Printf("    moved to %s\n", filepath.Join(filepath.Dir(image.path), ejectDir))
+			}
+		}
+	}
+	return errs.RunResult(len(images), errorCnt)
+}
@@ -0,0 +1,121 @@
+package flushqueue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/queue"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir          string
+	flagList         bool
+	flagApiKeysFile  string
+	flagMaxRetryDur  time.Duration
+	flagTimeout      time.Duration
+	flagTimeoutPerMB time.Duration
+)
+
+var flushQueueCmd = &cobra.Command{
+	Use:   "flush-queue",
+	Short: "Send the API requests queued by --queue-only",
+	Long: `Send the API requests queued by "caption --queue-only" or "stt --queue-only" in a dir
+(e.g. when the quota resets), and write the results to the sidecar files, the same way as the commands do.
+
+Sent requests are removed from the queue. If the API key is invalid or the quota is exhausted,
+it stops and the remaining requests are kept in the queue.
+
+Requires the GEMINI_API_KEY environment variable to be set.`,
+	RunE: flushQueue,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(flushQueueCmd)
+	flushQueueCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dataset dir")
+	flushQueueCmd.Flags().BoolVar(&flagList, "list", false, "Optional: Only list the queued requests")
+	flushQueueCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Optional: Path of a file of Gemini API keys (one per line), rotated among requests")
+	flushQueueCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Optional: Max total time spent on one request including retries. 0 = unlimited")
+	flushQueueCmd.Flags().DurationVar(&flagTimeout, "timeout", 60*time.Second, "Optional: Base timeout of a single API request. 0 = no timeout")
+	flushQueueCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 10*time.Second, "Optional: Additional API request timeout per MB of payload")
+	flushQueueCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(flushQueueCmd.Flags(), "dir", ".")
+}
+
+func flushQueue(_ *cobra.Command, args []string) error {
+	items, err := queue.List(flagDir)
+	if err != nil {
+		return err
+	}
+	if flagList || len(items) == 0 {
+		for _, item := range items {
+			fmt.Printf("%s  %-8s %-24s %s\n", item.CreatedAt.Format(time.DateTime), item.Command, item.Model, item.Source)
+		}
+		fmt.Printf("%d queued requests in %s\n", len(items), flagDir)
+		return nil
+	}
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return err
+	}
+	client := &gemini.Client{
+		HTTPClient:   &http.Client{},
+		Keys:         keys,
+		Timeout:      flagTimeout,
+		TimeoutPerMB: flagTimeoutPerMB,
+		Retry: util.RetryPolicy{
+			MaxRetries:  4,
+			BaseBackoff: 6 * time.Second,
+			MaxBackoff:  60 * time.Second,
+			MaxDuration: flagMaxRetryDur,
+		},
+	}
+
+	fmt.Printf("Sending %d queued requests in %s\n", len(items), flagDir)
+	errorCnt := 0
+	var fatalErr error
+	for _, item := range items {
+		fmt.Printf("Processing %s (%s): ⏳ SENDING...\n", item.Source, item.Command)
+		err := flushItem(client, item)
+		if err != nil {
+			fmt.Printf("Processing %s (%s): ❌ FAILED (%v)\n", item.Source, item.Command, err)
+			errorCnt++
+			// All remaining requests would fail the same way
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				fatalErr = err
+				break
+			}
+			continue
+		}
+		fmt.Printf("Processing %s (%s): ✅ SUCCESS\n", item.Source, item.Command)
+	}
+	if fatalErr != nil {
+		return fmt.Errorf("run aborted, remaining requests are kept in the queue: %w", fatalErr)
+	}
+	return errs.RunResult(len(items), errorCnt)
+}
+
+// flushItem sends the request of item, processes the response with the handler of its command,
+// and removes it from the queue.
+func flushItem(client *gemini.Client, item *queue.Item) error {
+	handler := queue.HandlerOf(item.Command)
+	if handler == nil {
+		return fmt.Errorf("unknown command %q", item.Command)
+	}
+	text, err := client.GenerateText(context.Background(), item.Model, item.Request)
+	if err != nil {
+		return err
+	}
+	if err := handler(item, filepath.Join(flagDir, item.Source), text); err != nil {
+		return err
+	}
+	return item.Remove()
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/sagan/goaider/util"
+	"github.com/sagan/goaider/version"
+)
+
+// File (relative to a dataset dir) of the audit log of the commands run on the dataset,
+// one JSON HistoryEntry per line, so that how a dataset was produced can be reconstructed later.
+const HISTORY_FILE = ".goaider/history.jsonl"
+
+// HistoryEntry is a command run on a dataset dir.
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Version string    `json:"version"`
+	Command string    `json:"command"`
+	Args    []string  `json:"args,omitempty"`
+	// The flags set on the command line or by the settings file
+	Flags map[string]string `json:"flags,omitempty"`
+	Model string            `json:"model,omitempty"`
+	// The file counts, of the commands that report them
+	Files    *HistoryFiles `json:"files,omitempty"`
+	Duration float64       `json:"duration"` // seconds
+	ExitCode int           `json:"exitCode"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// HistoryFiles are the file counts of a command run.
+type HistoryFiles struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Skipped   int `json:"skipped"`
+	Failed    int `json:"failed"`
+}
+
+// The file counts of the current command run, recorded by RecordFiles
+var historyFiles *HistoryFiles
+
+// RecordFiles records the file counts of the current command run, written to the history when it ends.
+func RecordFiles(total, succeeded, skipped, failed int) {
+	historyFiles = &HistoryFiles{Total: total, Succeeded: succeeded, Skipped: skipped, Failed: failed}
+}
+
+// AppendHistory appends the entry of the run of cmd, which started at start and ended with err, to the history file
+// of its dataset dir (--dir, or the dir of the first file arg). It does nothing if there is no dataset dir.
+// Failing to write the history only prints a warning.
+func AppendHistory(cmd *cobra.Command, args []string, start time.Time, err error) {
+	files := historyFiles
+	historyFiles = nil
+	if cmd == nil || cmd == RootCmd {
+		return
+	}
+	if help, _ := cmd.Flags().GetBool("help"); help {
+		return
+	}
+	dirFlag := cmd.Flags().Lookup("dir")
+	if dirFlag == nil {
+		return
+	}
+	dir := dirFlag.Value.String()
+	if dir == "" && len(args) > 0 && isRequiredUnlessArgs(cmd.Flags(), dirFlag) {
+		dir = filepath.Dir(args[0])
+	}
+	if info, statErr := os.Stat(util.LongPath(dir)); dir == "" || statErr != nil || !info.IsDir() {
+		return
+	}
+
+	entry := &HistoryEntry{
+		Time:     start,
+		Version:  version.Version,
+		Command:  cmd.CommandPath(),
+		Args:     args,
+		Files:    files,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.ExitCode = int(ExitCode(err))
+	}
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if !flag.Changed {
+			return
+		}
+		if entry.Flags == nil {
+			entry.Flags = map[string]string{}
+		}
+		value := flag.Value.String()
+		if slices.Contains(SensitiveFlags, flag.Name) {
+			value = "<redacted>"
+		}
+		entry.Flags[flag.Name] = value
+	})
+	if modelFlag := cmd.Flags().Lookup("model"); modelFlag != nil {
+		entry.Model = modelFlag.Value.String()
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(entry)
+	path := filepath.Join(dir, filepath.FromSlash(HISTORY_FILE))
+	if err := appendFile(path, buf.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write history file %s: %v\n", path, err)
+	}
+}
+
+func appendFile(path string, data []byte) error {
+	if err := os.MkdirAll(util.LongPath(filepath.Dir(path)), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(util.LongPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
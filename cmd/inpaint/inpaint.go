@@ -0,0 +1,244 @@
+package inpaint
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/cmd/detectwatermark"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir        string
+	flagOutputDir  string
+	flagMaskSuffix string
+	flagDetections bool
+	flagLabels     []string
+	flagDilate     int
+	flagRadius     int
+	flagForce      bool
+	fileFilter     util.FileFilter
+)
+
+var inpaintCmd = &cobra.Command{
+	Use:   "inpaint [image]...",
+	Short: "Fill small blemishes, logos and watermarks of images",
+	Long: `Fill the masked areas of the images of a dir from their surroundings, removing small blemishes,
+logos and watermarks without a round-trip to an image editor. The areas are filled from their boundary
+inwards by the fast marching method of Telea, which works best for thin or small areas; large areas get blurry.
+
+The areas of an image are:
+- its mask file "<name>` + "<mask-suffix>" + `" (default "<name>.mask.png"): a black image of the same size
+  with the areas to fill painted white.
+- with --detections, the regions of its "<name>` + detectwatermark.SidecarSuffix + `" sidecar file
+  of the detect-watermark command (of the --labels).
+
+The images are saved to the --output dir with the same file names; the images without areas to fill
+are copied as is. Existing output files are skipped unless --force is set.
+Instead of --dir, image files can be given as arguments to inpaint only them.`,
+	RunE: inpaint,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(inpaintCmd)
+	inpaintCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	inpaintCmd.Flags().StringVar(&flagOutputDir, "output", "", `Optional: Output dir. default to "<input-dir>-inpainted"`)
+	inpaintCmd.Flags().StringVar(&flagMaskSuffix, "mask-suffix", ".mask.png", `Optional: Suffix of the mask files of the images, e.g. "a.mask.png" of "a.jpg". The white pixels of a mask are filled`)
+	inpaintCmd.Flags().BoolVar(&flagDetections, "detections", false, "Optional: Also fill the regions of the "+detectwatermark.SidecarSuffix+" files of the detect-watermark command")
+	inpaintCmd.Flags().StringSliceVar(&flagLabels, "labels", []string{detectwatermark.LabelWatermark, detectwatermark.LabelText}, "Optional: Comma-separated labels of the --detections regions to fill: "+detectwatermark.LabelWatermark+", "+detectwatermark.LabelText)
+	inpaintCmd.Flags().IntVar(&flagDilate, "dilate", 3, "Optional: Grow the areas by this many pixels, covering the soft edges of watermarks and the loose boxes of detections")
+	inpaintCmd.Flags().IntVar(&flagRadius, "radius", 5, "Optional: Radius (pixels) of the neighborhood of known pixels that a filled pixel is averaged from")
+	inpaintCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing output files")
+	fileFilter.AddFlags(inpaintCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(inpaintCmd.Flags(), "dir")
+	cmd.SetPromptDefault(inpaintCmd.Flags(), "dir", ".")
+}
+
+func inpaint(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagMaskSuffix == "" || !cropper.IsImageFile(flagMaskSuffix) {
+		return errs.New(errs.ExitConfig, "invalid --mask-suffix %q: must end with an image extension, e.g. .mask.png", flagMaskSuffix)
+	}
+	for _, label := range flagLabels {
+		if label != detectwatermark.LabelWatermark && label != detectwatermark.LabelText {
+			return errs.New(errs.ExitConfig, "invalid --labels %q, expect %s or %s",
+				label, detectwatermark.LabelWatermark, detectwatermark.LabelText)
+		}
+	}
+	if flagDilate < 0 {
+		return errs.New(errs.ExitConfig, "invalid --dilate %d: must not be negative", flagDilate)
+	}
+	if flagRadius <= 0 {
+		return errs.New(errs.ExitConfig, "invalid --radius %d: must be positive", flagRadius)
+	}
+	output := flagOutputDir
+	if output == "" {
+		inputDir := flagDir
+		if len(args) > 0 {
+			inputDir = filepath.Dir(args[0])
+		}
+		absDir, err := filepath.Abs(inputDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path %s: %w", inputDir, err)
+		}
+		output = absDir + "-inpainted"
+	}
+
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []util.InputFile
+	skippedCnt := 0
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) ||
+			strings.HasSuffix(strings.ToLower(file.Name()), strings.ToLower(flagMaskSuffix)) {
+			continue
+		}
+		if !flagForce && util.OutputUpToDate(file.Path, filepath.Join(output, file.Name()), false) {
+			skippedCnt++
+			continue
+		}
+		images = append(images, file)
+	}
+	if err := os.MkdirAll(util.LongPath(output), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	fmt.Printf("Inpainting %d images (%d up to date) into %q\n", len(images), skippedCnt, output)
+
+	errorCnt, inpaintedCnt := 0, 0
+	for _, file := range images {
+		pixels, err := inpaintImage(file.Path, filepath.Join(output, file.Name()))
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			continue
+		}
+		if pixels == 0 {
+			fmt.Printf("✅ %s: nothing to fill, copied\n", file.Name())
+		} else {
+			inpaintedCnt++
+			fmt.Printf("✅ %s: filled %d pixels\n", file.Name(), pixels)
+		}
+	}
+	fmt.Printf("Done. %d images inpainted, %d copied, %d failed\n", inpaintedCnt, len(images)-inpaintedCnt-errorCnt, errorCnt)
+	return errs.RunResult(len(images), errorCnt)
+}
+
+// inpaintImage fills the areas of the image at inputPath and saves it to outputPath, or copies it if it has none.
+// It returns the number of the filled pixels.
+func inpaintImage(inputPath string, outputPath string) (int, error) {
+	maskPath := strings.TrimSuffix(inputPath, filepath.Ext(inputPath)) + flagMaskSuffix
+	_, err := os.Stat(util.LongPath(maskPath))
+	hasMask := err == nil
+	var regions []image.Rectangle
+	if flagDetections {
+		result, err := detectwatermark.LoadResult(inputPath)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if result != nil {
+			for _, region := range result.Regions {
+				if slices.Contains(flagLabels, region.Label) {
+					regions = append(regions, image.Rect(region.X, region.Y, region.X+region.Width, region.Y+region.Height))
+				}
+			}
+		}
+	}
+	if !hasMask && len(regions) == 0 {
+		return 0, util.CopyFileAtomic(inputPath, outputPath)
+	}
+
+	img, _, err := util.LoadImage(inputPath)
+	if err != nil {
+		return 0, err
+	}
+	nrgba := imaging.Clone(img) // at the origin
+	width, height := nrgba.Bounds().Dx(), nrgba.Bounds().Dy()
+	mask := make([]bool, width*height)
+	if hasMask {
+		maskImg, _, err := util.LoadImage(maskPath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load the mask: %w", err)
+		}
+		if maskImg.Bounds().Dx() != width || maskImg.Bounds().Dy() != height {
+			return 0, fmt.Errorf("the mask is %dx%d, not of the image size %dx%d",
+				maskImg.Bounds().Dx(), maskImg.Bounds().Dy(), width, height)
+		}
+		gray := imaging.Grayscale(maskImg)
+		for y := range height {
+			for x := range width {
+				c := gray.NRGBAAt(x, y)
+				mask[y*width+x] = c.A >= 128 && c.R >= 128
+			}
+		}
+	}
+	for _, rect := range regions {
+		rect = rect.Intersect(nrgba.Bounds())
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				mask[y*width+x] = true
+			}
+		}
+	}
+	mask = dilate(mask, width, height, flagDilate)
+	pixels := 0
+	for _, masked := range mask {
+		if masked {
+			pixels++
+		}
+	}
+	if pixels == len(mask) {
+		return 0, fmt.Errorf("the whole image is masked")
+	}
+	telea(nrgba, mask, flagRadius)
+	format, err := imaging.FormatFromFilename(outputPath)
+	if err != nil {
+		return 0, err
+	}
+	return pixels, util.WriteAtomic(outputPath, func(w io.Writer) error {
+		return imaging.Encode(w, nrgba, format, imaging.JPEGQuality(95))
+	})
+}
+
+// dilate returns the mask grown by radius pixels (a square neighborhood).
+func dilate(mask []bool, width, height, radius int) []bool {
+	if radius <= 0 {
+		return mask
+	}
+	// Grow horizontally, then vertically
+	horizontal := make([]bool, len(mask))
+	for y := range height {
+		for x := range width {
+			if mask[y*width+x] {
+				for nx := max(x-radius, 0); nx <= min(x+radius, width-1); nx++ {
+					horizontal[y*width+nx] = true
+				}
+			}
+		}
+	}
+	result := make([]bool, len(mask))
+	for y := range height {
+		for x := range width {
+			if horizontal[y*width+x] {
+				for ny := max(y-radius, 0); ny <= min(y+radius, height-1); ny++ {
+					result[ny*width+x] = true
+				}
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,173 @@
+package inpaint
+
+import (
+	"container/heap"
+	"image"
+	"math"
+)
+
+// The states of the pixels of the fast marching method
+const (
+	known  = iota // not masked, or already filled
+	band          // on the boundary of the unfilled area, in the queue
+	inside        // masked, not filled yet
+)
+
+// telea fills the masked pixels of img in place by the fast marching method of Telea
+// ("An Image Inpainting Technique Based on the Fast Marching Method", 2004): the pixels are filled
+// from the boundary of the mask inwards, each one with the weighted average of the known pixels within
+// radius, favoring the near ones, the ones along the normal of the boundary and the ones of the same distance
+// to it. mask has a bool of each pixel of img (row-major).
+func telea(img *image.NRGBA, mask []bool, radius int) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	flags := make([]uint8, width*height)
+	dist := make([]float64, width*height)
+	queue := &pixelQueue{}
+	for i, masked := range mask {
+		if masked {
+			flags[i] = inside
+			dist[i] = math.Inf(1)
+		}
+	}
+	// The initial band: the known pixels next to the mask
+	for y := range height {
+		for x := range width {
+			i := y*width + x
+			if flags[i] != known {
+				continue
+			}
+			for _, d := range neighbors {
+				nx, ny := x+d[0], y+d[1]
+				if nx >= 0 && nx < width && ny >= 0 && ny < height && flags[ny*width+nx] == inside {
+					flags[i] = band
+					heap.Push(queue, pixel{x, y, 0})
+					break
+				}
+			}
+		}
+	}
+
+	// solve returns the distance of a pixel to the boundary from its two neighbors (x1, y1) and (x2, y2),
+	// solving the eikonal equation |grad T| = 1
+	solve := func(x1, y1, x2, y2 int) float64 {
+		if x1 < 0 || x1 >= width || y1 < 0 || y1 >= height || x2 < 0 || x2 >= width || y2 < 0 || y2 >= height {
+			return math.Inf(1)
+		}
+		i1, i2 := y1*width+x1, y2*width+x2
+		switch {
+		case flags[i1] != inside && flags[i2] != inside:
+			t1, t2 := dist[i1], dist[i2]
+			r := math.Sqrt(math.Max(2-(t1-t2)*(t1-t2), 0))
+			if s := (t1 + t2 - r) / 2; s >= t1 && s >= t2 {
+				return s
+			} else if s += r; s >= t1 && s >= t2 {
+				return s
+			}
+			return math.Inf(1)
+		case flags[i1] != inside:
+			return 1 + dist[i1]
+		case flags[i2] != inside:
+			return 1 + dist[i2]
+		}
+		return math.Inf(1)
+	}
+
+	for queue.Len() > 0 {
+		p := heap.Pop(queue).(pixel)
+		flags[p.y*width+p.x] = known
+		for _, d := range neighbors {
+			x, y := p.x+d[0], p.y+d[1]
+			if x < 0 || x >= width || y < 0 || y >= height || flags[y*width+x] != inside {
+				continue
+			}
+			i := y*width + x
+			dist[i] = min(solve(x, y-1, x-1, y), solve(x, y+1, x-1, y), solve(x, y-1, x+1, y), solve(x, y+1, x+1, y))
+			fillPixel(img, flags, dist, x, y, radius)
+			flags[i] = band
+			heap.Push(queue, pixel{x, y, dist[i]})
+		}
+	}
+}
+
+// fillPixel sets the pixel (x, y) of img to the weighted average of the known pixels within radius.
+func fillPixel(img *image.NRGBA, flags []uint8, dist []float64, x, y, radius int) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	i := y*width + x
+	// The gradient of the distance, the normal of the boundary
+	gradX := distGradient(flags, dist, width, x-1, y, x+1, y, i)
+	gradY := distGradient(flags, dist, width, x, y-1, x, y+1, i)
+	var sum [4]float64
+	var weights float64
+	for ny := max(y-radius, 0); ny <= min(y+radius, height-1); ny++ {
+		for nx := max(x-radius, 0); nx <= min(x+radius, width-1); nx++ {
+			j := ny*width + nx
+			if flags[j] == inside {
+				continue
+			}
+			rx, ry := float64(x-nx), float64(y-ny)
+			length2 := rx*rx + ry*ry
+			if length2 == 0 || length2 > float64(radius*radius) {
+				continue
+			}
+			direction := math.Abs(rx*gradX + ry*gradY)
+			if direction <= 0.01 {
+				direction = 1e-6
+			}
+			distance := 1 / (length2 * math.Sqrt(length2))
+			level := 1 / (1 + math.Abs(dist[j]-dist[i]))
+			w := direction * distance * level
+			o := img.PixOffset(nx, ny)
+			for c := range 4 {
+				sum[c] += w * float64(img.Pix[o+c])
+			}
+			weights += w
+		}
+	}
+	if weights == 0 {
+		return
+	}
+	o := img.PixOffset(x, y)
+	for c := range 4 {
+		img.Pix[o+c] = uint8(math.Round(math.Min(math.Max(sum[c]/weights, 0), 255)))
+	}
+}
+
+// distGradient returns the gradient of the distance at pixel i between its neighbors (x1, y1) and (x2, y2)
+// (in this order along the axis): central if both are not inside the mask, one-sided if only one is.
+func distGradient(flags []uint8, dist []float64, width int, x1, y1, x2, y2, i int) float64 {
+	height := len(flags) / width
+	valid := func(x, y int) bool {
+		return x >= 0 && x < width && y >= 0 && y < height && flags[y*width+x] != inside
+	}
+	switch ok1, ok2 := valid(x1, y1), valid(x2, y2); {
+	case ok1 && ok2:
+		return (dist[y2*width+x2] - dist[y1*width+x1]) / 2
+	case ok2:
+		return dist[y2*width+x2] - dist[i]
+	case ok1:
+		return dist[i] - dist[y1*width+x1]
+	}
+	return 0
+}
+
+var neighbors = [][2]int{{0, -1}, {-1, 0}, {1, 0}, {0, 1}}
+
+// pixel is a pixel of the band and its distance to the boundary.
+type pixel struct {
+	x, y int
+	dist float64
+}
+
+// pixelQueue is a min-heap of the pixels of the band by their distance.
+type pixelQueue []pixel
+
+func (q pixelQueue) Len() int           { return len(q) }
+func (q pixelQueue) Less(i, j int) bool { return q[i].dist < q[j].dist }
+func (q pixelQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *pixelQueue) Push(x any)        { *q = append(*q, x.(pixel)) }
+func (q *pixelQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,215 @@
+package inspectmodel
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagJson    bool
+	flagTopTags int
+)
+
+var inspectModelCmd = &cobra.Command{
+	Use:   "inspect-model <model.safetensors>...",
+	Short: "Show the embedded metadata of model checkpoints",
+	Long: `Show the embedded metadata of model checkpoints (e.g. LoRAs trained by kohya-ss sd-scripts):
+the trained resolution, base model, network dim / alpha, training parameters, trigger words
+and the most frequent tags of the training captions (ss_tag_frequency).
+
+Trigger words are the "modelspec.trigger_phrase" metadata, or the tags in all captions of a dataset dir.
+Only the file headers are read. .ckpt / .pt files (PyTorch pickles) have no metadata header,
+only their tensor count is shown.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: inspectModel,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(inspectModelCmd)
+	inspectModelCmd.Flags().BoolVar(&flagJson, "json", false, "Print the full metadata of each model as JSON instead")
+	inspectModelCmd.Flags().IntVar(&flagTopTags, "top-tags", 20, "Number of the most frequent training tags to show. 0 = none")
+}
+
+// metadataFields are the shown metadata fields, in order.
+var metadataFields = []struct{ label, key string }{
+	{"Title", "modelspec.title"},
+	{"Architecture", "modelspec.architecture"},
+	{"Output name", "ss_output_name"},
+	{"Base model", "ss_sd_model_name"},
+	{"Base model version", "ss_base_model_version"},
+	{"Resolution", "ss_resolution"},
+	{"Network module", "ss_network_module"},
+	{"Network dim", "ss_network_dim"},
+	{"Network alpha", "ss_network_alpha"},
+	{"Network args", "ss_network_args"},
+	{"Train images", "ss_num_train_images"},
+	{"Reg images", "ss_num_reg_images"},
+	{"Epochs", "ss_num_epochs"},
+	{"Steps", "ss_steps"},
+	{"Batch size", "ss_total_batch_size"},
+	{"Learning rate", "ss_learning_rate"},
+	{"UNet LR", "ss_unet_lr"},
+	{"Text encoder LR", "ss_text_encoder_lr"},
+	{"Optimizer", "ss_optimizer"},
+	{"LR scheduler", "ss_lr_scheduler"},
+	{"Mixed precision", "ss_mixed_precision"},
+	{"Seed", "ss_seed"},
+}
+
+func inspectModel(_ *cobra.Command, args []string) error {
+	errorCnt := 0
+	all := map[string]map[string]string{}
+	for i, path := range args {
+		if !flagJson && i > 0 {
+			fmt.Println()
+		}
+		var err error
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".ckpt", ".pt", ".pth":
+			if err = inspectCkpt(path); err == nil && flagJson {
+				all[path] = map[string]string{}
+			}
+		default:
+			var header *util.SafetensorsHeader
+			if header, err = util.ReadSafetensorsHeader(path); err == nil {
+				if flagJson {
+					all[path] = header.Metadata
+				} else {
+					err = printHeader(path, header)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %s: %v\n", path, err)
+			errorCnt++
+		}
+	}
+	if flagJson {
+		data, _ := json.MarshalIndent(all, "", "  ")
+		fmt.Println(string(data))
+	}
+	return errs.RunResult(len(args), errorCnt)
+}
+
+func printHeader(path string, header *util.SafetensorsHeader) error {
+	var params int64
+	for _, tensor := range header.Tensors {
+		params += tensor.Params()
+	}
+	fmt.Printf("%s (safetensors, %d tensors, %s params)\n", path, len(header.Tensors), formatCount(params))
+	if len(header.Metadata) == 0 {
+		fmt.Printf("  No metadata\n")
+		return nil
+	}
+	for _, field := range metadataFields {
+		if value := header.Metadata[field.key]; value != "" {
+			fmt.Printf("  %-19s %s\n", field.label+":", value)
+		}
+	}
+	frequency, err := header.TagFrequency()
+	if err != nil {
+		return err
+	}
+	if words := triggerWords(header.Metadata, frequency); len(words) > 0 {
+		fmt.Printf("  %-19s %s\n", "Trigger words:", strings.Join(words, ", "))
+	}
+	if frequency == nil || flagTopTags <= 0 {
+		return nil
+	}
+	counts := map[string]int{}
+	for _, tags := range frequency {
+		for tag, count := range tags {
+			counts[strings.TrimSpace(tag)] += count
+		}
+	}
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	slices.SortFunc(tags, func(a, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return strings.Compare(a, b)
+	})
+	fmt.Printf("  Top tags (%d of %d distinct tags in %d dataset dirs):\n", min(flagTopTags, len(tags)), len(tags),
+		len(frequency))
+	for _, tag := range tags[:min(flagTopTags, len(tags))] {
+		fmt.Printf("    %6d  %s\n", counts[tag], tag)
+	}
+	return nil
+}
+
+// triggerWords returns the "modelspec.trigger_phrase" metadata, or the tags in all captions of a dataset dir
+// (by the image counts of the "ss_dataset_dirs" metadata).
+func triggerWords(metadata map[string]string, frequency map[string]map[string]int) []string {
+	if phrase := strings.TrimSpace(metadata["modelspec.trigger_phrase"]); phrase != "" {
+		return []string{phrase}
+	}
+	var dirs map[string]struct {
+		ImgCount int `json:"img_count"`
+	}
+	if json.Unmarshal([]byte(metadata["ss_dataset_dirs"]), &dirs) != nil {
+		return nil
+	}
+	var words []string
+	for dir, tags := range frequency {
+		imgCount := dirs[dir].ImgCount
+		if imgCount <= 0 {
+			continue
+		}
+		for tag, count := range tags {
+			if tag = strings.TrimSpace(tag); count >= imgCount && !slices.Contains(words, tag) {
+				words = append(words, tag)
+			}
+		}
+	}
+	slices.Sort(words)
+	return words
+}
+
+// inspectCkpt prints the tensor count of the .ckpt file (a zip of a PyTorch pickle and the tensor data files).
+func inspectCkpt(path string) error {
+	r, err := zip.OpenReader(util.LongPath(path))
+	if err != nil {
+		return fmt.Errorf("not a zip-based PyTorch checkpoint (legacy pickle checkpoints are not supported): %w", err)
+	}
+	defer r.Close()
+	tensors := 0
+	for _, file := range r.File {
+		if strings.Contains(file.Name, "/data/") {
+			tensors++
+		}
+	}
+	if flagJson {
+		return nil
+	}
+	fmt.Printf("%s (PyTorch checkpoint, %d tensor storages)\n", path, tensors)
+	fmt.Printf("  No metadata (checkpoints have no metadata header, convert to .safetensors to keep it)\n")
+	return nil
+}
+
+// formatCount formats n with a K / M / B suffix.
+func formatCount(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.2fB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fK", float64(n)/1e3)
+	default:
+		return fmt.Sprint(n)
+	}
+}
@@ -0,0 +1,339 @@
+package labelstudio
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/cmd/thumbs"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// Names of the labeling config controls, the from_name / to_name of the results
+	captionControl = "caption"
+	imageControl   = "image"
+
+	// The labeling config of the exported tasks, to be set in the Label Studio project
+	labelConfig = `<View>
+  <Image name="` + imageControl + `" value="$image"/>
+  <TextArea name="` + captionControl + `" toName="` + imageControl + `" editable="true" maxSubmissions="1" rows="4"/>
+</View>`
+
+	// The model_version of the exported predictions
+	modelVersion = "goaider"
+)
+
+var (
+	flagDir       string
+	flagOutput    string
+	flagImageURL  string
+	flagExt       string
+	flagRecursive bool
+	flagForce     bool
+	flagDryRun    bool
+	flagNoBackup  bool
+	fileFilter    util.FileFilter
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "labelstudio-export",
+	Short: "Export the images and captions of a dir as Label Studio tasks",
+	Long: `Export the images of a dir (and their .txt captions) as a Label Studio (https://labelstud.io)
+tasks JSON file, to be imported into a project, so that the captions can be reviewed and edited there.
+The existing captions are pre-filled as predictions; images without a caption are exported too.
+
+--image-url is the url prefix of the images, joined with their path relative to --dir.
+The default one serves them from Label Studio's local files storage, which requires
+LABEL_STUDIO_LOCAL_FILES_SERVING_ENABLED=true and LABEL_STUDIO_LOCAL_FILES_DOCUMENT_ROOT to be
+the parent dir of --dir. Set it to e.g. "http://host:8000/" to serve the images by another web server.
+
+Set this labeling config in the project:
+
+` + labelConfig + `
+
+When done, export the project as JSON in Label Studio and write the captions back with labelstudio-import.`,
+	Args: cobra.NoArgs,
+	RunE: export,
+}
+
+var importCmd = &cobra.Command{
+	Use:   "labelstudio-import <export.json>",
+	Short: "Write the captions of a Label Studio JSON export back to the .txt files",
+	Long: `Write the captions of the annotations of a Label Studio JSON export (of the tasks created by
+labelstudio-export) back to the .txt caption files of the images in --dir.
+
+The latest annotation of each task that was not skipped is used; tasks without one (or with an empty
+caption) are skipped.
+Unchanged captions are not written. Use --dry-run to preview the changes. The old versions
+of changed captions are backed up (see captions-diff / captions-restore) unless --no-backup is set.`,
+	Args: cobra.ExactArgs(1),
+	RunE: importAnnotations,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(exportCmd)
+	cmd.RootCmd.AddCommand(importCmd)
+	for _, c := range []*cobra.Command{exportCmd, importCmd} {
+		c.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dir of the images")
+		c.Flags().StringVar(&flagExt, "ext", ".txt", "Optional: Extension of the caption files, e.g. .caption")
+		c.MarkFlagRequired("dir")
+		cmd.SetPromptDefault(c.Flags(), "dir", ".")
+	}
+	exportCmd.Flags().StringVar(&flagOutput, "output", "", `Optional: Output tasks file path. Default: "<dir name>-labelstudio.json" in current dir`)
+	exportCmd.Flags().StringVar(&flagImageURL, "image-url", "", `Optional: Url prefix of the images. Default: "/data/local-files/?d=<dir name>/" (Label Studio local files storage)`)
+	exportCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also export the images in the subdirectories of --dir (except hidden ones)")
+	exportCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing output file")
+	fileFilter.AddFlags(exportCmd.Flags())
+	importCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "Optional: Only print the changes, do not write them")
+	importCmd.Flags().BoolVar(&flagNoBackup, "no-backup", false, "Optional: Do not back up changed captions (to "+util.BACKUPS_DIR+"/<time>/) before overwriting them")
+}
+
+// task is a Label Studio task, as exported by labelstudio-export and in the JSON export of a project.
+type task struct {
+	ID          int           `json:"id,omitempty"`
+	Data        taskData      `json:"data"`
+	Predictions []*annotation `json:"predictions,omitempty"`
+	Annotations []*annotation `json:"annotations,omitempty"`
+}
+
+type taskData struct {
+	Image string `json:"image"`
+	// The image path relative to the dir, with forward slashes, to map the task back to the image
+	File string `json:"file"`
+}
+
+// annotation is an annotation or prediction of a task.
+type annotation struct {
+	ModelVersion string    `json:"model_version,omitempty"`
+	Result       []*result `json:"result"`
+	WasCancelled bool      `json:"was_cancelled,omitempty"`
+	UpdatedAt    string    `json:"updated_at,omitempty"`
+}
+
+type result struct {
+	FromName string      `json:"from_name"`
+	ToName   string      `json:"to_name"`
+	Type     string      `json:"type"`
+	Value    resultValue `json:"value"`
+}
+
+type resultValue struct {
+	Text []string `json:"text"`
+}
+
+func export(_ *cobra.Command, _ []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	ext, err := util.ParseOutputExt(flagExt, ".txt", ".json")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	absDir, err := filepath.Abs(flagDir)
+	if err != nil {
+		return err
+	}
+	output := flagOutput
+	if output == "" {
+		output = filepath.Base(absDir) + "-labelstudio.json"
+	}
+	if _, err := os.Stat(util.LongPath(output)); err == nil && !flagForce {
+		return fmt.Errorf("output file %q already exists. Use --force to overwrite", output)
+	}
+	imageURL := flagImageURL
+	if imageURL == "" {
+		imageURL = "/data/local-files/?d=" + url.PathEscape(filepath.Base(absDir)) + "/"
+	}
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, nil)
+	if err != nil {
+		return err
+	}
+
+	tasks := []*task{}
+	captionedCnt := 0
+	for _, file := range files {
+		if file.IsDir() || !thumbs.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		name, err := filepath.Rel(flagDir, file.Path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		t := &task{Data: taskData{Image: imageURL + escapePath(name), File: name}}
+		content, err := os.ReadFile(util.LongPath(captioner.CaptionFilePath(file.Path, ext)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if caption := strings.TrimSpace(strings.TrimPrefix(string(content), util.UTF8_BOM)); caption != "" {
+			t.Predictions = []*annotation{{ModelVersion: modelVersion, Result: []*result{{
+				FromName: captionControl,
+				ToName:   imageControl,
+				Type:     "textarea",
+				Value:    resultValue{Text: []string{caption}},
+			}}}}
+			captionedCnt++
+		}
+		tasks = append(tasks, t)
+	}
+	if len(tasks) == 0 {
+		return fmt.Errorf("no images found in %q", flagDir)
+	}
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(output, data); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d images (%d captioned) as Label Studio tasks to %q (image urls like %q)\n",
+		len(tasks), captionedCnt, output, imageURL+escapePath(tasks[0].Data.File))
+	fmt.Printf("Labeling config of the project:\n%s\n", labelConfig)
+	return nil
+}
+
+// escapePath escapes each segment of the slash-separated path for use in a url.
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func importAnnotations(_ *cobra.Command, args []string) error {
+	ext, err := util.ParseOutputExt(flagExt, ".txt", ".json")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	data, err := os.ReadFile(util.LongPath(args[0]))
+	if err != nil {
+		return errs.New(errs.ExitConfig, "failed to read %q: %w", args[0], err)
+	}
+	var tasks []*task
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return errs.New(errs.ExitConfig, "invalid Label Studio JSON export %q: %w", args[0], err)
+	}
+	var backup *util.Backup
+	if !flagDryRun && !flagNoBackup {
+		backup = util.NewBackup()
+	}
+
+	total, changedCnt, writtenCnt, skippedCnt, errorCnt := 0, 0, 0, 0, 0
+	for _, t := range tasks {
+		name, err := taskFile(t)
+		if err != nil {
+			fmt.Printf("❌ task %d: %v\n", t.ID, err)
+			errorCnt++
+			continue
+		}
+		caption, ok := annotatedCaption(t)
+		if !ok {
+			skippedCnt++
+			continue
+		}
+		total++
+		captionPath := captioner.CaptionFilePath(filepath.Join(flagDir, filepath.FromSlash(name)), ext)
+		content, err := os.ReadFile(util.LongPath(captionPath))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			errorCnt++
+			continue
+		}
+		bom := strings.HasPrefix(string(content), util.UTF8_BOM)
+		old := strings.TrimSpace(strings.TrimPrefix(string(content), util.UTF8_BOM))
+		if caption == old {
+			continue
+		}
+		changedCnt++
+		if flagDryRun {
+			fmt.Printf("%s:\n- %s\n+ %s\n", name, old, caption)
+			continue
+		}
+		if backup != nil {
+			err = backup.Save(captionPath)
+		}
+		if err == nil {
+			err = util.WriteTextFile(captionPath, caption, bom)
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("✅ %s: %s\n", name, caption)
+		writtenCnt++
+	}
+	if flagDryRun {
+		fmt.Printf("Dry run. %d of %d annotated captions would be changed, %d tasks not annotated\n",
+			changedCnt, total, skippedCnt)
+		return nil
+	}
+	fmt.Printf("Done. %d of %d annotated captions changed, %d tasks not annotated, %d failed\n",
+		writtenCnt, total, skippedCnt, errorCnt)
+	if backup != nil && writtenCnt > 0 {
+		fmt.Printf("Old versions are backed up to backup %s (see captions-diff / captions-restore)\n", backup.ID)
+	}
+	return errs.RunResult(writtenCnt+errorCnt, errorCnt)
+}
+
+// taskFile returns the image path (relative to the dir, with forward slashes) of the task:
+// its "file" data set by labelstudio-export, or else the file name of its image url.
+func taskFile(t *task) (string, error) {
+	name := t.Data.File
+	if name == "" {
+		u, err := url.Parse(t.Data.Image)
+		if err != nil || t.Data.Image == "" {
+			return "", fmt.Errorf("no image of the task")
+		}
+		name = path.Base(u.Path)
+		if d := u.Query().Get("d"); d != "" {
+			name = path.Base(d)
+		}
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("unsafe image path %q", name)
+	}
+	return name, nil
+}
+
+// annotatedCaption returns the caption of the latest annotation of the task that was not skipped.
+// ok is false if there is none, or its caption is empty.
+func annotatedCaption(t *task) (caption string, ok bool) {
+	var latest *annotation
+	for _, a := range t.Annotations {
+		if !a.WasCancelled && (latest == nil || a.UpdatedAt >= latest.UpdatedAt) {
+			latest = a
+		}
+	}
+	if latest == nil {
+		return "", false
+	}
+	for _, r := range latest.Result {
+		if r.FromName == captionControl && r.Type == "textarea" {
+			var lines []string
+			for _, line := range r.Value.Text {
+				if line = strings.TrimSpace(line); line != "" {
+					lines = append(lines, line)
+				}
+			}
+			caption = strings.Join(lines, " ")
+			break
+		}
+	}
+	return caption, caption != ""
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+)
+
+var (
+	flagAll         bool
+	flagApiKeysFile string
+)
+
+var modelsCmd = &cobra.Command{
+	Use:   "models [model]...",
+	Short: "List available Gemini models",
+	Long: `List the Gemini models available to the API key, with their input / output token limits,
+known free tier rate limits (requests per minute / day) and paid tier prices (USD per 1M tokens).
+
+By default, only models supporting content generation (usable as --model) are listed.
+If models are given as args, show their details instead; it fails if any of them is not available.
+
+Requires the GEMINI_API_KEY environment variable to be set.`,
+	RunE: models,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(modelsCmd)
+	modelsCmd.Flags().BoolVar(&flagAll, "all", false, "Also list models that don't support content generation (e.g. embedding models)")
+	modelsCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Path of a file of Gemini API keys (one per line)")
+}
+
+func models(_ *cobra.Command, args []string) error {
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return err
+	}
+	client := &gemini.Client{HTTPClient: &http.Client{Timeout: 30 * time.Second}, Keys: keys}
+	if len(args) > 0 {
+		return showModels(client, args)
+	}
+
+	models, err := client.ListModels(context.Background())
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(models, func(a, b *gemini.Model) int { return strings.Compare(a.ID(), b.ID()) })
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tINPUT TOKENS\tOUTPUT TOKENS\tFREE TIER RPM/RPD\tPRICE IN/AUDIO/OUT")
+	for _, m := range models {
+		if !flagAll && !m.CanGenerateContent() {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", m.ID(), m.InputTokenLimit, m.OutputTokenLimit,
+			rateLimit(m.ID()), price(m.ID()))
+	}
+	return w.Flush()
+}
+
+// showModels prints the details of each model.
+func showModels(client *gemini.Client, ids []string) error {
+	errorCnt := 0
+	for i, id := range ids {
+		if i > 0 {
+			fmt.Println()
+		}
+		m, err := client.GetModel(context.Background(), id)
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", id, err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("%s (%s)\n", m.ID(), m.DisplayName)
+		if m.Description != "" {
+			fmt.Printf("  %s\n", m.Description)
+		}
+		fmt.Printf("  Input token limit:  %d\n", m.InputTokenLimit)
+		fmt.Printf("  Output token limit: %d\n", m.OutputTokenLimit)
+		fmt.Printf("  Methods:            %s\n", strings.Join(m.SupportedGenerationMethods, ", "))
+		fmt.Printf("  Free tier RPM/RPD:  %s\n", rateLimit(m.ID()))
+		fmt.Printf("  Price in/audio/out: %s\n", price(m.ID()))
+	}
+	if errorCnt > 0 {
+		return errs.New(errs.ExitConfig, "%d of %d models are not available", errorCnt, len(ids))
+	}
+	return nil
+}
+
+func rateLimit(id string) string {
+	if limit, ok := constants.GEMINI_MODEL_FREE_RATE_LIMITS[id]; ok {
+		return fmt.Sprintf("%d/%d", limit.RPM, limit.RPD)
+	}
+	return "-"
+}
+
+func price(id string) string {
+	if p, ok := constants.GEMINI_MODEL_PRICES[id]; ok {
+		return fmt.Sprintf("$%g/$%g/$%g", p.Input, p.AudioInput, p.Output)
+	}
+	return "-"
+}
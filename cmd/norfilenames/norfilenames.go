@@ -2,18 +2,24 @@ package norfilenames
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/spf13/cobra"
 
 	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
 )
 
 var (
-	flagDir   string
-	flagForce bool
+	flagDir    string
+	flagForce  bool
+	fileFilter util.FileFilter
 )
 
 // norfilenamesCmd represents the norfilenames command
@@ -29,10 +35,15 @@ func init() {
 	cmd.RootCmd.AddCommand(norfilenamesCmd)
 	norfilenamesCmd.Flags().StringVarP(&flagDir, "dir", "", "", "Directory to normalize filenames in")
 	norfilenamesCmd.Flags().BoolVarP(&flagForce, "force", "", false, "Force renaming without confirmation")
+	fileFilter.AddFlags(norfilenamesCmd.Flags())
 	norfilenamesCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(norfilenamesCmd.Flags(), "dir", ".")
 }
 
 func norfilenames(cmd *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
 	fmt.Printf("Normalizing filenames in directory: %s\n", flagDir)
 
 	type renamePair struct {
@@ -48,14 +59,11 @@ func norfilenames(cmd *cobra.Command, args []string) error {
 			return err
 		}
 
-		if !info.IsDir() {
+		if !info.IsDir() && fileFilter.Match(fs.FileInfoToDirEntry(info)) {
 			dir := filepath.Dir(path)
 			oldName := info.Name()
 
-			// Normalize the filename: replace special characters with '_'
-			// Special char: ASCII char and not in [-_.a-zA-Z0-9]
-			re := regexp.MustCompile(`[\x00-\x2C\x2F\x3A-\x40\x5B-\x5E\x60\x7B-\x7F]`)
-			newName := re.ReplaceAllString(oldName, "_")
+			newName := normalizeFilename(oldName)
 
 			if oldName != newName {
 				newPath := filepath.Join(dir, newName)
@@ -94,7 +102,7 @@ func norfilenames(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Performing renamings...\n")
 	errorCnt := 0
 	for _, rp := range pendingRenames {
-		if err := os.Rename(rp.oldPath, rp.newPath); err != nil {
+		if err := os.Rename(util.LongPath(rp.oldPath), util.LongPath(rp.newPath)); err != nil {
 			fmt.Printf("Error renaming %q: %v\n", rp.oldName, err)
 			errorCnt++
 		} else {
@@ -103,10 +111,21 @@ func norfilenames(cmd *cobra.Command, args []string) error {
 	}
 
 	fmt.Printf("Filename normalization complete.\n")
-	if errorCnt > 0 {
-		return fmt.Errorf("%d errors", errorCnt)
+	return errs.RunResult(len(pendingRenames), errorCnt)
+}
+
+// Special char: ASCII char and not in [-_.a-zA-Z0-9]
+var specialCharRegexp = regexp.MustCompile(`[\x00-\x2C\x2F\x3A-\x40\x5B-\x5E\x60\x7B-\x7F]`)
+
+// normalizeFilename replaces special characters in name with '_'.
+// Invalid UTF-8 byte sequences (e.g. GBK / Shift_JIS encoded names extracted from zip files)
+// and the Unicode replacement char are also replaced, so the result is always valid UTF-8.
+func normalizeFilename(name string) string {
+	if !utf8.ValidString(name) {
+		name = strings.ToValidUTF8(name, "_")
 	}
-	return nil
+	name = strings.ReplaceAll(name, string(utf8.RuneError), "_")
+	return specialCharRegexp.ReplaceAllString(name, "_")
 }
 
 // AddCommand adds the norfilenames command to the root command.
@@ -0,0 +1,334 @@
+package normalizecolors
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir           string
+	flagOutputDir     string
+	flagWhiteBalance  bool
+	flagExposure      bool
+	flagBrightness    float64
+	flagSourceProfile string
+	flagWorkers       int
+	flagForce         bool
+	flagProgress      bool
+	fileFilter        util.FileFilter
+)
+
+// Max correction of an image, so that e.g. a photo of a red wall or a night scene is not ruined
+const (
+	maxChannelGain = 1.6
+	minGamma       = 0.5
+	maxGamma       = 2.0
+)
+
+// profiles are the supported --source-profile color spaces: their transfer function (to linear)
+// and the matrix converting their linear RGB to linear sRGB.
+var profiles = map[string]*profile{
+	"srgb": nil,
+	"display-p3": {
+		toLinear: srgbToLinear,
+		matrix: [3][3]float64{
+			{1.2249, -0.2247, 0},
+			{-0.0420, 1.0419, 0},
+			{-0.0197, -0.0786, 1.0979},
+		},
+	},
+	"adobe-rgb": {
+		toLinear: func(v float64) float64 { return math.Pow(v, 563.0/256) },
+		matrix: [3][3]float64{
+			{1.3982, -0.3982, 0},
+			{0, 1, 0},
+			{0, -0.0429, 1.0429},
+		},
+	},
+}
+
+type profile struct {
+	toLinear func(v float64) float64
+	matrix   [3][3]float64
+}
+
+var normalizeColorsCmd = &cobra.Command{
+	Use:   "normalize-colors [image]...",
+	Short: "Normalize the white balance and exposure of the images of a dataset",
+	Long: `Reduce the lighting variance of a dataset whose photos come from many devices:
+auto white balance (gray world: the average color of each image is made neutral) and
+exposure normalization (a gamma curve maps the average brightness of each image to --brightness).
+Corrections are limited, so that e.g. a photo of a red wall is not turned gray.
+
+Set --source-profile to convert images of a wide gamut color space (e.g. iPhone photos in
+Display P3) to sRGB, the color space assumed by training tools. Output images are untagged sRGB.
+
+Normalized images (.jpg, .jpeg, .png) are saved to the --output dir with the same file names.
+Instead of --dir, image files can be given as arguments to normalize only them.`,
+	RunE: normalizeColors,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(normalizeColorsCmd)
+	normalizeColorsCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the image directory")
+	normalizeColorsCmd.Flags().StringVar(&flagOutputDir, "output", "", `Optional: Output dir. default to "<input-dir>-normalized"`)
+	normalizeColorsCmd.Flags().BoolVar(&flagWhiteBalance, "white-balance", true, "Optional: Apply auto white balance")
+	normalizeColorsCmd.Flags().BoolVar(&flagExposure, "exposure", true, "Optional: Apply exposure normalization")
+	normalizeColorsCmd.Flags().Float64Var(&flagBrightness, "brightness", 0.46, "Optional: Target average brightness (0.0-1.0) of exposure normalization")
+	normalizeColorsCmd.Flags().StringVar(&flagSourceProfile, "source-profile", "srgb", "Optional: Color space of the input images, converted to sRGB: "+strings.Join(profileNames(), ", "))
+	normalizeColorsCmd.Flags().IntVar(&flagWorkers, "workers", runtime.NumCPU(), "Optional: Number of images processed in parallel")
+	normalizeColorsCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing output files")
+	normalizeColorsCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar instead of per-image lines. Ignored if stdout is not a terminal")
+	fileFilter.AddFlags(normalizeColorsCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(normalizeColorsCmd.Flags(), "dir")
+	cmd.SetPromptDefault(normalizeColorsCmd.Flags(), "dir", ".")
+}
+
+func normalizeColors(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	source, ok := profiles[flagSourceProfile]
+	if !ok {
+		return errs.New(errs.ExitConfig, "invalid --source-profile %q, expect one of: %s", flagSourceProfile,
+			strings.Join(profileNames(), ", "))
+	}
+	if flagBrightness <= 0 || flagBrightness >= 1 || flagWorkers < 1 {
+		return errs.New(errs.ExitConfig, "invalid --brightness or --workers")
+	}
+	if !flagWhiteBalance && !flagExposure && source == nil {
+		return errs.New(errs.ExitConfig, "nothing to do: --white-balance, --exposure and --source-profile are all unset")
+	}
+	output := flagOutputDir
+	if output == "" {
+		inputDir := flagDir
+		if len(args) > 0 {
+			inputDir = filepath.Dir(args[0])
+		}
+		absDir, err := filepath.Abs(inputDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path %s: %w", inputDir, err)
+		}
+		output = absDir + "-normalized"
+	}
+	if err := os.MkdirAll(util.LongPath(output), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []string
+	skippedCnt := 0
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		if !flagForce && util.OutputUpToDate(file.Path, filepath.Join(output, file.Name()), false) {
+			skippedCnt++
+			continue
+		}
+		images = append(images, file.Path)
+	}
+	fmt.Printf("Normalizing %d images (%d up to date) into %q\n", len(images), skippedCnt, output)
+
+	start := time.Now()
+	progress := util.NewProgress(len(images), flagProgress)
+	var mu sync.Mutex
+	errorCnt := 0
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range flagWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for imagePath := range jobs {
+				summary, err := normalizeImage(imagePath, filepath.Join(output, filepath.Base(imagePath)), source)
+				mu.Lock()
+				if err != nil {
+					errorCnt++
+					progress.Printf("❌ %s: %v\n", filepath.Base(imagePath), err)
+				} else if !progress.Enabled {
+					fmt.Printf("✅ %s: %s\n", filepath.Base(imagePath), summary)
+				}
+				mu.Unlock()
+				progress.Done(err != nil)
+			}
+		}()
+	}
+	for _, imagePath := range images {
+		jobs <- imagePath
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Finish()
+	fmt.Printf("Done. %d images normalized, %d failed, in %v\n", len(images)-errorCnt, errorCnt,
+		time.Since(start).Round(time.Millisecond))
+	return errs.RunResult(len(images), errorCnt)
+}
+
+// normalizeImage normalizes the image at inputPath and saves it to outputPath.
+// It returns a summary of the applied corrections.
+func normalizeImage(inputPath, outputPath string, source *profile) (string, error) {
+	img, _, err := util.LoadImage(inputPath)
+	if err != nil {
+		return "", err
+	}
+	nrgba := imaging.Clone(img)
+	if source != nil {
+		convertToSRGB(nrgba, source)
+	}
+	var summary []string
+	if flagWhiteBalance {
+		gains := whiteBalanceGains(nrgba)
+		applyCurves(nrgba, func(c int, v float64) float64 { return v * gains[c] })
+		summary = append(summary, fmt.Sprintf("gains %.2f/%.2f/%.2f", gains[0], gains[1], gains[2]))
+	}
+	if flagExposure {
+		gamma := exposureGamma(nrgba, flagBrightness)
+		applyCurves(nrgba, func(_ int, v float64) float64 { return math.Pow(v, gamma) })
+		summary = append(summary, fmt.Sprintf("gamma %.2f", gamma))
+	}
+	if source != nil {
+		summary = append(summary, flagSourceProfile+" => srgb")
+	}
+	format, err := imaging.FormatFromFilename(outputPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(summary, ", "), util.WriteAtomic(outputPath, func(w io.Writer) error {
+		return imaging.Encode(w, nrgba, format, imaging.JPEGQuality(95))
+	})
+}
+
+// whiteBalanceGains returns the per-channel (R, G, B) gains that make the average color of the image
+// (excluding clipped pixels) neutral gray, limited to maxChannelGain.
+func whiteBalanceGains(img *image.NRGBA) [3]float64 {
+	var sum [3]float64
+	count := 0
+	forEachPixel(img, func(p []uint8) {
+		if p[3] == 0 || max(p[0], p[1], p[2]) >= 250 || max(p[0], p[1], p[2]) <= 5 {
+			return // transparent or clipped: carries no color information
+		}
+		for c := range 3 {
+			sum[c] += float64(p[c])
+		}
+		count++
+	})
+	gains := [3]float64{1, 1, 1}
+	if count == 0 || sum[0] == 0 || sum[1] == 0 || sum[2] == 0 {
+		return gains
+	}
+	gray := (sum[0] + sum[1] + sum[2]) / 3
+	for c := range 3 {
+		gains[c] = max(1/maxChannelGain, min(maxChannelGain, gray/sum[c]))
+	}
+	return gains
+}
+
+// exposureGamma returns the gamma that maps the average brightness (luma, 0.0-1.0) of the image to target,
+// limited to [minGamma, maxGamma].
+func exposureGamma(img *image.NRGBA, target float64) float64 {
+	var sum float64
+	count := 0
+	forEachPixel(img, func(p []uint8) {
+		if p[3] == 0 {
+			return
+		}
+		sum += (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 255
+		count++
+	})
+	if count == 0 {
+		return 1
+	}
+	mean := sum / float64(count)
+	if mean <= 0.001 || mean >= 0.999 {
+		return 1
+	}
+	return max(minGamma, min(maxGamma, math.Log(target)/math.Log(mean)))
+}
+
+// convertToSRGB converts the pixels of img from the source color space to sRGB.
+func convertToSRGB(img *image.NRGBA, source *profile) {
+	var toLinear [256]float64
+	for i := range toLinear {
+		toLinear[i] = source.toLinear(float64(i) / 255)
+	}
+	forEachPixel(img, func(p []uint8) {
+		linear := [3]float64{toLinear[p[0]], toLinear[p[1]], toLinear[p[2]]}
+		for c := range 3 {
+			m := source.matrix[c]
+			v := m[0]*linear[0] + m[1]*linear[1] + m[2]*linear[2]
+			p[c] = toByte(linearToSRGB(max(0, min(1, v))))
+		}
+	})
+}
+
+// applyCurves applies the curve fn(channel, value 0.0-1.0) to the R, G, B channels of img.
+func applyCurves(img *image.NRGBA, fn func(c int, v float64) float64) {
+	var lut [3][256]uint8
+	for c := range 3 {
+		for i := range 256 {
+			lut[c][i] = toByte(fn(c, float64(i)/255))
+		}
+	}
+	forEachPixel(img, func(p []uint8) {
+		for c := range 3 {
+			p[c] = lut[c][p[c]]
+		}
+	})
+}
+
+func forEachPixel(img *image.NRGBA, fn func(p []uint8)) {
+	for y := 0; y < img.Rect.Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+img.Rect.Dx()*4]
+		for x := 0; x < len(row); x += 4 {
+			fn(row[x : x+4])
+		}
+	}
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func toByte(v float64) uint8 {
+	return uint8(max(0, min(255, math.Round(v*255))))
+}
+
+func profileNames() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
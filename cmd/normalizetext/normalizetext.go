@@ -0,0 +1,139 @@
+package normalizetext
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/textnorm"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir       string
+	flagLang      string
+	flagRules     []string
+	flagExt       string
+	flagRecursive bool
+	flagDryRun    bool
+	flagNoBackup  bool
+	fileFilter    util.FileFilter
+)
+
+var normalizeTextCmd = &cobra.Command{
+	Use:   "normalize-text [txt]...",
+	Short: "Normalize the numbers, punctuation, casing and emoji of transcripts for TTS training",
+	Long: `Normalize the text of the transcripts (.txt files) of a dir in place by the rules of their language (--lang),
+so that a TTS model is trained on what is actually spoken, e.g. before generating a sovits-genlist list.
+
+--rules (comma-separated, default all, applied in this order):
+- emoji: remove emoji.
+- numbers: spell out numerals, percentages, "h:mm" times and (en) ordinals in words of the language,
+  e.g. "1,250" => "one thousand two hundred fifty" (en), "一千二百五十" (zh), "千二百五十" (ja), "천이백오십" (ko).
+  Chinese years are read digit by digit ("2010年" => "二零一零年"). Numbers with a leading zero or of more than
+  15 digits are read digit by digit; numbers right after a Latin letter (e.g. "mp3") are kept.
+- punctuation: en / ko: ASCII marks (full-width and typographic ones are converted, e.g. "，" and "…"),
+  no space before and a space after them. zh / yue / ja: full-width marks (e.g. "，" / "、" of ja), no spaces
+  next to CJK characters. Repeated marks are collapsed ("!!!" => "!").
+- case (en): capitalize the first word of each sentence and "I"; shouted all caps text is lowercased first.
+- ending: end each transcript with a sentence-ending mark ("." or "。"), replacing a trailing comma.
+
+Line breaks are always replaced with spaces, so each transcript becomes a single line.
+Use --dry-run to preview the changes. The old versions of changed files are backed up
+(see captions-diff / captions-restore) unless --no-backup is set.
+Instead of --dir, transcript files can be given as arguments.`,
+	RunE: normalizeText,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(normalizeTextCmd)
+	normalizeTextCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless transcript files are given as args): Path to the dir of the transcripts")
+	normalizeTextCmd.Flags().StringVar(&flagLang, "lang", "", "Required: The language of the transcripts: "+strings.Join(textnorm.Languages, " | "))
+	normalizeTextCmd.Flags().StringSliceVar(&flagRules, "rules", textnorm.Rules, "Optional: Comma-separated rules to apply: "+strings.Join(textnorm.Rules, ", "))
+	normalizeTextCmd.Flags().StringVar(&flagExt, "ext", ".txt", "Optional: Extension of the transcript files, e.g. .lab")
+	normalizeTextCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also normalize the transcripts in the subdirectories of --dir (except hidden ones), e.g. of a multi-speaker dataset")
+	normalizeTextCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "Optional: Only print the changes, do not write them")
+	normalizeTextCmd.Flags().BoolVar(&flagNoBackup, "no-backup", false, "Optional: Do not back up changed transcripts (to "+util.BACKUPS_DIR+"/<time>/) before overwriting them")
+	fileFilter.AddFlags(normalizeTextCmd.Flags())
+	normalizeTextCmd.MarkFlagRequired("lang")
+	cmd.MarkFlagRequiredUnlessArgs(normalizeTextCmd.Flags(), "dir")
+	cmd.SetPromptDefault(normalizeTextCmd.Flags(), "dir", ".")
+}
+
+func normalizeText(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	normalizer, err := textnorm.New(flagLang, flagRules)
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	ext, err := util.ParseOutputExt(flagExt, ".txt")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var backup *util.Backup
+	if !flagDryRun && !flagNoBackup {
+		backup = util.NewBackup()
+	}
+
+	total, changedCnt, writtenCnt, errorCnt := 0, 0, 0, 0
+	for _, file := range files {
+		if file.IsDir() || !strings.EqualFold(filepath.Ext(file.Name()), ext) || !fileFilter.Match(file) {
+			continue
+		}
+		total++
+		content, err := os.ReadFile(util.LongPath(file.Path))
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Path, err)
+			errorCnt++
+			continue
+		}
+		bom := strings.HasPrefix(string(content), util.UTF8_BOM)
+		text := strings.TrimPrefix(string(content), util.UTF8_BOM)
+		normalized := normalizer.Normalize(text)
+		if normalized == strings.TrimRight(text, "\r\n") {
+			continue
+		}
+		changedCnt++
+		if flagDryRun {
+			fmt.Printf("%s:\n- %s\n+ %s\n", file.Path, strings.TrimSpace(text), normalized)
+			continue
+		}
+		if backup != nil {
+			err = backup.Save(file.Path)
+		}
+		if err == nil {
+			err = util.WriteTextFile(file.Path, normalized, bom)
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Path, err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("✅ %s: %s\n", file.Path, normalized)
+		writtenCnt++
+	}
+	if flagDryRun {
+		fmt.Printf("Dry run. %d of %d transcripts would be changed\n", changedCnt, total)
+		return nil
+	}
+	fmt.Printf("Done. %d of %d transcripts changed, %d failed\n", writtenCnt, total, errorCnt)
+	if backup != nil && writtenCnt > 0 {
+		fmt.Printf("Old versions are backed up to backup %s (see captions-diff / captions-restore)\n", backup.ID)
+	}
+	return errs.RunResult(writtenCnt+errorCnt, errorCnt)
+}
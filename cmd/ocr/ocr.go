@@ -0,0 +1,281 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/cmd/thumbs"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// Suffix of the sidecar file of extracted text, e.g. "foo.ocr.txt" of "foo.jpg"
+	ocrSuffix = ".ocr.txt"
+
+	ocrPrompt = `Extract all visible text in this image (signs, captions, watermarks, UI text, handwriting...),
+exactly as written, preserving the line breaks and the reading order. Do not translate or describe anything.
+If there is no visible text, output exactly: ` + noTextMarker
+
+	// Response of the model for images without text
+	noTextMarker = "NO_TEXT"
+
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	// Rough token counts of an OCR request, used for the pre-flight estimate
+	ocrPromptTokens = 80
+	ocrOutputTokens = 100
+)
+
+// OCR providers, the values of --provider
+const (
+	providerAuto      = "auto"
+	providerGemini    = "gemini"
+	providerTesseract = "tesseract"
+)
+
+var (
+	flagDir           string
+	flagProvider      string
+	flagModel         string
+	flagLang          string
+	flagForce         bool
+	flagYes           bool
+	flagMaxFiles      int
+	flagUploadMaxSize int
+	flagApiKeysFile   string
+	flagMaxRetryDur   time.Duration
+	flagTimeout       time.Duration
+	flagTimeoutPerMB  time.Duration
+	fileFilter        util.FileFilter
+)
+
+var ocrCmd = &cobra.Command{
+	Use:   "ocr [image]...",
+	Short: "Extract visible text from images",
+	Long: `Extract the visible text of each image of a dir, writing it to a "<name>` + ocrSuffix + `" sidecar file
+(empty if the image has no text). Useful for filtering screenshots / memes (images whose sidecar
+is not empty) out of photo datasets, or for building document datasets.
+Existing sidecar files are skipped unless --force is set.
+
+--provider:
+- gemini: use the Gemini API. Requires the GEMINI_API_KEY environment variable to be set.
+- tesseract: use the local tesseract OCR engine (https://github.com/tesseract-ocr/tesseract),
+  which must be in PATH. --lang sets its languages, e.g. "eng+jpn".
+- auto (default): use Gemini if an API key is set, otherwise tesseract. Images that Gemini fails on
+  (e.g. blocked by safety filters) are retried with tesseract if it's available.
+
+Instead of --dir, image files can be given as arguments.`,
+	RunE: ocr,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(ocrCmd)
+	ocrCmd.Flags().StringVar(&flagDir, "dir", "", "Directory containing images (required unless image files are given as args)")
+	ocrCmd.Flags().StringVar(&flagProvider, "provider", providerAuto, "OCR provider: auto | gemini | tesseract")
+	ocrCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_MODEL, "The Gemini model to use")
+	ocrCmd.Flags().StringVar(&flagLang, "lang", "eng", `Languages of tesseract, e.g. "eng+jpn". Gemini detects the language itself`)
+	ocrCmd.Flags().BoolVar(&flagForce, "force", false, "Overwrite existing "+ocrSuffix+" files")
+	ocrCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Start without asking for confirmation of the pre-flight summary")
+	ocrCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Abort if the number of images to process exceeds this limit. 0 = unlimited")
+	ocrCmd.Flags().IntVar(&flagUploadMaxSize, "upload-max-size", 3072, "Downscale images whose longest side exceeds this (pixels) before sending to the API. 0 = disable")
+	ocrCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Path of a file of Gemini API keys (one per line), rotated among requests")
+	ocrCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Max total time spent on one image including retries. 0 = unlimited")
+	ocrCmd.Flags().DurationVar(&flagTimeout, "timeout", 60*time.Second, "Base timeout of a single API request. 0 = no timeout")
+	ocrCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 5*time.Second, "Additional API request timeout per MB of payload")
+	fileFilter.AddFlags(ocrCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(ocrCmd.Flags(), "dir")
+	cmd.SetPromptDefault(ocrCmd.Flags(), "dir", ".")
+}
+
+func ocr(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	var keys *gemini.KeyPool
+	var err error
+	_, tesseractErr := exec.LookPath(providerTesseract)
+	hasTesseract := tesseractErr == nil
+	switch flagProvider {
+	case providerGemini:
+		if keys, err = gemini.LoadKeys(flagApiKeysFile); err != nil {
+			return err
+		}
+	case providerTesseract:
+		if !hasTesseract {
+			return errs.New(errs.ExitConfig, "tesseract not found in PATH: %v", tesseractErr)
+		}
+	case providerAuto:
+		if keys, err = gemini.LoadKeys(flagApiKeysFile); err != nil {
+			if !hasTesseract {
+				return errs.New(errs.ExitConfig, "neither a Gemini API key is set (%v) nor tesseract is found in PATH", err)
+			}
+			fmt.Printf("No Gemini API key set, using tesseract\n")
+		}
+	default:
+		return errs.New(errs.ExitConfig, "invalid --provider %q", flagProvider)
+	}
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []util.InputFile
+	estimate := &util.UsageEstimate{ImageMaxSide: flagUploadMaxSize}
+	for _, file := range files {
+		if file.IsDir() || !thumbs.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		if !flagForce {
+			if _, err := os.Stat(util.LongPath(sidecarPath(file.Path))); err == nil {
+				continue
+			}
+		}
+		images = append(images, file)
+		if keys != nil {
+			var size int64
+			if info, err := file.Info(); err == nil {
+				size = info.Size()
+			}
+			estimate.AddImage(file.Path, size, ocrPromptTokens, ocrOutputTokens)
+		}
+	}
+	if estimate.Files > 0 {
+		if err := cmd.CheckModel(keys, "", flagModel); err != nil {
+			return err
+		}
+	}
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, 0); err != nil {
+		return err
+	}
+
+	var client *gemini.Client
+	if keys != nil {
+		client = &gemini.Client{
+			HTTPClient:   &http.Client{},
+			Keys:         keys,
+			Timeout:      flagTimeout,
+			TimeoutPerMB: flagTimeoutPerMB,
+			Retry: util.RetryPolicy{
+				MaxRetries:  maxRetries,
+				BaseBackoff: baseBackoff,
+				MaxBackoff:  maxBackoff,
+				MaxDuration: flagMaxRetryDur,
+			},
+		}
+	}
+	errorCnt, textCnt := 0, 0
+	for _, file := range images {
+		var text string
+		var err error
+		if client != nil {
+			text, err = geminiOcr(client, file.Path)
+			fatal := errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota)
+			if err != nil && !fatal && flagProvider == providerAuto && hasTesseract {
+				fmt.Printf("  ...%s: Gemini failed (%v), falling back to tesseract\n", file.Name(), err)
+				text, err = tesseractOcr(file.Path)
+			}
+		} else {
+			text, err = tesseractOcr(file.Path)
+		}
+		if err == nil {
+			content := ""
+			if text != "" {
+				content = text + "\n"
+			}
+			err = os.WriteFile(util.LongPath(sidecarPath(file.Path)), []byte(content), 0644)
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				return fmt.Errorf("run aborted: %w", err)
+			}
+			continue
+		}
+		if text != "" {
+			textCnt++
+			fmt.Printf("✅ %s: %d chars of text\n", file.Name(), len([]rune(text)))
+		} else {
+			fmt.Printf("✅ %s: no text\n", file.Name())
+		}
+	}
+	fmt.Printf("%d of %d images contain text\n", textCnt, len(images)-errorCnt)
+	return errs.RunResult(len(images), errorCnt)
+}
+
+// geminiOcr extracts the text of the image at path using the Gemini API. It returns "" if there is no text.
+func geminiOcr(client *gemini.Client, path string) (string, error) {
+	mimeType := getMimeType(path)
+	imageData, shrunk, err := util.ShrinkImageForUpload(path, flagUploadMaxSize, 90)
+	if err == nil && shrunk {
+		mimeType = "image/jpeg"
+	} else if imageData, err = os.ReadFile(util.LongPath(path)); err != nil {
+		return "", err
+	}
+	text, err := client.GenerateText(context.Background(), flagModel, &gemini.Request{
+		Contents: []gemini.Content{{Parts: []gemini.Part{
+			{InlineData: &gemini.InlineData{MimeType: mimeType, Data: base64.StdEncoding.EncodeToString(imageData)}},
+			{Text: ocrPrompt},
+		}}},
+	})
+	if err != nil {
+		return "", err
+	}
+	if text == noTextMarker {
+		return "", nil
+	}
+	return text, nil
+}
+
+// tesseractOcr extracts the text of the image at path using the local tesseract. It returns "" if there is no text.
+func tesseractOcr(path string) (string, error) {
+	c := exec.Command(providerTesseract, path, "stdout", "-l", flagLang)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("tesseract: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	// tesseract separates blocks with blank lines and ends the output with a form feed
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(stdout.String(), "\f", ""), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// sidecarPath returns the path of the OCR sidecar file of the image at path.
+func sidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ocrSuffix
+}
+
+// getMimeType determines the MIME type of an image from the file extension
+func getMimeType(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	default:
+		return "application/octet-stream"
+	}
+}
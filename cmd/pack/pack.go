@@ -0,0 +1,397 @@
+package pack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	formatTarZst = "tar.zst"
+	formatZip    = "zip"
+)
+
+var (
+	flagDir     string
+	flagOutput  string
+	flagFormat  string
+	flagName    string
+	flagVersion string
+	flagForce   bool
+	fileFilter  util.FileFilter
+)
+
+var packCmd = &cobra.Command{
+	Use:   "pack",
+	Short: "Bundle a dataset dir into a versioned .tar.zst / .zip archive with a manifest",
+	Long: `Bundle a prepared dataset dir (images, captions, list files, config, ...) into a
+versioned .tar.zst or .zip archive, for clean transfer to training machines.
+
+The first entry of the archive is a "` + util.MANIFEST_FILENAME + `" metadata header
+of the dataset name, version, creation time and the size & SHA-256 hash of every file,
+which "unpack" verifies. Hidden files and dirs (starting with ".") are not included.
+
+The archive is named "<name>-<version>.tar.zst" by default, where name is the dir name
+and version is the current date.`,
+	Args: cobra.NoArgs,
+	RunE: pack,
+}
+
+var unpackCmd = &cobra.Command{
+	Use:   "unpack <archive>",
+	Short: "Extract a dataset archive created by pack and verify its manifest",
+	Long: `Extract a dataset archive (.tar.zst / .zip) created by "pack" into a dir
+(default: the archive name without extension), and verify the size & SHA-256 hash of
+every extracted file against the manifest of the archive.`,
+	Args: cobra.ExactArgs(1),
+	RunE: unpack,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(packCmd)
+	cmd.RootCmd.AddCommand(unpackCmd)
+	packCmd.Flags().StringVar(&flagDir, "dir", "", "Dataset dir to pack (required)")
+	packCmd.Flags().StringVar(&flagOutput, "output", "", `Output archive path. Default: "<name>-<version>.<format>" in current dir`)
+	packCmd.Flags().StringVar(&flagFormat, "format", "", `Archive format: "tar.zst" | "zip". Default: by --output extension, or "tar.zst"`)
+	packCmd.Flags().StringVar(&flagName, "name", "", "Dataset name saved in manifest. Default: dir name")
+	packCmd.Flags().StringVar(&flagVersion, "version", "", `Dataset version saved in manifest, e.g. "v2". Default: current date ("20060102")`)
+	packCmd.Flags().BoolVar(&flagForce, "force", false, "Overwrite existing output archive")
+	fileFilter.AddFlags(packCmd.Flags())
+	packCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(packCmd.Flags(), "dir", ".")
+
+	unpackCmd.Flags().StringVar(&flagOutput, "output", "", "Output dir. Default: archive path without extension")
+	unpackCmd.Flags().BoolVar(&flagForce, "force", false, "Overwrite existing files in output dir")
+}
+
+func pack(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	format := flagFormat
+	if format == "" {
+		format, _ = archiveFormat(flagOutput)
+		if format == "" {
+			format = formatTarZst
+		}
+	}
+	if format != formatTarZst && format != formatZip {
+		return errs.New(errs.ExitConfig, "invalid format %q. Must be one of: tar.zst, zip", format)
+	}
+
+	absDir, err := filepath.Abs(flagDir)
+	if err != nil {
+		return err
+	}
+	name := flagName
+	if name == "" {
+		name = filepath.Base(absDir)
+	}
+	version := flagVersion
+	if version == "" {
+		version = time.Now().Format("20060102")
+	}
+	output := flagOutput
+	if output == "" {
+		output = name + "-" + version + "." + format
+	}
+	if _, err := os.Stat(output); err == nil && !flagForce {
+		return fmt.Errorf("output file %q already exists. Use --force to overwrite", output)
+	}
+	absOutput, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := util.BuildManifest(flagDir, func(path string, entry fs.DirEntry) bool {
+		if filepath.Join(absDir, filepath.FromSlash(path)) == absOutput {
+			return false // Don't pack the archive itself
+		}
+		return fileFilter.Match(entry)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan dir %q: %w", flagDir, err)
+	}
+	if len(manifest.Files) == 0 {
+		return fmt.Errorf("no files to pack in %q", flagDir)
+	}
+	manifest.Name = name
+	manifest.Version = version
+
+	fmt.Printf("Packing %d files (%s) of dataset %s version %s into %q\n", len(manifest.Files),
+		util.FormatBytes(manifest.TotalSize()), manifest.Name, manifest.Version, output)
+	start := time.Now()
+	if err := writeArchive(output, format, flagDir, manifest); err != nil {
+		os.Remove(output)
+		return err
+	}
+	stat, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done. %q (%s) created in %v\n", output, util.FormatBytes(stat.Size()),
+		time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// The archive formats by extension
+var archiveExts = []struct{ ext, format string }{
+	{".tar.zst", formatTarZst},
+	{".tzst", formatTarZst},
+	{".zip", formatZip},
+}
+
+// archiveFormat returns the archive format of a filename and its extension (as in filename), or "" if unknown.
+func archiveFormat(filename string) (format string, ext string) {
+	lower := strings.ToLower(filename)
+	for _, e := range archiveExts {
+		if strings.HasSuffix(lower, e.ext) {
+			return e.format, filename[len(filename)-len(e.ext):]
+		}
+	}
+	return "", ""
+}
+
+// writeArchive writes the manifest and all files of it (relative to dir) to the archive at output.
+func writeArchive(output string, format string, dir string, manifest *util.Manifest) error {
+	f, err := os.Create(util.LongPath(output))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifestData := manifest.Marshal()
+
+	if format == formatZip {
+		zw := zip.NewWriter(f)
+		zw.SetComment(fmt.Sprintf("goaider dataset %s %s", manifest.Name, manifest.Version))
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: util.MANIFEST_FILENAME, Method: zip.Deflate,
+			Modified: manifest.CreatedAt})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(manifestData); err != nil {
+			return err
+		}
+		for _, file := range manifest.Files {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: file.Path, Method: zip.Deflate,
+				Modified: manifest.CreatedAt})
+			if err != nil {
+				return err
+			}
+			if err := copyFile(w, filepath.Join(dir, filepath.FromSlash(file.Path))); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: util.MANIFEST_FILENAME, Mode: 0644, Size: int64(len(manifestData)),
+		ModTime: manifest.CreatedAt}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.Path, Mode: 0644, Size: file.Size,
+			ModTime: manifest.CreatedAt}); err != nil {
+			return err
+		}
+		if err := copyFile(tw, filepath.Join(dir, filepath.FromSlash(file.Path))); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func unpack(_ *cobra.Command, args []string) error {
+	archive := args[0]
+	format, ext := archiveFormat(archive)
+	if format == "" {
+		return errs.New(errs.ExitConfig, "unknown archive format of %q. Must be .tar.zst or .zip", archive)
+	}
+	output := flagOutput
+	if output == "" {
+		output = strings.TrimSuffix(archive, ext)
+		// An archive named only by the extension, e.g. ".tzst"
+		if output == "" || os.IsPathSeparator(output[len(output)-1]) {
+			output += "unpacked"
+		}
+	}
+
+	var manifest *util.Manifest
+	hashes := map[string]string{} // path => sha256 of extracted files
+	sizes := map[string]int64{}
+	extract := func(name string, r io.Reader) error {
+		if name == util.MANIFEST_FILENAME {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if manifest, err = util.ParseManifest(data); err != nil {
+				return fmt.Errorf("invalid manifest: %w", err)
+			}
+			return nil
+		}
+		path, err := safePath(output, name)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(util.LongPath(path)); err == nil && !flagForce {
+			return fmt.Errorf("%q already exists. Use --force to overwrite", path)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(util.LongPath(path))
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		size, err := io.Copy(io.MultiWriter(f, h), r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		hashes[name] = hex.EncodeToString(h.Sum(nil))
+		sizes[name] = size
+		return f.Close()
+	}
+
+	var err error
+	if format == formatZip {
+		err = extractZip(archive, extract)
+	} else {
+		err = extractTarZst(archive, extract)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract %q: %w", archive, err)
+	}
+	if manifest == nil {
+		return fmt.Errorf("%s not found in archive, it's not created by pack", util.MANIFEST_FILENAME)
+	}
+
+	// Verify extracted files against manifest
+	var problems []string
+	for _, file := range manifest.Files {
+		hash, ok := hashes[file.Path]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing", file.Path))
+		} else if hash != file.Sha256 || sizes[file.Path] != file.Size {
+			problems = append(problems, fmt.Sprintf("%s: hash mismatch", file.Path))
+		}
+		delete(hashes, file.Path)
+	}
+	for path := range hashes {
+		problems = append(problems, fmt.Sprintf("%s: not in manifest", path))
+	}
+	fmt.Printf("Unpacked dataset %s version %s (created %s): %d files into %q\n", manifest.Name, manifest.Version,
+		manifest.CreatedAt.Format(time.RFC3339), len(manifest.Files), output)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Printf("❌ %s\n", problem)
+		}
+		return fmt.Errorf("%d files failed verification", len(problems))
+	}
+	fmt.Printf("✅ All files verified\n")
+	return nil
+}
+
+// safePath returns the path of an archive entry name in dir. It rejects names escaping dir (zip slip).
+func safePath(dir string, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("unsafe path in archive: %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+func extractZip(archive string, extract func(name string, r io.Reader) error) error {
+	zr, err := zip.OpenReader(util.LongPath(archive))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = extract(file.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTarZst(archive string, extract func(name string, r io.Reader) error) error {
+	f, err := os.Open(util.LongPath(archive))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := extract(header.Name, tr); err != nil {
+			return err
+		}
+	}
+}
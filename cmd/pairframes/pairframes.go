@@ -0,0 +1,212 @@
+package pairframes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	// A "[h]h-mm-ss[.mmm]" timestamp in a frame name, e.g. "frame_00-01-23.500"; ":" and "_" also separate the parts
+	clockRegexp = regexp.MustCompile(`(\d+)[-_:](\d{2})[-_:](\d{2})(?:[.,](\d{1,3}))?`)
+	// A seconds timestamp at the end of a frame name, e.g. "frame_83.5s"
+	secondsRegexp = regexp.MustCompile(`(\d+(?:\.\d+)?)s$`)
+	// The frame number at the end of a frame name, e.g. "frame_00042"
+	numberRegexp = regexp.MustCompile(`(\d+)$`)
+)
+
+var (
+	flagDir         string
+	flagTranscript  string
+	flagFps         float64
+	flagStartNumber int
+	flagOffset      time.Duration
+	flagMaxGap      time.Duration
+	flagWindow      time.Duration
+	flagCaptionExt  string
+	flagForce       bool
+	fileFilter      util.FileFilter
+)
+
+var pairFramesCmd = &cobra.Command{
+	Use:   "pair-frames [image]...",
+	Short: "Caption the frames extracted from a video with the transcript segment of their timestamp",
+	Long: `For lecture / screencast datasets, caption each frame extracted from a video with the text
+of the transcript segment (--transcript, a SRT file, e.g. the one of subtitle-align or the subtitles of the video)
+that covers its timestamp, writing it to a "<name>.txt" sidecar file (--caption-ext).
+
+The timestamp of a frame is:
+- with --fps, the one of its frame number (the number at the end of its name) for frames extracted at this rate,
+  e.g. by "ffmpeg -i video.mp4 -vf fps=1 frame_%05d.png" (numbered from --start-number, default 1).
+- otherwise, the one in its name: "[h]h-mm-ss[.mmm]" (e.g. "frame_00-01-23.500.png", ":" and "_" also
+  separate the parts) or seconds at the end (e.g. "frame_83.5s.png").
+
+A frame between two segments gets the nearest one, if it's at most --max-gap away; otherwise it's skipped.
+Set --window to also include the text of the segments within this duration before and after the timestamp,
+for slides that are talked about longer than a segment.
+Existing caption files are skipped unless --force is set.
+Instead of --dir, image files can be given as arguments.`,
+	RunE: pairFrames,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(pairFramesCmd)
+	pairFramesCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the dir of the frames")
+	pairFramesCmd.Flags().StringVar(&flagTranscript, "transcript", "", "Required: Path of the transcript of the video, a SRT file")
+	pairFramesCmd.Flags().Float64Var(&flagFps, "fps", 0, "Optional: The rate (frames per second) the frames were extracted at, whose timestamps are computed from their frame numbers. 0 = parse the timestamps from the frame names")
+	pairFramesCmd.Flags().IntVar(&flagStartNumber, "start-number", 1, "Optional: The number of the first frame (at 0s) of --fps")
+	pairFramesCmd.Flags().DurationVar(&flagOffset, "offset", 0, "Optional: Add this duration (can be negative) to the timestamps of the frames, e.g. if the frames were extracted from a clip of the video")
+	pairFramesCmd.Flags().DurationVar(&flagMaxGap, "max-gap", 2*time.Second, "Optional: Max distance of a frame between segments to the nearest one, beyond which it's skipped")
+	pairFramesCmd.Flags().DurationVar(&flagWindow, "window", 0, "Optional: Also include the text of the segments within this duration before and after the timestamp of a frame")
+	pairFramesCmd.Flags().StringVar(&flagCaptionExt, "caption-ext", ".txt", "Optional: Extension of the caption files")
+	pairFramesCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing caption files")
+	fileFilter.AddFlags(pairFramesCmd.Flags())
+	pairFramesCmd.MarkFlagRequired("transcript")
+	cmd.MarkFlagRequiredUnlessArgs(pairFramesCmd.Flags(), "dir")
+	cmd.SetPromptDefault(pairFramesCmd.Flags(), "dir", ".")
+}
+
+func pairFrames(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagFps < 0 {
+		return errs.New(errs.ExitConfig, "invalid --fps %v: must not be negative", flagFps)
+	}
+	if flagMaxGap < 0 || flagWindow < 0 {
+		return errs.New(errs.ExitConfig, "--max-gap and --window must not be negative")
+	}
+	captionExt, err := util.ParseOutputExt(flagCaptionExt, ".txt")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	content, err := os.ReadFile(util.LongPath(flagTranscript))
+	if err != nil {
+		return errs.New(errs.ExitConfig, "failed to read --transcript file: %w", err)
+	}
+	subtitles, err := util.ParseSRT(string(content))
+	if err != nil {
+		return errs.New(errs.ExitConfig, "failed to parse --transcript file: %w", err)
+	}
+	if len(subtitles) == 0 {
+		return errs.New(errs.ExitConfig, "no segments in --transcript file %q", flagTranscript)
+	}
+
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	total, writtenCnt, skippedCnt, errorCnt := 0, 0, 0, 0
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		total++
+		captionPath := captioner.CaptionFilePath(file.Path, captionExt)
+		if !flagForce {
+			if _, err := os.Stat(util.LongPath(captionPath)); err == nil {
+				skippedCnt++
+				continue
+			}
+		}
+		timestamp, err := frameTimestamp(file.Name())
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			continue
+		}
+		timestamp += flagOffset
+		text := segmentText(subtitles, timestamp)
+		if text == "" {
+			fmt.Printf("⏩ %s [%s]: no segment\n", file.Name(), timestamp)
+			skippedCnt++
+			continue
+		}
+		if err := util.WriteFileAtomic(captionPath, []byte(text)); err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("✅ %s [%s]: %s\n", file.Name(), timestamp, text)
+		writtenCnt++
+	}
+	fmt.Printf("Done. %d of %d frames captioned, %d skipped, %d failed\n", writtenCnt, total, skippedCnt, errorCnt)
+	return errs.RunResult(writtenCnt+errorCnt, errorCnt)
+}
+
+// frameTimestamp returns the timestamp of the frame of the file name, see the help of the command.
+func frameTimestamp(name string) (time.Duration, error) {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	if flagFps > 0 {
+		m := numberRegexp.FindStringSubmatch(stem)
+		if m == nil {
+			return 0, fmt.Errorf("no frame number at the end of the name")
+		}
+		number, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, err
+		}
+		if number < flagStartNumber {
+			return 0, fmt.Errorf("frame number %d is less than --start-number %d", number, flagStartNumber)
+		}
+		return time.Duration(float64(number-flagStartNumber) / flagFps * float64(time.Second)), nil
+	}
+	if m := clockRegexp.FindAllStringSubmatch(stem, -1); m != nil {
+		parts := m[len(m)-1]
+		h, _ := strconv.Atoi(parts[1])
+		minutes, _ := strconv.Atoi(parts[2])
+		s, _ := strconv.Atoi(parts[3])
+		ms, _ := strconv.Atoi((parts[4] + "000")[:3])
+		return time.Duration(h)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(s)*time.Second +
+			time.Duration(ms)*time.Millisecond, nil
+	}
+	if m := secondsRegexp.FindStringSubmatch(stem); m != nil {
+		seconds, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf(`no timestamp in the name (e.g. "frame_00-01-23.500"), set --fps for numbered frames`)
+}
+
+// segmentText returns the text of the segment of subtitles covering timestamp (or the nearest one within
+// --max-gap), with the segments within --window around it. It returns "" if there is none.
+func segmentText(subtitles []util.Subtitle, timestamp time.Duration) string {
+	nearest, nearestGap := -1, time.Duration(0)
+	for i, subtitle := range subtitles {
+		gap := time.Duration(0)
+		if timestamp < subtitle.Start {
+			gap = subtitle.Start - timestamp
+		} else if timestamp > subtitle.End {
+			gap = timestamp - subtitle.End
+		}
+		if gap <= flagMaxGap && (nearest == -1 || gap < nearestGap) {
+			nearest, nearestGap = i, gap
+		}
+	}
+	if nearest == -1 {
+		return ""
+	}
+	var texts []string
+	for i, subtitle := range subtitles {
+		if i == nearest || (subtitle.End >= timestamp-flagWindow && subtitle.Start <= timestamp+flagWindow) {
+			if text := strings.TrimSpace(subtitle.Text); text != "" {
+				texts = append(texts, text)
+			}
+		}
+	}
+	return strings.Join(texts, " ")
+}
@@ -2,34 +2,94 @@ package cmd
 
 import (
 	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 
 	"github.com/xxr3376/gtboard/pkg/ingest"
 
 	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
 	"github.com/sagan/goaider/util"
 )
 
 var (
-	flagCsv string
+	flagCsv            string
+	flagSaveImages     string
+	flagSaveHistograms string
+	flagTags           []string
+	flagSteps          string
+	flagGroupByEpoch   bool
+	flagStepsPerEpoch  int64
+	flagTranspose      bool
+	flagCsvDelimiter   string
+	flagCsvPrecision   int
+	flagCsvScientific  bool
+	flagCsvGzip        bool
 )
 
 // Parse an TensorBoard event file
 var sttCmd = &cobra.Command{
 	Use:   "parsetfef <filename>",
 	Short: "Parse TensorBoard event file",
-	Long:  `Parse.`,
-	Args:  cobra.ExactArgs(1),
-	RunE:  parsetfef,
+	Long: `Parse a TensorBoard event file and print its scalars in a table.
+
+Image summaries (e.g. sample grids logged during training) can be saved with --save-images,
+and histograms with --save-histograms, which are otherwise only viewable in TensorBoard.
+
+To summarize huge event files, select the tags by --tags glob patterns (e.g. "loss/*")
+and the steps by --steps "start:end[:stride]" (inclusive; start and end are optional,
+e.g. "1000:", ":5000", "::100" = every 100th step).
+
+--group-by-epoch aggregates the scalars per epoch of --steps-per-epoch steps (steps 1..N are epoch 1)
+and prints the mean, min and last value of each tag in each epoch, which maps to how LoRA checkpoints
+are saved. --save-csv then saves the epoch table. --transpose prints a row per tag instead of per epoch.
+
+The format of --save-csv can be set by --csv-delimiter (e.g. "tab" for TSV), --csv-precision,
+--csv-scientific and --csv-gzip.`,
+	Args: cobra.ExactArgs(1),
+	RunE: parsetfef,
 }
 
 func init() {
 	sttCmd.Flags().StringVar(&flagCsv, "save-csv", "", "Save the parsed result to a CSV file")
+	sttCmd.Flags().StringVar(&flagSaveImages, "save-images", "", `Save the image summaries to this folder, as "<tag>/<step>.png"`)
+	sttCmd.Flags().StringVar(&flagSaveHistograms, "save-histograms", "", "Save the histogram summaries to a CSV file (one row per bucket)")
+	sttCmd.Flags().StringSliceVar(&flagTags, "tags", nil, `Only include the tags matching these comma-separated glob patterns, e.g. "loss/*"`)
+	sttCmd.Flags().StringVar(&flagSteps, "steps", "", `Only include the steps in "start:end[:stride]", e.g. "1000:5000" or "::100"`)
+	sttCmd.Flags().BoolVar(&flagGroupByEpoch, "group-by-epoch", false, "Aggregate the scalars per epoch (mean / min / last). Requires --steps-per-epoch")
+	sttCmd.Flags().Int64Var(&flagStepsPerEpoch, "steps-per-epoch", 0, "Number of training steps per epoch, for --group-by-epoch")
+	sttCmd.Flags().BoolVar(&flagTranspose, "transpose", false, "Print the epoch table of --group-by-epoch with a row per tag and a column per epoch")
+	sttCmd.Flags().StringVar(&flagCsvDelimiter, "csv-delimiter", ",", `Field delimiter of --save-csv. "tab" = TSV`)
+	sttCmd.Flags().IntVar(&flagCsvPrecision, "csv-precision", -1, "Number of digits after the decimal point of the values of --save-csv. -1 = full precision")
+	sttCmd.Flags().BoolVar(&flagCsvScientific, "csv-scientific", false, `Use scientific notation (e.g. "1.5e-04") for the values of --save-csv`)
+	sttCmd.Flags().BoolVar(&flagCsvGzip, "csv-gzip", false, `Gzip compress the --save-csv file (name it e.g. "scalars.csv.gz")`)
 	cmd.RootCmd.AddCommand(sttCmd)
 }
 
-func parsetfef(cmd *cobra.Command, args []string) error {
+func parsetfef(_ *cobra.Command, args []string) error {
+	if err := checkTagPatterns(flagTags); err != nil {
+		return err
+	}
+	steps, err := parseStepRange(flagSteps)
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagGroupByEpoch && flagStepsPerEpoch <= 0 {
+		return errs.New(errs.ExitConfig, "--group-by-epoch requires a positive --steps-per-epoch")
+	}
+	csvOptions, err := parseCSVOptions()
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
 	r, err := ingest.NewIngester("file", args[0])
 	if err != nil {
 		return err
@@ -42,15 +102,217 @@ func parsetfef(cmd *cobra.Command, args []string) error {
 	}
 
 	run := r.GetRun()
+	scalars := filterScalars(run.Scalars, steps)
 
-	util.PrintScalarsTable(run.Scalars)
+	if flagGroupByEpoch {
+		epochScalars := util.AggregateScalarsByEpoch(scalars, flagStepsPerEpoch)
+		epochScalars.PrintTable(flagTranspose)
+		if flagCsv != "" {
+			if err := epochScalars.SaveCSV(flagCsv, csvOptions); err != nil {
+				return err
+			}
+		}
+	} else {
+		util.PrintScalarsTable(scalars)
+	}
 
-	if flagCsv != "" {
-		err := util.SaveScalarsToCSV(run.Scalars, flagCsv)
+	if flagCsv != "" && !flagGroupByEpoch {
+		err := util.SaveScalarsToCSV(scalars, flagCsv, csvOptions)
 		if err != nil {
 			return err
 		}
 	}
 
+	if flagSaveImages != "" || flagSaveHistograms != "" {
+		return saveSummaries(args[0], steps)
+	}
 	return nil
 }
+
+// parseCSVOptions returns the --save-csv format options of the --csv-* flags.
+func parseCSVOptions() (*util.CSVOptions, error) {
+	opts := &util.CSVOptions{Precision: flagCsvPrecision, Scientific: flagCsvScientific, Gzip: flagCsvGzip}
+	switch delimiter := []rune(flagCsvDelimiter); {
+	case flagCsvDelimiter == "tab" || flagCsvDelimiter == `\t`:
+		opts.Delimiter = '\t'
+	case len(delimiter) == 1 && delimiter[0] != '"' && delimiter[0] != '\r' && delimiter[0] != '\n':
+		opts.Delimiter = delimiter[0]
+	default:
+		return nil, fmt.Errorf("invalid --csv-delimiter %q", flagCsvDelimiter)
+	}
+	if opts.Precision < -1 {
+		return nil, fmt.Errorf("invalid --csv-precision %d", opts.Precision)
+	}
+	return opts, nil
+}
+
+// stepRange is the --steps selection. end < 0 means no end.
+type stepRange struct {
+	start, end, stride int64
+}
+
+// parseStepRange parses "start:end[:stride]". An empty s selects all steps.
+func parseStepRange(s string) (*stepRange, error) {
+	r := &stepRange{end: -1, stride: 1}
+	if s == "" {
+		return r, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf(`invalid --steps %q: must be "start:end[:stride]"`, s)
+	}
+	for i, field := range []*int64{&r.start, &r.end, &r.stride} {
+		if i >= len(parts) || parts[i] == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil || value < 0 || i == 2 && value == 0 {
+			return nil, fmt.Errorf("invalid --steps %q: %q is not a valid number", s, parts[i])
+		}
+		*field = value
+	}
+	if r.end >= 0 && r.end < r.start {
+		return nil, fmt.Errorf("invalid --steps %q: end is before start", s)
+	}
+	return r, nil
+}
+
+// contains reports whether step is selected by r.
+func (r *stepRange) contains(step int64) bool {
+	return step >= r.start && (r.end < 0 || step <= r.end) && (step-r.start)%r.stride == 0
+}
+
+// matchTag reports whether tag matches any of the glob patterns. All tags match empty patterns.
+func matchTag(patterns []string, tag string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTagPatterns checks the --tags glob patterns.
+func checkTagPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errs.New(errs.ExitConfig, "invalid --tags pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// filterScalars returns the scalars of the tags and steps selected by --tags and --steps.
+func filterScalars(scalars map[string]*ingest.ScalarEvents, steps *stepRange) map[string]*ingest.ScalarEvents {
+	filtered := map[string]*ingest.ScalarEvents{}
+	for tag, events := range scalars {
+		if !matchTag(flagTags, tag) {
+			continue
+		}
+		selected := &ingest.ScalarEvents{}
+		for i, step := range events.Step {
+			if steps.contains(step) {
+				selected.Timestamp = append(selected.Timestamp, events.Timestamp[i])
+				selected.Step = append(selected.Step, step)
+				selected.Value = append(selected.Value, events.Value[i])
+			}
+		}
+		if len(selected.Step) > 0 {
+			filtered[tag] = selected
+		}
+	}
+	return filtered
+}
+
+// saveSummaries saves the image and histogram summaries of the event file to --save-images / --save-histograms.
+func saveSummaries(filename string, steps *stepRange) error {
+	var onImage func(*util.TFImage) error
+	var onHistogram func(*util.TFHistogram) error
+	imageCnt, histogramCnt := 0, 0
+	if flagSaveImages != "" {
+		onImage = func(image *util.TFImage) error {
+			if !matchTag(flagTags, image.Tag) || !steps.contains(image.Step) {
+				return nil
+			}
+			name := strconv.FormatInt(image.Step, 10)
+			if image.Index > 0 {
+				name += "-" + strconv.Itoa(image.Index)
+			}
+			path := filepath.Join(flagSaveImages, tagFilename(image.Tag), name+imageExt(image.Data))
+			if err := os.MkdirAll(util.LongPath(filepath.Dir(path)), 0755); err != nil {
+				return err
+			}
+			imageCnt++
+			return os.WriteFile(util.LongPath(path), image.Data, 0644)
+		}
+	}
+	if flagSaveHistograms != "" {
+		file, err := os.Create(flagSaveHistograms)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer := csv.NewWriter(file)
+		defer writer.Flush()
+		if err := writer.Write([]string{"Tag", "Step", "WallTime", "Left", "Right", "Count"}); err != nil {
+			return err
+		}
+		onHistogram = func(histogram *util.TFHistogram) error {
+			if !matchTag(flagTags, histogram.Tag) || !steps.contains(histogram.Step) {
+				return nil
+			}
+			histogramCnt++
+			for _, bucket := range histogram.Buckets {
+				if err := writer.Write([]string{
+					histogram.Tag,
+					strconv.FormatInt(histogram.Step, 10),
+					strconv.FormatFloat(histogram.WallTime, 'f', -1, 64),
+					strconv.FormatFloat(bucket.Left, 'g', -1, 64),
+					strconv.FormatFloat(bucket.Right, 'g', -1, 64),
+					strconv.FormatFloat(bucket.Count, 'g', -1, 64),
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if err := util.ReadTFEventSummaries(filename, onImage, onHistogram); err != nil {
+		return err
+	}
+	if flagSaveImages != "" {
+		fmt.Printf("Saved %d images to %s\n", imageCnt, flagSaveImages)
+	}
+	if flagSaveHistograms != "" {
+		fmt.Printf("Saved %d histograms to %s\n", histogramCnt, flagSaveHistograms)
+	}
+	return nil
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^\p{L}\p{N}._-]+`)
+
+// tagFilename returns a folder name of a summary tag, e.g. "samples_grid" of "samples/grid".
+func tagFilename(tag string) string {
+	name := strings.Trim(unsafeFilenameChars.ReplaceAllString(tag, "_"), "_.")
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// imageExt returns the file extension of the encoded image data.
+func imageExt(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".png"
+	}
+}
@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xxr3376/gtboard/pkg/ingest"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/cmd/thumbs"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// Formats of the train-report
+const (
+	reportFormatMarkdown = "markdown"
+	reportFormatJson     = "json"
+)
+
+// The final mean of a loss is the mean of this last fraction of its points, which is less noisy than the last value
+const finalMeanFraction = 0.1
+
+var (
+	flagReportDir           string
+	flagReportManifest      string
+	flagReportModel         string
+	flagReportCaptionPrompt string
+	flagReportTags          []string
+	flagReportEpochSteps    int64
+	flagReportFormat        string
+	flagReportOutput        string
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "train-report <filename>",
+	Short: "Write an experiment report of a training run from its TensorBoard event file and dataset",
+	Long: `Write an experiment report of a training run, joining its TensorBoard event file with the dataset
+it was trained on. The report records the dataset hash (of the paths and SHA-256 hashes of all files,
+so it changes whenever an image or caption is edited), the dataset stats, the captioning model and
+prompt hash, and a summary of the loss curves. Keeping the reports of training runs makes it easy
+to tell which dataset version / captions produced which LoRA.
+
+The dataset is read from --manifest, or the goaider-manifest.json file of --dir (as created by pack),
+or is hashed from the files of --dir if it has no manifest.
+
+The loss tags are the tags containing "loss", unless --tags glob patterns are set.
+If --steps-per-epoch is set, the report also includes a per-epoch table of the losses.
+
+The report is written to stdout, or to --output file.`,
+	Args: cobra.ExactArgs(1),
+	RunE: trainReport,
+}
+
+func init() {
+	reportCmd.Flags().StringVar(&flagReportDir, "dir", "", "The dataset dir of the training")
+	reportCmd.Flags().StringVar(&flagReportManifest, "manifest", "", "The dataset manifest file. Default: goaider-manifest.json of --dir")
+	reportCmd.Flags().StringVar(&flagReportModel, "model", "", "The model used to caption the dataset")
+	reportCmd.Flags().StringVar(&flagReportCaptionPrompt, "caption-prompt-file", "", "File of the prompt used to caption the dataset, whose hash is recorded")
+	reportCmd.Flags().StringSliceVar(&flagReportTags, "tags", nil, `Glob patterns of the loss tags, e.g. "loss/*". Default: the tags containing "loss"`)
+	reportCmd.Flags().Int64Var(&flagReportEpochSteps, "steps-per-epoch", 0, "Number of training steps per epoch, to include a per-epoch loss table")
+	reportCmd.Flags().StringVar(&flagReportFormat, "format", reportFormatMarkdown, "Report format: markdown | json")
+	reportCmd.Flags().StringVar(&flagReportOutput, "output", "", "Write the report to this file instead of stdout")
+	cmd.RootCmd.AddCommand(reportCmd)
+}
+
+// experimentReport is the JSON of the train-report.
+type experimentReport struct {
+	CreatedAt           time.Time          `json:"created_at"`
+	EventFile           string             `json:"event_file"`
+	Dataset             *reportDataset     `json:"dataset"`
+	CaptionModel        string             `json:"caption_model,omitempty"`
+	CaptionPromptSha256 string             `json:"caption_prompt_sha256,omitempty"`
+	Losses              []*lossSummary     `json:"losses"`
+	StepsPerEpoch       int64              `json:"steps_per_epoch,omitempty"`
+	Epochs              []*reportEpochLoss `json:"epochs,omitempty"`
+	epochScalars        *util.EpochScalars
+}
+
+type reportDataset struct {
+	Name        string `json:"name"`
+	Version     string `json:"version,omitempty"`
+	Sha256      string `json:"sha256"`
+	Files       int    `json:"files"`
+	Size        int64  `json:"size"`
+	Images      int    `json:"images"`
+	ImagesSize  int64  `json:"images_size"`
+	Captions    int    `json:"captions"`
+	Uncaptioned int    `json:"uncaptioned"`
+}
+
+// lossSummary summarizes the curve of a loss tag. NaN values are skipped.
+type lossSummary struct {
+	Tag       string  `json:"tag"`
+	Points    int     `json:"points"`
+	FirstStep int64   `json:"first_step"`
+	LastStep  int64   `json:"last_step"`
+	First     float64 `json:"first"`
+	Last      float64 `json:"last"`
+	Min       float64 `json:"min"`
+	MinStep   int64   `json:"min_step"`
+	FinalMean float64 `json:"final_mean"` // mean of the last 10% points
+}
+
+type reportEpochLoss struct {
+	Epoch int64                        `json:"epoch"`
+	Stats map[string]*util.ScalarStats `json:"stats"` // tag => stats
+}
+
+func trainReport(_ *cobra.Command, args []string) error {
+	if flagReportDir == "" && flagReportManifest == "" {
+		return errs.New(errs.ExitConfig, "either --dir or --manifest must be set")
+	}
+	if flagReportFormat != reportFormatMarkdown && flagReportFormat != reportFormatJson {
+		return errs.New(errs.ExitConfig, "invalid --format %q", flagReportFormat)
+	}
+	if flagReportEpochSteps < 0 {
+		return errs.New(errs.ExitConfig, "invalid --steps-per-epoch %d", flagReportEpochSteps)
+	}
+	if err := checkTagPatterns(flagReportTags); err != nil {
+		return err
+	}
+	report := &experimentReport{
+		CreatedAt:     time.Now(),
+		EventFile:     filepath.Base(args[0]),
+		CaptionModel:  flagReportModel,
+		StepsPerEpoch: flagReportEpochSteps,
+	}
+	if flagReportCaptionPrompt != "" {
+		prompt, err := os.ReadFile(flagReportCaptionPrompt)
+		if err != nil {
+			return errs.Wrap(errs.ExitConfig, err)
+		}
+		sum := sha256.Sum256([]byte(strings.TrimSpace(string(prompt))))
+		report.CaptionPromptSha256 = hex.EncodeToString(sum[:])
+	}
+	dataset, err := readReportDataset()
+	if err != nil {
+		return fmt.Errorf("failed to read dataset: %w", err)
+	}
+	report.Dataset = dataset
+
+	r, err := ingest.NewIngester("file", args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err = r.FetchUpdates(context.Background()); err != nil {
+		return err
+	}
+	losses := map[string]*ingest.ScalarEvents{}
+	for tag, events := range r.GetRun().Scalars {
+		if len(flagReportTags) > 0 && matchTag(flagReportTags, tag) ||
+			len(flagReportTags) == 0 && strings.Contains(strings.ToLower(tag), "loss") {
+			losses[tag] = events
+		}
+	}
+	if len(losses) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: no loss tags found in the event file\n")
+	}
+	for tag, events := range losses {
+		if summary := summarizeLoss(tag, events); summary != nil {
+			report.Losses = append(report.Losses, summary)
+		}
+	}
+	slices.SortFunc(report.Losses, func(a, b *lossSummary) int { return strings.Compare(a.Tag, b.Tag) })
+	if flagReportEpochSteps > 0 {
+		report.epochScalars = util.AggregateScalarsByEpoch(losses, flagReportEpochSteps)
+		for _, epoch := range report.epochScalars.Epochs {
+			epochLoss := &reportEpochLoss{Epoch: epoch, Stats: map[string]*util.ScalarStats{}}
+			for _, tag := range report.epochScalars.Tags {
+				if stats := report.epochScalars.Stats[tag][epoch]; stats != nil {
+					epochLoss.Stats[tag] = stats
+				}
+			}
+			report.Epochs = append(report.Epochs, epochLoss)
+		}
+	}
+
+	out := io.Writer(os.Stdout)
+	if flagReportOutput != "" {
+		file, err := os.Create(flagReportOutput)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if flagReportFormat == reportFormatJson {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		_, err = fmt.Fprintf(out, "%s\n", data)
+	} else {
+		_, err = io.WriteString(out, report.markdown())
+	}
+	if err != nil {
+		return err
+	}
+	if flagReportOutput != "" {
+		fmt.Printf("Report saved to %s\n", flagReportOutput)
+	}
+	return nil
+}
+
+// readReportDataset reads the --manifest, or the manifest of --dir, or builds the manifest of --dir,
+// and returns the dataset summary.
+func readReportDataset() (*reportDataset, error) {
+	var manifest *util.Manifest
+	var err error
+	if flagReportManifest != "" {
+		manifest, err = util.ReadManifest(flagReportManifest)
+	} else if manifestPath := filepath.Join(flagReportDir, util.MANIFEST_FILENAME); fileExists(manifestPath) {
+		manifest, err = util.ReadManifest(manifestPath)
+	} else {
+		fmt.Fprintf(os.Stderr, "Hashing the files of %s\n", flagReportDir)
+		manifest, err = util.BuildManifest(flagReportDir, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dataset := &reportDataset{
+		Name:    manifest.Name,
+		Version: manifest.Version,
+		Sha256:  manifest.Hash(),
+		Files:   len(manifest.Files),
+		Size:    manifest.TotalSize(),
+	}
+	paths := map[string]bool{}
+	for _, file := range manifest.Files {
+		paths[file.Path] = true
+	}
+	for _, file := range manifest.Files {
+		if !thumbs.IsImageFile(file.Path) {
+			continue
+		}
+		dataset.Images++
+		dataset.ImagesSize += file.Size
+		if paths[strings.TrimSuffix(file.Path, filepath.Ext(file.Path))+".txt"] {
+			dataset.Captions++
+		} else {
+			dataset.Uncaptioned++
+		}
+	}
+	return dataset, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(util.LongPath(path))
+	return err == nil
+}
+
+// summarizeLoss returns the summary of the loss curve, or nil if it has no (non NaN) values.
+func summarizeLoss(tag string, events *ingest.ScalarEvents) *lossSummary {
+	var steps []int64
+	var values []float64
+	for i, step := range events.Step {
+		if value := float64(events.Value[i]); !math.IsNaN(value) {
+			steps = append(steps, step)
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	summary := &lossSummary{
+		Tag:       tag,
+		Points:    len(values),
+		FirstStep: steps[0],
+		LastStep:  steps[len(steps)-1],
+		First:     values[0],
+		Last:      values[len(values)-1],
+		Min:       values[0],
+		MinStep:   steps[0],
+	}
+	for i, value := range values {
+		if value < summary.Min {
+			summary.Min, summary.MinStep = value, steps[i]
+		}
+	}
+	final := values[len(values)-max(int(float64(len(values))*finalMeanFraction), 1):]
+	for _, value := range final {
+		summary.FinalMean += value
+	}
+	summary.FinalMean /= float64(len(final))
+	return summary
+}
+
+// markdown returns the Markdown of the report.
+func (report *experimentReport) markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Training report: %s\n\n", report.EventFile)
+	fmt.Fprintf(&sb, "- Created: %s\n", report.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(&sb, "- Event file: `%s`\n", report.EventFile)
+	if report.CaptionModel != "" {
+		fmt.Fprintf(&sb, "- Caption model: `%s`\n", report.CaptionModel)
+	}
+	if report.CaptionPromptSha256 != "" {
+		fmt.Fprintf(&sb, "- Caption prompt SHA-256: `%s`\n", report.CaptionPromptSha256)
+	}
+
+	dataset := report.Dataset
+	fmt.Fprintf(&sb, "\n## Dataset\n\n")
+	name := dataset.Name
+	if dataset.Version != "" {
+		name += " " + dataset.Version
+	}
+	fmt.Fprintf(&sb, "- Name: %s\n", name)
+	fmt.Fprintf(&sb, "- SHA-256: `%s`\n", dataset.Sha256)
+	fmt.Fprintf(&sb, "- Files: %d (%s)\n", dataset.Files, util.FormatBytes(dataset.Size))
+	fmt.Fprintf(&sb, "- Images: %d (%s), %d captioned, %d uncaptioned\n", dataset.Images,
+		util.FormatBytes(dataset.ImagesSize), dataset.Captions, dataset.Uncaptioned)
+
+	fmt.Fprintf(&sb, "\n## Loss\n\n")
+	if len(report.Losses) == 0 {
+		fmt.Fprintf(&sb, "No loss tags.\n")
+	} else {
+		fmt.Fprintf(&sb, "| Tag | Points | Steps | First | Last | Min (step) | Final mean |\n")
+		fmt.Fprintf(&sb, "| --- | --- | --- | --- | --- | --- | --- |\n")
+		for _, loss := range report.Losses {
+			fmt.Fprintf(&sb, "| %s | %d | %d-%d | %f | %f | %f (%d) | %f |\n", loss.Tag, loss.Points,
+				loss.FirstStep, loss.LastStep, loss.First, loss.Last, loss.Min, loss.MinStep, loss.FinalMean)
+		}
+	}
+
+	if epochs := report.epochScalars; epochs != nil && len(epochs.Epochs) > 0 {
+		fmt.Fprintf(&sb, "\n## Loss per epoch\n\n%d steps per epoch. Mean / min / last value of each epoch.\n\n",
+			report.StepsPerEpoch)
+		fmt.Fprintf(&sb, "| Epoch |")
+		for _, tag := range epochs.Tags {
+			fmt.Fprintf(&sb, " %s |", tag)
+		}
+		fmt.Fprintf(&sb, "\n| --- |%s\n", strings.Repeat(" --- |", len(epochs.Tags)))
+		for _, epoch := range epochs.Epochs {
+			fmt.Fprintf(&sb, "| %d |", epoch)
+			for _, tag := range epochs.Tags {
+				if stats := epochs.Stats[tag][epoch]; stats != nil {
+					fmt.Fprintf(&sb, " %f / %f / %f |", stats.Mean, stats.Min, stats.Last)
+				} else {
+					fmt.Fprintf(&sb, " |")
+				}
+			}
+			fmt.Fprintf(&sb, "\n")
+		}
+	}
+	return sb.String()
+}
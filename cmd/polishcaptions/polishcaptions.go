@@ -0,0 +1,458 @@
+package polishcaptions
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// File (relative to the dataset dir) of the proposed caption fixes, reviewed before --apply
+	proposalsFile = ".goaider/polish.diff"
+
+	polishPrompt = `You are proofreading the captions of an image dataset used to train an image model.
+Fix ONLY:
+- spelling mistakes and typos, e.g. "whtie shrit" => "white shirt";
+- obvious grammar errors;
+- the tag style of comma-separated tags: separated by ", ", lowercase (except proper nouns),
+  spaces instead of underscores, no trailing period, no empty tags.
+Change NOTHING else: do not add, remove, reorder, merge, translate or rephrase tags or words, and do not
+"improve" correct wording. Keep names, brands and made-up trigger words as they are, even if they look like typos.
+If a caption needs no fix, return it exactly as is.
+`
+	// Appended to the prompt with the words to keep (--identity / --keep)
+	keepPrompt  = "Keep these words exactly as they are: %s\n"
+	inputPrompt = `
+INPUT: a JSON array of {"file": "<file name>", "caption": "<caption>"} objects.
+OUTPUT FORMAT: a JSON array with one object per input object, in the same order, with the same "file" and the fixed "caption".
+
+`
+
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	// Rough token count of the prompt, and of the caption text (bytes per token), for the pre-flight estimate
+	polishPromptTokens = 250
+	bytesPerToken      = 4
+)
+
+var (
+	flagDir         string
+	flagApply       bool
+	flagModel       string
+	flagIdentity    string
+	flagKeep        []string
+	flagBatchSize   int
+	flagMaxChange   float64
+	flagExt         string
+	flagRecursive   bool
+	flagNoBackup    bool
+	flagYes         bool
+	flagMaxFiles    int
+	flagApiKeysFile string
+	flagMaxRetryDur time.Duration
+	flagTimeout     time.Duration
+	fileFilter      util.FileFilter
+)
+
+var polishCaptionsCmd = &cobra.Command{
+	Use:   "polish-captions",
+	Short: "Fix typos and the tag style of captions via the Gemini API, with the changes reviewed before applying",
+	Long: `Send the existing captions (.txt files) of a dir to the Gemini API in batches, with a constrained prompt
+to fix typos, obvious grammar errors and the tag style (", " separated, lowercase, no underscores) and
+change nothing else. Captions are not written; the proposed changes are saved to
+"<dir>/` + proposalsFile + `" for review, e.g.:
+
+  a.txt
+  - photo of foobar, whtie shrit, Long_Hair
+  + photo of foobar, white shirt, long hair
+
+Delete the entries you reject (or edit their "+" line), then write the rest with --apply.
+An entry is skipped if its caption was changed since. The old versions of written captions are
+backed up (see captions-diff / captions-restore) unless --no-backup is set.
+
+Proposals that change more than --max-change of the characters of a caption are discarded,
+as the model rewrote it instead of fixing it. The words of --identity and --keep
+(e.g. trigger words) are kept as is. Multi-line captions are skipped.`,
+	RunE: polishCaptions,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(polishCaptionsCmd)
+	polishCaptionsCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dir of the captions")
+	polishCaptionsCmd.Flags().BoolVar(&flagApply, "apply", false, "Optional: Write the (reviewed) proposed changes of "+proposalsFile+" to the captions, instead of generating them")
+	polishCaptionsCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_MODEL, "Optional: The Gemini model to use")
+	polishCaptionsCmd.Flags().StringVar(&flagIdentity, "identity", "", "Optional: The trigger word (e.g. 'foobar' or 'photo of foobar') of the captions, kept as is")
+	polishCaptionsCmd.Flags().StringSliceVar(&flagKeep, "keep", nil, "Optional: Comma-separated words to keep as is, e.g. names the model could take for typos")
+	polishCaptionsCmd.Flags().IntVar(&flagBatchSize, "batch-size", 50, "Optional: Number of captions sent in one request")
+	polishCaptionsCmd.Flags().Float64Var(&flagMaxChange, "max-change", 0.2, "Optional: Discard proposals that change more than this share (0-1) of the characters of a caption. 0 = no limit")
+	polishCaptionsCmd.Flags().StringVar(&flagExt, "ext", ".txt", "Optional: Extension of the caption files, e.g. .caption")
+	polishCaptionsCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also polish the captions in the subdirectories of --dir (except hidden ones)")
+	polishCaptionsCmd.Flags().BoolVar(&flagNoBackup, "no-backup", false, "Optional: --apply: Do not back up changed captions (to "+util.BACKUPS_DIR+"/<time>/) before overwriting them")
+	polishCaptionsCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Optional: Start without asking for confirmation of the pre-flight summary")
+	polishCaptionsCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Optional: Abort if the number of captions to process exceeds this limit. 0 = unlimited")
+	polishCaptionsCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Optional: Path of a file of Gemini API keys (one per line), rotated among requests")
+	polishCaptionsCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Optional: Max total time spent on one batch including retries. 0 = unlimited")
+	polishCaptionsCmd.Flags().DurationVar(&flagTimeout, "timeout", 2*time.Minute, "Optional: Timeout of a single API request. 0 = no timeout")
+	fileFilter.AddFlags(polishCaptionsCmd.Flags())
+	polishCaptionsCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(polishCaptionsCmd.Flags(), "dir", ".")
+}
+
+// caption is a caption file of the dir.
+type caption struct {
+	name string // path relative to the dir, with forward slashes
+	path string
+	text string
+}
+
+// proposal is a proposed change of a caption, an entry of the proposals file.
+type proposal struct {
+	name    string
+	oldText string
+	newText string
+}
+
+var polishSchema = &gemini.Schema{
+	Type: "ARRAY",
+	Items: &gemini.Schema{
+		Type: "OBJECT",
+		Properties: map[string]*gemini.Schema{
+			"file":    {Type: "STRING"},
+			"caption": {Type: "STRING"},
+		},
+		Required: []string{"file", "caption"},
+	},
+}
+
+// batchItem is an item of the JSON input and the structured response of a request.
+type batchItem struct {
+	File    string `json:"file"`
+	Caption string `json:"caption"`
+}
+
+func polishCaptions(_ *cobra.Command, _ []string) error {
+	if flagApply {
+		return apply()
+	}
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagBatchSize < 1 {
+		return errs.New(errs.ExitConfig, "invalid --batch-size %d: must be positive", flagBatchSize)
+	}
+	if flagMaxChange < 0 || flagMaxChange > 1 {
+		return errs.New(errs.ExitConfig, "invalid --max-change %g: must be in 0-1", flagMaxChange)
+	}
+	ext, err := util.ParseOutputExt(flagExt, ".txt", ".json")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return err
+	}
+	captions, err := listCaptions(ext)
+	if err != nil {
+		return err
+	}
+	estimate := &util.UsageEstimate{BatchSize: flagBatchSize}
+	for _, c := range captions {
+		tokens := int64(len(c.text)/bytesPerToken + 1)
+		estimate.AddText(1, int64(len(c.text)), tokens, tokens)
+	}
+	estimate.InputTokens += int64((len(captions)+flagBatchSize-1)/flagBatchSize) * polishPromptTokens
+	if estimate.Files > 0 {
+		if err := cmd.CheckModel(keys, "", flagModel); err != nil {
+			return err
+		}
+	}
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, 0); err != nil {
+		return err
+	}
+	client := &gemini.Client{
+		HTTPClient: &http.Client{},
+		Keys:       keys,
+		Timeout:    flagTimeout,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+			MaxDuration: flagMaxRetryDur,
+		},
+	}
+
+	var proposals []*proposal
+	discardedCnt, errorCnt := 0, 0
+	for start := 0; start < len(captions); start += flagBatchSize {
+		batch := captions[start:min(start+flagBatchSize, len(captions))]
+		fmt.Printf("Polishing captions %d-%d of %d...\n", start+1, start+len(batch), len(captions))
+		fixed, err := polishBatch(client, batch)
+		if err != nil {
+			errorCnt += len(batch)
+			fmt.Printf("❌ batch of %s - %s: %v\n", batch[0].name, batch[len(batch)-1].name, err)
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				return fmt.Errorf("run aborted: %w", err)
+			}
+			continue
+		}
+		for _, c := range batch {
+			text, ok := fixed[c.name]
+			text = strings.TrimSpace(text)
+			switch {
+			case !ok || text == "":
+				fmt.Printf("❌ %s: missing from the response\n", c.name)
+				errorCnt++
+			case text == c.text:
+			case strings.ContainsAny(text, "\r\n"):
+				fmt.Printf("⚠️ %s: discarded multi-line proposal\n", c.name)
+				discardedCnt++
+			case flagMaxChange > 0 && changeRatio(c.text, text) > flagMaxChange:
+				fmt.Printf("⚠️ %s: discarded proposal changing too much: %s\n", c.name, text)
+				discardedCnt++
+			default:
+				proposals = append(proposals, &proposal{name: c.name, oldText: c.text, newText: text})
+				fmt.Printf("%s:\n- %s\n+ %s\n", c.name, c.text, text)
+			}
+		}
+	}
+	proposalsPath := filepath.Join(flagDir, filepath.FromSlash(proposalsFile))
+	if len(proposals) > 0 {
+		if err := os.MkdirAll(util.LongPath(filepath.Dir(proposalsPath)), 0755); err != nil {
+			return err
+		}
+		if err := util.WriteFileAtomic(proposalsPath, []byte(formatProposals(proposals))); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Done. %d of %d captions have proposed changes, %d discarded, %d failed\n",
+		len(proposals), len(captions), discardedCnt, errorCnt)
+	if len(proposals) > 0 {
+		fmt.Printf("Review the proposals in %q (delete the rejected entries or edit their \"+\" line), "+
+			"then write them: goaider polish-captions --dir %q --apply\n", proposalsPath, flagDir)
+	}
+	return errs.RunResult(len(captions), errorCnt)
+}
+
+// listCaptions returns the single-line, non-empty caption files of --dir with extension ext.
+func listCaptions(ext string) ([]*caption, error) {
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	var captions []*caption
+	for _, file := range files {
+		if file.IsDir() || !strings.EqualFold(filepath.Ext(file.Name()), ext) || !fileFilter.Match(file) {
+			continue
+		}
+		text, _, err := readCaption(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if text == "" || strings.ContainsAny(text, "\r\n") {
+			continue
+		}
+		name, err := filepath.Rel(flagDir, file.Path)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, &caption{name: filepath.ToSlash(name), path: file.Path, text: text})
+	}
+	return captions, nil
+}
+
+// readCaption returns the trimmed caption of the file at path, and whether it has a BOM.
+func readCaption(path string) (text string, bom bool, err error) {
+	content, err := os.ReadFile(util.LongPath(path))
+	if err != nil {
+		return "", false, err
+	}
+	bom = strings.HasPrefix(string(content), util.UTF8_BOM)
+	return strings.TrimSpace(strings.TrimPrefix(string(content), util.UTF8_BOM)), bom, nil
+}
+
+// polishBatch requests the fixed captions of the batch and returns them by name.
+func polishBatch(client *gemini.Client, batch []*caption) (map[string]string, error) {
+	var items []*batchItem
+	for _, c := range batch {
+		items = append(items, &batchItem{File: c.name, Caption: c.text})
+	}
+	input, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	prompt := polishPrompt
+	var keep []string
+	if flagIdentity != "" {
+		keep = append(keep, flagIdentity)
+	}
+	keep = append(keep, flagKeep...)
+	if len(keep) > 0 {
+		prompt += fmt.Sprintf(keepPrompt, strings.Join(keep, ", "))
+	}
+	prompt += inputPrompt + string(input)
+	text, err := client.GenerateText(context.Background(), flagModel, &gemini.Request{
+		Contents: []gemini.Content{{Parts: []gemini.Part{{Text: prompt}}}},
+		GenerationConfig: &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   polishSchema,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(text), &items); err != nil {
+		return nil, fmt.Errorf("invalid response %q: %w", text, err)
+	}
+	fixed := map[string]string{}
+	for _, item := range items {
+		fixed[strings.TrimSpace(item.File)] = item.Caption
+	}
+	return fixed, nil
+}
+
+// changeRatio returns the edit distance of the runes of oldText and newText, relative to the length of oldText.
+func changeRatio(oldText, newText string) float64 {
+	a, b := []rune(oldText), []rune(newText)
+	if len(a) == 0 {
+		return 1
+	}
+	// Levenshtein distance with a single row
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			prev, row[j] = row[j], min(row[j]+1, row[j-1]+1, prev+cost)
+		}
+	}
+	return float64(row[len(b)]) / float64(len(a))
+}
+
+// formatProposals returns the contents of the proposals file.
+func formatProposals(proposals []*proposal) string {
+	var sb strings.Builder
+	sb.WriteString("# Proposed caption changes of goaider polish-captions.\n")
+	sb.WriteString("# Delete the entries you reject (or edit their \"+\" line), then run polish-captions with --apply.\n\n")
+	for _, p := range proposals {
+		fmt.Fprintf(&sb, "%s\n- %s\n+ %s\n\n", p.name, p.oldText, p.newText)
+	}
+	return sb.String()
+}
+
+// parseProposals parses the proposals file at path. Lines starting with "#" and blank lines are ignored.
+func parseProposals(path string) ([]*proposal, error) {
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var proposals []*proposal
+	var current *proposal
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#"):
+			if current != nil {
+				return nil, fmt.Errorf("line %d: incomplete entry of %s", lineNo, current.name)
+			}
+		case current == nil:
+			current = &proposal{name: strings.TrimSpace(line)}
+		case strings.HasPrefix(line, "- ") && current.oldText == "":
+			current.oldText = strings.TrimSpace(line[2:])
+		case strings.HasPrefix(line, "+ ") && current.oldText != "":
+			current.newText = strings.TrimSpace(line[2:])
+			proposals = append(proposals, current)
+			current = nil
+		default:
+			return nil, fmt.Errorf("line %d: invalid line %q", lineNo, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("incomplete entry of %s at the end", current.name)
+	}
+	return proposals, nil
+}
+
+// apply writes the proposed changes of the proposals file to the captions, then removes the file.
+func apply() error {
+	proposalsPath := filepath.Join(flagDir, filepath.FromSlash(proposalsFile))
+	proposals, err := parseProposals(proposalsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errs.New(errs.ExitConfig, "no proposals found in %q, run polish-captions without --apply first", proposalsPath)
+		}
+		return errs.New(errs.ExitConfig, "invalid proposals file %q: %w", proposalsPath, err)
+	}
+	var backup *util.Backup
+	if !flagNoBackup {
+		backup = util.NewBackup()
+	}
+	writtenCnt, skippedCnt, errorCnt := 0, 0, 0
+	for _, p := range proposals {
+		path := filepath.Join(flagDir, filepath.FromSlash(p.name))
+		text, bom, err := readCaption(path)
+		if err == nil && text != p.oldText {
+			fmt.Printf("⏩ %s: skipped (changed since the proposal)\n", p.name)
+			skippedCnt++
+			continue
+		}
+		if err == nil && p.newText == p.oldText {
+			continue
+		}
+		if err == nil && backup != nil {
+			err = backup.Save(path)
+		}
+		if err == nil {
+			err = util.WriteTextFile(path, p.newText, bom)
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", p.name, err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("✅ %s: %s\n", p.name, p.newText)
+		writtenCnt++
+	}
+	if errorCnt == 0 {
+		if err := os.Remove(util.LongPath(proposalsPath)); err != nil {
+			fmt.Printf("Warning: failed to remove %q: %v\n", proposalsPath, err)
+		}
+	}
+	fmt.Printf("Done. %d captions changed, %d skipped, %d failed\n", writtenCnt, skippedCnt, errorCnt)
+	if backup != nil && writtenCnt > 0 {
+		fmt.Printf("Old versions are backed up to backup %s (see captions-diff / captions-restore)\n", backup.ID)
+	}
+	return errs.RunResult(writtenCnt+errorCnt, errorCnt)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+// ConfirmUsage prints the pre-flight summary of an API run and asks the user to confirm it.
+// It returns an error if the run should not be started: the number of files exceeds maxFiles (if > 0),
+// their total size exceeds maxSize MiB (if > 0), or the user declines.
+// The confirmation is skipped if yes is true or the session is not interactive.
+func ConfirmUsage(estimate *util.UsageEstimate, model string, yes bool, maxFiles int, maxSize int) error {
+	if estimate.Files == 0 {
+		return nil
+	}
+	estimate.Print(model)
+	if maxFiles > 0 && estimate.Files > maxFiles {
+		return fmt.Errorf("%d files to process exceeds --max-files limit %d", estimate.Files, maxFiles)
+	}
+	if maxSize > 0 && estimate.Bytes > int64(maxSize)<<20 {
+		return fmt.Errorf("%s of files to process exceeds --max-size limit %d MiB", util.FormatBytes(estimate.Bytes),
+			maxSize)
+	}
+	if yes || !IsInteractive() {
+		return nil
+	}
+	if !util.AskYesNo("Proceed?") {
+		return fmt.Errorf("cancelled by user")
+	}
+	return nil
+}
+
+// CorruptFile is a media file excluded from a run by the pre-scan (util.CheckMediaFile).
+type CorruptFile struct {
+	Path string
+	Err  error
+}
+
+// ReportCorruptFiles prints the media files excluded by the pre-scan, moving them to the util.CORRUPT_DIR
+// folder in their dirs if move is true.
+func ReportCorruptFiles(files []*CorruptFile, move bool) {
+	if len(files) == 0 {
+		return
+	}
+	fmt.Printf("%d corrupt files excluded:\n", len(files))
+	for _, file := range files {
+		fmt.Printf("  %s: %v\n", file.Path, file.Err)
+		if move {
+			if newPath, err := util.MoveToCorruptDir(file.Path); err != nil {
+				fmt.Printf("    failed to move: %v\n", err)
+			} else {
+				fmt.Printf("    moved to %s\n", newPath)
+			}
+		}
+	}
+}
+
+// CheckModel validates model via the models API before a run, so that an invalid --model or API key
+// fails fast instead of on every file. Other errors (e.g. network) are only printed as a warning.
+// apiURL is the base url of the API, "" = GEMINI_API_URL env or the default.
+func CheckModel(keys *gemini.KeyPool, apiURL string, model string) error {
+	client := &gemini.Client{HTTPClient: &http.Client{Timeout: 30 * time.Second}, Keys: keys, APIURL: apiURL}
+	m, err := client.GetModel(context.Background(), model)
+	switch {
+	case errors.Is(err, gemini.ErrNotFound):
+		return errs.New(errs.ExitConfig, "model %q not found. Run \"goaider models\" to list available models", model)
+	case errs.Is(err, errs.ExitAuth):
+		return err
+	case err != nil:
+		fmt.Printf("Warning: failed to validate model %q: %v\n", model, err)
+	case !m.CanGenerateContent():
+		return errs.New(errs.ExitConfig, "model %q does not support generateContent", model)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package pushhub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/cmd/thumbs"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/hfhub"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// Filename of the dataset card of a HuggingFace dataset repo
+	cardFilename = "README.md"
+
+	maxRetries  = 5
+	baseBackoff = 2 * time.Second
+	maxBackoff  = 60 * time.Second
+)
+
+var (
+	flagDir         string
+	flagRepo        string
+	flagRevision    string
+	flagMessage     string
+	flagPrivate     bool
+	flagCommitEvery int
+	flagNoCard      bool
+	flagDryRun      bool
+	fileFilter      util.FileFilter
+)
+
+var pushHubCmd = &cobra.Command{
+	Use:   "push-hub",
+	Short: "Upload a dataset dir to a HuggingFace Hub dataset repo",
+	Long: `Upload a prepared dataset dir (e.g. the shards of export, or images and captions) to a
+HuggingFace Hub dataset repo, which is created (--private) if it does not exist.
+The access token (with write permission) is read from the ` + constants.ENV_HF_TOKEN + ` environment variable.
+Set ` + constants.ENV_HF_ENDPOINT + ` to use another Hub endpoint, e.g. a mirror.
+
+Local files are hashed and compared with the files of the repo, and only new or changed files are uploaded.
+Large and binary files are uploaded to the LFS storage (in parts if the Hub requests it), and the files
+are committed every --commit-every files. An interrupted push is resumed by running it again:
+committed files are skipped, and uploaded but not committed LFS files are not uploaded again.
+A large file interrupted in the middle of its upload is uploaded again from its start.
+
+If the dir has no "` + cardFilename + `" dataset card, a stub of it (with the metadata of the dataset and
+sections to fill in) is created in the dir and uploaded, unless --no-card is set.
+Hidden files and dirs (starting with ".") are not uploaded.`,
+	Args: cobra.NoArgs,
+	RunE: pushHub,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(pushHubCmd)
+	pushHubCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dataset dir")
+	pushHubCmd.Flags().StringVar(&flagRepo, "repo", "", `Required: The dataset repo, "<user or organization>/<name>"`)
+	pushHubCmd.Flags().StringVar(&flagRevision, "revision", "main", "Optional: The branch to push to")
+	pushHubCmd.Flags().StringVar(&flagMessage, "message", "Upload dataset with goaider", "Optional: The commit message")
+	pushHubCmd.Flags().BoolVar(&flagPrivate, "private", false, "Optional: Create the repo as a private one if it does not exist")
+	pushHubCmd.Flags().IntVar(&flagCommitEvery, "commit-every", 200, "Optional: Commit the uploaded files every this number of files")
+	pushHubCmd.Flags().BoolVar(&flagNoCard, "no-card", false, "Optional: Do not create a "+cardFilename+" dataset card stub if the dir has none")
+	pushHubCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "Optional: Only print the files that would be uploaded")
+	fileFilter.AddFlags(pushHubCmd.Flags())
+	pushHubCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(pushHubCmd.Flags(), "dir", ".")
+	pushHubCmd.MarkFlagRequired("repo")
+}
+
+func pushHub(_ *cobra.Command, _ []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if owner, name, ok := strings.Cut(flagRepo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return errs.New(errs.ExitConfig, `invalid --repo %q, must be in "<user or organization>/<name>" format`, flagRepo)
+	}
+	if flagCommitEvery <= 0 {
+		return errs.New(errs.ExitConfig, "invalid --commit-every %d: must be positive", flagCommitEvery)
+	}
+	token, err := hfhub.LoadToken()
+	if err != nil {
+		return err
+	}
+	client := &hfhub.Client{
+		HTTPClient: &http.Client{},
+		Token:      token,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+		},
+	}
+	ctx := context.Background()
+	if !flagDryRun {
+		if err := client.CreateRepo(ctx, flagRepo, flagPrivate); err != nil {
+			return fmt.Errorf("failed to create repo %s: %w", flagRepo, err)
+		}
+	}
+
+	cardPath := filepath.Join(flagDir, cardFilename)
+	if _, err := os.Stat(util.LongPath(cardPath)); os.IsNotExist(err) && !flagNoCard {
+		card, err := datasetCard()
+		if err != nil {
+			return err
+		}
+		if flagDryRun {
+			fmt.Printf("Would create dataset card stub %q\n", cardPath)
+		} else if err := util.WriteFileAtomic(cardPath, []byte(card)); err != nil {
+			return err
+		} else {
+			fmt.Printf("Created dataset card stub %q, edit it and push again to update it\n", cardPath)
+		}
+	}
+
+	fmt.Printf("Hashing local files in %q...\n", flagDir)
+	manifest, err := util.BuildManifest(flagDir, func(path string, entry fs.DirEntry) bool {
+		return fileFilter.Match(entry)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan dir %q: %w", flagDir, err)
+	}
+	var files []*hfhub.File
+	for _, file := range manifest.Files {
+		files = append(files, &hfhub.File{
+			Path:      file.Path,
+			LocalPath: filepath.Join(flagDir, filepath.FromSlash(file.Path)),
+			Size:      file.Size,
+			Sha256:    file.Sha256,
+		})
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no files to upload in %q", flagDir)
+	}
+
+	repoExists := true
+	remoteFiles, err := client.ListFiles(ctx, flagRepo, flagRevision)
+	if errors.Is(err, hfhub.ErrNotFound) && flagDryRun {
+		repoExists = false
+	} else if err != nil {
+		return fmt.Errorf("failed to list the files of repo %s: %w", flagRepo, err)
+	}
+	remote := map[string]*hfhub.RepoFile{}
+	for _, file := range remoteFiles {
+		remote[file.Path] = file
+	}
+	modes := map[string]string{}
+	if repoExists {
+		if modes, err = client.Preupload(ctx, flagRepo, flagRevision, files); err != nil {
+			return fmt.Errorf("failed to get the upload modes of files: %w", err)
+		}
+	}
+
+	var changed []*hfhub.File
+	var changedSize int64
+	unchangedCnt, ignoredCnt := 0, 0
+	for _, file := range files {
+		if modes[file.Path] == hfhub.ModeIgnore {
+			ignoredCnt++
+			continue
+		}
+		unchanged, err := isUnchanged(file, remote[file.Path])
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			unchangedCnt++
+			continue
+		}
+		changed = append(changed, file)
+		changedSize += file.Size
+	}
+	fmt.Printf("%d files to upload (%s), %d unchanged, %d ignored by the repo\n", len(changed),
+		util.FormatBytes(changedSize), unchangedCnt, ignoredCnt)
+	if flagDryRun {
+		for _, file := range changed {
+			fmt.Printf("  + %s (%s)\n", file.Path, util.FormatBytes(file.Size))
+		}
+		return nil
+	}
+
+	commits := (len(changed) + flagCommitEvery - 1) / flagCommitEvery
+	uploadedCnt, errorCnt := 0, 0
+	for start := 0; start < len(changed); start += flagCommitEvery {
+		batch := changed[start:min(start+flagCommitEvery, len(changed))]
+		var committing []*hfhub.File
+		lfs := map[string]bool{}
+		for _, file := range batch {
+			if modes[file.Path] == hfhub.ModeLFS {
+				uploaded, err := client.UploadLFS(ctx, flagRepo, flagRevision, file)
+				if err != nil {
+					fmt.Printf("❌ %s: %v\n", file.Path, err)
+					errorCnt++
+					if errs.Is(err, errs.ExitAuth) {
+						return fmt.Errorf("push aborted: %w", err)
+					}
+					continue
+				}
+				if uploaded {
+					fmt.Printf("✅ %s (%s)\n", file.Path, util.FormatBytes(file.Size))
+				} else {
+					fmt.Printf("⏩ %s: already uploaded\n", file.Path)
+				}
+				lfs[file.Path] = true
+			}
+			committing = append(committing, file)
+		}
+		if len(committing) == 0 {
+			continue
+		}
+		message := flagMessage
+		if commits > 1 {
+			message = fmt.Sprintf("%s (%d/%d)", flagMessage, start/flagCommitEvery+1, commits)
+		}
+		commitURL, err := client.Commit(ctx, flagRepo, flagRevision, message, committing, lfs)
+		if err != nil {
+			return fmt.Errorf("failed to commit %d files (run again to resume): %w", len(committing), err)
+		}
+		uploadedCnt += len(committing)
+		fmt.Printf("Committed %d files: %s\n", len(committing), commitURL)
+	}
+	fmt.Printf("Done. %d files uploaded, %d failed. Dataset: %s/datasets/%s\n", uploadedCnt, errorCnt,
+		client.EndpointURL(), flagRepo)
+	return errs.RunResult(len(changed), errorCnt)
+}
+
+// isUnchanged reports whether the local file has the same content as the file of the repo (nil if none).
+func isUnchanged(file *hfhub.File, remote *hfhub.RepoFile) (bool, error) {
+	if remote == nil || remote.Size != file.Size {
+		return false, nil
+	}
+	if remote.LFS != nil {
+		return remote.LFS.Oid == file.Sha256, nil
+	}
+	oid, err := hfhub.GitBlobSHA1(file.LocalPath, file.Size)
+	if err != nil {
+		return false, err
+	}
+	return remote.Oid == oid, nil
+}
+
+// datasetCard returns the stub of the dataset card of --dir: the YAML metadata of the dataset
+// (from the kinds of its files) and sections to fill in.
+func datasetCard() (string, error) {
+	absDir, err := filepath.Abs(flagDir)
+	if err != nil {
+		return "", err
+	}
+	imageCnt, captionCnt, audioCnt, parquetCnt, tarCnt := 0, 0, 0, 0, 0
+	err = filepath.WalkDir(util.LongPath(flagDir), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != util.LongPath(flagDir) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch ext := strings.ToLower(filepath.Ext(entry.Name())); {
+		case entry.IsDir():
+		case thumbs.IsImageFile(entry.Name()):
+			imageCnt++
+		case ext == ".txt":
+			captionCnt++
+		case ext == ".wav" || ext == ".flac" || ext == ".mp3" || ext == ".ogg":
+			audioCnt++
+		case ext == ".parquet":
+			parquetCnt++
+		case ext == ".tar":
+			tarCnt++
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	name := filepath.Base(absDir)
+	sb.WriteString("---\n")
+	fmt.Fprintf(&sb, "pretty_name: %s\n", name)
+	sb.WriteString("license: other # TODO: the license of the data\n")
+	var tasks []string
+	samples := imageCnt
+	if imageCnt > 0 || parquetCnt > 0 || tarCnt > 0 {
+		tasks = append(tasks, "text-to-image")
+	}
+	if audioCnt > 0 {
+		tasks = append(tasks, "text-to-speech")
+		samples = max(samples, audioCnt)
+	}
+	if len(tasks) > 0 {
+		sb.WriteString("task_categories:\n")
+		for _, task := range tasks {
+			fmt.Fprintf(&sb, "- %s\n", task)
+		}
+	}
+	if samples > 0 {
+		fmt.Fprintf(&sb, "size_categories:\n- %s\n", sizeCategory(samples))
+	}
+	sb.WriteString("tags:\n- goaider\n")
+	sb.WriteString("---\n\n")
+	fmt.Fprintf(&sb, "# %s\n\n", name)
+	sb.WriteString("TODO: describe the dataset: its subject, the sources of the data and how it was collected.\n\n")
+	sb.WriteString("## Dataset structure\n\n")
+	if parquetCnt > 0 {
+		fmt.Fprintf(&sb, "- %d parquet shards with the columns `image` (`{bytes, path}`), `caption` and `metadata`"+
+			" (the JSON of the metadata of the image).\n", parquetCnt)
+	}
+	if tarCnt > 0 {
+		fmt.Fprintf(&sb, "- %d WebDataset tar shards. The files of a sample are `<key>.<image ext>`, `<key>.txt`"+
+			" (the caption) and `<key>.json` (the metadata, if any).\n", tarCnt)
+	}
+	if imageCnt > 0 {
+		fmt.Fprintf(&sb, "- %d images, each captioned by the `.txt` file of the same name.\n", imageCnt)
+	}
+	if audioCnt > 0 {
+		fmt.Fprintf(&sb, "- %d audio clips, each transcribed by the `.txt` file of the same name.\n", audioCnt)
+	}
+	if imageCnt == 0 && audioCnt == 0 && captionCnt > 0 {
+		fmt.Fprintf(&sb, "- %d `.txt` files.\n", captionCnt)
+	}
+	sb.WriteString("\n## Intended use\n\nTODO: e.g. the models the dataset is for, and its limitations.\n")
+	return sb.String(), nil
+}
+
+// sizeCategory returns the size category (of the dataset card metadata) of n samples.
+func sizeCategory(n int) string {
+	switch {
+	case n < 1000:
+		return "n<1K"
+	case n < 10000:
+		return "1K<n<10K"
+	case n < 100000:
+		return "10K<n<100K"
+	case n < 1000000:
+		return "100K<n<1M"
+	default:
+		return "1M<n<10M"
+	}
+}
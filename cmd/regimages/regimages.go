@@ -0,0 +1,316 @@
+package regimages
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/pkg/embedder"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir            string
+	flagPool           string
+	flagOutput         string
+	flagCount          int
+	flagClasses        []string
+	flagClassThreshold float64
+	flagMaxSimilarity  float64
+	flagDiversity      float64
+	flagCaptionExt     string
+	flagRecursive      bool
+	flagDryRun         bool
+	flagProgress       bool
+	embedOptions       embedder.Options
+	fileFilter         util.FileFilter
+)
+
+var regImagesCmd = &cobra.Command{
+	Use:   "reg-images --pool <dir>",
+	Short: "Select regularization images (hard negatives) of a subject dataset from a generic image pool",
+	Long: `Select --count regularization images for the subject dataset (--dir) from a large generic image pool
+(--pool): the images that are similar in composition to the subject images (e.g. the same class, framing
+and setting) but are not the subject, which teach the model what the class looks like without the subject.
+
+The images are compared by the image embeddings of a local CLIP or SigLIP model (--embed-model).
+The existing embeddings of the embed command ("<dir>/.goaider/embeddings.npz") of both dirs are reused,
+so run "goaider embed --dir <pool>" once for a large pool.
+- The pool images too similar to any subject image (--max-similarity) are skipped as the subject itself
+  or its near-duplicates.
+- With --class (e.g. "woman"), only the pool images whose caption has any of the class tags are
+  candidates; the images without a caption qualify if their similarity to the text "a photo of a <class>"
+  is at least --class-threshold (requires the text encoder of the model).
+- The candidates are ranked by their similarity to the mean of the subject images, and picked greedily
+  for both the similarity and the diversity (--diversity) of the selection.
+
+The selected images are copied (with their caption files) to --output (default "<dir>-reg").`,
+	Args: cobra.NoArgs,
+	RunE: regImages,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(regImagesCmd)
+	regImagesCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the subject image directory")
+	regImagesCmd.Flags().StringVar(&flagPool, "pool", "", "Required: Path to the directory of the generic image pool")
+	regImagesCmd.Flags().StringVar(&flagOutput, "output", "", `Optional: Output dir of the selected images. default: "<dir>-reg"`)
+	regImagesCmd.Flags().IntVar(&flagCount, "count", 100, "Optional: Number of regularization images to select")
+	regImagesCmd.Flags().StringSliceVar(&flagClasses, "class", nil, `Optional: Comma-separated class tags (e.g. "woman"). Only the pool images of the class are candidates`)
+	regImagesCmd.Flags().Float64Var(&flagClassThreshold, "class-threshold", 0.2, `Optional: Min similarity (cosine) of the pool images without a caption to the text "a photo of a <class>" of --class`)
+	regImagesCmd.Flags().Float64Var(&flagMaxSimilarity, "max-similarity", 0.9, "Optional: Max similarity (cosine) of a pool image to any subject image, above which it's skipped as the subject")
+	regImagesCmd.Flags().Float64Var(&flagDiversity, "diversity", 0.5, "Optional: Weight (0.0-1.0) of the diversity of the selection vs the similarity to the subject images")
+	regImagesCmd.Flags().StringVar(&flagCaptionExt, "caption-ext", ".txt", "Optional: Extension of the caption files")
+	regImagesCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also select the images in the subdirectories of --pool (except hidden ones)")
+	regImagesCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "Optional: Only print the selected images, do not copy them")
+	regImagesCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar while embedding the images. Ignored if stdout is not a terminal")
+	embedOptions.AddFlags(regImagesCmd.Flags())
+	fileFilter.AddFlags(regImagesCmd.Flags())
+	regImagesCmd.MarkFlagRequired("dir")
+	regImagesCmd.MarkFlagRequired("pool")
+	cmd.SetPromptDefault(regImagesCmd.Flags(), "dir", ".")
+}
+
+// embedded is an image of a dir and its embedding.
+type embedded struct {
+	path   string
+	name   string // the slash-separated path relative to the dir
+	vector []float32
+	// Of the pool images
+	relevance float64 // the similarity to the mean of the subject images
+	subject   float64 // the max similarity to the subject images
+}
+
+func regImages(_ *cobra.Command, _ []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagCount < 1 {
+		return errs.New(errs.ExitConfig, "invalid --count %d: must be >= 1", flagCount)
+	}
+	if flagDiversity < 0 || flagDiversity > 1 {
+		return errs.New(errs.ExitConfig, "invalid --diversity %v: must be in 0.0-1.0", flagDiversity)
+	}
+	captionExt, err := util.ParseOutputExt(flagCaptionExt, ".txt")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	output := flagOutput
+	if output == "" {
+		output = filepath.Clean(flagDir) + "-reg"
+	}
+	e, err := embedder.New(&embedOptions)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	var classVectors [][]float32
+	for _, class := range flagClasses {
+		v, err := e.EmbedText("a photo of a " + class)
+		if errors.Is(err, embedder.ErrNoTextModel) {
+			fmt.Printf("Warning: the model has no text encoder, the pool images without a caption are skipped by --class\n")
+			break
+		} else if err != nil {
+			return err
+		}
+		classVectors = append(classVectors, v)
+	}
+
+	// 1. Embed the subject and pool images
+	subjects, errorCnt, err := embedDir(e, flagDir, false, false)
+	if err != nil {
+		return err
+	}
+	if len(subjects) == 0 {
+		return errs.New(errs.ExitConfig, "no subject images in %q", flagDir)
+	}
+	pool, poolErrorCnt, err := embedDir(e, flagPool, flagRecursive, true)
+	if err != nil {
+		return err
+	}
+	errorCnt += poolErrorCnt
+	var centroid []float32
+	for _, subject := range subjects {
+		if centroid == nil {
+			centroid = make([]float32, len(subject.vector))
+		}
+		for i := range min(len(centroid), len(subject.vector)) {
+			centroid[i] += subject.vector[i]
+		}
+	}
+	centroid = embedder.Normalize(centroid)
+	var subjectVectors [][]float32
+	for _, subject := range subjects {
+		subjectVectors = append(subjectVectors, subject.vector)
+	}
+
+	// 2. Filter the candidates
+	var candidates []*embedded
+	skippedSubject, skippedClass := 0, 0
+	for _, img := range pool {
+		img.subject, _ = embedder.MaxSimilarity(img.vector, subjectVectors)
+		if img.subject > flagMaxSimilarity {
+			skippedSubject++
+			continue
+		}
+		if len(flagClasses) > 0 && !isOfClass(img, captionExt, classVectors) {
+			skippedClass++
+			continue
+		}
+		img.relevance = embedder.Similarity(img.vector, centroid)
+		candidates = append(candidates, img)
+	}
+	fmt.Printf("%d candidates of %d pool images (%d skipped as the subject, %d not of the class)\n",
+		len(candidates), len(pool), skippedSubject, skippedClass)
+
+	// 3. Select the most relevant and diverse candidates
+	selected := selectDiverse(candidates, flagCount, flagDiversity)
+	if len(selected) < flagCount {
+		fmt.Printf("Warning: only %d candidates, fewer than --count %d\n", len(selected), flagCount)
+	}
+	fmt.Printf("Selected %d regularization images (similarity to the subject images, path):\n", len(selected))
+	for _, img := range selected {
+		fmt.Printf("  %.3f %s\n", img.relevance, img.path)
+	}
+	if flagDryRun {
+		return errs.RunResult(len(subjects)+len(pool)+errorCnt, errorCnt)
+	}
+
+	// 4. Copy them
+	if err := os.MkdirAll(util.LongPath(output), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	for _, img := range selected {
+		// The images of the subdirectories of the pool are flattened, e.g. "a/b.jpg" => "a_b.jpg"
+		name := strings.ReplaceAll(img.name, "/", "_")
+		if err := util.CopyFileAtomic(img.path, filepath.Join(output, name)); err != nil {
+			fmt.Printf("❌ failed to copy %s: %v\n", img.path, err)
+			errorCnt++
+			continue
+		}
+		captionPath := captioner.CaptionFilePath(img.path, captionExt)
+		if _, err := os.Stat(util.LongPath(captionPath)); err == nil {
+			if err := util.CopyFileAtomic(captionPath,
+				captioner.CaptionFilePath(filepath.Join(output, name), captionExt)); err != nil {
+				fmt.Printf("❌ failed to copy %s: %v\n", captionPath, err)
+				errorCnt++
+			}
+		}
+	}
+	fmt.Printf("Copied the selected images to %s\n", output)
+	return errs.RunResult(len(subjects)+len(pool)+errorCnt, errorCnt)
+}
+
+// embedDir returns the images of dir with their embeddings, reusing the embeddings of the embed command
+// of dir of the unchanged images. The images that fail to embed are skipped and counted.
+func embedDir(e embedder.Embedder, dir string, recursive bool, filter bool) (images []*embedded, errorCnt int, err error) {
+	listInputFiles := util.ListInputFiles
+	if recursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(dir, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	var store *embedder.Store
+	var index map[string]int
+	if s, err := embedder.LoadStore(embedder.DefaultStorePath(dir)); err == nil &&
+		s.Image != nil && s.ImageModel == embedder.LocalModelName(&embedOptions) {
+		store, index = s, s.Index()
+	}
+	var todo []*embedded
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || (filter && !fileFilter.Match(file)) {
+			continue
+		}
+		img := &embedded{path: file.Path, name: file.Name()}
+		if rel, err := filepath.Rel(dir, file.Path); err == nil {
+			img.name = filepath.ToSlash(rel)
+		}
+		images = append(images, img)
+		if i, ok := index[img.name]; ok && store.Image[i] != nil {
+			// The stored mtime is the latest of the image and its caption
+			if info, err := file.Info(); err == nil && store.Mtimes[i] >= info.ModTime().UnixNano() {
+				img.vector = store.Image[i]
+				continue
+			}
+		}
+		todo = append(todo, img)
+	}
+	if len(todo) > 0 {
+		fmt.Printf("Embedding %d images of %s (%d up to date)\n", len(todo), dir, len(images)-len(todo))
+	}
+	progress := util.NewProgress(len(todo), flagProgress && util.IsTerminal(os.Stdout))
+	for _, img := range todo {
+		progress.Start(img.name)
+		img.vector, err = embedder.EmbedImageFile(e, img.path)
+		progress.Done(err != nil)
+		if err != nil {
+			progress.Printf("❌ %s: %v\n", img.path, err)
+			errorCnt++
+		}
+	}
+	progress.Finish()
+	images = slices.DeleteFunc(images, func(img *embedded) bool { return img.vector == nil })
+	return images, errorCnt, nil
+}
+
+// isOfClass reports whether the pool image is of any class of --class: by the tags of its caption,
+// or by the similarity to the classVectors if it has no caption.
+func isOfClass(img *embedded, captionExt string, classVectors [][]float32) bool {
+	data, err := os.ReadFile(util.LongPath(captioner.CaptionFilePath(img.path, captionExt)))
+	if err != nil {
+		similarity, _ := embedder.MaxSimilarity(img.vector, classVectors)
+		return similarity >= flagClassThreshold
+	}
+	caption := strings.ToLower(strings.TrimPrefix(string(data), util.UTF8_BOM))
+	for _, tag := range strings.Split(caption, ",") {
+		for _, class := range flagClasses {
+			if strings.TrimSpace(tag) == strings.ToLower(strings.TrimSpace(class)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectDiverse picks up to count of candidates by maximal marginal relevance: each next pick maximizes
+// (1 - diversity) * its relevance - diversity * its max similarity to the picked ones.
+func selectDiverse(candidates []*embedded, count int, diversity float64) []*embedded {
+	// Only the most relevant ones are considered, which keeps the selection O(count^2)
+	slices.SortStableFunc(candidates, func(a, b *embedded) int { return cmp.Compare(b.relevance, a.relevance) })
+	candidates = candidates[:min(len(candidates), 10*count)]
+	var selected []*embedded
+	// The max similarity of each candidate to the selected ones
+	redundancy := make([]float64, len(candidates))
+	picked := make([]bool, len(candidates))
+	for len(selected) < min(count, len(candidates)) {
+		best, bestScore := -1, 0.0
+		for i, candidate := range candidates {
+			if picked[i] {
+				continue
+			}
+			score := (1-diversity)*candidate.relevance - diversity*redundancy[i]
+			if best == -1 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked[best] = true
+		selected = append(selected, candidates[best])
+		for i, candidate := range candidates {
+			if s := embedder.Similarity(candidate.vector, candidates[best].vector); len(selected) == 1 || s > redundancy[i] {
+				redundancy[i] = s
+			}
+		}
+	}
+	return selected
+}
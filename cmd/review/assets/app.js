@@ -0,0 +1,143 @@
+"use strict";
+
+let images = [];
+
+const grid = document.getElementById("grid");
+const filterInput = document.getElementById("filter");
+const flaggedOnly = document.getElementById("flagged-only");
+
+function splitTags(caption) {
+  return caption.split(",").map((t) => t.trim().toLowerCase()).filter((t) => t);
+}
+
+function matches(image) {
+  if (flaggedOnly.checked && !image.flagged) {
+    return false;
+  }
+  const tags = splitTags(image.caption);
+  for (const term of splitTags(filterInput.value)) {
+    if (term.startsWith("-")) {
+      if (tags.includes(term.slice(1).trim())) return false;
+    } else if (!tags.includes(term)) {
+      return false;
+    }
+  }
+  return true;
+}
+
+async function saveCaption(image, textarea, status) {
+  if (textarea.value === image.caption) return;
+  status.textContent = "saving...";
+  status.className = "status";
+  try {
+    const res = await fetch("api/caption/" + encodeURIComponent(image.name), { method: "PUT", body: textarea.value });
+    if (!res.ok) throw new Error(await res.text());
+    image.caption = textarea.value.trim();
+    status.textContent = "saved";
+    status.className = "status saved";
+    renderTags();
+  } catch (e) {
+    status.textContent = "error: " + e.message;
+    status.className = "status error";
+  }
+}
+
+async function setFlagged(image, flagged, card) {
+  const res = await fetch("api/flag/" + encodeURIComponent(image.name), {
+    method: "PUT",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ flagged }),
+  });
+  if (res.ok) {
+    image.flagged = flagged;
+    card.classList.toggle("flagged", flagged);
+    renderStats();
+  }
+}
+
+function renderCard(image) {
+  const card = document.createElement("div");
+  card.className = "card" + (image.flagged ? " flagged" : "");
+
+  const img = document.createElement("img");
+  img.loading = "lazy";
+  img.src = "thumb/" + encodeURIComponent(image.name);
+  img.onclick = () => window.open("image/" + encodeURIComponent(image.name), "_blank");
+
+  const name = document.createElement("div");
+  name.className = "name";
+  name.textContent = image.name;
+
+  const textarea = document.createElement("textarea");
+  textarea.value = image.caption;
+  const status = document.createElement("span");
+  status.className = "status";
+  textarea.oninput = () => {
+    status.textContent = "unsaved (Ctrl+Enter or leave to save)";
+    status.className = "status dirty";
+  };
+  textarea.onblur = () => saveCaption(image, textarea, status);
+  textarea.onkeydown = (e) => {
+    if (e.key === "Enter" && (e.ctrlKey || e.metaKey)) {
+      e.preventDefault();
+      saveCaption(image, textarea, status);
+    }
+  };
+
+  const actions = document.createElement("div");
+  actions.className = "actions";
+  const flag = document.createElement("label");
+  const checkbox = document.createElement("input");
+  checkbox.type = "checkbox";
+  checkbox.checked = image.flagged;
+  checkbox.onchange = () => setFlagged(image, checkbox.checked, card);
+  flag.append(checkbox, " Flag for deletion");
+  actions.append(flag, status);
+
+  card.append(img, name, textarea, actions);
+  return card;
+}
+
+function renderStats() {
+  const shown = images.filter(matches).length;
+  const flagged = images.filter((i) => i.flagged).length;
+  document.getElementById("stats").textContent = `${shown} / ${images.length} images, ${flagged} flagged`;
+}
+
+function renderTags() {
+  const counts = new Map();
+  for (const image of images) {
+    for (const tag of new Set(splitTags(image.caption))) {
+      counts.set(tag, (counts.get(tag) || 0) + 1);
+    }
+  }
+  const list = document.getElementById("tags");
+  list.replaceChildren();
+  for (const [tag, count] of [...counts].sort((a, b) => b[1] - a[1] || a[0].localeCompare(b[0]))) {
+    const li = document.createElement("li");
+    li.append(tag, Object.assign(document.createElement("span"), { textContent: count }));
+    li.onclick = () => {
+      const terms = splitTags(filterInput.value);
+      if (!terms.includes(tag)) terms.push(tag);
+      filterInput.value = terms.join(", ");
+      render();
+    };
+    list.append(li);
+  }
+}
+
+function render() {
+  grid.replaceChildren(...images.filter(matches).map(renderCard));
+  renderStats();
+}
+
+filterInput.oninput = render;
+flaggedOnly.onchange = render;
+
+fetch("api/images")
+  .then((res) => res.json())
+  .then((data) => {
+    images = data;
+    renderTags();
+    render();
+  });
@@ -0,0 +1,285 @@
+package review
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/cmd/thumbs"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+//go:embed assets
+var assets embed.FS
+
+var (
+	flagDir       string
+	flagAddr      string
+	flagThumbSize int
+	fileFilter    util.FileFilter
+)
+
+var reviewCmd = &cobra.Command{
+	Use:   "review",
+	Short: "Serve a local web UI to review and edit the captions of a dataset",
+	Long: `Serve a local web UI showing an image grid of a dataset dir with captions.
+
+- Edit captions inline; changes are saved back to the .txt files.
+  The original captions are backed up (see captions-diff / captions-restore).
+- Filter images by tags (comma-separated; prefix a tag with "-" to exclude it),
+  or click a tag in the tag list.
+- Flag images for deletion. The flagged images are saved to "` + util.FLAGGED_FILE + `"
+  in the dir (one filename per line), and listed when the server stops.
+  No file is deleted by the server.
+
+Thumbnails are read from the "<dir>-thumbs" folder generated by the thumbs command
+if it exists, otherwise generated on the fly.`,
+	Args: cobra.NoArgs,
+	RunE: review,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(reviewCmd)
+	reviewCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the image directory")
+	reviewCmd.Flags().StringVar(&flagAddr, "addr", "127.0.0.1:8080", "Optional: Listening address of the web server")
+	reviewCmd.Flags().IntVar(&flagThumbSize, "thumb-size", 384, "Optional: Max size of thumbnails generated on the fly")
+	fileFilter.AddFlags(reviewCmd.Flags())
+	reviewCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(reviewCmd.Flags(), "dir", ".")
+}
+
+// imageItem is an image of the dataset, as returned by the images API.
+type imageItem struct {
+	Name    string `json:"name"`
+	Caption string `json:"caption"`
+	Flagged bool   `json:"flagged"`
+}
+
+type server struct {
+	dir       string
+	thumbsDir string
+	images    map[string]bool // image filenames of dir
+	flagged   map[string]bool
+	thumbs    map[string][]byte // on the fly generated thumbnails
+	backup    *util.Backup      // backup of edited captions
+	mu        sync.Mutex
+}
+
+func review(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	absDir, err := filepath.Abs(flagDir)
+	if err != nil {
+		return err
+	}
+	s := &server{
+		dir:       absDir,
+		thumbsDir: absDir + "-thumbs",
+		images:    map[string]bool{},
+		flagged:   map[string]bool{},
+		thumbs:    map[string][]byte{},
+		backup:    util.NewBackup(),
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %q: %w", flagDir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && thumbs.IsImageFile(entry.Name()) && fileFilter.Match(entry) {
+			s.images[entry.Name()] = true
+		}
+	}
+	if len(s.images) == 0 {
+		return fmt.Errorf("no images found in %q", flagDir)
+	}
+	flagged, err := util.ReadFlagged(absDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range flagged {
+		s.flagged[name] = true
+	}
+
+	mux := http.NewServeMux()
+	static, _ := fs.Sub(assets, "assets")
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET /api/images", s.handleImages)
+	mux.HandleFunc("GET /image/{name}", s.handleImage)
+	mux.HandleFunc("GET /thumb/{name}", s.handleThumb)
+	mux.HandleFunc("PUT /api/caption/{name}", s.handleCaption)
+	mux.HandleFunc("PUT /api/flag/{name}", s.handleFlag)
+
+	listener, err := net.Listen("tcp", flagAddr)
+	if err != nil {
+		return errs.New(errs.ExitConfig, "failed to listen on %s: %w", flagAddr, err)
+	}
+	fmt.Printf("Reviewing %d images of %q at http://%s/ (press Ctrl+C to stop)\n", len(s.images), flagDir,
+		listener.Addr())
+	srv := &http.Server{Handler: mux}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.flagged) > 0 {
+		fmt.Printf("\n%d images flagged for deletion (saved to %s):\n", len(s.flagged), filepath.Join(flagDir, util.FLAGGED_FILE))
+		var names []string
+		for name := range s.flagged {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	return nil
+}
+
+func (s *server) handleImages(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := []imageItem{}
+	for name := range s.images {
+		caption, _ := os.ReadFile(util.LongPath(s.captionPath(name)))
+		items = append(items, imageItem{Name: name, Caption: strings.TrimSpace(string(caption)),
+			Flagged: s.flagged[name]})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// imageName returns the requested image name, or "" (after writing a 404 response) if it's not an image of dir.
+func (s *server) imageName(w http.ResponseWriter, r *http.Request) string {
+	name := r.PathValue("name")
+	if !s.images[name] {
+		http.NotFound(w, r)
+		return ""
+	}
+	return name
+}
+
+func (s *server) captionPath(name string) string {
+	return filepath.Join(s.dir, strings.TrimSuffix(name, filepath.Ext(name))+".txt")
+}
+
+func (s *server) handleImage(w http.ResponseWriter, r *http.Request) {
+	if name := s.imageName(w, r); name != "" {
+		http.ServeFile(w, r, util.LongPath(filepath.Join(s.dir, name)))
+	}
+}
+
+func (s *server) handleThumb(w http.ResponseWriter, r *http.Request) {
+	name := s.imageName(w, r)
+	if name == "" {
+		return
+	}
+	if thumbPath := thumbs.ThumbPath(s.thumbsDir, name); util.OutputUpToDate(filepath.Join(s.dir, name), thumbPath, true) {
+		http.ServeFile(w, r, util.LongPath(thumbPath))
+		return
+	}
+	s.mu.Lock()
+	data, ok := s.thumbs[name]
+	s.mu.Unlock()
+	if !ok {
+		var shrunk bool
+		var err error
+		data, shrunk, err = util.ShrinkImageForUpload(filepath.Join(s.dir, name), flagThumbSize, 80)
+		if err != nil || !shrunk {
+			// Small enough (or can't be decoded): serve the original
+			http.ServeFile(w, r, util.LongPath(filepath.Join(s.dir, name)))
+			return
+		}
+		s.mu.Lock()
+		s.thumbs[name] = data
+		s.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.Copy(w, bytes.NewReader(data))
+}
+
+func (s *server) handleCaption(w http.ResponseWriter, r *http.Request) {
+	name := s.imageName(w, r)
+	if name == "" {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	caption := strings.TrimSpace(strings.ReplaceAll(string(body), "\r\n", "\n"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.backup.Save(s.captionPath(name)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(util.LongPath(s.captionPath(name)), []byte(caption), 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Saved caption of %s\n", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleFlag(w http.ResponseWriter, r *http.Request) {
+	name := s.imageName(w, r)
+	if name == "" {
+		return
+	}
+	var req struct {
+		Flagged bool `json:"flagged"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Flagged {
+		s.flagged[name] = true
+	} else {
+		delete(s.flagged, name)
+	}
+	if err := s.saveFlagged(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Flagged images for deletion: %d\n", len(s.flagged))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveFlagged writes the flagged images list file. The caller must hold s.mu.
+func (s *server) saveFlagged() error {
+	var names []string
+	for name := range s.flagged {
+		names = append(names, name)
+	}
+	return util.WriteFlagged(s.dir, names)
+}
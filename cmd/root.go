@@ -1,22 +1,201 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/sagan/goaider/version"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+	"github.com/sagan/goaider/version"
+)
+
+// Flag annotation key of the suggested value used when interactively prompting for a missing required flag.
+const promptDefaultAnnotation = "goaider_prompt_default"
+
+// Flag annotation key of flags that are required unless positional args are given.
+const requiredUnlessArgsAnnotation = "goaider_required_unless_args"
+
+var (
+	flagNoInteractive bool
+	flagDebugHTTP     string
 )
 
 var RootCmd = &cobra.Command{
 	Use:   "goaider",
 	Short: "A CLI aider tool for AIGC " + version.Version,
 	Long:  `A CLI aider tool for AIGC ` + version.Version + ".",
+	// Runs before cobra validates required flags, so the prompted values satisfy them.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := promptMissingFlags(cmd, args); err != nil {
+			return err
+		}
+		if err := ValidateRequiredUnlessArgs(cmd, args); err != nil {
+			return err
+		}
+		if flagDebugHTTP != "" {
+			file, err := os.OpenFile(util.LongPath(flagDebugHTTP), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return errs.New(errs.ExitConfig, "failed to open --debug-http file: %w", err)
+			}
+			gemini.SetDebugLog(file)
+		}
+		return ApplyDirSettings(cmd, args)
+	},
+}
+
+func init() {
+	RootCmd.SetFlagErrorFunc(func(c *cobra.Command, err error) error {
+		return errs.Wrap(errs.ExitConfig, err)
+	})
+	RootCmd.PersistentFlags().BoolVar(&flagNoInteractive, "no-interactive", false,
+		"Do not prompt for missing required flags even if running in a terminal")
+	RootCmd.PersistentFlags().StringVar(&flagDebugHTTP, "debug-http", "",
+		"Append the API requests and responses (with API keys redacted, inline media elided and long bodies truncated) "+
+			"to this file, to diagnose failures")
 }
 
+// Execute runs the root command and appends the run to the history of the dataset dir (see AppendHistory).
+// On error, it exits with the exit code of the error's failure class. See errs package for the exit codes.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	start := time.Now()
+	cmd, err := RootCmd.ExecuteC()
+	if cmd != nil {
+		AppendHistory(cmd, cmd.Flags().Args(), start, err)
+	}
+	if err != nil {
 		fmt.Printf("%v\n", err)
-		os.Exit(1)
+		os.Exit(int(ExitCode(err)))
+	}
+}
+
+// ExitCode returns the exit code of the failure class of err, also of the usage errors of cobra itself.
+func ExitCode(err error) errs.Code {
+	code := errs.CodeOf(err)
+	if code == errs.ExitGeneral && isUsageError(err) {
+		code = errs.ExitConfig
+	}
+	return code
+}
+
+// isUsageError reports whether err is a command line usage error reported by cobra itself.
+func isUsageError(err error) bool {
+	msg := err.Error()
+	for _, prefix := range []string{"required flag(s)", "unknown command", "accepts ", "requires at least",
+		"requires at most", "if any flags in the group", "none of the others can be", "at least one of the flags"} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsInteractive reports whether the user can be prompted for input,
+// that is, stdin is a terminal and --no-interactive is not set.
+func IsInteractive() bool {
+	return !flagNoInteractive && util.IsTerminal(os.Stdin)
+}
+
+// SetPromptDefault sets the suggested value of flag name,
+// which is used if the user leaves the interactive prompt of that missing required flag empty.
+func SetPromptDefault(flags *pflag.FlagSet, name string, value string) {
+	flags.SetAnnotation(name, promptDefaultAnnotation, []string{value})
+}
+
+// MarkFlagRequiredUnlessArgs marks flag name as required if no positional args are given
+// and none of the unlessFlags (bool flags) is set, e.g. the --dir flag of commands that also accept files as args.
+func MarkFlagRequiredUnlessArgs(flags *pflag.FlagSet, name string, unlessFlags ...string) {
+	flags.SetAnnotation(name, requiredUnlessArgsAnnotation, append([]string{"true"}, unlessFlags...))
+}
+
+// ValidateRequiredUnlessArgs returns an error if no positional args are given and
+// any flag marked by MarkFlagRequiredUnlessArgs is not set.
+func ValidateRequiredUnlessArgs(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 {
+		return nil
+	}
+	var missing []string
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if !flag.Changed && isRequiredUnlessArgs(cmd.Flags(), flag) {
+			missing = append(missing, flag.Name)
+		}
+	})
+	if len(missing) > 0 {
+		// Same message as cobra's, so it's classified as a usage error
+		return fmt.Errorf(`required flag(s) "%s" not set`, strings.Join(missing, `", "`))
+	}
+	return nil
+}
+
+func isRequiredUnlessArgs(flags *pflag.FlagSet, flag *pflag.Flag) bool {
+	values := flag.Annotations[requiredUnlessArgsAnnotation]
+	if len(values) == 0 || values[0] != "true" {
+		return false
+	}
+	for _, name := range values[1:] {
+		if f := flags.Lookup(name); f != nil && f.Changed && f.Value.String() == "true" {
+			return false
+		}
+	}
+	return true
+}
+
+// promptMissingFlags asks the user for the values of all missing required flags,
+// if stdin is a terminal. Otherwise it does nothing and cobra reports the missing flags.
+func promptMissingFlags(cmd *cobra.Command, args []string) error {
+	if !IsInteractive() {
+		return nil
 	}
+	var reader *bufio.Reader
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed {
+			return
+		}
+		if required, ok := flag.Annotations[cobra.BashCompOneRequiredFlag]; (!ok || len(required) == 0 ||
+			required[0] != "true") && (len(args) > 0 || !isRequiredUnlessArgs(cmd.Flags(), flag)) {
+			return
+		}
+		defaultValue := ""
+		if values := flag.Annotations[promptDefaultAnnotation]; len(values) > 0 {
+			defaultValue = values[0]
+		}
+		if reader == nil {
+			reader = bufio.NewReader(os.Stdin)
+		}
+		for {
+			if defaultValue != "" {
+				fmt.Printf("--%s (%s) [%s]: ", flag.Name, flag.Usage, defaultValue)
+			} else {
+				fmt.Printf("--%s (%s): ", flag.Name, flag.Usage)
+			}
+			var input string
+			input, err = reader.ReadString('\n')
+			input = strings.TrimSpace(input)
+			if err != nil && input == "" {
+				err = fmt.Errorf("failed to read --%s: %w", flag.Name, err)
+				return
+			}
+			err = nil
+			if input == "" {
+				input = defaultValue
+			}
+			if input == "" {
+				continue
+			}
+			if err = cmd.Flags().Set(flag.Name, input); err != nil {
+				fmt.Printf("Invalid value: %v\n", err)
+				err = nil
+				continue
+			}
+			return
+		}
+	})
+	return err
 }
@@ -0,0 +1,260 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+)
+
+// Workflow is a pipeline of commands declared in a YAML workflow file.
+type Workflow struct {
+	// Optional default --dir of all steps. Relative paths are relative to the workflow file.
+	Dir string `yaml:"dir"`
+	// If true, continue to the next step when a step fails.
+	ContinueOnError bool   `yaml:"continue_on_error"`
+	Steps           []Step `yaml:"steps"`
+}
+
+// Step is a single command of a workflow.
+type Step struct {
+	Name    string `yaml:"name"`
+	Command string `yaml:"command"`
+	// Optional --dir of this step, overriding the workflow's dir.
+	Dir string `yaml:"dir"`
+	// Positional arguments.
+	Args []string `yaml:"args"`
+	// Flags of the command: flag name (without "--") => scalar value, or list of values for repeatable flags.
+	Options map[string]any `yaml:"options"`
+}
+
+type stepResult struct {
+	name     string
+	err      error
+	duration time.Duration
+	skipped  bool
+}
+
+var (
+	flagDryRun bool
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run <workflow.yaml>",
+	Short: "Run a pipeline of commands declared in a YAML workflow file",
+	Long: `Run a pipeline of commands declared in a YAML workflow file.
+
+Example workflow file:
+
+  dir: ./dataset          # default --dir of all steps, relative to the workflow file
+  continue_on_error: false
+  steps:
+    - command: norfilenames
+      options:
+        force: true
+    - command: crop
+      options:
+        width: 1024
+        height: 1024
+    - command: caption
+      dir: ./dataset-crop  # override the dir of this step
+      options:
+        identity: foobar
+        yes: true
+
+Each step runs a goaider command with the specified options (flags).
+A flag that can be set multiple times accepts a list value.
+The steps run sequentially; by default the pipeline stops at the first failed step.`,
+	Args: cobra.ExactArgs(1),
+	RunE: run,
+}
+
+func init() {
+	runCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "Only print the commands of the steps, do not run them")
+	cmd.RootCmd.AddCommand(runCmd)
+}
+
+func run(_ *cobra.Command, args []string) error {
+	workflow, err := loadWorkflow(args[0])
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var results []*stepResult
+	failed := false
+	for i, step := range workflow.Steps {
+		result := &stepResult{name: step.Name}
+		if result.name == "" {
+			result.name = step.Command
+		}
+		results = append(results, result)
+		if failed && !workflow.ContinueOnError {
+			result.skipped = true
+			continue
+		}
+		stepArgs, err := prepareStep(workflow, &step)
+		if err == nil {
+			fmt.Printf("\n==> [%d/%d] %s: goaider %s\n", i+1, len(workflow.Steps), result.name,
+				strings.Join(append([]string{step.Command}, stepArgs...), " "))
+			if !flagDryRun {
+				stepStart := time.Now()
+				err = runStep(&step, stepArgs)
+				result.duration = time.Since(stepStart)
+			}
+		}
+		if err != nil {
+			fmt.Printf("==> [%d/%d] %s: ❌ FAILED (%v)\n", i+1, len(workflow.Steps), result.name, err)
+			result.err = err
+			failed = true
+		}
+	}
+
+	fmt.Printf("\nWorkflow summary (%s):\n", time.Since(start).Round(time.Millisecond))
+	errorCnt := 0
+	var firstErr error
+	for i, result := range results {
+		status := "✅ OK"
+		if result.skipped {
+			status = "⏩ SKIPPED"
+		} else if result.err != nil {
+			status = fmt.Sprintf("❌ FAILED (%v)", result.err)
+			errorCnt++
+			if firstErr == nil {
+				firstErr = result.err
+			}
+		}
+		fmt.Printf("  %d. % -20s % -12s %s\n", i+1, result.name, result.duration.Round(time.Millisecond), status)
+	}
+	if errorCnt > 0 {
+		// Exit with the failure class of the first failed step
+		return errs.Wrap(cmd.ExitCode(firstErr), fmt.Errorf("%d steps failed", errorCnt))
+	}
+	return nil
+}
+
+// loadWorkflow reads and validates the workflow file at path.
+// The dirs in it are resolved relative to the dir of the workflow file.
+func loadWorkflow(path string) (*Workflow, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workflow file: %w", err)
+	}
+	workflow := &Workflow{}
+	if err := yaml.Unmarshal(contents, workflow); err != nil {
+		return nil, fmt.Errorf("failed to parse workflow file: %w", err)
+	}
+	if len(workflow.Steps) == 0 {
+		return nil, fmt.Errorf("workflow has no steps")
+	}
+	baseDir := filepath.Dir(path)
+	resolve := func(dir string) string {
+		if dir == "" || filepath.IsAbs(dir) {
+			return dir
+		}
+		return filepath.Join(baseDir, dir)
+	}
+	workflow.Dir = resolve(workflow.Dir)
+	for i := range workflow.Steps {
+		step := &workflow.Steps[i]
+		if step.Command == "" {
+			return nil, fmt.Errorf("step %d: command is empty", i+1)
+		}
+		if step.Command == "run" {
+			return nil, fmt.Errorf("step %d: nested workflow is not supported", i+1)
+		}
+		if c, _, err := cmd.RootCmd.Find([]string{step.Command}); err != nil || c == cmd.RootCmd {
+			return nil, fmt.Errorf("step %d: unknown command %q", i+1, step.Command)
+		}
+		step.Dir = resolve(step.Dir)
+	}
+	return workflow, nil
+}
+
+// prepareStep finds the command of step and resets its flags, returning the command line args of the step:
+// its options as flags and its positional args.
+func prepareStep(workflow *Workflow, step *Step) ([]string, error) {
+	c, _, err := cmd.RootCmd.Find([]string{step.Command})
+	if err != nil {
+		return nil, err
+	}
+	// Flags are bound to package-level variables that keep values of previous steps.
+	// The inherited root flags (e.g. --debug-http) of the run command line are kept.
+	resetFlags(c.LocalFlags())
+
+	var args []string
+	setFlag := func(name string, value any) error {
+		flag := c.Flag(name)
+		if flag == nil {
+			return fmt.Errorf("unknown option %q of command %s", name, step.Command)
+		}
+		for _, value := range cmd.FlagValues(flag, value) {
+			args = append(args, fmt.Sprintf("--%s=%s", name, value))
+		}
+		return nil
+	}
+
+	dir := step.Dir
+	if dir == "" {
+		dir = workflow.Dir
+	}
+	if _, hasDir := step.Options["dir"]; !hasDir && dir != "" && c.Flag("dir") != nil {
+		if err := setFlag("dir", dir); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(step.Options))
+	for name := range step.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := setFlag(name, step.Options[name]); err != nil {
+			return nil, err
+		}
+	}
+	return append(args, step.Args...), nil
+}
+
+// runStep runs the command line args of step through the root command, the same as if they were typed by hand:
+// with the root pre-run (prompting for missing flags, the dataset settings...) and cobra's validations of
+// the args and flags. The step is recorded in the history of its dataset dir. The errors are printed by the caller.
+func runStep(step *Step, args []string) error {
+	silenceErrors, silenceUsage := cmd.RootCmd.SilenceErrors, cmd.RootCmd.SilenceUsage
+	cmd.RootCmd.SilenceErrors, cmd.RootCmd.SilenceUsage = true, true
+	defer func() {
+		cmd.RootCmd.SilenceErrors, cmd.RootCmd.SilenceUsage = silenceErrors, silenceUsage
+	}()
+	cmd.RootCmd.SetArgs(append([]string{step.Command}, args...))
+	start := time.Now()
+	c, err := cmd.RootCmd.ExecuteC()
+	if c != nil {
+		cmd.AppendHistory(c, c.Flags().Args(), start, err)
+	}
+	return err
+}
+
+// resetFlags restores all flags of flags to their default values.
+func resetFlags(flags *pflag.FlagSet) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if sv, ok := flag.Value.(pflag.SliceValue); ok {
+			var values []string
+			if defValue := strings.Trim(flag.DefValue, "[]"); defValue != "" {
+				values = strings.Split(defValue, ",")
+			}
+			sv.Replace(values)
+		} else {
+			flag.Value.Set(flag.DefValue)
+		}
+		flag.Changed = false
+	})
+}
@@ -0,0 +1,297 @@
+package scoretranscripts
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/textnorm"
+	"github.com/sagan/goaider/pkg/transcriber"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// The speech rate of clips shorter than this is not checked
+	minRateDuration = 2.0
+	// A run of a phrase repeated this many times (a single token: minWordRepeats) is a repetition loop
+	minPhraseRepeats = 3
+	minWordRepeats   = 4
+	// Longest phrase (in tokens) checked for repetition
+	maxPhraseTokens = 8
+	// A ja transcript of at least this many Han characters but no kana is probably Chinese
+	minKanaCheckHan = 10
+)
+
+// The default min and max plausible speech rates (tokens per second, see textnorm.Tokens) of the languages:
+// words of en, characters of zh, yue and ja, syllables of ko
+var defaultRates = map[string][2]float64{
+	"en":  {1.0, 5.0},
+	"zh":  {1.5, 9.0},
+	"yue": {1.5, 9.0},
+	"ja":  {2.0, 12.0},
+	"ko":  {2.0, 10.0},
+}
+
+var (
+	flagDir      string
+	flagLang     string
+	flagExt      string
+	flagMinRate  float64
+	flagMaxRate  float64
+	flagSaveCsv  string
+	flagFlag     bool
+	flagShowText bool
+	fileFilter   util.FileFilter
+)
+
+var scoreTranscriptsCmd = &cobra.Command{
+	Use:   "score-transcripts [wav]...",
+	Short: "Score transcripts for suspicious patterns and list them for review, most suspicious first",
+	Long: `Check the transcript (.txt) of each audio clip (.wav) of a dir against the duration of the clip and
+the declared language (--lang), and list the suspicious ones ranked by score, most suspicious first,
+so review effort goes where transcription (or alignment) most likely failed.
+
+The checks (and their scores, summed to the score of a transcript):
+- empty: the transcript is empty (1).
+- too short / too long: the speech rate (tokens per second: words of en, characters of zh / yue / ja,
+  syllables of ko) is below --min-rate (missing text, e.g. a clip that contains more speech than transcribed)
+  or above --max-rate (extra text, e.g. a hallucination). Scored by how far it's off (0-1).
+  Clips shorter than 2s are not checked.
+- repeated: a word / character repeated 4+ times or a phrase repeated 3+ times in a row, a common
+  hallucination loop of speech-to-text models. Scored by the share of the transcript it covers (0-1).
+- wrong script: less than half of the words / characters are in the script of the language (1),
+  or a ja transcript of Han characters only (probably Chinese).
+- inaudible: it has "` + transcriber.InaudibleMarker + `" markers of stt --review (0.5).
+
+Only .wav clips are checked (the duration is read from the header); clips without a transcript are counted.
+Set --save-csv to save the list, and --flag to add the listed clips to the flagged list file
+"` + util.FLAGGED_FILE + `" of their dir (see review).
+Instead of --dir, wav files can be given as arguments.`,
+	RunE: scoreTranscripts,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(scoreTranscriptsCmd)
+	scoreTranscriptsCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless wav files are given as args): Path to the dir of the audio clips and transcripts")
+	scoreTranscriptsCmd.Flags().StringVar(&flagLang, "lang", "", "Required: The language of the transcripts: "+strings.Join(textnorm.Languages, " | "))
+	scoreTranscriptsCmd.Flags().StringVar(&flagExt, "ext", ".txt", "Optional: Extension of the transcript files, e.g. .lab")
+	scoreTranscriptsCmd.Flags().Float64Var(&flagMinRate, "min-rate", 0, "Optional: Min plausible speech rate (tokens per second). 0 = the default of the language (en: 1.0, zh / yue: 1.5, ja / ko: 2.0)")
+	scoreTranscriptsCmd.Flags().Float64Var(&flagMaxRate, "max-rate", 0, "Optional: Max plausible speech rate (tokens per second). 0 = the default of the language (en: 5.0, zh / yue: 9.0, ja: 12.0, ko: 10.0)")
+	scoreTranscriptsCmd.Flags().StringVar(&flagSaveCsv, "save-csv", "", "Optional: Save the list to a CSV file (audio, score, issues, duration, transcript)")
+	scoreTranscriptsCmd.Flags().BoolVar(&flagFlag, "flag", false, "Optional: Add the listed clips to the flagged list file "+util.FLAGGED_FILE+" of their dir")
+	scoreTranscriptsCmd.Flags().BoolVar(&flagShowText, "show-text", false, "Optional: Also print the transcripts in the list")
+	fileFilter.AddFlags(scoreTranscriptsCmd.Flags())
+	scoreTranscriptsCmd.MarkFlagRequired("lang")
+	cmd.MarkFlagRequiredUnlessArgs(scoreTranscriptsCmd.Flags(), "dir")
+	cmd.SetPromptDefault(scoreTranscriptsCmd.Flags(), "dir", ".")
+}
+
+// scored is a clip with a suspicious transcript.
+type scored struct {
+	path     string // the audio file
+	duration float64
+	text     string
+	score    float64
+	issues   []string
+}
+
+func scoreTranscripts(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	rates, ok := defaultRates[flagLang]
+	if !ok {
+		return errs.New(errs.ExitConfig, "invalid --lang %q, must be one of: %s", flagLang, strings.Join(textnorm.Languages, ", "))
+	}
+	if flagMinRate < 0 || flagMaxRate < 0 {
+		return errs.New(errs.ExitConfig, "--min-rate and --max-rate must not be negative")
+	}
+	if flagMinRate > 0 {
+		rates[0] = flagMinRate
+	}
+	if flagMaxRate > 0 {
+		rates[1] = flagMaxRate
+	}
+	if rates[0] >= rates[1] {
+		return errs.New(errs.ExitConfig, "--min-rate %v must be less than --max-rate %v", rates[0], rates[1])
+	}
+	ext, err := util.ParseOutputExt(flagExt, ".txt")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+
+	total, missingCnt, unsupportedCnt, errorCnt := 0, 0, 0, 0
+	var suspicious []*scored
+	for _, file := range files {
+		if file.IsDir() || !fileFilter.Match(file) {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(file.Name())) {
+		case ".wav":
+		case ".mp3", ".m4a", ".flac", ".ogg", ".opus", ".aac":
+			unsupportedCnt++
+			continue
+		default:
+			continue
+		}
+		content, err := os.ReadFile(util.LongPath(strings.TrimSuffix(file.Path, filepath.Ext(file.Path)) + ext))
+		if os.IsNotExist(err) {
+			missingCnt++
+			continue
+		}
+		total++
+		var info *util.WavInfo
+		if err == nil {
+			info, err = util.ReadWavInfo(file.Path)
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Path, err)
+			errorCnt++
+			continue
+		}
+		text := strings.TrimSpace(strings.TrimPrefix(string(content), util.UTF8_BOM))
+		result := &scored{path: file.Path, duration: info.Duration(), text: text}
+		result.check(rates[0], rates[1])
+		if len(result.issues) > 0 {
+			suspicious = append(suspicious, result)
+		}
+	}
+	if unsupportedCnt > 0 {
+		fmt.Printf("%d non-wav audio files are not checked, convert them first (e.g. ffmpeg -i input.mp3 output.wav)\n",
+			unsupportedCnt)
+	}
+	if missingCnt > 0 {
+		fmt.Printf("%d wav files have no %s transcript\n", missingCnt, ext)
+	}
+
+	slices.SortStableFunc(suspicious, func(a, b *scored) int {
+		if a.score > b.score {
+			return -1
+		} else if a.score < b.score {
+			return 1
+		}
+		return 0
+	})
+	fmt.Printf("%d of %d transcripts look suspicious, most suspicious first:\n", len(suspicious), total-errorCnt)
+	for _, s := range suspicious {
+		fmt.Printf("  %.2f %s (%.1fs): %s\n", s.score, s.path, s.duration, strings.Join(s.issues, "; "))
+		if flagShowText && s.text != "" {
+			fmt.Printf("       %s\n", s.text)
+		}
+	}
+	if flagSaveCsv != "" {
+		err := util.WriteAtomic(flagSaveCsv, func(w io.Writer) error {
+			writer := csv.NewWriter(w)
+			writer.Write([]string{"audio", "score", "issues", "duration", "transcript"})
+			for _, s := range suspicious {
+				writer.Write([]string{s.path, strconv.FormatFloat(s.score, 'f', 2, 64), strings.Join(s.issues, "; "),
+					strconv.FormatFloat(s.duration, 'f', 2, 64), s.text})
+			}
+			writer.Flush()
+			return writer.Error()
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save csv: %w", err)
+		}
+		fmt.Printf("List saved to %q\n", flagSaveCsv)
+	}
+	if flagFlag {
+		byDir := map[string][]string{} // dir => names of the listed clips
+		for _, s := range suspicious {
+			byDir[filepath.Dir(s.path)] = append(byDir[filepath.Dir(s.path)], filepath.Base(s.path))
+		}
+		for dir, names := range byDir {
+			existing, err := util.ReadFlagged(dir)
+			if err == nil {
+				err = util.WriteFlagged(dir, append(existing, names...))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return errs.RunResult(total, errorCnt)
+}
+
+// check runs the checks of the transcript, adding the score and description of each issue found.
+// minRate and maxRate are the plausible speech rates (tokens per second).
+func (s *scored) check(minRate, maxRate float64) {
+	add := func(score float64, format string, a ...any) {
+		s.score += score
+		s.issues = append(s.issues, fmt.Sprintf(format, a...))
+	}
+	tokens := textnorm.Tokens(strings.ReplaceAll(s.text, transcriber.InaudibleMarker, " "))
+	if len(tokens) == 0 {
+		add(1, "empty")
+		return
+	}
+	if s.duration >= minRateDuration {
+		rate := float64(len(tokens)) / s.duration
+		if rate < minRate {
+			add(1-rate/minRate, "too short (%.1f tokens/s, expected >= %.1f)", rate, minRate)
+		} else if rate > maxRate {
+			add(1-maxRate/rate, "too long (%.1f tokens/s, expected <= %.1f)", rate, maxRate)
+		}
+	}
+	if phrase, repeats := longestRepetition(tokens); repeats > 0 {
+		add(float64(len(phrase)*repeats)/float64(len(tokens)), "repeated (%q x%d)", strings.Join(phrase, " "), repeats)
+	}
+	if share, letters := textnorm.ScriptShare(s.text, flagLang); share < 0.5 {
+		add(1, "wrong script (%.0f%% of %d words / characters in the script of %s)", share*100, letters, flagLang)
+	} else if flagLang == "ja" && !hasKana(s.text) && countHan(s.text) >= minKanaCheckHan {
+		add(1, "wrong script (no kana, probably Chinese)")
+	}
+	if n := strings.Count(s.text, transcriber.InaudibleMarker); n > 0 {
+		add(0.5, "inaudible (%d)", n)
+	}
+}
+
+// longestRepetition returns the phrase of tokens repeated in a row that covers the most tokens,
+// and its number of repeats, if it's repeated at least minWordRepeats (a single token) or
+// minPhraseRepeats times. It returns 0 repeats if there is none.
+func longestRepetition(tokens []string) (phrase []string, repeats int) {
+	for n := 1; n <= maxPhraseTokens && n*minPhraseRepeats <= len(tokens); n++ {
+		minRepeats := minPhraseRepeats
+		if n == 1 {
+			minRepeats = minWordRepeats
+		}
+		for i := 0; i+n <= len(tokens); i++ {
+			count := 1
+			for j := i + n; j+n <= len(tokens) && slices.Equal(tokens[i:i+n], tokens[j:j+n]); j += n {
+				count++
+			}
+			if count >= minRepeats && n*count > len(phrase)*repeats {
+				phrase, repeats = tokens[i:i+n], count
+			}
+		}
+	}
+	return phrase, repeats
+}
+
+func hasKana(text string) bool {
+	return strings.IndexFunc(text, func(r rune) bool { return unicode.In(r, unicode.Hiragana, unicode.Katakana) }) >= 0
+}
+
+func countHan(text string) int {
+	n := 0
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) {
+			n++
+		}
+	}
+	return n
+}
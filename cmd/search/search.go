@@ -0,0 +1,272 @@
+package search
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/pkg/embedder"
+	"github.com/sagan/goaider/util"
+)
+
+// Search methods, the values of --by
+const (
+	byAuto    = "auto"
+	byImage   = "image"
+	byText    = "text"
+	byCaption = "caption"
+)
+
+const (
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+)
+
+var (
+	flagDir         string
+	flagBy          string
+	flagEmbeddings  string
+	flagTop         int
+	flagMinScore    float64
+	flagCaptionExt  string
+	flagRecursive   bool
+	flagOpen        bool
+	flagApiKeysFile string
+	embedOptions    embedder.Options
+	fileFilter      util.FileFilter
+)
+
+var searchCmd = &cobra.Command{
+	Use:   "search <query>...",
+	Short: "Find the images of a dataset by a text query",
+	Long: `Rank the images of a dataset against a natural-language query (e.g. "red jacket, side view")
+and print the top matches with their score, most relevant first.
+
+--by:
+- image: the similarity of the query to the image embeddings of the embed command
+  (default "<dir>/.goaider/embeddings.npz"), by the text encoder of the local CLIP model (--embed-model).
+- text: the similarity of the query to the caption embeddings of the embed command (--type text),
+  by the same model (the local one, or the Gemini embedding API).
+- caption: the fraction of the query words found in the caption files (--caption-ext), no model needed.
+- auto (default): image if the dataset has image embeddings and the local model is set, else text if it has
+  caption embeddings of Gemini or of the local model, else caption.
+
+Set --open to also open the top matches with the default image viewer.
+The query is the args joined by spaces.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: search,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(searchCmd)
+	searchCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the image directory")
+	searchCmd.Flags().StringVar(&flagBy, "by", byAuto, "Optional: The search method: "+byAuto+", "+byImage+" (image embeddings), "+byText+" (caption embeddings) or "+byCaption+" (caption words)")
+	searchCmd.Flags().StringVar(&flagEmbeddings, "embeddings", "", `Optional: Path of the embeddings .npz file of the embed command. default: "<dir>/.goaider/embeddings.npz"`)
+	searchCmd.Flags().IntVar(&flagTop, "top", 20, "Optional: Max number of matches to print. 0 = all")
+	searchCmd.Flags().Float64Var(&flagMinScore, "min-score", 0, "Optional: Min score of the printed matches (the cosine similarity, or the fraction of matched words of --by "+byCaption+")")
+	searchCmd.Flags().StringVar(&flagCaptionExt, "caption-ext", ".txt", "Optional: Extension of the caption files of --by "+byCaption)
+	searchCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also search the images in the subdirectories of --dir (except hidden ones) of --by "+byCaption)
+	searchCmd.Flags().BoolVar(&flagOpen, "open", false, "Optional: Open the top matches with the default image viewer")
+	searchCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Optional: Path of a file of Gemini API keys (one per line), for the caption embeddings of the Gemini embedding API")
+	embedOptions.AddFlags(searchCmd.Flags())
+	fileFilter.AddFlags(searchCmd.Flags())
+	searchCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(searchCmd.Flags(), "dir", ".")
+}
+
+// match is an image and its score against the query.
+type match struct {
+	path  string
+	score float64
+}
+
+func search(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if !slices.Contains([]string{byAuto, byImage, byText, byCaption}, flagBy) {
+		return errs.New(errs.ExitConfig, "invalid --by %q", flagBy)
+	}
+	if flagTop < 0 {
+		return errs.New(errs.ExitConfig, "invalid --top %d: must be >= 0", flagTop)
+	}
+	query := strings.TrimSpace(strings.Join(args, " "))
+	if query == "" {
+		return errs.New(errs.ExitConfig, "the query is empty")
+	}
+	storePath := flagEmbeddings
+	if storePath == "" {
+		storePath = embedder.DefaultStorePath(flagDir)
+	}
+	var store *embedder.Store
+	if flagBy != byCaption {
+		var err error
+		if store, err = embedder.LoadStore(storePath); err != nil {
+			if !os.IsNotExist(err) {
+				return errs.New(errs.ExitConfig, "failed to load the embeddings %q: %w", storePath, err)
+			}
+			if flagBy != byAuto {
+				return errs.New(errs.ExitConfig, "no embeddings at %q: run `goaider embed --dir %s` first",
+					storePath, flagDir)
+			}
+		}
+	}
+	by := flagBy
+	if by == byAuto {
+		switch {
+		case store != nil && store.Image != nil && embedOptions.Configured():
+			by = byImage
+		case store != nil && store.Text != nil &&
+			(strings.HasPrefix(store.TextModel, "gemini:") || embedOptions.Configured()):
+			by = byText
+		default:
+			by = byCaption
+		}
+	}
+
+	var matches []*match
+	var err error
+	switch by {
+	case byImage:
+		if store.Image == nil {
+			return errs.New(errs.ExitConfig, "no image embeddings in %q: run `goaider embed --dir %s` first",
+				storePath, flagDir)
+		}
+		matches, err = searchEmbeddings(query, store, store.Image, store.ImageModel)
+	case byText:
+		if store.Text == nil {
+			return errs.New(errs.ExitConfig, "no caption embeddings in %q: run `goaider embed --dir %s --type text` first",
+				storePath, flagDir)
+		}
+		matches, err = searchEmbeddings(query, store, store.Text, store.TextModel)
+	default:
+		matches, err = searchCaptions(query)
+	}
+	if err != nil {
+		return err
+	}
+
+	matches = slices.DeleteFunc(matches, func(m *match) bool { return m.score < flagMinScore })
+	slices.SortStableFunc(matches, func(a, b *match) int { return cmp.Compare(b.score, a.score) })
+	if flagTop > 0 && len(matches) > flagTop {
+		matches = matches[:flagTop]
+	}
+	fmt.Printf("Top %d matches of %q (by %s):\n", len(matches), query, by)
+	for _, m := range matches {
+		fmt.Printf("  %.3f %s\n", m.score, m.path)
+	}
+	if flagOpen {
+		for _, m := range matches {
+			if err := util.OpenFile(m.path); err != nil {
+				return fmt.Errorf("failed to open %s: %w", m.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// searchEmbeddings scores the files of the store by the similarity of their embeddings rows
+// to the embedding of query by model (of the store).
+func searchEmbeddings(query string, store *embedder.Store, rows [][]float32, model string) ([]*match, error) {
+	var v []float32
+	if geminiModel, ok := strings.CutPrefix(model, "gemini:"); ok {
+		keys, err := gemini.LoadKeys(flagApiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		client := &gemini.Client{
+			HTTPClient: &http.Client{},
+			Keys:       keys,
+			Timeout:    60 * time.Second,
+			Retry:      util.RetryPolicy{MaxRetries: maxRetries, BaseBackoff: baseBackoff},
+		}
+		embeddings, err := client.EmbedTexts(context.Background(), geminiModel, []string{query})
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed the query: %w", err)
+		}
+		v = embedder.Normalize(embeddings[0])
+	} else {
+		e, err := embedder.New(&embedOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer e.Close()
+		if localModel := embedder.LocalModelName(&embedOptions); model != localModel {
+			return nil, errs.New(errs.ExitConfig, "the embeddings are of %q, not of the local model %q", model, localModel)
+		}
+		if v, err = e.EmbedText(query); err != nil {
+			return nil, errs.Wrap(errs.ExitConfig, err)
+		}
+	}
+	var matches []*match
+	for i, name := range store.Files {
+		if rows[i] == nil {
+			continue
+		}
+		path := filepath.Join(flagDir, filepath.FromSlash(name))
+		info, err := os.Stat(util.LongPath(path))
+		if err != nil || !fileFilter.Match(fs.FileInfoToDirEntry(info)) {
+			continue
+		}
+		matches = append(matches, &match{path, embedder.Similarity(v, rows[i])})
+	}
+	return matches, nil
+}
+
+// searchCaptions scores the images of --dir by the fraction of the words of query found in their captions.
+func searchCaptions(query string) ([]*match, error) {
+	captionExt, err := util.ParseOutputExt(flagCaptionExt, ".txt")
+	if err != nil {
+		return nil, errs.Wrap(errs.ExitConfig, err)
+	}
+	listInputFiles := util.ListInputFiles
+	if flagRecursive {
+		listInputFiles = util.ListInputFilesRecursive
+	}
+	files, err := listInputFiles(flagDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	words := strings.FieldsFunc(strings.ToLower(query), isSeparator)
+	var matches []*match
+	for _, file := range files {
+		if file.IsDir() || !cropper.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		data, err := os.ReadFile(util.LongPath(captioner.CaptionFilePath(file.Path, captionExt)))
+		if err != nil {
+			continue
+		}
+		captionWords := strings.FieldsFunc(strings.ToLower(strings.TrimPrefix(string(data), util.UTF8_BOM)), isSeparator)
+		found := 0
+		for _, word := range words {
+			if slices.Contains(captionWords, word) {
+				found++
+			}
+		}
+		if found > 0 {
+			matches = append(matches, &match{file.Path, float64(found) / float64(len(words))})
+		}
+	}
+	return matches, nil
+}
+
+// isSeparator reports whether r separates the words of captions (tags are separated by commas).
+func isSeparator(r rune) bool {
+	return r == ',' || r == '.' || r == ';' || r == ':' || r == '(' || r == ')' || r == '\n' || r == '\t' ||
+		r == ' ' || r == '\r'
+}
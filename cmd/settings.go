@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	"github.com/sagan/goaider/errs"
+)
+
+// Filename of the per-directory settings file of a dataset dir, which pins the default flags of commands
+// run on the dir, e.g.:
+//
+//	identity: foobar  # flags of all commands that have them
+//	caption:          # flags of a command, overriding the above
+//	  prompt: ...
+//	crop:
+//	  width: 768
+const SETTINGS_FILENAME = ".goaider.yaml"
+
+// Flag annotation key of cobra's mutually exclusive flag groups (MarkFlagsMutuallyExclusive).
+const mutuallyExclusiveAnnotation = "cobra_annotation_mutually_exclusive"
+
+// Flags that carry endpoints, credentials, commands or secrets. A settings file comes with the dataset dir,
+// which may be untrusted (e.g. downloaded), so these can only be set on the command line or by env.
+// Their values are not recorded in the history either.
+var SensitiveFlags = []string{"api-url", "api-keys-file", "debug-http", "notify", "remote", "ssh"}
+
+// ApplyDirSettings sets the flags of cmd that are not set on the command line
+// from the settings file of the dataset dir (--dir, or the dir of the first file arg) if it exists,
+// or else the one of its parent dir (e.g. of a dataset with raw/ and cropped/ sub dirs).
+func ApplyDirSettings(cmd *cobra.Command, args []string) error {
+	dirFlag := cmd.Flags().Lookup("dir")
+	if dirFlag == nil {
+		return nil
+	}
+	dir := dirFlag.Value.String()
+	if dir == "" && len(args) > 0 && isRequiredUnlessArgs(cmd.Flags(), dirFlag) {
+		dir = filepath.Dir(args[0])
+	}
+	if dir == "" {
+		return nil
+	}
+	path := filepath.Join(dir, SETTINGS_FILENAME)
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if absDir, absErr := filepath.Abs(dir); absErr == nil && filepath.Dir(absDir) != absDir {
+			path = filepath.Join(filepath.Dir(absDir), SETTINGS_FILENAME)
+			contents, err = os.ReadFile(path)
+		}
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errs.New(errs.ExitConfig, "failed to read settings file: %w", err)
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(contents, &settings); err != nil {
+		return errs.New(errs.ExitConfig, "failed to parse settings file %q: %w", path, err)
+	}
+
+	for name, value := range settings {
+		if commandSettings, isCommand := value.(map[string]any); isCommand {
+			if name != cmd.Name() {
+				continue
+			}
+			for name := range commandSettings {
+				if slices.Contains(SensitiveFlags, name) {
+					return errs.New(errs.ExitConfig, "settings file %q: option %q of command %s can only be set "+
+						"on the command line or by env", path, name, cmd.Name())
+				}
+			}
+		} else if slices.Contains(SensitiveFlags, name) && cmd.Flags().Lookup(name) != nil {
+			return errs.New(errs.ExitConfig, "settings file %q: option %q can only be set on the command line or by env",
+				path, name)
+		}
+	}
+
+	values := map[string]any{}
+	for name, value := range settings {
+		if _, isCommand := value.(map[string]any); isCommand {
+			continue
+		}
+		// Common settings are only applied to the commands that have the flags
+		if cmd.Flags().Lookup(name) != nil {
+			values[name] = value
+		}
+	}
+	if commandSettings, ok := settings[cmd.Name()].(map[string]any); ok {
+		for name, value := range commandSettings {
+			if cmd.Flags().Lookup(name) == nil {
+				return errs.New(errs.ExitConfig, "settings file %q: unknown option %q of command %s", path, name,
+					cmd.Name())
+			}
+			values[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	commandLine := map[string]bool{}
+	cmd.Flags().Visit(func(flag *pflag.Flag) { commandLine[flag.Name] = true })
+	var applied []string
+	for _, name := range names {
+		flag := cmd.Flags().Lookup(name)
+		if commandLine[name] || name == "dir" || excludedByCommandLine(flag, commandLine) {
+			continue // The command line takes precedence
+		}
+		for _, value := range FlagValues(flag, values[name]) {
+			if err := flag.Value.Set(value); err != nil {
+				return errs.New(errs.ExitConfig, "settings file %q: invalid option %s=%q: %w", path, name, value, err)
+			}
+			applied = append(applied, fmt.Sprintf("--%s=%q", name, value))
+		}
+		flag.Changed = true
+	}
+	if len(applied) > 0 {
+		fmt.Fprintf(os.Stderr, "Using settings of %s: %s\n", path, strings.Join(applied, " "))
+	}
+	return nil
+}
+
+// excludedByCommandLine reports whether a flag mutually exclusive with flag (cobra flag groups) is set on
+// the command line (commandLine), e.g. crop --multi-size, which overrides the width and height of the settings.
+func excludedByCommandLine(flag *pflag.Flag, commandLine map[string]bool) bool {
+	for _, group := range flag.Annotations[mutuallyExclusiveAnnotation] {
+		for _, name := range strings.Fields(group) {
+			if name != flag.Name && commandLine[name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FlagValues returns the command line values of flag of a value of a YAML file (workflow / settings):
+// a list value for flags that can be set multiple times, a scalar, or null: true of bool flags, otherwise empty.
+func FlagValues(flag *pflag.Flag, value any) []string {
+	switch v := value.(type) {
+	case []any:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = fmt.Sprint(item)
+		}
+		return values
+	case nil:
+		if flag.Value.Type() == "bool" {
+			return []string{"true"}
+		}
+		return []string{""}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,78 @@
+package sovitsgenlist
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sagan/goaider/pkg/textnorm"
+)
+
+// listRecord is an audio file with its speaker and transcription, a line of the generated list.
+type listRecord struct {
+	audio   string // audio path of the line: the filename, or the absolute path in multi-speaker mode
+	speaker string
+	text    string // single-line transcription
+}
+
+// listFormat is a dataset annotation list format of a TTS training stack.
+type listFormat struct {
+	name   string // value of --format
+	title  string
+	output string // default output filename
+	// validate returns an error if the format can not be generated with the flags, e.g. of an unsupported --lang.
+	// It may be nil
+	validate func() error
+	// line returns the list line of a record. speakerIDs are the 0-based numeric IDs of the speakers
+	line func(record *listRecord, speakerIDs map[string]int) string
+}
+
+// The language codes of Bert-VITS2
+var bertVits2Langs = map[string]string{"zh": "ZH", "ja": "JP", "en": "EN"}
+
+var listFormats = map[string]*listFormat{
+	"sovits": {
+		name:   "sovits",
+		title:  "GPT-SoVITS",
+		output: "sovits.list",
+		line: func(record *listRecord, _ map[string]int) string {
+			return fmt.Sprintf("%s|%s|%s|%s", record.audio, record.speaker, flagLang, record.text)
+		},
+	},
+	"vits": {
+		name:   "vits",
+		title:  "VITS",
+		output: "vits.list",
+		line: func(record *listRecord, speakerIDs map[string]int) string {
+			if flagMulti {
+				return fmt.Sprintf("%s|%d|%s", record.audio, speakerIDs[record.speaker], record.text)
+			}
+			return fmt.Sprintf("%s|%s", record.audio, record.text)
+		},
+	},
+	"bertvits2": {
+		name:   "bertvits2",
+		title:  "Bert-VITS2",
+		output: "esd.list",
+		validate: func() error {
+			if bertVits2Langs[flagLang] == "" {
+				return fmt.Errorf("--format bertvits2 does not support --lang %q. Must be one of: zh, ja, en", flagLang)
+			}
+			return nil
+		},
+		line: func(record *listRecord, _ map[string]int) string {
+			return fmt.Sprintf("%s|%s|%s|%s", record.audio, record.speaker, bertVits2Langs[flagLang], record.text)
+		},
+	},
+	"ljspeech": {
+		name:   "ljspeech",
+		title:  "LJSpeech",
+		output: "metadata.csv",
+		line: func(record *listRecord, _ map[string]int) string {
+			id := strings.TrimSuffix(filepath.Base(record.audio), ".wav")
+			// The normalized text column: all rules. --lang is validated before and all languages of it are supported
+			normalizer, _ := textnorm.New(flagLang, textnorm.Rules)
+			return fmt.Sprintf("%s|%s|%s", id, record.text, normalizer.Normalize(record.text))
+		},
+	},
+}
@@ -3,6 +3,7 @@ package sovitsgenlist
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,6 +12,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/textnorm"
+	"github.com/sagan/goaider/util"
 )
 
 var (
@@ -19,11 +23,18 @@ var (
 	flagForce   bool
 	flagSpeaker string
 	flagOutput  string
+	flagFormats []string
+	flagStrict  bool
+	flagMulti   bool
+	flagLayout  string
+	flagAppend  bool
+	flagMerge   bool
+	fileFilter  util.FileFilter
 )
 
 var genlistCmd = &cobra.Command{
 	Use:   "sovits-genlist",
-	Short: "Generates a GPT-SoVITS dataset annotation sovits.list file",
+	Short: "Generates a GPT-SoVITS (or VITS, Bert-VITS2, LJSpeech) dataset annotation list file",
 	Long: `The sovits-genlist command generates a dataset annotation sovits.list file
 used by GPT-SoVITS (a voice synthesis and cloning model).
 
@@ -41,29 +52,91 @@ Notes:
 - Only include a wav file record in sovits.list file if a corresponding .txt
   transcription file exists.
 - If a .txt file has multiple lines, replace new line breaks (\r\n / \n)
-  with a single space.`,
+  with a single space.
+
+Other formats (--format, comma-separated to generate several lists of the same data at once):
+- vits: "vits.list" of VITS: audio_filename|text (multi-speaker: audio_path|speaker_id|text, with
+  0-based numeric speaker IDs in the order of the speaker subdirectories).
+- bertvits2: "esd.list" of Bert-VITS2: audio_filename|speaker|language|text, with the language
+  codes ZH, JP and EN (other languages are not supported).
+- ljspeech: "metadata.csv" of LJSpeech: id|text|normalized text, where id is the wav filename without
+  extension and the normalized text has the numbers spelled out, etc. (see normalize-text).
+
+Strict mode (--strict): transcriptions with characters that the text frontend of the language
+can not handle, which crash the GPT-SoVITS preprocessing midway, are rejected (left out of the list)
+and reported: letters of other scripts (e.g. Latin letters in a zh line) and symbols (e.g. emoji).
+Digits, punctuation and spaces are allowed. The exit code is 3 (partial failure) if any is rejected.
+
+Multi-speaker mode (--multi-speaker): each subdirectory of the dir holds the
+files of one speaker, named after the subdirectory. The wav files of all speakers
+are linked (or copied) into a single flat "slicer_opt" style folder (--layout),
+named "<speaker>_<filename>.wav" so that names are unique across speakers, and a
+combined .list file referencing them by absolute path is generated:
+
+<dir>/slicer_opt/foo_foo1.wav|foo|en|I have a dream
+<dir>/slicer_opt/bar_bar1.wav|bar|en|Hello world
+
+To keep manual edits of an existing .list file when adding new recordings:
+- --append: add lines only for audio files not already in the file, at the end.
+  Existing lines are kept as is.
+- --merge: rewrite the file in directory order, keeping existing lines of audio
+  files already in the file, adding new ones and dropping lines of audio files
+  that no longer exist.`,
 	RunE: runSovitsGenlist,
 }
 
 func init() {
 	genlistCmd.Flags().StringVarP(&flagDir, "dir", "", "", "Required. Directory containing audio & transcription files.")
-	genlistCmd.Flags().StringVarP(&flagOutput, "output", "", "sovits.list", `Output filename in target dir. Set to "-" to output to stdout`)
+	genlistCmd.Flags().StringVarP(&flagOutput, "output", "", "", `Output filename in target dir. Set to "-" to output to stdout. Default: the filename of the --format (e.g. "sovits.list"). Can not be set with multiple formats`)
+	genlistCmd.Flags().StringSliceVar(&flagFormats, "format", []string{"sovits"}, "Comma-separated list formats to generate: sovits | vits | bertvits2 | ljspeech")
 	genlistCmd.Flags().StringVarP(&flagLang, "lang", "", "", "Required. The language spoken in the audio files: zh | ja | en | ko | yue.")
 	genlistCmd.Flags().BoolVarP(&flagForce, "force", "", false, `Force re-generate "sovits.list" file even if it already exists.`)
-	genlistCmd.Flags().StringVarP(&flagSpeaker, "speaker", "", "", "Required. Speaker name.")
+	genlistCmd.Flags().StringVarP(&flagSpeaker, "speaker", "", "", "Speaker name. Required unless --multi-speaker is set.")
+	genlistCmd.Flags().BoolVar(&flagMulti, "multi-speaker", false, "Multi-speaker mode: each subdirectory of dir is a speaker, named after the subdirectory")
+	genlistCmd.Flags().BoolVar(&flagAppend, "append", false, "Append lines for audio files not already in the existing output file, keeping existing lines")
+	genlistCmd.Flags().BoolVar(&flagMerge, "merge", false, "Merge with the existing output file: keep its lines of audio files still present, add new ones, drop the rest")
+	genlistCmd.Flags().BoolVar(&flagStrict, "strict", false, "Reject (leave out) the files whose transcription has characters the text frontend of the language can not handle, e.g. Latin letters in zh")
+	genlistCmd.Flags().StringVar(&flagLayout, "layout", "slicer_opt", "Multi-speaker mode: the flat folder (relative to dir) that wav files of all speakers are linked / copied into")
 
+	fileFilter.AddFlags(genlistCmd.Flags())
+	genlistCmd.MarkFlagsMutuallyExclusive("append", "merge", "force")
 	genlistCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(genlistCmd.Flags(), "dir", ".")
 	genlistCmd.MarkFlagRequired("lang")
-	genlistCmd.MarkFlagRequired("speaker")
 	cmd.RootCmd.AddCommand(genlistCmd)
 }
 
 func runSovitsGenlist(cmd *cobra.Command, args []string) error {
 	var err error
+	if err = fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
 	// Validate language
 	validLangs := map[string]bool{"zh": true, "ja": true, "en": true, "ko": true, "yue": true}
 	if !validLangs[flagLang] {
-		return fmt.Errorf("invalid language: %q. Must be one of: zh, ja, en, ko, yue", flagLang)
+		return errs.New(errs.ExitConfig, "invalid language: %q. Must be one of: zh, ja, en, ko, yue", flagLang)
+	}
+	if flagSpeaker == "" && !flagMulti {
+		return errs.New(errs.ExitConfig, "--speaker flag is required unless --multi-speaker is set")
+	}
+	var formats []*listFormat
+	for _, name := range flagFormats {
+		format := listFormats[name]
+		if format == nil {
+			return errs.New(errs.ExitConfig, "invalid --format %q. Must be one of: sovits, vits, bertvits2, ljspeech", name)
+		}
+		if format.validate != nil {
+			if err := format.validate(); err != nil {
+				return errs.Wrap(errs.ExitConfig, err)
+			}
+		}
+		formats = append(formats, format)
+	}
+	if len(formats) == 0 {
+		return errs.New(errs.ExitConfig, "--format must not be empty")
+	}
+	if flagOutput != "" && len(formats) > 1 {
+		return errs.New(errs.ExitConfig, "--output can not be set with multiple --format")
 	}
 
 	// Get absolute path for the directory
@@ -72,31 +145,152 @@ func runSovitsGenlist(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to get absolute path for directory %q: %w", flagDir, err)
 	}
 
-	var outputFilePath string
-	if flagOutput != "-" {
-		outputFilePath = filepath.Join(absDirPath, flagOutput)
+	if (flagAppend || flagMerge) && flagOutput == "-" {
+		return errs.New(errs.ExitConfig, "--append and --merge can not be used with stdout output")
+	}
+	outputFilePaths := make([]string, len(formats))
+	for i, format := range formats {
+		output := flagOutput
+		if output == "" {
+			output = format.output
+		}
+		if output == "-" {
+			outputFilePaths[i] = "-"
+			continue
+		}
+		outputFilePath := filepath.Join(absDirPath, output)
 		// Check if output file exists and if force flag is not set
-		if _, err := os.Stat(outputFilePath); err == nil && !flagForce {
+		if _, err := os.Stat(outputFilePath); err == nil && !flagForce && !flagAppend && !flagMerge {
 			return fmt.Errorf("output file %q already exists. Use --force to overwrite", outputFilePath)
 		} else if err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("failed to check existence of output file %q: %w", outputFilePath, err)
 		}
+		outputFilePaths[i] = outputFilePath
+	}
+
+	var records []*listRecord
+	if flagMulti {
+		records, err = multiSpeakerRecords(absDirPath)
 	} else {
-		outputFilePath = "-"
+		var entries []*listEntry
+		entries, err = collectEntries(absDirPath)
+		for _, entry := range entries {
+			records = append(records, &listRecord{audio: entry.baseName + ".wav", speaker: flagSpeaker, text: entry.text})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	rejected := map[*listRecord]bool{}
+	if flagStrict {
+		rejected = rejectInvalid(records)
+	}
+
+	if len(records) == len(rejected) {
+		return fmt.Errorf("no valid wav files found")
+	}
+
+	for i, format := range formats {
+		if err := writeList(format, records, rejected, outputFilePaths[i]); err != nil {
+			return err
+		}
+	}
+	if len(rejected) > 0 {
+		log.Printf("%d files rejected by --strict, fix their transcriptions (or normalize-text them) and re-run",
+			len(rejected))
+	}
+	return errs.RunResult(len(records), len(rejected))
+}
+
+// rejectInvalid returns the records whose text has characters invalid for the text frontend of --lang,
+// logging them.
+func rejectInvalid(records []*listRecord) map[*listRecord]bool {
+	rejected := map[*listRecord]bool{}
+	for _, record := range records {
+		if invalid := textnorm.InvalidChars(record.text, flagLang); len(invalid) > 0 {
+			log.Printf("Rejected %s: invalid characters for %s: %q", record.audio, flagLang, string(invalid))
+			rejected[record] = true
+		}
+	}
+	return rejected
+}
+
+// writeList writes the lines of the records in format to outputFilePath ("-" = stdout),
+// appended to / merged with the existing file in --append / --merge mode.
+// The rejected records (--strict) get no new lines, but their existing lines are kept.
+func writeList(format *listFormat, records []*listRecord, rejected map[*listRecord]bool, outputFilePath string) error {
+	speakerIDs := map[string]int{}
+	for _, record := range records {
+		if _, ok := speakerIDs[record.speaker]; !ok && !rejected[record] {
+			speakerIDs[record.speaker] = len(speakerIDs)
+		}
+	}
+	var listLines []string
+	rejectedAudio := map[string]bool{}
+	for _, record := range records {
+		line := format.line(record, speakerIDs)
+		if rejected[record] {
+			rejectedAudio[listLineAudio(line)] = true
+			if !flagMerge {
+				continue
+			}
+		}
+		listLines = append(listLines, line)
+	}
+
+	if flagAppend || flagMerge {
+		existingLines, err := readListFile(outputFilePath)
+		if err != nil {
+			return err
+		}
+		var added, dropped int
+		listLines, added, dropped = mergeLines(existingLines, listLines, flagMerge, rejectedAudio)
+		log.Printf("%s: %d existing lines, %d added, %d dropped", format.name, len(existingLines), added, dropped)
+	}
+
+	writeLines := func(w io.Writer) error {
+		writer := bufio.NewWriter(w)
+		for _, line := range listLines {
+			if _, err := writer.WriteString(line + "\n"); err != nil {
+				return fmt.Errorf("failed to write line to output file: %w", err)
+			}
+		}
+		return writer.Flush()
+	}
+	if outputFilePath != "-" {
+		// Write to a temp file which replaces the output file when complete
+		if err := util.WriteAtomic(outputFilePath, writeLines); err != nil {
+			return fmt.Errorf("failed to write output file %q: %w", outputFilePath, err)
+		}
+	} else if err := writeLines(os.Stdout); err != nil {
+		return err
 	}
 
+	log.Printf("Successfully generated %s list file: %q", format.title, outputFilePath)
+	return nil
+}
+
+// listEntry is a wav file with its transcription.
+type listEntry struct {
+	baseName string // wav filename without ext
+	text     string // single-line transcription
+}
+
+// collectEntries returns all .wav files in dir that have a corresponding .txt transcription file.
+func collectEntries(dir string) ([]*listEntry, error) {
 	// Read directory contents
-	entries, err := os.ReadDir(absDirPath)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Errorf("failed to read directory %q: %w", absDirPath, err)
+		return nil, fmt.Errorf("failed to read directory %q: %w", dir, err)
 	}
 
-	var listLines []string
+	var listEntries []*listEntry
 	wavFiles := make(map[string]struct{}) // To keep track of found wav files
 
 	// First pass: collect all .wav files
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".wav") {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".wav") && fileFilter.Match(entry) {
 			baseName := strings.TrimSuffix(entry.Name(), ".wav")
 			wavFiles[baseName] = struct{}{}
 		}
@@ -108,7 +302,7 @@ func runSovitsGenlist(cmd *cobra.Command, args []string) error {
 			baseName := strings.TrimSuffix(entry.Name(), ".txt")
 
 			if _, exists := wavFiles[baseName]; exists {
-				txtFilePath := filepath.Join(absDirPath, entry.Name())
+				txtFilePath := filepath.Join(dir, entry.Name())
 				content, err := os.ReadFile(txtFilePath)
 				if err != nil {
 					log.Printf("Warning: Failed to read transcription file %q: %v. Skipping.", txtFilePath, err)
@@ -120,38 +314,130 @@ func runSovitsGenlist(cmd *cobra.Command, args []string) error {
 				text = strings.ReplaceAll(text, "\n", " ")
 				text = strings.TrimSpace(text) // Trim leading/trailing spaces
 
-				// Format the line
-				line := fmt.Sprintf("%s.wav|%s|%s|%s", baseName, flagSpeaker, flagLang, text)
-				listLines = append(listLines, line)
+				listEntries = append(listEntries, &listEntry{baseName: baseName, text: text})
 			}
 		}
 	}
+	return listEntries, nil
+}
 
-	if len(listLines) == 0 {
-		return fmt.Errorf("no valid wav files found")
+// multiSpeakerRecords collects the files of each speaker subdirectory of dir, links them into
+// the flat layout folder and returns the combined list records.
+func multiSpeakerRecords(dir string) ([]*listRecord, error) {
+	layoutDir := filepath.Join(dir, flagLayout)
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %q: %w", dir, err)
 	}
-
-	var outputFile *os.File
-	if outputFilePath != "-" {
-		// Write to output file
-		outputFile, err = os.Create(outputFilePath)
+	var records []*listRecord
+	for _, dirEntry := range dirEntries {
+		speaker := dirEntry.Name()
+		speakerDir := filepath.Join(dir, speaker)
+		if !dirEntry.IsDir() || speakerDir == layoutDir || strings.HasPrefix(speaker, ".") {
+			continue
+		}
+		entries, err := collectEntries(speakerDir)
 		if err != nil {
-			return fmt.Errorf("failed to create output file %q: %w", outputFilePath, err)
+			return nil, err
 		}
-		defer outputFile.Close()
-	} else {
-		outputFile = os.Stdout
+		if len(entries) == 0 {
+			continue
+		}
+		if err := os.MkdirAll(layoutDir, 0755); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			layoutPath := filepath.Join(layoutDir, speaker+"_"+entry.baseName+".wav")
+			if err := linkFile(filepath.Join(speakerDir, entry.baseName+".wav"), layoutPath); err != nil {
+				return nil, fmt.Errorf("failed to create %q: %w", layoutPath, err)
+			}
+			records = append(records, &listRecord{audio: layoutPath, speaker: speaker, text: entry.text})
+		}
+		log.Printf("Speaker %q: %d files", speaker, len(entries))
 	}
+	return records, nil
+}
 
-	writer := bufio.NewWriter(outputFile)
-	for _, line := range listLines {
-		_, err := writer.WriteString(line + "\n")
-		if err != nil {
-			return fmt.Errorf("failed to write line to output file: %w", err)
+// linkFile hard links src to dst, falling back to copy (e.g. across devices).
+// An existing dst is replaced.
+func linkFile(src, dst string) error {
+	if err := os.Remove(util.LongPath(dst)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(util.LongPath(src), util.LongPath(dst)); err == nil {
+		return nil
+	}
+	in, err := os.Open(util.LongPath(src))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return util.WriteAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// readListFile reads the non-empty lines of an existing .list file. It returns nil if the file does not exist.
+func readListFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read existing list file %q: %w", path, err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
 		}
 	}
-	writer.Flush()
+	return lines, nil
+}
 
-	log.Printf("Successfully generated GPT-SoVITS list file: %q", outputFilePath)
-	return nil
+// listLineAudio returns the audio path (first field) of a .list line.
+func listLineAudio(line string) string {
+	audio, _, _ := strings.Cut(line, "|")
+	return audio
+}
+
+// mergeLines combines existing .list lines with newly generated lines, identified by audio path.
+// In append mode, all existing lines are kept and new lines of audio not already present are added at the end.
+// In merge mode, the result is in the order of generated lines, using the existing line of an audio if any;
+// existing lines of audio not generated anymore are dropped. The generated lines of rejected audio are not added,
+// but their existing lines are kept (in merge mode, in the order of generated lines).
+func mergeLines(existingLines, generatedLines []string, merge bool, rejected map[string]bool) (lines []string,
+	added, dropped int) {
+	existing := map[string]string{}
+	for _, line := range existingLines {
+		existing[listLineAudio(line)] = line
+	}
+	generated := map[string]bool{}
+	if !merge {
+		lines = append(lines, existingLines...)
+	}
+	for _, line := range generatedLines {
+		audio := listLineAudio(line)
+		generated[audio] = true
+		if existingLine, ok := existing[audio]; ok {
+			if merge {
+				lines = append(lines, existingLine)
+			}
+			continue
+		}
+		if rejected[audio] {
+			continue
+		}
+		lines = append(lines, line)
+		added++
+	}
+	if merge {
+		for audio := range existing {
+			if !generated[audio] {
+				dropped++
+			}
+		}
+	}
+	return lines, added, dropped
 }
@@ -0,0 +1,230 @@
+package splitchannels
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir      string
+	flagOutput   string
+	flagSpeakers []string
+	flagPcm16    bool
+	flagForce    bool
+	fileFilter   util.FileFilter
+)
+
+var splitChannelsCmd = &cobra.Command{
+	Use:   "split-channels [audio.wav]...",
+	Short: "Split multi-channel wav files into mono wav files per speaker",
+	Long: `Split the channels of stereo (or multi-channel) wav recordings, e.g. interviews with one speaker
+per channel, into mono wav files named per speaker:
+
+  <output>/<speaker>/<filename>.wav
+
+Each subdir holds the files of one speaker, which is the layout of
+"sovits-genlist --multi-speaker", e.g.:
+
+  goaider split-channels --dir interviews --speakers alice,bob
+  goaider stt --dir interviews-channels/alice
+  goaider stt --dir interviews-channels/bob
+  goaider sovits-genlist --dir interviews-channels --multi-speaker --lang en
+
+Set --pcm16 to re-encode the samples as 16-bit PCM. Mono files are skipped.
+
+Instead of --dir, wav files can be given as arguments to split only them.`,
+	RunE: splitChannels,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(splitChannelsCmd)
+	splitChannelsCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless wav files are given as args): Directory containing wav files")
+	splitChannelsCmd.Flags().StringVar(&flagOutput, "output", "", `Optional: Output dir. default: "<input-dir>-channels"`)
+	splitChannelsCmd.Flags().StringSliceVar(&flagSpeakers, "speakers", nil, `Optional: Comma-separated speaker names of the channels in order. default: "left,right" for stereo, "ch1,ch2,..." otherwise`)
+	splitChannelsCmd.Flags().BoolVar(&flagPcm16, "pcm16", false, "Optional: Re-encode the samples as 16-bit PCM")
+	splitChannelsCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Overwrite existing output files")
+	fileFilter.AddFlags(splitChannelsCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(splitChannelsCmd.Flags(), "dir")
+	cmd.SetPromptDefault(splitChannelsCmd.Flags(), "dir", ".")
+}
+
+func splitChannels(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	for _, speaker := range flagSpeakers {
+		if speaker == "" || speaker != filepath.Base(speaker) || strings.HasPrefix(speaker, ".") {
+			return errs.New(errs.ExitConfig, "invalid speaker name %q", speaker)
+		}
+	}
+	output := flagOutput
+	if output == "" {
+		inputDir := flagDir
+		if len(args) > 0 {
+			inputDir = filepath.Dir(args[0])
+		}
+		absDir, err := filepath.Abs(inputDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path %s: %w", inputDir, err)
+		}
+		output = absDir + "-channels"
+	}
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+
+	total, errorCnt := 0, 0
+	for _, file := range files {
+		if file.IsDir() || strings.ToLower(filepath.Ext(file.Name())) != ".wav" || !fileFilter.Match(file) {
+			continue
+		}
+		total++
+		outputs, err := splitFile(file.Path, output)
+		switch {
+		case err != nil:
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+		case outputs == nil:
+			fmt.Printf("⏩ %s: skipped (mono, or output files exist)\n", file.Name())
+		default:
+			fmt.Printf("✅ %s => %s\n", file.Name(), strings.Join(outputs, ", "))
+		}
+	}
+	fmt.Printf("Split %d of %d files into %s\n", total-errorCnt, total, output)
+	return errs.RunResult(total, errorCnt)
+}
+
+// speakerNames returns the speaker names of the channels of a file.
+func speakerNames(channels int) ([]string, error) {
+	if len(flagSpeakers) > 0 {
+		if len(flagSpeakers) < channels {
+			return nil, fmt.Errorf("%d channels, but only %d --speakers", channels, len(flagSpeakers))
+		}
+		return flagSpeakers[:channels], nil
+	}
+	if channels == 2 {
+		return []string{"left", "right"}, nil
+	}
+	names := make([]string, channels)
+	for i := range names {
+		names[i] = fmt.Sprintf("ch%d", i+1)
+	}
+	return names, nil
+}
+
+// splitFile writes the channels of the wav file at path to "<output>/<speaker>/<filename>",
+// returning the output paths, or nil if the file is skipped (mono, or outputs exist).
+func splitFile(path string, output string) ([]string, error) {
+	info, err := util.ReadWavInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	channels := int(info.Channels)
+	if channels < 2 {
+		return nil, nil
+	}
+	speakers, err := speakerNames(channels)
+	if err != nil {
+		return nil, err
+	}
+	sampleSize := int(info.BitsPerSample / 8)
+	if sampleSize == 0 || int(info.BlockAlign) != channels*sampleSize {
+		return nil, fmt.Errorf("unsupported wav sample format: %s", info.FormatName())
+	}
+	outSampleSize := sampleSize
+	var decode func(b []byte) float64
+	if flagPcm16 {
+		if decode, err = info.SampleDecoder(); err != nil {
+			return nil, err
+		}
+		outSampleSize = 2
+	}
+	outputPaths := make([]string, channels)
+	exists := 0
+	for i, speaker := range speakers {
+		outputPaths[i] = filepath.Join(output, speaker, filepath.Base(path))
+		if _, err := os.Stat(util.LongPath(outputPaths[i])); err == nil {
+			exists++
+		}
+	}
+	if !flagForce && exists == channels {
+		return nil, nil
+	}
+
+	fmtChunk := info.FmtChunkOf(1, uint16(outSampleSize*8), flagPcm16)
+	frames := info.DataSize / int64(info.BlockAlign)
+	dataSize := frames * int64(outSampleSize)
+	writers := make([]*bufio.Writer, channels)
+	outFiles := make([]*os.File, channels)
+	defer func() {
+		for _, f := range outFiles {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i, outputPath := range outputPaths {
+		if err := os.MkdirAll(util.LongPath(filepath.Dir(outputPath)), 0755); err != nil {
+			return nil, err
+		}
+		if outFiles[i], err = os.Create(util.LongPath(outputPath)); err != nil {
+			return nil, err
+		}
+		writers[i] = bufio.NewWriterSize(outFiles[i], 1<<16)
+		if err := util.WriteWavHeader(writers[i], fmtChunk, dataSize); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(info.DataOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(f, 1<<16)
+	frame := make([]byte, info.BlockAlign)
+	var sample [2]byte
+	for range frames {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, fmt.Errorf("failed to read samples: %w", err)
+		}
+		for ch, w := range writers {
+			b := frame[ch*sampleSize : (ch+1)*sampleSize]
+			if decode != nil {
+				v := math.Round(max(-1, min(1, decode(b))) * math.MaxInt16)
+				binary.LittleEndian.PutUint16(sample[:], uint16(int16(v)))
+				b = sample[:]
+			}
+			w.Write(b)
+		}
+	}
+	for i, w := range writers {
+		if dataSize%2 == 1 {
+			w.WriteByte(0)
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		if err := outFiles[i].Close(); err != nil {
+			return nil, err
+		}
+		outFiles[i] = nil
+	}
+	return outputPaths, nil
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/sagan/goaider/pkg/provider"
+	"github.com/sagan/goaider/pkg/transcriber"
+	"github.com/sagan/goaider/queue"
+)
+
+// queuedTranscript are the options saved with a queued transcription request (--queue-only).
+type queuedTranscript struct {
+	// Absolute path of the --glossary file
+	Glossary        string  `json:"glossary,omitempty"`
+	Review          bool    `json:"review,omitempty"`
+	ReviewThreshold float64 `json:"reviewThreshold,omitempty"`
+	OutputExt       string  `json:"outputExt,omitempty"`
+	BOM             bool    `json:"bom,omitempty"`
+}
+
+func init() {
+	queue.Register("stt", flushTranscript)
+}
+
+// queueAudio queues the request to transcribe the audio data of the audio file at audioFilePath.
+func queueAudio(audioFilePath string, audioData []byte, mimeType string, opts *transcriber.Options) error {
+	queued := &queuedTranscript{Review: opts.Review, ReviewThreshold: opts.ReviewThreshold,
+		OutputExt: opts.OutputExt, BOM: opts.BOM}
+	if flagGlossary != "" {
+		queued.Glossary, _ = filepath.Abs(flagGlossary)
+	}
+	return queue.Add("stt", audioFilePath, opts.Model, provider.GeminiTranscribeRequest(transcriber.NewRequest(audioData, mimeType, opts)), queued)
+}
+
+// flushTranscript saves the transcript of the response of a queued request, the same way as stt does.
+func flushTranscript(item *queue.Item, audioFilePath string, text string) error {
+	var queued queuedTranscript
+	if err := json.Unmarshal(item.Options, &queued); err != nil {
+		return fmt.Errorf("invalid queued transcript options: %w", err)
+	}
+	opts := &transcriber.Options{Review: queued.Review, ReviewThreshold: queued.ReviewThreshold,
+		OutputExt: queued.OutputExt, BOM: queued.BOM}
+	if queued.Glossary != "" {
+		var err error
+		if opts.Glossary, err = transcriber.LoadGlossary(queued.Glossary); err != nil {
+			return fmt.Errorf("failed to load glossary file: %w", err)
+		}
+	}
+	result, err := transcriber.ParseResponse(text, opts)
+	if err != nil {
+		return err
+	}
+	if err := transcriber.Save(audioFilePath, result, opts); err != nil {
+		return err
+	}
+	if result.Review != nil && result.Review.NeedsReview {
+		fmt.Printf("  ...transcript of %s needs human review\n", filepath.Base(audioFilePath))
+	}
+	return nil
+}
@@ -1,14 +1,11 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,6 +15,13 @@ import (
 
 	"github.com/sagan/goaider/cmd"
 	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/notify"
+	"github.com/sagan/goaider/pkg/provider"
+	"github.com/sagan/goaider/pkg/transcriber"
+	"github.com/sagan/goaider/queue"
+	"github.com/sagan/goaider/util"
 )
 
 // --- Constants for API and Retry Logic ---
@@ -26,22 +30,59 @@ const (
 	baseBackoff = 6 * time.Second
 	maxBackoff  = 60 * time.Second
 	maxRetries  = 4 // 4 retries = 5 total attempts
+
+	// Rough token counts of a transcription request, used for the pre-flight estimate
+	sttPromptTokens          = 20
+	sttOutputTokensPerSecond = 4
 )
 
 var (
-	flagDir   string
-	flagForce bool
-	flagModel string
+	flagDir             string
+	flagForce           bool
+	flagModel           string
+	flagYes             bool
+	flagMaxFiles        int
+	flagMaxSize         int
+	flagMaxRetryDur     time.Duration
+	flagTimeout         time.Duration
+	flagTimeoutPerMB    time.Duration
+	flagNotify          []string
+	flagApiKeysFile     string
+	flagApiURL          string
+	flagGlossary        string
+	flagReview          bool
+	flagReviewThreshold float64
+	flagStdin           bool
+	flagProgress        bool
+	flagMimeType        string
+	flagQueueOnly       bool
+	flagProvider        string
+	flagLanguage        string
+	flagOutputExt       string
+	flagMoveCorrupt     bool
+	flagRetryFailed     bool
+	flagFallback        []string
+	flagBOM             bool
+	// Extension of the transcript files (--output-ext)
+	outputExt  string
+	fileFilter util.FileFilter
+	sampling   gemini.Sampling
 )
 
 // sttCmd represents the stt command
 var sttCmd = &cobra.Command{
-	Use:   "stt",
+	Use:   "stt [audio]...",
 	Short: "Generates speech-to-text transcripts for audio files",
 	Long: `Processes a directory of audio files (.wav, .mp3, .m4a, .flac, .ogg)
 and generates a corresponding .txt file for each one using the
 Google Gemini API.
 
+Instead of --dir, audio files can be given as arguments to transcribe only them.
+
+Pipe mode (--stdin): read the audio from stdin and write the transcript to stdout
+(the review JSON in --review mode), e.g.:
+  ffmpeg -i input.mp4 -f wav - | goaider stt --stdin --mime-type audio/wav
+
 Implements exponential backoff to handle rate limiting (e.g., 10 RPM).
 
 Requires the GEMINI_API_KEY environment variable to be set.`,
@@ -51,261 +92,365 @@ Requires the GEMINI_API_KEY environment variable to be set.`,
 
 func init() {
 	cmd.RootCmd.AddCommand(sttCmd)
-	sttCmd.Flags().StringVarP(&flagDir, "dir", "", "", "Directory containing audio files (required)")
+	sttCmd.Flags().StringVarP(&flagDir, "dir", "", "", "Directory containing audio files (required unless audio files are given as args)")
 	sttCmd.Flags().BoolVarP(&flagForce, "force", "", false, "Overwrite existing .txt transcript files")
 	sttCmd.Flags().StringVarP(&flagModel, "model", "", constants.DEFAULT_GEMINI_MODEL, "The model to use for transcription")
-	sttCmd.MarkFlagRequired("dir")
+	sttCmd.Flags().StringVar(&flagProvider, "provider", provider.GEMINI, "The model backend. Available: "+strings.Join(provider.TranscribeProviders(), ", "))
+	sttCmd.Flags().StringSliceVar(&flagFallback, "fallback", nil, `Comma-separated fallback chain of "[<provider>:]<model>" (e.g. "gemini-2.0-flash"), tried in order when the previous one fails for a file with an exhausted quota or a safety block. The provider defaults to --provider`)
+	sttCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Start without asking for confirmation of the pre-flight summary")
+	sttCmd.Flags().IntVar(&flagMaxFiles, "max-files", 0, "Abort if the number of audio files to transcribe exceeds this limit. 0 = unlimited")
+	sttCmd.Flags().IntVar(&flagMaxSize, "max-size", 0, "Abort if the total size of the audio files to transcribe exceeds this limit (MiB). 0 = unlimited")
+	sttCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Max total time spent on one file including retries, after which it's skipped as failed. 0 = unlimited")
+	sttCmd.Flags().DurationVar(&flagTimeout, "timeout", 60*time.Second, "Base timeout of a single API request. 0 = no timeout")
+	sttCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 10*time.Second, "Additional API request timeout per MB of payload")
+	sttCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Path of a file of Gemini API keys (one per line), rotated among requests")
+	sttCmd.Flags().StringVar(&flagApiURL, "api-url", "", `Base url of the Gemini API, e.g. of a proxy or gateway ("https://<host>[/<path>]/v1beta"). default: the `+constants.ENV_GEMINI_API_URL+` env, or the official API`)
+	sttCmd.Flags().StringVar(&flagLanguage, "language", "", `Language of the audio (e.g. "en", "Japanese"), as a hint to the model. default: auto detect`)
+	sttCmd.Flags().StringVar(&flagGlossary, "glossary", "", `Path of a glossary file of names / terms (one per line, optionally followed by ": misspelling1, misspelling2") used as spelling hints; known misspellings are fixed in transcripts`)
+	sttCmd.Flags().BoolVar(&flagReview, "review", false, `Review mode: the model marks unintelligible words as "[inaudible]" and rates the confidence of each segment, saved to a .json sidecar file. Transcripts that need human review are listed at the end`)
+	sttCmd.Flags().Float64Var(&flagReviewThreshold, "review-threshold", 0.7, "In review mode, a transcript with any segment confidence (0.0-1.0) below this needs review")
+	sttCmd.Flags().BoolVar(&flagProgress, "progress", false, "Show a progress bar (done/total, ETA, throughput, errors) instead of per-file lines. Ignored if stdout is not a terminal")
+	sttCmd.Flags().BoolVar(&flagStdin, "stdin", false, "Pipe mode: read the audio from stdin and write the transcript to stdout. Requires --mime-type")
+	sttCmd.Flags().StringVar(&flagMimeType, "mime-type", "", `MIME type of the --stdin audio, e.g. "audio/wav"`)
+	sttCmd.Flags().StringVar(&flagOutputExt, "output-ext", ".txt", `Extension of the transcript files, e.g. ".lab"`)
+	sttCmd.Flags().BoolVar(&flagBOM, "bom", false, "Write the transcript files with the UTF-8 BOM, for Windows tools that expect it")
+	sttCmd.Flags().BoolVar(&flagMoveCorrupt, "move-corrupt", false, "Move the corrupt audio files found by the pre-scan (zero-byte, truncated or unreadable) to the "+util.CORRUPT_DIR+" folder next to them")
+	sttCmd.Flags().BoolVar(&flagQueueOnly, "queue-only", false, "Only prepare the API requests and save them to the queue (in "+queue.QUEUE_DIR+"/) without network access, to be sent later by flush-queue")
+	cmd.AddRetryFailedFlag(sttCmd.Flags(), &flagRetryFailed, "stt")
+	notify.AddFlag(sttCmd.Flags(), &flagNotify)
+	fileFilter.AddFlags(sttCmd.Flags())
+	sampling.AddFlags(sttCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(sttCmd.Flags(), "dir", "stdin")
+	cmd.SetPromptDefault(sttCmd.Flags(), "dir", ".")
 }
 
-func stt(cmd *cobra.Command, args []string) error {
-	apiKey := os.Getenv(constants.ENV_GEMINI_API_KEY)
-	if apiKey == "" {
-		return fmt.Errorf("error: %s environment variable not set", constants.ENV_GEMINI_API_KEY)
+func stt(_ *cobra.Command, args []string) error {
+	// The provider (API keys) and its fallback chain are not needed in --queue-only mode
+	var p, primary provider.TranscribeProvider
+	fallbacks, err := provider.ParseFallbacks(flagFallback, flagProvider)
+	if err != nil {
+		return err
+	}
+	if flagApiURL, err = gemini.ResolveAPIURL(flagApiURL); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagQueueOnly {
+		if flagProvider != provider.GEMINI {
+			return errs.New(errs.ExitConfig, "--queue-only requires the %s provider", provider.GEMINI)
+		}
+		if len(fallbacks) > 0 {
+			return errs.New(errs.ExitConfig, "--fallback can not be used with --queue-only")
+		}
+	} else if p, primary, err = newProvider(!flagStdin && flagProgress && util.IsTerminal(os.Stdout),
+		fallbacks); err != nil {
+		return err
 	}
 
-	fmt.Printf("Processing audio files in: %q\n", flagDir)
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if outputExt, err = util.ParseOutputExt(flagOutputExt, ".txt", ".json"); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if err := sampling.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	var glossary []*transcriber.GlossaryEntry
+	if flagGlossary != "" {
+		if glossary, err = transcriber.LoadGlossary(flagGlossary); err != nil {
+			return errs.New(errs.ExitConfig, "failed to load --glossary file: %w", err)
+		}
+		log.Printf("Using glossary of %d terms", len(glossary))
+	}
+	if flagStdin {
+		if len(args) > 0 || flagDir != "" || flagQueueOnly {
+			return errs.New(errs.ExitConfig, "--stdin can not be used with --dir, file args or --queue-only")
+		}
+		if flagMimeType == "" {
+			return errs.New(errs.ExitConfig, "--mime-type flag is required in --stdin mode")
+		}
+		return sttStdin(p, flagOptions(glossary))
+	}
+
+	// In progress bar mode, only failures are printed (above the bar)
+	showProgress := flagProgress && util.IsTerminal(os.Stdout)
+	var logOut io.Writer = os.Stdout
+	if showProgress {
+		logOut = io.Discard
+	}
+	if len(args) == 0 {
+		fmt.Printf("Processing audio files in: %q\n", flagDir)
+	}
 	fmt.Printf("Using model: %s\n", flagModel)
 
-	// Read all files in the directory
-	files, err := os.ReadDir(flagDir)
+	// Read all files in the directory (or the failed files of the last run)
+	if flagRetryFailed {
+		if args, err = cmd.LoadFailedFiles(flagDir, "stt", args); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			fmt.Printf("No failed audio file of the last run in %s\n", flagDir)
+			return nil
+		}
+		fmt.Printf("Retrying %d failed audio files of the last run\n", len(args))
+	}
+	files, err := util.ListInputFiles(flagDir, args)
 	if err != nil {
-		return fmt.Errorf("error reading directory %q: %w", flagDir, err)
+		return err
 	}
 
-	// 60-second timeout for a single request, but retries can make this longer.
-	httpClient := &http.Client{Timeout: 60 * time.Second}
-
-	errorCnt := 0
+	// Collect audio files to transcribe and estimate the API usage
+	var audioFiles []util.InputFile
+	var corruptFiles []*cmd.CorruptFile
+	skippedCnt := 0
+	estimate := &util.UsageEstimate{}
 	for _, file := range files {
-		if file.IsDir() {
-			continue // Skip subdirectories
+		if file.IsDir() || !fileFilter.Match(file) {
+			continue // Skip subdirectories and filtered out files
 		}
 
 		fileName := file.Name()
 		fileExt := strings.ToLower(filepath.Ext(fileName))
-		mimeType := getMimeType(fileExt)
-
-		if mimeType == "" {
+		if transcriber.MimeType(fileExt) == "" {
 			// fmt.Printf("Skipping non-audio file: %s\n", fileName)
 			continue // Not a supported audio file
 		}
 
-		// Define input and output paths
-		audioFilePath := filepath.Join(flagDir, fileName)
-		outputTxtPath := strings.TrimSuffix(audioFilePath, fileExt) + ".txt"
-
 		// Check if output file exists
+		audioFilePath := file.Path
 		if !flagForce {
-			if _, err := os.Stat(outputTxtPath); err == nil {
-				fmt.Printf("Skipping (exists): %s\n", fileName)
+			if util.OutputUpToDate(audioFilePath, transcriber.TranscriptFilePath(audioFilePath, outputExt), false) {
+				fmt.Fprintf(logOut, "Skipping (exists): %s\n", fileName)
+				skippedCnt++
 				continue
 			}
 		}
-
-		// Process the file
-		fmt.Printf("Processing: %s\n", fileName)
-
-		// 1. Read audio file
-		audioData, err := os.ReadFile(audioFilePath)
-		if err != nil {
-			log.Printf("Error reading audio file %s: %v", fileName, err)
-			errorCnt++
-			continue
-		}
-
-		// 2. Call Gemini API
-		transcript, err := getTranscript(httpClient, apiKey, flagModel, audioData, mimeType)
-		if err != nil {
-			log.Printf("Error generating transcript for %s: %v", fileName, err)
-			errorCnt++
+		// Pre-scan: exclude corrupt audio files before any API call
+		if err := util.CheckMediaFile(audioFilePath); err != nil {
+			corruptFiles = append(corruptFiles, &cmd.CorruptFile{Path: audioFilePath, Err: err})
 			continue
 		}
-
-		// 3. Write transcript to .txt file
-		err = os.WriteFile(outputTxtPath, []byte(transcript), 0644)
-		if err != nil {
-			log.Printf("Error writing transcript file %s: %v", outputTxtPath, err)
-			errorCnt++
-			continue
+		audioFiles = append(audioFiles, file)
+		var size int64
+		if info, err := file.Info(); err == nil {
+			size = info.Size()
 		}
-
-		fmt.Printf("Generated: %s\n", filepath.Base(outputTxtPath))
+		estimate.AddAudio(audioFilePath, size, sttPromptTokens, sttOutputTokensPerSecond)
 	}
-
-	fmt.Printf("Processing complete.\n")
-	if errorCnt > 0 {
-		return fmt.Errorf("%d errors", errorCnt)
-	}
-	return nil
-}
-
-// Structs for Gemini API Request
-type GeminiRequest struct {
-	Contents []Content `json:"contents"`
-}
-
-type Content struct {
-	Parts []Part `json:"parts"`
-}
-
-type Part struct {
-	Text       string      `json:"text,omitempty"`
-	InlineData *InlineData `json:"inlineData,omitempty"`
-}
-
-type InlineData struct {
-	MimeType string `json:"mimeType"`
-	Data     string `json:"data"` // Base64 encoded string
-}
-
-// Structs for Gemini API Response
-type GeminiResponse struct {
-	Candidates     []Candidate     `json:"candidates"`
-	PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
-}
-
-type Candidate struct {
-	Content       Content        `json:"content"`
-	FinishReason  string         `json:"finishReason"`
-	Index         int            `json:"index"`
-	SafetyRatings []SafetyRating `json:"safetyRatings"`
-}
-
-type SafetyRating struct {
-	Category    string `json:"category"`
-	Probability string `json:"probability"`
-}
-
-type PromptFeedback struct {
-	BlockReason   string         `json:"blockReason,omitempty"`
-	SafetyRatings []SafetyRating `json:"safetyRatings,omitempty"`
-}
-
-// getTranscript calls the Gemini API with retry logic
-func getTranscript(client *http.Client, apiKey, modelName string, audioData []byte, mimeType string) (string, error) {
-	// 1. Base64 encode the audio
-	encodedData := base64.StdEncoding.EncodeToString(audioData)
-
-	// 2. Prepare the request body
-	reqBody := GeminiRequest{
-		Contents: []Content{
-			{
-				Parts: []Part{
-					{Text: "Generate a transcript of this audio. Only output the transcribed text."},
-					{InlineData: &InlineData{
-						MimeType: mimeType,
-						Data:     encodedData,
-					}},
-				},
-			},
-		},
+	cmd.ReportCorruptFiles(corruptFiles, flagMoveCorrupt)
+	if g, ok := primary.(*provider.Gemini); ok && estimate.Files > 0 {
+		if err := cmd.CheckModel(g.Client.Keys, g.Client.APIURL, flagModel); err != nil {
+			return err
+		}
 	}
-
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal JSON request: %w", err)
+	if err := cmd.ConfirmUsage(estimate, flagModel, flagYes, flagMaxFiles, flagMaxSize); err != nil {
+		return err
 	}
 
-	// 3. Build the URL
-	url := fmt.Sprintf("%s%s:generateContent?key=%s", constants.GEMINI_API_URL, modelName, apiKey)
-
-	var lastErr error
-
-	// 4. Start retry loop
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		// Create a new request *inside* the loop because the body buffer must be fresh
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			return "", fmt.Errorf("failed to create HTTP request: %w", err) // Non-retryable
-		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := client.Do(req)
-		if err != nil {
-			// Network error
-			lastErr = fmt.Errorf("request failed: %w", err)
-			log.Printf("Attempt %d/%d: Network error (%v). Retrying...", attempt+1, maxRetries+1, err)
-			time.Sleep(calculateBackoff(attempt))
-			continue
+	start := time.Now()
+	errorCnt := 0
+	succeededCnt := 0
+	var needsReview []string // paths of audio files whose transcripts need review
+	reviews := map[string]*transcriber.TranscriptReview{}
+	opts := flagOptions(glossary)
+	var fatalErr error
+	failed := &cmd.FailedFiles{}
+	progress := util.NewProgress(len(audioFiles), showProgress)
+	// Errors are printed above the progress bar in progress bar mode
+	logError := func(format string, args ...any) {
+		if progress.Enabled {
+			progress.Printf(format+"\n", args...)
+		} else {
+			log.Printf(format, args...)
 		}
-
-		// Check status code
-		switch resp.StatusCode {
-		case http.StatusOK:
-			// Success!
-			respBody, err := io.ReadAll(resp.Body)
-			resp.Body.Close()
+	}
+	for i, file := range audioFiles {
+		progress.Start(file.Name())
+		errorsBefore := errorCnt
+		stop := func() bool {
+			fileName := file.Name()
+			fileExt := strings.ToLower(filepath.Ext(fileName))
+			mimeType := transcriber.MimeType(fileExt)
+
+			// Define input and output paths
+			audioFilePath := file.Path
+			outputTxtPath := transcriber.TranscriptFilePath(audioFilePath, opts.OutputExt)
+
+			// Process the file
+			fmt.Fprintf(logOut, "Processing: %s\n", fileName)
+
+			// 1. Read audio file
+			audioData, err := os.ReadFile(audioFilePath)
 			if err != nil {
-				return "", fmt.Errorf("failed to read successful API response body: %w", err)
+				logError("Error reading audio file %s: %v", fileName, err)
+				errorCnt++
+				failed.Add(audioFilePath, err)
+				return false
 			}
-
-			// Parse the response
-			var apiResp GeminiResponse
-			if err := json.Unmarshal(respBody, &apiResp); err != nil {
-				return "", fmt.Errorf("failed to unmarshal API response: %w", err)
+			mimeType, warning := util.CheckMimeType(audioData, mimeType)
+			if warning != "" {
+				fmt.Fprintf(logOut, "  ...%s: %s\n", fileName, warning)
 			}
 
-			// Check for blocked content
-			if apiResp.PromptFeedback != nil && apiResp.PromptFeedback.BlockReason != "" {
-				return "", fmt.Errorf("request was blocked: %s", apiResp.PromptFeedback.BlockReason)
+			if flagQueueOnly {
+				if err := queueAudio(audioFilePath, audioData, mimeType, opts); err != nil {
+					logError("Error queuing %s: %v", fileName, err)
+					errorCnt++
+					failed.Add(audioFilePath, err)
+					return false
+				}
+				fmt.Fprintf(logOut, "Queued: %s\n", fileName)
+				succeededCnt++
+				return false
 			}
 
-			// Extract the text
-			if len(apiResp.Candidates) == 0 || len(apiResp.Candidates[0].Content.Parts) == 0 {
-				return "", fmt.Errorf("no transcript content found in API response: %s", string(respBody))
+			// 2. Call the provider API
+			result, err := transcriber.Transcribe(context.Background(), p, audioData, mimeType, opts)
+			if err != nil {
+				logError("Error generating transcript for %s: %v", fileName, err)
+				errorCnt++
+				failed.Add(audioFilePath, err)
+				// All remaining requests would fail the same way
+				if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+					fatalErr = err
+					// The remaining files are retried by --retry-failed too
+					for _, remaining := range audioFiles[i+1:] {
+						failed.Add(remaining.Path, fmt.Errorf("not processed, run aborted: %w", err))
+					}
+					return true
+				}
+				return false
 			}
-			transcript := apiResp.Candidates[0].Content.Parts[0].Text
-			return transcript, nil // SUCCESS EXIT
 
-		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
-			// Retryable server-side error (429 or 5xx)
-			respBody, _ := io.ReadAll(resp.Body) // Read body for logging, ignore error
-			resp.Body.Close()
-			lastErr = fmt.Errorf("API returned retryable status %d: %s", resp.StatusCode, string(respBody))
-			log.Printf("Attempt %d/%d: %v. Retrying in %v...", attempt+1, maxRetries+1, lastErr, calculateBackoff(attempt))
-			time.Sleep(calculateBackoff(attempt))
-			continue
+			// 3. Write transcript to .txt file (and the review to .json file)
+			if err := transcriber.Save(audioFilePath, result, opts); err != nil {
+				logError("Error saving transcript for %s: %v", fileName, err)
+				errorCnt++
+				failed.Add(audioFilePath, err)
+				return false
+			}
+			if result.Review != nil && result.Review.NeedsReview {
+				needsReview = append(needsReview, audioFilePath)
+				reviews[audioFilePath] = result.Review
+			}
 
-		default:
-			// Non-retryable client-side error (e.g., 400, 401, 404)
-			respBody, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			return "", fmt.Errorf("API request failed with non-retryable status %d: %s", resp.StatusCode, string(respBody))
+			fmt.Fprintf(logOut, "Generated: %s\n", filepath.Base(outputTxtPath))
+			succeededCnt++
+			return false
+		}()
+		progress.Done(errorCnt > errorsBefore)
+		if stop {
+			break
 		}
-	} // end for loop
-
-	// If loop finishes, all retries failed
-	return "", fmt.Errorf("all %d retry attempts failed. Last error: %w", maxRetries+1, lastErr)
+	}
+	progress.Finish()
+	failed.Save(cmd.InputDir(flagDir, args), "stt")
+	if flagQueueOnly {
+		fmt.Printf("Queued %d requests. Run \"goaider flush-queue\" to send them.\n", succeededCnt)
+	} else {
+		fmt.Printf("Processing complete.\n")
+	}
+	if flagReview {
+		fmt.Printf("%d transcripts need human review:\n", len(needsReview))
+		for _, audioFilePath := range needsReview {
+			fmt.Printf("  %s\n", audioFilePath)
+			for _, segment := range transcriber.LowConfidenceSegments(reviews[audioFilePath], flagReviewThreshold) {
+				fmt.Printf("    - %q (confidence %.2f)\n", segment.Text, segment.Confidence)
+			}
+		}
+	}
+	summary := &notify.Summary{
+		Command:   "stt",
+		Dir:       flagDir,
+		Total:     len(audioFiles) + skippedCnt,
+		Succeeded: succeededCnt,
+		Skipped:   skippedCnt,
+		Failed:    errorCnt,
+		Duration:  time.Since(start),
+	}
+	if fatalErr != nil {
+		summary.Error = fatalErr.Error()
+	}
+	notify.Send(flagNotify, summary)
+	cmd.RecordFiles(summary.Total, summary.Succeeded, summary.Skipped, summary.Failed)
+	if fatalErr != nil {
+		return fmt.Errorf("run aborted: %w", fatalErr)
+	}
+	return errs.RunResult(len(audioFiles), errorCnt)
 }
 
-// calculateBackoff computes the exponential backoff duration for a given attempt
-func calculateBackoff(attempt int) time.Duration {
-	// Exponential backoff: base * 2^attempt
-	backoff := baseBackoff * (1 << attempt)
-	if backoff > maxBackoff {
-		backoff = maxBackoff
-	}
-	// Add random jitter (0-1000ms) to prevent thundering herd
-	jitter := time.Duration(rand.Intn(1000)) * time.Millisecond
-	return backoff + jitter
+// newProvider returns the --provider of stt, and the provider chain of it and the fallbacks (if any).
+// quiet: do not log retries (progress bar mode).
+// 60-second (plus 10s per MB of payload) timeout for a single request, but retries can make this longer.
+func newProvider(quiet bool, fallbacks []*provider.Fallback) (p, primary provider.TranscribeProvider, err error) {
+	config := &provider.Config{
+		APIKeysFile:  flagApiKeysFile,
+		APIURL:       flagApiURL,
+		Timeout:      flagTimeout,
+		TimeoutPerMB: flagTimeoutPerMB,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+			MaxDuration: flagMaxRetryDur,
+		},
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			log.Printf("Attempt %d/%d: %v. Retrying in %v...", attempt+1, maxRetries+1, err, delay)
+		},
+		Log: os.Stderr,
+	}
+	if quiet {
+		config.OnRetry = func(attempt int, err error, delay time.Duration) {}
+		config.Log = io.Discard
+	}
+	if primary, err = provider.NewTranscribe(flagProvider, config); err != nil {
+		return nil, nil, err
+	}
+	if len(fallbacks) == 0 {
+		return primary, primary, nil
+	}
+	if p, err = provider.NewTranscribeChain(flagProvider+":"+flagModel, primary, fallbacks, config); err != nil {
+		return nil, nil, err
+	}
+	return p, primary, nil
 }
 
-// --- Helpers ---
+// sttStdin transcribes the audio read from stdin (--stdin mode) and writes the transcript to stdout.
+func sttStdin(p provider.TranscribeProvider, opts *transcriber.Options) error {
+	audioData, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+	if len(audioData) == 0 {
+		return errs.New(errs.ExitConfig, "no audio data in stdin")
+	}
+	mimeType, warning := util.CheckMimeType(audioData, flagMimeType)
+	if warning != "" {
+		fmt.Fprintf(os.Stderr, "stdin: %s\n", warning)
+	}
+	result, err := transcriber.Transcribe(context.Background(), p, audioData, mimeType, opts)
+	if err != nil {
+		return err
+	}
+	transcript := result.Transcript
+	if result.Review != nil {
+		data, _ := json.MarshalIndent(result.Review, "", "  ")
+		transcript = string(data)
+	}
+	fmt.Println(transcript)
+	return nil
+}
 
-// getMimeType maps file extensions to their MIME types for the API
-func getMimeType(ext string) string {
-	switch ext {
-	case ".wav":
-		return "audio/wav"
-	case ".mp3":
-		return "audio/mpeg"
-	case ".m4a":
-		return "audio/m4a"
-	case ".flac":
-		return "audio/flac"
-	case ".ogg":
-		return "audio/ogg"
-	default:
-		return "" // Not a supported type
+// flagOptions returns the transcription options set by flags.
+func flagOptions(glossary []*transcriber.GlossaryEntry) *transcriber.Options {
+	return &transcriber.Options{
+		Model:           flagModel,
+		Language:        flagLanguage,
+		Glossary:        glossary,
+		Review:          flagReview,
+		ReviewThreshold: flagReviewThreshold,
+		Sampling:        &sampling,
+		OutputExt:       outputExt,
+		BOM:             flagBOM,
 	}
 }
@@ -0,0 +1,309 @@
+package subtitlealign
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	maxRetries  = 3
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	alignPrompt = `Align the transcript below to this audio. Split it into sentences (or short utterances,
+at natural pauses). For each segment, output its exact text from the transcript, and its start and end time
+in the audio in seconds, with millisecond precision. Segments must be in order and not overlap.
+Do not skip, add or change any words of the transcript.
+
+Transcript:
+`
+	transcribeAlignPrompt = `Transcribe this audio and split the transcript into sentences (or short utterances,
+at natural pauses). For each segment, output its text, and its start and end time in the audio in seconds,
+with millisecond precision. Segments must be in order and not overlap.`
+)
+
+var (
+	flagAudio        string
+	flagTranscript   string
+	flagOutput       string
+	flagForce        bool
+	flagModel        string
+	flagPadding      time.Duration
+	flagMinDuration  time.Duration
+	flagTimeout      time.Duration
+	flagTimeoutPerMB time.Duration
+	flagApiKeysFile  string
+)
+
+var subtitleAlignCmd = &cobra.Command{
+	Use:   "subtitle-align",
+	Short: "Cut a long audio into sentence-level wav + txt pairs, aligned with its transcript",
+	Long: `Cut a long audio (.wav) into sentence-level utterances, each saved as a wav file
+with a .txt transcript file of the same name, ready for sovits-genlist.
+
+If --transcript is a SRT subtitle file, its timestamps are used as is, and no API call is made.
+Otherwise the transcript (.txt) is force-aligned to the audio by the Gemini API, which outputs
+timestamped sentences. If --transcript is not set, the audio is also transcribed by the API.
+Audio too large to be sent inline is uploaded via the Gemini Files API.
+
+Output files are named "<audio>_0001.wav", "<audio>_0001.txt", ... The alignment is also saved
+as "<audio>.srt" in the output dir, so it can be fixed by hand and used as --transcript in a re-run.`,
+	RunE: subtitleAlign,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(subtitleAlignCmd)
+	subtitleAlignCmd.Flags().StringVar(&flagAudio, "audio", "", "Path of the long audio .wav file (required)")
+	subtitleAlignCmd.Flags().StringVar(&flagTranscript, "transcript", "", "Path of the full transcript (.txt) or subtitles (.srt) of the audio. If not set, the audio is transcribed by the API")
+	subtitleAlignCmd.Flags().StringVar(&flagOutput, "output", "", `Output dir of the utterance files. Default: "<audio>_segments" dir next to the audio`)
+	subtitleAlignCmd.Flags().BoolVar(&flagForce, "force", false, "Overwrite existing files in output dir")
+	subtitleAlignCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_MODEL, "The model to use for alignment")
+	subtitleAlignCmd.Flags().DurationVar(&flagPadding, "padding", 100*time.Millisecond, "Extend each utterance by this duration at both ends (limited by the neighbour utterances)")
+	subtitleAlignCmd.Flags().DurationVar(&flagMinDuration, "min-duration", 500*time.Millisecond, "Skip utterances shorter than this")
+	subtitleAlignCmd.Flags().DurationVar(&flagTimeout, "timeout", 5*time.Minute, "Base timeout of a single API request. 0 = no timeout")
+	subtitleAlignCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 10*time.Second, "Additional API request timeout per MB of payload")
+	subtitleAlignCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Path of a file of Gemini API keys (one per line), rotated among requests")
+	subtitleAlignCmd.MarkFlagRequired("audio")
+}
+
+// alignedSegment is a segment of the structured alignment response.
+type alignedSegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+var alignSchema = &gemini.Schema{
+	Type: "ARRAY",
+	Items: &gemini.Schema{
+		Type: "OBJECT",
+		Properties: map[string]*gemini.Schema{
+			"start": {Type: "NUMBER", Description: "Start time in seconds"},
+			"end":   {Type: "NUMBER", Description: "End time in seconds"},
+			"text":  {Type: "STRING"},
+		},
+		Required: []string{"start", "end", "text"},
+	},
+}
+
+func subtitleAlign(_ *cobra.Command, args []string) error {
+	if strings.ToLower(filepath.Ext(flagAudio)) != ".wav" {
+		return errs.New(errs.ExitConfig, "only .wav audio is supported, convert it first (e.g. ffmpeg -i input.mp3 output.wav)")
+	}
+	info, err := util.ReadWavInfo(flagAudio)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", flagAudio, err)
+	}
+	base := strings.TrimSuffix(filepath.Base(flagAudio), filepath.Ext(flagAudio))
+	output := flagOutput
+	if output == "" {
+		output = filepath.Join(filepath.Dir(flagAudio), base+"_segments")
+	}
+	fmt.Printf("Audio: %q (%s, %d Hz, %d channels)\n", flagAudio,
+		time.Duration(info.Duration()*float64(time.Second)).Round(time.Millisecond), info.SampleRate, info.Channels)
+
+	var subtitles []util.Subtitle
+	if strings.ToLower(filepath.Ext(flagTranscript)) == ".srt" {
+		content, err := os.ReadFile(flagTranscript)
+		if err != nil {
+			return errs.New(errs.ExitConfig, "failed to read --transcript file: %w", err)
+		}
+		if subtitles, err = util.ParseSRT(string(content)); err != nil {
+			return errs.New(errs.ExitConfig, "failed to parse --transcript file: %w", err)
+		}
+		fmt.Printf("Using %d cues of subtitles %q\n", len(subtitles), flagTranscript)
+	} else {
+		transcript := ""
+		if flagTranscript != "" {
+			content, err := os.ReadFile(flagTranscript)
+			if err != nil {
+				return errs.New(errs.ExitConfig, "failed to read --transcript file: %w", err)
+			}
+			transcript = strings.TrimSpace(string(content))
+		}
+		if subtitles, err = align(flagAudio, transcript); err != nil {
+			return err
+		}
+	}
+	subtitles = normalizeSubtitles(subtitles, info.Duration())
+	if len(subtitles) == 0 {
+		return fmt.Errorf("no utterance found")
+	}
+
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	srtPath := filepath.Join(output, base+".srt")
+	if flagTranscript != srtPath {
+		if err := writeFile(srtPath, []byte(util.FormatSRT(subtitles))); err != nil {
+			return err
+		}
+	}
+
+	writtenCnt, skippedCnt, errorCnt := 0, 0, 0
+	for i, subtitle := range subtitles {
+		name := fmt.Sprintf("%s_%04d", base, i+1)
+		if subtitle.End-subtitle.Start < flagMinDuration || subtitle.Text == "" {
+			fmt.Printf("⏩ %s: skipped (too short or no text)\n", name)
+			skippedCnt++
+			continue
+		}
+		// Pad into the silence around the utterance, without overlapping neighbours
+		start, end := subtitle.Start-flagPadding, subtitle.End+flagPadding
+		if i > 0 {
+			start = max(start, (subtitles[i-1].End+subtitle.Start)/2)
+		}
+		if i < len(subtitles)-1 {
+			end = min(end, (subtitle.End+subtitles[i+1].Start)/2)
+		}
+		wavPath := filepath.Join(output, name+".wav")
+		data, err := util.ReadWavSegment(flagAudio, info, max(start, 0).Seconds(), end.Seconds())
+		if err == nil {
+			err = checkOverwrite(wavPath)
+		}
+		if err == nil {
+			err = util.WriteWav(wavPath, info.FmtChunk, data)
+		}
+		if err == nil {
+			err = writeFile(filepath.Join(output, name+".txt"), []byte(subtitle.Text))
+		}
+		if err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			errorCnt++
+			continue
+		}
+		fmt.Printf("✅ %s [%s - %s]: %s\n", name, subtitle.Start, subtitle.End, subtitle.Text)
+		writtenCnt++
+	}
+	fmt.Printf("Done. %d utterances written to %q, %d skipped, %d failed\n", writtenCnt, output, skippedCnt, errorCnt)
+	return errs.RunResult(writtenCnt+errorCnt, errorCnt)
+}
+
+// align calls the Gemini API to align the transcript (or transcribe, if it's empty) to the audio.
+func align(audioPath string, transcript string) ([]util.Subtitle, error) {
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	client := &gemini.Client{
+		HTTPClient:   &http.Client{},
+		Keys:         keys,
+		Timeout:      flagTimeout,
+		TimeoutPerMB: flagTimeoutPerMB,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+		},
+	}
+	ctx := context.Background()
+
+	var audioPart gemini.Part
+	stat, err := os.Stat(audioPath)
+	if err != nil {
+		return nil, err
+	}
+	// Base64 encoding inflates inline data by 4/3
+	if stat.Size()*4/3 < gemini.MaxInlineSize {
+		data, err := os.ReadFile(audioPath)
+		if err != nil {
+			return nil, err
+		}
+		audioPart = gemini.Part{InlineData: &gemini.InlineData{
+			MimeType: "audio/wav",
+			Data:     base64.StdEncoding.EncodeToString(data),
+		}}
+	} else {
+		fmt.Printf("Uploading audio (%s)...\n", util.FormatBytes(stat.Size()))
+		file, err := client.UploadFile(ctx, audioPath, "audio/wav")
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload audio: %w", err)
+		}
+		defer client.DeleteFile(ctx, file)
+		audioPart = file.Part()
+	}
+
+	prompt := transcribeAlignPrompt
+	if transcript != "" {
+		prompt = alignPrompt + transcript
+	}
+	fmt.Printf("Aligning with model %s...\n", flagModel)
+	text, err := client.GenerateText(ctx, flagModel, &gemini.Request{
+		Contents: []gemini.Content{{Parts: []gemini.Part{{Text: prompt}, audioPart}}},
+		GenerationConfig: &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   alignSchema,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var segments []alignedSegment
+	if err := json.Unmarshal([]byte(text), &segments); err != nil {
+		return nil, fmt.Errorf("invalid alignment response %q: %w", text, err)
+	}
+	var subtitles []util.Subtitle
+	for _, segment := range segments {
+		subtitles = append(subtitles, util.Subtitle{
+			Start: time.Duration(segment.Start * float64(time.Second)).Round(time.Millisecond),
+			End:   time.Duration(segment.End * float64(time.Second)).Round(time.Millisecond),
+			Text:  segment.Text,
+		})
+	}
+	return subtitles, nil
+}
+
+// normalizeSubtitles sorts subtitles, trims their text, clamps them to the audio duration (in seconds)
+// and drops empty ones. Overlapping subtitles are cut at the start of the next one.
+func normalizeSubtitles(subtitles []util.Subtitle, duration float64) []util.Subtitle {
+	total := time.Duration(duration * float64(time.Second))
+	sort.SliceStable(subtitles, func(i, j int) bool { return subtitles[i].Start < subtitles[j].Start })
+	var result []util.Subtitle
+	for i, subtitle := range subtitles {
+		subtitle.Text = strings.TrimSpace(subtitle.Text)
+		subtitle.Start = max(subtitle.Start, 0)
+		subtitle.End = min(subtitle.End, total)
+		if i < len(subtitles)-1 {
+			subtitle.End = min(subtitle.End, subtitles[i+1].Start)
+		}
+		if subtitle.End <= subtitle.Start {
+			continue
+		}
+		result = append(result, subtitle)
+	}
+	return result
+}
+
+// checkOverwrite returns an error if the file at path exists, unless --force is set.
+func checkOverwrite(path string) error {
+	if !flagForce {
+		if _, err := os.Stat(util.LongPath(path)); err == nil {
+			return fmt.Errorf("%q already exists, use --force to overwrite", path)
+		}
+	}
+	return nil
+}
+
+// writeFile writes a file, which must not exist unless --force is set.
+func writeFile(path string, data []byte) error {
+	if err := checkOverwrite(path); err != nil {
+		return err
+	}
+	return os.WriteFile(util.LongPath(path), data, 0644)
+}
@@ -0,0 +1,226 @@
+package datasync
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir    string
+	flagRemote string
+	flagSsh    string
+	flagDelete bool
+	flagDryRun bool
+	fileFilter util.FileFilter
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Push changed dataset files to a remote dir over SSH",
+	Long: `Push a dataset dir to a remote dir (e.g. on a training box) over SSH,
+uploading only files that are new or changed since the last sync.
+
+The remote dir keeps a "` + util.MANIFEST_FILENAME + `" of the SHA-256 hashes of synced
+files. Local files are hashed and compared with it, and only the changed files are
+streamed as a tar archive through a single "ssh <host> tar -x" session. So iterating
+on captions doesn't require re-uploading gigabytes of images.
+
+The system "ssh" client is used, so ~/.ssh/config, keys and agents work as usual.
+The remote host must have "tar". Use --include / --exclude to select files,
+e.g. --exclude "*.json" to not sync sidecar files.`,
+	Args: cobra.NoArgs,
+	RunE: sync,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().StringVar(&flagDir, "dir", "", "Local dataset dir (required)")
+	syncCmd.Flags().StringVar(&flagRemote, "remote", "", `Remote dir, in "[user@]host:path" format (required). A relative (or "~/") path is relative to the remote home`)
+	syncCmd.Flags().StringVar(&flagSsh, "ssh", "ssh", `The ssh command, with extra args if needed, e.g. "ssh -p 2222"`)
+	syncCmd.Flags().BoolVar(&flagDelete, "delete", false, "Delete remote files synced before that no longer exist locally (or are excluded)")
+	syncCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "Only print the files that would be uploaded / deleted")
+	fileFilter.AddFlags(syncCmd.Flags())
+	syncCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(syncCmd.Flags(), "dir", ".")
+	syncCmd.MarkFlagRequired("remote")
+}
+
+func sync(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	host, remoteDir, ok := strings.Cut(flagRemote, ":")
+	if !ok || host == "" || remoteDir == "" {
+		return errs.New(errs.ExitConfig, `invalid --remote %q, must be in "[user@]host:path" format`, flagRemote)
+	}
+	// The remote path is quoted in the remote commands, so "~" is not expanded by the remote shell.
+	// The ssh session starts in the remote home, to which relative paths are relative anyway
+	if remoteDir == "~" {
+		remoteDir = "."
+	} else if rest, ok := strings.CutPrefix(remoteDir, "~/"); ok && rest != "" {
+		remoteDir = rest
+	}
+	sshArgs := strings.Fields(flagSsh)
+	if len(sshArgs) == 0 {
+		return errs.New(errs.ExitConfig, "--ssh can not be empty")
+	}
+
+	fmt.Printf("Hashing local files in %q...\n", flagDir)
+	local, err := util.BuildManifest(flagDir, func(path string, entry fs.DirEntry) bool {
+		return fileFilter.Match(entry)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan dir %q: %w", flagDir, err)
+	}
+
+	fmt.Printf("Reading remote manifest of %s...\n", flagRemote)
+	remoteManifestPath := quote(remoteDir + "/" + util.MANIFEST_FILENAME)
+	output, err := ssh(sshArgs, host, "if [ -f "+remoteManifestPath+" ]; then cat "+remoteManifestPath+"; fi", nil)
+	if err != nil {
+		return err
+	}
+	remote := &util.Manifest{}
+	if len(bytes.TrimSpace(output)) > 0 {
+		if remote, err = util.ParseManifest(output); err != nil {
+			return fmt.Errorf("invalid remote manifest: %w", err)
+		}
+	}
+	remoteHashes := map[string]string{}
+	for _, file := range remote.Files {
+		remoteHashes[file.Path] = file.Sha256
+	}
+
+	var uploads []util.ManifestFile
+	var uploadSize int64
+	for _, file := range local.Files {
+		if remoteHashes[file.Path] != file.Sha256 {
+			uploads = append(uploads, file)
+			uploadSize += file.Size
+		}
+		delete(remoteHashes, file.Path)
+	}
+	localCnt := len(local.Files)
+	var deletes []string
+	if flagDelete {
+		for path := range remoteHashes {
+			deletes = append(deletes, path)
+		}
+	} else {
+		// Keep tracking remote files that were not deleted
+		for _, file := range remote.Files {
+			if _, ok := remoteHashes[file.Path]; ok {
+				local.Files = append(local.Files, file)
+			}
+		}
+	}
+
+	fmt.Printf("%d local files, %d to upload (%s), %d to delete, %d unchanged\n", localCnt, len(uploads),
+		util.FormatBytes(uploadSize), len(deletes), localCnt-len(uploads))
+	if flagDryRun {
+		for _, file := range uploads {
+			fmt.Printf("  upload: %s\n", file.Path)
+		}
+		for _, path := range deletes {
+			fmt.Printf("  delete: %s\n", path)
+		}
+		return nil
+	}
+	if len(uploads) == 0 && len(deletes) == 0 {
+		fmt.Printf("✅ Remote is up to date\n")
+		return nil
+	}
+
+	start := time.Now()
+	if len(deletes) > 0 {
+		var quoted []string
+		for _, path := range deletes {
+			quoted = append(quoted, quote(path))
+		}
+		if _, err := ssh(sshArgs, host, "cd "+quote(remoteDir)+" && rm -f -- "+strings.Join(quoted, " "), nil); err != nil {
+			return fmt.Errorf("failed to delete remote files: %w", err)
+		}
+	}
+
+	// Stream changed files and the new manifest (last, so it's only updated if everything else succeeded)
+	pr, pw := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		err := writeTar(pw, flagDir, uploads, local.Marshal())
+		pw.CloseWithError(err)
+		writeErr <- err
+	}()
+	_, err = ssh(sshArgs, host, "mkdir -p "+quote(remoteDir)+" && tar -xf - -C "+quote(remoteDir), pr)
+	pr.Close()
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("failed to upload files: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload files: %w", err)
+	}
+	fmt.Printf("✅ Synced %d files (%s) in %v\n", len(uploads), util.FormatBytes(uploadSize),
+		time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// writeTar writes files (relative to dir) and the manifest to w as a tar archive.
+func writeTar(w io.Writer, dir string, files []util.ManifestFile, manifest []byte) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, file := range files {
+		f, err := os.Open(util.LongPath(filepath.Join(dir, filepath.FromSlash(file.Path))))
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{Name: file.Path, Mode: 0644, Size: file.Size, ModTime: now})
+		if err == nil {
+			_, err = f.WriteTo(tw)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: util.MANIFEST_FILENAME, Mode: 0644, Size: int64(len(manifest)),
+		ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ssh runs the remote shell command on host and returns its stdout.
+func ssh(sshArgs []string, host string, command string, stdin io.Reader) ([]byte, error) {
+	args := append(append([]string{}, sshArgs[1:]...), host, command)
+	c := exec.Command(sshArgs[0], args...)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if stdin != nil {
+		c.Stdin = stdin
+	}
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("ssh %s: %w: %s", host, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// quote quotes s as a single argument of POSIX shell.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,204 @@
+package tagdrift
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir        string
+	flagCaptionExt string
+	flagThreshold  float64
+	flagTop        int
+	fileFilter     util.FileFilter
+)
+
+var tagDriftCmd = &cobra.Command{
+	Use:   "tag-drift <model.safetensors>",
+	Short: "Compare the tag frequency of a dataset with the training captions of a LoRA",
+	Long: `Compare the tag frequency of the captions of a dataset (including its subdirs) with the
+ss_tag_frequency metadata recorded in a LoRA trained by kohya-ss sd-scripts, to reproduce or
+deliberately change the dataset composition between versions.
+
+The frequency of a tag is the percent of captions having it. It reports the tags only in the
+training captions (removed), the tags only in the dataset (new), and the tags whose frequency
+changed by at least --threshold percentage points.`,
+	Args: cobra.ExactArgs(1),
+	RunE: tagDrift,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(tagDriftCmd)
+	tagDriftCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dataset dir")
+	tagDriftCmd.Flags().StringVar(&flagCaptionExt, "caption-ext", ".txt", "Optional: Extension of the caption files")
+	tagDriftCmd.Flags().Float64Var(&flagThreshold, "threshold", 10, "Optional: Report the tags whose frequency changed by at least this many percentage points")
+	tagDriftCmd.Flags().IntVar(&flagTop, "top", 50, "Optional: Max number of tags of each list. 0 = unlimited")
+	fileFilter.AddFlags(tagDriftCmd.Flags())
+	tagDriftCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(tagDriftCmd.Flags(), "dir", ".")
+}
+
+// tagCounts are the number of captions having each tag, of a number of captions.
+type tagCounts struct {
+	captions int
+	tags     map[string]int
+}
+
+// percent returns the frequency of tag in percent.
+func (c *tagCounts) percent(tag string) float64 {
+	if c.captions == 0 {
+		return 0
+	}
+	return 100 * float64(c.tags[tag]) / float64(c.captions)
+}
+
+// tagDiff is the frequency of a tag in the training captions and the dataset.
+type tagDiff struct {
+	tag     string
+	trained float64
+	current float64
+}
+
+func tagDrift(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	captionExt, err := util.ParseOutputExt(flagCaptionExt, ".txt")
+	if err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	trained, err := modelTagCounts(args[0])
+	if err != nil {
+		return err
+	}
+	current, err := datasetTagCounts(flagDir, captionExt)
+	if err != nil {
+		return err
+	}
+	if current.captions == 0 {
+		return errs.New(errs.ExitConfig, "no %s caption found in %q", captionExt, flagDir)
+	}
+	fmt.Printf("Model:   %s (%d captions, %d distinct tags)\n", args[0], trained.captions, len(trained.tags))
+	fmt.Printf("Dataset: %s (%d captions, %d distinct tags)\n", flagDir, current.captions, len(current.tags))
+
+	var removed, added, changed []*tagDiff
+	for tag := range trained.tags {
+		diff := &tagDiff{tag: tag, trained: trained.percent(tag), current: current.percent(tag)}
+		if current.tags[tag] == 0 {
+			removed = append(removed, diff)
+		} else if math.Abs(diff.current-diff.trained) >= flagThreshold {
+			changed = append(changed, diff)
+		}
+	}
+	for tag := range current.tags {
+		if trained.tags[tag] == 0 {
+			added = append(added, &tagDiff{tag: tag, current: current.percent(tag)})
+		}
+	}
+	printDiffs("Removed tags (only in the training captions)", removed)
+	printDiffs("New tags (only in the dataset)", added)
+	printDiffs(fmt.Sprintf("Changed tags (by >= %g percentage points)", flagThreshold), changed)
+	if len(removed)+len(added)+len(changed) == 0 {
+		fmt.Printf("No drift: the tag frequency of the dataset matches the training captions\n")
+	}
+	return nil
+}
+
+// printDiffs prints the diffs, largest change first.
+func printDiffs(title string, diffs []*tagDiff) {
+	if len(diffs) == 0 {
+		return
+	}
+	slices.SortFunc(diffs, func(a, b *tagDiff) int {
+		da, db := math.Abs(a.current-a.trained), math.Abs(b.current-b.trained)
+		if da != db {
+			if da > db {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.tag, b.tag)
+	})
+	fmt.Printf("%s: %d\n", title, len(diffs))
+	shown := diffs
+	if flagTop > 0 && len(shown) > flagTop {
+		shown = shown[:flagTop]
+	}
+	for _, diff := range shown {
+		fmt.Printf("  %5.1f%% -> %5.1f%% (%+6.1f)  %s\n", diff.trained, diff.current, diff.current-diff.trained, diff.tag)
+	}
+	if len(shown) < len(diffs) {
+		fmt.Printf("  ... and %d more\n", len(diffs)-len(shown))
+	}
+}
+
+// modelTagCounts returns the tag counts of the ss_tag_frequency metadata of the model at path.
+// The caption count of a dataset dir is its image count (of the ss_dataset_dirs metadata),
+// or the count of its most frequent tag if unknown.
+func modelTagCounts(path string) (*tagCounts, error) {
+	header, err := util.ReadSafetensorsHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	frequency, err := header.TagFrequency()
+	if err != nil {
+		return nil, err
+	}
+	if frequency == nil {
+		return nil, errs.New(errs.ExitConfig, "%s has no ss_tag_frequency metadata", path)
+	}
+	var dirs map[string]struct {
+		ImgCount int `json:"img_count"`
+	}
+	json.Unmarshal([]byte(header.Metadata["ss_dataset_dirs"]), &dirs)
+	counts := &tagCounts{tags: map[string]int{}}
+	for dir, tags := range frequency {
+		captions := dirs[dir].ImgCount
+		for tag, count := range tags {
+			counts.tags[strings.TrimSpace(tag)] += count
+			if dirs[dir].ImgCount <= 0 {
+				captions = max(captions, count)
+			}
+		}
+		counts.captions += captions
+	}
+	return counts, nil
+}
+
+// datasetTagCounts returns the tag counts of the caption files in dir and its subdirs.
+func datasetTagCounts(dir string, captionExt string) (*tagCounts, error) {
+	files, err := util.ListInputFilesRecursive(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	counts := &tagCounts{tags: map[string]int{}}
+	for _, file := range files {
+		if file.IsDir() || !strings.EqualFold(filepath.Ext(file.Name()), captionExt) || !fileFilter.Match(file) {
+			continue
+		}
+		data, err := os.ReadFile(util.LongPath(file.Path))
+		if err != nil {
+			return nil, err
+		}
+		counts.captions++
+		var seen []string
+		for _, tag := range strings.Split(strings.TrimPrefix(string(data), util.UTF8_BOM), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(seen, tag) {
+				seen = append(seen, tag)
+				counts.tags[tag]++
+			}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,181 @@
+package thumbs
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir         string
+	flagOutputDir   string
+	flagSize        int
+	flagQuality     int
+	flagWorkers     int
+	flagForce       bool
+	flagChangedOnly bool
+	flagProgress    bool
+	fileFilter      util.FileFilter
+)
+
+var thumbsCmd = &cobra.Command{
+	Use:   "thumbs",
+	Short: "Generate thumbnails of all images of a dataset into a parallel folder",
+	Long: `Generate fixed-size thumbnails of all images (.jpg, .jpeg, .png, .webp) in a dataset dir,
+including subdirectories, into a parallel folder with the same structure, e.g. for fast web
+galleries for caption review.
+
+Each thumbnail is scaled down to fit in a --size x --size box (aspect ratio preserved;
+smaller images are not enlarged) and saved as JPEG "<filename without ext>.jpg".`,
+	Args: cobra.NoArgs,
+	RunE: thumbs,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(thumbsCmd)
+	thumbsCmd.Flags().StringVar(&flagDir, "dir", "", "Required: Path to the dataset dir")
+	thumbsCmd.Flags().StringVar(&flagOutputDir, "output", "", `Optional: Output dir. default to "<dir>-thumbs"`)
+	thumbsCmd.Flags().IntVar(&flagSize, "size", 256, "Optional: Max width and height of thumbnails")
+	thumbsCmd.Flags().IntVar(&flagQuality, "quality", 80, "Optional: JPEG quality (1-100) of thumbnails")
+	thumbsCmd.Flags().IntVar(&flagWorkers, "workers", runtime.NumCPU(), "Optional: Number of images processed in parallel")
+	thumbsCmd.Flags().BoolVar(&flagForce, "force", false, "Optional: Re-generate thumbnails even if they already exist")
+	thumbsCmd.Flags().BoolVar(&flagChangedOnly, "changed-only", false, "Optional: Also re-generate thumbnails of images modified after them")
+	thumbsCmd.MarkFlagsMutuallyExclusive("force", "changed-only")
+	thumbsCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar instead of per-image lines. Ignored if stdout is not a terminal")
+	fileFilter.AddFlags(thumbsCmd.Flags())
+	thumbsCmd.MarkFlagRequired("dir")
+	cmd.SetPromptDefault(thumbsCmd.Flags(), "dir", ".")
+}
+
+func thumbs(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagSize <= 0 || flagQuality < 1 || flagQuality > 100 || flagWorkers < 1 {
+		return errs.New(errs.ExitConfig, "invalid --size, --quality or --workers")
+	}
+	absDir, err := filepath.Abs(flagDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path %s: %w", flagDir, err)
+	}
+	output := flagOutputDir
+	if output == "" {
+		output = absDir + "-thumbs"
+	}
+	absOutput, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+
+	// Collect images (relative paths) to process
+	var images []string
+	skippedCnt := 0
+	err = filepath.WalkDir(absDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != absDir && (strings.HasPrefix(entry.Name(), ".") || path == absOutput) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !IsImageFile(entry.Name()) || !fileFilter.Match(entry) {
+			return nil
+		}
+		relPath, err := filepath.Rel(absDir, path)
+		if err != nil {
+			return err
+		}
+		if !flagForce && util.OutputUpToDate(path, ThumbPath(absOutput, relPath), flagChangedOnly) {
+			skippedCnt++
+			return nil
+		}
+		images = append(images, relPath)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan dir %q: %w", flagDir, err)
+	}
+	fmt.Printf("Generating %d thumbnails (%d up to date) into %q\n", len(images), skippedCnt, output)
+
+	start := time.Now()
+	progress := util.NewProgress(len(images), flagProgress)
+	var mu sync.Mutex
+	errorCnt := 0
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range flagWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relPath := range jobs {
+				err := makeThumb(filepath.Join(absDir, relPath), ThumbPath(absOutput, relPath))
+				mu.Lock()
+				if err != nil {
+					errorCnt++
+					progress.Printf("❌ %s: %v\n", relPath, err)
+				} else if !progress.Enabled {
+					fmt.Printf("✅ %s\n", relPath)
+				}
+				mu.Unlock()
+				progress.Done(err != nil)
+			}
+		}()
+	}
+	for _, relPath := range images {
+		jobs <- relPath
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Finish()
+	fmt.Printf("Done. %d thumbnails generated, %d failed, in %v\n", len(images)-errorCnt, errorCnt,
+		time.Since(start).Round(time.Millisecond))
+	return errs.RunResult(len(images), errorCnt)
+}
+
+// ThumbPath returns the path of the thumbnail in thumbsDir of the image at relPath (relative to the dataset dir).
+func ThumbPath(thumbsDir string, relPath string) string {
+	return filepath.Join(thumbsDir, strings.TrimSuffix(relPath, filepath.Ext(relPath))+".jpg")
+}
+
+// IsImageFile checks if a filename has an image extension supported by thumbs.
+func IsImageFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return true
+	default:
+		return false
+	}
+}
+
+func makeThumb(inputPath, outputPath string) error {
+	img, _, err := util.LoadImage(inputPath)
+	if err != nil {
+		return err
+	}
+	if img.Bounds().Dx() > flagSize || img.Bounds().Dy() > flagSize {
+		img = imaging.Fit(img, flagSize, flagSize, imaging.Lanczos)
+	}
+	// JPEG has no alpha channel: flatten transparent images onto a white background.
+	background := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+	img = imaging.Overlay(background, img, image.Pt(0, 0), 1)
+	if err := os.MkdirAll(util.LongPath(filepath.Dir(outputPath)), 0755); err != nil {
+		return err
+	}
+	return imaging.Save(img, util.LongPath(outputPath), imaging.JPEGQuality(flagQuality))
+}
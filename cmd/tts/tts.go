@@ -0,0 +1,219 @@
+package tts
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	maxRetries  = 4
+	baseBackoff = 6 * time.Second
+	maxBackoff  = 60 * time.Second
+
+	// Format of the raw PCM audio returned by Gemini speech generation models,
+	// if not stated in the MIME type of the response
+	defaultSampleRate = 24000
+)
+
+var (
+	flagDir          string
+	flagOutput       string
+	flagModel        string
+	flagVoice        string
+	flagStyle        string
+	flagForce        bool
+	flagApiKeysFile  string
+	flagMaxRetryDur  time.Duration
+	flagTimeout      time.Duration
+	flagTimeoutPerMB time.Duration
+	fileFilter       util.FileFilter
+)
+
+var ttsCmd = &cobra.Command{
+	Use:   "tts [text.txt]...",
+	Short: "Synthesize speech from text files using Gemini speech generation models",
+	Long: `Synthesize speech from the .txt files of a dir using a Gemini speech generation (TTS) model,
+e.g. to generate reference audio or to augment a voice dataset.
+
+For each "<name>.txt", "<output>/<name>.wav" is written, along with a copy of the text file,
+so the output dir is a dataset of audio / transcript pairs as produced by stt,
+which can be fed to sovits-genlist. Existing wav files are skipped unless --force is set.
+
+--voice is one of the prebuilt voices of the model, e.g. "Kore" (firm) or "Puck" (upbeat).
+See https://ai.google.dev/gemini-api/docs/speech-generation#voices .
+--style is an instruction prepended to the text to control the delivery, e.g. "Say cheerfully:".
+
+Instead of --dir, text files can be given as arguments.
+
+Requires the GEMINI_API_KEY environment variable to be set.`,
+	RunE: tts,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(ttsCmd)
+	ttsCmd.Flags().StringVar(&flagDir, "dir", "", "Directory containing .txt files (required unless text files are given as args)")
+	ttsCmd.Flags().StringVar(&flagOutput, "output", "", `Optional: Output dir. default: "<input-dir>-tts"`)
+	ttsCmd.Flags().StringVar(&flagModel, "model", constants.DEFAULT_GEMINI_TTS_MODEL, "The speech generation model to use")
+	ttsCmd.Flags().StringVar(&flagVoice, "voice", constants.DEFAULT_GEMINI_TTS_VOICE, "The prebuilt voice to use")
+	ttsCmd.Flags().StringVar(&flagStyle, "style", "", `Optional: Style instruction prepended to the text, e.g. "Say cheerfully:"`)
+	ttsCmd.Flags().BoolVar(&flagForce, "force", false, "Overwrite existing wav files")
+	ttsCmd.Flags().StringVar(&flagApiKeysFile, "api-keys-file", "", "Path of a file of Gemini API keys (one per line), rotated among requests")
+	ttsCmd.Flags().DurationVar(&flagMaxRetryDur, "max-retry-duration", 5*time.Minute, "Max total time spent on one file including retries. 0 = unlimited")
+	ttsCmd.Flags().DurationVar(&flagTimeout, "timeout", 120*time.Second, "Base timeout of a single API request. 0 = no timeout")
+	ttsCmd.Flags().DurationVar(&flagTimeoutPerMB, "timeout-per-mb", 10*time.Second, "Additional API request timeout per MB of payload")
+	fileFilter.AddFlags(ttsCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(ttsCmd.Flags(), "dir")
+	cmd.SetPromptDefault(ttsCmd.Flags(), "dir", ".")
+}
+
+func tts(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	i := slices.IndexFunc(constants.GEMINI_TTS_VOICES, func(voice string) bool {
+		return strings.EqualFold(voice, flagVoice)
+	})
+	if i == -1 {
+		return errs.New(errs.ExitConfig, "unknown --voice %q, available voices: %s",
+			flagVoice, strings.Join(constants.GEMINI_TTS_VOICES, ", "))
+	}
+	flagVoice = constants.GEMINI_TTS_VOICES[i]
+	output := flagOutput
+	if output == "" {
+		inputDir := flagDir
+		if len(args) > 0 {
+			inputDir = filepath.Dir(args[0])
+		}
+		absDir, err := filepath.Abs(inputDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path %s: %w", inputDir, err)
+		}
+		output = absDir + "-tts"
+	}
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var toSynthesize []util.InputFile
+	for _, file := range files {
+		if file.IsDir() || strings.ToLower(filepath.Ext(file.Name())) != ".txt" || !fileFilter.Match(file) {
+			continue
+		}
+		wavPath := filepath.Join(output, strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))+".wav")
+		if !flagForce {
+			if _, err := os.Stat(util.LongPath(wavPath)); err == nil {
+				continue
+			}
+		}
+		toSynthesize = append(toSynthesize, file)
+	}
+	if len(toSynthesize) == 0 {
+		fmt.Printf("No text files to synthesize\n")
+		return nil
+	}
+	keys, err := gemini.LoadKeys(flagApiKeysFile)
+	if err != nil {
+		return err
+	}
+	if err := cmd.CheckModel(keys, "", flagModel); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(util.LongPath(output), 0755); err != nil {
+		return err
+	}
+
+	client := &gemini.Client{
+		HTTPClient:   &http.Client{},
+		Keys:         keys,
+		Timeout:      flagTimeout,
+		TimeoutPerMB: flagTimeoutPerMB,
+		Retry: util.RetryPolicy{
+			MaxRetries:  maxRetries,
+			BaseBackoff: baseBackoff,
+			MaxBackoff:  maxBackoff,
+			MaxDuration: flagMaxRetryDur,
+		},
+	}
+	errorCnt := 0
+	for _, file := range toSynthesize {
+		if err := synthesizeFile(client, file.Path, output); err != nil {
+			fmt.Printf("❌ %s: %v\n", file.Name(), err)
+			errorCnt++
+			if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) {
+				return fmt.Errorf("run aborted: %w", err)
+			}
+			continue
+		}
+		fmt.Printf("✅ %s\n", file.Name())
+	}
+	return errs.RunResult(len(toSynthesize), errorCnt)
+}
+
+// synthesizeFile synthesizes the text file at path, and writes the wav file and a copy of the text to output dir.
+func synthesizeFile(client *gemini.Client, path string, output string) error {
+	data, err := os.ReadFile(util.LongPath(path))
+	if err != nil {
+		return err
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return fmt.Errorf("empty text")
+	}
+	prompt := text
+	if flagStyle != "" {
+		prompt = flagStyle + " " + text
+	}
+	generationConfig := &gemini.GenerationConfig{
+		ResponseModalities: []string{"AUDIO"},
+		SpeechConfig:       &gemini.SpeechConfig{},
+	}
+	generationConfig.SpeechConfig.VoiceConfig.PrebuiltVoiceConfig.VoiceName = flagVoice
+	audio, err := client.GenerateData(context.Background(), flagModel, &gemini.Request{
+		Contents:         []gemini.Content{{Parts: []gemini.Part{{Text: prompt}}}},
+		GenerationConfig: generationConfig,
+	})
+	if err != nil {
+		return err
+	}
+	samples, err := base64.StdEncoding.DecodeString(audio.Data)
+	if err != nil {
+		return fmt.Errorf("invalid audio data: %w", err)
+	}
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	wavPath := filepath.Join(output, base+".wav")
+	mediaType, params, _ := mime.ParseMediaType(audio.MimeType)
+	switch strings.ToLower(mediaType) {
+	case "audio/wav", "audio/x-wav", "audio/wave":
+		err = os.WriteFile(util.LongPath(wavPath), samples, 0644)
+	case "audio/l16", "audio/pcm", "":
+		// Raw signed 16-bit little-endian mono PCM
+		sampleRate := defaultSampleRate
+		if rate, err := strconv.Atoi(params["rate"]); err == nil && rate > 0 {
+			sampleRate = rate
+		}
+		err = util.WriteWav(wavPath, util.PCMFmtChunk(1, uint32(sampleRate), 16), samples)
+	default:
+		return fmt.Errorf("unsupported audio format %q", audio.MimeType)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(util.LongPath(filepath.Join(output, base+".txt")), []byte(text+"\n"), 0644)
+}
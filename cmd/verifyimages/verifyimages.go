@@ -0,0 +1,117 @@
+package verifyimages
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/captioner"
+	"github.com/sagan/goaider/util"
+)
+
+var (
+	flagDir         string
+	flagRecursive   bool
+	flagWorkers     int
+	flagMoveCorrupt bool
+	flagProgress    bool
+	fileFilter      util.FileFilter
+)
+
+var verifyImagesCmd = &cobra.Command{
+	Use:   "verify-images [image]...",
+	Short: "Fully decode all images of a dataset to detect corrupt files",
+	Long: `Fully decode every image (.jpg, .jpeg, .png, .webp) of a dataset dir to detect corrupt files,
+e.g. truncated downloads or PNG chunks with CRC errors, which otherwise crash training at some
+later epoch with cryptic errors.
+
+Instead of --dir, image files can be given as arguments to verify only them.
+The exit code is 3 (partial failure) if any image is corrupt, or 4 if all of them are.`,
+	RunE: verifyImages,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(verifyImagesCmd)
+	verifyImagesCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless image files are given as args): Path to the dataset dir")
+	verifyImagesCmd.Flags().BoolVar(&flagRecursive, "recursive", false, "Optional: Also verify the images in the subdirectories of --dir (except hidden ones)")
+	verifyImagesCmd.Flags().IntVar(&flagWorkers, "workers", runtime.NumCPU(), "Optional: Number of images decoded in parallel")
+	verifyImagesCmd.Flags().BoolVar(&flagMoveCorrupt, "move-corrupt", false, "Optional: Move the corrupt images to the "+util.CORRUPT_DIR+" folder next to them")
+	verifyImagesCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar instead of per-image lines. Ignored if stdout is not a terminal")
+	fileFilter.AddFlags(verifyImagesCmd.Flags())
+	cmd.MarkFlagRequiredUnlessArgs(verifyImagesCmd.Flags(), "dir")
+	cmd.SetPromptDefault(verifyImagesCmd.Flags(), "dir", ".")
+}
+
+func verifyImages(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagWorkers < 1 {
+		return errs.New(errs.ExitConfig, "invalid --workers")
+	}
+	listFiles := util.ListInputFiles
+	if flagRecursive {
+		listFiles = util.ListInputFilesRecursive
+	}
+	files, err := listFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var images []string
+	for _, file := range files {
+		if file.IsDir() || !captioner.IsImageFile(file.Name()) || !fileFilter.Match(file) {
+			continue
+		}
+		images = append(images, file.Path)
+	}
+	fmt.Printf("Verifying %d images\n", len(images))
+
+	start := time.Now()
+	progress := util.NewProgress(len(images), flagProgress)
+	var mu sync.Mutex
+	var corruptFiles []*cmd.CorruptFile
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range flagWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				err := util.VerifyImageFile(path)
+				mu.Lock()
+				if err != nil {
+					corruptFiles = append(corruptFiles, &cmd.CorruptFile{Path: path, Err: err})
+					progress.Printf("❌ %s: %v\n", path, err)
+				} else if !progress.Enabled {
+					fmt.Printf("✅ %s\n", filepath.Base(path))
+				}
+				mu.Unlock()
+				progress.Done(err != nil)
+			}
+		}()
+	}
+	for _, path := range images {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Finish()
+	fmt.Printf("Done. %d images verified, %d corrupt, in %v\n", len(images), len(corruptFiles),
+		time.Since(start).Round(time.Millisecond))
+	if flagMoveCorrupt {
+		for _, file := range corruptFiles {
+			if newPath, err := util.MoveToCorruptDir(file.Path); err != nil {
+				fmt.Printf("Failed to move %s: %v\n", file.Path, err)
+			} else {
+				fmt.Printf("Moved %s to %s\n", file.Path, newPath)
+			}
+		}
+	}
+	return errs.RunResult(len(images), len(corruptFiles))
+}
@@ -0,0 +1,176 @@
+package verifyspeaker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/sagan/goaider/cmd"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/pkg/cropper"
+	"github.com/sagan/goaider/pkg/embedder"
+	"github.com/sagan/goaider/util"
+)
+
+// The folder (in the dir of the clips) where the clips of other speakers are moved by --action move
+const moveDir = "other-speaker"
+
+var (
+	flagDir        string
+	flagRefs       []string
+	flagThreshold  float64
+	flagAction     string
+	flagProgress   bool
+	speakerOptions embedder.SpeakerOptions
+	fileFilter     util.FileFilter
+)
+
+var verifySpeakerCmd = &cobra.Command{
+	Use:   "verify-speaker --ref <wav>... [wav]...",
+	Short: "Flag the audio clips of other speakers than the one of a reference voice sample",
+	Long: `Compare the voice of each audio clip (.wav) of a dir against one or more reference samples of the speaker
+(--ref), using the speaker embeddings of a local speaker verification model (--speaker-model), and flag the clips
+whose similarity to all references is below --threshold, e.g. the clips of the other voices of a podcast
+that was auto-sliced into clips.
+
+--action:
+- flag (default): add the clips of other speakers to the flagged list file "` + util.FLAGGED_FILE + `"
+  of their dir (see review), nothing is deleted.
+- move: move them (and their sidecar files of the same name, e.g. .txt) to "<dir>/` + moveDir + `/".
+
+The model runs locally with the onnxruntime library (see --onnxruntime-lib), no API key is needed.
+Clips are downmixed to mono and resampled to 16 kHz; clips shorter than 0.5s can not be verified.
+The best --threshold depends on the model and the recordings: run with the default action first and check
+the similarity of the flagged clips.
+Instead of --dir, wav files can be given as arguments.`,
+	RunE: verifySpeaker,
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(verifySpeakerCmd)
+	verifySpeakerCmd.Flags().StringVar(&flagDir, "dir", "", "Required (unless wav files are given as args): Path to the dir of the audio clips")
+	verifySpeakerCmd.Flags().StringSliceVar(&flagRefs, "ref", nil, "Required: Comma-separated paths of reference voice samples (.wav) of the speaker (a few clean clips of 5-30s work best). Can be set multiple times")
+	verifySpeakerCmd.Flags().Float64Var(&flagThreshold, "threshold", 0.5, "Optional: Min similarity (cosine, -1.0-1.0) of a clip to the most similar reference, below which it's flagged")
+	verifySpeakerCmd.Flags().StringVar(&flagAction, "action", "flag", "Optional: What to do with the clips of other speakers: flag | move")
+	verifySpeakerCmd.Flags().BoolVar(&flagProgress, "progress", false, "Optional: Show a progress bar instead of per-clip lines. Ignored if stdout is not a terminal")
+	speakerOptions.AddFlags(verifySpeakerCmd.Flags())
+	fileFilter.AddFlags(verifySpeakerCmd.Flags())
+	verifySpeakerCmd.MarkFlagRequired("ref")
+	cmd.MarkFlagRequiredUnlessArgs(verifySpeakerCmd.Flags(), "dir")
+	cmd.SetPromptDefault(verifySpeakerCmd.Flags(), "dir", ".")
+}
+
+// scored is a clip and its similarity to the references.
+type scored struct {
+	path       string
+	similarity float64
+}
+
+func verifySpeaker(_ *cobra.Command, args []string) error {
+	if err := fileFilter.Init(); err != nil {
+		return errs.Wrap(errs.ExitConfig, err)
+	}
+	if flagThreshold < -1 || flagThreshold > 1 {
+		return errs.New(errs.ExitConfig, "invalid --threshold %v: must be in -1.0-1.0", flagThreshold)
+	}
+	if flagAction != "flag" && flagAction != "move" {
+		return errs.New(errs.ExitConfig, "invalid --action %q", flagAction)
+	}
+	files, err := util.ListInputFiles(flagDir, args)
+	if err != nil {
+		return err
+	}
+	var clips []string
+	unsupported := 0
+	for _, file := range files {
+		if file.IsDir() || !fileFilter.Match(file) {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(file.Name())) {
+		case ".wav":
+			clips = append(clips, file.Path)
+		case ".mp3", ".m4a", ".flac", ".ogg":
+			unsupported++
+		}
+	}
+	if unsupported > 0 {
+		fmt.Printf("%d non-wav audio files are not verified, convert them first (e.g. ffmpeg -i input.mp3 output.wav)\n",
+			unsupported)
+	}
+
+	e, err := embedder.NewSpeaker(&speakerOptions)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	var refs [][]float32
+	for _, ref := range flagRefs {
+		v, err := embedder.EmbedAudioFile(e, ref)
+		if err != nil {
+			return errs.New(errs.ExitConfig, "failed to embed the reference sample %q: %w", ref, err)
+		}
+		refs = append(refs, v)
+	}
+
+	fmt.Printf("Verifying %d clips against %d reference samples\n", len(clips), len(refs))
+	progress := util.NewProgress(len(clips), flagProgress && util.IsTerminal(os.Stdout))
+	errorCnt := 0
+	var flagged []*scored
+	for _, clip := range clips {
+		progress.Start(filepath.Base(clip))
+		v, err := embedder.EmbedAudioFile(e, clip)
+		progress.Done(err != nil)
+		if err != nil {
+			progress.Printf("❌ %s: %v\n", clip, err)
+			errorCnt++
+			continue
+		}
+		similarity, _ := embedder.MaxSimilarity(v, refs)
+		if similarity < flagThreshold {
+			flagged = append(flagged, &scored{clip, similarity})
+		} else if !progress.Enabled {
+			fmt.Printf("✅ %s: %.3f\n", clip, similarity)
+		}
+	}
+	progress.Finish()
+
+	slices.SortFunc(flagged, func(a, b *scored) int {
+		if a.similarity < b.similarity {
+			return -1
+		} else if a.similarity > b.similarity {
+			return 1
+		}
+		return 0
+	})
+	fmt.Printf("%d of %d clips below the similarity threshold %.3f (action: %s):\n",
+		len(flagged), len(clips)-errorCnt, flagThreshold, flagAction)
+	byDir := map[string][]string{} // dir => names of the flagged clips
+	for _, clip := range flagged {
+		fmt.Printf("  %.3f %s\n", clip.similarity, clip.path)
+		byDir[filepath.Dir(clip.path)] = append(byDir[filepath.Dir(clip.path)], filepath.Base(clip.path))
+	}
+	for dir, names := range byDir {
+		if flagAction == "flag" {
+			existing, err := util.ReadFlagged(dir)
+			if err == nil {
+				err = util.WriteFlagged(dir, append(existing, names...))
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, name := range names {
+			// cropper.MoveImage moves any file with its sidecar files
+			if err := cropper.MoveImage(filepath.Join(dir, name), filepath.Join(dir, moveDir)); err != nil {
+				fmt.Printf("    failed to move %s: %v\n", name, err)
+				errorCnt++
+			}
+		}
+	}
+	return errs.RunResult(len(clips), errorCnt)
+}
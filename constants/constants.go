@@ -1,10 +1,92 @@
 package constants
 
-// Gemini API base url
-const GEMINI_API_URL = "https://generativelanguage.googleapis.com/v1beta/models/"
+// Default Gemini API base url (of the API version). The models, files and upload endpoints are derived from it
+const GEMINI_API_URL = "https://generativelanguage.googleapis.com/v1beta/"
+
+// Env variable name of the Gemini API base url, e.g. of a proxy or gateway
+const ENV_GEMINI_API_URL = "GEMINI_API_URL"
 
 // Env variable name
 const ENV_GEMINI_API_KEY = "GEMINI_API_KEY"
 
+// Env variable name of multiple Gemini API keys (comma-separated), rotated among requests
+const ENV_GEMINI_API_KEYS = "GEMINI_API_KEYS"
+
+// Env variable name of the path of a Gemini API keys file (one key per line)
+const ENV_GEMINI_API_KEYS_FILE = "GEMINI_API_KEYS_FILE"
+
 // Default gemini model
 const DEFAULT_GEMINI_MODEL = "gemini-2.5-flash"
+
+// Default gemini speech generation (TTS) model
+const DEFAULT_GEMINI_TTS_MODEL = "gemini-2.5-flash-preview-tts"
+
+// Default voice of speech generation
+const DEFAULT_GEMINI_TTS_VOICE = "Kore"
+
+// Prebuilt voices of Gemini speech generation models.
+// See https://ai.google.dev/gemini-api/docs/speech-generation#voices .
+var GEMINI_TTS_VOICES = []string{
+	"Zephyr", "Puck", "Charon", "Kore", "Fenrir", "Leda", "Orus", "Aoede", "Callirrhoe", "Autonoe",
+	"Enceladus", "Iapetus", "Umbriel", "Algieba", "Despina", "Erinome", "Algenib", "Rasalgethi", "Laomedeia", "Achernar",
+	"Alnilam", "Schedar", "Gacrux", "Pulcherrima", "Achird", "Zubenelgenubi", "Vindemiatrix", "Sadachbia", "Sadaltager", "Sulafat",
+}
+
+// Gemini API price of a model, in USD per 1M tokens.
+type ModelPrice struct {
+	Input      float64 // text / image / video input
+	AudioInput float64
+	Output     float64 // including thinking tokens
+}
+
+// Known Gemini API (paid tier) prices, used to estimate the cost of a run.
+var GEMINI_MODEL_PRICES = map[string]ModelPrice{
+	"gemini-2.5-pro":        {Input: 1.25, AudioInput: 1.25, Output: 10},
+	"gemini-2.5-flash":      {Input: 0.30, AudioInput: 1.00, Output: 2.50},
+	"gemini-2.5-flash-lite": {Input: 0.10, AudioInput: 0.30, Output: 0.40},
+	"gemini-2.0-flash":      {Input: 0.10, AudioInput: 0.70, Output: 0.40},
+	"gemini-2.0-flash-lite": {Input: 0.075, AudioInput: 0.075, Output: 0.30},
+}
+
+// Gemini API free tier rate limit of a model.
+type RateLimit struct {
+	RPM int // requests per minute
+	RPD int // requests per day
+}
+
+// Known Gemini API free tier rate limits, shown by the models command.
+// Paid tiers have much higher limits, see https://ai.google.dev/gemini-api/docs/rate-limits .
+var GEMINI_MODEL_FREE_RATE_LIMITS = map[string]RateLimit{
+	"gemini-2.5-pro":        {RPM: 5, RPD: 100},
+	"gemini-2.5-flash":      {RPM: 10, RPD: 250},
+	"gemini-2.5-flash-lite": {RPM: 15, RPD: 1000},
+	"gemini-2.0-flash":      {RPM: 15, RPD: 200},
+	"gemini-2.0-flash-lite": {RPM: 30, RPD: 200},
+}
+
+// Env variable name of default notification targets (comma-separated) of --notify flag
+const ENV_NOTIFY = "GOAIDER_NOTIFY"
+
+// Env variable name of the default dir of the local embedding model (an ONNX export of CLIP or SigLIP)
+const ENV_EMBED_MODEL = "GOAIDER_EMBED_MODEL"
+
+// Env variable name of the path of the local speaker embedding model (an ONNX export of a WeSpeaker-style model)
+const ENV_SPEAKER_MODEL = "GOAIDER_SPEAKER_MODEL"
+
+// Env variable name of the path of the onnxruntime shared library, used to run local embedding models
+const ENV_ONNXRUNTIME_LIB = "ONNXRUNTIME_LIB"
+
+// Default HuggingFace Hub endpoint
+const HF_ENDPOINT = "https://huggingface.co"
+
+// Env variable name of the HuggingFace Hub endpoint, e.g. of a mirror
+const ENV_HF_ENDPOINT = "HF_ENDPOINT"
+
+// Env variable name of the HuggingFace Hub access token (with write permission to upload)
+const ENV_HF_TOKEN = "HF_TOKEN"
+
+// Default url of the local Ollama server (of the ollama caption provider)
+const OLLAMA_HOST = "http://127.0.0.1:11434"
+
+// Env variable name of the url of the Ollama server, the same one as of the ollama CLI
+const ENV_OLLAMA_HOST = "OLLAMA_HOST"
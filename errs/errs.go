@@ -0,0 +1,90 @@
+// Package errs defines the typed errors and the process exit codes of goaider,
+// so that wrappers and schedulers can branch on the failure class.
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Code is the failure class of an error, also used as the process exit code.
+type Code int
+
+const (
+	ExitOK             Code = 0
+	ExitGeneral        Code = 1 // Unclassified error
+	ExitConfig         Code = 2 // Invalid flags, config or environment
+	ExitPartialFailure Code = 3 // Some files failed to process
+	ExitAllFailed      Code = 4 // All files failed to process
+	ExitAuth           Code = 5 // API authentication failure (invalid or missing permission API key)
+	ExitQuota          Code = 6 // API quota exceeded
+)
+
+var codeNames = map[Code]string{
+	ExitOK:             "ok",
+	ExitGeneral:        "error",
+	ExitConfig:         "config",
+	ExitPartialFailure: "partial_failure",
+	ExitAllFailed:      "all_failed",
+	ExitAuth:           "auth",
+	ExitQuota:          "quota",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code_%d", int(c))
+}
+
+// Error is an error with a failure class.
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// New returns a new error of code, formatted as fmt.Errorf.
+func New(code Code, format string, args ...any) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Wrap classifies err as code. It returns nil if err is nil.
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// CodeOf returns the failure class of err: ExitOK if err is nil, ExitGeneral if err is unclassified.
+func CodeOf(err error) Code {
+	if err == nil {
+		return ExitOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ExitGeneral
+}
+
+// Is reports whether err is classified as code.
+func Is(err error, code Code) bool {
+	return err != nil && CodeOf(err) == code
+}
+
+// RunResult returns the result error of a run which processed total files, of which failed ones failed.
+// It returns nil if there is no failure.
+func RunResult(total int, failed int) error {
+	switch {
+	case failed == 0:
+		return nil
+	case failed >= total:
+		return New(ExitAllFailed, "%d errors (all files failed)", failed)
+	default:
+		return New(ExitPartialFailure, "%d errors", failed)
+	}
+}
@@ -0,0 +1,125 @@
+package gemini
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max length of a request or response body in the debug log. Longer bodies are truncated.
+const debugBodyMaxSize = 8 << 10
+
+// Base64 runs at least this long (inline media) are replaced by a placeholder in the debug log.
+var debugBase64Regexp = regexp.MustCompile(`[A-Za-z0-9+/]{256,}={0,2}`)
+
+// Headers whose values are not written to the debug log.
+var debugRedactedHeaders = []string{"X-Goog-Api-Key", "Authorization"}
+
+var (
+	debugMu  sync.Mutex
+	debugLog io.Writer
+)
+
+// SetDebugLog sets where the requests and responses of all clients are logged (the --debug-http flag):
+// the method, url, headers and status, and the bodies with inline media (base64) elided and truncated.
+// API keys are redacted. nil = disabled.
+func SetDebugLog(w io.Writer) {
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	debugLog = w
+}
+
+// send sends req with the HTTP client, and logs the request and response if the debug log is set.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	debugMu.Lock()
+	enabled := debugLog != nil
+	debugMu.Unlock()
+	if !enabled {
+		return c.HTTPClient.Do(req)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "=== %s %s %s\n", time.Now().Format(time.RFC3339Nano), req.Method, req.URL)
+	writeDebugHeaders(&sb, req.Header)
+	if req.GetBody != nil && strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			writeDebugBody(&sb, data)
+		}
+	} else if req.ContentLength > 0 {
+		fmt.Fprintf(&sb, "<%d bytes of %s>\n", req.ContentLength, req.Header.Get("Content-Type"))
+	}
+	start := time.Now()
+	resp, err := c.HTTPClient.Do(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(&sb, "--- error (%v): %v\n", elapsed, err)
+	} else {
+		fmt.Fprintf(&sb, "--- %s (%v)\n", resp.Status, elapsed)
+		writeDebugHeaders(&sb, resp.Header)
+		data, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// The caller reads the body again, including the read error if any
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), errReader{readErr}))
+		writeDebugBody(&sb, data)
+		if readErr != nil {
+			fmt.Fprintf(&sb, "<failed to read body: %v>\n", readErr)
+		}
+	}
+	sb.WriteString("\n")
+
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	if debugLog != nil {
+		io.WriteString(debugLog, c.Keys.redact(sb.String()))
+	}
+	return resp, err
+}
+
+func writeDebugHeaders(sb *strings.Builder, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if slices.Contains(debugRedactedHeaders, http.CanonicalHeaderKey(name)) {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(sb, "%s: %s\n", name, value)
+	}
+}
+
+func writeDebugBody(sb *strings.Builder, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	body := debugBase64Regexp.ReplaceAllStringFunc(string(data), func(s string) string {
+		return fmt.Sprintf("<%d base64 chars>", len(s))
+	})
+	if len(body) > debugBodyMaxSize {
+		body = fmt.Sprintf("%s... <truncated, %d bytes in total>", strings.ToValidUTF8(body[:debugBodyMaxSize], ""), len(data))
+	}
+	sb.WriteString(strings.TrimRight(body, "\n"))
+	sb.WriteString("\n")
+}
+
+// errReader is a reader that returns err (if not nil) at the end.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,63 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DefaultEmbeddingModel is the default text embedding model.
+const DefaultEmbeddingModel = "gemini-embedding-001"
+
+// Max number of texts of a batchEmbedContents request
+const embedBatchSize = 100
+
+type embedRequest struct {
+	Model   string  `json:"model"`
+	Content Content `json:"content"`
+}
+
+type batchEmbedRequest struct {
+	Requests []*embedRequest `json:"requests"`
+}
+
+type batchEmbedResponse struct {
+	Embeddings []struct {
+		Values []float32 `json:"values"`
+	} `json:"embeddings"`
+}
+
+// EmbedTexts calls the batchEmbedContents endpoint of model (e.g. DefaultEmbeddingModel) and returns
+// the embeddings of texts, in batches of up to 100 texts per request, with the same retry logic as GenerateText.
+func (c *Client) EmbedTexts(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	model = strings.TrimPrefix(model, "models/")
+	var embeddings [][]float32
+	for start := 0; start < len(texts); start += embedBatchSize {
+		batch := texts[start:min(start+embedBatchSize, len(texts))]
+		request := &batchEmbedRequest{}
+		for _, text := range batch {
+			request.Requests = append(request.Requests, &embedRequest{
+				Model:   "models/" + model,
+				Content: Content{Parts: []Part{{Text: text}}},
+			})
+		}
+		err := c.call(ctx, model, "batchEmbedContents", request, func(respBody []byte) error {
+			var resp batchEmbedResponse
+			if err := json.Unmarshal(respBody, &resp); err != nil {
+				return fmt.Errorf("failed to unmarshal API response: %w", err)
+			}
+			if len(resp.Embeddings) != len(batch) {
+				return fmt.Errorf("API returned %d embeddings of %d texts", len(resp.Embeddings), len(batch))
+			}
+			for _, embedding := range resp.Embeddings {
+				embeddings = append(embeddings, embedding.Values)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return embeddings, nil
+}
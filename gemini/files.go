@@ -0,0 +1,263 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// Requests with inline data larger than this must upload the media via the Files API instead.
+const MaxInlineSize = 20 << 20
+
+// Interval of polling the state of an uploaded file that is being processed (e.g. a video).
+const fileStatePollInterval = 5 * time.Second
+
+// File states
+const (
+	FILE_STATE_PROCESSING = "PROCESSING"
+	FILE_STATE_ACTIVE     = "ACTIVE"
+	FILE_STATE_FAILED     = "FAILED"
+)
+
+// File is a file uploaded via the Files API. Uploaded files are deleted by the server after 48 hours.
+type File struct {
+	Name     string `json:"name"` // "files/<id>"
+	Uri      string `json:"uri"`
+	MimeType string `json:"mimeType"`
+	State    string `json:"state"` // "PROCESSING", "ACTIVE", "FAILED"
+}
+
+// Part returns a request part referencing the file.
+func (f *File) Part() Part {
+	return Part{FileData: &FileData{MimeType: f.MimeType, FileUri: f.Uri}}
+}
+
+// UploadFile uploads the local file at path via the Files API (resumable upload protocol).
+// The file is streamed from disk, so large media (e.g. videos) are not read into memory.
+// Network errors and 5xx statuses are retried according to the client's retry policy.
+func (c *Client) UploadFile(ctx context.Context, path string, mimeType string) (*File, error) {
+	stat, err := os.Stat(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	metadata, err := json.Marshal(map[string]any{"file": map[string]string{"display_name": filepath.Base(path)}})
+	if err != nil {
+		return nil, err
+	}
+	onRetry := c.OnRetry
+	if onRetry == nil {
+		onRetry = func(attempt int, err error, delay time.Duration) {
+			fmt.Fprintf(c.log(), "  ...upload attempt %d/%d: %v, retrying in %v\n", attempt+1, c.Retry.MaxRetries+1, err, delay)
+		}
+	}
+	redactedOnRetry := func(attempt int, err error, delay time.Duration) {
+		onRetry(attempt, c.Keys.Redact(err), delay)
+	}
+	uploadURL, err := c.uploadURL()
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.RequestTimeout(int(size))
+	var file *File
+	err = util.Retry(ctx, c.Retry, func(ctx context.Context) error {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		key, _, err := c.Keys.Get()
+		if err != nil {
+			return err
+		}
+		// Start a resumable upload session, then send all bytes in one request
+		req, err := newRequest(ctx, http.MethodPost, uploadURL, bytes.NewReader(metadata), key)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Goog-Upload-Protocol", "resumable")
+		req.Header.Set("X-Goog-Upload-Command", "start")
+		req.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.FormatInt(size, 10))
+		req.Header.Set("X-Goog-Upload-Header-Content-Type", mimeType)
+		_, header, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		uploadUrl := header.Get("X-Goog-Upload-Url")
+		if uploadUrl == "" {
+			return fmt.Errorf("upload url not found in API response")
+		}
+
+		f, err := os.Open(util.LongPath(path))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, uploadUrl, f)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		req.Header.Set("X-Goog-Upload-Offset", "0")
+		req.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+		body, _, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			File *File `json:"file"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil || resp.File == nil || resp.File.Uri == "" {
+			return fmt.Errorf("invalid upload API response: %s", body)
+		}
+		file = resp.File
+		return nil
+	}, redactedOnRetry)
+	return file, c.Keys.Redact(err)
+}
+
+// GetFile returns the current metadata of an uploaded file. Errors are not retried.
+func (c *Client) GetFile(ctx context.Context, name string) (*File, error) {
+	key, _, err := c.Keys.Get()
+	if err != nil {
+		return nil, err
+	}
+	base, err := c.apiURL()
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(ctx, http.MethodGet, base+name, nil, key)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{}
+	if err := json.Unmarshal(body, file); err != nil {
+		return nil, fmt.Errorf("invalid file API response: %w", err)
+	}
+	return file, nil
+}
+
+// WaitFileActive waits until an uploaded file has been processed by the server, which is required
+// before using video files in requests. timeout is the max waiting time (0 = unlimited).
+func (c *Client) WaitFileActive(ctx context.Context, file *File, timeout time.Duration) (*File, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	for file.State == FILE_STATE_PROCESSING {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("file %s is still being processed: %w", file.Name, ctx.Err())
+		case <-time.After(fileStatePollInterval):
+		}
+		current, err := c.GetFile(ctx, file.Name)
+		if err != nil {
+			// Polling errors (e.g. a transient network error) are retried in the next loop
+			if errs.Is(err, errs.ExitAuth) || errors.Is(err, ErrNotFound) || ctx.Err() != nil {
+				return nil, err
+			}
+			fmt.Fprintf(c.log(), "  ...failed to get state of file %s: %v\n", file.Name, err)
+			continue
+		}
+		file = current
+	}
+	if file.State == FILE_STATE_FAILED {
+		return nil, fmt.Errorf("server failed to process file %s", file.Name)
+	}
+	return file, nil
+}
+
+// VideoMimeType returns the MIME type of a video file supported by Gemini, or "".
+func VideoMimeType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v":
+		return "video/mp4"
+	case ".mpeg", ".mpg":
+		return "video/mpeg"
+	case ".mov":
+		return "video/mov"
+	case ".avi":
+		return "video/avi"
+	case ".flv":
+		return "video/x-flv"
+	case ".webm":
+		return "video/webm"
+	case ".wmv":
+		return "video/wmv"
+	case ".3gp":
+		return "video/3gpp"
+	default:
+		return ""
+	}
+}
+
+// DeleteFile deletes an uploaded file. Errors are not retried.
+func (c *Client) DeleteFile(ctx context.Context, file *File) error {
+	key, _, err := c.Keys.Get()
+	if err != nil {
+		return err
+	}
+	base, err := c.apiURL()
+	if err != nil {
+		return err
+	}
+	req, err := newRequest(ctx, http.MethodDelete, base+file.Name, nil, key)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(req)
+	return err
+}
+
+// do sends a Files API (or models API) request and classifies the error of a non-2xx response
+// the same way as GenerateText does.
+func (c *Client) do(req *http.Request) (body []byte, header http.Header, err error) {
+	defer func() {
+		err = c.Keys.Redact(err)
+	}()
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, nil, util.Retryable(fmt.Errorf("network error: %w", err))
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, util.Retryable(fmt.Errorf("failed to read API response body: %w", err))
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return body, resp.Header, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		if daily, _ := parseQuotaError(body); daily {
+			return nil, nil, errs.New(errs.ExitQuota, "API quota exhausted with status %d: %s", resp.StatusCode, body)
+		}
+		fallthrough
+	case resp.StatusCode >= 500:
+		return nil, nil, util.Retryable(fmt.Errorf("API returned retryable status %d: %s", resp.StatusCode, body))
+	case isAuthError(resp.StatusCode, body):
+		return nil, nil, errs.New(errs.ExitAuth, "API authentication failed with status %d: %s",
+			resp.StatusCode, body)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotFound, body)
+	default:
+		return nil, nil, fmt.Errorf("API request failed with non-retryable status %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,356 @@
+// Package gemini is a minimal client of the Gemini API generateContent endpoint,
+// shared by all commands that call the API.
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// --- Structs for Gemini API Request ---
+
+type Request struct {
+	Contents         []Content         `json:"contents"`
+	GenerationConfig *GenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type GenerationConfig struct {
+	ResponseMimeType string  `json:"responseMimeType,omitempty"`
+	ResponseSchema   *Schema `json:"responseSchema,omitempty"`
+	// Sampling parameters. nil / 0 = model default. Temperature and TopP are pointers, as 0 is a valid value.
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            int      `json:"topK,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	// Random seed of sampling. nil = random. A pointer, as 0 is a valid value.
+	Seed *int `json:"seed,omitempty"`
+	// The thinking of Gemini 2.5 (and later) models. nil = model default
+	ThinkingConfig *ThinkingConfig `json:"thinkingConfig,omitempty"`
+	// e.g. ["AUDIO"] for speech generation models
+	ResponseModalities []string      `json:"responseModalities,omitempty"`
+	SpeechConfig       *SpeechConfig `json:"speechConfig,omitempty"`
+}
+
+// ThinkingConfig is the thinking config of thinking models.
+type ThinkingConfig struct {
+	// Max number of thinking tokens. 0 = thinking off, -1 = dynamic (decided by the model)
+	ThinkingBudget int `json:"thinkingBudget"`
+}
+
+// SpeechConfig is the voice config of speech generation (TTS) models.
+type SpeechConfig struct {
+	VoiceConfig struct {
+		PrebuiltVoiceConfig struct {
+			VoiceName string `json:"voiceName"`
+		} `json:"prebuiltVoiceConfig"`
+	} `json:"voiceConfig"`
+}
+
+// Schema is the (OpenAPI subset) schema of a structured output response.
+type Schema struct {
+	Type        string             `json:"type"` // "STRING", "ARRAY", "OBJECT", ...
+	Description string             `json:"description,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	MaxItems    int64              `json:"maxItems,omitempty,string"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+}
+
+type Content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []Part `json:"parts"`
+}
+
+type Part struct {
+	Text       string      `json:"text,omitempty"`
+	InlineData *InlineData `json:"inlineData,omitempty"`
+	FileData   *FileData   `json:"fileData,omitempty"`
+}
+
+type InlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // Base64 encoded string
+}
+
+// NewImageData returns the inline data of the decoded img: its JPEG encoding, downscaled so that its longest side
+// is at most maxSide pixels (see util.EncodeImageForUpload).
+func NewImageData(img image.Image, maxSide int, quality int) (*InlineData, error) {
+	data, err := util.EncodeImageForUpload(img, maxSide, quality)
+	if err != nil {
+		return nil, err
+	}
+	return &InlineData{MimeType: "image/jpeg", Data: base64.StdEncoding.EncodeToString(data)}, nil
+}
+
+// FileData references a file uploaded via the Files API.
+type FileData struct {
+	MimeType string `json:"mimeType"`
+	FileUri  string `json:"fileUri"`
+}
+
+// --- Structs for Gemini API Response ---
+
+type Response struct {
+	Candidates     []Candidate     `json:"candidates"`
+	PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
+}
+
+type Candidate struct {
+	Content       Content        `json:"content"`
+	FinishReason  string         `json:"finishReason"`
+	Index         int            `json:"index"`
+	SafetyRatings []SafetyRating `json:"safetyRatings"`
+}
+
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+}
+
+type PromptFeedback struct {
+	BlockReason   string         `json:"blockReason,omitempty"`
+	SafetyRatings []SafetyRating `json:"safetyRatings,omitempty"`
+}
+
+// ErrBlocked is wrapped by the errors of requests or responses blocked by the safety filters of the API.
+var ErrBlocked = errors.New("blocked by safety filters")
+
+// Finish reasons of candidates whose content was blocked by the safety filters
+var blockedFinishReasons = []string{"SAFETY", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY"}
+
+// Text returns the text of the first candidate.
+// It returns an error if the request was blocked (wrapping ErrBlocked) or the response has no text.
+func (r *Response) Text() (string, error) {
+	if r.PromptFeedback != nil && r.PromptFeedback.BlockReason != "" {
+		return "", fmt.Errorf("request was %w: %s", ErrBlocked, r.PromptFeedback.BlockReason)
+	}
+	if len(r.Candidates) == 0 {
+		return "", fmt.Errorf("no candidate in API response")
+	}
+	var sb strings.Builder
+	for _, part := range r.Candidates[0].Content.Parts {
+		sb.WriteString(part.Text)
+	}
+	if reason := r.Candidates[0].FinishReason; sb.Len() == 0 && slices.Contains(blockedFinishReasons, reason) {
+		return "", fmt.Errorf("response was %w: %s", ErrBlocked, reason)
+	}
+	return sb.String(), nil
+}
+
+// Client calls the Gemini API with unified retry logic.
+type Client struct {
+	HTTPClient *http.Client
+	Keys       *KeyPool
+	Retry      util.RetryPolicy
+	// Base url of the API (e.g. of a proxy), see ResolveAPIURL. "" = GEMINI_API_URL env or the official API
+	APIURL string
+	// Timeout of a single request is Timeout + TimeoutPerMB * (payload size in MB),
+	// so that large files on slow connections don't fail falsely. 0 = no timeout.
+	Timeout      time.Duration
+	TimeoutPerMB time.Duration
+	// Optional. Called before each retry. If nil, a message is printed to Log.
+	OnRetry func(attempt int, err error, delay time.Duration)
+	// Optional. Where status messages (retries, key rotation) are printed. Default: stdout.
+	Log io.Writer
+}
+
+func (c *Client) log() io.Writer {
+	if c.Log == nil {
+		return os.Stdout
+	}
+	return c.Log
+}
+
+// isAuthError reports whether the API error response indicates an invalid API key or missing permission.
+func isAuthError(statusCode int, body []byte) bool {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return true
+	}
+	return statusCode == http.StatusBadRequest &&
+		(bytes.Contains(body, []byte("API_KEY_INVALID")) || bytes.Contains(body, []byte("API key not valid")))
+}
+
+// newRequest returns an API request authenticated with key. The key is sent in the x-goog-api-key header
+// rather than the "key" query parameter, which would leak into logs and error messages that include the url.
+func newRequest(ctx context.Context, method string, url string, body io.Reader, key string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-goog-api-key", key)
+	return req, nil
+}
+
+// RequestTimeout returns the timeout of a single request with a payload of size bytes.
+func (c *Client) RequestTimeout(size int) time.Duration {
+	if c.Timeout <= 0 {
+		return 0
+	}
+	return c.Timeout + time.Duration(float64(c.TimeoutPerMB)*float64(size)/(1<<20))
+}
+
+// GenerateText calls the generateContent endpoint of model and returns the trimmed text of the response.
+// Network errors, 429 / 5xx statuses and empty responses are retried according to the client's retry policy.
+// Errors of invalid API key and exhausted daily quota (429 with a per-day quota violation) are classified as
+// errs.ExitAuth and errs.ExitQuota, which callers should treat as fatal to the whole run.
+// Rate limit 429s that persist after all retries are plain errors of the request.
+func (c *Client) GenerateText(ctx context.Context, model string, request *Request) (string, error) {
+	var text string
+	err := c.generate(ctx, model, request, func(apiResp *Response) error {
+		var err error
+		text, err = apiResp.Text()
+		if err != nil {
+			return err
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return util.Retryable(fmt.Errorf("API returned empty response"))
+		}
+		return nil
+	})
+	return text, err
+}
+
+// GenerateData calls the generateContent endpoint of model and returns the first inline data
+// (e.g. the audio of a speech generation model) of the response, with the same retry logic as GenerateText.
+func (c *Client) GenerateData(ctx context.Context, model string, request *Request) (*InlineData, error) {
+	var data *InlineData
+	err := c.generate(ctx, model, request, func(apiResp *Response) error {
+		if _, err := apiResp.Text(); err != nil {
+			return err
+		}
+		for _, part := range apiResp.Candidates[0].Content.Parts {
+			if part.InlineData != nil && part.InlineData.Data != "" {
+				data = part.InlineData
+				return nil
+			}
+		}
+		return util.Retryable(fmt.Errorf("API returned no data"))
+	})
+	return data, err
+}
+
+// generate sends request to the generateContent endpoint of model (with retries),
+// and calls extract with the parsed response of a successful request. extract may return a retryable error.
+func (c *Client) generate(ctx context.Context, model string, request *Request,
+	extract func(apiResp *Response) error) error {
+	return c.call(ctx, model, "generateContent", request, func(respBody []byte) error {
+		var apiResp Response
+		if err := json.Unmarshal(respBody, &apiResp); err != nil {
+			return fmt.Errorf("failed to unmarshal API response: %w", err)
+		}
+		return extract(&apiResp)
+	})
+}
+
+// call sends request to the method endpoint (e.g. "generateContent") of model (with retries),
+// and calls extract with the body of a successful response. extract may return a retryable error.
+func (c *Client) call(ctx context.Context, model string, method string, request any,
+	extract func(respBody []byte) error) error {
+	jsonPayload, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON payload: %w", err)
+	}
+	modelsURL, err := c.modelsURL()
+	if err != nil {
+		return err
+	}
+
+	onRetry := c.OnRetry
+	if onRetry == nil {
+		onRetry = func(attempt int, err error, delay time.Duration) {
+			fmt.Fprintf(c.log(), "  ...attempt %d/%d: %v, retrying in %v\n", attempt+1, c.Retry.MaxRetries+1, err, delay)
+		}
+	}
+	redactedOnRetry := func(attempt int, err error, delay time.Duration) {
+		onRetry(attempt, c.Keys.Redact(err), delay)
+	}
+
+	timeout := c.RequestTimeout(len(jsonPayload))
+	err = util.Retry(ctx, c.Retry, func(ctx context.Context) error {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		var resp *http.Response
+		var respBody []byte
+		// Fail over to the next key immediately if the key hits its quota, while other keys are available
+		for {
+			key, keyIndex, err := c.Keys.Get()
+			if err != nil {
+				return err
+			}
+			apiUrl := modelsURL + model + ":" + method
+			// Create a new request for each attempt because the body buffer must be fresh
+			req, err := newRequest(ctx, http.MethodPost, apiUrl, bytes.NewReader(jsonPayload), key)
+			if err != nil {
+				return fmt.Errorf("failed to create request: %w", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err = c.send(req)
+			if err != nil {
+				if ctx.Err() == context.DeadlineExceeded {
+					err = fmt.Errorf("request timeout (%v): %w", timeout, err)
+				}
+				return util.Retryable(fmt.Errorf("network error: %w", err))
+			}
+			respBody, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return util.Retryable(fmt.Errorf("failed to read API response body: %w", err))
+			}
+			if resp.StatusCode != http.StatusTooManyRequests || c.Keys.Len() == 1 {
+				break
+			}
+			daily := c.Keys.ReportQuota(key, respBody)
+			if !c.Keys.Available() {
+				break
+			}
+			if daily {
+				fmt.Fprintf(c.log(), "  ...API key #%d exhausted its daily quota, switching to the next key\n", keyIndex)
+			} else {
+				fmt.Fprintf(c.log(), "  ...API key #%d is rate limited, switching to the next key\n", keyIndex)
+			}
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+		case resp.StatusCode == http.StatusTooManyRequests:
+			// All keys are exhausted or cooling down
+			if _, _, err := c.Keys.Get(); err != nil {
+				return fmt.Errorf("%w: %s", err, respBody)
+			}
+			// Only an exhausted daily (project) quota of the only key is fatal (the exhausted keys of a pool are
+			// skipped above); a rate limit (e.g. requests per minute) fails only this request after the retries
+			if daily, _ := parseQuotaError(respBody); daily && c.Keys.Len() == 1 {
+				return errs.New(errs.ExitQuota, "API quota exhausted with status %d: %s", resp.StatusCode, respBody)
+			}
+			return util.Retryable(fmt.Errorf("API returned retryable status %d: %s", resp.StatusCode, respBody))
+		case resp.StatusCode >= 500:
+			return util.Retryable(fmt.Errorf("API returned retryable status %d: %s", resp.StatusCode, respBody))
+		case isAuthError(resp.StatusCode, respBody):
+			return errs.New(errs.ExitAuth, "API authentication failed with status %d: %s", resp.StatusCode, respBody)
+		default:
+			return fmt.Errorf("API request failed with non-retryable status %d: %s", resp.StatusCode, respBody)
+		}
+
+		return extract(respBody)
+	}, redactedOnRetry)
+	return c.Keys.Redact(err)
+}
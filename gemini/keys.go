@@ -0,0 +1,215 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// Cooldown of a key which hit a per-minute rate limit, if the API doesn't tell the retry delay.
+const defaultKeyCooldown = 60 * time.Second
+
+// KeyPool rotates requests among multiple API keys (round-robin),
+// failing over to the next key when one hits its quota.
+type KeyPool struct {
+	mu   sync.Mutex
+	keys []*apiKey
+	next int
+}
+
+type apiKey struct {
+	value     string
+	exhausted bool      // hit a daily quota, unusable for the rest of the run
+	coolUntil time.Time // hit a per-minute rate limit
+}
+
+// NewKeyPool returns a pool of keys. Empty and duplicate keys are ignored.
+func NewKeyPool(keys ...string) *KeyPool {
+	pool := &KeyPool{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		pool.keys = append(pool.keys, &apiKey{value: key})
+	}
+	return pool
+}
+
+// LoadKeys returns a pool of the API keys from keysFile (if not empty), the GEMINI_API_KEYS_FILE,
+// GEMINI_API_KEYS (comma-separated) and GEMINI_API_KEY envs. It returns a config error if there is no key.
+func LoadKeys(keysFile string) (*KeyPool, error) {
+	var keys []string
+	if keysFile == "" {
+		keysFile = os.Getenv(constants.ENV_GEMINI_API_KEYS_FILE)
+	}
+	if keysFile != "" {
+		fileKeys, err := util.ReadListFile(keysFile)
+		if err != nil {
+			return nil, errs.New(errs.ExitConfig, "failed to read API keys file: %w", err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	keys = append(keys, strings.Split(os.Getenv(constants.ENV_GEMINI_API_KEYS), ",")...)
+	keys = append(keys, os.Getenv(constants.ENV_GEMINI_API_KEY))
+	pool := NewKeyPool(keys...)
+	if pool.Len() == 0 {
+		return nil, errs.New(errs.ExitConfig, "%s environment variable not set", constants.ENV_GEMINI_API_KEY)
+	}
+	return pool, nil
+}
+
+// Len returns the number of keys in the pool.
+func (p *KeyPool) Len() int {
+	return len(p.keys)
+}
+
+// Get returns the next usable key (round-robin) and its 1-based index for display.
+// Keys cooling down from a rate limit are skipped, unless all usable keys are cooling.
+// It returns a quota error if all keys have exhausted their quota.
+func (p *KeyPool) Get() (string, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	fallback := -1
+	for i := range p.keys {
+		index := (p.next + i) % len(p.keys)
+		key := p.keys[index]
+		if key.exhausted {
+			continue
+		}
+		if now.Before(key.coolUntil) {
+			if fallback == -1 || key.coolUntil.Before(p.keys[fallback].coolUntil) {
+				fallback = index
+			}
+			continue
+		}
+		p.next = index + 1
+		return key.value, index + 1, nil
+	}
+	if fallback >= 0 {
+		p.next = fallback + 1
+		return p.keys[fallback].value, fallback + 1, nil
+	}
+	return "", 0, errs.New(errs.ExitQuota, "all %d API keys have exhausted their quota", len(p.keys))
+}
+
+// Available reports whether there is a key that is neither exhausted nor cooling down.
+func (p *KeyPool) Available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, key := range p.keys {
+		if !key.exhausted && !now.Before(key.coolUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportQuota records that key got a 429 response with body.
+// A daily quota failure makes the key unusable for the rest of the run,
+// otherwise (per-minute rate limit) the key cools down for the retry delay told by the API.
+// It returns whether the failure was a daily quota.
+func (p *KeyPool) ReportQuota(key string, body []byte) (daily bool) {
+	daily, retryDelay := parseQuotaError(body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		if k.value != key {
+			continue
+		}
+		if daily {
+			k.exhausted = true
+		} else {
+			k.coolUntil = time.Now().Add(retryDelay)
+		}
+	}
+	return daily
+}
+
+// parseQuotaError parses a 429 RESOURCE_EXHAUSTED error response, returning whether it's a daily quota
+// failure (QuotaFailure violation with a "PerDay" quota id) and the retry delay (RetryInfo).
+func parseQuotaError(body []byte) (daily bool, retryDelay time.Duration) {
+	var resp struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+				Violations []struct {
+					QuotaId string `json:"quotaId"`
+				} `json:"violations"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	retryDelay = defaultKeyCooldown
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false, retryDelay
+	}
+	for _, detail := range resp.Error.Details {
+		for _, violation := range detail.Violations {
+			if strings.Contains(violation.QuotaId, "PerDay") {
+				daily = true
+			}
+		}
+		if detail.RetryDelay != "" {
+			if d, err := time.ParseDuration(detail.RetryDelay); err == nil {
+				retryDelay = d
+			}
+		}
+	}
+	return daily, retryDelay
+}
+
+// Redact returns err with the keys of the pool in its message replaced by "<redacted>", so that printed errors
+// (e.g. of a proxy echoing the request) never reveal a key. The returned error wraps err.
+func (p *KeyPool) Redact(err error) error {
+	if p == nil || err == nil {
+		return err
+	}
+	msg := err.Error()
+	redacted := p.redact(msg)
+	if redacted == msg {
+		return err
+	}
+	return &redactedError{msg: redacted, err: err}
+}
+
+// redact returns s with the keys of the pool replaced by "<redacted>".
+func (p *KeyPool) redact(s string) string {
+	if p == nil {
+		return s
+	}
+	for _, key := range p.keys {
+		s = strings.ReplaceAll(s, key.value, "<redacted>")
+	}
+	return s
+}
+
+// redactedError is an error whose message has the API keys redacted.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// String returns a description of the pool for display, without revealing the keys.
+func (p *KeyPool) String() string {
+	return fmt.Sprintf("%d API key(s)", len(p.keys))
+}
@@ -0,0 +1,100 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ErrNotFound is wrapped by the errors of API requests of a non-existent resource (404).
+var ErrNotFound = errors.New("not found")
+
+// Model is the info of a model returned by the models endpoint.
+type Model struct {
+	Name                       string   `json:"name"` // "models/<id>"
+	DisplayName                string   `json:"displayName"`
+	Description                string   `json:"description"`
+	InputTokenLimit            int64    `json:"inputTokenLimit"`
+	OutputTokenLimit           int64    `json:"outputTokenLimit"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+// ID returns the model ID used in API requests and the --model flag, e.g. "gemini-2.5-flash".
+func (m *Model) ID() string {
+	return strings.TrimPrefix(m.Name, "models/")
+}
+
+// CanGenerateContent reports whether the model supports the generateContent method.
+func (m *Model) CanGenerateContent() bool {
+	return slices.Contains(m.SupportedGenerationMethods, "generateContent")
+}
+
+// ListModels returns all models available to the API key. Errors are not retried.
+func (c *Client) ListModels(ctx context.Context) ([]*Model, error) {
+	key, _, err := c.Keys.Get()
+	if err != nil {
+		return nil, err
+	}
+	modelsURL, err := c.modelsURL()
+	if err != nil {
+		return nil, err
+	}
+	var models []*Model
+	pageToken := ""
+	for {
+		query := url.Values{"pageSize": {"1000"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		req, err := newRequest(ctx, http.MethodGet, strings.TrimSuffix(modelsURL, "/")+"?"+query.Encode(), nil, key)
+		if err != nil {
+			return nil, err
+		}
+		body, _, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Models        []*Model `json:"models"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal API response: %w", err)
+		}
+		models = append(models, resp.Models...)
+		if resp.NextPageToken == "" {
+			return models, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// GetModel returns the info of model. The error wraps ErrNotFound if the model does not exist.
+func (c *Client) GetModel(ctx context.Context, model string) (*Model, error) {
+	key, _, err := c.Keys.Get()
+	if err != nil {
+		return nil, err
+	}
+	modelsURL, err := c.modelsURL()
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(ctx, http.MethodGet, modelsURL+url.PathEscape(model), nil, key)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var m Model
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API response: %w", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,114 @@
+package gemini
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+// Sampling holds the generation parameters set by the --temperature, --top-p, --top-k,
+// --max-output-tokens, --seed and --thinking-budget flags. Parameters whose flags are not set are left to the model defaults.
+// A Sampling without flags (as used by library callers) sets the non-zero parameters.
+// A nil *Sampling sets none.
+type Sampling struct {
+	Temperature     float64
+	TopP            float64
+	TopK            int
+	MaxOutputTokens int
+	Seed            int
+	ThinkingBudget  int
+
+	flags *pflag.FlagSet
+}
+
+// AddFlags registers the sampling flags to flags.
+func (s *Sampling) AddFlags(flags *pflag.FlagSet) {
+	s.flags = flags
+	flags.Float64Var(&s.Temperature, "temperature", 0,
+		"Sampling temperature (0.0-2.0). Lower is more deterministic. default: model default")
+	flags.Float64Var(&s.TopP, "top-p", 0, "Nucleus sampling probability mass (0.0-1.0). default: model default")
+	flags.IntVar(&s.TopK, "top-k", 0, "Sample from the k most probable tokens. default: model default")
+	flags.IntVar(&s.MaxOutputTokens, "max-output-tokens", 0, "Max number of tokens of a response. default: model default")
+	flags.IntVar(&s.Seed, "seed", 0, "Random seed of sampling, for reproducible outputs of the same inputs and parameters "+
+		"(best effort, depends on the model). default: random")
+	flags.IntVar(&s.ThinkingBudget, "thinking-budget", 0, "Max number of thinking tokens of thinking models (Gemini 2.5). "+
+		"0 = thinking off (cheaper and faster, not supported by 2.5 pro), -1 = dynamic. default: model default")
+}
+
+func (s *Sampling) changed(name string) bool {
+	if s == nil {
+		return false
+	}
+	if s.flags == nil {
+		switch name {
+		case "temperature":
+			return s.Temperature != 0
+		case "top-p":
+			return s.TopP != 0
+		case "top-k":
+			return s.TopK != 0
+		case "max-output-tokens":
+			return s.MaxOutputTokens != 0
+		case "seed":
+			return s.Seed != 0
+		case "thinking-budget":
+			return s.ThinkingBudget != 0
+		}
+		return false
+	}
+	return s.flags.Changed(name)
+}
+
+// Init validates the flag values.
+func (s *Sampling) Init() error {
+	if s.changed("temperature") && (s.Temperature < 0 || s.Temperature > 2) {
+		return fmt.Errorf("invalid --temperature %v: must be in 0.0-2.0", s.Temperature)
+	}
+	if s.changed("top-p") && (s.TopP < 0 || s.TopP > 1) {
+		return fmt.Errorf("invalid --top-p %v: must be in 0.0-1.0", s.TopP)
+	}
+	if s.changed("top-k") && s.TopK <= 0 {
+		return fmt.Errorf("invalid --top-k %d: must be positive", s.TopK)
+	}
+	if s.changed("max-output-tokens") && s.MaxOutputTokens <= 0 {
+		return fmt.Errorf("invalid --max-output-tokens %d: must be positive", s.MaxOutputTokens)
+	}
+	if s.changed("thinking-budget") && s.ThinkingBudget < -1 {
+		return fmt.Errorf("invalid --thinking-budget %d: must be -1 (dynamic), 0 (off) or positive", s.ThinkingBudget)
+	}
+	return nil
+}
+
+// Apply sets the parameters of the set flags to config and returns it.
+// If config is nil and any flag is set, a new config is returned.
+func (s *Sampling) Apply(config *GenerationConfig) *GenerationConfig {
+	if !s.changed("temperature") && !s.changed("top-p") && !s.changed("top-k") && !s.changed("max-output-tokens") &&
+		!s.changed("seed") && !s.changed("thinking-budget") {
+		return config
+	}
+	if config == nil {
+		config = &GenerationConfig{}
+	} else {
+		c := *config
+		config = &c
+	}
+	if s.changed("temperature") {
+		config.Temperature = &s.Temperature
+	}
+	if s.changed("top-p") {
+		config.TopP = &s.TopP
+	}
+	if s.changed("top-k") {
+		config.TopK = s.TopK
+	}
+	if s.changed("max-output-tokens") {
+		config.MaxOutputTokens = s.MaxOutputTokens
+	}
+	if s.changed("seed") {
+		config.Seed = &s.Seed
+	}
+	if s.changed("thinking-budget") {
+		config.ThinkingConfig = &ThinkingConfig{ThinkingBudget: s.ThinkingBudget}
+	}
+	return config
+}
@@ -0,0 +1,75 @@
+package gemini
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+)
+
+// ResolveAPIURL returns the normalized Gemini API base url: apiURL (e.g. of the --api-url flag) if not empty,
+// or else the GEMINI_API_URL env if set, or else the official API.
+func ResolveAPIURL(apiURL string) (string, error) {
+	if apiURL == "" {
+		apiURL = os.Getenv(constants.ENV_GEMINI_API_URL)
+	}
+	if apiURL == "" {
+		return constants.GEMINI_API_URL, nil
+	}
+	return NormalizeAPIURL(apiURL)
+}
+
+// NormalizeAPIURL validates the base url of the Gemini API (or of a proxy / gateway of it) and returns it as
+// the url of the API version with a trailing slash, e.g. "https://proxy.example.com/v1beta/".
+// The path defaults to "/v1beta", and a trailing "/models" is removed.
+func NormalizeAPIURL(apiURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(apiURL))
+	if err != nil {
+		return "", fmt.Errorf("invalid Gemini API url %q: %w", apiURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid Gemini API url %q: must be an http(s) url", apiURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid Gemini API url %q: must not have a query, fragment or user info", apiURL)
+	}
+	path := strings.TrimSuffix(strings.TrimRight(u.Path, "/"), "/models")
+	if path == "" {
+		path = "/v1beta"
+	}
+	u.Path, u.RawPath = path+"/", ""
+	return u.String(), nil
+}
+
+// apiURL returns the normalized base url of the API of the client.
+func (c *Client) apiURL() (string, error) {
+	base, err := ResolveAPIURL(c.APIURL)
+	if err != nil {
+		return "", errs.Wrap(errs.ExitConfig, err)
+	}
+	return base, nil
+}
+
+// modelsURL returns the url of the models endpoint of the API of the client, with a trailing slash.
+func (c *Client) modelsURL() (string, error) {
+	base, err := c.apiURL()
+	if err != nil {
+		return "", err
+	}
+	return base + "models/", nil
+}
+
+// uploadURL returns the url of the Files API upload endpoint of the API of the client,
+// which is the files endpoint under the "/upload" path prefix.
+func (c *Client) uploadURL() (string, error) {
+	base, err := c.apiURL()
+	if err != nil {
+		return "", err
+	}
+	u, _ := url.Parse(base)
+	u.Path = "/upload" + u.Path + "files"
+	return u.String(), nil
+}
@@ -6,10 +6,17 @@ toolchain go1.24.10
 
 require (
 	github.com/disintegration/imaging v1.6.2
+	github.com/klauspost/compress v1.19.2
 	github.com/muesli/smartcrop v0.3.0
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	github.com/ryszard/tfutils v0.0.0-20161028141955-98de232c7c68
 	github.com/spf13/cobra v1.10.1
+	github.com/spf13/pflag v1.0.9
 	github.com/xxr3376/gtboard v0.0.2
+	github.com/yalue/onnxruntime_go v1.36.0
+	golang.org/x/image v0.32.0
+	google.golang.org/protobuf v1.36.10
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -17,8 +24,4 @@ require (
 	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	github.com/ryszard/tfutils v0.0.0-20161028141955-98de232c7c68 // indirect
-	github.com/spf13/pflag v1.0.9 // indirect
-	golang.org/x/image v0.32.0 // indirect
-	google.golang.org/protobuf v1.36.10 // indirect
 )
@@ -0,0 +1,527 @@
+// Package hfhub is a minimal client of the HuggingFace Hub API to upload files to dataset repos:
+// the files are committed by the commit API, with large / binary files uploaded to the LFS storage first
+// (in parts if the server requests a multipart upload). LFS objects that are already stored are not
+// uploaded again, so an interrupted upload can be resumed by uploading the same files again.
+package hfhub
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// Upload modes of files, by the preupload API
+const (
+	ModeRegular = "regular" // committed inline
+	ModeLFS     = "lfs"     // uploaded to the LFS storage, committed as a pointer
+	ModeIgnore  = "ignore"  // ignored by the .gitignore of the repo
+)
+
+const (
+	// Max files of a preupload request
+	preuploadBatchSize = 256
+	// Size of the sample of a file sent to the preupload API
+	preuploadSampleSize = 512
+	lfsContentType      = "application/vnd.git-lfs+json"
+)
+
+// ErrNotFound is returned (wrapped) if the repo or revision does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Client is a client of the HuggingFace Hub API.
+type Client struct {
+	HTTPClient *http.Client
+	// The Hub endpoint. "" = HF_ENDPOINT env or the default
+	Endpoint string
+	Token    string
+	Retry    util.RetryPolicy
+	// Optional. Where status messages (retries...) are printed. nil = stdout
+	Log io.Writer
+}
+
+// File is a local file to upload.
+type File struct {
+	Path      string // path in the repo, with "/" separators
+	LocalPath string
+	Size      int64
+	Sha256    string // hex encoded
+}
+
+// RepoFile is a file of a repo.
+type RepoFile struct {
+	Type string `json:"type"` // "file" or "directory"
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Oid  string `json:"oid"` // the git blob SHA-1
+	// The LFS object of the file, nil if the file is not stored in LFS
+	LFS *struct {
+		Oid  string `json:"oid"` // SHA-256
+		Size int64  `json:"size"`
+	} `json:"lfs"`
+}
+
+// LoadToken returns the access token of the HF_TOKEN env. It returns a config error if it's not set.
+func LoadToken() (string, error) {
+	token := strings.TrimSpace(os.Getenv(constants.ENV_HF_TOKEN))
+	if token == "" {
+		return "", errs.New(errs.ExitConfig, "%s environment variable not set", constants.ENV_HF_TOKEN)
+	}
+	return token, nil
+}
+
+func (c *Client) log() io.Writer {
+	if c.Log == nil {
+		return os.Stdout
+	}
+	return c.Log
+}
+
+// EndpointURL returns the url of the Hub: Endpoint, or of the HF_ENDPOINT env, or the default one.
+func (c *Client) EndpointURL() string {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv(constants.ENV_HF_ENDPOINT)
+	}
+	if endpoint == "" {
+		endpoint = constants.HF_ENDPOINT
+	}
+	return strings.TrimRight(endpoint, "/")
+}
+
+// datasetURL returns the API url of the method (e.g. "commit") of the dataset repo at revision.
+func (c *Client) datasetURL(repoID string, method string, revision string) string {
+	return c.EndpointURL() + "/api/datasets/" + repoID + "/" + method + "/" + url.PathEscape(revision)
+}
+
+// request is an HTTP request of the client.
+type request struct {
+	method string
+	url    string
+	header map[string]string
+	// Returns the body of each attempt. nil = no body
+	body func() io.Reader
+	// The length of the body, -1 = unknown (chunked). Only used with body
+	size int64
+	// Send the token as a bearer token
+	auth bool
+}
+
+// do sends the request (with retries) and returns the body and headers of a 2xx response.
+// 401 / 403 responses are auth errors, 404 ones ErrNotFound; 429 and 5xx responses and network errors are retried.
+func (c *Client) do(ctx context.Context, r *request) ([]byte, http.Header, error) {
+	var respBody []byte
+	var respHeader http.Header
+	err := util.Retry(ctx, c.Retry, func(ctx context.Context) error {
+		var body io.Reader
+		if r.body != nil {
+			body = r.body()
+		}
+		req, err := http.NewRequestWithContext(ctx, r.method, r.url, body)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		if r.body != nil {
+			req.ContentLength = r.size
+		}
+		for key, value := range r.header {
+			req.Header.Set(key, value)
+		}
+		if r.auth {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return util.Retryable(fmt.Errorf("network error: %w", err))
+		}
+		defer resp.Body.Close()
+		respBody, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return util.Retryable(fmt.Errorf("failed to read response body: %w", err))
+		}
+		respHeader = resp.Header
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return util.Retryable(fmt.Errorf("%s %s returned retryable status %d: %s", r.method, redactURL(r.url),
+				resp.StatusCode, respBody))
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return errs.New(errs.ExitAuth, "%s %s returned status %d (check the %s token and its write permission): %s",
+				r.method, redactURL(r.url), resp.StatusCode, constants.ENV_HF_TOKEN, respBody)
+		case resp.StatusCode == http.StatusNotFound:
+			return fmt.Errorf("%w: %s %s: %s", ErrNotFound, r.method, redactURL(r.url), respBody)
+		}
+		return &statusError{code: resp.StatusCode, err: fmt.Errorf("%s %s returned status %d: %s", r.method,
+			redactURL(r.url), resp.StatusCode, respBody)}
+	}, func(attempt int, err error, delay time.Duration) {
+		fmt.Fprintf(c.log(), "  ...attempt %d/%d: %v, retrying in %v\n", attempt+1, c.Retry.MaxRetries+1, err, delay)
+	})
+	return respBody, respHeader, err
+}
+
+// statusError is the error of a non-retryable error status of a response.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+// redactURL removes the query of url, which contains the signature of presigned storage urls.
+func redactURL(u string) string {
+	u, _, _ = strings.Cut(u, "?")
+	return u
+}
+
+// jsonRequest returns a request with the JSON body of payload.
+func jsonRequest(method string, apiURL string, payload any, contentType string) (*request, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &request{
+		method: method,
+		url:    apiURL,
+		header: map[string]string{"Content-Type": contentType, "Accept": contentType},
+		body:   func() io.Reader { return bytes.NewReader(data) },
+		size:   int64(len(data)),
+		auth:   true,
+	}, nil
+}
+
+// CreateRepo creates the dataset repo repoID ("<user or organization>/<name>"). An existing repo is not an error.
+func (c *Client) CreateRepo(ctx context.Context, repoID string, private bool) error {
+	organization, name, ok := strings.Cut(repoID, "/")
+	if !ok {
+		return errs.New(errs.ExitConfig, "invalid repo %q, must be in \"<user or organization>/<name>\" format", repoID)
+	}
+	r, err := jsonRequest(http.MethodPost, c.EndpointURL()+"/api/repos/create", map[string]any{
+		"type":         "dataset",
+		"name":         name,
+		"organization": organization,
+		"private":      private,
+	}, "application/json")
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, r)
+	if se := (*statusError)(nil); errors.As(err, &se) && se.code == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ListFiles returns all files of the dataset repo at revision.
+func (c *Client) ListFiles(ctx context.Context, repoID string, revision string) ([]*RepoFile, error) {
+	var files []*RepoFile
+	next := c.datasetURL(repoID, "tree", revision) + "?recursive=true&expand=false"
+	for next != "" {
+		body, header, err := c.do(ctx, &request{method: http.MethodGet, url: next, auth: true})
+		if err != nil {
+			return nil, err
+		}
+		var page []*RepoFile
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("invalid tree response: %w", err)
+		}
+		for _, file := range page {
+			if file.Type == "file" {
+				files = append(files, file)
+			}
+		}
+		next = ""
+		if m := linkNextRegexp.FindStringSubmatch(header.Get("Link")); m != nil {
+			next = m[1]
+		}
+	}
+	return files, nil
+}
+
+// Preupload returns the upload mode (ModeRegular, ModeLFS or ModeIgnore) of the files by their paths,
+// as decided by the Hub from their sizes and first bytes.
+func (c *Client) Preupload(ctx context.Context, repoID string, revision string, files []*File) (map[string]string, error) {
+	modes := map[string]string{}
+	for start := 0; start < len(files); start += preuploadBatchSize {
+		var items []map[string]any
+		for _, file := range files[start:min(start+preuploadBatchSize, len(files))] {
+			sample, err := readSample(file.LocalPath)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, map[string]any{
+				"path":   file.Path,
+				"sample": base64.StdEncoding.EncodeToString(sample),
+				"size":   file.Size,
+			})
+		}
+		r, err := jsonRequest(http.MethodPost, c.datasetURL(repoID, "preupload", revision),
+			map[string]any{"files": items}, "application/json")
+		if err != nil {
+			return nil, err
+		}
+		body, _, err := c.do(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Files []struct {
+				Path         string `json:"path"`
+				UploadMode   string `json:"uploadMode"`
+				ShouldIgnore bool   `json:"shouldIgnore"`
+			} `json:"files"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("invalid preupload response: %w", err)
+		}
+		for _, file := range resp.Files {
+			modes[file.Path] = file.UploadMode
+			if file.ShouldIgnore {
+				modes[file.Path] = ModeIgnore
+			}
+		}
+	}
+	return modes, nil
+}
+
+func readSample(path string) ([]byte, error) {
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sample := make([]byte, preuploadSampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return sample[:n], nil
+}
+
+// lfsAction is an action of an LFS batch response object.
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+// UploadLFS uploads the file to the LFS storage of the dataset repo, in parts if the server requests it.
+// It returns false if the LFS object is already stored, e.g. uploaded by an interrupted earlier run.
+func (c *Client) UploadLFS(ctx context.Context, repoID string, revision string, file *File) (bool, error) {
+	r, err := jsonRequest(http.MethodPost, c.EndpointURL()+"/datasets/"+repoID+".git/info/lfs/objects/batch",
+		map[string]any{
+			"operation": "upload",
+			"transfers": []string{"basic", "multipart"},
+			"objects":   []map[string]any{{"oid": file.Sha256, "size": file.Size}},
+			"hash_algo": "sha256",
+			"ref":       map[string]string{"name": revision},
+		}, lfsContentType)
+	if err != nil {
+		return false, err
+	}
+	body, _, err := c.do(ctx, r)
+	if err != nil {
+		return false, err
+	}
+	var resp struct {
+		Objects []struct {
+			Actions map[string]*lfsAction `json:"actions"`
+			Error   *struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false, fmt.Errorf("invalid LFS batch response: %w", err)
+	}
+	if len(resp.Objects) != 1 {
+		return false, fmt.Errorf("invalid LFS batch response: %d objects", len(resp.Objects))
+	}
+	object := resp.Objects[0]
+	if object.Error != nil {
+		return false, fmt.Errorf("LFS error %d: %s", object.Error.Code, object.Error.Message)
+	}
+	upload := object.Actions["upload"]
+	if upload == nil {
+		return false, nil
+	}
+	if chunkSize, ok := upload.Header["chunk_size"]; ok {
+		err = c.uploadMultipart(ctx, file, upload, chunkSize)
+	} else {
+		_, _, err = c.do(ctx, &request{
+			method: http.MethodPut,
+			url:    upload.Href,
+			header: upload.Header,
+			body:   func() io.Reader { return openSection(file.LocalPath, 0, file.Size) },
+			size:   file.Size,
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	if verify := object.Actions["verify"]; verify != nil {
+		r, err := jsonRequest(http.MethodPost, verify.Href, map[string]any{"oid": file.Sha256, "size": file.Size},
+			lfsContentType)
+		if err != nil {
+			return false, err
+		}
+		for key, value := range verify.Header {
+			r.header[key] = value
+		}
+		if _, _, err := c.do(ctx, r); err != nil {
+			return false, fmt.Errorf("failed to verify the upload: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// uploadMultipart uploads the file in parts of chunkSize to the presigned urls of the upload action,
+// whose header keys are the 1-based part numbers, then completes the upload.
+func (c *Client) uploadMultipart(ctx context.Context, file *File, upload *lfsAction, chunkSize string) error {
+	size, err := strconv.ParseInt(chunkSize, 10, 64)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid chunk size %q", chunkSize)
+	}
+	var partNumbers []int
+	for key := range upload.Header {
+		if n, err := strconv.Atoi(key); err == nil {
+			partNumbers = append(partNumbers, n)
+		}
+	}
+	slices.Sort(partNumbers)
+	type part struct {
+		PartNumber int    `json:"partNumber"`
+		Etag       string `json:"etag"`
+	}
+	var parts []*part
+	for i, n := range partNumbers {
+		offset := int64(n-1) * size
+		length := min(size, file.Size-offset)
+		if length <= 0 {
+			return fmt.Errorf("invalid part %d of %d bytes", n, file.Size)
+		}
+		_, header, err := c.do(ctx, &request{
+			method: http.MethodPut,
+			url:    upload.Header[strconv.Itoa(n)],
+			body:   func() io.Reader { return openSection(file.LocalPath, offset, length) },
+			size:   length,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d/%d: %w", i+1, len(partNumbers), err)
+		}
+		parts = append(parts, &part{PartNumber: n, Etag: header.Get("ETag")})
+		if len(partNumbers) > 1 {
+			fmt.Fprintf(c.log(), "  ...%s: uploaded part %d/%d\n", file.Path, i+1, len(partNumbers))
+		}
+	}
+	r, err := jsonRequest(http.MethodPost, upload.Href, map[string]any{"oid": file.Sha256, "parts": parts},
+		lfsContentType)
+	if err != nil {
+		return err
+	}
+	r.auth = false
+	if _, _, err := c.do(ctx, r); err != nil {
+		return fmt.Errorf("failed to complete the multipart upload: %w", err)
+	}
+	return nil
+}
+
+// openSection returns a reader of length bytes of the file at path from offset.
+// A failure to open the file is returned by the reads.
+func openSection(path string, offset int64, length int64) io.Reader {
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return &errReader{err}
+	}
+	return &sectionReadCloser{SectionReader: io.NewSectionReader(f, offset, length), f: f}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// sectionReadCloser is a section of a file, which is closed by the HTTP client after the request.
+type sectionReadCloser struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *sectionReadCloser) Close() error { return r.f.Close() }
+
+// Commit commits the files to the dataset repo at revision: the files of lfs are committed as pointers
+// to their (uploaded) LFS objects, the others inline. It returns the url of the commit.
+func (c *Client) Commit(ctx context.Context, repoID string, revision string, summary string, files []*File,
+	lfs map[string]bool) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(map[string]any{"key": "header", "value": map[string]string{"summary": summary, "description": ""}})
+	for _, file := range files {
+		if lfs[file.Path] {
+			enc.Encode(map[string]any{"key": "lfsFile", "value": map[string]any{
+				"path": file.Path, "algo": "sha256", "oid": file.Sha256,
+			}})
+			continue
+		}
+		data, err := os.ReadFile(util.LongPath(file.LocalPath))
+		if err != nil {
+			return "", err
+		}
+		enc.Encode(map[string]any{"key": "file", "value": map[string]string{
+			"path": file.Path, "content": base64.StdEncoding.EncodeToString(data), "encoding": "base64",
+		}})
+	}
+	data := buf.Bytes()
+	body, _, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		url:    c.datasetURL(repoID, "commit", revision),
+		header: map[string]string{"Content-Type": "application/x-ndjson"},
+		body:   func() io.Reader { return bytes.NewReader(data) },
+		size:   int64(len(data)),
+		auth:   true,
+	})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		CommitURL string `json:"commitUrl"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("invalid commit response: %w", err)
+	}
+	return resp.CommitURL, nil
+}
+
+// GitBlobSHA1 returns the hex encoded git blob hash of the file at path, the oid of a regular file of a repo.
+func GitBlobSHA1(path string, size int64) (string, error) {
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", size)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
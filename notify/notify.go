@@ -0,0 +1,155 @@
+// Package notify posts run summaries to webhook, Discord or Telegram targets
+// when a long-running command finishes.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/sagan/goaider/constants"
+)
+
+// Summary is the result of a command run.
+type Summary struct {
+	Command   string        `json:"command"`
+	Dir       string        `json:"dir"`
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Skipped   int           `json:"skipped"`
+	Failed    int           `json:"failed"`
+	Duration  time.Duration `json:"-"`
+	Error     string        `json:"error,omitempty"` // run-level error, if any
+}
+
+// Text returns a human-readable message of the summary.
+func (s *Summary) Text() string {
+	status := "✅ finished"
+	if s.Error != "" || s.Failed > 0 {
+		status = "❌ finished with errors"
+	}
+	text := fmt.Sprintf("goaider %s %s in %s\nDir: %s\nTotal: %d, succeeded: %d, skipped: %d, failed: %d",
+		s.Command, status, s.Duration.Round(time.Second), s.Dir, s.Total, s.Succeeded, s.Skipped, s.Failed)
+	if s.Error != "" {
+		text += "\nError: " + s.Error
+	}
+	return text
+}
+
+// AddFlag registers the --notify flag to flags, bound to urls.
+// Its default value is read from the GOAIDER_NOTIFY env.
+func AddFlag(flags *pflag.FlagSet, urls *[]string) {
+	var defaultUrls []string
+	if env := os.Getenv(constants.ENV_NOTIFY); env != "" {
+		defaultUrls = strings.Split(env, ",")
+	}
+	flags.StringArrayVar(urls, "notify", defaultUrls, `Post a summary to this target when the run finishes: `+
+		`"discord://<id>/<token>", "tgram://<bot_token>/<chat_id>" or a webhook url. Can be set multiple times`)
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Send posts the summary to each of the target urls. Failures are printed as warnings.
+//
+// Supported targets:
+//   - "discord://<webhook_id>/<webhook_token>" or a "https://discord.com/api/webhooks/..." url.
+//   - "tgram://<bot_token>/<chat_id>": Telegram bot message.
+//   - Any other http(s) url: generic webhook, the summary is POSTed as JSON.
+func Send(urls []string, s *Summary) {
+	for _, target := range urls {
+		if target == "" {
+			continue
+		}
+		if err := send(target, s); err != nil {
+			fmt.Printf("Warning: failed to send notification to %s: %v\n", targetName(target), err)
+		}
+	}
+}
+
+// send posts the summary to target. The returned errors never contain the target, which has secrets.
+func send(target string, s *Summary) error {
+	// The discord and tgram targets are not parsed as urls: a bot token ("123456:ABC...") is not a valid host
+	scheme, rest, _ := strings.Cut(target, "://")
+	switch scheme {
+	case "discord":
+		id, token, _ := strings.Cut(rest, "/")
+		if id == "" || token == "" {
+			return fmt.Errorf("invalid discord target, expect discord://<webhook_id>/<webhook_token>")
+		}
+		return postJSON("https://discord.com/api/webhooks/"+id+"/"+token, map[string]string{"content": s.Text()})
+	case "tgram":
+		token, chatId, _ := strings.Cut(rest, "/")
+		chatId = strings.Trim(chatId, "/")
+		if token == "" || chatId == "" {
+			return fmt.Errorf("invalid telegram target, expect tgram://<bot_token>/<chat_id>")
+		}
+		return postJSON("https://api.telegram.org/bot"+token+"/sendMessage",
+			map[string]string{"chat_id": chatId, "text": s.Text()})
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target url")
+	}
+	switch {
+	case (u.Scheme == "https" || u.Scheme == "http") &&
+		(u.Host == "discord.com" || u.Host == "discordapp.com") && strings.HasPrefix(u.Path, "/api/webhooks/"):
+		return postJSON(target, map[string]string{"content": s.Text()})
+	case u.Scheme == "https" || u.Scheme == "http":
+		payload := struct {
+			*Summary
+			DurationSeconds float64 `json:"duration_seconds"`
+			Text            string  `json:"text"`
+		}{s, s.Duration.Seconds(), s.Text()}
+		return postJSON(target, payload)
+	default:
+		return fmt.Errorf("unsupported notification target scheme %q", u.Scheme)
+	}
+}
+
+func postJSON(target string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The url.Error has the full target url, only report the failed operation
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("request failed: %s: %v", urlErr.Op, urlErr.Err)
+		}
+		return fmt.Errorf("request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// targetName returns the printable name of target without its secrets (tokens, and the path and query of
+// webhook urls): the service, or the scheme and host of a url.
+func targetName(target string) string {
+	scheme, _, _ := strings.Cut(target, "://")
+	switch scheme {
+	case "discord":
+		return "discord"
+	case "tgram":
+		return "telegram"
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "invalid target"
+	}
+	return u.Scheme + "://" + u.Host
+}
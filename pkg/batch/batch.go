@@ -0,0 +1,56 @@
+// Package batch runs the per-file processing of the goaider library packages (captioner, transcriber,
+// cropper) over a list of files, reporting the progress of each file to a callback.
+package batch
+
+import (
+	"context"
+
+	"github.com/sagan/goaider/errs"
+)
+
+// Progress is reported to a ProgressFunc before (Done = false) and after (Done = true) each file is processed.
+type Progress struct {
+	Path   string // the input file
+	Output string // the main output file, e.g. the caption .txt file. Set when Done
+	Index  int    // 0-based index of the file
+	Total  int
+	Done   bool
+	// The file was skipped, e.g. because the output file already exists. Set when Done
+	Skipped bool
+	// The error of the file. Set when Done
+	Err error
+}
+
+// ProgressFunc is called with the progress of each file. It may be nil.
+type ProgressFunc func(*Progress)
+
+// ProcessFunc processes the file at path and returns its output file, or skipped = true if it's not processed.
+type ProcessFunc func(ctx context.Context, path string) (output string, skipped bool, err error)
+
+// Run processes paths in order. The error of a file is reported to onProgress and does not stop the run,
+// unless it's fatal (all remaining files would fail the same way, e.g. an invalid API key or an exceeded quota),
+// or ctx is canceled, in which case Run returns the error.
+func Run(ctx context.Context, paths []string, process ProcessFunc, onProgress ProgressFunc) error {
+	report := func(p *Progress) {
+		if onProgress != nil {
+			onProgress(p)
+		}
+	}
+	for i, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report(&Progress{Path: path, Index: i, Total: len(paths)})
+		output, skipped, err := process(ctx, path)
+		report(&Progress{Path: path, Output: output, Index: i, Total: len(paths), Done: true, Skipped: skipped, Err: err})
+		if IsFatal(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsFatal reports whether err would also fail all remaining files: an API authentication or quota error.
+func IsFatal(err error) bool {
+	return errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota)
+}
@@ -0,0 +1,63 @@
+package captioner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sagan/goaider/util"
+)
+
+// Appended to the prompt when regenerating a caption which contained banned words
+const banWordsPrompt = `
+Your previous caption contained these FORBIDDEN words: %s.
+DO NOT use any of these words (or their variants) in the caption: %s.
+`
+
+// BanWord is a term which must not appear in generated captions.
+type BanWord struct {
+	term   string
+	regexp *regexp.Regexp
+}
+
+// LoadBanWords reads the banned terms from a file, one term per line.
+func LoadBanWords(path string) ([]*BanWord, error) {
+	terms, err := util.ReadListFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var words []*BanWord
+	for _, term := range terms {
+		// Match the whole term case-insensitively, not as part of a longer word
+		re, err := regexp.Compile(`(?i)(^|[^\p{L}\p{N}])` + regexp.QuoteMeta(term) + `($|[^\p{L}\p{N}])`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid banned term %q: %w", term, err)
+		}
+		words = append(words, &BanWord{term: term, regexp: re})
+	}
+	return words, nil
+}
+
+// FindBanWords returns the banned terms that appear in caption.
+func FindBanWords(words []*BanWord, caption string) []string {
+	var found []string
+	for _, word := range words {
+		if word.regexp.MatchString(caption) {
+			found = append(found, word.term)
+		}
+	}
+	return found
+}
+
+// banWordsPromptSuffix returns the prompt suffix of a regeneration, after the previous caption contained found.
+func banWordsPromptSuffix(words []*BanWord, found []string) string {
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = fmt.Sprintf("%q", word.term)
+	}
+	quotedFound := make([]string, len(found))
+	for i, term := range found {
+		quotedFound[i] = fmt.Sprintf("%q", term)
+	}
+	return fmt.Sprintf(banWordsPrompt, strings.Join(quotedFound, ", "), strings.Join(terms, ", "))
+}
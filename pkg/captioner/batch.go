@@ -0,0 +1,164 @@
+package captioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/provider"
+)
+
+// Appended to the prompt of a batch request (CaptionBatch)
+const batchPrompt = `
+BATCH MODE: %d images follow, each one preceded by its file name ("File: <name>"). Caption each image independently, following the RULES above.
+OUTPUT FORMAT: a JSON array with one object per image, in the same order: {"file": "<the file name of the image>", "caption": "<the caption>"}.
+`
+
+var batchSchema = &gemini.Schema{
+	Type: "ARRAY",
+	Items: &gemini.Schema{
+		Type: "OBJECT",
+		Properties: map[string]*gemini.Schema{
+			"file":    {Type: "STRING", Description: "The file name of the image"},
+			"caption": {Type: "STRING"},
+		},
+		Required: []string{"file", "caption"},
+	},
+}
+
+// BatchImage is an image of a batch caption request.
+type BatchImage struct {
+	// The image path, used in messages. Its file name labels the image in the request
+	Name     string
+	Data     []byte
+	MimeType string
+	// The options of the image (e.g. its identity), which must have the same prompt and model as the batch.
+	// nil = the options of the batch
+	Options *Options
+}
+
+// CaptionBatch generates the captions of multiple images in one request, with a structured response of the caption
+// of each file, to reduce the number of requests. It returns the result or error of each image.
+// The images whose captions are missing from the response, contain banned words or are in the wrong language
+// are captioned individually by Caption (with its regenerations), as are all images if the batch request fails
+// with a non fatal error. opts must not be in a structured response mode (Metadata, MaxTags or MaxChars).
+func CaptionBatch(ctx context.Context, p provider.CaptionProvider, images []*BatchImage,
+	opts *Options) ([]*Result, []error) {
+	results := make([]*Result, len(images))
+	imageErrs := make([]error, len(images))
+	labels := batchLabels(images)
+	request := NewBatchRequest(images, labels, opts)
+	text, err := p.Caption(ctx, request)
+	var captions map[string]string
+	if err == nil {
+		captions, err = parseBatchResponse(text)
+	}
+	if err != nil {
+		if errs.Is(err, errs.ExitAuth) || errs.Is(err, errs.ExitQuota) || ctx.Err() != nil {
+			for i := range imageErrs {
+				imageErrs[i] = err
+			}
+			return results, imageErrs
+		}
+		fmt.Fprintf(opts.log(), "  ...batch request of %d images failed (%v), captioning them individually\n",
+			len(images), err)
+	}
+
+	for i, image := range images {
+		imageOpts := image.Options
+		if imageOpts == nil {
+			imageOpts = opts
+		}
+		caption, ok := captions[labels[i]]
+		if ok {
+			found := FindBanWords(imageOpts.BanWords, caption)
+			wrongLanguage := !IsInLanguage(caption, imageOpts.Language)
+			switch {
+			case strings.TrimSpace(caption) == "":
+				ok = false
+			case len(found) > 0:
+				fmt.Fprintf(opts.log(), "  ...%s: caption contains banned words (%s), regenerating individually\n",
+					filepath.Base(image.Name), strings.Join(found, ", "))
+				ok = false
+			case wrongLanguage:
+				fmt.Fprintf(opts.log(), "  ...%s: caption is not in %s, regenerating individually\n",
+					filepath.Base(image.Name), imageOpts.Language)
+				ok = false
+			}
+		} else if err == nil {
+			fmt.Fprintf(opts.log(), "  ...%s: caption missing from the batch response, captioning individually\n",
+				filepath.Base(image.Name))
+		}
+		if ok {
+			results[i] = &Result{}
+			results[i].Caption, _ = Finish(caption, nil, imageOpts)
+			continue
+		}
+		results[i], imageErrs[i] = Caption(ctx, p, image.Name, image.Data, image.MimeType, imageOpts)
+		// All remaining requests would fail the same way
+		if errs.Is(imageErrs[i], errs.ExitAuth) || errs.Is(imageErrs[i], errs.ExitQuota) {
+			for j := i + 1; j < len(images); j++ {
+				imageErrs[j] = imageErrs[i]
+			}
+			break
+		}
+	}
+	return results, imageErrs
+}
+
+// NewBatchRequest returns the provider request to caption the images, labeled by labels, in one request.
+func NewBatchRequest(images []*BatchImage, labels []string, opts *Options) *provider.CaptionRequest {
+	request := &provider.CaptionRequest{
+		Model:  opts.model(),
+		Prompt: opts.prompt() + languagePromptSuffix(opts.Language) + fmt.Sprintf(batchPrompt, len(images)),
+		Config: opts.Sampling.Apply(&gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   batchSchema,
+		}),
+	}
+	for i, image := range images {
+		request.Images = append(request.Images, &provider.CaptionImage{
+			Label:    labels[i],
+			Data:     image.Data,
+			MimeType: image.MimeType,
+		})
+	}
+	return request
+}
+
+// batchLabels returns the labels of the images in a batch request: their file names,
+// prefixed with their 1-based index if not unique.
+func batchLabels(images []*BatchImage) []string {
+	count := map[string]int{}
+	for _, image := range images {
+		count[filepath.Base(image.Name)]++
+	}
+	labels := make([]string, len(images))
+	for i, image := range images {
+		labels[i] = filepath.Base(image.Name)
+		if count[labels[i]] > 1 {
+			labels[i] = fmt.Sprintf("%d-%s", i+1, labels[i])
+		}
+	}
+	return labels
+}
+
+// parseBatchResponse parses the structured response of a batch request into the captions of the file labels.
+func parseBatchResponse(text string) (map[string]string, error) {
+	var items []struct {
+		File    string `json:"file"`
+		Caption string `json:"caption"`
+	}
+	if err := json.Unmarshal([]byte(text), &items); err != nil {
+		return nil, fmt.Errorf("invalid batch caption response %q: %w", text, err)
+	}
+	captions := map[string]string{}
+	for _, item := range items {
+		captions[strings.TrimSpace(item.File)] = item.Caption
+	}
+	return captions, nil
+}
@@ -0,0 +1,406 @@
+// Package captioner generates LoRA training captions of images using a provider (e.g. the Gemini API).
+// It's the library API of the caption command.
+package captioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/batch"
+	"github.com/sagan/goaider/pkg/provider"
+	"github.com/sagan/goaider/util"
+)
+
+// DefaultPrompt is the default caption prompt, optimized for LoRa training captions.
+const DefaultPrompt = `Generate a simple, comma-separated caption for this image, optimized for LoRa training.
+
+RULES:
+1.  Focus ONLY on the main subject.
+2.  Describe visible attributes: clothing (e.g., "pink jacket"), hairstyle (e.g., "ponytail"), pose (e.g., "crouching", "standing"), and expression (e.g., "smiling").
+3.  You can describe an object that the main subject is interacting with (e.g., "holding a toy").
+
+CRITICAL:
+* DO NOT use general category words like "girl", "boy", "child", "woman", "man", or "person".
+* DO NOT describe the background, environment, or location (e.g., AVOID "in a room", "child's room", "indoor", "outside", "at home").
+* DO NOT describe artistic style, lighting, camera quality, or effects.
+
+Good example: "pink puffer jacket, ponytail, hair clips, crouching, holding toy".
+
+Bad example: "young girl, pink puffer jacket, fur collar, black pants, slippers, pink bunny hair clips, ponytail, pink bobbles, crouching, holding a pink plastic toy, child's room, pink desk, pink chair, toys, curtains, wooden floor".
+"
+`
+
+// DefaultClassWords are the common class words that duplicate the identity of a caption.
+var DefaultClassWords = []string{"girl", "boy", "woman", "man", "person", "child", "1girl", "1boy"}
+
+// Options are the options of how a caption is requested and post-processed.
+// The JSON fields are saved with queued requests (caption --queue-only), so that flush-queue
+// processes the responses the same way.
+type Options struct {
+	// The model. Default: constants.DEFAULT_GEMINI_MODEL
+	Model string `json:"-"`
+	// The prompt of the model. Default: DefaultPrompt. Not saved, the queued request has it already
+	Prompt string `json:"-"`
+	// The trigger word prepended to the caption
+	Identity string `json:"identity,omitempty"`
+	// Class words (e.g. DefaultClassWords) removed from the generated caption if Identity is set, see StripIdentity
+	StripWords []string `json:"stripWords,omitempty"`
+	// A class word inserted into the caption (if it doesn't have it) at the 0-based tag position ClassTokenPos.
+	// ClassTokenPos -1 = append to the end
+	ClassToken    string `json:"classToken,omitempty"`
+	ClassTokenPos int    `json:"classTokenPos"`
+	// The caption template (see ApplyTemplate) merging the generated tags with the Facts of the image. "" = none
+	Template string            `json:"template,omitempty"`
+	Facts    map[string]string `json:"facts,omitempty"`
+	// Max number of tags (enforced via structured output) and max length of the final caption. 0 = unlimited
+	MaxTags  int `json:"maxTags,omitempty"`
+	MaxChars int `json:"maxChars,omitempty"`
+	// Request a structured ImageMetadata, saved as the .json sidecar file
+	Metadata bool `json:"metadata,omitempty"`
+	// EXIF fields of the image saved to the metadata
+	Exif map[string]string `json:"exif,omitempty"`
+	// Language of the caption, e.g. "Chinese" or "zh". A known language's caption not in its script
+	// is regenerated like one containing banned terms. "" = the language of the prompt (English)
+	Language string `json:"language,omitempty"`
+	// Banned terms. A caption containing any of them (or in the wrong Language) is regenerated up to BanRetries times
+	BanWords   []*BanWord `json:"-"`
+	BanRetries int        `json:"-"`
+	// Sampling parameters. nil = model defaults
+	Sampling *gemini.Sampling `json:"-"`
+	// Downscale images whose longest side exceeds UploadMaxSize pixels (0 = disable) to JPEG of UploadQuality
+	// (default 85) before sending them to the API
+	UploadMaxSize int `json:"-"`
+	UploadQuality int `json:"-"`
+	// Re-generate the captions of images which have them (CaptionFiles)
+	Force bool `json:"-"`
+	// Extension of the caption files (e.g. ".caption"). Default: ".txt"
+	OutputExt string `json:"outputExt,omitempty"`
+	// Write the caption files with the UTF-8 BOM
+	BOM bool `json:"bom,omitempty"`
+	// Where status messages (e.g. regenerations) are written. nil = discard
+	Log io.Writer `json:"-"`
+}
+
+// Result is the caption of an image.
+type Result struct {
+	// The final caption, with identity and class token
+	Caption string
+	// The structured metadata (with the final caption) if Options.Metadata is set
+	Metadata *ImageMetadata
+	// The banned terms that the caption still contains after all regenerations
+	Flagged []string
+	// The caption is still not in Options.Language after all regenerations
+	WrongLanguage bool
+}
+
+func (opts *Options) model() string {
+	if opts.Model == "" {
+		return constants.DEFAULT_GEMINI_MODEL
+	}
+	return opts.Model
+}
+
+func (opts *Options) prompt() string {
+	if opts.Prompt == "" {
+		return DefaultPrompt
+	}
+	return opts.Prompt
+}
+
+func (opts *Options) log() io.Writer {
+	if opts.Log == nil {
+		return io.Discard
+	}
+	return opts.Log
+}
+
+// Caption generates the caption of the image data using p. name (the image path, or e.g. "stdin")
+// is used in messages. If the caption contains banned words, it's regenerated with an amended prompt.
+func Caption(ctx context.Context, p provider.CaptionProvider, name string, imageData []byte, mimeType string,
+	opts *Options) (*Result, error) {
+	request, promptSuffix := NewRequest(imageData, mimeType, opts)
+	result := &Result{}
+	var caption string
+	var answered *provider.Fallback // the provider and model that generated the caption, if p is a chain
+	for attempt := 0; ; attempt++ {
+		var text string
+		var err error
+		if chain, ok := p.(*provider.CaptionChain); ok {
+			text, answered, err = chain.CaptionBy(ctx, request)
+		} else {
+			text, err = p.Caption(ctx, request)
+		}
+		if err != nil {
+			return nil, err
+		}
+		caption, result.Metadata, err = ParseResponse(text, opts)
+		if err != nil {
+			return nil, err
+		}
+		found := FindBanWords(opts.BanWords, caption)
+		wrongLanguage := !IsInLanguage(caption, opts.Language)
+		if len(found) == 0 && !wrongLanguage {
+			break
+		}
+		if attempt >= opts.BanRetries {
+			result.Flagged, result.WrongLanguage = found, wrongLanguage
+			break
+		}
+		request.Prompt = opts.prompt() + promptSuffix
+		if len(found) > 0 {
+			fmt.Fprintf(opts.log(), "  ...%s: caption contains banned words (%s), regenerating\n",
+				filepath.Base(name), strings.Join(found, ", "))
+			request.Prompt += banWordsPromptSuffix(opts.BanWords, found)
+		}
+		if wrongLanguage {
+			fmt.Fprintf(opts.log(), "  ...%s: caption is not in %s, regenerating\n", filepath.Base(name), opts.Language)
+			request.Prompt += languageRetryPromptSuffix(opts.Language)
+		}
+	}
+	result.Caption, result.Metadata = Finish(caption, result.Metadata, opts)
+	if result.Metadata != nil {
+		result.Metadata.Generation = NewGeneration(request)
+		if answered != nil {
+			result.Metadata.Generation.Provider, result.Metadata.Generation.Model = answered.Provider, answered.Model
+		}
+	}
+	return result, nil
+}
+
+// CaptionFile generates the caption of the image file at imagePath.
+func CaptionFile(ctx context.Context, p provider.CaptionProvider, imagePath string, opts *Options) (*Result, error) {
+	imageData, mimeType, err := ReadImage(imagePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return Caption(ctx, p, imagePath, imageData, mimeType, opts)
+}
+
+// CaptionFiles captions the image files, saving each caption to the .txt (opts.OutputExt) file of the image
+// (and the metadata to the .json file). Images which have captions are skipped unless opts.Force is set.
+// See batch.Run for the error handling.
+func CaptionFiles(ctx context.Context, p provider.CaptionProvider, imagePaths []string, opts *Options,
+	onProgress batch.ProgressFunc) error {
+	return batch.Run(ctx, imagePaths, func(ctx context.Context, imagePath string) (string, bool, error) {
+		txtPath := CaptionFilePath(imagePath, opts.OutputExt)
+		if !opts.Force && util.OutputUpToDate(imagePath, txtPath, false) {
+			return txtPath, true, nil
+		}
+		result, err := CaptionFile(ctx, p, imagePath, opts)
+		if err != nil {
+			return "", false, err
+		}
+		return txtPath, false, Save(imagePath, result, opts)
+	}, onProgress)
+}
+
+// ReadImage reads the image file at imagePath for a request, downscaled if it's larger than opts.UploadMaxSize.
+func ReadImage(imagePath string, opts *Options) (imageData []byte, mimeType string, err error) {
+	quality := opts.UploadQuality
+	if quality == 0 {
+		quality = 85
+	}
+	imageData, shrunk, err := util.ShrinkImageForUpload(imagePath, opts.UploadMaxSize, quality)
+	if err != nil {
+		fmt.Fprintf(opts.log(), "  ...failed to downscale image (%v), sending the original\n", err)
+	}
+	if shrunk {
+		return imageData, "image/jpeg", nil
+	}
+	if imageData, err = os.ReadFile(util.LongPath(imagePath)); err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+	mimeType, warning := util.CheckMimeType(imageData, MimeType(imagePath))
+	if warning != "" {
+		fmt.Fprintf(opts.log(), "  ...%s: %s\n", filepath.Base(imagePath), warning)
+	}
+	return imageData, mimeType, nil
+}
+
+// NewRequest returns the provider request to caption the image data, and the prompt suffix of the response mode.
+func NewRequest(imageData []byte, mimeType string, opts *Options) (*provider.CaptionRequest, string) {
+	promptSuffix, generationConfig := responseConfig(opts)
+	promptSuffix = languagePromptSuffix(opts.Language) + promptSuffix
+	return &provider.CaptionRequest{
+		Model:    opts.model(),
+		Prompt:   opts.prompt() + promptSuffix,
+		Image:    imageData,
+		MimeType: mimeType,
+		Config:   opts.Sampling.Apply(generationConfig),
+	}, promptSuffix
+}
+
+// Finish removes the duplicates of the identity, inserts the class token, applies the template and prepends
+// the identity of opts (if set) to the caption,
+// and returns it and the metadata (if not nil) updated with it.
+func Finish(caption string, metadata *ImageMetadata, opts *Options) (string, *ImageMetadata) {
+	finalCaption := strings.TrimSpace(caption) // Clean up any extra whitespace
+	if opts.Identity != "" {
+		finalCaption = StripIdentity(finalCaption, opts.Identity, opts.StripWords)
+	}
+	if opts.ClassToken != "" {
+		finalCaption = InsertTag(finalCaption, opts.ClassToken, opts.ClassTokenPos)
+	}
+	if opts.Template != "" {
+		finalCaption = ApplyTemplate(opts.Template, finalCaption, opts.Facts)
+	}
+	if opts.Identity != "" {
+		finalCaption = opts.Identity + ", " + finalCaption
+	}
+	if metadata != nil {
+		metadata.Caption = finalCaption
+		metadata.Exif = opts.Exif
+	}
+	return finalCaption, metadata
+}
+
+// Save saves the caption to the .txt (opts.OutputExt) file of the image (and the metadata to the .json file if not nil).
+func Save(imagePath string, result *Result, opts *Options) error {
+	if err := util.WriteTextFile(CaptionFilePath(imagePath, opts.OutputExt), result.Caption, opts.BOM); err != nil {
+		return fmt.Errorf("failed to write caption file: %w", err)
+	}
+	if result.Metadata != nil {
+		data, err := json.MarshalIndent(result.Metadata, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+		if err = util.WriteFileAtomic(MetadataFilePath(imagePath), data); err != nil {
+			return fmt.Errorf("failed to write metadata file: %w", err)
+		}
+	}
+	return nil
+}
+
+// CaptionFilePath returns the path of the caption file of the image file at imagePath. ext "" = ".txt"
+func CaptionFilePath(imagePath string, ext string) string {
+	if ext == "" {
+		ext = ".txt"
+	}
+	return strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ext
+}
+
+// MetadataFilePath returns the path of the .json metadata sidecar file of the image file at imagePath
+func MetadataFilePath(imagePath string) string {
+	return strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".json"
+}
+
+// InsertTag inserts tag into the comma-separated caption at the 0-based position pos.
+// A negative or out of range pos appends the tag to the end.
+// The caption is returned unchanged if it already contains the tag (case-insensitive).
+func InsertTag(caption string, tag string, pos int) string {
+	tag = strings.TrimSpace(tag)
+	var tags []string
+	for _, t := range strings.Split(caption, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if strings.EqualFold(t, tag) {
+			return caption
+		}
+		tags = append(tags, t)
+	}
+	if pos < 0 || pos > len(tags) {
+		pos = len(tags)
+	}
+	tags = append(tags[:pos], append([]string{tag}, tags[pos:]...)...)
+	return strings.Join(tags, ", ")
+}
+
+// RemoveTags removes the tags of the comma-separated caption for which match returns true.
+// The caption is returned unchanged if no tag matches.
+func RemoveTags(caption string, match func(tag string) bool) string {
+	var tags []string
+	removed := false
+	for _, t := range strings.Split(caption, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if match(t) {
+			removed = true
+			continue
+		}
+		tags = append(tags, t)
+	}
+	if !removed {
+		return caption
+	}
+	return strings.Join(tags, ", ")
+}
+
+// StripIdentity removes the tags of the comma-separated caption that duplicate the identity, as the model
+// may output it, e.g. "foobar, pink jacket": the identity itself, its trigger word (the last word, e.g. "foobar"
+// of "photo of foobar"), and the class words, alone or after the trigger word (e.g. "foobar girl").
+// Tags are compared case-insensitively. The caption is returned unchanged if it has no such tags.
+func StripIdentity(caption string, identity string, classWords []string) string {
+	identity = strings.TrimSpace(identity)
+	fields := strings.Fields(identity)
+	if len(fields) == 0 {
+		return caption
+	}
+	trigger := fields[len(fields)-1]
+	isDuplicate := func(tag string) bool {
+		if strings.EqualFold(tag, identity) || strings.EqualFold(tag, trigger) {
+			return true
+		}
+		if len(tag) > len(trigger) && strings.EqualFold(tag[:len(trigger)], trigger) && tag[len(trigger)] == ' ' {
+			tag = strings.TrimSpace(tag[len(trigger):])
+		}
+		return slices.ContainsFunc(classWords, func(word string) bool {
+			return strings.EqualFold(tag, strings.TrimSpace(word))
+		})
+	}
+	var tags []string
+	stripped := false
+	for _, t := range strings.Split(caption, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if isDuplicate(t) {
+			stripped = true
+			continue
+		}
+		tags = append(tags, t)
+	}
+	if !stripped {
+		return caption
+	}
+	return strings.Join(tags, ", ")
+}
+
+// IsImageFile checks if a filename has a common image extension
+func IsImageFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// MimeType determines the MIME type from the file extension
+func MimeType(imagePath string) string {
+	ext := strings.ToLower(filepath.Ext(imagePath))
+	switch ext {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	default:
+		// A safe default
+		return "application/octet-stream"
+	}
+}
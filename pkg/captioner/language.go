@@ -0,0 +1,92 @@
+package captioner
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// captionLanguage is a caption language with a known writing system.
+type captionLanguage struct {
+	name    string // English name, used in the prompt
+	codes   []string
+	scripts []*unicode.RangeTable
+}
+
+var captionLanguages = []*captionLanguage{
+	{"Chinese", []string{"zh", "zh-cn", "zh-tw", "zh-hans", "zh-hant"}, []*unicode.RangeTable{unicode.Han}},
+	{"Japanese", []string{"ja"}, []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana}},
+	{"Korean", []string{"ko"}, []*unicode.RangeTable{unicode.Hangul, unicode.Han}},
+	{"Russian", []string{"ru"}, []*unicode.RangeTable{unicode.Cyrillic}},
+	{"Ukrainian", []string{"uk"}, []*unicode.RangeTable{unicode.Cyrillic}},
+	{"Greek", []string{"el"}, []*unicode.RangeTable{unicode.Greek}},
+	{"Arabic", []string{"ar"}, []*unicode.RangeTable{unicode.Arabic}},
+	{"Hebrew", []string{"he"}, []*unicode.RangeTable{unicode.Hebrew}},
+	{"Hindi", []string{"hi"}, []*unicode.RangeTable{unicode.Devanagari}},
+	{"Thai", []string{"th"}, []*unicode.RangeTable{unicode.Thai}},
+	{"English", []string{"en"}, []*unicode.RangeTable{unicode.Latin}},
+	{"French", []string{"fr"}, []*unicode.RangeTable{unicode.Latin}},
+	{"German", []string{"de"}, []*unicode.RangeTable{unicode.Latin}},
+	{"Spanish", []string{"es"}, []*unicode.RangeTable{unicode.Latin}},
+	{"Italian", []string{"it"}, []*unicode.RangeTable{unicode.Latin}},
+	{"Portuguese", []string{"pt", "pt-br"}, []*unicode.RangeTable{unicode.Latin}},
+	{"Vietnamese", []string{"vi"}, []*unicode.RangeTable{unicode.Latin}},
+	{"Indonesian", []string{"id"}, []*unicode.RangeTable{unicode.Latin}},
+}
+
+// findLanguage returns the caption language of a name (e.g. "Chinese") or code (e.g. "zh"), or nil if unknown.
+func findLanguage(language string) *captionLanguage {
+	language = strings.ToLower(strings.TrimSpace(language))
+	for _, l := range captionLanguages {
+		if strings.ToLower(l.name) == language {
+			return l
+		}
+		for _, code := range l.codes {
+			if code == language || strings.ReplaceAll(code, "-", "_") == language {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// languagePromptSuffix returns the prompt suffix of the caption language. "" = the prompt's language.
+func languagePromptSuffix(language string) string {
+	if language == "" {
+		return ""
+	}
+	name := language
+	if l := findLanguage(language); l != nil {
+		name = l.name
+	}
+	return fmt.Sprintf("\n\nLANGUAGE: Write all tags and descriptions in %s, regardless of the language of the examples above.", name)
+}
+
+// languageRetryPromptSuffix returns the prompt suffix to regenerate a caption that is not in language.
+func languageRetryPromptSuffix(language string) string {
+	name := language
+	if l := findLanguage(language); l != nil {
+		name = l.name
+	}
+	return fmt.Sprintf("\n\nIMPORTANT: The previous answer was not in %s. Write it in %s only.", name, name)
+}
+
+// IsInLanguage reports whether the caption is written in the script of language: at least half of its letters
+// are in the script. Languages of unknown scripts and captions without letters always pass.
+func IsInLanguage(caption string, language string) bool {
+	l := findLanguage(language)
+	if language == "" || l == nil {
+		return true
+	}
+	letters, inScript := 0, 0
+	for _, r := range caption {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.In(r, l.scripts...) {
+			inScript++
+		}
+	}
+	return letters == 0 || inScript*2 >= letters
+}
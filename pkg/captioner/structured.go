@@ -0,0 +1,271 @@
+package captioner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/provider"
+	"github.com/sagan/goaider/util"
+)
+
+const (
+	// Appended to the prompt in structured tags mode (MaxTags / MaxChars)
+	structuredTagsPrompt = `
+OUTPUT FORMAT: a JSON array of tag strings, most important tags first, e.g. ["pink puffer jacket", "ponytail", "crouching"].
+`
+
+	// Appended to the prompt in structured metadata mode (Metadata)
+	structuredMetadataPrompt = `
+OUTPUT FORMAT: a JSON object. "subject" is a short description of the main subject (general category words are allowed here ONLY).
+Each other field is an array of tags following the RULES above; use an empty array if there is nothing to describe.
+`
+)
+
+// ImageMetadata is the structured description of an image requested in Metadata mode,
+// saved as the .json sidecar file.
+type ImageMetadata struct {
+	Subject    string   `json:"subject"`
+	Clothing   []string `json:"clothing"`
+	Hairstyle  []string `json:"hairstyle"`
+	Pose       []string `json:"pose"`
+	Expression []string `json:"expression"`
+	Objects    []string `json:"objects"`
+	// The final caption saved to the .txt file
+	Caption string `json:"caption,omitempty"`
+	// EXIF fields of the image (Options.Exif)
+	Exif map[string]string `json:"exif,omitempty"`
+	// The parameters the caption was generated with
+	Generation *Generation `json:"generation,omitempty"`
+}
+
+// Generation are the model and parameters of a caption request, recorded in the metadata
+// so that a caption can be audited or reproduced.
+type Generation struct {
+	// The provider (if a --fallback chain is used) and model that generated the caption
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model"`
+	// The first 16 hex digits of the SHA-256 of the final prompt (including the suffixes of the response mode)
+	PromptHash string `json:"promptHash"`
+	// Sampling parameters. Unset = model default
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            int      `json:"topK,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Seed            *int     `json:"seed,omitempty"`
+	ThinkingBudget  *int     `json:"thinkingBudget,omitempty"`
+}
+
+// NewGeneration returns the generation parameters of request.
+func NewGeneration(request *provider.CaptionRequest) *Generation {
+	hash := sha256.Sum256([]byte(request.Prompt))
+	g := &Generation{Model: request.Model, PromptHash: hex.EncodeToString(hash[:8])}
+	if config := request.Config; config != nil {
+		g.Temperature, g.TopP, g.TopK = config.Temperature, config.TopP, config.TopK
+		g.MaxOutputTokens, g.Seed = config.MaxOutputTokens, config.Seed
+		if config.ThinkingConfig != nil {
+			g.ThinkingBudget = &config.ThinkingConfig.ThinkingBudget
+		}
+	}
+	return g
+}
+
+// Tags returns the flattened caption tags of the metadata. The subject is not included.
+func (m *ImageMetadata) Tags() []string {
+	var tags []string
+	for _, group := range [][]string{m.Clothing, m.Hairstyle, m.Pose, m.Expression, m.Objects} {
+		tags = append(tags, group...)
+	}
+	return tags
+}
+
+var metadataSchema = &gemini.Schema{
+	Type: "OBJECT",
+	Properties: map[string]*gemini.Schema{
+		"subject":    {Type: "STRING", Description: "Short description of the main subject"},
+		"clothing":   {Type: "ARRAY", Items: &gemini.Schema{Type: "STRING"}, Description: "Clothing and accessories"},
+		"hairstyle":  {Type: "ARRAY", Items: &gemini.Schema{Type: "STRING"}},
+		"pose":       {Type: "ARRAY", Items: &gemini.Schema{Type: "STRING"}},
+		"expression": {Type: "ARRAY", Items: &gemini.Schema{Type: "STRING"}},
+		"objects":    {Type: "ARRAY", Items: &gemini.Schema{Type: "STRING"}, Description: "Objects the subject interacts with"},
+	},
+	Required: []string{"subject", "clothing", "hairstyle", "pose", "expression", "objects"},
+}
+
+// ExifPrompt returns the prompt suffix of the hints of the EXIF fields of an image.
+func ExifPrompt(exifFields map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString("\nCONTEXT from the photo's EXIF metadata (use it only as a hint where it's consistent " +
+		"with the image and the rules above; do not quote it verbatim):\n")
+	for _, field := range util.EXIF_FIELDS {
+		if value := exifFields[field]; value != "" {
+			fmt.Fprintf(&sb, "- %s: %s\n", field, value)
+		}
+	}
+	return sb.String()
+}
+
+// FactsPrompt returns the prompt suffix of the known facts of an image (e.g. the columns of caption --metadata-csv).
+// If merged is set, the facts are merged into the caption by a template (Options.Template), so the model is asked
+// not to repeat them.
+func FactsPrompt(facts map[string]string, merged bool) string {
+	var names []string
+	for name, value := range facts {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	slices.Sort(names)
+	var sb strings.Builder
+	sb.WriteString("\nKNOWN FACTS about this image (authoritative, never contradict them")
+	if merged {
+		sb.WriteString("; they are added to the caption separately, so do not output tags that repeat them")
+	}
+	sb.WriteString("):\n")
+	for _, name := range names {
+		fmt.Fprintf(&sb, "- %s: %s\n", name, facts[name])
+	}
+	return sb.String()
+}
+
+// TemplateTagsField is the field of a caption template (Options.Template) replaced by the generated tags.
+const TemplateTagsField = "tags"
+
+// templateFieldRegexp matches the "{field}" placeholders of a caption template.
+var templateFieldRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// TemplateFields returns the names of the "{field}" placeholders of the caption template.
+func TemplateFields(template string) []string {
+	var fields []string
+	for _, m := range templateFieldRegexp.FindAllStringSubmatch(template, -1) {
+		fields = append(fields, strings.TrimSpace(m[1]))
+	}
+	return fields
+}
+
+// ApplyTemplate returns the caption of the template (e.g. "{outfit}, {location}, {tags}"), where each "{field}"
+// is replaced by its value in facts, or by the generated tags for "{tags}". Empty and duplicate tags
+// (case-insensitive, the first one is kept) of the result are removed, so the facts replace the same tags
+// generated by the model.
+func ApplyTemplate(template string, tags string, facts map[string]string) string {
+	caption := templateFieldRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		field := strings.TrimSpace(placeholder[1 : len(placeholder)-1])
+		if field == TemplateTagsField {
+			return tags
+		}
+		return facts[field]
+	})
+	var result []string
+	for _, tag := range strings.Split(caption, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.ContainsFunc(result, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			result = append(result, tag)
+		}
+	}
+	return strings.Join(result, ", ")
+}
+
+// StyleContextFile is the name of the style context file of a folder (caption --context-caption):
+// a reference caption or tag list of the images in the folder.
+const StyleContextFile = ".caption-context.txt"
+
+// ContextPrompt returns the prompt suffix of a reference caption (e.g. of the previous image of a series),
+// to keep the tag vocabulary consistent across related images.
+func ContextPrompt(caption string) string {
+	return "\nCONTEXT: a caption of a related image of the same series (reuse its wording for the attributes " +
+		"this image shares with it, but describe only what is visible in this image):\n" + caption + "\n"
+}
+
+// responseConfig returns the prompt suffix and the generation config of the response mode of opts:
+// plain text (default), a JSON array of tags (MaxTags / MaxChars) or a metadata object (Metadata).
+func responseConfig(opts *Options) (string, *gemini.GenerationConfig) {
+	switch {
+	case opts.Metadata:
+		return structuredMetadataPrompt, &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   metadataSchema,
+		}
+	case opts.MaxTags > 0 || opts.MaxChars > 0:
+		// Request a JSON array of tags, so the tags count limit is guaranteed by the API
+		return structuredTagsPrompt, &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema: &gemini.Schema{
+				Type:     "ARRAY",
+				Items:    &gemini.Schema{Type: "STRING"},
+				MaxItems: int64(opts.MaxTags),
+			},
+		}
+	default:
+		return "", nil
+	}
+}
+
+// ParseResponse parses the model response of the response mode of opts,
+// returning the caption (without identity & class token) and the metadata (in Metadata mode).
+func ParseResponse(text string, opts *Options) (string, *ImageMetadata, error) {
+	var tags []string
+	var metadata *ImageMetadata
+	switch {
+	case opts.Metadata:
+		metadata = &ImageMetadata{}
+		if err := json.Unmarshal([]byte(text), metadata); err != nil {
+			return "", nil, fmt.Errorf("invalid structured metadata response %q: %w", text, err)
+		}
+		tags = metadata.Tags()
+	case opts.MaxTags > 0 || opts.MaxChars > 0:
+		if err := json.Unmarshal([]byte(text), &tags); err != nil {
+			return "", nil, fmt.Errorf("invalid structured caption response %q: %w", text, err)
+		}
+	default:
+		return text, nil, nil
+	}
+	// The template fields other than {tags} (e.g. the --metadata-csv facts) are also in the final caption
+	templated := ""
+	if opts.Template != "" {
+		templated = ApplyTemplate(opts.Template, "", opts.Facts)
+	}
+	return strings.Join(limitTags(tags, opts.MaxTags, opts.MaxChars, opts.Identity, opts.ClassToken, templated), ", "),
+		metadata, nil
+}
+
+// limitTags returns at most maxTags (if > 0) tags of tags, dropping trailing ones so that the final caption
+// (including identity, classToken and the templated output of the other template fields, if not empty)
+// is at most maxChars (if > 0) chars.
+func limitTags(tags []string, maxTags int, maxChars int, identity string, classToken string,
+	templated string) []string {
+	var result []string
+	length := 0
+	for _, part := range []string{identity, classToken, templated} {
+		if part != "" {
+			length += utf8.RuneCountInString(part) + len(", ")
+		}
+	}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if maxTags > 0 && len(result) >= maxTags {
+			break
+		}
+		tagLength := utf8.RuneCountInString(tag)
+		if len(result) > 0 {
+			tagLength += len(", ")
+		}
+		if maxChars > 0 && length+tagLength > maxChars {
+			break
+		}
+		length += tagLength
+		result = append(result, tag)
+	}
+	return result
+}
@@ -0,0 +1,402 @@
+// Package cropper crops and resizes images to a target size using smartcrop.
+// It's the library API of the crop command.
+package cropper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/muesli/smartcrop"
+
+	"github.com/sagan/goaider/pkg/batch"
+	"github.com/sagan/goaider/util"
+)
+
+// Options are the options of CropFiles.
+type Options struct {
+	// Target size. Default: 1024x1024
+	Width  int
+	Height int
+	// Process the images even if their output files exist
+	Force bool
+	// Also re-process the images modified after their output files
+	ChangedOnly bool
+	// Multiple target sizes. If set, Width and Height are ignored, and each image is cropped to every size,
+	// saved to the "<width>x<height>" sub dir of the output dir
+	Sizes []Size
+	// If set, images with the same series key (e.g. SeriesByDir) are a series: the crop window found
+	// in the first image of a series is applied to all its images, for a consistent framing
+	SeriesKey func(path string) string
+	// Expand the crop window by this percent of its size on each side (clamped to the image), zooming out
+	// to include more context around the subject
+	PaddingPercent float64
+	// Trim the solid-color borders (e.g. letterbox bars) of the images before cropping: the crop window
+	// is searched in the rest of the image
+	TrimBorders bool
+	// Ignore the strips of this many pixels along the edges of the images in the smartcrop analysis
+	// (e.g. of watermarks or frames), so they don't attract the crop window. The window may still include them
+	IgnoreBorder int
+	// Ignore these regions of the images (e.g. watermarked corners) in the smartcrop analysis, like IgnoreBorder
+	ExcludeRegions []Region
+	// Move the crop window up by this percent of its height, keeping headroom above faces
+	Headroom float64
+	// Move the crop window so that the subject (the center of the best crop window) is on its upper third line
+	RuleOfThirds bool
+	// Template of the output file names (without the extension), e.g. "{name}_{width}x{height}",
+	// see ValidateNameTemplate and the NameField constants. "" = the input file name
+	NameTemplate string
+	// The paths of all images of the dataset, whose position in is the {index} of NameTemplate, so that it
+	// doesn't depend on which images are processed in this run. It must include all input files. nil = the input files
+	IndexPaths []string
+	// Extension of the output files (".jpg" or ".png"), converting the images to its format. "" = the input one
+	OutputExt string
+	// Copy the sidecar files (see Sidecars) whose names end with any of these extensions (e.g. ".txt")
+	// next to the output files, renamed after them
+	SidecarExts []string
+	// Where warnings (e.g. of images whose content does not match the extension) are written. nil = discard
+	Log io.Writer
+}
+
+// Size is a target size of the cropped images.
+type Size struct {
+	Width  int
+	Height int
+}
+
+// String returns the size as "<width>x<height>", which is also the name of its output sub dir.
+func (s Size) String() string {
+	return fmt.Sprintf("%dx%d", s.Width, s.Height)
+}
+
+// ParseSizes parses the comma-separated list of "<width>x<height>" sizes, e.g. "1024x1024,768x1344".
+func ParseSizes(str string) ([]Size, error) {
+	var sizes []Size
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		w, h, ok := strings.Cut(strings.ToLower(item), "x")
+		width, err1 := strconv.Atoi(w)
+		height, err2 := strconv.Atoi(h)
+		if !ok || err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("invalid size %q, must be <width>x<height>", item)
+		}
+		sizes = append(sizes, Size{Width: width, Height: height})
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no sizes")
+	}
+	return sizes, nil
+}
+
+// CropFiles crops and resizes the image files to opts.Width x opts.Height, saving each one to outputDir
+// with the same file name (or the one of opts.NameTemplate and opts.OutputExt). If opts.Sizes is set, each image
+// is decoded once and cropped to every size instead, saved to the "<width>x<height>" sub dirs of outputDir;
+// the reported output is the one of the first size. Images whose output files exist are skipped (see Options).
+// The crops are recorded in the ManifestFilename manifest of outputDir. See batch.Run for the error handling.
+func CropFiles(ctx context.Context, inputPaths []string, outputDir string, opts *Options,
+	onProgress batch.ProgressFunc) error {
+	sizes := opts.Sizes
+	dirs := []string{outputDir}
+	if len(sizes) > 0 {
+		dirs = nil
+		for _, size := range sizes {
+			dir := filepath.Join(outputDir, size.String())
+			if err := os.MkdirAll(util.LongPath(dir), 0755); err != nil {
+				return fmt.Errorf("failed to create output directory: %w", err)
+			}
+			dirs = append(dirs, dir)
+		}
+	} else {
+		size := Size{Width: opts.Width, Height: opts.Height}
+		if size.Width <= 0 {
+			size.Width = 1024
+		}
+		if size.Height <= 0 {
+			size.Height = 1024
+		}
+		sizes = []Size{size}
+	}
+	names, err := opts.outputNames(inputPaths, sizes)
+	if err != nil {
+		return err
+	}
+	var series *seriesCropper
+	if opts.SeriesKey != nil {
+		series = newSeriesCropper(inputPaths, opts)
+	}
+	// The records of the existing outputs are kept, and those of the outputs of this run are replaced
+	manifestPath := filepath.Join(outputDir, ManifestFilename)
+	manifest, err := LoadManifest(manifestPath)
+	if err != nil {
+		if opts.Log != nil {
+			fmt.Fprintf(opts.Log, "  ...invalid %s (%v), re-creating it\n", manifestPath, err)
+		}
+		manifest = &Manifest{}
+	}
+	records := map[string]*CropRecord{}
+	for _, record := range manifest.Crops {
+		records[record.Output] = record
+	}
+	// recropped reports whether the existing output file was cropped from another source image,
+	// e.g. of {index} names after images were added or removed, so it must be re-cropped
+	recropped := func(inputPath, outputPath string) bool {
+		rel, err1 := filepath.Rel(outputDir, outputPath)
+		abs, err2 := filepath.Abs(inputPath)
+		record := records[filepath.ToSlash(rel)]
+		return err1 == nil && err2 == nil && record != nil && record.Source != abs
+	}
+	err = batch.Run(ctx, inputPaths, func(ctx context.Context, inputPath string) (string, bool, error) {
+		var img image.Image
+		skipped := true
+		for i, size := range sizes {
+			outputPath := filepath.Join(dirs[i], names[i][inputPath])
+			if !opts.Force && util.OutputUpToDate(inputPath, outputPath, opts.ChangedOnly) &&
+				!recropped(inputPath, outputPath) {
+				continue
+			}
+			skipped = false
+			if img == nil {
+				var format string
+				var err error
+				if img, format, err = util.LoadImage(inputPath); err != nil {
+					return "", false, err
+				}
+				if ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(inputPath)), "."); opts.Log != nil &&
+					ext != format && !(ext == "jpg" && format == "jpeg") {
+					fmt.Fprintf(opts.Log, "  ...%s: content is a %s image, not %s as its extension says\n",
+						filepath.Base(inputPath), format, ext)
+				}
+			}
+			var rect image.Rectangle
+			var err error
+			bounds := opts.contentBounds(img)
+			if series != nil {
+				rect, err = series.FindCrop(inputPath, img, bounds, size)
+			} else {
+				rect, err = opts.findCrop(img, bounds, size)
+			}
+			if err == nil {
+				rect = opts.bias(opts.pad(rect, bounds), bounds)
+				err = saveCrop(img, rect, outputPath, size.Width, size.Height)
+			}
+			if err == nil {
+				record := newCropRecord(outputDir, inputPath, outputPath, img, rect, size)
+				records[record.Output] = record
+			}
+			if err != nil {
+				if len(sizes) > 1 {
+					err = fmt.Errorf("%s: %w", size, err)
+				}
+				return "", false, err
+			}
+		}
+		if len(opts.SidecarExts) > 0 {
+			// Also of the skipped images, so that edited captions are synced
+			for i := range sizes {
+				if err := copySidecars(inputPath, filepath.Join(dirs[i], names[i][inputPath]), opts.SidecarExts); err != nil {
+					return "", false, err
+				}
+			}
+		}
+		return filepath.Join(dirs[0], names[0][inputPath]), skipped, nil
+	}, onProgress)
+	manifest.Crops = slices.Collect(maps.Values(records))
+	if saveErr := manifest.Save(manifestPath); saveErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to save %s: %w", ManifestFilename, saveErr))
+	}
+	return err
+}
+
+// Sidecars returns the paths of the sidecar files of the image at imagePath: the files of the same dir whose names
+// are "<image name without ext>.*", e.g. the caption, except other images.
+func Sidecars(imagePath string) ([]string, error) {
+	dir := filepath.Dir(imagePath)
+	base := strings.TrimSuffix(filepath.Base(imagePath), filepath.Ext(imagePath))
+	entries, err := os.ReadDir(util.LongPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	var sidecars []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && name != filepath.Base(imagePath) && strings.HasPrefix(name, base+".") && !IsImageFile(name) {
+			sidecars = append(sidecars, filepath.Join(dir, name))
+		}
+	}
+	return sidecars, nil
+}
+
+// MoveImage moves the image at imagePath and its sidecar files (see Sidecars) to targetDir, creating it if needed.
+func MoveImage(imagePath, targetDir string) error {
+	sidecars, err := Sidecars(imagePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(util.LongPath(targetDir), 0755); err != nil {
+		return err
+	}
+	for _, path := range append([]string{imagePath}, sidecars...) {
+		if err := os.Rename(util.LongPath(path), util.LongPath(filepath.Join(targetDir, filepath.Base(path)))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySidecars copies the sidecar files (see Sidecars) of the image at inputPath whose names end with any of exts
+// next to its output file at outputPath, renamed after it (e.g. "a.ocr.txt" of "a.jpg" => "b.ocr.txt" of "b.png").
+// Sidecars whose copies are up to date are skipped.
+func copySidecars(inputPath, outputPath string, exts []string) error {
+	sidecars, err := Sidecars(inputPath)
+	if err != nil {
+		return err
+	}
+	inputBase := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+	outputBase := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	for _, sidecar := range sidecars {
+		name := filepath.Base(sidecar)
+		if !slices.ContainsFunc(exts, func(ext string) bool {
+			return strings.HasSuffix(strings.ToLower(name), strings.ToLower(ext))
+		}) {
+			continue
+		}
+		target := outputBase + strings.TrimPrefix(name, inputBase)
+		if util.OutputUpToDate(sidecar, target, true) {
+			continue
+		}
+		if err := util.CopyFileAtomic(sidecar, target); err != nil {
+			return fmt.Errorf("failed to copy sidecar %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// IsImageFile reports whether the image file can be cropped (by its extension).
+func IsImageFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	default:
+		return false
+	}
+}
+
+type resizer struct{}
+
+func (r resizer) Resize(img image.Image, width, height uint) image.Image {
+	// Use the new imaging library's Resize function
+	return imaging.Resize(img, int(width), int(height), imaging.Lanczos)
+}
+
+// CropImage crops the best (smartcrop) region of the aspect ratio of width x height of the image file
+// at inputPath, resizes it to width x height and saves it to outputPath (.jpg or .png).
+func CropImage(inputPath, outputPath string, width, height int) error {
+	img, _, err := util.LoadImage(inputPath)
+	if err != nil {
+		return err
+	}
+	rect, err := FindCrop(img, width, height)
+	if err != nil {
+		return err
+	}
+	return saveCrop(img, rect, outputPath, width, height)
+}
+
+// cropSize returns the size of the largest crop window of the aspect ratio of width x height in the image bounds.
+func cropSize(bounds image.Rectangle, width, height int) (cropWidth, cropHeight int) {
+	targetRatio := float64(width) / float64(height)
+	imgWidth := bounds.Dx()
+	imgHeight := bounds.Dy()
+	imgRatio := float64(imgWidth) / float64(imgHeight)
+
+	if imgRatio > targetRatio {
+		cropHeight = imgHeight
+		cropWidth = int(float64(imgHeight) * targetRatio)
+	} else {
+		cropWidth = imgWidth
+		cropHeight = int(float64(imgWidth) / targetRatio)
+	}
+	return cropWidth, cropHeight
+}
+
+// pad expands the crop window rect by the PaddingPercent option on each side, keeping its aspect ratio
+// and center, and then moves (or shrinks) it into the image bounds.
+func (opts *Options) pad(rect image.Rectangle, bounds image.Rectangle) image.Rectangle {
+	if opts.PaddingPercent <= 0 {
+		return rect
+	}
+	scale := 1 + 2*opts.PaddingPercent/100
+	// The largest scale that fits the image
+	scale = min(scale, float64(bounds.Dx())/float64(rect.Dx()), float64(bounds.Dy())/float64(rect.Dy()))
+	width := min(int(math.Round(float64(rect.Dx())*scale)), bounds.Dx())
+	height := min(int(math.Round(float64(rect.Dy())*scale)), bounds.Dy())
+	center := image.Pt((rect.Min.X+rect.Max.X)/2, (rect.Min.Y+rect.Max.Y)/2)
+	x := clamp(center.X-width/2, bounds.Min.X, bounds.Max.X-width)
+	y := clamp(center.Y-height/2, bounds.Min.Y, bounds.Max.Y-height)
+	return image.Rect(x, y, x+width, y+height)
+}
+
+// bias moves the crop window rect per the Headroom and RuleOfThirds options, keeping it in the image bounds.
+func (opts *Options) bias(rect image.Rectangle, bounds image.Rectangle) image.Rectangle {
+	dy := 0.0
+	if opts.RuleOfThirds {
+		// The subject is at 1/2 of the height, move it to 1/3
+		dy += float64(rect.Dy()) / 6
+	}
+	dy -= float64(rect.Dy()) * opts.Headroom / 100
+	if dy == 0 {
+		return rect
+	}
+	y := clamp(rect.Min.Y+int(math.Round(dy)), bounds.Min.Y, bounds.Max.Y-rect.Dy())
+	return rect.Add(image.Pt(0, y-rect.Min.Y))
+}
+
+// FindCrop returns the best (smartcrop) crop window of the aspect ratio of width x height in img.
+func FindCrop(img image.Image, width, height int) (image.Rectangle, error) {
+	cropWidth, cropHeight := cropSize(img.Bounds(), width, height)
+	analyzer := smartcrop.NewAnalyzer(resizer{})
+	return analyzer.FindBestCrop(img, cropWidth, cropHeight)
+}
+
+// saveCrop crops the rect region of img, resizes it to width x height and saves it to outputPath (.jpg or .png).
+func saveCrop(img image.Image, rect image.Rectangle, outputPath string, width, height int) error {
+	type subImager interface {
+		SubImage(r image.Rectangle) image.Image
+	}
+
+	croppedImg := img.(subImager).SubImage(rect)
+
+	// Use imaging.Resize for the final resize
+	resizedImg := imaging.Resize(croppedImg, width, height, imaging.Lanczos)
+
+	// Encode the image to a temp file which is renamed to outputPath when complete
+	var format imaging.Format
+	var options []imaging.EncodeOption
+	ext := strings.ToLower(filepath.Ext(outputPath))
+	switch ext {
+	case ".jpg", ".jpeg":
+		format, options = imaging.JPEG, []imaging.EncodeOption{imaging.JPEGQuality(95)}
+	case ".png":
+		format, options = imaging.PNG, []imaging.EncodeOption{imaging.PNGCompressionLevel(png.DefaultCompression)}
+	default:
+		return fmt.Errorf("unsupported image format: %s", ext)
+	}
+	return util.WriteAtomic(outputPath, func(w io.Writer) error {
+		return imaging.Encode(w, resizedImg, format, options...)
+	})
+}
@@ -0,0 +1,91 @@
+package cropper
+
+import (
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sagan/goaider/util"
+)
+
+// ManifestFilename is the name of the crops manifest written to the output dir by CropFiles.
+const ManifestFilename = "crops-manifest.json"
+
+// Manifest records the source of each output file of CropFiles, so that later tooling (e.g. re-cropping
+// at a higher resolution, or masked training) can reference the original pixels.
+type Manifest struct {
+	Crops []*CropRecord `json:"crops"`
+}
+
+// CropRecord is the crop of an output file.
+type CropRecord struct {
+	// The output file, slash-separated and relative to the dir of the manifest
+	Output string `json:"output"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// The absolute path of the source image
+	Source       string `json:"source"`
+	SourceWidth  int    `json:"source_width"`
+	SourceHeight int    `json:"source_height"`
+	// The crop window in the source image, in the pixels of the upright image (after the EXIF orientation)
+	Rect Rect `json:"rect"`
+}
+
+// Rect is a rectangle of an image.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// LoadManifest reads the crops manifest file at path. It returns an empty manifest if the file doesn't exist.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(util.LongPath(path))
+	if os.IsNotExist(err) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Save writes the manifest to the file at path atomically, with the crops sorted by output.
+func (m *Manifest) Save(path string) error {
+	slices.SortFunc(m.Crops, func(a, b *CropRecord) int { return strings.Compare(a.Output, b.Output) })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path, data)
+}
+
+// newCropRecord returns the record of the rect crop of img (the image at inputPath) saved to outputPath,
+// relative to the manifest dir.
+func newCropRecord(dir, inputPath, outputPath string, img image.Image, rect image.Rectangle, size Size) *CropRecord {
+	record := &CropRecord{
+		Output:       filepath.ToSlash(outputPath),
+		Width:        size.Width,
+		Height:       size.Height,
+		Source:       inputPath,
+		SourceWidth:  img.Bounds().Dx(),
+		SourceHeight: img.Bounds().Dy(),
+	}
+	if rel, err := filepath.Rel(dir, outputPath); err == nil {
+		record.Output = filepath.ToSlash(rel)
+	}
+	if abs, err := filepath.Abs(inputPath); err == nil {
+		record.Source = abs
+	}
+	rect = rect.Sub(img.Bounds().Min)
+	record.Rect = Rect{X: rect.Min.X, Y: rect.Min.Y, Width: rect.Dx(), Height: rect.Dy()}
+	return record
+}
@@ -0,0 +1,132 @@
+package cropper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sagan/goaider/util"
+)
+
+// The fields of the output name template (Options.NameTemplate)
+const (
+	NameFieldName   = "name"   // the input file name without the extension
+	NameFieldIndex  = "index"  // the 1-based index of the input file in Options.IndexPaths, zero-padded to the digits of their count
+	NameFieldWidth  = "width"  // the target width
+	NameFieldHeight = "height" // the target height
+	NameFieldHash   = "hash"   // the first 12 hex digits of the SHA-256 of the input file
+)
+
+var nameFields = []string{NameFieldName, NameFieldIndex, NameFieldWidth, NameFieldHeight, NameFieldHash}
+
+var nameFieldRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// ValidateNameTemplate returns an error if the output name template has an unknown field.
+func ValidateNameTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("empty template")
+	}
+	for _, m := range nameFieldRegexp.FindAllStringSubmatch(template, -1) {
+		if !slices.Contains(nameFields, m[1]) {
+			return fmt.Errorf("unknown field {%s}, must be one of {%s}", m[1], strings.Join(nameFields, "}, {"))
+		}
+	}
+	if strings.ContainsAny(nameFieldRegexp.ReplaceAllString(template, ""), `/\`) {
+		return fmt.Errorf("the template must not contain a path separator")
+	}
+	return nil
+}
+
+// outputNames returns the output file names of the input files for each of sizes: the input file name,
+// or the opts.NameTemplate name, with the opts.OutputExt extension if set. If either is set, it returns an error
+// if two input files would have the same output name.
+func (opts *Options) outputNames(inputPaths []string, sizes []Size) ([]map[string]string, error) {
+	indexPaths := opts.IndexPaths
+	if indexPaths == nil {
+		indexPaths = inputPaths
+	}
+	digits := len(strconv.Itoa(len(indexPaths)))
+	indexes := map[string]int{} // the 1-based index of each absolute path
+	for i, path := range indexPaths {
+		if abs, err := filepath.Abs(path); err == nil {
+			indexes[abs] = i + 1
+		}
+	}
+	hashes := map[string]string{}
+	names := make([]map[string]string, len(sizes))
+	for i, size := range sizes {
+		names[i] = map[string]string{}
+		sources := map[string]string{} // the input file of each output name
+		for _, inputPath := range inputPaths {
+			ext := filepath.Ext(inputPath)
+			name := strings.TrimSuffix(filepath.Base(inputPath), ext)
+			if opts.NameTemplate != "" {
+				var err error
+				name = nameFieldRegexp.ReplaceAllStringFunc(opts.NameTemplate, func(placeholder string) string {
+					switch placeholder[1 : len(placeholder)-1] {
+					case NameFieldName:
+						return name
+					case NameFieldIndex:
+						abs, _ := filepath.Abs(inputPath)
+						index, ok := indexes[abs]
+						if !ok {
+							err = fmt.Errorf("not in the indexed images")
+							return ""
+						}
+						return fmt.Sprintf("%0*d", digits, index)
+					case NameFieldWidth:
+						return strconv.Itoa(size.Width)
+					case NameFieldHeight:
+						return strconv.Itoa(size.Height)
+					case NameFieldHash:
+						hash, ok := hashes[inputPath]
+						if !ok {
+							if hash, err = fileHash(inputPath); err != nil {
+								err = fmt.Errorf("failed to hash: %w", err)
+								return ""
+							}
+							hashes[inputPath] = hash
+						}
+						return hash
+					}
+					return placeholder
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to name %s: %w", inputPath, err)
+				}
+			}
+			if opts.OutputExt != "" {
+				ext = opts.OutputExt
+			}
+			name += ext
+			key := strings.ToLower(name) // case-insensitive file systems
+			if source, ok := sources[key]; ok && (opts.NameTemplate != "" || opts.OutputExt != "") {
+				return nil, fmt.Errorf("%s and %s have the same output name %q", source, inputPath, name)
+			}
+			sources[key] = inputPath
+			names[i][inputPath] = name
+		}
+	}
+	return names, nil
+}
+
+// fileHash returns the first 12 hex digits of the SHA-256 of the file at path.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(util.LongPath(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
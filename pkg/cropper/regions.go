@@ -0,0 +1,191 @@
+package cropper
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Max difference of a channel (0-255) of a border pixel from the border color, allowing JPEG noise
+	borderTolerance = 24
+	// Min fraction of the pixels of a line (row or column) that must match the border color
+	borderMinSolid = 0.98
+	// Solid lines of a side up to this fraction of the width / height are a border; more are the content
+	// (e.g. a plain background)
+	borderMaxTrim = 0.4
+)
+
+// RegionValue is a coordinate or length of a Region, in pixels or in percent of the image size.
+type RegionValue struct {
+	Value   float64
+	Percent bool
+}
+
+// pixels returns the value in pixels of an image of size pixels (the width or height).
+func (v RegionValue) pixels(size int) int {
+	if v.Percent {
+		return int(math.Round(v.Value * float64(size) / 100))
+	}
+	return int(math.Round(v.Value))
+}
+
+// Region is a rectangle of an image, e.g. a watermarked corner, whose values may be in percent of the image size
+// so that it applies to images of different sizes.
+type Region struct {
+	X, Y, Width, Height RegionValue
+}
+
+// ParseRegion parses a "<x>,<y>,<width>,<height>" region, each value in pixels or in percent of the image size
+// (e.g. "80%,85%,20%,15%" is the bottom right corner).
+func ParseRegion(str string) (Region, error) {
+	parts := strings.Split(str, ",")
+	if len(parts) != 4 {
+		return Region{}, fmt.Errorf("invalid region %q, must be <x>,<y>,<width>,<height>", str)
+	}
+	var values [4]RegionValue
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		number, percent := strings.CutSuffix(part, "%")
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil || value < 0 || (i >= 2 && value == 0) {
+			return Region{}, fmt.Errorf("invalid region %q: invalid value %q", str, part)
+		}
+		values[i] = RegionValue{Value: value, Percent: percent}
+	}
+	return Region{X: values[0], Y: values[1], Width: values[2], Height: values[3]}, nil
+}
+
+// Rect returns the region in the image bounds.
+func (r Region) Rect(bounds image.Rectangle) image.Rectangle {
+	x := bounds.Min.X + r.X.pixels(bounds.Dx())
+	y := bounds.Min.Y + r.Y.pixels(bounds.Dy())
+	return image.Rect(x, y, x+r.Width.pixels(bounds.Dx()), y+r.Height.pixels(bounds.Dy())).Intersect(bounds)
+}
+
+// contentBounds returns the bounds of img that crop windows are searched in: without the solid borders
+// (e.g. letterbox bars) if the TrimBorders option is set, else the image bounds.
+func (opts *Options) contentBounds(img image.Image) image.Rectangle {
+	if !opts.TrimBorders {
+		return img.Bounds()
+	}
+	return trimBorders(img)
+}
+
+// findCrop returns the best (smartcrop) crop window of size's aspect ratio in the bounds of img
+// (see contentBounds). The IgnoreBorder strips of bounds and the ExcludeRegions of img are masked
+// (filled with their average color) for the analysis, so they don't attract the window.
+func (opts *Options) findCrop(img image.Image, bounds image.Rectangle, size Size) (image.Rectangle, error) {
+	if bounds == img.Bounds() && opts.IgnoreBorder <= 0 && len(opts.ExcludeRegions) == 0 {
+		return FindCrop(img, size.Width, size.Height)
+	}
+	analysis := imaging.Crop(img, bounds) // at the origin
+	var masks []image.Rectangle
+	if b := opts.IgnoreBorder; b > 0 {
+		w, h := bounds.Dx(), bounds.Dy()
+		masks = append(masks, image.Rect(0, 0, w, b), image.Rect(0, h-b, w, h),
+			image.Rect(0, 0, b, h), image.Rect(w-b, 0, w, h))
+	}
+	for _, region := range opts.ExcludeRegions {
+		masks = append(masks, region.Rect(img.Bounds()).Sub(bounds.Min))
+	}
+	for _, mask := range masks {
+		if mask = mask.Intersect(analysis.Bounds()); !mask.Empty() {
+			draw.Draw(analysis, mask, image.NewUniform(averageColor(analysis, mask)), image.Point{}, draw.Src)
+		}
+	}
+	rect, err := FindCrop(analysis, size.Width, size.Height)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return rect.Add(bounds.Min), nil
+}
+
+// averageColor returns the average color of the rect region of img.
+func averageColor(img *image.NRGBA, rect image.Rectangle) color.NRGBA {
+	var sum [4]uint64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			sum[0] += uint64(c.R)
+			sum[1] += uint64(c.G)
+			sum[2] += uint64(c.B)
+			sum[3] += uint64(c.A)
+		}
+	}
+	n := uint64(rect.Dx() * rect.Dy())
+	return color.NRGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+}
+
+// trimBorders returns the bounds of img without the solid-color lines (e.g. letterbox or pillarbox bars,
+// scanner margins) of each side, at most borderMaxTrim of the size. The color of the border of a side is the one
+// of its outermost line.
+func trimBorders(img image.Image) image.Rectangle {
+	bounds := img.Bounds()
+	type side struct {
+		count int // the number of lines
+		// line returns the start, direction and length of the i-th row (or column) from the side
+		line func(i int) (x0, y0, dx, dy, length int)
+	}
+	w, h := bounds.Dx(), bounds.Dy()
+	sides := []side{
+		{h, func(i int) (int, int, int, int, int) { return bounds.Min.X, bounds.Min.Y + i, 1, 0, w }},     // top
+		{h, func(i int) (int, int, int, int, int) { return bounds.Min.X, bounds.Max.Y - 1 - i, 1, 0, w }}, // bottom
+		{w, func(i int) (int, int, int, int, int) { return bounds.Min.X + i, bounds.Min.Y, 0, 1, h }},     // left
+		{w, func(i int) (int, int, int, int, int) { return bounds.Max.X - 1 - i, bounds.Min.Y, 0, 1, h }}, // right
+	}
+	var trims [4]int
+	for s, side := range sides {
+		x0, y0, dx, dy, length := side.line(0)
+		border := lineColor(img, x0, y0, dx, dy, length)
+		maxTrim := int(float64(side.count) * borderMaxTrim)
+		for trims[s] <= maxTrim {
+			x0, y0, dx, dy, length = side.line(trims[s])
+			if !isSolidLine(img, x0, y0, dx, dy, length, border) {
+				break
+			}
+			trims[s]++
+		}
+		if trims[s] > maxTrim {
+			trims[s] = 0
+		}
+	}
+	return image.Rect(bounds.Min.X+trims[2], bounds.Min.Y+trims[0], bounds.Max.X-trims[3], bounds.Max.Y-trims[1])
+}
+
+// lineColor returns the average color of the line of length pixels from (x0, y0) in the (dx, dy) direction.
+func lineColor(img image.Image, x0, y0, dx, dy, length int) [3]float64 {
+	var sum [3]float64
+	for i := range length {
+		r, g, b, _ := img.At(x0+i*dx, y0+i*dy).RGBA()
+		sum[0] += float64(r >> 8)
+		sum[1] += float64(g >> 8)
+		sum[2] += float64(b >> 8)
+	}
+	for i := range sum {
+		sum[i] /= float64(length)
+	}
+	return sum
+}
+
+// isSolidLine reports whether nearly all (borderMinSolid) pixels of the line are of the border color.
+func isSolidLine(img image.Image, x0, y0, dx, dy, length int, border [3]float64) bool {
+	mismatches := 0
+	maxMismatches := int(float64(length) * (1 - borderMinSolid))
+	for i := range length {
+		r, g, b, _ := img.At(x0+i*dx, y0+i*dy).RGBA()
+		if math.Abs(float64(r>>8)-border[0]) > borderTolerance || math.Abs(float64(g>>8)-border[1]) > borderTolerance ||
+			math.Abs(float64(b>>8)-border[2]) > borderTolerance {
+			if mismatches++; mismatches > maxMismatches {
+				return false
+			}
+		}
+	}
+	return true
+}
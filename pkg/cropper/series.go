@@ -0,0 +1,88 @@
+package cropper
+
+import (
+	"image"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sagan/goaider/util"
+)
+
+// seriesSuffixRegexp matches the sequence number suffix of a file name in a series, e.g. "-003" of "burst-003".
+var seriesSuffixRegexp = regexp.MustCompile(`[-_. ]*(\(\d+\)|\d+)$`)
+
+// SeriesByDir is a series key func: all images in the same dir are a series.
+func SeriesByDir(path string) string {
+	return filepath.Dir(path)
+}
+
+// SeriesByPrefix is a series key func: the images in the same dir whose file names only differ
+// in the trailing sequence number (e.g. "burst-001.jpg", "burst-002.jpg") are a series.
+func SeriesByPrefix(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return filepath.Join(filepath.Dir(path), seriesSuffixRegexp.ReplaceAllString(name, ""))
+}
+
+// seriesCropper finds the crop windows of images of series. The window of an image is the one of the same size
+// centered at the same relative position as the best crop window of the first image of its series.
+type seriesCropper struct {
+	opts    *Options
+	key     func(path string) string
+	first   map[string]string     // series key => the path of the first image
+	centers map[string][2]float64 // series key + size => relative center of the crop window of the first image
+}
+
+func newSeriesCropper(paths []string, opts *Options) *seriesCropper {
+	s := &seriesCropper{opts: opts, key: opts.SeriesKey, first: map[string]string{}, centers: map[string][2]float64{}}
+	for _, path := range paths {
+		if k := s.key(path); s.first[k] == "" {
+			s.first[k] = path
+		}
+	}
+	return s
+}
+
+// FindCrop returns the crop window of size's aspect ratio in bounds (see Options.contentBounds) of img,
+// the image at path.
+func (s *seriesCropper) FindCrop(path string, img image.Image, bounds image.Rectangle,
+	size Size) (image.Rectangle, error) {
+	key := s.key(path)
+	centerKey := key + "\x00" + size.String()
+	center, ok := s.centers[centerKey]
+	if !ok {
+		// The first image may be skipped (its output is up to date) or fail, so it's loaded here if needed.
+		// If it can't be loaded, the current image becomes the first one of the series.
+		firstImg, firstBounds := img, bounds
+		if first := s.first[key]; first != "" && first != path {
+			if i, _, err := util.LoadImage(first); err == nil {
+				firstImg, firstBounds = i, s.opts.contentBounds(i)
+			}
+		}
+		rect, err := s.opts.findCrop(firstImg, firstBounds, size)
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		center = [2]float64{
+			(float64(rect.Min.X+rect.Max.X)/2 - float64(firstBounds.Min.X)) / float64(firstBounds.Dx()),
+			(float64(rect.Min.Y+rect.Max.Y)/2 - float64(firstBounds.Min.Y)) / float64(firstBounds.Dy()),
+		}
+		s.centers[centerKey] = center
+	}
+	cropWidth, cropHeight := cropSize(bounds, size.Width, size.Height)
+	x := clamp(int(math.Round(center[0]*float64(bounds.Dx())))-cropWidth/2, 0, bounds.Dx()-cropWidth)
+	y := clamp(int(math.Round(center[1]*float64(bounds.Dy())))-cropHeight/2, 0, bounds.Dy()-cropHeight)
+	return image.Rect(x, y, x+cropWidth, y+cropHeight).Add(bounds.Min), nil
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,262 @@
+// Package embedder computes image and text embeddings with a local CLIP or SigLIP model (an ONNX export,
+// run by the onnxruntime shared library), for similarity based dataset curation.
+package embedder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/pflag"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// ErrNoTextModel is returned by EmbedText of models without a (supported) text encoder.
+var ErrNoTextModel = errors.New("the embedding model has no text encoder with a CLIP tokenizer")
+
+// Embedder computes the L2-normalized embeddings of images and texts in the same space,
+// so that the dot product of two embeddings is their cosine similarity.
+type Embedder interface {
+	EmbedImage(img image.Image) ([]float32, error)
+	// EmbedText returns ErrNoTextModel if the model has no text encoder
+	EmbedText(text string) ([]float32, error)
+	// Close frees the resources of the model
+	Close() error
+}
+
+// Options are the options of the local embedding model, set by the --embed-model and --onnxruntime-lib flags.
+type Options struct {
+	// Dir of the model: "vision_model.onnx" and optionally "text_model.onnx" (directly or in an "onnx" subdir),
+	// "preprocessor_config.json" and "tokenizer.json", as in the Hugging Face ONNX exports
+	// (e.g. Xenova/clip-vit-base-patch32). Default: the GOAIDER_EMBED_MODEL env
+	ModelDir string
+	// Path of the onnxruntime shared library. Default: the ONNXRUNTIME_LIB env, or the library in the system path
+	LibPath string
+}
+
+// AddFlags registers the embedding model flags to flags.
+func (o *Options) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.ModelDir, "embed-model", "", "Dir of the local embedding model: an ONNX export of CLIP or SigLIP "+
+		"(e.g. of https://huggingface.co/Xenova/clip-vit-base-patch32). default: the "+constants.ENV_EMBED_MODEL+" env")
+	flags.StringVar(&o.LibPath, "onnxruntime-lib", "", "Path of the onnxruntime shared library "+
+		"(https://github.com/microsoft/onnxruntime/releases). default: the "+constants.ENV_ONNXRUNTIME_LIB+
+		" env, or "+defaultLibName()+" in the system library path")
+}
+
+// Configured reports whether the local embedding model is set, by --embed-model or the env.
+func (o *Options) Configured() bool {
+	return o.ModelDir != "" || os.Getenv(constants.ENV_EMBED_MODEL) != ""
+}
+
+func (o *Options) modelDir() (string, error) {
+	dir := o.ModelDir
+	if dir == "" {
+		dir = os.Getenv(constants.ENV_EMBED_MODEL)
+	}
+	if dir == "" {
+		return "", errs.New(errs.ExitConfig, "no embedding model: set --embed-model or the %s env to the dir of "+
+			"an ONNX export of CLIP or SigLIP, e.g. of https://huggingface.co/Xenova/clip-vit-base-patch32",
+			constants.ENV_EMBED_MODEL)
+	}
+	return dir, nil
+}
+
+func (o *Options) libPath() string {
+	if o.LibPath != "" {
+		return o.LibPath
+	}
+	if path := os.Getenv(constants.ENV_ONNXRUNTIME_LIB); path != "" {
+		return path
+	}
+	return defaultLibName()
+}
+
+func defaultLibName() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "onnxruntime.dll"
+	case "darwin":
+		return "libonnxruntime.dylib"
+	default:
+		return "libonnxruntime.so"
+	}
+}
+
+// findModelFile returns the path of the first of names that exists in dir or its "onnx" subdir, or "".
+func findModelFile(dir string, names ...string) string {
+	for _, name := range names {
+		for _, path := range []string{filepath.Join(dir, name), filepath.Join(dir, "onnx", name)} {
+			if _, err := os.Stat(util.LongPath(path)); err == nil {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// EmbedImageFile returns the embedding of the image file at path.
+func EmbedImageFile(e Embedder, path string) ([]float32, error) {
+	img, _, err := util.LoadImage(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.EmbedImage(img)
+}
+
+// Similarity returns the cosine similarity of the normalized embeddings a and b.
+func Similarity(a, b []float32) float64 {
+	var sum float64
+	for i := range min(len(a), len(b)) {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// MaxSimilarity returns the max cosine similarity of the normalized embedding v to refs, and the index of the
+// most similar one. It returns (-1, -1) if refs is empty.
+func MaxSimilarity(v []float32, refs [][]float32) (float64, int) {
+	best, index := -1.0, -1
+	for i, ref := range refs {
+		if s := Similarity(v, ref); s > best {
+			best, index = s, i
+		}
+	}
+	return best, index
+}
+
+// Normalize scales v to unit length in place and returns it.
+func Normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+// preprocessConfig is the image preprocessing of a model ("preprocessor_config.json" of Hugging Face).
+type preprocessConfig struct {
+	// Resize the shortest side to ShortestEdge, or else the image to Width x Height
+	ShortestEdge  int
+	Width, Height int
+	// Center crop to CropWidth x CropHeight. 0 = no crop
+	CropWidth, CropHeight int
+	Mean, Std             [3]float32
+}
+
+// The preprocessing of CLIP, used if the model has no preprocessor_config.json
+var clipPreprocess = &preprocessConfig{
+	ShortestEdge: 224,
+	CropWidth:    224,
+	CropHeight:   224,
+	Mean:         [3]float32{0.48145466, 0.4578275, 0.40821073},
+	Std:          [3]float32{0.26862954, 0.26130258, 0.27577711},
+}
+
+// loadPreprocessConfig reads the preprocessor_config.json of the model dir, or returns clipPreprocess if it
+// doesn't exist.
+func loadPreprocessConfig(dir string) (*preprocessConfig, error) {
+	data, err := os.ReadFile(util.LongPath(filepath.Join(dir, "preprocessor_config.json")))
+	if errors.Is(err, os.ErrNotExist) {
+		return clipPreprocess, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Size         json.RawMessage `json:"size"`
+		CropSize     json.RawMessage `json:"crop_size"`
+		DoCenterCrop *bool           `json:"do_center_crop"`
+		ImageMean    []float32       `json:"image_mean"`
+		ImageStd     []float32       `json:"image_std"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid preprocessor_config.json: %w", err)
+	}
+	config := &preprocessConfig{Mean: clipPreprocess.Mean, Std: clipPreprocess.Std}
+	if len(raw.ImageMean) == 3 && len(raw.ImageStd) == 3 {
+		copy(config.Mean[:], raw.ImageMean)
+		copy(config.Std[:], raw.ImageStd)
+	}
+	// The size is an int (the shortest edge) or an object of "shortest_edge" or "height" and "width"
+	var size struct {
+		ShortestEdge int `json:"shortest_edge"`
+		Height       int `json:"height"`
+		Width        int `json:"width"`
+	}
+	if json.Unmarshal(raw.Size, &size.ShortestEdge) != nil {
+		json.Unmarshal(raw.Size, &size)
+	}
+	config.ShortestEdge, config.Width, config.Height = size.ShortestEdge, size.Width, size.Height
+	if config.ShortestEdge == 0 && (config.Width == 0 || config.Height == 0) {
+		config.ShortestEdge = clipPreprocess.ShortestEdge
+	}
+	if raw.DoCenterCrop == nil || *raw.DoCenterCrop {
+		var crop struct {
+			Height int `json:"height"`
+			Width  int `json:"width"`
+		}
+		if json.Unmarshal(raw.CropSize, &crop.Height) == nil {
+			crop.Width = crop.Height
+		} else {
+			json.Unmarshal(raw.CropSize, &crop)
+		}
+		config.CropWidth, config.CropHeight = crop.Width, crop.Height
+	}
+	if config.CropWidth == 0 && config.ShortestEdge > 0 {
+		config.CropWidth, config.CropHeight = config.ShortestEdge, config.ShortestEdge
+	}
+	return config, nil
+}
+
+// inputSize returns the width and height of the preprocessed images.
+func (c *preprocessConfig) inputSize() (int, int) {
+	if c.CropWidth > 0 {
+		return c.CropWidth, c.CropHeight
+	}
+	return c.Width, c.Height
+}
+
+// pixelValues returns the preprocessed img as the normalized float RGB values of a 1 x 3 x height x width tensor.
+func (c *preprocessConfig) pixelValues(img image.Image) []float32 {
+	bounds := img.Bounds()
+	if c.ShortestEdge > 0 {
+		width, height := c.ShortestEdge, 0
+		if bounds.Dx() > bounds.Dy() {
+			width, height = 0, c.ShortestEdge
+		}
+		img = imaging.Resize(img, width, height, imaging.CatmullRom)
+	} else {
+		img = imaging.Resize(img, c.Width, c.Height, imaging.CatmullRom)
+	}
+	if c.CropWidth > 0 {
+		img = imaging.CropCenter(img, c.CropWidth, c.CropHeight)
+	}
+	nrgba := imaging.Clone(img)
+	width, height := c.inputSize()
+	values := make([]float32, 3*width*height)
+	for y := range height {
+		for x := range width {
+			p := nrgba.Pix[y*nrgba.Stride+x*4:]
+			for ch := range 3 {
+				values[ch*width*height+y*width+x] = (float32(p[ch])/255 - c.Mean[ch]) / c.Std[ch]
+			}
+		}
+	}
+	return values
+}
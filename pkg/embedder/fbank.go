@@ -0,0 +1,166 @@
+package embedder
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// The Kaldi-compatible log mel filterbank features of the speaker models (as of WeSpeaker and 3D-Speaker)
+const (
+	fbankSampleRate = 16000
+	fbankBins       = 80
+	fbankFrameLen   = 400 // 25 ms
+	fbankFrameShift = 160 // 10 ms
+	fbankFFTSize    = 512
+	fbankPreemph    = 0.97
+	fbankLowFreq    = 20
+)
+
+// resample returns the samples at sampleRate resampled to toRate by linear interpolation.
+func resample(samples []float64, sampleRate, toRate int) []float64 {
+	if sampleRate == toRate || len(samples) == 0 {
+		return samples
+	}
+	n := int(int64(len(samples)) * int64(toRate) / int64(sampleRate))
+	out := make([]float64, n)
+	ratio := float64(sampleRate) / float64(toRate)
+	for i := range out {
+		pos := float64(i) * ratio
+		j := int(pos)
+		if j+1 >= len(samples) {
+			out[i] = samples[len(samples)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		out[i] = samples[j]*(1-frac) + samples[j+1]*frac
+	}
+	return out
+}
+
+// fbank returns the log mel filterbank features (frames x fbankBins, row-major) of the 16 kHz samples
+// (in [-1, 1]), with the mean of each bin subtracted (CMN), and the number of frames.
+func fbank(samples []float64) ([]float32, int) {
+	if len(samples) < fbankFrameLen {
+		return nil, 0
+	}
+	frames := 1 + (len(samples)-fbankFrameLen)/fbankFrameShift
+	window := make([]float64, fbankFrameLen)
+	for i := range window {
+		// The "povey" window of Kaldi
+		window[i] = math.Pow(0.5-0.5*math.Cos(2*math.Pi*float64(i)/float64(fbankFrameLen-1)), 0.85)
+	}
+	filters := melFilters()
+	features := make([]float32, frames*fbankBins)
+	frame := make([]float64, fbankFrameLen)
+	spectrum := make([]complex128, fbankFFTSize)
+	for f := range frames {
+		// Kaldi works on 16-bit integer sample values
+		var mean float64
+		for i := range frame {
+			frame[i] = samples[f*fbankFrameShift+i] * (1 << 15)
+			mean += frame[i]
+		}
+		mean /= fbankFrameLen
+		for i := range frame {
+			frame[i] -= mean
+		}
+		for i := fbankFrameLen - 1; i > 0; i-- {
+			frame[i] -= fbankPreemph * frame[i-1]
+		}
+		frame[0] -= fbankPreemph * frame[0]
+		for i := range spectrum {
+			spectrum[i] = 0
+			if i < fbankFrameLen {
+				spectrum[i] = complex(frame[i]*window[i], 0)
+			}
+		}
+		fft(spectrum)
+		for b, filter := range filters {
+			var energy float64
+			for k, w := range filter.weights {
+				energy += w * math.Pow(cmplx.Abs(spectrum[filter.start+k]), 2)
+			}
+			features[f*fbankBins+b] = float32(math.Log(math.Max(energy, math.SmallestNonzeroFloat32)))
+		}
+	}
+	for b := range fbankBins {
+		var mean float32
+		for f := range frames {
+			mean += features[f*fbankBins+b]
+		}
+		mean /= float32(frames)
+		for f := range frames {
+			features[f*fbankBins+b] -= mean
+		}
+	}
+	return features, frames
+}
+
+// melFilter is a triangular filter of the mel filterbank: its weights of the FFT bins from start.
+type melFilter struct {
+	start   int
+	weights []float64
+}
+
+// melFilters returns the fbankBins triangular filters between fbankLowFreq and the Nyquist frequency,
+// equally spaced on the mel scale.
+func melFilters() []melFilter {
+	mel := func(hz float64) float64 { return 1127 * math.Log(1+hz/700) }
+	low, high := mel(fbankLowFreq), mel(fbankSampleRate/2)
+	delta := (high - low) / (fbankBins + 1)
+	binHz := float64(fbankSampleRate) / fbankFFTSize
+	filters := make([]melFilter, fbankBins)
+	for b := range filters {
+		left, center, right := low+float64(b)*delta, low+float64(b+1)*delta, low+float64(b+2)*delta
+		filters[b].start = -1
+		for k := 0; k < fbankFFTSize/2; k++ {
+			m := mel(binHz * float64(k))
+			var w float64
+			if m > left && m < right {
+				if m <= center {
+					w = (m - left) / (center - left)
+				} else {
+					w = (right - m) / (right - center)
+				}
+			}
+			if w > 0 {
+				if filters[b].start == -1 {
+					filters[b].start = k
+				}
+				filters[b].weights = append(filters[b].weights, w)
+			} else if filters[b].start != -1 {
+				break
+			}
+		}
+		if filters[b].start == -1 {
+			filters[b].start = 0
+		}
+	}
+	return filters
+}
+
+// fft computes the discrete Fourier transform of x (of a power of 2 length) in place.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package embedder
+
+import (
+	"math"
+	"math/rand/v2"
+)
+
+// KMeans groups the normalized embeddings vectors into k clusters by spherical k-means (the cosine similarity),
+// initialized by k-means++ with the random seed. It returns the cluster of each vector and the normalized
+// centroids of the clusters. k is capped to len(vectors).
+func KMeans(vectors [][]float32, k int, seed uint64, maxIterations int) (assignments []int, centroids [][]float32) {
+	k = min(k, len(vectors))
+	if k <= 0 {
+		return nil, nil
+	}
+	rng := rand.New(rand.NewPCG(seed, seed))
+	centroids = kmeansPlusPlus(vectors, k, rng)
+	assignments = make([]int, len(vectors))
+	for i := range assignments {
+		assignments[i] = -1
+	}
+	for range maxIterations {
+		changed := false
+		for i, v := range vectors {
+			if _, c := MaxSimilarity(v, centroids); c != assignments[i] {
+				assignments[i] = c
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		dimensions := len(vectors[0])
+		sums := make([][]float32, k)
+		counts := make([]int, k)
+		for i, v := range vectors {
+			c := assignments[i]
+			if sums[c] == nil {
+				sums[c] = make([]float32, dimensions)
+			}
+			for j := range min(dimensions, len(v)) {
+				sums[c][j] += v[j]
+			}
+			counts[c]++
+		}
+		for c := range centroids {
+			if counts[c] == 0 {
+				// Re-seed an empty cluster with the vector farthest from its centroid
+				farthest, best := 0, math.Inf(1)
+				for i, v := range vectors {
+					if s := Similarity(v, centroids[assignments[i]]); s < best {
+						farthest, best = i, s
+					}
+				}
+				centroids[c] = vectors[farthest]
+				assignments[farthest] = c
+				continue
+			}
+			centroids[c] = Normalize(sums[c])
+		}
+	}
+	return assignments, centroids
+}
+
+// kmeansPlusPlus picks k of vectors as the initial centroids: the first at random, and each next one with
+// the probability proportional to its squared distance to the nearest picked centroid.
+func kmeansPlusPlus(vectors [][]float32, k int, rng *rand.Rand) [][]float32 {
+	centroids := [][]float32{vectors[rng.IntN(len(vectors))]}
+	distances := make([]float64, len(vectors))
+	for len(centroids) < k {
+		total := 0.0
+		for i, v := range vectors {
+			// The squared euclidean distance of normalized vectors
+			similarity, _ := MaxSimilarity(v, centroids)
+			distances[i] = max(0, 2-2*similarity)
+			total += distances[i]
+		}
+		next := len(vectors) - 1
+		if total == 0 {
+			// All the vectors are identical to the picked ones
+			next = rng.IntN(len(vectors))
+		} else {
+			target := rng.Float64() * total
+			for i, d := range distances {
+				if target -= d; target < 0 {
+					next = i
+					break
+				}
+			}
+		}
+		centroids = append(centroids, vectors[next])
+	}
+	return centroids
+}
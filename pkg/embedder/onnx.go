@@ -0,0 +1,184 @@
+//go:build cgo
+
+package embedder
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/sagan/goaider/errs"
+)
+
+var (
+	initOnce sync.Once
+	initErr  error
+)
+
+// onnxEmbedder runs the vision (and text) model of CLIP or SigLIP with onnxruntime.
+type onnxEmbedder struct {
+	mu         sync.Mutex
+	vision     *model
+	text       *model // nil = no text encoder
+	preprocess *preprocessConfig
+	tokenizer  *tokenizer
+}
+
+// model is an ONNX model session, with its input and output names.
+type model struct {
+	session *ort.DynamicAdvancedSession
+	inputs  []string
+	output  string
+}
+
+// New loads the local embedding model of opts. The text encoder is optional.
+func New(opts *Options) (Embedder, error) {
+	dir, err := opts.modelDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := initRuntime(opts.libPath()); err != nil {
+		return nil, err
+	}
+	visionPath := findModelFile(dir, "vision_model.onnx", "vision_model_quantized.onnx")
+	if visionPath == "" {
+		return nil, errs.New(errs.ExitConfig, "no vision_model.onnx in the embedding model dir %q", dir)
+	}
+	e := &onnxEmbedder{}
+	if e.preprocess, err = loadPreprocessConfig(dir); err != nil {
+		return nil, errs.Wrap(errs.ExitConfig, err)
+	}
+	if e.vision, err = loadModel(visionPath, []string{"pixel_values"},
+		[]string{"image_embeds", "pooler_output"}); err != nil {
+		return nil, err
+	}
+	if textPath := findModelFile(dir, "text_model.onnx", "text_model_quantized.onnx"); textPath != "" {
+		// Only the text encoders with a CLIP tokenizer are supported
+		if e.tokenizer, err = loadTokenizer(filepath.Join(dir, "tokenizer.json")); err == nil {
+			if e.text, err = loadModel(textPath, []string{"input_ids", "attention_mask"},
+				[]string{"text_embeds", "pooler_output"}); err != nil {
+				e.Close()
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// initRuntime loads the onnxruntime shared library at libPath, once.
+func initRuntime(libPath string) error {
+	initOnce.Do(func() {
+		ort.SetSharedLibraryPath(libPath)
+		if err := ort.InitializeEnvironment(); err != nil {
+			initErr = errs.New(errs.ExitConfig, "failed to load the onnxruntime library %q (set --onnxruntime-lib): %w",
+				libPath, err)
+		}
+	})
+	return initErr
+}
+
+// loadModel creates the session of the ONNX model file at path. The model must have the first of inputs,
+// and may have the others. The output is the first of the preferred outputs that it has, or its first output.
+func loadModel(path string, inputs []string, outputs []string) (*model, error) {
+	inputInfos, outputInfos, err := ort.GetInputOutputInfo(path)
+	if err != nil {
+		return nil, errs.New(errs.ExitConfig, "failed to load the model %q: %w", path, err)
+	}
+	m := &model{}
+	for i, name := range inputs {
+		if slices.ContainsFunc(inputInfos, func(info ort.InputOutputInfo) bool { return info.Name == name }) {
+			m.inputs = append(m.inputs, name)
+		} else if i == 0 {
+			return nil, errs.New(errs.ExitConfig, "the model %q has no %q input", path, name)
+		}
+	}
+	if len(outputInfos) == 0 {
+		return nil, errs.New(errs.ExitConfig, "the model %q has no output", path)
+	}
+	m.output = outputInfos[0].Name
+	for _, name := range slices.Backward(outputs) {
+		if slices.ContainsFunc(outputInfos, func(info ort.InputOutputInfo) bool { return info.Name == name }) {
+			m.output = name
+		}
+	}
+	if m.session, err = ort.NewDynamicAdvancedSession(path, m.inputs, []string{m.output}, nil); err != nil {
+		return nil, errs.New(errs.ExitConfig, "failed to load the model %q: %w", path, err)
+	}
+	return m, nil
+}
+
+// run runs the model with the inputs and returns the normalized first row of its output.
+func (m *model) run(inputs ...ort.Value) ([]float32, error) {
+	outputs := []ort.Value{nil}
+	if err := m.session.Run(inputs, outputs); err != nil {
+		return nil, err
+	}
+	defer outputs[0].Destroy()
+	tensor, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, fmt.Errorf("unsupported %s output of the model", outputs[0].GetONNXType())
+	}
+	shape := tensor.GetShape()
+	if len(shape) != 2 {
+		return nil, fmt.Errorf("unsupported output shape %v of the model, expect [batch, dimensions]", shape)
+	}
+	return Normalize(slices.Clone(tensor.GetData()[:shape[1]])), nil
+}
+
+func (e *onnxEmbedder) EmbedImage(img image.Image) ([]float32, error) {
+	width, height := e.preprocess.inputSize()
+	input, err := ort.NewTensor(ort.NewShape(1, 3, int64(height), int64(width)), e.preprocess.pixelValues(img))
+	if err != nil {
+		return nil, err
+	}
+	defer input.Destroy()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vision.run(input)
+}
+
+func (e *onnxEmbedder) EmbedText(text string) ([]float32, error) {
+	if e.text == nil {
+		return nil, ErrNoTextModel
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := e.tokenizer.encode(text)
+	shape := ort.NewShape(1, int64(len(ids)))
+	var inputs []ort.Value
+	defer func() {
+		for _, input := range inputs {
+			input.Destroy()
+		}
+	}()
+	for _, name := range e.text.inputs {
+		data := ids
+		if name == "attention_mask" {
+			data = make([]int64, len(ids))
+			for i := range data {
+				data[i] = 1
+			}
+		}
+		input, err := ort.NewTensor(shape, data)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+	return e.text.run(inputs...)
+}
+
+func (e *onnxEmbedder) Close() error {
+	var err error
+	for _, m := range []*model{e.vision, e.text} {
+		if m != nil && m.session != nil {
+			err = errors.Join(err, m.session.Destroy())
+		}
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package embedder
+
+import "github.com/sagan/goaider/errs"
+
+// New loads the local embedding model of opts. Builds without cgo can not load the onnxruntime library.
+func New(opts *Options) (Embedder, error) {
+	return nil, errs.New(errs.ExitConfig, "local embedding models are not supported: goaider was built without cgo")
+}
+
+// NewSpeaker loads the local speaker embedding model of opts. Builds without cgo can not load the onnxruntime library.
+func NewSpeaker(opts *SpeakerOptions) (SpeakerEmbedder, error) {
+	return nil, errs.New(errs.ExitConfig, "local speaker models are not supported: goaider was built without cgo")
+}
@@ -0,0 +1,75 @@
+package embedder
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/util"
+)
+
+// Min duration of the audio of a speaker embedding
+const minSpeakerAudio = 0.5
+
+// SpeakerEmbedder computes the L2-normalized speaker (voice) embeddings of audio, so that the dot product of
+// the embeddings of two clips is the cosine similarity of their voices.
+type SpeakerEmbedder interface {
+	// EmbedFeatures returns the embedding of the fbank features (frames x fbankBins) of 16 kHz audio
+	EmbedFeatures(features []float32, frames int) ([]float32, error)
+	// Close frees the resources of the model
+	Close() error
+}
+
+// SpeakerOptions are the options of the local speaker embedding model, set by the --speaker-model
+// and --onnxruntime-lib flags.
+type SpeakerOptions struct {
+	// Path of the model: an ONNX export of a speaker verification model whose input is the 80-bin log mel
+	// filterbank features [batch, frames, 80] of 16 kHz audio (e.g. the WeSpeaker ResNet or ECAPA-TDNN models).
+	// Default: the GOAIDER_SPEAKER_MODEL env
+	ModelPath string
+	// Path of the onnxruntime shared library. Default: the ONNXRUNTIME_LIB env, or the library in the system path
+	LibPath string
+}
+
+// AddFlags registers the speaker model flags to flags.
+func (o *SpeakerOptions) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.ModelPath, "speaker-model", "", "Path of the local speaker embedding model: an ONNX export "+
+		"of a WeSpeaker-style model taking 80-bin fbank features (e.g. of https://huggingface.co/Wespeaker). "+
+		"default: the "+constants.ENV_SPEAKER_MODEL+" env")
+	flags.StringVar(&o.LibPath, "onnxruntime-lib", "", "Path of the onnxruntime shared library "+
+		"(https://github.com/microsoft/onnxruntime/releases). default: the "+constants.ENV_ONNXRUNTIME_LIB+
+		" env, or "+defaultLibName()+" in the system library path")
+}
+
+func (o *SpeakerOptions) modelPath() (string, error) {
+	path := o.ModelPath
+	if path == "" {
+		path = os.Getenv(constants.ENV_SPEAKER_MODEL)
+	}
+	if path == "" {
+		return "", errs.New(errs.ExitConfig, "no speaker model: set --speaker-model or the %s env to the path of "+
+			"an ONNX export of a speaker embedding model, e.g. of https://huggingface.co/Wespeaker",
+			constants.ENV_SPEAKER_MODEL)
+	}
+	return path, nil
+}
+
+func (o *SpeakerOptions) libPath() string {
+	return (&Options{LibPath: o.LibPath}).libPath()
+}
+
+// EmbedAudioFile returns the speaker embedding of the wav file at path, downmixed to mono and resampled to 16 kHz.
+func EmbedAudioFile(e SpeakerEmbedder, path string) ([]float32, error) {
+	samples, info, err := util.ReadWavMono(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Duration() < minSpeakerAudio {
+		return nil, fmt.Errorf("too short (%.2fs) for a speaker embedding", info.Duration())
+	}
+	features, frames := fbank(resample(samples, int(info.SampleRate), fbankSampleRate))
+	return e.EmbedFeatures(features, frames)
+}
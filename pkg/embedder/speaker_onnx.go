@@ -0,0 +1,61 @@
+//go:build cgo
+
+package embedder
+
+import (
+	"fmt"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/sagan/goaider/errs"
+)
+
+// onnxSpeakerEmbedder runs a speaker embedding model with onnxruntime.
+type onnxSpeakerEmbedder struct {
+	mu    sync.Mutex
+	model *model
+}
+
+// NewSpeaker loads the local speaker embedding model of opts.
+func NewSpeaker(opts *SpeakerOptions) (SpeakerEmbedder, error) {
+	path, err := opts.modelPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := initRuntime(opts.libPath()); err != nil {
+		return nil, err
+	}
+	// The input is "feats" in WeSpeaker exports, other names of the single input are accepted too
+	inputInfos, _, err := ort.GetInputOutputInfo(path)
+	if err != nil {
+		return nil, errs.New(errs.ExitConfig, "failed to load the model %q: %w", path, err)
+	}
+	if len(inputInfos) != 1 {
+		return nil, errs.New(errs.ExitConfig, "the speaker model %q has %d inputs, expect one (the fbank features)",
+			path, len(inputInfos))
+	}
+	m, err := loadModel(path, []string{inputInfos[0].Name}, []string{"embs", "embedding", "embeddings"})
+	if err != nil {
+		return nil, err
+	}
+	return &onnxSpeakerEmbedder{model: m}, nil
+}
+
+func (e *onnxSpeakerEmbedder) EmbedFeatures(features []float32, frames int) ([]float32, error) {
+	if frames == 0 {
+		return nil, fmt.Errorf("no audio frames")
+	}
+	input, err := ort.NewTensor(ort.NewShape(1, int64(frames), fbankBins), features)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Destroy()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.model.run(input)
+}
+
+func (e *onnxSpeakerEmbedder) Close() error {
+	return e.model.session.Destroy()
+}
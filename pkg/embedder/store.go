@@ -0,0 +1,122 @@
+package embedder
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/sagan/goaider/util"
+)
+
+// Store is the embeddings of the files of a dataset (the embed command), saved as a NumPy .npz file of the arrays:
+// "files" (the slash-separated paths relative to the dataset dir), "mtimes" (the modification time in unix
+// nanoseconds of each file and its caption), "image" and "text" (n x dimensions float32, the rows of the files
+// without an embedding are zero), and "image_model" and "text_model" (the models of the embeddings).
+type Store struct {
+	Files  []string
+	Mtimes []int64
+	// nil if the store has no image (text) embeddings. A nil row = the file has no embedding
+	Image [][]float32
+	Text  [][]float32
+	// The models of the embeddings: "local:<model dir name>" or "gemini:<model>"
+	ImageModel string
+	TextModel  string
+}
+
+// DefaultStorePath returns the default path of the embeddings store of the dataset dir.
+func DefaultStorePath(dir string) string {
+	return filepath.Join(dir, ".goaider", "embeddings.npz")
+}
+
+// LocalModelName returns the model name of the embeddings of the local model of opts, e.g. "local:clip-vit-base-patch32".
+func LocalModelName(opts *Options) string {
+	dir, _ := opts.modelDir()
+	return "local:" + filepath.Base(filepath.Clean(dir))
+}
+
+// Index returns the index of each file of the store.
+func (s *Store) Index() map[string]int {
+	index := make(map[string]int, len(s.Files))
+	for i, file := range s.Files {
+		index[file] = i
+	}
+	return index
+}
+
+// Save saves the store to the .npz file at path.
+func (s *Store) Save(path string) error {
+	arrays := map[string]*util.NpyArray{
+		"files":       {Shape: []int{len(s.Files)}, Strings: s.Files},
+		"mtimes":      {Shape: []int{len(s.Mtimes)}, Int64: append(make([]int64, 0, len(s.Mtimes)), s.Mtimes...)},
+		"image_model": {Strings: []string{s.ImageModel}},
+		"text_model":  {Strings: []string{s.TextModel}},
+	}
+	for name, rows := range map[string][][]float32{"image": s.Image, "text": s.Text} {
+		if rows != nil {
+			arrays[name] = matrixArray(rows)
+		}
+	}
+	return util.WriteNpz(path, arrays)
+}
+
+// LoadStore loads the store from the .npz file at path.
+func LoadStore(path string) (*Store, error) {
+	arrays, err := util.ReadNpz(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{}
+	if files := arrays["files"]; files != nil {
+		s.Files = files.Strings
+	}
+	if mtimes := arrays["mtimes"]; mtimes != nil {
+		s.Mtimes = mtimes.Int64
+	}
+	if len(s.Mtimes) != len(s.Files) {
+		s.Mtimes = make([]int64, len(s.Files))
+	}
+	for name, model := range map[string]*string{"image_model": &s.ImageModel, "text_model": &s.TextModel} {
+		if array := arrays[name]; array != nil && len(array.Strings) > 0 {
+			*model = array.Strings[0]
+		}
+	}
+	for name, rows := range map[string]*[][]float32{"image": &s.Image, "text": &s.Text} {
+		array := arrays[name]
+		if array == nil {
+			continue
+		}
+		if len(array.Shape) != 2 || array.Shape[0] != len(s.Files) || array.Float32 == nil {
+			return nil, fmt.Errorf("invalid %s embeddings of shape %v in %s", name, array.Shape, path)
+		}
+		*rows = matrixRows(array)
+	}
+	return s, nil
+}
+
+// matrixArray returns the rows as a float32 matrix array. Nil rows are zero.
+func matrixArray(rows [][]float32) *util.NpyArray {
+	dimensions := 0
+	for _, row := range rows {
+		dimensions = max(dimensions, len(row))
+	}
+	data := make([]float32, len(rows)*dimensions)
+	for i, row := range rows {
+		copy(data[i*dimensions:], row)
+	}
+	return &util.NpyArray{Shape: []int{len(rows), dimensions}, Float32: data}
+}
+
+// matrixRows returns the rows of a float32 matrix array. Zero rows are nil.
+func matrixRows(array *util.NpyArray) [][]float32 {
+	rows := make([][]float32, array.Shape[0])
+	dimensions := array.Shape[1]
+	for i := range rows {
+		row := array.Float32[i*dimensions : (i+1)*dimensions]
+		for _, v := range row {
+			if v != 0 {
+				rows[i] = row
+				break
+			}
+		}
+	}
+	return rows
+}
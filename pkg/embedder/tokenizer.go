@@ -0,0 +1,144 @@
+package embedder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/sagan/goaider/util"
+)
+
+// Max number of tokens (including the start and end tokens) of the CLIP text encoder
+const clipMaxTokens = 77
+
+const (
+	clipStartToken = "<|startoftext|>"
+	clipEndToken   = "<|endoftext|>"
+)
+
+// The pre-tokenization of CLIP: the words, digits and punctuation runs of the lowercase text
+var clipWordRegexp = regexp.MustCompile(`'s|'t|'re|'ve|'m|'ll|'d|\p{L}+|\p{N}|[^\s\p{L}\p{N}]+`)
+
+// tokenizer is the byte level BPE tokenizer of CLIP, loaded from the tokenizer.json of Hugging Face.
+type tokenizer struct {
+	vocab     map[string]int64
+	ranks     map[[2]string]int // the rank (priority) of each merge
+	byteRunes [256]rune         // the unicode char of each byte (the bytes_to_unicode of GPT-2)
+	start     int64
+	end       int64
+	cache     map[string][]string
+}
+
+// loadTokenizer reads the tokenizer.json file at path, which must be a CLIP (BPE) tokenizer.
+func loadTokenizer(path string) (*tokenizer, error) {
+	data, err := os.ReadFile(util.LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Model struct {
+			Type   string            `json:"type"`
+			Vocab  map[string]int64  `json:"vocab"`
+			Merges []json.RawMessage `json:"merges"`
+		} `json:"model"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid tokenizer.json: %w", err)
+	}
+	t := &tokenizer{vocab: raw.Model.Vocab, ranks: map[[2]string]int{}, cache: map[string][]string{}}
+	var ok1, ok2 bool
+	t.start, ok1 = t.vocab[clipStartToken]
+	t.end, ok2 = t.vocab[clipEndToken]
+	if raw.Model.Type != "BPE" || !ok1 || !ok2 {
+		return nil, ErrNoTextModel
+	}
+	// A merge is "a b" (older tokenizers) or ["a", "b"]
+	for i, merge := range raw.Model.Merges {
+		var pair [2]string
+		var s string
+		if json.Unmarshal(merge, &s) == nil {
+			a, b, found := strings.Cut(s, " ")
+			if !found {
+				continue
+			}
+			pair = [2]string{a, b}
+		} else if json.Unmarshal(merge, &pair) != nil {
+			continue
+		}
+		t.ranks[pair] = i
+	}
+	// Printable bytes map to themselves, the others to the unicode chars from 256
+	n := 0
+	for b := range 256 {
+		if (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF) {
+			t.byteRunes[b] = rune(b)
+		} else {
+			t.byteRunes[b] = rune(256 + n)
+			n++
+		}
+	}
+	return t, nil
+}
+
+// encode returns the token ids of text, with the start and end tokens, truncated to clipMaxTokens.
+func (t *tokenizer) encode(text string) []int64 {
+	ids := []int64{t.start}
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	for _, word := range clipWordRegexp.FindAllString(text, -1) {
+		var sb strings.Builder
+		for _, b := range []byte(word) {
+			sb.WriteRune(t.byteRunes[b])
+		}
+		for _, token := range t.bpe(sb.String()) {
+			if id, ok := t.vocab[token]; ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) > clipMaxTokens-1 {
+		ids = ids[:clipMaxTokens-1]
+	}
+	return append(ids, t.end)
+}
+
+// bpe splits the (byte-mapped) word into tokens by applying the merges in the order of their ranks.
+// The last token has the "</w>" end of word suffix.
+func (t *tokenizer) bpe(word string) []string {
+	if tokens, ok := t.cache[word]; ok {
+		return tokens
+	}
+	var symbols []string
+	for _, r := range word {
+		symbols = append(symbols, string(r))
+	}
+	if len(symbols) == 0 {
+		return nil
+	}
+	symbols[len(symbols)-1] += "</w>"
+	for len(symbols) > 1 {
+		best, bestRank := -1, 0
+		for i := range len(symbols) - 1 {
+			if rank, ok := t.ranks[[2]string{symbols[i], symbols[i+1]}]; ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		pair := [2]string{symbols[best], symbols[best+1]}
+		var merged []string
+		for i := 0; i < len(symbols); i++ {
+			if i < len(symbols)-1 && symbols[i] == pair[0] && symbols[i+1] == pair[1] {
+				merged = append(merged, pair[0]+pair[1])
+				i++
+			} else {
+				merged = append(merged, symbols[i])
+			}
+		}
+		symbols = merged
+	}
+	t.cache[word] = symbols
+	return symbols
+}
@@ -0,0 +1,241 @@
+// Package parquet is a minimal writer of Apache Parquet files (https://parquet.apache.org/docs/file-format/):
+// required byte array (binary or UTF-8 string) columns, optionally nested in groups, plain encoded and
+// uncompressed, in one row group. It's enough to export datasets of (already compressed) images and captions
+// for training frameworks, e.g. the Image feature of HuggingFace datasets is a {bytes, path} group.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+const (
+	magic = "PAR1"
+	// Data pages are cut after this size of values
+	pageSize = 1 << 20
+
+	typeByteArray       = 6
+	repetitionRequired  = 0
+	convertedTypeUTF8   = 0
+	encodingPlain       = 0
+	encodingRLE         = 3
+	codecUncompressed   = 0
+	pageTypeData        = 0
+	fileMetaDataVersion = 1
+)
+
+// Field is a field of the schema of a file: a byte array column, or a group of Fields if set.
+// All fields are required.
+type Field struct {
+	Name string
+	// The column is a UTF-8 string, not binary data
+	String bool
+	Fields []*Field
+}
+
+// leaf is a column of the schema.
+type leaf struct {
+	path []string
+}
+
+func leaves(fields []*Field, parent []string) []*leaf {
+	var result []*leaf
+	for _, field := range fields {
+		path := append(slices.Clone(parent), field.Name)
+		if len(field.Fields) > 0 {
+			result = append(result, leaves(field.Fields, path)...)
+		} else {
+			result = append(result, &leaf{path: path})
+		}
+	}
+	return result
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// columnChunk is the written data of a column.
+type columnChunk struct {
+	offset int64
+	size   int64
+}
+
+// Write writes a parquet file of numRows (> 0) rows of schema to w.
+// value returns the value of a row of a column, the index of the column in the depth-first order of the schema
+// leaf fields. It's called for the rows of each column in order: all rows of the first column, then of the second...
+// metadata is the key-value metadata of the file, e.g. "huggingface" dataset info. It may be nil.
+func Write(w io.Writer, schema []*Field, numRows int, value func(column int, row int) ([]byte, error),
+	metadata map[string]string) error {
+	if numRows <= 0 {
+		return fmt.Errorf("no rows")
+	}
+	columns := leaves(schema, nil)
+	cw := &countingWriter{w: w}
+	if _, err := io.WriteString(cw, magic); err != nil {
+		return err
+	}
+	chunks := make([]*columnChunk, len(columns))
+	for column := range columns {
+		chunk := &columnChunk{offset: cw.n}
+		var page bytes.Buffer
+		for row := 0; row < numRows; {
+			page.Reset()
+			pageRows := 0
+			for ; row < numRows && (pageRows == 0 || page.Len() < pageSize); row++ {
+				v, err := value(column, row)
+				if err != nil {
+					return err
+				}
+				if len(v) > math.MaxInt32-4-page.Len() {
+					return fmt.Errorf("value of %d bytes is too large", len(v))
+				}
+				page.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(v))))
+				page.Write(v)
+				pageRows++
+			}
+			if err := writePage(cw, page.Bytes(), pageRows); err != nil {
+				return err
+			}
+		}
+		chunk.size = cw.n - chunk.offset
+		chunks[column] = chunk
+	}
+
+	var footer bytes.Buffer
+	writeFileMetaData(&thriftWriter{w: &footer}, schema, columns, chunks, numRows, metadata)
+	if _, err := cw.Write(footer.Bytes()); err != nil {
+		return err
+	}
+	if _, err := cw.Write(binary.LittleEndian.AppendUint32(nil, uint32(footer.Len()))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(cw, magic)
+	return err
+}
+
+// writePage writes a data page (header and plain encoded values) of numValues values.
+func writePage(w io.Writer, data []byte, numValues int) error {
+	var header bytes.Buffer
+	t := &thriftWriter{w: &header}
+	t.structBegin()
+	t.i32Field(1, pageTypeData)
+	t.i32Field(2, int32(len(data))) // uncompressed_page_size
+	t.i32Field(3, int32(len(data))) // compressed_page_size
+	t.structField(5)                // data_page_header
+	t.i32Field(1, int32(numValues))
+	t.i32Field(2, encodingPlain)
+	t.i32Field(3, encodingRLE) // definition_level_encoding, unused by required columns
+	t.i32Field(4, encodingRLE) // repetition_level_encoding
+	t.structEnd()
+	t.structEnd()
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func writeFileMetaData(t *thriftWriter, schema []*Field, columns []*leaf, chunks []*columnChunk, numRows int,
+	metadata map[string]string) {
+	var elements int
+	var countElements func(fields []*Field)
+	countElements = func(fields []*Field) {
+		for _, field := range fields {
+			elements++
+			countElements(field.Fields)
+		}
+	}
+	countElements(schema)
+
+	t.structBegin()
+	t.i32Field(1, fileMetaDataVersion)
+	// The schema is flattened in depth-first order, with the number of children of the root and groups
+	t.listField(2, thriftStruct, elements+1)
+	t.structBegin()
+	t.stringField(4, "schema")
+	t.i32Field(5, int32(len(schema)))
+	t.structEnd()
+	var writeElements func(fields []*Field)
+	writeElements = func(fields []*Field) {
+		for _, field := range fields {
+			t.structBegin()
+			if len(field.Fields) == 0 {
+				t.i32Field(1, typeByteArray)
+			}
+			t.i32Field(3, repetitionRequired)
+			t.stringField(4, field.Name)
+			if len(field.Fields) > 0 {
+				t.i32Field(5, int32(len(field.Fields)))
+			} else if field.String {
+				t.i32Field(6, convertedTypeUTF8)
+				t.structField(10) // logicalType: STRING
+				t.structField(1)
+				t.structEnd()
+				t.structEnd()
+			}
+			t.structEnd()
+			writeElements(field.Fields)
+		}
+	}
+	writeElements(schema)
+	t.i64Field(3, int64(numRows))
+
+	t.listField(4, thriftStruct, 1) // row_groups
+	t.structBegin()
+	t.listField(1, thriftStruct, len(columns))
+	var totalSize int64
+	for i, column := range columns {
+		chunk := chunks[i]
+		totalSize += chunk.size
+		t.structBegin()
+		t.i64Field(2, chunk.offset) // file_offset
+		t.structField(3)            // meta_data
+		t.i32Field(1, typeByteArray)
+		t.listField(2, thriftI32, 2)
+		t.varint(encodingPlain)
+		t.varint(encodingRLE)
+		t.listField(3, thriftBinary, len(column.path))
+		for _, name := range column.path {
+			t.binary(name)
+		}
+		t.i32Field(4, codecUncompressed)
+		t.i64Field(5, int64(numRows))
+		t.i64Field(6, chunk.size) // total_uncompressed_size
+		t.i64Field(7, chunk.size) // total_compressed_size
+		t.i64Field(9, chunk.offset)
+		t.structEnd()
+		t.structEnd()
+	}
+	t.i64Field(2, totalSize)
+	t.i64Field(3, int64(numRows))
+	t.structEnd()
+
+	if len(metadata) > 0 {
+		keys := make([]string, 0, len(metadata))
+		for key := range metadata {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		t.listField(5, thriftStruct, len(keys))
+		for _, key := range keys {
+			t.structBegin()
+			t.stringField(1, key)
+			t.stringField(2, metadata[key])
+			t.structEnd()
+		}
+	}
+	t.stringField(6, "goaider")
+	t.structEnd()
+}
@@ -0,0 +1,96 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Types of the Thrift compact protocol
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, the encoding of the parquet metadata.
+// The first write error is kept in err, and later writes are skipped.
+type thriftWriter struct {
+	w   io.Writer
+	err error
+	// The last field id of each struct being written, innermost last
+	lastIDs []int16
+}
+
+func (t *thriftWriter) write(data []byte) {
+	if t.err == nil {
+		_, t.err = t.w.Write(data)
+	}
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	t.write(binary.AppendUvarint(nil, v))
+}
+
+// varint writes a zigzag varint.
+func (t *thriftWriter) varint(v int64) {
+	t.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) structBegin() {
+	t.lastIDs = append(t.lastIDs, 0)
+}
+
+func (t *thriftWriter) structEnd() {
+	t.write([]byte{0})
+	t.lastIDs = t.lastIDs[:len(t.lastIDs)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.lastIDs[len(t.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.write([]byte{byte(delta)<<4 | typ})
+	} else {
+		t.write([]byte{typ})
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) stringField(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.binary(v)
+}
+
+func (t *thriftWriter) binary(v string) {
+	t.uvarint(uint64(len(v)))
+	t.write([]byte(v))
+}
+
+// listField writes the header of a list field of size elements of type typ, which must be written next.
+func (t *thriftWriter) listField(id int16, typ byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.write([]byte{byte(size)<<4 | typ})
+	} else {
+		t.write([]byte{0xf0 | typ})
+		t.uvarint(uint64(size))
+	}
+}
+
+// structField writes the header of a struct field, whose fields must be written next, then structEnd.
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.structBegin()
+}
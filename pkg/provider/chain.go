@@ -0,0 +1,183 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+)
+
+// Fallback is an entry of a provider fallback chain: a provider and the model used with it.
+type Fallback struct {
+	Provider string
+	Model    string
+}
+
+func (f *Fallback) String() string {
+	return f.Provider + ":" + f.Model
+}
+
+// ParseFallbacks parses the "[<provider>:]<model>" fallbacks, e.g. "gemini-2.0-flash" or "ollama:llava:13b"
+// (the provider is the part before the first ":", the model may contain more).
+// The provider defaults to defaultProvider.
+func ParseFallbacks(values []string, defaultProvider string) ([]*Fallback, error) {
+	var fallbacks []*Fallback
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		fallback := &Fallback{Provider: defaultProvider, Model: value}
+		if name, model, ok := strings.Cut(value, ":"); ok {
+			fallback.Provider, fallback.Model = strings.TrimSpace(name), strings.TrimSpace(model)
+		}
+		if fallback.Provider == "" || fallback.Model == "" {
+			return nil, errs.New(errs.ExitConfig, "invalid fallback %q, must be [<provider>:]<model>", value)
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+	return fallbacks, nil
+}
+
+// IsFallbackError reports whether err of a provider should make a chain try the next provider:
+// an exhausted quota (after all retries) or a request / response blocked by the safety filters.
+func IsFallbackError(err error) bool {
+	return errs.Is(err, errs.ExitQuota) || errors.Is(err, gemini.ErrBlocked)
+}
+
+// chain tries its providers in order, until one succeeds or fails with a non fallback error.
+// A provider that failed with an exhausted quota is skipped in later requests.
+type chain struct {
+	names     []string // "<provider>:<model>" of each provider, for logging
+	providers []string // the provider name of each provider
+	models    []string // the model of each provider. "" = the model of the request
+	exhausted []bool
+	log       io.Writer
+}
+
+// try calls the providers in order, returning the response and the index of the provider that made it.
+func (c *chain) try(ctx context.Context, call func(i int) (string, error)) (string, int, error) {
+	var text string
+	var err error
+	for i := range c.names {
+		if c.exhausted[i] && i < len(c.names)-1 {
+			continue
+		}
+		if text, err = call(i); err == nil || !IsFallbackError(err) || ctx.Err() != nil {
+			return text, i, err
+		}
+		if errs.Is(err, errs.ExitQuota) {
+			c.exhausted[i] = true
+		}
+		if i < len(c.names)-1 {
+			fmt.Fprintf(c.log, "%s failed (%v), falling back to %s\n", c.names[i], err, c.names[i+1])
+		}
+	}
+	return text, len(c.names) - 1, err
+}
+
+// answered returns the provider and model (request's model if "") of the provider of index i.
+func (c *chain) answered(i int, model string) *Fallback {
+	if c.models[i] != "" {
+		model = c.models[i]
+	}
+	return &Fallback{Provider: c.providers[i], Model: model}
+}
+
+// newChain returns the chain of the primary ("<provider>:<model>") provider and the fallbacks.
+func newChain(primary string, fallbacks []*Fallback, config *Config) *chain {
+	primaryProvider, _, _ := strings.Cut(primary, ":")
+	c := &chain{names: []string{primary}, providers: []string{primaryProvider}, models: []string{""},
+		exhausted: make([]bool, len(fallbacks)+1), log: config.Log}
+	if c.log == nil {
+		c.log = os.Stdout
+	}
+	for _, fallback := range fallbacks {
+		c.names = append(c.names, fallback.String())
+		c.providers = append(c.providers, fallback.Provider)
+		c.models = append(c.models, fallback.Model)
+	}
+	return c
+}
+
+// CaptionChain is a caption provider that falls back to the next provider of the chain
+// when a provider fails with an exhausted quota or a safety block.
+type CaptionChain struct {
+	*chain
+	captioners []CaptionProvider
+}
+
+// NewCaptionChain returns the caption provider chain of the primary provider (named name) and the fallbacks,
+// which are created with config.
+func NewCaptionChain(name string, primary CaptionProvider, fallbacks []*Fallback, config *Config) (*CaptionChain, error) {
+	c := &CaptionChain{chain: newChain(name, fallbacks, config), captioners: []CaptionProvider{primary}}
+	for _, fallback := range fallbacks {
+		p, err := NewCaption(fallback.Provider, config)
+		if err != nil {
+			return nil, err
+		}
+		c.captioners = append(c.captioners, p)
+	}
+	return c, nil
+}
+
+// Caption captions the image with the first provider of the chain that succeeds.
+func (c *CaptionChain) Caption(ctx context.Context, request *CaptionRequest) (string, error) {
+	text, _, err := c.CaptionBy(ctx, request)
+	return text, err
+}
+
+// CaptionBy is Caption that also returns the provider and model that generated the caption.
+func (c *CaptionChain) CaptionBy(ctx context.Context, request *CaptionRequest) (string, *Fallback, error) {
+	text, i, err := c.try(ctx, func(i int) (string, error) {
+		r := request
+		if c.models[i] != "" {
+			copied := *request
+			copied.Model = c.models[i]
+			r = &copied
+		}
+		return c.captioners[i].Caption(ctx, r)
+	})
+	return text, c.answered(i, request.Model), err
+}
+
+// TranscribeChain is a transcribe provider that falls back to the next provider of the chain
+// when a provider fails with an exhausted quota or a safety block.
+type TranscribeChain struct {
+	*chain
+	transcribers []TranscribeProvider
+}
+
+// NewTranscribeChain returns the transcribe provider chain of the primary provider (named name) and the fallbacks,
+// which are created with config.
+func NewTranscribeChain(name string, primary TranscribeProvider, fallbacks []*Fallback,
+	config *Config) (*TranscribeChain, error) {
+	c := &TranscribeChain{chain: newChain(name, fallbacks, config), transcribers: []TranscribeProvider{primary}}
+	for _, fallback := range fallbacks {
+		p, err := NewTranscribe(fallback.Provider, config)
+		if err != nil {
+			return nil, err
+		}
+		c.transcribers = append(c.transcribers, p)
+	}
+	return c, nil
+}
+
+// Transcribe transcribes the audio with the first provider of the chain that succeeds.
+func (c *TranscribeChain) Transcribe(ctx context.Context, request *TranscribeRequest) (string, error) {
+	text, _, err := c.try(ctx, func(i int) (string, error) {
+		r := request
+		if c.models[i] != "" {
+			copied := *request
+			copied.Model = c.models[i]
+			r = &copied
+		}
+		return c.transcribers[i].Transcribe(ctx, r)
+	})
+	return text, err
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/sagan/goaider/gemini"
+)
+
+// Gemini is the built-in provider of the Gemini API.
+type Gemini struct {
+	Client *gemini.Client
+}
+
+func init() {
+	RegisterCaption(GEMINI, func(config *Config) (CaptionProvider, error) {
+		return NewGemini(config)
+	})
+	RegisterTranscribe(GEMINI, func(config *Config) (TranscribeProvider, error) {
+		return NewGemini(config)
+	})
+}
+
+// NewGemini returns a new Gemini provider. It fails if no API key is set.
+func NewGemini(config *Config) (*Gemini, error) {
+	keys, err := gemini.LoadKeys(config.APIKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Gemini{Client: &gemini.Client{
+		HTTPClient:   &http.Client{},
+		Keys:         keys,
+		APIURL:       config.APIURL,
+		Timeout:      config.Timeout,
+		TimeoutPerMB: config.TimeoutPerMB,
+		Retry:        config.Retry,
+		OnRetry:      config.OnRetry,
+		Log:          config.Log,
+	}}, nil
+}
+
+// Caption calls the generateContent API (with the retries of the client) to caption the image.
+func (g *Gemini) Caption(ctx context.Context, request *CaptionRequest) (string, error) {
+	return g.Client.GenerateText(ctx, request.Model, GeminiCaptionRequest(request))
+}
+
+// Transcribe calls the generateContent API (with the retries of the client) to transcribe the audio.
+func (g *Gemini) Transcribe(ctx context.Context, request *TranscribeRequest) (string, error) {
+	return g.Client.GenerateText(ctx, request.Model, GeminiTranscribeRequest(request))
+}
+
+// GeminiCaptionRequest returns the Gemini API request of the caption request.
+func GeminiCaptionRequest(request *CaptionRequest) *gemini.Request {
+	if len(request.Images) > 0 {
+		parts := []gemini.Part{{Text: request.Prompt}}
+		for _, image := range request.Images {
+			parts = append(parts, gemini.Part{Text: "File: " + image.Label}, gemini.Part{
+				InlineData: &gemini.InlineData{
+					MimeType: image.MimeType,
+					Data:     base64.StdEncoding.EncodeToString(image.Data),
+				},
+			})
+		}
+		return &gemini.Request{
+			Contents:         []gemini.Content{{Role: "user", Parts: parts}},
+			GenerationConfig: request.Config,
+		}
+	}
+	return &gemini.Request{
+		Contents: []gemini.Content{
+			{
+				Role: "user",
+				Parts: []gemini.Part{
+					{Text: request.Prompt}, // The prompt to the model
+					{
+						InlineData: &gemini.InlineData{ // The image data
+							MimeType: request.MimeType,
+							Data:     base64.StdEncoding.EncodeToString(request.Image),
+						},
+					},
+				},
+			},
+		},
+		GenerationConfig: request.Config,
+	}
+}
+
+// GeminiTranscribeRequest returns the Gemini API request of the transcribe request.
+func GeminiTranscribeRequest(request *TranscribeRequest) *gemini.Request {
+	return &gemini.Request{
+		Contents: []gemini.Content{
+			{
+				Parts: []gemini.Part{
+					{Text: request.Prompt},
+					{InlineData: &gemini.InlineData{
+						MimeType: request.MimeType,
+						Data:     base64.StdEncoding.EncodeToString(request.Audio),
+					}},
+				},
+			},
+		},
+		GenerationConfig: request.Config,
+	}
+}
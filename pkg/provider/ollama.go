@@ -0,0 +1,176 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+// OLLAMA is the name of the built-in caption provider of local vision models (e.g. llava) served by Ollama
+// (https://ollama.com).
+const OLLAMA = "ollama"
+
+// Ollama is the caption provider of an Ollama server, whose url is the OLLAMA_HOST env
+// (default http://127.0.0.1:11434). Models are the Ollama model names, e.g. "llava:13b".
+type Ollama struct {
+	HTTPClient *http.Client
+	Host       string
+	config     *Config
+}
+
+func init() {
+	RegisterCaption(OLLAMA, func(config *Config) (CaptionProvider, error) {
+		return NewOllama(config)
+	})
+}
+
+// NewOllama returns a new Ollama provider.
+func NewOllama(config *Config) (*Ollama, error) {
+	host := os.Getenv(constants.ENV_OLLAMA_HOST)
+	if host == "" {
+		host = constants.OLLAMA_HOST
+	} else if !strings.Contains(host, "://") {
+		// The ollama CLI accepts a bare "host:port"
+		host = "http://" + host
+	}
+	return &Ollama{HTTPClient: &http.Client{}, Host: strings.TrimRight(host, "/"), config: config}, nil
+}
+
+// Caption calls the chat API (with the retries of config) to caption the image.
+// A request of multiple images (caption --batch-size) is not supported.
+func (o *Ollama) Caption(ctx context.Context, request *CaptionRequest) (string, error) {
+	if len(request.Images) > 0 {
+		return "", errs.New(errs.ExitConfig, "the %s provider does not support multiple images per request", OLLAMA)
+	}
+	payload := map[string]any{
+		"model":  request.Model,
+		"stream": false,
+		"messages": []map[string]any{{
+			"role":    "user",
+			"content": request.Prompt,
+			"images":  []string{base64.StdEncoding.EncodeToString(request.Image)},
+		}},
+	}
+	if config := request.Config; config != nil {
+		if config.ResponseSchema != nil {
+			payload["format"] = jsonSchema(config.ResponseSchema)
+		} else if config.ResponseMimeType == "application/json" {
+			payload["format"] = "json"
+		}
+		options := map[string]any{}
+		if config.Temperature != nil {
+			options["temperature"] = *config.Temperature
+		}
+		if config.TopP != nil {
+			options["top_p"] = *config.TopP
+		}
+		if config.TopK > 0 {
+			options["top_k"] = config.TopK
+		}
+		if config.MaxOutputTokens > 0 {
+			options["num_predict"] = config.MaxOutputTokens
+		}
+		if config.Seed != nil {
+			options["seed"] = *config.Seed
+		}
+		if len(options) > 0 {
+			payload["options"] = options
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var text string
+	err = util.Retry(ctx, o.config.Retry, func(ctx context.Context) error {
+		if timeout := o.timeout(len(body)); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.Host+"/api/chat", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := o.HTTPClient.Do(req)
+		if err != nil {
+			return util.Retryable(fmt.Errorf("network error: %w", err))
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return util.Retryable(fmt.Errorf("failed to read response body: %w", err))
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+		case resp.StatusCode == http.StatusNotFound:
+			return errs.New(errs.ExitConfig, "model %q not found on the Ollama server (pull it first): %s",
+				request.Model, respBody)
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return util.Retryable(fmt.Errorf("Ollama returned retryable status %d: %s", resp.StatusCode, respBody))
+		default:
+			return fmt.Errorf("Ollama request failed with status %d: %s", resp.StatusCode, respBody)
+		}
+		var chatResp struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(respBody, &chatResp); err != nil {
+			return fmt.Errorf("invalid Ollama response: %w", err)
+		}
+		text = strings.TrimSpace(chatResp.Message.Content)
+		if text == "" {
+			return util.Retryable(fmt.Errorf("Ollama returned empty response"))
+		}
+		return nil
+	}, o.config.OnRetry)
+	return text, err
+}
+
+// timeout returns the timeout of a request with a payload of size bytes. 0 = no timeout.
+func (o *Ollama) timeout(size int) time.Duration {
+	if o.config.Timeout <= 0 {
+		return 0
+	}
+	return o.config.Timeout + time.Duration(float64(o.config.TimeoutPerMB)*float64(size)/(1<<20))
+}
+
+// jsonSchema returns the JSON schema of a Gemini response schema, the format of structured outputs of Ollama.
+func jsonSchema(schema *gemini.Schema) map[string]any {
+	s := map[string]any{"type": strings.ToLower(schema.Type)}
+	if schema.Description != "" {
+		s["description"] = schema.Description
+	}
+	if schema.Items != nil {
+		s["items"] = jsonSchema(schema.Items)
+	}
+	if schema.MaxItems > 0 {
+		s["maxItems"] = schema.MaxItems
+	}
+	if len(schema.Properties) > 0 {
+		properties := map[string]any{}
+		for name, property := range schema.Properties {
+			properties[name] = jsonSchema(property)
+		}
+		s["properties"] = properties
+	}
+	if len(schema.Required) > 0 {
+		s["required"] = schema.Required
+	}
+	return s
+}
@@ -0,0 +1,149 @@
+// Package provider is the registry of the model backends of caption and stt.
+// A backend registers its factories at init time, e.g. in a third-party build of goaider
+// that blank-imports its package, and is then selected by the --provider flag:
+//
+//	func init() {
+//		provider.RegisterCaption("acme", func(config *provider.Config) (provider.CaptionProvider, error) {
+//			return &acmeProvider{endpoint: os.Getenv("ACME_ENDPOINT")}, nil
+//		})
+//	}
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sagan/goaider/errs"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+// GEMINI is the name of the built-in Gemini API provider, the default one.
+const GEMINI = "gemini"
+
+// Config is the config of a provider, set by the flags of the command.
+type Config struct {
+	// Path of a file of API keys, one per line. Gemini: default GEMINI_API_KEY(S) env
+	APIKeysFile string
+	// Gemini: the base url of the API (e.g. of a proxy), see gemini.ResolveAPIURL. "" = GEMINI_API_URL env or the default
+	APIURL string
+	// Timeout of a single request is Timeout + TimeoutPerMB * (payload size in MB). 0 = no timeout
+	Timeout      time.Duration
+	TimeoutPerMB time.Duration
+	Retry        util.RetryPolicy
+	// Optional. Called before each retry
+	OnRetry func(attempt int, err error, delay time.Duration)
+	// Optional. Where status messages (retries...) are printed
+	Log io.Writer
+}
+
+// CaptionRequest is a request to caption an image.
+type CaptionRequest struct {
+	Model    string
+	Prompt   string
+	Image    []byte
+	MimeType string
+	// Multiple images captioned in one request (caption --batch-size), each one preceded by its label.
+	// Image is not used if set. A provider that supports only one image per request should return an error
+	Images []*CaptionImage
+	// The response format (structured output schema) and sampling parameters. nil = plain text, model defaults
+	Config *gemini.GenerationConfig
+}
+
+// CaptionImage is an image of a multiple images caption request.
+type CaptionImage struct {
+	Label    string // e.g. the file name
+	Data     []byte
+	MimeType string
+}
+
+// TranscribeRequest is a request to transcribe an audio.
+type TranscribeRequest struct {
+	Model    string
+	Prompt   string
+	Audio    []byte
+	MimeType string
+	// The response format (structured output schema) and sampling parameters. nil = plain text, model defaults
+	Config *gemini.GenerationConfig
+}
+
+// CaptionProvider generates the caption of an image.
+// It should classify errors as errs.ExitAuth / errs.ExitQuota if they're fatal to the whole run.
+type CaptionProvider interface {
+	// Caption returns the trimmed text of the response.
+	Caption(ctx context.Context, request *CaptionRequest) (string, error)
+}
+
+// TranscribeProvider generates the transcript of an audio.
+// It should classify errors as errs.ExitAuth / errs.ExitQuota if they're fatal to the whole run.
+type TranscribeProvider interface {
+	// Transcribe returns the trimmed text of the response.
+	Transcribe(ctx context.Context, request *TranscribeRequest) (string, error)
+}
+
+type CaptionFactory func(config *Config) (CaptionProvider, error)
+type TranscribeFactory func(config *Config) (TranscribeProvider, error)
+
+var (
+	captionFactories    = map[string]CaptionFactory{}
+	transcribeFactories = map[string]TranscribeFactory{}
+)
+
+// RegisterCaption registers a caption provider. It should be called in init. It panics if name is registered.
+func RegisterCaption(name string, factory CaptionFactory) {
+	if _, ok := captionFactories[name]; ok {
+		panic(fmt.Sprintf("caption provider %q is already registered", name))
+	}
+	captionFactories[name] = factory
+}
+
+// RegisterTranscribe registers a transcribe provider. It should be called in init. It panics if name is registered.
+func RegisterTranscribe(name string, factory TranscribeFactory) {
+	if _, ok := transcribeFactories[name]; ok {
+		panic(fmt.Sprintf("transcribe provider %q is already registered", name))
+	}
+	transcribeFactories[name] = factory
+}
+
+// NewCaption returns a new caption provider of name. An unknown name is an errs.ExitConfig error.
+func NewCaption(name string, config *Config) (CaptionProvider, error) {
+	factory := captionFactories[name]
+	if factory == nil {
+		return nil, errs.New(errs.ExitConfig, "unknown caption provider %q (available: %s)", name,
+			strings.Join(CaptionProviders(), ", "))
+	}
+	return factory(config)
+}
+
+// NewTranscribe returns a new transcribe provider of name. An unknown name is an errs.ExitConfig error.
+func NewTranscribe(name string, config *Config) (TranscribeProvider, error) {
+	factory := transcribeFactories[name]
+	if factory == nil {
+		return nil, errs.New(errs.ExitConfig, "unknown transcribe provider %q (available: %s)", name,
+			strings.Join(TranscribeProviders(), ", "))
+	}
+	return factory(config)
+}
+
+// CaptionProviders returns the sorted names of the registered caption providers.
+func CaptionProviders() []string {
+	return sortedKeys(captionFactories)
+}
+
+// TranscribeProviders returns the sorted names of the registered transcribe providers.
+func TranscribeProviders() []string {
+	return sortedKeys(transcribeFactories)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,306 @@
+package textnorm
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Numbers of more digits are read digit by digit, as are the ones with a leading zero (e.g. "007")
+const maxCardinalDigits = 15
+
+var (
+	// A year of Chinese, which is read digit by digit, e.g. 二零一零年 (2010)
+	chineseYearRegexp = regexp.MustCompile(`(\d{4})年`)
+	// A "h:mm" time, e.g. "10:30"
+	timeRegexp = regexp.MustCompile(`\b([01]?\d|2[0-4]):([0-5]\d)\b`)
+	// A number with optional thousands separators, decimals and a percent sign or an English ordinal suffix
+	numberRegexp = regexp.MustCompile(`(\d{1,3}(?:,\d{3})+|\d+)(?:\.(\d+))?(%|(?i:st|nd|rd|th)\b)?`)
+)
+
+// numeralSystem spells numbers with the digits and the powers-of-ten units of Chinese, Japanese or
+// Sino-Korean numerals, which are grouped by ten thousands.
+type numeralSystem struct {
+	digits [10]string
+	units  [4]string // of 1, 10, 100 and 1000
+	groups [4]string // of 1, 10^4, 10^8 and 10^12
+	zero   string    // inserted for the skipped zeros inside a number, e.g. 一千零五 (1005). "" = none
+	point  string    // decimal point
+	// omitOne reports whether the "one" before unit u of group g (of value) is omitted, e.g. 十五 (15).
+	// leading is true for the first digit of the number
+	omitOne func(u, g, value int, leading bool) bool
+	percent func(number string) string
+	time    func(s *numeralSystem, hour, minute int) string
+}
+
+var chineseNumerals = &numeralSystem{
+	digits:  [10]string{"零", "一", "二", "三", "四", "五", "六", "七", "八", "九"},
+	units:   [4]string{"", "十", "百", "千"},
+	groups:  [4]string{"", "万", "亿", "万亿"},
+	zero:    "零",
+	point:   "点",
+	omitOne: func(u, g, value int, leading bool) bool { return u == 1 && leading },
+	percent: func(number string) string { return "百分之" + number },
+	time: func(s *numeralSystem, hour, minute int) string {
+		if minute == 0 {
+			return s.cardinal(uint64(hour)) + "点"
+		} else if minute < 10 {
+			return s.cardinal(uint64(hour)) + "点零" + s.cardinal(uint64(minute)) + "分"
+		}
+		return s.cardinal(uint64(hour)) + "点" + s.cardinal(uint64(minute)) + "分"
+	},
+}
+
+var japaneseNumerals = &numeralSystem{
+	digits:  [10]string{"零", "一", "二", "三", "四", "五", "六", "七", "八", "九"},
+	units:   [4]string{"", "十", "百", "千"},
+	groups:  [4]string{"", "万", "億", "兆"},
+	point:   "点",
+	omitOne: func(u, g, value int, leading bool) bool { return u >= 1 },
+	percent: func(number string) string { return number + "パーセント" },
+	time: func(s *numeralSystem, hour, minute int) string {
+		if minute == 0 {
+			return s.cardinal(uint64(hour)) + "時"
+		}
+		return s.cardinal(uint64(hour)) + "時" + s.cardinal(uint64(minute)) + "分"
+	},
+}
+
+// The native Korean numbers of the hours of times, e.g. 한 시 (1:00)
+var koreanHours = []string{"영", "한", "두", "세", "네", "다섯", "여섯", "일곱", "여덟", "아홉", "열", "열한", "열두",
+	"열세", "열네", "열다섯", "열여섯", "열일곱", "열여덟", "열아홉", "스물", "스물한", "스물두", "스물세", "스물네"}
+
+var koreanNumerals = &numeralSystem{
+	digits: [10]string{"영", "일", "이", "삼", "사", "오", "육", "칠", "팔", "구"},
+	units:  [4]string{"", "십", "백", "천"},
+	groups: [4]string{"", "만", "억", "조"},
+	point:  "점",
+	omitOne: func(u, g, value int, leading bool) bool {
+		return u >= 1 || (u == 0 && g == 1 && value == 1) // 만 (10000), not 일만
+	},
+	percent: func(number string) string { return number + " 퍼센트" },
+	time: func(s *numeralSystem, hour, minute int) string {
+		if minute == 0 {
+			return koreanHours[hour] + " 시"
+		}
+		return koreanHours[hour] + " 시 " + s.cardinal(uint64(minute)) + " 분"
+	},
+}
+
+var pow10 = [4]int{1, 10, 100, 1000}
+
+// cardinal returns n (less than 10^16) in numerals.
+func (s *numeralSystem) cardinal(n uint64) string {
+	if n == 0 {
+		return s.digits[0]
+	}
+	var groups []int // groups of 4 digits, the lowest first
+	for ; n > 0; n /= 10000 {
+		groups = append(groups, int(n%10000))
+	}
+	var b strings.Builder
+	gap := false // a group of zeros was skipped
+	for g := len(groups) - 1; g >= 0; g-- {
+		value := groups[g]
+		if value == 0 {
+			gap = b.Len() > 0
+			continue
+		}
+		zero := b.Len() > 0 && (gap || value < 1000)
+		gap = false
+		for u := 3; u >= 0; u-- {
+			d := value / pow10[u] % 10
+			if d == 0 {
+				zero = zero || (b.Len() > 0 && value%pow10[u] != 0)
+				continue
+			}
+			if zero {
+				b.WriteString(s.zero)
+				zero = false
+			}
+			if d != 1 || !s.omitOne(u, g, value, b.Len() == 0) {
+				b.WriteString(s.digits[d])
+			}
+			b.WriteString(s.units[u])
+		}
+		b.WriteString(s.groups[g])
+	}
+	return b.String()
+}
+
+// spell returns the digits of a number read digit by digit.
+func (s *numeralSystem) spell(digits string) string {
+	var b strings.Builder
+	for _, d := range digits {
+		b.WriteString(s.digits[d-'0'])
+	}
+	return b.String()
+}
+
+var (
+	englishOnes = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+		"eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	englishTens   = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	englishScales = []string{"", "thousand", "million", "billion", "trillion", "quadrillion"}
+	// The irregular ordinals of the last word of a number
+	englishOrdinals = map[string]string{"one": "first", "two": "second", "three": "third", "five": "fifth",
+		"eight": "eighth", "nine": "ninth", "twelve": "twelfth"}
+)
+
+// englishCardinal returns n (less than 10^18) in English words, e.g. "one hundred twenty-three".
+func englishCardinal(n uint64) string {
+	if n == 0 {
+		return englishOnes[0]
+	}
+	var words []string
+	for scale := len(englishScales) - 1; scale >= 0; scale-- {
+		unit := uint64(1)
+		for range scale {
+			unit *= 1000
+		}
+		group := int(n / unit % 1000)
+		if group == 0 {
+			continue
+		}
+		if group >= 100 {
+			words = append(words, englishOnes[group/100], "hundred")
+			group %= 100
+		}
+		if group >= 20 {
+			word := englishTens[group/10]
+			if group%10 != 0 {
+				word += "-" + englishOnes[group%10]
+			}
+			words = append(words, word)
+		} else if group > 0 {
+			words = append(words, englishOnes[group])
+		}
+		if scale > 0 {
+			words = append(words, englishScales[scale])
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// englishOrdinal returns the ordinal of an English cardinal, e.g. "twenty-first" of "twenty-one".
+func englishOrdinal(cardinal string) string {
+	i := strings.LastIndexAny(cardinal, " -") + 1
+	last := cardinal[i:]
+	if ordinal, ok := englishOrdinals[last]; ok {
+		return cardinal[:i] + ordinal
+	} else if strings.HasSuffix(last, "y") {
+		return cardinal[:i] + strings.TrimSuffix(last, "y") + "ieth"
+	}
+	return cardinal + "th"
+}
+
+// englishSpell returns the digits of a number read digit by digit, e.g. "zero zero seven".
+func englishSpell(digits string) string {
+	var words []string
+	for _, d := range digits {
+		words = append(words, englishOnes[d-'0'])
+	}
+	return strings.Join(words, " ")
+}
+
+// integer returns the integer part of a number in words.
+func (l *language) integer(digits string) string {
+	n, err := strconv.ParseUint(digits, 10, 64)
+	readDigits := err != nil || len(digits) > maxCardinalDigits || (len(digits) > 1 && digits[0] == '0')
+	switch {
+	case l.numerals == nil && readDigits:
+		return englishSpell(digits)
+	case l.numerals == nil:
+		return englishCardinal(n)
+	case readDigits:
+		return l.numerals.spell(digits)
+	}
+	return l.numerals.cardinal(n)
+}
+
+// spellNumbers spells out the numbers, percentages, "h:mm" times, Chinese years and English ordinals (e.g. "21st")
+// of text.
+// Numbers right after a Latin letter (e.g. "mp3") are kept as is.
+func (l *language) spellNumbers(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if (r >= '０' && r <= '９') || r == '％' {
+			return r - 0xFEE0
+		}
+		return r
+	}, text)
+	if l.numerals == chineseNumerals {
+		text = l.replaceNumbers(text, chineseYearRegexp, func(m []string) string {
+			return l.numerals.spell(m[1]) + "年"
+		})
+	}
+	text = l.replaceNumbers(text, timeRegexp, func(m []string) string {
+		hour, _ := strconv.Atoi(m[1])
+		minute, _ := strconv.Atoi(m[2])
+		if l.numerals != nil {
+			return l.numerals.time(l.numerals, hour, minute)
+		}
+		switch {
+		case minute == 0:
+			return englishCardinal(uint64(hour)) + " o'clock"
+		case minute < 10:
+			return englishCardinal(uint64(hour)) + " oh " + englishCardinal(uint64(minute))
+		}
+		return englishCardinal(uint64(hour)) + " " + englishCardinal(uint64(minute))
+	})
+	return l.replaceNumbers(text, numberRegexp, func(m []string) string {
+		suffix := strings.ToLower(m[3])
+		if suffix != "" && suffix != "%" && l.numerals != nil {
+			return m[0] // English ordinal suffix in another language
+		}
+		number := l.integer(strings.ReplaceAll(m[1], ",", ""))
+		if m[2] != "" {
+			if l.numerals != nil {
+				number += l.numerals.point + l.numerals.spell(m[2])
+			} else {
+				number += " point " + englishSpell(m[2])
+			}
+		}
+		switch {
+		case suffix == "%" && l.numerals != nil:
+			return l.numerals.percent(number)
+		case suffix == "%":
+			return number + " percent"
+		case suffix != "":
+			return englishOrdinal(number)
+		}
+		return number
+	})
+}
+
+// replaceNumbers replaces the matches of re in text with the result of replace of their submatches,
+// except the ones right after a Latin letter. For the languages written with spaces, a space is added
+// between a replacement and a following Latin letter.
+func (l *language) replaceNumbers(text string, re *regexp.Regexp, replace func(m []string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[0], loc[1]
+		if start > 0 && isLatinLetter(rune(text[start-1])) {
+			continue
+		}
+		m := make([]string, len(loc)/2)
+		for i := range m {
+			if loc[2*i] >= 0 {
+				m[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(replace(m))
+		if next, _ := utf8.DecodeRuneInString(text[end:]); !l.cjk && isLatinLetter(next) {
+			b.WriteString(" ")
+		}
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func isLatinLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
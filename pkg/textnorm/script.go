@@ -0,0 +1,108 @@
+package textnorm
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// The scripts of the letters of the languages
+var languageScripts = map[string][]*unicode.RangeTable{
+	"zh":  {unicode.Han},
+	"yue": {unicode.Han},
+	"ja":  {unicode.Han, unicode.Hiragana, unicode.Katakana},
+	"ko":  {unicode.Hangul, unicode.Han},
+	"en":  {unicode.Latin},
+}
+
+// The scripts of the letters that the text frontends (grapheme-to-phoneme) of TTS models
+// of the languages handle, e.g. of GPT-SoVITS
+var frontendScripts = map[string][]*unicode.RangeTable{
+	"zh":  {unicode.Han},
+	"yue": {unicode.Han},
+	"ja":  {unicode.Han, unicode.Hiragana, unicode.Katakana},
+	"ko":  {unicode.Hangul},
+	"en":  {unicode.Latin},
+}
+
+// isSyllabic reports whether r is written without spaces and spoken as (about) a syllable:
+// a Han, kana or Hangul character.
+func isSyllabic(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// Tokens splits text into spoken units: each Han, kana or Hangul character is a token, as is each word
+// (a run of other letters and digits, lowercased). Marks and spaces are dropped.
+func Tokens(text string) []string {
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, strings.ToLower(word.String()))
+			word.Reset()
+		}
+	}
+	for _, r := range text {
+		switch {
+		case isSyllabic(r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == '\'':
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// ScriptShare returns the share (0-1) of the letter tokens (see Tokens) of text that are in the script
+// of language lang (one of Languages), and the number of letter tokens. Tokens of digits are not counted.
+func ScriptShare(text string, lang string) (share float64, letters int) {
+	scripts := languageScripts[lang]
+	inScript := 0
+	for _, token := range Tokens(text) {
+		var first rune
+		for _, r := range token {
+			if unicode.IsLetter(r) {
+				first = r
+				break
+			}
+		}
+		if first == 0 {
+			continue
+		}
+		letters++
+		if unicode.In(first, scripts...) {
+			inScript++
+		}
+	}
+	if letters == 0 {
+		return 1, 0
+	}
+	return float64(inScript) / float64(letters), letters
+}
+
+// InvalidChars returns the distinct characters of text that the text frontend of TTS models of language lang
+// (one of Languages) can not handle, in order of appearance: letters of other scripts (e.g. Latin letters
+// in zh text) and symbols (e.g. emoji). Digits, punctuation and spaces are valid.
+func InvalidChars(text string, lang string) []rune {
+	scripts := frontendScripts[lang]
+	var invalid []rune
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r) || unicode.IsDigit(r) || unicode.IsPunct(r):
+			continue
+		case unicode.IsLetter(r):
+			// The prolonged sound mark of kana is of the common script
+			if unicode.In(r, scripts...) || (lang == "ja" && r == 'ー') {
+				continue
+			}
+		}
+		if !slices.Contains(invalid, r) {
+			invalid = append(invalid, r)
+		}
+	}
+	return invalid
+}
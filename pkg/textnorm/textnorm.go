@@ -0,0 +1,286 @@
+// Package textnorm normalizes the text of speech transcripts for TTS training by per-language rules:
+// numerals are spelled out, punctuation and casing are made consistent and emoji are removed.
+// It also splits transcripts into spoken units and checks their script.
+package textnorm
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// The rules of a Normalizer, in the order they are applied
+const (
+	RuleEmoji       = "emoji"       // remove emoji
+	RuleNumbers     = "numbers"     // spell out numerals, percentages, times and ordinals
+	RulePunctuation = "punctuation" // use the punctuation style of the language, collapse repeated marks
+	RuleCase        = "case"        // sentence case (en): capitalize the first word of sentences and "I"
+	RuleEnding      = "ending"      // end the text with a sentence-ending mark
+)
+
+// Rules are all rules, in the order they are applied.
+var Rules = []string{RuleEmoji, RuleNumbers, RulePunctuation, RuleCase, RuleEnding}
+
+// Languages are the codes of the supported languages (as of GPT-SoVITS).
+var Languages = []string{"zh", "ja", "en", "ko", "yue"}
+
+// language is the normalization style of a language.
+type language struct {
+	code     string
+	cjk      bool           // full-width punctuation, no spaces between words
+	numerals *numeralSystem // nil = English words
+	comma    rune           // comma of cjk languages
+}
+
+var languages = map[string]*language{
+	"zh":  {code: "zh", cjk: true, numerals: chineseNumerals, comma: '，'},
+	"yue": {code: "yue", cjk: true, numerals: chineseNumerals, comma: '，'},
+	"ja":  {code: "ja", cjk: true, numerals: japaneseNumerals, comma: '、'},
+	"ko":  {code: "ko", numerals: koreanNumerals},
+	"en":  {code: "en"},
+}
+
+// Normalizer normalizes the transcripts of a language.
+type Normalizer struct {
+	lang  *language
+	rules []string
+}
+
+// New returns a Normalizer of language lang (one of Languages) that applies rules (of Rules).
+func New(lang string, rules []string) (*Normalizer, error) {
+	l := languages[lang]
+	if l == nil {
+		return nil, fmt.Errorf("unsupported language %q, must be one of: %s", lang, strings.Join(Languages, ", "))
+	}
+	for _, rule := range rules {
+		if !slices.Contains(Rules, rule) {
+			return nil, fmt.Errorf("unknown rule %q, must be one of: %s", rule, strings.Join(Rules, ", "))
+		}
+	}
+	return &Normalizer{lang: l, rules: rules}, nil
+}
+
+var spacesRegexp = regexp.MustCompile(`\s+`)
+
+// Normalize returns the normalized text. Line breaks are always replaced with spaces and
+// runs of whitespace are collapsed, so the result is a single line.
+func (n *Normalizer) Normalize(text string) string {
+	text = strings.TrimPrefix(text, "\ufeff")
+	text = strings.TrimSpace(spacesRegexp.ReplaceAllString(text, " "))
+	if n.lang.code == "en" && slices.Contains(n.rules, RuleCase) {
+		// Before the numbers are spelled out in lowercase
+		text = lowerShouted(text)
+	}
+	for _, rule := range Rules {
+		if !slices.Contains(n.rules, rule) {
+			continue
+		}
+		switch rule {
+		case RuleEmoji:
+			text = stripEmoji(text)
+		case RuleNumbers:
+			text = n.lang.spellNumbers(text)
+		case RulePunctuation:
+			if n.lang.cjk {
+				text = n.lang.cjkPunctuation(text)
+			} else {
+				text = westernPunctuation(text)
+			}
+		case RuleCase:
+			if n.lang.code == "en" {
+				text = sentenceCase(text)
+			}
+		case RuleEnding:
+			text = n.lang.ensureEnding(text)
+		}
+		text = strings.TrimSpace(spacesRegexp.ReplaceAllString(text, " "))
+	}
+	return text
+}
+
+// stripEmoji removes emoji, with their variation selectors, joiners, skin tones and keycaps.
+func stripEmoji(text string) string {
+	return strings.Map(func(r rune) rune {
+		if isEmoji(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // mahjong, cards, enclosed, pictographs, emoticons, transport, ...
+		r >= 0x2600 && r <= 0x27BF,   // misc symbols, dingbats
+		r >= 0xFE00 && r <= 0xFE0F,   // variation selectors
+		r >= 0xE0020 && r <= 0xE007F, // tags of flags
+		r == 0x200D, r == 0x20E3,     // zero width joiner, keycap
+		r == 0x231A, r == 0x231B, r >= 0x23E9 && r <= 0x23F3, r >= 0x23F8 && r <= 0x23FA,
+		r >= 0x2B05 && r <= 0x2B07, r == 0x2B1B, r == 0x2B1C, r == 0x2B50, r == 0x2B55:
+		return true
+	}
+	return false
+}
+
+// foldWidth returns the text with full-width ASCII characters and the ideographic space
+// replaced by their ASCII counterparts.
+func foldWidth(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 0xFF01 && r <= 0xFF5E {
+			return r - 0xFEE0
+		} else if r == 0x3000 {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+var westernReplacer = strings.NewReplacer(
+	"“", `"`, "”", `"`, "„", `"`, "「", `"`, "」", `"`, "『", `"`, "』", `"`,
+	"‘", "'", "’", "'", "…", "...", "—", " - ", "–", "-", "、", ",", "。", ".",
+)
+
+var (
+	spaceBeforeMarkRegexp  = regexp.MustCompile(` +([,.!?;:])`)
+	noSpaceAfterMarkRegexp = regexp.MustCompile(`([,;:!?])(\pL)`)
+	repeatedMarkRegexp     = regexp.MustCompile(`([!?])[!?]+`)
+	repeatedCommaRegexp    = regexp.MustCompile(`,{2,}`)
+	longEllipsisRegexp     = regexp.MustCompile(`\.{4,}`)
+)
+
+// westernPunctuation converts full-width and typographic marks to ASCII, removes spaces before marks,
+// adds a space after them and collapses repeated marks.
+func westernPunctuation(text string) string {
+	text = westernReplacer.Replace(foldWidth(text))
+	text = spaceBeforeMarkRegexp.ReplaceAllString(text, "$1")
+	text = noSpaceAfterMarkRegexp.ReplaceAllString(text, "$1 $2")
+	text = repeatedMarkRegexp.ReplaceAllString(text, "$1")
+	text = repeatedCommaRegexp.ReplaceAllString(text, ",")
+	return longEllipsisRegexp.ReplaceAllString(text, "...")
+}
+
+var cjkMarks = map[rune]rune{'!': '！', '?': '？', ':': '：', ';': '；', '(': '（', ')': '）'}
+
+// isCJK reports whether r is a Han, kana or Hangul character or a full-width mark.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		(r >= 0x3000 && r <= 0x303F) || (r >= 0xFF00 && r <= 0xFFEF)
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// cjkPunctuation converts ASCII marks to full-width (except the separators of numbers, e.g. "1,000" and "3.5")
+// and full-width letters and digits to ASCII, removes the spaces next to CJK characters and collapses
+// repeated marks.
+func (l *language) cjkPunctuation(text string) string {
+	runes := []rune(strings.ReplaceAll(text, "...", "…"))
+	for i, r := range runes {
+		if (r >= '０' && r <= '９') || (r >= 'Ａ' && r <= 'Ｚ') || (r >= 'ａ' && r <= 'ｚ') {
+			runes[i] = r - 0xFEE0
+		} else if r == 0x3000 {
+			runes[i] = ' '
+		}
+	}
+	var out []rune
+	for i, r := range runes {
+		var prev, next rune
+		if i > 0 {
+			prev = runes[i-1]
+		}
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		separator := isDigit(prev) && isDigit(next)
+		switch {
+		case r == '…':
+			if len(out) == 0 || out[len(out)-1] != '…' {
+				out = append(out, '…', '…')
+			}
+			continue
+		case (r == ',' || r == '，' || r == '、') && !separator:
+			r = l.comma
+		case r == '.' && !separator:
+			r = '。'
+		case cjkMarks[r] != 0 && !(r == ':' && separator):
+			r = cjkMarks[r]
+		}
+		// Collapse repeated sentence marks and commas
+		if len(out) > 0 && out[len(out)-1] == r && strings.ContainsRune("。！？，、", r) {
+			continue
+		}
+		out = append(out, r)
+	}
+	// Remove the spaces next to CJK characters
+	var result []rune
+	for i, r := range out {
+		if r == ' ' && ((i > 0 && isCJK(out[i-1])) || (i+1 < len(out) && isCJK(out[i+1]))) {
+			continue
+		}
+		result = append(result, r)
+	}
+	return string(result)
+}
+
+var (
+	sentenceStartRegexp = regexp.MustCompile(`(^|[.!?]\s+)(["'(]?)(\p{Ll})`)
+	pronounIRegexp      = regexp.MustCompile(`\bi\b`)
+)
+
+// lowerShouted returns the text lowercased if it's shouted: all caps, of at least 8 letters.
+func lowerShouted(text string) string {
+	letters, upper := 0, 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= 8 && upper == letters {
+		return strings.ToLower(text)
+	}
+	return text
+}
+
+// sentenceCase capitalizes the first word of each sentence and the pronoun "I".
+func sentenceCase(text string) string {
+	text = pronounIRegexp.ReplaceAllString(text, "I")
+	return sentenceStartRegexp.ReplaceAllStringFunc(text, func(s string) string {
+		runes := []rune(s)
+		runes[len(runes)-1] = unicode.ToUpper(runes[len(runes)-1])
+		return string(runes)
+	})
+}
+
+const (
+	sentenceEnders = ".!?…。！？"
+	pauseMarks     = ",;:、，；："
+	closingMarks   = `"')]}”’」』）】》`
+)
+
+// ensureEnding ends a non-empty text with a sentence-ending mark of the language, replacing a trailing pause mark.
+// The ending goes before the closing quotes and brackets.
+func (l *language) ensureEnding(text string) string {
+	body := strings.TrimRight(text, closingMarks+" ")
+	if body == "" {
+		return text
+	}
+	closing := text[len(body):]
+	last := []rune(body)[len([]rune(body))-1]
+	if strings.ContainsRune(sentenceEnders, last) {
+		return text
+	}
+	ending := "."
+	if l.cjk {
+		ending = "。"
+	}
+	if strings.ContainsRune(pauseMarks, last) {
+		body = strings.TrimRight(body[:len(body)-len(string(last))], " ")
+	}
+	return body + ending + strings.TrimLeft(closing, " ")
+}
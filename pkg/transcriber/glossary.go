@@ -0,0 +1,126 @@
+package transcriber
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sagan/goaider/util"
+)
+
+// Appended to the transcription prompt if a glossary is set
+const glossaryPrompt = `
+The audio may contain the following names and terms. If they are spoken, use these exact spellings: %s.`
+
+// GlossaryEntry is a term (proper noun, jargon) of the glossary with its known misspellings.
+type GlossaryEntry struct {
+	term         string
+	misspellings []string
+}
+
+// LoadGlossary reads a glossary file. Each line is a term, optionally followed by ":" and
+// a comma-separated list of its known misspellings, which are fixed in the transcript, e.g.:
+//
+//	Hatsune Miku: hatsunemiku, hatsune mikku
+func LoadGlossary(path string) ([]*GlossaryEntry, error) {
+	lines, err := util.ReadListFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var glossary []*GlossaryEntry
+	for _, line := range lines {
+		term, misspellings, _ := strings.Cut(line, ":")
+		entry := &GlossaryEntry{term: strings.TrimSpace(term)}
+		if entry.term == "" {
+			return nil, fmt.Errorf("invalid glossary line %q: empty term", line)
+		}
+		for _, misspelling := range strings.Split(misspellings, ",") {
+			misspelling = strings.TrimSpace(misspelling)
+			if misspelling == "" {
+				continue
+			}
+			entry.misspellings = append(entry.misspellings, misspelling)
+		}
+		glossary = append(glossary, entry)
+	}
+	return glossary, nil
+}
+
+// glossaryPromptSuffix returns the transcription prompt suffix of the spelling hints of glossary.
+func glossaryPromptSuffix(glossary []*GlossaryEntry) string {
+	if len(glossary) == 0 {
+		return ""
+	}
+	terms := make([]string, len(glossary))
+	for i, entry := range glossary {
+		terms[i] = fmt.Sprintf("%q", entry.term)
+	}
+	return fmt.Sprintf(glossaryPrompt, strings.Join(terms, ", "))
+}
+
+// ApplyGlossary replaces the known misspellings of glossary terms in transcript with the correct terms,
+// in one pass: a whole misspelling is matched case-insensitively, not as part of a longer word, and
+// the replaced text is not scanned again (a misspelling may be a part of its own term, e.g. "miku").
+func ApplyGlossary(glossary []*GlossaryEntry, transcript string) string {
+	var misspellings, terms []string
+	for _, entry := range glossary {
+		for _, misspelling := range entry.misspellings {
+			misspellings = append(misspellings, misspelling)
+			terms = append(terms, entry.term)
+		}
+	}
+	if len(misspellings) == 0 {
+		return transcript
+	}
+	// Each misspelling is a group, longer ones first, so the longest one at a position is matched
+	order := make([]int, len(misspellings))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return len(misspellings[b]) - len(misspellings[a]) })
+	groups := make([]string, len(order))
+	for i, index := range order {
+		groups[i] = "(" + regexp.QuoteMeta(misspellings[index]) + ")"
+	}
+	re := regexp.MustCompile("(?i)" + strings.Join(groups, "|"))
+
+	var sb strings.Builder
+	pos := 0 // transcript[:pos] is done
+	for start := 0; start < len(transcript); {
+		match := re.FindStringSubmatchIndex(transcript[start:])
+		if match == nil {
+			break
+		}
+		matchStart, matchEnd := start+match[0], start+match[1]
+		if !isWordBoundary(transcript, matchStart) || !isWordBoundary(transcript, matchEnd) {
+			// Part of a longer word, retry from the next char
+			_, size := utf8.DecodeRuneInString(transcript[matchStart:])
+			start = matchStart + max(size, 1)
+			continue
+		}
+		for i := range order {
+			if match[2+2*i] >= 0 {
+				sb.WriteString(transcript[pos:matchStart])
+				sb.WriteString(terms[order[i]])
+				break
+			}
+		}
+		pos, start = matchEnd, matchEnd
+	}
+	sb.WriteString(transcript[pos:])
+	return sb.String()
+}
+
+// isWordBoundary reports whether pos of s is not between two letters or digits.
+func isWordBoundary(s string, pos int) bool {
+	if pos == 0 || pos == len(s) {
+		return true
+	}
+	before, _ := utf8.DecodeLastRuneInString(s[:pos])
+	after, _ := utf8.DecodeRuneInString(s[pos:])
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }
+	return !isWord(before) || !isWord(after)
+}
@@ -0,0 +1,78 @@
+package transcriber
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sagan/goaider/gemini"
+)
+
+// Marker of uncertain / unintelligible speech in review mode transcripts
+const InaudibleMarker = "[inaudible]"
+
+// Appended to the transcription prompt in review mode (Options.Review)
+const reviewPrompt = `
+Split the transcript into segments (sentences or utterances). For each segment, rate your confidence
+in its transcription from 0.0 (guess) to 1.0 (certain). Replace words you can not make out with "` + InaudibleMarker + `".
+"transcript" is the full transcribed text.`
+
+// TranscriptReview is the structured transcription of review mode, saved as the .json sidecar file.
+type TranscriptReview struct {
+	Transcript string          `json:"transcript"`
+	Segments   []ReviewSegment `json:"segments"`
+	// Whether the transcript needs human review
+	NeedsReview bool `json:"needs_review"`
+}
+
+type ReviewSegment struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+}
+
+var reviewSchema = &gemini.Schema{
+	Type: "OBJECT",
+	Properties: map[string]*gemini.Schema{
+		"transcript": {Type: "STRING"},
+		"segments": {
+			Type: "ARRAY",
+			Items: &gemini.Schema{
+				Type: "OBJECT",
+				Properties: map[string]*gemini.Schema{
+					"text":       {Type: "STRING"},
+					"confidence": {Type: "NUMBER"},
+				},
+				Required: []string{"text", "confidence"},
+			},
+		},
+	},
+	Required: []string{"transcript", "segments"},
+}
+
+// ParseReview parses the review mode response text. The transcript needs review
+// if it has inaudible parts or any segment's confidence is lower than threshold.
+func ParseReview(text string, threshold float64) (*TranscriptReview, error) {
+	review := &TranscriptReview{}
+	if err := json.Unmarshal([]byte(text), review); err != nil {
+		return nil, fmt.Errorf("invalid structured transcript response %q: %w", text, err)
+	}
+	review.Transcript = strings.TrimSpace(review.Transcript)
+	if review.Transcript == "" {
+		return nil, fmt.Errorf("empty transcript in structured response")
+	}
+	review.NeedsReview = strings.Contains(review.Transcript, InaudibleMarker) ||
+		len(LowConfidenceSegments(review, threshold)) > 0
+	return review, nil
+}
+
+// LowConfidenceSegments returns the segments of review whose confidence is lower than threshold
+// or that have inaudible parts.
+func LowConfidenceSegments(review *TranscriptReview, threshold float64) []ReviewSegment {
+	var segments []ReviewSegment
+	for _, segment := range review.Segments {
+		if segment.Confidence < threshold || strings.Contains(segment.Text, InaudibleMarker) {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,190 @@
+// Package transcriber generates speech-to-text transcripts of audio using a provider (e.g. the Gemini API).
+// It's the library API of the stt command.
+package transcriber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sagan/goaider/constants"
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/pkg/batch"
+	"github.com/sagan/goaider/pkg/provider"
+	"github.com/sagan/goaider/util"
+)
+
+// DefaultPrompt is the transcription prompt.
+const DefaultPrompt = "Generate a transcript of this audio. Only output the transcribed text."
+
+// Options are the options of how a transcript is requested and post-processed.
+type Options struct {
+	// The model. Default: constants.DEFAULT_GEMINI_MODEL
+	Model string
+	// Language of the audio (e.g. "en", "Japanese"), as a hint to the model. "" = auto detect
+	Language string
+	// Names / terms used as spelling hints. Their known misspellings are fixed in transcripts
+	Glossary []*GlossaryEntry
+	// Review mode: the model marks unintelligible words as InaudibleMarker and rates the confidence
+	// of each segment. A transcript with any segment confidence below ReviewThreshold needs review
+	Review          bool
+	ReviewThreshold float64
+	// Sampling parameters. nil = model defaults
+	Sampling *gemini.Sampling
+	// Re-transcribe the audio files which have transcripts (TranscribeFiles)
+	Force bool
+	// Extension of the transcript files (e.g. ".lab"). Default: ".txt"
+	OutputExt string
+	// Write the transcript files with the UTF-8 BOM
+	BOM bool
+	// Where status messages (e.g. mislabeled audio files) are written. nil = discard
+	Log io.Writer
+}
+
+// Result is the transcript of an audio.
+type Result struct {
+	Transcript string
+	// The review in review mode
+	Review *TranscriptReview
+}
+
+func (opts *Options) model() string {
+	if opts.Model == "" {
+		return constants.DEFAULT_GEMINI_MODEL
+	}
+	return opts.Model
+}
+
+// Transcribe transcribes the audio data using p.
+func Transcribe(ctx context.Context, p provider.TranscribeProvider, audioData []byte, mimeType string,
+	opts *Options) (*Result, error) {
+	text, err := p.Transcribe(ctx, NewRequest(audioData, mimeType, opts))
+	if err != nil {
+		return nil, err
+	}
+	return ParseResponse(text, opts)
+}
+
+// TranscribeFile transcribes the audio file at audioPath.
+func TranscribeFile(ctx context.Context, p provider.TranscribeProvider, audioPath string, opts *Options) (*Result, error) {
+	mimeType := MimeType(strings.ToLower(filepath.Ext(audioPath)))
+	if mimeType == "" {
+		return nil, fmt.Errorf("unsupported audio file type %q", filepath.Ext(audioPath))
+	}
+	audioData, err := os.ReadFile(util.LongPath(audioPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audio file: %w", err)
+	}
+	mimeType, warning := util.CheckMimeType(audioData, mimeType)
+	if warning != "" && opts.Log != nil {
+		fmt.Fprintf(opts.Log, "  ...%s: %s\n", filepath.Base(audioPath), warning)
+	}
+	return Transcribe(ctx, p, audioData, mimeType, opts)
+}
+
+// TranscribeFiles transcribes the audio files, saving each transcript to the .txt (opts.OutputExt) file of the audio
+// (and the review to the .json file in review mode). Audio files which have transcripts are skipped
+// unless opts.Force is set. See batch.Run for the error handling.
+func TranscribeFiles(ctx context.Context, p provider.TranscribeProvider, audioPaths []string, opts *Options,
+	onProgress batch.ProgressFunc) error {
+	return batch.Run(ctx, audioPaths, func(ctx context.Context, audioPath string) (string, bool, error) {
+		txtPath := TranscriptFilePath(audioPath, opts.OutputExt)
+		if !opts.Force && util.OutputUpToDate(audioPath, txtPath, false) {
+			return txtPath, true, nil
+		}
+		result, err := TranscribeFile(ctx, p, audioPath, opts)
+		if err != nil {
+			return "", false, err
+		}
+		return txtPath, false, Save(audioPath, result, opts)
+	}, onProgress)
+}
+
+// ParseResponse parses the model response text (the JSON of TranscriptReview in review mode)
+// and applies the glossary to the transcript.
+func ParseResponse(text string, opts *Options) (*Result, error) {
+	if !opts.Review {
+		return &Result{Transcript: ApplyGlossary(opts.Glossary, text)}, nil
+	}
+	review, err := ParseReview(text, opts.ReviewThreshold)
+	if err != nil {
+		return nil, err
+	}
+	review.Transcript = ApplyGlossary(opts.Glossary, review.Transcript)
+	for i := range review.Segments {
+		review.Segments[i].Text = ApplyGlossary(opts.Glossary, review.Segments[i].Text)
+	}
+	return &Result{Transcript: review.Transcript, Review: review}, nil
+}
+
+// Save writes the transcript to the .txt (opts.OutputExt) file of the audio file (and the review to the .json file).
+func Save(audioPath string, result *Result, opts *Options) error {
+	outputPath := strings.TrimSuffix(audioPath, filepath.Ext(audioPath))
+	if result.Review != nil {
+		data, _ := json.MarshalIndent(result.Review, "", "  ")
+		if err := util.WriteFileAtomic(outputPath+".json", data); err != nil {
+			return fmt.Errorf("failed to write review file: %w", err)
+		}
+	}
+	if err := util.WriteTextFile(TranscriptFilePath(audioPath, opts.OutputExt), result.Transcript, opts.BOM); err != nil {
+		return fmt.Errorf("failed to write transcript file: %w", err)
+	}
+	return nil
+}
+
+// TranscriptFilePath returns the path of the transcript file of the audio file at audioPath. ext "" = ".txt"
+func TranscriptFilePath(audioPath string, ext string) string {
+	if ext == "" {
+		ext = ".txt"
+	}
+	return strings.TrimSuffix(audioPath, filepath.Ext(audioPath)) + ext
+}
+
+// languagePromptSuffix returns the prompt suffix of the language hint.
+func languagePromptSuffix(language string) string {
+	if language == "" {
+		return ""
+	}
+	return fmt.Sprintf(" The audio is in %s; write the transcript in this language.", language)
+}
+
+// NewRequest returns the provider request to transcribe the audio.
+func NewRequest(audioData []byte, mimeType string, opts *Options) *provider.TranscribeRequest {
+	request := &provider.TranscribeRequest{
+		Model:    opts.model(),
+		Prompt:   DefaultPrompt + languagePromptSuffix(opts.Language) + glossaryPromptSuffix(opts.Glossary),
+		Audio:    audioData,
+		MimeType: mimeType,
+	}
+	if opts.Review {
+		request.Prompt += reviewPrompt
+		request.Config = &gemini.GenerationConfig{
+			ResponseMimeType: "application/json",
+			ResponseSchema:   reviewSchema,
+		}
+	}
+	request.Config = opts.Sampling.Apply(request.Config)
+	return request
+}
+
+// MimeType maps (lower case) file extensions to their MIME types for the API. It returns "" if not supported.
+func MimeType(ext string) string {
+	switch ext {
+	case ".wav":
+		return "audio/wav"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a":
+		return "audio/m4a"
+	case ".flac":
+		return "audio/flac"
+	case ".ogg":
+		return "audio/ogg"
+	default:
+		return "" // Not a supported type
+	}
+}
@@ -0,0 +1,115 @@
+// Package queue stores API requests prepared offline (--queue-only) in a dataset dir,
+// to be sent later by the flush-queue command.
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sagan/goaider/gemini"
+	"github.com/sagan/goaider/util"
+)
+
+// Dir (relative to a dataset dir) of the queued requests. Each request is a "<source file>.<command>.json" file.
+const QUEUE_DIR = ".goaider/queue"
+
+// Item is a queued API request of a source file.
+type Item struct {
+	Command   string          `json:"command"` // The command that queued it, e.g. "caption"
+	Source    string          `json:"source"`  // The filename of the source file, in the dataset dir
+	Model     string          `json:"model"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Request   *gemini.Request `json:"request"`
+	// Command specific options to process the response with, e.g. the identity of caption
+	Options json.RawMessage `json:"options,omitempty"`
+
+	// The path of the queue file
+	path string
+}
+
+// Handler processes the response text of a queued request, e.g. writes the caption to the sidecar file.
+type Handler func(item *Item, sourcePath string, text string) error
+
+var handlers = map[string]Handler{}
+
+// Register registers the handler of the items queued by command. It's called in the init of commands.
+func Register(command string, handler Handler) {
+	handlers[command] = handler
+}
+
+// HandlerOf returns the registered handler of command, or nil.
+func HandlerOf(command string) Handler {
+	return handlers[command]
+}
+
+// Add queues a request of the source file at sourcePath, overwriting the existing one of the same command.
+func Add(command string, sourcePath string, model string, request *gemini.Request, options any) error {
+	item := &Item{
+		Command:   command,
+		Source:    filepath.Base(sourcePath),
+		Model:     model,
+		CreatedAt: time.Now(),
+		Request:   request,
+	}
+	if options != nil {
+		data, err := json.Marshal(options)
+		if err != nil {
+			return err
+		}
+		item.Options = data
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	queueDir := filepath.Join(filepath.Dir(sourcePath), filepath.FromSlash(QUEUE_DIR))
+	if err := os.MkdirAll(util.LongPath(queueDir), 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(queueDir, item.Source+"."+command+".json")
+	if err := os.WriteFile(util.LongPath(path), data, 0644); err != nil {
+		return fmt.Errorf("failed to write queue file: %w", err)
+	}
+	return nil
+}
+
+// List returns all queued items of dir, oldest first.
+func List(dir string) ([]*Item, error) {
+	queueDir := filepath.Join(dir, filepath.FromSlash(QUEUE_DIR))
+	entries, err := os.ReadDir(util.LongPath(queueDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var items []*Item
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(queueDir, entry.Name())
+		data, err := os.ReadFile(util.LongPath(path))
+		if err != nil {
+			return nil, err
+		}
+		item := &Item{}
+		if err := json.Unmarshal(data, item); err != nil || item.Request == nil {
+			return nil, fmt.Errorf("invalid queue file %q: %v", path, err)
+		}
+		item.path = path
+		items = append(items, item)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].CreatedAt.Before(items[j].CreatedAt) })
+	return items, nil
+}
+
+// Remove deletes the queue file of an item returned by List.
+func (item *Item) Remove() error {
+	return os.Remove(util.LongPath(item.path))
+}
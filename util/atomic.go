@@ -0,0 +1,55 @@
+package util
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to the file at filename atomically, see WriteAtomic.
+func WriteFileAtomic(filename string, data []byte) error {
+	return WriteAtomic(filename, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// CopyFileAtomic copies the file at src to dst atomically, see WriteAtomic.
+func CopyFileAtomic(src, dst string) error {
+	f, err := os.Open(LongPath(src))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return WriteAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// WriteAtomic writes the file at filename by calling write with a temp file in the same dir,
+// which is renamed to filename only if write succeeds. So an interrupted run never leaves a truncated file,
+// which would be skipped as an existing output by later runs. The mode of the file is 0644.
+func WriteAtomic(filename string, write func(w io.Writer) error) (err error) {
+	filename = LongPath(filename)
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	if err = write(file); err != nil {
+		return err
+	}
+	if err = file.Chmod(0644); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
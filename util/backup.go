@@ -0,0 +1,101 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dir (relative to a dataset dir) of the caption backups. Each backup is a subdir named by its ID,
+// which is the time of the run that created it.
+const BACKUPS_DIR = ".goaider/backups"
+
+// Backup saves the old versions of files before they are overwritten in a run.
+// The old version of "<dir>/foo.txt" is saved to "<dir>/.goaider/backups/<id>/foo.txt".
+type Backup struct {
+	ID string
+}
+
+// NewBackup returns a backup identified by the current time.
+func NewBackup() *Backup {
+	return &Backup{ID: time.Now().Format("20060102-150405")}
+}
+
+// Save copies the file at path into the backup, if it exists. A file already saved in this backup is kept.
+func (b *Backup) Save(path string) error {
+	data, err := os.ReadFile(LongPath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	backupPath := BackupPath(filepath.Dir(path), b.ID, filepath.Base(path))
+	if _, err := os.Stat(LongPath(backupPath)); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(LongPath(filepath.Dir(backupPath)), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(LongPath(backupPath), data, 0644); err != nil {
+		return fmt.Errorf("failed to back up %q: %w", path, err)
+	}
+	return nil
+}
+
+// BackupPath returns the path of file name in the backup id of dir.
+func BackupPath(dir string, id string, name string) string {
+	return filepath.Join(dir, filepath.FromSlash(BACKUPS_DIR), id, name)
+}
+
+// ListBackups returns the IDs of all backups of dir, oldest first.
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(LongPath(filepath.Join(dir, filepath.FromSlash(BACKUPS_DIR))))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// File (relative to a dataset dir) listing the files flagged for deletion, one filename per line,
+// e.g. by review or filter-audio. goaider never deletes them by itself.
+const FLAGGED_FILE = ".goaider/flagged.txt"
+
+// ReadFlagged returns the flagged filenames of dir.
+func ReadFlagged(dir string) ([]string, error) {
+	names, err := ReadListFile(LongPath(filepath.Join(dir, filepath.FromSlash(FLAGGED_FILE))))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return names, err
+}
+
+// WriteFlagged writes the flagged filenames of dir, sorted.
+func WriteFlagged(dir string, names []string) error {
+	names = slices.Clone(names)
+	sort.Strings(names)
+	names = slices.Compact(names)
+	path := filepath.Join(dir, filepath.FromSlash(FLAGGED_FILE))
+	if err := os.MkdirAll(LongPath(filepath.Dir(path)), 0755); err != nil {
+		return err
+	}
+	content := strings.Join(names, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return os.WriteFile(LongPath(path), []byte(content), 0644)
+}
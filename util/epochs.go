@@ -0,0 +1,164 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/xxr3376/gtboard/pkg/ingest"
+)
+
+// ScalarStats are the aggregated values of a scalar tag in an epoch. NaN values are skipped.
+type ScalarStats struct {
+	Count    int     `json:"count"`
+	Mean     float64 `json:"mean"`
+	Min      float64 `json:"min"`
+	Last     float64 `json:"last"` // the value of the last step
+	lastStep int64
+}
+
+// EpochScalars are the scalars of an event file aggregated per epoch.
+type EpochScalars struct {
+	Tags   []string
+	Epochs []int64 // 1-based, sorted
+	// tag => epoch => stats
+	Stats map[string]map[int64]*ScalarStats
+}
+
+// StepEpoch returns the 1-based epoch of step: steps 1..stepsPerEpoch (and step 0) are epoch 1.
+func StepEpoch(step int64, stepsPerEpoch int64) int64 {
+	return max(step-1, 0)/stepsPerEpoch + 1
+}
+
+// AggregateScalarsByEpoch aggregates the scalar values of each tag per epoch of stepsPerEpoch steps.
+func AggregateScalarsByEpoch(scalars map[string]*ingest.ScalarEvents, stepsPerEpoch int64) *EpochScalars {
+	result := &EpochScalars{Stats: map[string]map[int64]*ScalarStats{}}
+	epochs := map[int64]bool{}
+	for tag, events := range scalars {
+		result.Tags = append(result.Tags, tag)
+		tagStats := map[int64]*ScalarStats{}
+		result.Stats[tag] = tagStats
+		for i, step := range events.Step {
+			value := float64(events.Value[i])
+			if math.IsNaN(value) {
+				continue
+			}
+			epoch := StepEpoch(step, stepsPerEpoch)
+			epochs[epoch] = true
+			stats := tagStats[epoch]
+			if stats == nil {
+				stats = &ScalarStats{Min: value, lastStep: step}
+				tagStats[epoch] = stats
+			}
+			stats.Count++
+			// Running mean, to avoid overflow of large sums
+			stats.Mean += (value - stats.Mean) / float64(stats.Count)
+			stats.Min = min(stats.Min, value)
+			if step >= stats.lastStep {
+				stats.Last = value
+				stats.lastStep = step
+			}
+		}
+	}
+	sort.Strings(result.Tags)
+	for epoch := range epochs {
+		result.Epochs = append(result.Epochs, epoch)
+	}
+	sort.Slice(result.Epochs, func(i, j int) bool { return result.Epochs[i] < result.Epochs[j] })
+	return result
+}
+
+// aggregates are the column names of the stats of ScalarStats.
+var aggregates = []string{"mean", "min", "last"}
+
+func (s *ScalarStats) values() []float64 {
+	return []float64{s.Mean, s.Min, s.Last}
+}
+
+// PrintTable prints the epoch table to stdout: a row per epoch and mean / min / last columns per tag.
+// If transpose is true, it prints a row per tag and aggregate and a column per epoch instead,
+// which reads better with many tags.
+func (e *EpochScalars) PrintTable(transpose bool) {
+	if transpose {
+		fmt.Printf("% -30s", "Tag")
+		for _, epoch := range e.Epochs {
+			fmt.Printf("% -12s", fmt.Sprintf("Epoch %d", epoch))
+		}
+		fmt.Printf("\n")
+		for _, tag := range e.Tags {
+			for i, aggregate := range aggregates {
+				fmt.Printf("% -30s", tag+" ("+aggregate+")")
+				for _, epoch := range e.Epochs {
+					if stats := e.Stats[tag][epoch]; stats != nil {
+						fmt.Printf("% -12f", stats.values()[i])
+					} else {
+						fmt.Printf("% -12s", "")
+					}
+				}
+				fmt.Printf("\n")
+			}
+		}
+		return
+	}
+	fmt.Printf("% -8s", "Epoch")
+	for _, tag := range e.Tags {
+		for _, aggregate := range aggregates {
+			fmt.Printf("% -20s", tag+" ("+aggregate+")")
+		}
+	}
+	fmt.Printf("\n")
+	for _, epoch := range e.Epochs {
+		fmt.Printf("% -8d", epoch)
+		for _, tag := range e.Tags {
+			stats := e.Stats[tag][epoch]
+			for i := range aggregates {
+				if stats != nil {
+					fmt.Printf("% -20f", stats.values()[i])
+				} else {
+					fmt.Printf("% -20s", "")
+				}
+			}
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// SaveCSV saves the epoch table (a row per epoch) to a CSV file. opts may be nil.
+func (e *EpochScalars) SaveCSV(filename string, opts *CSVOptions) (err error) {
+	writer, closeCSV, err := opts.CreateCSV(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := closeCSV(); err == nil {
+			err = closeErr
+		}
+	}()
+	header := []string{"Epoch"}
+	for _, tag := range e.Tags {
+		for _, aggregate := range aggregates {
+			header = append(header, tag+" ("+aggregate+")")
+		}
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, epoch := range e.Epochs {
+		row := []string{strconv.FormatInt(epoch, 10)}
+		for _, tag := range e.Tags {
+			stats := e.Stats[tag][epoch]
+			for i := range aggregates {
+				if stats != nil {
+					row = append(row, opts.FormatFloat(stats.values()[i], 64))
+				} else {
+					row = append(row, "")
+				}
+			}
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
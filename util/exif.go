@@ -0,0 +1,147 @@
+package util
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// EXIF fields of ReadExifFields
+const (
+	EXIF_CAMERA       = "camera"       // camera make and model
+	EXIF_LENS         = "lens"         // lens model
+	EXIF_DATE         = "date"         // capture date
+	EXIF_ORIENTATION  = "orientation"  // portrait / landscape / square, after applying the EXIF orientation
+	EXIF_FOCAL_LENGTH = "focal-length" // focal length (35mm equivalent if known)
+	EXIF_EXPOSURE     = "exposure"     // exposure time, aperture and ISO
+	EXIF_GPS          = "gps"          // GPS coordinates of the capture location
+)
+
+// EXIF_FIELDS are all the fields supported by ReadExifFields.
+var EXIF_FIELDS = []string{EXIF_CAMERA, EXIF_LENS, EXIF_DATE, EXIF_ORIENTATION, EXIF_FOCAL_LENGTH,
+	EXIF_EXPOSURE, EXIF_GPS}
+
+// ReadExifFields reads the EXIF metadata of the image file at path and returns the human-readable values
+// of fields (of EXIF_FIELDS). Fields missing in the image are omitted. It returns an empty map
+// (and no error) if the image has no EXIF metadata.
+func ReadExifFields(path string, fields []string) (map[string]string, error) {
+	file, err := os.Open(LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := map[string]string{}
+	x, err := exif.Decode(file)
+	if err != nil {
+		return values, nil
+	}
+	str := func(name exif.FieldName) string {
+		if tag, err := x.Get(name); err == nil {
+			if s, err := tag.StringVal(); err == nil {
+				return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+			}
+		}
+		return ""
+	}
+	rat := func(name exif.FieldName) (float64, bool) {
+		if tag, err := x.Get(name); err == nil {
+			if r, err := tag.Rat(0); err == nil && r.Sign() > 0 {
+				f, _ := r.Float64()
+				return f, true
+			}
+		}
+		return 0, false
+	}
+	integer := func(name exif.FieldName) (int, bool) {
+		if tag, err := x.Get(name); err == nil {
+			if i, err := tag.Int(0); err == nil && i > 0 {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	for _, field := range fields {
+		var value string
+		switch field {
+		case EXIF_CAMERA:
+			maker, model := str(exif.Make), str(exif.Model)
+			// Many cameras include the make in the model, e.g. "Canon" "Canon EOS R5"
+			if maker != "" && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+				model = strings.TrimSpace(maker + " " + model)
+			}
+			value = model
+		case EXIF_LENS:
+			value = str(exif.LensModel)
+		case EXIF_DATE:
+			if t, err := x.DateTime(); err == nil {
+				value = t.Format("2006-01-02 15:04")
+			}
+		case EXIF_ORIENTATION:
+			value = imageOrientation(file, x)
+		case EXIF_FOCAL_LENGTH:
+			if mm, ok := integer(exif.FocalLengthIn35mmFilm); ok {
+				value = fmt.Sprintf("%dmm (35mm equivalent)", mm)
+			} else if mm, ok := rat(exif.FocalLength); ok {
+				value = fmt.Sprintf("%gmm", mm)
+			}
+		case EXIF_EXPOSURE:
+			var parts []string
+			if t, ok := rat(exif.ExposureTime); ok {
+				if t < 1 {
+					parts = append(parts, fmt.Sprintf("1/%.0fs", 1/t))
+				} else {
+					parts = append(parts, fmt.Sprintf("%gs", t))
+				}
+			}
+			if f, ok := rat(exif.FNumber); ok {
+				parts = append(parts, fmt.Sprintf("f/%g", f))
+			}
+			if iso, ok := integer(exif.ISOSpeedRatings); ok {
+				parts = append(parts, fmt.Sprintf("ISO %d", iso))
+			}
+			value = strings.Join(parts, " ")
+		case EXIF_GPS:
+			if lat, long, err := x.LatLong(); err == nil {
+				value = fmt.Sprintf("%.4f, %.4f", lat, long)
+			}
+		default:
+			return nil, fmt.Errorf("unknown EXIF field %q", field)
+		}
+		if value != "" {
+			values[field] = value
+		}
+	}
+	return values, nil
+}
+
+// imageOrientation returns "portrait", "landscape" or "square" of the image file,
+// as displayed (after applying the EXIF orientation). It returns "" if the image can not be decoded.
+func imageOrientation(file io.ReadSeeker, x *exif.Exif) string {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return ""
+	}
+	width, height := config.Width, config.Height
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		// Orientations 5-8 rotate the image by 90 degrees
+		if orientation, _ := tag.Int(0); orientation >= 5 && orientation <= 8 {
+			width, height = height, width
+		}
+	}
+	switch {
+	case width > height:
+		return "landscape"
+	case width < height:
+		return "portrait"
+	default:
+		return "square"
+	}
+}
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// FileFilter selects the files processed by a directory-scanning command,
+// using --include, --exclude and --since flags.
+//
+// Each include / exclude pattern is a glob (e.g. "*.png") matched against the filename,
+// or a regular expression if it's enclosed in slashes (e.g. "/^IMG_\d+/").
+type FileFilter struct {
+	Include []string
+	Exclude []string
+	// Duration (e.g. "12h", "7d") or date / time (e.g. "2006-01-02", RFC3339)
+	Since string
+
+	includes []*filePattern
+	excludes []*filePattern
+	since    time.Time
+}
+
+type filePattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+// AddFlags registers the filter flags to flags.
+func (f *FileFilter) AddFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&f.Include, "include", nil,
+		`Only process files whose names match this glob (or "/regexp/") pattern. Can be set multiple times`)
+	flags.StringArrayVar(&f.Exclude, "exclude", nil,
+		`Skip files whose names match this glob (or "/regexp/") pattern. Can be set multiple times`)
+	flags.StringVar(&f.Since, "since", "",
+		`Only process files modified since this time. Duration (e.g. "12h", "7d") or date (e.g. "2006-01-02")`)
+}
+
+// Init parses and validates the flag values. It must be called before Match.
+func (f *FileFilter) Init() (err error) {
+	if f.includes, err = parsePatterns(f.Include); err != nil {
+		return fmt.Errorf("invalid --include: %w", err)
+	}
+	if f.excludes, err = parsePatterns(f.Exclude); err != nil {
+		return fmt.Errorf("invalid --exclude: %w", err)
+	}
+	f.since = time.Time{}
+	if f.Since != "" {
+		if f.since, err = ParseSince(f.Since, time.Now()); err != nil {
+			return fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the file of entry should be processed.
+func (f *FileFilter) Match(entry fs.DirEntry) bool {
+	name := entry.Name()
+	if len(f.includes) > 0 && !matchAny(f.includes, name) {
+		return false
+	}
+	if matchAny(f.excludes, name) {
+		return false
+	}
+	if !f.since.IsZero() {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(f.since) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSince parses a duration (relative to now) or a date / time string to a time.
+// Besides time.ParseDuration units, a "d" (day) suffix is supported, e.g. "7d".
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.ParseFloat(days, 64); err == nil {
+			return now.Add(-time.Duration(n * float64(24*time.Hour))), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration nor a date", value)
+}
+
+func parsePatterns(patterns []string) ([]*filePattern, error) {
+	var result []*filePattern
+	for _, pattern := range patterns {
+		if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &filePattern{regexp: re})
+		} else {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%q: %w", pattern, err)
+			}
+			result = append(result, &filePattern{glob: pattern})
+		}
+	}
+	return result, nil
+}
+
+func matchAny(patterns []*filePattern, name string) bool {
+	for _, p := range patterns {
+		if p.regexp != nil {
+			if p.regexp.MatchString(name) {
+				return true
+			}
+		} else if ok, _ := filepath.Match(p.glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// LoadImage reads and decodes the image file at path, returning the image and its format (e.g. "jpeg").
+// The EXIF orientation of JPEG images is applied, so the image is upright as displayed by viewers.
+func LoadImage(path string) (image.Image, string, error) {
+	file, err := os.Open(LongPath(path))
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	return DecodeImage(file)
+}
+
+// DecodeImage decodes the image from r, applying the EXIF orientation of JPEG images.
+func DecodeImage(r io.ReadSeeker) (image.Image, string, error) {
+	// 1. Read EXIF data first
+	x, err := exif.Decode(r)
+	var orientation int
+	if err == nil { // If EXIF data exists
+		tag, err := x.Get(exif.Orientation)
+		if err == nil { // If Orientation tag exists
+			orientation, _ = tag.Int(0) // Get the orientation value
+		}
+	}
+
+	// 2. Rewind the file to read it again for image decoding
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	// 3. Decode the image (and get its format)
+	img, imgFormat, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// 4. Apply rotation IF it's a JPEG and has an orientation tag
+	if imgFormat == "jpeg" && orientation > 1 {
+		img = ApplyExifOrientation(img, orientation)
+	}
+	return img, imgFormat, nil
+}
+
+// ApplyExifOrientation checks for an EXIF orientation tag and rotates the image accordingly.
+func ApplyExifOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2: // F: Horizontal Flip
+		return imaging.FlipH(img)
+	case 3: // R180: Rotate 180
+		return imaging.Rotate180(img)
+	case 4: // FV: Vertical Flip
+		return imaging.FlipV(img)
+	case 5: // T: Transpose (FlipH + R270)
+		return imaging.Transpose(img)
+	case 6: // R270: Rotate 270 (or 90 clockwise)
+		return imaging.Rotate270(img)
+	case 7: // TV: Transverse (FlipV + R270)
+		return imaging.Transverse(img)
+	case 8: // R90: Rotate 90 (or 270 clockwise)
+		return imaging.Rotate90(img)
+	default: // 1 or unknown
+		return img
+	}
+}
+
+// ShrinkImageForUpload returns a downscaled JPEG encoding of the image file at path,
+// with the longest side at most maxSide pixels, for use as an API payload. The file itself is not modified.
+// If the image is already small enough (or maxSide <= 0), ok is false and the original file should be sent.
+func ShrinkImageForUpload(path string, maxSide int, quality int) (data []byte, ok bool, err error) {
+	if maxSide <= 0 {
+		return nil, false, nil
+	}
+	img, _, err := LoadImage(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return shrinkImage(img, maxSide, quality)
+}
+
+// ShrinkImageDataForUpload is like ShrinkImageForUpload, but takes the encoded image data (e.g. read from stdin).
+func ShrinkImageDataForUpload(imageData []byte, maxSide int, quality int) (data []byte, ok bool, err error) {
+	if maxSide <= 0 {
+		return nil, false, nil
+	}
+	img, _, err := DecodeImage(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, false, err
+	}
+	return shrinkImage(img, maxSide, quality)
+}
+
+func shrinkImage(img image.Image, maxSide int, quality int) (data []byte, ok bool, err error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= maxSide && height <= maxSide {
+		return nil, false, nil
+	}
+	if data, err = EncodeImageForUpload(img, maxSide, quality); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// EncodeImageForUpload returns the JPEG encoding of the decoded img for use as an API payload, downscaled so that
+// its longest side is at most maxSide pixels (if maxSide > 0). Unlike ShrinkImageForUpload, it always encodes img.
+func EncodeImageForUpload(img image.Image, maxSide int, quality int) ([]byte, error) {
+	if maxSide > 0 {
+		img = imaging.Fit(img, maxSide, maxSide, imaging.Lanczos)
+	}
+	// JPEG has no alpha channel: flatten transparent images onto a white background.
+	background := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+	img = imaging.Overlay(background, img, image.Pt(0, 0), 1)
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(quality)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FitSize returns the dimensions of a width x height image scaled down (preserving aspect ratio)
+// so that its longest side is at most maxSide. If maxSide <= 0, the dimensions are returned as is.
+func FitSize(width, height, maxSide int) (int, int) {
+	if maxSide <= 0 || (width <= maxSide && height <= maxSide) {
+		return width, height
+	}
+	if width >= height {
+		return maxSide, max(1, height*maxSide/width)
+	}
+	return max(1, width*maxSide/height), maxSide
+}
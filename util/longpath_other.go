@@ -0,0 +1,8 @@
+//go:build !windows
+
+package util
+
+// LongPath returns path as is. It's only meaningful on Windows.
+func LongPath(path string) string {
+	return path
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package util
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// LongPath converts path to an extended-length ("\\?\") absolute path,
+// so that it can exceed MAX_PATH (260) characters on Windows.
+// If the path can not be converted, it's returned as is.
+func LongPath(path string) string {
+	if path == "" || strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	// Extended-length paths are not normalized by Windows, so they must be clean and use backslashes.
+	absPath = filepath.Clean(absPath)
+	if strings.HasPrefix(absPath, `\\`) {
+		// UNC path: \\server\share\foo => \\?\UNC\server\share\foo
+		return `\\?\UNC\` + absPath[2:]
+	}
+	return `\\?\` + absPath
+}
@@ -0,0 +1,136 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Name of the dataset manifest file, stored in the root of packed / synced datasets.
+const MANIFEST_FILENAME = "goaider-manifest.json"
+
+// Manifest describes the files of a dataset dir.
+type Manifest struct {
+	Name      string         `json:"name"`
+	Version   string         `json:"version,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file of the dataset. Path is relative to the dataset dir, with "/" separators.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// TotalSize returns the total size of the files.
+func (m *Manifest) TotalSize() int64 {
+	var size int64
+	for _, file := range m.Files {
+		size += file.Size
+	}
+	return size
+}
+
+// Hash returns the hex encoded SHA-256 hash of the paths and hashes of the files, which identifies
+// the dataset content regardless of the name, version and creation time of the manifest.
+func (m *Manifest) Hash() string {
+	files := slices.Clone(m.Files)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	h := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(h, "%s\t%s\n", file.Path, file.Sha256)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BuildManifest walks dir recursively and hashes all regular files for which match returns true
+// (all files if match is nil). Hidden files and dirs (starting with ".") and the manifest file itself
+// are skipped. Files are sorted by path.
+func BuildManifest(dir string, match func(path string, entry fs.DirEntry) bool) (*Manifest, error) {
+	manifest := &Manifest{Name: filepath.Base(dir), CreatedAt: time.Now()}
+	if abs, err := filepath.Abs(dir); err == nil {
+		manifest.Name = filepath.Base(abs)
+	}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && entry.Name()[0] == '.' {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == MANIFEST_FILENAME || (match != nil && !match(relPath, entry)) {
+			return nil
+		}
+		size, sum, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, ManifestFile{Path: relPath, Size: size, Sha256: sum})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+	return manifest, nil
+}
+
+// HashFile returns the size and hex encoded SHA-256 hash of the file at path.
+func HashFile(path string) (int64, string, error) {
+	f, err := os.Open(LongPath(path))
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadManifest reads a manifest JSON file.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(data)
+}
+
+// ParseManifest parses the JSON of a manifest.
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Marshal returns the indented JSON of the manifest.
+func (m *Manifest) Marshal() []byte {
+	data, _ := json.MarshalIndent(m, "", "  ")
+	return data
+}
@@ -0,0 +1,193 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CORRUPT_DIR is the folder (next to the files) where corrupt media files are moved by --move-corrupt.
+const CORRUPT_DIR = "_corrupt"
+
+// CheckMediaFile quickly checks that the image or audio file at path is not empty, truncated or unreadable,
+// so it can be excluded from a run before any API call. Only the header and the end of the file are read,
+// except for images which look truncated, which are fully decoded to confirm it.
+// Files of other formats are only checked to be not empty.
+// A corrupt file is reported as an error; it never panics, as the check is run on untrusted files.
+func CheckMediaFile(path string) (err error) {
+	defer func() {
+		// A decoder crashed on malformed data, which is corruption as well
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unreadable file: %v", r)
+		}
+	}()
+	file, err := os.Open(LongPath(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("zero-byte file")
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return checkImage(file, info.Size())
+	case ".wav":
+		return checkWav(file, info.Size())
+	case ".mp3", ".m4a", ".flac", ".ogg":
+		return checkAudioMagic(file, strings.ToLower(filepath.Ext(path)))
+	}
+	return nil
+}
+
+func checkImage(file *os.File, size int64) error {
+	_, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return fmt.Errorf("unreadable image: %w", err)
+	}
+	tail := make([]byte, min(size, 64))
+	if _, err := file.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return err
+	}
+	complete := true
+	switch format {
+	case "jpeg":
+		// Some cameras append data (e.g. the video of motion photos) after the EOI marker
+		complete = bytes.Contains(tail, []byte{0xFF, 0xD9})
+	case "png":
+		complete = bytes.Contains(tail, []byte("IEND"))
+	case "webp":
+		var header [8]byte
+		if _, err := file.ReadAt(header[:], 0); err != nil {
+			return err
+		}
+		complete = int64(binary.LittleEndian.Uint32(header[4:8]))+8 <= size
+	}
+	if complete {
+		return nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, _, err := image.Decode(file); err != nil {
+		return fmt.Errorf("truncated %s image: %w", format, err)
+	}
+	return nil
+}
+
+func checkWav(file *os.File, size int64) error {
+	info, err := readWavInfo(file)
+	if err != nil {
+		return fmt.Errorf("unreadable wav file: %w", err)
+	}
+	// Streaming writers (e.g. ffmpeg to a pipe) leave the data size unset
+	if info.DataSize != 0 && info.DataSize != 0xFFFFFFFF && info.DataOffset+info.DataSize > size {
+		return fmt.Errorf("truncated wav file: %d of %d bytes of audio data", size-info.DataOffset, info.DataSize)
+	}
+	return nil
+}
+
+func checkAudioMagic(file *os.File, ext string) error {
+	var header [12]byte
+	n, _ := io.ReadFull(file, header[:])
+	h := header[:n]
+	var ok bool
+	switch ext {
+	case ".mp3":
+		ok = bytes.HasPrefix(h, []byte("ID3")) || len(h) >= 2 && h[0] == 0xFF && h[1]&0xE0 == 0xE0
+	case ".m4a":
+		ok = len(h) >= 8 && string(h[4:8]) == "ftyp"
+	case ".flac":
+		ok = bytes.HasPrefix(h, []byte("fLaC"))
+	case ".ogg":
+		ok = bytes.HasPrefix(h, []byte("OggS"))
+	}
+	// A mislabeled audio file (e.g. a wav named .mp3) is not corrupt, it's sent as its actual type
+	if !ok && !strings.HasPrefix(SniffMimeType(h), "audio/") {
+		return fmt.Errorf("not a valid %s file", strings.TrimPrefix(ext, "."))
+	}
+	return nil
+}
+
+// SniffMimeType returns the MIME type of the image or audio data by its magic bytes, as the types used by the API
+// (e.g. "image/png" or "audio/wav"), or "" if it's not a known media type.
+func SniffMimeType(data []byte) string {
+	switch mimeType := http.DetectContentType(data); mimeType {
+	case "image/jpeg", "image/png", "image/webp", "image/gif", "image/bmp":
+		return mimeType
+	case "audio/wave":
+		return "audio/wav"
+	case "audio/mpeg", "audio/aiff":
+		return mimeType
+	case "application/ogg":
+		return "audio/ogg"
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "audio/flac"
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0:
+		return "audio/mpeg" // MP3 without ID3 tag
+	case len(data) >= 12 && string(data[4:8]) == "ftyp" && string(data[8:11]) == "M4A":
+		return "audio/m4a"
+	}
+	return ""
+}
+
+// CheckMimeType returns the actual MIME type of the media data which is labeled as mimeType (e.g. of its file
+// extension), so that mislabeled files (e.g. a PNG named .jpg) are sent as what they are. If the sniffed type
+// is known and differs from mimeType, it's returned with a warning message; otherwise mimeType is returned as is.
+func CheckMimeType(data []byte, mimeType string) (actual string, warning string) {
+	sniffed := SniffMimeType(data)
+	if sniffed == "" || sniffed == mimeType || mimeType == "image/jpg" && sniffed == "image/jpeg" {
+		return mimeType, ""
+	}
+	return sniffed, fmt.Sprintf("content is %s, not %s as labeled; sending it as %s", sniffed, mimeType, sniffed)
+}
+
+// VerifyImageFile fully decodes the image file at path to detect corruption that CheckMediaFile misses,
+// e.g. corrupt JPEG scan data or PNG chunks with CRC errors.
+func VerifyImageFile(path string) error {
+	file, err := os.Open(LongPath(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("zero-byte file")
+	}
+	img, format, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+	if img.Bounds().Empty() {
+		return fmt.Errorf("empty %s image", format)
+	}
+	return nil
+}
+
+// MoveToCorruptDir moves the file at path to the CORRUPT_DIR folder in its dir and returns the new path.
+func MoveToCorruptDir(path string) (string, error) {
+	dir := filepath.Join(filepath.Dir(path), CORRUPT_DIR)
+	if err := os.MkdirAll(LongPath(dir), 0755); err != nil {
+		return "", err
+	}
+	newPath := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(LongPath(path), LongPath(newPath)); err != nil {
+		return "", err
+	}
+	return newPath, nil
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const npyMagic = "\x93NUMPY"
+
+// The "descr" and "shape" of the header dict of a .npy file, e.g. "{'descr': '<f4', 'fortran_order': False, 'shape': (2, 3), }"
+var npyHeaderRegexp = regexp.MustCompile(`'descr':\s*'([^']+)'.*'shape':\s*\(([^)]*)\)`)
+
+// NpyArray is an array of a NumPy .npy file (in a .npz file) of float32 (Float32), int64 (Int64)
+// or unicode string (Strings) elements, in C order.
+type NpyArray struct {
+	Shape   []int
+	Float32 []float32
+	Int64   []int64
+	Strings []string
+}
+
+// WriteNpz writes the arrays to the NumPy .npz file (a zip of .npy files, loadable by numpy.load) at filename
+// atomically.
+func WriteNpz(filename string, arrays map[string]*NpyArray) error {
+	return WriteAtomic(filename, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		for name, array := range arrays {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Deflate})
+			if err != nil {
+				return err
+			}
+			if err := array.write(fw); err != nil {
+				return fmt.Errorf("failed to write array %s: %w", name, err)
+			}
+		}
+		return zw.Close()
+	})
+}
+
+// ReadNpz reads the arrays of the NumPy .npz file at filename, keyed by name (without the ".npy" suffix).
+func ReadNpz(filename string) (map[string]*NpyArray, error) {
+	zr, err := zip.OpenReader(LongPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	arrays := map[string]*NpyArray{}
+	for _, file := range zr.File {
+		if !strings.HasSuffix(file.Name, ".npy") {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		array, err := readNpy(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read array %s: %w", file.Name, err)
+		}
+		arrays[strings.TrimSuffix(file.Name, ".npy")] = array
+	}
+	return arrays, nil
+}
+
+func (a *NpyArray) write(w io.Writer) error {
+	var descr string
+	var data []byte
+	switch {
+	case a.Float32 != nil:
+		descr = "<f4"
+		data = make([]byte, 4*len(a.Float32))
+		for i, v := range a.Float32 {
+			binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+		}
+	case a.Int64 != nil:
+		descr = "<i8"
+		data = make([]byte, 8*len(a.Int64))
+		for i, v := range a.Int64 {
+			binary.LittleEndian.PutUint64(data[8*i:], uint64(v))
+		}
+	default:
+		// Fixed width UTF-32 of the longest string, zero padded
+		width := 1
+		for _, s := range a.Strings {
+			width = max(width, utf8.RuneCountInString(s))
+		}
+		descr = fmt.Sprintf("<U%d", width)
+		data = make([]byte, 4*width*len(a.Strings))
+		for i, s := range a.Strings {
+			j := 0
+			for _, r := range s {
+				binary.LittleEndian.PutUint32(data[4*(i*width+j):], uint32(r))
+				j++
+			}
+		}
+	}
+	var shape []string
+	for _, dim := range a.Shape {
+		shape = append(shape, strconv.Itoa(dim))
+	}
+	shapeStr := strings.Join(shape, ", ")
+	if len(shape) == 1 {
+		shapeStr += ","
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", descr, shapeStr)
+	// The magic, version, header length and header are padded to a multiple of 64 bytes, ending with "\n"
+	padding := 64 - (len(npyMagic)+4+len(header)+1)%64
+	header += strings.Repeat(" ", padding%64) + "\n"
+	var buf bytes.Buffer
+	buf.WriteString(npyMagic)
+	buf.Write([]byte{1, 0})
+	binary.Write(&buf, binary.LittleEndian, uint16(len(header)))
+	buf.WriteString(header)
+	buf.Write(data)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readNpy(r io.Reader) (*NpyArray, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 10 || string(data[:6]) != npyMagic {
+		return nil, fmt.Errorf("not a .npy file")
+	}
+	var headerLen, offset int
+	if data[6] == 1 {
+		headerLen, offset = int(binary.LittleEndian.Uint16(data[8:])), 10
+	} else if len(data) >= 12 {
+		headerLen, offset = int(binary.LittleEndian.Uint32(data[8:])), 12
+	}
+	if offset == 0 || len(data) < offset+headerLen {
+		return nil, fmt.Errorf("invalid .npy header")
+	}
+	header := string(data[offset : offset+headerLen])
+	data = data[offset+headerLen:]
+	m := npyHeaderRegexp.FindStringSubmatch(header)
+	if m == nil || strings.Contains(header, "'fortran_order': True") {
+		return nil, fmt.Errorf("unsupported .npy header %q", header)
+	}
+	array := &NpyArray{}
+	size := 1
+	for _, dim := range strings.Split(m[2], ",") {
+		if dim = strings.TrimSpace(dim); dim == "" {
+			continue
+		}
+		n, err := strconv.Atoi(dim)
+		if err != nil {
+			return nil, fmt.Errorf("invalid .npy shape %q", m[2])
+		}
+		array.Shape = append(array.Shape, n)
+		size *= n
+	}
+	switch descr := m[1]; {
+	case descr == "<f4":
+		if len(data) < 4*size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		array.Float32 = make([]float32, size)
+		for i := range array.Float32 {
+			array.Float32[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		}
+	case descr == "<i8":
+		if len(data) < 8*size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		array.Int64 = make([]int64, size)
+		for i := range array.Int64 {
+			array.Int64[i] = int64(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+	case strings.HasPrefix(descr, "<U"):
+		width, err := strconv.Atoi(descr[2:])
+		if err != nil || len(data) < 4*width*size {
+			return nil, fmt.Errorf("invalid .npy %s data", descr)
+		}
+		array.Strings = make([]string, size)
+		for i := range array.Strings {
+			var sb strings.Builder
+			for j := range width {
+				if r := rune(binary.LittleEndian.Uint32(data[4*(i*width+j):])); r != 0 {
+					sb.WriteRune(r)
+				}
+			}
+			array.Strings[i] = sb.String()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported .npy dtype %q", descr)
+	}
+	return array, nil
+}
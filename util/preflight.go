@@ -0,0 +1,180 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+
+	"github.com/sagan/goaider/constants"
+)
+
+// Gemini tokenizes images into 768x768 tiles of 258 tokens each; small images count as one tile.
+const (
+	imageTileSize   = 768
+	imageTileTokens = 258
+	// Gemini tokenizes audio at 32 tokens per second.
+	audioTokensPerSecond = 32
+	// Gemini samples video at 1 frame per second, 258 tokens per frame plus the audio track.
+	videoTokensPerSecond = imageTileTokens + audioTokensPerSecond
+	// Typical video bitrate (~2 Mbps), used to estimate the duration of videos from the file size.
+	videoBytesPerSecond = 250000
+)
+
+// UsageEstimate is a rough pre-flight estimate of the Gemini API usage of a run.
+type UsageEstimate struct {
+	Files        int
+	Bytes        int64
+	InputTokens  int64 // text / image input tokens
+	AudioTokens  int64 // audio input tokens
+	OutputTokens int64
+	// If > 0, images are downscaled to this longest side before upload
+	ImageMaxSide int
+	// If > 1, the number of files sent in one request
+	BatchSize int
+}
+
+// AddImage adds a request of the image file at path with a text prompt to the estimate.
+func (e *UsageEstimate) AddImage(path string, size int64, promptTokens int64, outputTokens int64) {
+	e.Files++
+	e.Bytes += size
+	e.InputTokens += promptTokens + EstimateImageTokens(path, e.ImageMaxSide)
+	e.OutputTokens += outputTokens
+}
+
+// AddAudio adds a request of the audio file at path with a text prompt to the estimate.
+// The output tokens are estimated from the audio duration.
+func (e *UsageEstimate) AddAudio(path string, size int64, promptTokens int64, outputTokensPerSecond float64) {
+	e.Files++
+	e.Bytes += size
+	seconds := EstimateAudioSeconds(path, size)
+	e.InputTokens += promptTokens
+	e.AudioTokens += int64(seconds * audioTokensPerSecond)
+	e.OutputTokens += int64(seconds * outputTokensPerSecond)
+}
+
+// AddText adds a text-only request of the files of size bytes (e.g. a batch of captions) to the estimate.
+func (e *UsageEstimate) AddText(files int, size int64, inputTokens int64, outputTokens int64) {
+	e.Files += files
+	e.Bytes += size
+	e.InputTokens += inputTokens
+	e.OutputTokens += outputTokens
+}
+
+// AddVideo adds a request of the video file at path with a text prompt to the estimate.
+// The video duration is estimated from the file size.
+func (e *UsageEstimate) AddVideo(size int64, promptTokens int64, outputTokens int64) {
+	e.Files++
+	e.Bytes += size
+	e.InputTokens += promptTokens + int64(float64(size)/videoBytesPerSecond*videoTokensPerSecond)
+	e.OutputTokens += outputTokens
+}
+
+// Cost returns the estimated cost in USD using model's price. ok is false if the price of model is unknown.
+func (e *UsageEstimate) Cost(model string) (cost float64, ok bool) {
+	price, ok := constants.GEMINI_MODEL_PRICES[model]
+	if !ok {
+		return 0, false
+	}
+	cost = (float64(e.InputTokens)*price.Input + float64(e.AudioTokens)*price.AudioInput +
+		float64(e.OutputTokens)*price.Output) / 1e6
+	return cost, true
+}
+
+// Print prints the estimate summary to stdout.
+func (e *UsageEstimate) Print(model string) {
+	fmt.Printf("Pre-flight summary:\n")
+	fmt.Printf("  Files to process: %d (%s)\n", e.Files, FormatBytes(e.Bytes))
+	calls := e.Files
+	if e.BatchSize > 1 {
+		calls = (e.Files + e.BatchSize - 1) / e.BatchSize
+	}
+	fmt.Printf("  API calls: ~%d (excluding retries)\n", calls)
+	fmt.Printf("  Input tokens: ~%d", e.InputTokens+e.AudioTokens)
+	if e.AudioTokens > 0 {
+		fmt.Printf(" (audio: ~%d)", e.AudioTokens)
+	}
+	fmt.Printf("\n")
+	fmt.Printf("  Output tokens: ~%d (excluding thinking)\n", e.OutputTokens)
+	if cost, ok := e.Cost(model); ok {
+		fmt.Printf("  Estimated cost: ~$%.4f (%s paid tier)\n", cost, model)
+	} else {
+		fmt.Printf("  Estimated cost: unknown (no price data for %s)\n", model)
+	}
+}
+
+// EstimateImageTokens returns the Gemini input tokens of the image file at path,
+// calculated from its dimensions (after downscaling to maxSide, if > 0).
+// If the image can not be decoded, one tile is assumed.
+func EstimateImageTokens(path string, maxSide int) int64 {
+	f, err := os.Open(LongPath(path))
+	if err != nil {
+		return imageTileTokens
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return imageTileTokens
+	}
+	width, height := FitSize(config.Width, config.Height, maxSide)
+	if width <= 384 && height <= 384 {
+		return imageTileTokens
+	}
+	tilesX := (width + imageTileSize - 1) / imageTileSize
+	tilesY := (height + imageTileSize - 1) / imageTileSize
+	return int64(tilesX * tilesY * imageTileTokens)
+}
+
+// EstimateAudioSeconds returns the duration of the audio file at path.
+// It's read from the header for wav files; for other formats it's estimated from the file size
+// using a typical bitrate.
+func EstimateAudioSeconds(path string, size int64) float64 {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".wav" {
+		if seconds, err := WavDuration(path); err == nil {
+			return seconds
+		}
+	}
+	bytesPerSecond := 16000.0 // 128 kbps
+	if ext == ".flac" || ext == ".wav" {
+		bytesPerSecond = 100000.0 // ~800 kbps
+	}
+	return float64(size) / bytesPerSecond
+}
+
+// WavDuration returns the duration in seconds of a RIFF WAVE file, read from its "fmt " and "data" chunks.
+func WavDuration(path string) (float64, error) {
+	info, err := ReadWavInfo(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration(), nil
+}
+
+// FormatBytes formats n bytes as a human-readable string, e.g. "1.5 MiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// AskYesNo prints question and reads the answer from stdin. Only "y" or "yes" (case-insensitive) is a yes.
+func AskYesNo(question string) bool {
+	fmt.Printf("%s (y/N): ", question)
+	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	input = strings.ToLower(strings.TrimSpace(input))
+	return input == "y" || input == "yes"
+}
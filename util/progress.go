@@ -0,0 +1,138 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// Progress is a single-line progress bar of a run over files: files done / total, ETA,
+// throughput and error count. It's drawn on stdout, and only if stdout is a terminal;
+// otherwise it's disabled and does nothing, so callers should keep plain logging then.
+type Progress struct {
+	Enabled bool
+	total   int
+	done    int
+	failed  int
+	current string
+	start   time.Time
+	mu      sync.Mutex
+	stop    chan struct{}
+	out     io.Writer
+}
+
+// NewProgress returns a progress bar of total files. It's enabled only if enable is true and stdout is a terminal.
+// The bar is redrawn periodically until Finish is called.
+func NewProgress(total int, enable bool) *Progress {
+	p := &Progress{
+		Enabled: enable && IsTerminal(os.Stdout),
+		total:   total,
+		start:   time.Now(),
+		out:     os.Stdout,
+	}
+	if p.Enabled {
+		p.stop = make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.mu.Lock()
+					p.draw()
+					p.mu.Unlock()
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Start marks name as the file currently being processed.
+func (p *Progress) Start(name string) {
+	if !p.Enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = name
+	p.draw()
+}
+
+// Done marks a file as processed. Skipped files count as done.
+func (p *Progress) Done(failed bool) {
+	if !p.Enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if failed {
+		p.failed++
+	}
+	p.current = ""
+	p.draw()
+}
+
+// Printf prints a message above the progress bar (or as a plain line if the bar is disabled).
+func (p *Progress) Printf(format string, args ...any) {
+	if !p.Enabled {
+		fmt.Printf(format, args...)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.out, "\r\033[K"+format, args...)
+	p.draw()
+}
+
+// Write prints p above the progress bar, so that the bar can be the writer of status messages (e.g. a Log option).
+func (p *Progress) Write(b []byte) (int, error) {
+	p.Printf("%s", b)
+	return len(b), nil
+}
+
+// Finish draws the final state of the bar and ends its line.
+func (p *Progress) Finish() {
+	if !p.Enabled {
+		return
+	}
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = ""
+	p.draw()
+	fmt.Fprintln(p.out)
+}
+
+func (p *Progress) draw() {
+	elapsed := time.Since(p.start)
+	ratio := 1.0
+	if p.total > 0 {
+		ratio = float64(p.done) / float64(p.total)
+	}
+	filled := int(ratio * progressBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	eta := "-"
+	throughput := 0.0
+	if p.done > 0 {
+		throughput = float64(p.done) / elapsed.Seconds()
+		eta = (time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))).Round(time.Second).String()
+	}
+	line := fmt.Sprintf("[%s] %d/%d %.1f%% | %.2f files/s | elapsed %s | ETA %s | errors %d", bar, p.done, p.total,
+		ratio*100, throughput, elapsed.Round(time.Second), eta, p.failed)
+	if p.current != "" {
+		line += " | " + p.current
+	}
+	fmt.Fprintf(p.out, "\r\033[K%s", line)
+}
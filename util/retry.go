@@ -0,0 +1,98 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how Retry repeats a failed operation.
+type RetryPolicy struct {
+	MaxRetries  int           // Max number of retries after the first attempt
+	BaseBackoff time.Duration // Delay before the first retry, doubled for each subsequent retry
+	MaxBackoff  time.Duration // Upper limit of the delay (before jitter). 0 = unlimited
+	// Total wall-clock budget of all attempts and delays. 0 = unlimited.
+	// When exceeded, Retry gives up immediately instead of blocking the pipeline.
+	MaxDuration time.Duration
+}
+
+// ErrRetryBudgetExceeded is returned (wrapped) by Retry if the MaxDuration budget is exceeded.
+var ErrRetryBudgetExceeded = errors.New("retry budget exceeded")
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Retryable marks err as a transient error, so that Retry will retry the operation.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err}
+}
+
+// IsRetryable reports whether err is marked by Retryable.
+func IsRetryable(err error) bool {
+	var re *retryableError
+	return errors.As(err, &re)
+}
+
+// Backoff returns the delay before the retry following attempt (0-based),
+// exponential to attempt with random jitter (0-1000ms) to prevent thundering herd.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.BaseBackoff * (1 << attempt)
+	if p.MaxBackoff > 0 && (backoff > p.MaxBackoff || backoff <= 0) {
+		backoff = p.MaxBackoff
+	}
+	jitter := time.Duration(rand.Intn(1000)) * time.Millisecond
+	return backoff + jitter
+}
+
+// Retry calls op until it succeeds, returns a non-retryable error, or the retries / time budget are exhausted.
+// The ctx passed to op is cancelled when the MaxDuration budget is exceeded.
+// onRetry, if not nil, is called before sleeping for each retry.
+func Retry(ctx context.Context, policy RetryPolicy, op func(ctx context.Context) error,
+	onRetry func(attempt int, err error, delay time.Duration)) error {
+	if policy.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.MaxDuration)
+		defer cancel()
+	}
+	var err error
+	for attempt := 0; attempt <= policy.MaxRetries; attempt++ {
+		err = op(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && policy.MaxDuration > 0 {
+				return fmt.Errorf("%w (%v): %w", ErrRetryBudgetExceeded, policy.MaxDuration, err)
+			}
+			return err
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		if attempt == policy.MaxRetries {
+			break
+		}
+		delay := policy.Backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return fmt.Errorf("%w (%v): %w", ErrRetryBudgetExceeded, policy.MaxDuration, err)
+		}
+		if onRetry != nil {
+			onRetry(attempt, err, delay)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+	return fmt.Errorf("all %d attempts failed. Last error: %w", policy.MaxRetries+1, err)
+}
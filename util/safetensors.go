@@ -0,0 +1,88 @@
+package util
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Max size of the JSON header of a safetensors file. The format limits it to 100MB
+const safetensorsMaxHeaderSize = 100 << 20
+
+// SafetensorsTensor is the header entry of a tensor of a safetensors file.
+type SafetensorsTensor struct {
+	Dtype       string  `json:"dtype"`
+	Shape       []int64 `json:"shape"`
+	DataOffsets []int64 `json:"data_offsets"`
+}
+
+// Params returns the number of parameters (elements) of the tensor.
+func (t *SafetensorsTensor) Params() int64 {
+	n := int64(1)
+	for _, dim := range t.Shape {
+		n *= dim
+	}
+	return n
+}
+
+// SafetensorsHeader is the header of a safetensors file: the metadata ("__metadata__") and the tensors.
+type SafetensorsHeader struct {
+	// The metadata, e.g. the "ss_*" training parameters written by kohya-ss sd-scripts
+	Metadata map[string]string
+	Tensors  map[string]*SafetensorsTensor
+}
+
+// ReadSafetensorsHeader reads the header of the safetensors file at path. The tensor data is not read.
+func ReadSafetensorsHeader(path string) (*SafetensorsHeader, error) {
+	file, err := os.Open(LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var size uint64
+	if err := binary.Read(file, binary.LittleEndian, &size); err != nil {
+		return nil, fmt.Errorf("not a safetensors file: %w", err)
+	}
+	if size < 2 || size > safetensorsMaxHeaderSize {
+		return nil, fmt.Errorf("not a safetensors file: invalid header size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, fmt.Errorf("truncated safetensors header: %w", err)
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid safetensors header: %w", err)
+	}
+	header := &SafetensorsHeader{Metadata: map[string]string{}, Tensors: map[string]*SafetensorsTensor{}}
+	for name, raw := range entries {
+		if name == "__metadata__" {
+			if err := json.Unmarshal(raw, &header.Metadata); err != nil {
+				return nil, fmt.Errorf("invalid safetensors metadata: %w", err)
+			}
+			continue
+		}
+		tensor := &SafetensorsTensor{}
+		if err := json.Unmarshal(raw, tensor); err != nil {
+			return nil, fmt.Errorf("invalid safetensors tensor %q: %w", name, err)
+		}
+		header.Tensors[name] = tensor
+	}
+	return header, nil
+}
+
+// TagFrequency returns the "ss_tag_frequency" metadata (written by kohya-ss sd-scripts):
+// the number of captions having each tag, of each dataset dir. It returns nil if the metadata has none.
+func (h *SafetensorsHeader) TagFrequency() (map[string]map[string]int, error) {
+	value := h.Metadata["ss_tag_frequency"]
+	if value == "" {
+		return nil, nil
+	}
+	var frequency map[string]map[string]int
+	if err := json.Unmarshal([]byte(value), &frequency); err != nil {
+		return nil, fmt.Errorf("invalid ss_tag_frequency metadata: %w", err)
+	}
+	return frequency, nil
+}
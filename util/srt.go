@@ -0,0 +1,78 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subtitle is a timed text cue, e.g. of a SRT file.
+type Subtitle struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// "00:01:02,345 --> 00:01:04,000". "." is also accepted as the millisecond separator.
+var srtTimingRegexp = regexp.MustCompile(
+	`^(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})`)
+
+// ParseSRT parses the content of a SRT subtitle file. Formatting tags in the text are kept as is,
+// multi-line text is joined with spaces.
+func ParseSRT(content string) ([]Subtitle, error) {
+	content = strings.TrimPrefix(content, "\uFEFF")
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	var subtitles []Subtitle
+	for i, block := range regexp.MustCompile(`\n\s*\n`).Split(strings.TrimSpace(content), -1) {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		// The sequence number line is optional in the wild
+		if len(lines) > 0 && !srtTimingRegexp.MatchString(lines[0]) {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		m := srtTimingRegexp.FindStringSubmatch(strings.TrimSpace(lines[0]))
+		if m == nil {
+			return nil, fmt.Errorf("invalid SRT cue #%d: no timing line", i+1)
+		}
+		var texts []string
+		for _, line := range lines[1:] {
+			if line = strings.TrimSpace(line); line != "" {
+				texts = append(texts, line)
+			}
+		}
+		subtitles = append(subtitles, Subtitle{
+			Start: srtTimestamp(m[1:5]),
+			End:   srtTimestamp(m[5:9]),
+			Text:  strings.Join(texts, " "),
+		})
+	}
+	return subtitles, nil
+}
+
+func srtTimestamp(parts []string) time.Duration {
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	s, _ := strconv.Atoi(parts[2])
+	ms, _ := strconv.Atoi((parts[3] + "00")[:3])
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second +
+		time.Duration(ms)*time.Millisecond
+}
+
+// FormatSRT formats subtitles as the content of a SRT file.
+func FormatSRT(subtitles []Subtitle) string {
+	var sb strings.Builder
+	for i, subtitle := range subtitles {
+		fmt.Fprintf(&sb, "%d\n%s --> %s\n%s\n\n", i+1,
+			formatSrtTimestamp(subtitle.Start), formatSrtTimestamp(subtitle.End), subtitle.Text)
+	}
+	return sb.String()
+}
+
+func formatSrtTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+
+	pb "github.com/xxr3376/gtboard/tensorboard_pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// TFImage is an image summary of a TensorBoard event file, e.g. a sample grid logged during training.
+type TFImage struct {
+	Tag      string
+	Step     int64
+	WallTime float64
+	// 0-based index of the image in a summary of multiple images (the "images" plugin)
+	Index int
+	// Encoded image, usually PNG
+	Data []byte
+}
+
+// TFHistogram is a histogram summary of a TensorBoard event file, e.g. of the weights of a layer.
+type TFHistogram struct {
+	Tag      string
+	Step     int64
+	WallTime float64
+	Buckets  []TFHistogramBucket
+}
+
+// TFHistogramBucket is a bucket of values in [Left, Right) of a histogram.
+type TFHistogramBucket struct {
+	Left  float64
+	Right float64
+	Count float64
+}
+
+// ReadTFEventSummaries reads the image and histogram summaries of the TensorBoard event file at path,
+// calling onImage / onHistogram (if not nil) for each one in file order, so that large files are not loaded
+// into memory. Both the legacy summary values and the tensors of the "images" / "histograms" plugins are supported.
+func ReadTFEventSummaries(path string, onImage func(*TFImage) error, onHistogram func(*TFHistogram) error) error {
+	file, err := os.Open(LongPath(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var event pb.Event
+	for {
+		data, err := readTFRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// A truncated last record is normal for the event file of a running training
+				return nil
+			}
+			return fmt.Errorf("failed to read event record: %w", err)
+		}
+		event.Reset()
+		if err := proto.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("failed to parse event: %w", err)
+		}
+		summary := event.GetSummary()
+		if summary == nil {
+			continue
+		}
+		for _, v := range summary.Value {
+			var plugin string
+			if v.Metadata != nil && v.Metadata.PluginData != nil {
+				plugin = v.Metadata.PluginData.PluginName
+			}
+			switch value := v.Value.(type) {
+			case *pb.Summary_Value_Image:
+				if onImage != nil && value.Image != nil {
+					err = onImage(&TFImage{Tag: v.Tag, Step: event.Step, WallTime: event.WallTime,
+						Data: value.Image.EncodedImageString})
+				}
+			case *pb.Summary_Value_Histo:
+				if onHistogram != nil && value.Histo != nil {
+					err = onHistogram(&TFHistogram{Tag: v.Tag, Step: event.Step, WallTime: event.WallTime,
+						Buckets: legacyHistogramBuckets(value.Histo)})
+				}
+			case *pb.Summary_Value_Tensor:
+				switch {
+				case plugin == "images" && onImage != nil:
+					// string_val: width, height, then the encoded images
+					for i, data := range value.Tensor.GetStringVal() {
+						if i < 2 {
+							continue
+						}
+						if err = onImage(&TFImage{Tag: v.Tag, Step: event.Step, WallTime: event.WallTime,
+							Index: i - 2, Data: data}); err != nil {
+							break
+						}
+					}
+				case plugin == "histograms" && onHistogram != nil:
+					var buckets []TFHistogramBucket
+					if buckets, err = tensorHistogramBuckets(value.Tensor); err == nil {
+						err = onHistogram(&TFHistogram{Tag: v.Tag, Step: event.Step, WallTime: event.WallTime,
+							Buckets: buckets})
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// readTFRecord reads a record of the TFRecord format: uint64 length, uint32 masked CRC32-C of the length,
+// data, uint32 masked CRC32-C of the data. It returns io.EOF at the end of r.
+func readTFRecord(r io.Reader) ([]byte, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if maskedCRC(header[:8]) != binary.LittleEndian.Uint32(header[8:]) {
+		return nil, fmt.Errorf("record length checksum mismatch")
+	}
+	data := make([]byte, binary.LittleEndian.Uint64(header[:8])+4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	data, checksum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if maskedCRC(data) != checksum {
+		return nil, fmt.Errorf("record data checksum mismatch")
+	}
+	return data, nil
+}
+
+func maskedCRC(data []byte) uint32 {
+	crc := crc32.Checksum(data, crc32c)
+	return (crc>>15 | crc<<17) + 0xa282ead8
+}
+
+// legacyHistogramBuckets returns the buckets of a HistogramProto, whose buckets are given by their right edges.
+func legacyHistogramBuckets(h *pb.HistogramProto) []TFHistogramBucket {
+	buckets := make([]TFHistogramBucket, 0, len(h.Bucket))
+	left := h.Min
+	for i := 0; i < len(h.Bucket) && i < len(h.BucketLimit); i++ {
+		// The last bucket limit is usually DBL_MAX
+		right := min(h.BucketLimit[i], h.Max)
+		buckets = append(buckets, TFHistogramBucket{Left: left, Right: right, Count: h.Bucket[i]})
+		left = right
+	}
+	return buckets
+}
+
+// tensorHistogramBuckets returns the buckets of a "histograms" plugin tensor of shape [k, 3] (left, right, count).
+func tensorHistogramBuckets(t *pb.TensorProto) ([]TFHistogramBucket, error) {
+	var values []float64
+	switch t.Dtype {
+	case pb.DataType_DT_DOUBLE:
+		values = t.DoubleVal
+		if len(values) == 0 {
+			for i := 0; i+8 <= len(t.TensorContent); i += 8 {
+				values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(t.TensorContent[i:])))
+			}
+		}
+	case pb.DataType_DT_FLOAT:
+		for _, v := range t.FloatVal {
+			values = append(values, float64(v))
+		}
+		if len(values) == 0 {
+			for i := 0; i+4 <= len(t.TensorContent); i += 4 {
+				values = append(values, float64(math.Float32frombits(binary.LittleEndian.Uint32(t.TensorContent[i:]))))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported histogram tensor dtype %v", t.Dtype)
+	}
+	if len(values)%3 != 0 {
+		return nil, fmt.Errorf("invalid histogram tensor of %d values", len(values))
+	}
+	buckets := make([]TFHistogramBucket, 0, len(values)/3)
+	for i := 0; i < len(values); i += 3 {
+		buckets = append(buckets, TFHistogramBucket{Left: values[i], Right: values[i+1], Count: values[i+2]})
+	}
+	return buckets, nil
+}
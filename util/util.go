@@ -1,14 +1,24 @@
 package util
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/xxr3376/gtboard/pkg/ingest"
 )
@@ -22,65 +32,111 @@ func ToJson(v any) string {
 	return string(b)
 }
 
-// PrintScalarsTable prints a table of scalar data to stdout.
-func PrintScalarsTable(scalars map[string]*ingest.ScalarEvents) {
-	// Get all tags and sort them alphabetically.
-	tags := make([]string, 0, len(scalars))
+// IsTerminal reports whether f is an interactive terminal (character device).
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// scalarTable is the table of the scalars of all tags, with a row per step and a column per tag.
+type scalarTable struct {
+	tags  []string // sorted
+	steps []int64  // sorted union of the steps of all tags
+	// step => index of the value in the events of each tag (of tags)
+	index  []map[int64]int
+	events []*ingest.ScalarEvents
+}
+
+// newScalarTable indexes the steps of scalars once, so that each cell is looked up in O(1)
+// instead of scanning the steps of the tag.
+func newScalarTable(scalars map[string]*ingest.ScalarEvents) *scalarTable {
+	table := &scalarTable{tags: make([]string, 0, len(scalars))}
 	for tag := range scalars {
-		tags = append(tags, tag)
+		table.tags = append(table.tags, tag)
 	}
-	sort.Strings(tags)
+	sort.Strings(table.tags)
 
-	// Get all steps and sort them numerically.
-	steps := make(map[int64]bool)
-	for _, scalarEvents := range scalars {
-		for _, step := range scalarEvents.Step {
-			steps[step] = true
+	allSteps := make(map[int64]struct{})
+	for _, tag := range table.tags {
+		scalarEvents := scalars[tag]
+		index := make(map[int64]int, len(scalarEvents.Step))
+		for i, step := range scalarEvents.Step {
+			// Keep the first value of duplicate steps
+			if _, ok := index[step]; !ok {
+				index[step] = i
+			}
+			allSteps[step] = struct{}{}
 		}
+		table.index = append(table.index, index)
+		table.events = append(table.events, scalarEvents)
 	}
-	sortedSteps := make([]int64, 0, len(steps))
-	for step := range steps {
-		sortedSteps = append(sortedSteps, step)
+	table.steps = make([]int64, 0, len(allSteps))
+	for step := range allSteps {
+		table.steps = append(table.steps, step)
+	}
+	slices.Sort(table.steps)
+	return table
+}
+
+// forEachRow calls fn for each step in ascending order with the values of the tags at that step.
+// found[i] is false if tag i has no value at the step. values and found are reused between calls,
+// so rows are streamed without building the whole table in memory.
+func (t *scalarTable) forEachRow(fn func(step int64, values []float64, found []bool) error) error {
+	values := make([]float64, len(t.tags))
+	found := make([]bool, len(t.tags))
+	for _, step := range t.steps {
+		for i, index := range t.index {
+			var j int
+			j, found[i] = index[step]
+			if found[i] {
+				values[i] = float64(t.events[i].Value[j])
+			}
+		}
+		if err := fn(step, values, found); err != nil {
+			return err
+		}
 	}
-	sort.Slice(sortedSteps, func(i, j int) bool { return sortedSteps[i] < sortedSteps[j] })
+	return nil
+}
+
+// PrintScalarsTable prints a table of scalar data to stdout.
+func PrintScalarsTable(scalars map[string]*ingest.ScalarEvents) {
+	table := newScalarTable(scalars)
+	tags := table.tags
 
 	// Print header.
-	fmt.Printf("% -10s", "Step")
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	fmt.Fprintf(out, "% -10s", "Step")
 	for _, tag := range tags {
-		fmt.Printf("% -20s", tag)
+		fmt.Fprintf(out, "% -20s", tag)
 	}
-	fmt.Printf("\n")
+	fmt.Fprintf(out, "\n")
 
 	// Print data.
-	for _, step := range sortedSteps {
-		fmt.Printf("% -10d", step)
-		for _, tag := range tags {
-			found := false
-			if scalarEvents, ok := scalars[tag]; ok {
-				for i, s := range scalarEvents.Step {
-					if s == step {
-						value := scalarEvents.Value[i]
-						// Handle NaN values
-						if math.IsNaN(float64(value)) {
-							fmt.Printf("% -20s", "NaN")
-						} else {
-							fmt.Printf("% -20f", value)
-						}
-						found = true
-						break
-					}
-				}
-			}
-			if !found {
-				fmt.Printf("% -20s", "")
+	table.forEachRow(func(step int64, values []float64, found []bool) error {
+		fmt.Fprintf(out, "% -10d", step)
+		for i, value := range values {
+			switch {
+			case !found[i]:
+				fmt.Fprintf(out, "% -20s", "")
+			case math.IsNaN(value):
+				// Handle NaN values
+				fmt.Fprintf(out, "% -20s", "NaN")
+			default:
+				fmt.Fprintf(out, "% -20f", value)
 			}
 		}
-		fmt.Printf("\n")
-	}
+		fmt.Fprintf(out, "\n")
+		return nil
+	})
 
 	// Print lowest point for each tag
-	fmt.Printf("\n")
-	fmt.Printf("Lowest points for each tag:\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Lowest points for each tag:\n")
 	for _, tag := range tags {
 		if scalarEvents, ok := scalars[tag]; ok && len(scalarEvents.Value) > 0 {
 			minVal := float64(scalarEvents.Value[0])
@@ -92,80 +148,252 @@ func PrintScalarsTable(scalars map[string]*ingest.ScalarEvents) {
 					minStep = scalarEvents.Step[i]
 				}
 			}
-			fmt.Printf("% -20s: Value = % -15f, Step = %d\n", tag, minVal, minStep)
+			fmt.Fprintf(out, "% -20s: Value = % -15f, Step = %d\n", tag, minVal, minStep)
 		} else {
-			fmt.Printf("% -20s: No data or empty\n", tag)
+			fmt.Fprintf(out, "% -20s: No data or empty\n", tag)
 		}
 	}
 }
 
-// SaveScalarsToCSV saves the scalar data to a CSV file.
-func SaveScalarsToCSV(scalars map[string]*ingest.ScalarEvents, filename string) error {
+// CSVOptions are the format options of the CSV files of scalars. A nil *CSVOptions uses the defaults:
+// comma delimiter, full precision, no gzip.
+type CSVOptions struct {
+	Delimiter rune // default ','
+	// Number of digits after the decimal point. -1 = the minimum number of digits to represent the value exactly
+	Precision  int
+	Scientific bool // use scientific notation, e.g. "1.5e-04"
+	Gzip       bool // gzip compress the file
+}
+
+// FormatFloat formats a value of bitSize (32 or 64) bits according to the options.
+func (o *CSVOptions) FormatFloat(value float64, bitSize int) string {
+	if math.IsNaN(value) {
+		return "NaN"
+	}
+	if o == nil {
+		return strconv.FormatFloat(value, 'f', -1, bitSize)
+	}
+	format := byte('f')
+	if o.Scientific {
+		format = 'e'
+	}
+	return strconv.FormatFloat(value, format, o.Precision, bitSize)
+}
+
+// CreateCSV creates the CSV file according to the options. The returned close func flushes the writer
+// and closes the file, and must be called to complete the file.
+func (o *CSVOptions) CreateCSV(filename string) (writer *csv.Writer, close func() error, err error) {
 	file, err := os.Create(filename)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	var w io.Writer = file
+	var zw *gzip.Writer
+	if o != nil && o.Gzip {
+		zw = gzip.NewWriter(file)
+		w = zw
+	}
+	writer = csv.NewWriter(w)
+	if o != nil && o.Delimiter != 0 {
+		writer.Comma = o.Delimiter
+	}
+	close = func() error {
+		writer.Flush()
+		err := writer.Error()
+		if zw != nil {
+			err = errors.Join(err, zw.Close())
+		}
+		return errors.Join(err, file.Close())
+	}
+	return writer, close, nil
+}
 
-	// Get all tags and sort them alphabetically.
-	tags := make([]string, 0, len(scalars))
-	for tag := range scalars {
-		tags = append(tags, tag)
+// SaveScalarsToCSV saves the scalar data to a CSV file. opts may be nil.
+func SaveScalarsToCSV(scalars map[string]*ingest.ScalarEvents, filename string, opts *CSVOptions) (err error) {
+	writer, closeCSV, err := opts.CreateCSV(filename)
+	if err != nil {
+		return err
 	}
-	sort.Strings(tags)
+	defer func() {
+		if closeErr := closeCSV(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	table := newScalarTable(scalars)
 
 	// Write header.
 	header := []string{"Step"}
-	header = append(header, tags...)
+	header = append(header, table.tags...)
 	err = writer.Write(header)
 	if err != nil {
 		return err
 	}
 
-	// Get all steps and sort them numerically.
-	steps := make(map[int64]bool)
-	for _, scalarEvents := range scalars {
-		for _, step := range scalarEvents.Step {
-			steps[step] = true
+	// Write data.
+	row := make([]string, 0, len(header))
+	return table.forEachRow(func(step int64, values []float64, found []bool) error {
+		row = append(row[:0], strconv.FormatInt(step, 10))
+		for i, value := range values {
+			if found[i] {
+				row = append(row, opts.FormatFloat(value, 32))
+			} else {
+				row = append(row, "")
+			}
 		}
+		return writer.Write(row)
+	})
+}
+
+// ReadListFile reads a list file, returning its lines with leading and trailing spaces trimmed.
+// Empty lines and comment lines (starting with "#") are skipped.
+func ReadListFile(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	sortedSteps := make([]int64, 0, len(steps))
-	for step := range steps {
-		sortedSteps = append(sortedSteps, step)
+	var items []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			items = append(items, line)
+		}
 	}
-	sort.Slice(sortedSteps, func(i, j int) bool { return sortedSteps[i] < sortedSteps[j] })
+	return items, nil
+}
 
-	// Write data.
-	for _, step := range sortedSteps {
-		row := []string{strconv.FormatInt(step, 10)}
-		for _, tag := range tags {
-			found := false
-			if scalarEvents, ok := scalars[tag]; ok {
-				for i, s := range scalarEvents.Step {
-					if s == step {
-						value := scalarEvents.Value[i]
-						if math.IsNaN(float64(value)) {
-							row = append(row, "NaN")
-						} else {
-							row = append(row, strconv.FormatFloat(float64(value), 'f', -1, 32))
-						}
-						found = true
-						break
-					}
-				}
-			}
-			if !found {
-				row = append(row, "")
+// UTF8_BOM is the UTF-8 byte order mark, expected at the start of text files by some Windows tools.
+const UTF8_BOM = "\ufeff"
+
+// WriteTextFile writes text to the file at filename, prefixed with the UTF-8 BOM if bom is true.
+func WriteTextFile(filename string, text string, bom bool) error {
+	if bom {
+		text = UTF8_BOM + text
+	}
+	return WriteFileAtomic(filename, []byte(text))
+}
+
+// ParseOutputExt parses the file extension of an --output-ext flag, e.g. "caption" or ".tags".
+// "" returns the default ext. Extensions of the other sidecar files (e.g. ".json") are not allowed.
+func ParseOutputExt(ext string, defaultExt string, reserved ...string) (string, error) {
+	ext = strings.TrimSpace(ext)
+	if ext == "" {
+		return defaultExt, nil
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if len(ext) == 1 || strings.ContainsAny(ext, `/\`) {
+		return "", fmt.Errorf("invalid output ext %q", ext)
+	}
+	for _, r := range reserved {
+		if strings.EqualFold(ext, r) {
+			return "", fmt.Errorf("output ext %q is reserved for the %s sidecar files", ext, r)
+		}
+	}
+	return ext, nil
+}
+
+// OutputUpToDate reports whether the output file generated from source exists and is not empty,
+// so processing of source can be skipped. If changedOnly is true, the output must also be not older than
+// source (by mtime).
+func OutputUpToDate(source string, output string, changedOnly bool) bool {
+	outputInfo, err := os.Stat(LongPath(output))
+	if err != nil || outputInfo.Size() == 0 {
+		return false
+	}
+	if !changedOnly {
+		return true
+	}
+	sourceInfo, err := os.Stat(LongPath(source))
+	if err != nil {
+		return true
+	}
+	return !sourceInfo.ModTime().After(outputInfo.ModTime())
+}
+
+// InputFile is a file to process: an entry of the scanned dir, or a file given as a command line argument.
+type InputFile struct {
+	fs.DirEntry
+	Path string
+}
+
+// ListInputFiles returns the files of args if any is given, otherwise all entries of dir.
+func ListInputFiles(dir string, args []string) ([]InputFile, error) {
+	var files []InputFile
+	if len(args) == 0 {
+		entries, err := os.ReadDir(LongPath(dir))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory %q: %w", dir, err)
+		}
+		for _, entry := range entries {
+			files = append(files, InputFile{DirEntry: entry, Path: filepath.Join(dir, entry.Name())})
+		}
+		return files, nil
+	}
+	return listArgFiles(args)
+}
+
+// ListInputFilesRecursive is like ListInputFiles, but lists the files of dir and all its subdirs
+// (except hidden ones, e.g. ".goaider", and CORRUPT_DIR). Subdirs themselves are not returned.
+func ListInputFilesRecursive(dir string, args []string) ([]InputFile, error) {
+	if len(args) > 0 {
+		return listArgFiles(args)
+	}
+	var files []InputFile
+	err := filepath.WalkDir(LongPath(dir), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != LongPath(dir) && (strings.HasPrefix(entry.Name(), ".") || entry.Name() == CORRUPT_DIR) {
+				return filepath.SkipDir
 			}
+			return nil
 		}
-		err := writer.Write(row)
+		rel, err := filepath.Rel(LongPath(dir), path)
 		if err != nil {
 			return err
 		}
+		files = append(files, InputFile{DirEntry: entry, Path: filepath.Join(dir, rel)})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %q: %w", dir, err)
 	}
+	return files, nil
+}
 
+// listArgFiles returns the files of command line args.
+func listArgFiles(args []string) ([]InputFile, error) {
+	var files []InputFile
+	for _, arg := range args {
+		info, err := os.Stat(LongPath(arg))
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("%q is a directory, use --dir flag instead", arg)
+		}
+		files = append(files, InputFile{DirEntry: fs.FileInfoToDirEntry(info), Path: arg})
+	}
+	return files, nil
+}
+
+// OpenFile opens the file at path with the default application of the OS, without waiting for it.
+func OpenFile(path string) error {
+	var c *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		c = exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	case "darwin":
+		c = exec.Command("open", path)
+	default:
+		c = exec.Command("xdg-open", path)
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	go c.Wait()
 	return nil
 }
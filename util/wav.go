@@ -0,0 +1,298 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+// Limits of the header of a wav file, so that a corrupt or malicious header is rejected, not followed:
+// the size of the "fmt " chunk (at most 40 bytes in practice), and the number of chunks before "data".
+const (
+	maxWavFmtChunkSize = 1024
+	maxWavChunks       = 256
+)
+
+// WavInfo is the format and data location of a RIFF WAVE file.
+type WavInfo struct {
+	AudioFormat   uint16 // 1 = PCM, 3 = IEEE float, 0xFFFE = extensible
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16 // bytes per sample frame (all channels)
+	BitsPerSample uint16
+	DataOffset    int64 // offset of the sample data in the file
+	DataSize      int64 // size of the sample data
+	// Raw "fmt " chunk content, written as is to derived files
+	FmtChunk []byte
+}
+
+// ReadWavInfo reads the header ("fmt " and "data" chunks) of the RIFF WAVE file at path.
+func ReadWavInfo(path string) (*WavInfo, error) {
+	f, err := os.Open(LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readWavInfo(f)
+}
+
+// readWavInfo reads the header of the wav file f. The chunk sizes are untrusted: a chunk must fit in the file,
+// and the chunks other than "fmt " are skipped without reading them.
+func readWavInfo(f io.ReadSeeker) (*WavInfo, error) {
+	fileSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var header [12]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a wav file")
+	}
+	info := &WavInfo{}
+	offset := int64(12)
+	for range maxWavChunks {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		var chunk [8]byte
+		if _, err := io.ReadFull(f, chunk[:]); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("invalid wav file: no data chunk")
+			}
+			return nil, err
+		}
+		offset += 8
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch id {
+		case "fmt ":
+			if size < 16 || size > maxWavFmtChunkSize || size > fileSize-offset {
+				return nil, fmt.Errorf("invalid fmt chunk of %d bytes", size)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(f, data); err != nil {
+				return nil, err
+			}
+			info.FmtChunk = data
+			info.AudioFormat = binary.LittleEndian.Uint16(data[0:2])
+			info.Channels = binary.LittleEndian.Uint16(data[2:4])
+			info.SampleRate = binary.LittleEndian.Uint32(data[4:8])
+			info.ByteRate = binary.LittleEndian.Uint32(data[8:12])
+			info.BlockAlign = binary.LittleEndian.Uint16(data[12:14])
+			info.BitsPerSample = binary.LittleEndian.Uint16(data[14:16])
+			offset += size + size%2
+		case "data":
+			if info.FmtChunk == nil || info.ByteRate == 0 || info.BlockAlign == 0 {
+				return nil, fmt.Errorf("invalid wav file: no valid fmt chunk before data")
+			}
+			info.DataOffset = offset
+			info.DataSize = size
+			return info, nil
+		default:
+			offset += size + size%2
+		}
+	}
+	return nil, fmt.Errorf("invalid wav file: no data chunk in the first %d chunks", maxWavChunks)
+}
+
+// Duration returns the duration of the audio in seconds.
+func (w *WavInfo) Duration() float64 {
+	return float64(w.DataSize) / float64(w.ByteRate)
+}
+
+// FrameOffset returns the byte offset (relative to the data start) of the sample frame at seconds,
+// clamped to the data.
+func (w *WavInfo) FrameOffset(seconds float64) int64 {
+	frame := int64(seconds*float64(w.SampleRate) + 0.5)
+	offset := frame * int64(w.BlockAlign)
+	offset = max(0, min(offset, w.DataSize-w.DataSize%int64(w.BlockAlign)))
+	return offset
+}
+
+// WriteWav writes a RIFF WAVE file to path with the format chunk fmtChunk and the sample data.
+func WriteWav(path string, fmtChunk []byte, data []byte) error {
+	f, err := os.Create(LongPath(path))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	WriteWavHeader(w, fmtChunk, int64(len(data)))
+	w.Write(data)
+	if len(data)%2 == 1 {
+		w.WriteByte(0)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteWavHeader writes the header of a RIFF WAVE file with the format chunk fmtChunk,
+// up to the start of the sample data of dataSize bytes, which the caller writes next (plus a pad byte if odd).
+func WriteWavHeader(w io.Writer, fmtChunk []byte, dataSize int64) error {
+	fmtSize := len(fmtChunk) + len(fmtChunk)%2
+	var header [12]byte
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(int64(4+8+fmtSize+8)+dataSize+dataSize%2))
+	copy(header[8:12], "WAVE")
+	buf := append(header[:], "fmt "...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(fmtChunk)))
+	buf = append(buf, fmtChunk...)
+	if len(fmtChunk)%2 == 1 {
+		buf = append(buf, 0)
+	}
+	buf = append(buf, "data"...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(dataSize))
+	_, err := w.Write(buf)
+	return err
+}
+
+// PCMFmtChunk returns the format chunk of PCM audio of channels channels of bitsPerSample bits at sampleRate.
+func PCMFmtChunk(channels uint16, sampleRate uint32, bitsPerSample uint16) []byte {
+	blockAlign := channels * bitsPerSample / 8
+	chunk := binary.LittleEndian.AppendUint16(nil, WAV_FORMAT_PCM)
+	chunk = binary.LittleEndian.AppendUint16(chunk, channels)
+	chunk = binary.LittleEndian.AppendUint32(chunk, sampleRate)
+	chunk = binary.LittleEndian.AppendUint32(chunk, sampleRate*uint32(blockAlign))
+	chunk = binary.LittleEndian.AppendUint16(chunk, blockAlign)
+	return binary.LittleEndian.AppendUint16(chunk, bitsPerSample)
+}
+
+// FmtChunkOf returns the format chunk of the same sample rate and format as w,
+// with channels channels of bitsPerSample bits. If pcm is true, the format is PCM.
+func (w *WavInfo) FmtChunkOf(channels uint16, bitsPerSample uint16, pcm bool) []byte {
+	chunk := slices.Clone(w.FmtChunk)
+	blockAlign := channels * bitsPerSample / 8
+	if pcm || w.AudioFormat == WAV_FORMAT_EXTENSIBLE {
+		// Plain format chunk, without the extensible channel mask of the original channels
+		chunk = chunk[:16]
+		format := w.Format()
+		if pcm {
+			format = WAV_FORMAT_PCM
+		}
+		binary.LittleEndian.PutUint16(chunk[0:2], format)
+	}
+	binary.LittleEndian.PutUint16(chunk[2:4], channels)
+	binary.LittleEndian.PutUint32(chunk[8:12], w.SampleRate*uint32(blockAlign))
+	binary.LittleEndian.PutUint16(chunk[12:14], blockAlign)
+	binary.LittleEndian.PutUint16(chunk[14:16], bitsPerSample)
+	return chunk
+}
+
+// ReadWavSegment reads the sample data of the wav file at path between start and end seconds.
+func ReadWavSegment(path string, info *WavInfo, start, end float64) ([]byte, error) {
+	f, err := os.Open(LongPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	from, to := info.FrameOffset(start), info.FrameOffset(end)
+	// The data size of the header may exceed the file (truncated or streamed files)
+	to = min(to, stat.Size()-info.DataOffset)
+	if to <= from {
+		return nil, fmt.Errorf("empty segment %.3f-%.3f", start, end)
+	}
+	data := make([]byte, to-from)
+	if _, err := f.ReadAt(data, info.DataOffset+from); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WAVE audio formats
+const (
+	WAV_FORMAT_PCM        = 1
+	WAV_FORMAT_FLOAT      = 3
+	WAV_FORMAT_EXTENSIBLE = 0xFFFE
+)
+
+// Format returns the audio format of the samples, resolving the sub format of WAVE_FORMAT_EXTENSIBLE.
+func (w *WavInfo) Format() uint16 {
+	if w.AudioFormat == WAV_FORMAT_EXTENSIBLE && len(w.FmtChunk) >= 26 {
+		return binary.LittleEndian.Uint16(w.FmtChunk[24:26])
+	}
+	return w.AudioFormat
+}
+
+// FormatName returns the human readable sample format, e.g. "16-bit PCM".
+func (w *WavInfo) FormatName() string {
+	switch w.Format() {
+	case WAV_FORMAT_PCM:
+		return fmt.Sprintf("%d-bit PCM", w.BitsPerSample)
+	case WAV_FORMAT_FLOAT:
+		return fmt.Sprintf("%d-bit float", w.BitsPerSample)
+	default:
+		return fmt.Sprintf("%d-bit format %#x", w.BitsPerSample, w.Format())
+	}
+}
+
+// SampleDecoder returns a function that decodes a single sample (BitsPerSample / 8 bytes)
+// to a value in [-1, 1]. Only PCM (8 / 16 / 24 / 32 bit) and float (32 / 64 bit) samples are supported.
+func (w *WavInfo) SampleDecoder() (func(b []byte) float64, error) {
+	switch format, bits := w.Format(), w.BitsPerSample; {
+	case format == WAV_FORMAT_PCM && bits == 8:
+		// 8-bit samples are unsigned
+		return func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }, nil
+	case format == WAV_FORMAT_PCM && bits == 16:
+		return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }, nil
+	case format == WAV_FORMAT_PCM && bits == 24:
+		return func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}, nil
+	case format == WAV_FORMAT_PCM && bits == 32:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }, nil
+	case format == WAV_FORMAT_FLOAT && bits == 32:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }, nil
+	case format == WAV_FORMAT_FLOAT && bits == 64:
+		return func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported wav sample format: %s", w.FormatName())
+	}
+}
+
+// ReadWavMono reads all samples of the wav file at path, downmixed to mono (the average of the channels),
+// as values in [-1, 1].
+func ReadWavMono(path string) ([]float64, *WavInfo, error) {
+	info, err := ReadWavInfo(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	decode, err := info.SampleDecoder()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ReadWavSegment(path, info, 0, info.Duration())
+	if err != nil {
+		return nil, nil, err
+	}
+	sampleSize := int(info.BitsPerSample / 8)
+	channels := int(info.Channels)
+	blockAlign := int(info.BlockAlign)
+	if channels == 0 || blockAlign < channels*sampleSize {
+		return nil, nil, fmt.Errorf("invalid wav format: %d channels, block align %d", channels, blockAlign)
+	}
+	samples := make([]float64, 0, len(data)/blockAlign)
+	for offset := 0; offset+blockAlign <= len(data); offset += blockAlign {
+		var sum float64
+		for ch := range channels {
+			sum += decode(data[offset+ch*sampleSize : offset+(ch+1)*sampleSize])
+		}
+		samples = append(samples, sum/float64(channels))
+	}
+	return samples, info, nil
+}